@@ -0,0 +1,222 @@
+package balancer
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/logging"
+)
+
+const (
+	ACCESS_LOG_SINK_SYSLOG   = "syslog"
+	ACCESS_LOG_SINK_JOURNALD = "journald"
+	// MSGID of syslog
+	ACCESS_LOG_MSGID = "access"
+)
+
+// accessSink sends an access log line at a syslog severity
+type accessSink func(severity int, line string, fields map[string]string) error
+
+var (
+	access_sinks_lock sync.Mutex
+	// the sinks are shared by the virtual servers, and kept on reload
+	accessSinks = make(map[config.AccessLogSink]accessSink)
+)
+
+// sharedAccessSink returns the sink of c, connected on the first use
+func sharedAccessSink(c config.AccessLogSink) (accessSink, error) {
+	if c.Tag == "" {
+		c.Tag = logging.IDENTIFIER
+	}
+	access_sinks_lock.Lock()
+	defer access_sinks_lock.Unlock()
+	if sink, ok := accessSinks[c]; ok {
+		return sink, nil
+	}
+	var sink accessSink
+	switch c.Type {
+	case ACCESS_LOG_SINK_SYSLOG:
+		s, err := logging.DialSyslog(c.Address, c.Facility, c.Tag)
+		if err != nil {
+			return nil, err
+		}
+		sink = func(severity int, line string, fields map[string]string) error {
+			return s.Send(severity, ACCESS_LOG_MSGID, line, fields)
+		}
+	case ACCESS_LOG_SINK_JOURNALD:
+		j, err := logging.DialJournal()
+		if err != nil {
+			return nil, err
+		}
+		sink = func(severity int, line string, fields map[string]string) error {
+			return j.Send(severity, c.Tag, line, fields)
+		}
+	default:
+		return nil, ErrAccessLogSink
+	}
+	accessSinks[c] = sink
+	return sink, nil
+}
+
+// accessLog decides which requests are written to the access log
+type accessLog struct {
+	// status class -> percent of the requests logged
+	sample     map[string]float64
+	every      uint64
+	errorsOnly bool
+	slowerThan time.Duration
+	// template of the lines, empty means the default line
+	format string
+}
+
+// AccessLogOpt filters the access log lines by c, and sends them to its sink, see config.AccessLog
+func AccessLogOpt(c config.AccessLog) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.Sink.Type != "" {
+			sink, err := sharedAccessSink(c.Sink)
+			if err != nil {
+				return err
+			}
+			vs.accessSink = sink
+			vs.accessSinkConfig = c.Sink
+		}
+		return vs.setAccessLog(c)
+	}
+}
+
+// statusClass returns "2xx" for 200
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+func (s *VirtualServer) setAccessLog(c config.AccessLog) error {
+	if c.Every < 0 || c.SlowerThan < 0 {
+		return ErrNegativeAccessLog
+	}
+	al := &accessLog{
+		sample:     make(map[string]float64, len(c.Sample)),
+		every:      uint64(c.Every),
+		errorsOnly: c.ErrorsOnly,
+		slowerThan: time.Duration(c.SlowerThan) * time.Millisecond,
+		format:     c.Format,
+	}
+	for class, percent := range c.Sample {
+		class = strings.ToLower(class)
+		if len(class) != 3 || class[0] < '1' || class[0] > '5' || class[1:] != "xx" {
+			return ErrStatusClass
+		}
+		if percent < 0 || percent > 100 {
+			return ErrSamplePercent
+		}
+		al.sample[class] = percent
+	}
+	s.accessLog.Store(al)
+	return nil
+}
+
+// SetAccessLog replaces the filters of the access log of s, and of its rules, canary and mirror,
+// the sink is kept
+func (s *VirtualServer) SetAccessLog(c config.AccessLog) error {
+	if err := s.setAccessLog(c); err != nil {
+		return err
+	}
+	for _, ru := range s.rules {
+		ru.vs.setAccessLog(c)
+	}
+	if s.canary != nil {
+		s.canary.vs.setAccessLog(c)
+	}
+	if s.mirror != nil {
+		s.mirror.vs.setAccessLog(c)
+	}
+	return nil
+}
+
+// AccessLog returns the filters of the access log
+func (s *VirtualServer) AccessLog() config.AccessLog {
+	al, _ := s.accessLog.Load().(*accessLog)
+	if al == nil {
+		return config.AccessLog{}
+	}
+	c := config.AccessLog{
+		Every:      int(al.every),
+		ErrorsOnly: al.errorsOnly,
+		SlowerThan: int(al.slowerThan / time.Millisecond),
+		Sink:       s.accessSinkConfig,
+		Format:     al.format,
+	}
+	if len(al.sample) > 0 {
+		c.Sample = make(map[string]float64, len(al.sample))
+		for class, percent := range al.sample {
+			c.Sample[class] = percent
+		}
+	}
+	return c
+}
+
+// logSampled returns true if the access log line of a response with code taking cost is written
+func (s *VirtualServer) logSampled(code int, cost time.Duration) bool {
+	al, _ := s.accessLog.Load().(*accessLog)
+	if al == nil {
+		return true
+	}
+	if al.errorsOnly || al.slowerThan > 0 {
+		isError := al.errorsOnly && code >= 400
+		isSlow := al.slowerThan > 0 && cost >= al.slowerThan
+		if !isError && !isSlow {
+			return false
+		}
+	}
+	if al.every > 1 && atomic.AddUint64(&s.accessLogCount, 1)%al.every != 0 {
+		return false
+	}
+	percent, ok := al.sample[statusClass(code)]
+	if !ok || percent >= 100 {
+		return true
+	}
+	return rand.Float64()*100 < percent
+}
+
+// accessSeverity returns the syslog severity of a response with code
+func accessSeverity(code int) int {
+	switch {
+	case code >= 500:
+		return logging.SEVERITY_ERR
+	case code >= 400:
+		return logging.SEVERITY_WARNING
+	}
+	return logging.SEVERITY_INFO
+}
+
+// logAccess writes the access log line of r, to the sink if any, or to the log if the sink fails
+func (s *VirtualServer) logAccess(r *http.Request, code int, cost time.Duration) {
+	line := fmt.Sprintf("%s - %s %s%s %s %dms- %d", r.RemoteAddr, r.Method, r.Host, r.URL, r.Proto,
+		cost/time.Millisecond, code)
+	if al, _ := s.accessLog.Load().(*accessLog); al != nil && al.format != "" {
+		line = expandVars(al.format, r)
+	}
+	if s.accessSink != nil {
+		err := s.accessSink(accessSeverity(code), line, map[string]string{
+			"vs":          s.Name,
+			"client":      r.RemoteAddr,
+			"method":      r.Method,
+			"host":        r.Host,
+			"uri":         r.URL.RequestURI(),
+			"status":      strconv.Itoa(code),
+			"duration_ms": strconv.FormatInt(int64(cost/time.Millisecond), 10),
+		})
+		if err == nil {
+			return
+		}
+	}
+	log.Info(line)
+}
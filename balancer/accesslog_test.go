@@ -0,0 +1,131 @@
+package balancer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestAccessLogSample(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass(204))
+	assert.Equal(t, "5xx", statusClass(502))
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		AccessLogOpt(config.AccessLog{Sample: map[string]float64{"2XX": 10, "3xx": 0}}),
+		RulesOpt([]config.Rule{{PathPrefix: "/api/"}}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"2xx": 10, "3xx": 0}, vs.AccessLog().Sample)
+
+	logged := 0
+	for i := 0; i < 1000; i++ {
+		if vs.logSampled(200, time.Millisecond) {
+			logged += 1
+		}
+		assert.False(t, vs.logSampled(302, time.Millisecond))
+		assert.True(t, vs.logSampled(502, time.Millisecond))
+	}
+	assert.InDelta(t, 100, logged, 50)
+
+	// the rules follow the runtime changes
+	require.NoError(t, vs.SetAccessLog(config.AccessLog{Sample: map[string]float64{"5xx": 0}}))
+	assert.True(t, vs.rules[0].vs.logSampled(200, time.Millisecond))
+	assert.False(t, vs.rules[0].vs.logSampled(500, time.Millisecond))
+	assert.Equal(t, ErrStatusClass, vs.SetAccessLog(config.AccessLog{Sample: map[string]float64{"2x": 10}}))
+	assert.Equal(t, ErrSamplePercent, vs.SetAccessLog(config.AccessLog{Sample: map[string]float64{"2xx": -1}}))
+	assert.Equal(t, map[string]float64{"5xx": 0}, vs.AccessLog().Sample)
+
+	require.NoError(t, vs.SetAccessLog(config.AccessLog{}))
+	assert.True(t, vs.logSampled(500, time.Millisecond))
+	assert.Empty(t, vs.AccessLog().Sample)
+}
+
+func TestAccessLogConditions(t *testing.T) {
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		AccessLogOpt(config.AccessLog{Every: 10}),
+	)
+	require.NoError(t, err)
+	logged := 0
+	for i := 0; i < 100; i++ {
+		if vs.logSampled(200, time.Millisecond) {
+			logged += 1
+		}
+	}
+	assert.Equal(t, 10, logged)
+
+	require.NoError(t, vs.SetAccessLog(config.AccessLog{ErrorsOnly: true}))
+	assert.False(t, vs.logSampled(200, time.Second))
+	assert.True(t, vs.logSampled(404, time.Millisecond))
+	assert.True(t, vs.logSampled(502, time.Millisecond))
+
+	require.NoError(t, vs.SetAccessLog(config.AccessLog{SlowerThan: 100}))
+	assert.False(t, vs.logSampled(500, 99*time.Millisecond))
+	assert.True(t, vs.logSampled(200, 100*time.Millisecond))
+
+	// either condition
+	require.NoError(t, vs.SetAccessLog(config.AccessLog{ErrorsOnly: true, SlowerThan: 100}))
+	assert.False(t, vs.logSampled(200, time.Millisecond))
+	assert.True(t, vs.logSampled(500, time.Millisecond))
+	assert.True(t, vs.logSampled(200, time.Second))
+	assert.Equal(t, config.AccessLog{ErrorsOnly: true, SlowerThan: 100}, vs.EffectiveConfig().AccessLog)
+
+	assert.Equal(t, ErrNegativeAccessLog, vs.SetAccessLog(config.AccessLog{Every: -1}))
+}
+
+func TestAccessLogSink(t *testing.T) {
+	_, err := NewVirtualServer(AccessLogOpt(config.AccessLog{Sink: config.AccessLogSink{Type: "kafka"}}))
+	assert.Equal(t, ErrAccessLogSink, err)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	sink := config.AccessLogSink{Type: "syslog", Address: "udp://" + pc.LocalAddr().String(), Facility: "local0", Tag: "web"}
+	defer func() {
+		access_sinks_lock.Lock()
+		delete(accessSinks, sink)
+		access_sinks_lock.Unlock()
+	}()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		PoolOpt([]config.Server{{Address: "127.0.0.1:1", Weight: 1}}),
+		AccessLogOpt(config.AccessLog{Sink: sink}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, sink, vs.EffectiveConfig().AccessLog.Sink)
+	require.NoError(t, vs.SetAccessLog(config.AccessLog{ErrorsOnly: true}))
+	assert.Equal(t, sink, vs.AccessLog().Sink)
+
+	// the peer refuses the connection
+	req := httptest.NewRequest("GET", "/x?y=1", nil)
+	req.Host = "localhost"
+	w := httptest.NewRecorder()
+	vs.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := string(buf[:n])
+	// local0.err
+	assert.True(t, strings.HasPrefix(msg, "<131>1 "), msg)
+	assert.Contains(t, msg, ` web `)
+	assert.Contains(t, msg, ` access [golb@32473 `)
+	assert.Contains(t, msg, `status="502"`)
+	assert.Contains(t, msg, `uri="/x?y=1"`)
+	assert.Regexp(t, `GET localhost/x\?y=1 HTTP/1\.1 \d+ms- 502$`, msg)
+}
@@ -0,0 +1,126 @@
+package balancer
+
+import (
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	ADAPTIVE_GRADIENT        = "gradient"
+	ADAPTIVE_AIMD            = "aimd"
+	DEFAULT_ADAPTIVE_INITIAL = 20
+	DEFAULT_ADAPTIVE_MIN     = 1
+	DEFAULT_ADAPTIVE_MAX     = 1000
+	// weights of a sample in the short and long term latencies of gradient
+	gradientShortAlpha = 0.1
+	gradientLongAlpha  = 0.002
+	// weight of the new limit of gradient
+	gradientSmoothing = 0.2
+	// aimd multiplies the limit by it on a 5xx
+	aimdBackoff = 0.9
+)
+
+// adaptiveLimit infers the concurrent requests the pool can take, the lock of the connLimiter guards it
+type adaptiveLimit struct {
+	config.AdaptiveLimit
+	limit float64
+	// short and long term moving averages of the latency, in nanoseconds
+	short, long float64
+}
+
+// AdaptiveLimitOpt limits the concurrent requests of the pool to a limit inferred from
+// its latency, see config.AdaptiveLimit. queueSize and queueTimeout are those of LimitOpt,
+// used if it does not limit
+func AdaptiveLimitOpt(c config.AdaptiveLimit, queueSize int, queueTimeout time.Duration) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		switch c.Algorithm {
+		case "":
+			return nil
+		case ADAPTIVE_GRADIENT, ADAPTIVE_AIMD:
+		default:
+			return ErrAdaptiveLimit
+		}
+		if c.InitialLimit < 0 || c.MinLimit < 0 || c.MaxLimit < 0 {
+			return ErrAdaptiveLimit
+		}
+		if c.MinLimit == 0 {
+			c.MinLimit = DEFAULT_ADAPTIVE_MIN
+		}
+		if c.MaxLimit == 0 {
+			c.MaxLimit = DEFAULT_ADAPTIVE_MAX
+		}
+		if c.MinLimit > c.MaxLimit {
+			return ErrAdaptiveLimit
+		}
+		if c.InitialLimit == 0 {
+			c.InitialLimit = DEFAULT_ADAPTIVE_INITIAL
+		}
+		c.InitialLimit = int(math.Min(math.Max(float64(c.InitialLimit), float64(c.MinLimit)), float64(c.MaxLimit)))
+		if vs.limiter == nil {
+			vs.limiter = newConnLimiter(0, 0, queueSize, queueTimeout)
+		}
+		vs.limiter.adaptive = &adaptiveLimit{AdaptiveLimit: c, limit: float64(c.InitialLimit)}
+		return nil
+	}
+}
+
+// update adjusts the limit by the latency of a request, inflight is the number of
+// requests when it finished and dropped is true if it failed with a 5xx
+func (a *adaptiveLimit) update(rtt time.Duration, inflight int, dropped bool) {
+	if a.Algorithm == ADAPTIVE_AIMD {
+		if dropped {
+			a.limit *= aimdBackoff
+		} else if inflight*2 >= int(a.limit) {
+			a.limit += 1
+		}
+	} else {
+		x := float64(rtt)
+		if a.long == 0 {
+			a.short, a.long = x, x
+		}
+		a.short += gradientShortAlpha * (x - a.short)
+		a.long += gradientLongAlpha * (x - a.long)
+		// the latency dropped for good, e.g. the peers scaled out, the long term follows sooner
+		if a.long > 2*a.short {
+			a.long *= 0.95
+		}
+		// the latency of an idle pool says nothing about its capacity
+		if inflight*2 < int(a.limit) {
+			return
+		}
+		gradient := math.Min(math.Max(a.long/a.short, 0.5), 1)
+		newLimit := a.limit*gradient + math.Sqrt(a.limit)
+		a.limit = a.limit*(1-gradientSmoothing) + newLimit*gradientSmoothing
+	}
+	a.limit = math.Min(math.Max(a.limit, float64(a.MinLimit)), float64(a.MaxLimit))
+}
+
+// sample records the latency of a request before its release
+func (l *connLimiter) sample(rtt time.Duration, dropped bool) {
+	if l.adaptive == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	before := int(l.adaptive.limit)
+	l.adaptive.update(rtt, l.total, dropped)
+	if after := int(l.adaptive.limit); after != before {
+		log.Debugf("Adaptive concurrency limit %d -> %d", before, after)
+	}
+}
+
+// poolLimit returns the concurrent requests of the pool, 0 means unlimited, the lock should be held
+func (l *connLimiter) poolLimit() int {
+	if l.adaptive == nil {
+		return l.poolMax
+	}
+	limit := int(l.adaptive.limit)
+	if l.poolMax > 0 && l.poolMax < limit {
+		limit = l.poolMax
+	}
+	return limit
+}
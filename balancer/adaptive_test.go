@@ -0,0 +1,96 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestAdaptiveGradient(t *testing.T) {
+	a := &adaptiveLimit{
+		AdaptiveLimit: config.AdaptiveLimit{Algorithm: ADAPTIVE_GRADIENT, MinLimit: 1, MaxLimit: 100},
+		limit:         20,
+	}
+	// an idle pool keeps its limit
+	a.update(10*time.Millisecond, 1, false)
+	assert.Equal(t, 20.0, a.limit)
+
+	// a busy pool at a steady latency probes for more
+	for i := 0; i < 10; i++ {
+		a.update(10*time.Millisecond, int(a.limit), false)
+	}
+	grown := a.limit
+	assert.True(t, grown > 20, "%v", grown)
+
+	// and backs off as the latency rises
+	for i := 0; i < 50; i++ {
+		a.update(100*time.Millisecond, int(a.limit), false)
+	}
+	assert.True(t, a.limit < grown/2, "%v", a.limit)
+
+	for i := 0; i < 1000; i++ {
+		a.update(10*time.Millisecond, int(a.limit), false)
+	}
+	assert.Equal(t, 100.0, a.limit)
+}
+
+func TestAdaptiveAIMD(t *testing.T) {
+	a := &adaptiveLimit{
+		AdaptiveLimit: config.AdaptiveLimit{Algorithm: ADAPTIVE_AIMD, MinLimit: 5, MaxLimit: 100},
+		limit:         10,
+	}
+	a.update(time.Millisecond, 5, false)
+	assert.Equal(t, 11.0, a.limit)
+	a.update(time.Millisecond, 1, false)
+	assert.Equal(t, 11.0, a.limit)
+	a.update(time.Millisecond, 5, true)
+	assert.InDelta(t, 9.9, a.limit, 0.001)
+	for i := 0; i < 20; i++ {
+		a.update(time.Millisecond, 5, true)
+	}
+	assert.Equal(t, 5.0, a.limit)
+}
+
+func TestAdaptiveLimitOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		AdaptiveLimitOpt(config.AdaptiveLimit{Algorithm: ADAPTIVE_AIMD, InitialLimit: 1, MaxLimit: 2}, 0, 0))
+	require.NoError(t, err)
+	l := vs.limiter
+	require.NotNil(t, l)
+	assert.Equal(t, config.AdaptiveLimit{Algorithm: ADAPTIVE_AIMD, InitialLimit: 1, MinLimit: 1, MaxLimit: 2},
+		l.adaptive.AdaptiveLimit)
+
+	pick := alternate("a")
+	ctx := context.Background()
+	_, err = l.acquire(ctx, pick, 1, 0)
+	require.NoError(t, err)
+	// over the limit without a queue
+	_, err = l.acquire(ctx, pick, 1, 0)
+	assert.Equal(t, errSaturated, err)
+
+	l.sample(time.Millisecond, false)
+	assert.Equal(t, 2, l.poolLimit())
+	_, err = l.acquire(ctx, pick, 1, 0)
+	require.NoError(t, err)
+
+	// the static pool_max_conns is the ceiling
+	l.poolMax = 1
+	assert.Equal(t, 1, l.poolLimit())
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), AdaptiveLimitOpt(config.AdaptiveLimit{}, 0, 0))
+	require.NoError(t, err)
+	assert.Nil(t, vs.limiter)
+	for _, c := range []config.AdaptiveLimit{
+		{Algorithm: "vegas"},
+		{Algorithm: ADAPTIVE_GRADIENT, MinLimit: 10, MaxLimit: 5},
+		{Algorithm: ADAPTIVE_GRADIENT, InitialLimit: -1},
+	} {
+		_, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), AdaptiveLimitOpt(c, 0, 0))
+		assert.Equal(t, ErrAdaptiveLimit, err)
+	}
+}
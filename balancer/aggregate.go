@@ -0,0 +1,121 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/onestraw/golb/stats"
+)
+
+// AggregateStats sums the statistics of the peers of a virtual server, or of all the virtual servers
+type AggregateStats struct {
+	Requests uint64 `json:"requests"`
+	// responses 5xx, ErrorRate is their percent of the requests
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	InBytes   uint64  `json:"recv_bytes"`
+	OutBytes  uint64  `json:"send_bytes"`
+	// requests per second over the last stats.RATE_WINDOW seconds
+	QPS float64 `json:"qps"`
+	// client requests in progress, and client connections of the listeners
+	ActiveRequests int64 `json:"active_requests"`
+	ActiveConns    int   `json:"active_conns"`
+}
+
+func (a *AggregateStats) String() string {
+	return fmt.Sprintf("requests: %d, qps: %.1f, errors: %d (%.2f%%), recv_bytes: %d, send_bytes: %d, "+
+		"active_requests: %d, active_conns: %d", a.Requests, a.QPS, a.Errors, a.ErrorRate,
+		a.InBytes, a.OutBytes, a.ActiveRequests, a.ActiveConns)
+}
+
+// add sums the counters of r
+func (a *AggregateStats) add(r *stats.Report) {
+	a.Requests += r.Latency.Count
+	for code, n := range r.StatusCode {
+		if strings.HasPrefix(code, "5") {
+			a.Errors += n
+		}
+	}
+	a.InBytes += r.InBytes
+	a.OutBytes += r.OutBytes
+}
+
+func (a *AggregateStats) setErrorRate() {
+	a.ErrorRate = 0
+	if a.Requests > 0 {
+		a.ErrorRate = float64(a.Errors) * 100 / float64(a.Requests)
+	}
+}
+
+// aggregate sums the peers, with the rate and the activity of s
+func (s *VirtualServer) aggregate(peers map[string]*stats.Report) *AggregateStats {
+	a := &AggregateStats{}
+	for _, r := range peers {
+		a.add(r)
+	}
+	a.setErrorRate()
+	a.QPS = s.requests.PerSecond(time.Now())
+	a.ActiveRequests = atomic.LoadInt64(&s.activeRequests)
+	if l := s.runningListener(); l != nil {
+		a.ActiveConns = l.activeConns()
+	}
+	return a
+}
+
+// runningListener returns the listener serving s, nil if s is not running
+func (s *VirtualServer) runningListener() *listener {
+	listeners_lock.Lock()
+	l, ok := listeners[s.Address]
+	listeners_lock.Unlock()
+	if !ok {
+		return nil
+	}
+	l.RLock()
+	defer l.RUnlock()
+	for _, vs := range l.vservers {
+		if vs == s {
+			return l
+		}
+	}
+	return nil
+}
+
+func (l *listener) activeConns() int {
+	l.conns_lock.Lock()
+	defer l.conns_lock.Unlock()
+	return len(l.conns)
+}
+
+// withActive counts the client requests in progress, once whatever the tries
+func (s *VirtualServer) withActive(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.activeRequests, 1)
+		defer atomic.AddInt64(&s.activeRequests, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AggregateStats sums the statistics of all the virtual servers, the connections of a listener
+// shared by several virtual servers are counted once
+func (b *Balancer) AggregateStats() *AggregateStats {
+	a := &AggregateStats{}
+	seen := make(map[*listener]bool)
+	for _, vs := range b.virtualServers() {
+		t := vs.StatsReport().Total
+		a.Requests += t.Requests
+		a.Errors += t.Errors
+		a.InBytes += t.InBytes
+		a.OutBytes += t.OutBytes
+		a.QPS += t.QPS
+		a.ActiveRequests += t.ActiveRequests
+		if l := vs.runningListener(); l != nil && !seen[l] {
+			seen[l] = true
+			a.ActiveConns += t.ActiveConns
+		}
+	}
+	a.setErrorRate()
+	return a
+}
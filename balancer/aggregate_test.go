@@ -0,0 +1,60 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestAggregateStats(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		started <- struct{}{}
+		<-release
+	}))
+	defer s1.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		PoolOpt([]config.Server{{Address: s1.URL[7:], Weight: 1}}),
+	)
+	require.NoError(t, err)
+	b := &Balancer{VServers: []*VirtualServer{vs}}
+
+	serve := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "localhost"
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	done := make(chan int)
+	go func() { done <- serve("/") }()
+	<-started
+	assert.Equal(t, int64(1), vs.StatsReport().Total.ActiveRequests)
+	release <- struct{}{}
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusServiceUnavailable, serve("/error"))
+
+	total := vs.StatsReport().Total
+	assert.Equal(t, uint64(2), total.Requests)
+	assert.Equal(t, uint64(1), total.Errors)
+	assert.Equal(t, float64(50), total.ErrorRate)
+	assert.Equal(t, int64(0), total.ActiveRequests)
+	assert.Equal(t, 0, total.ActiveConns)
+	assert.Equal(t, total.Requests, b.AggregateStats().Requests)
+	assert.Contains(t, vs.Stats(), "Total\nrequests: 2")
+
+	require.NoError(t, vs.ResetStats(""))
+	assert.Equal(t, AggregateStats{}, *b.AggregateStats())
+}
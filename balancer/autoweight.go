@@ -0,0 +1,155 @@
+package balancer
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/roundrobin"
+	"github.com/onestraw/golb/stats"
+)
+
+const (
+	DEFAULT_AUTO_WEIGHT_INTERVAL     = 30 * time.Second
+	DEFAULT_AUTO_WEIGHT_STEP         = 10
+	DEFAULT_AUTO_WEIGHT_MIN_PERCENT  = 50
+	DEFAULT_AUTO_WEIGHT_MAX_PERCENT  = 150
+	DEFAULT_AUTO_WEIGHT_MIN_REQUESTS = 20
+	// a peer within this ratio of the mean of the pool keeps its weight
+	AUTO_WEIGHT_TOLERANCE = 0.2
+)
+
+// autoWeight slowly moves the traffic away from the peers slower or failing more than
+// the mean of the pool, and towards the faster ones
+type autoWeight struct {
+	interval    time.Duration
+	step        int
+	minPercent  int
+	maxPercent  int
+	minRequests uint64
+	// reports taken by the previous adjustment
+	prev map[string]*stats.Report
+}
+
+// PeerWeight is the percent the configured weight of a peer is scaled by
+type PeerWeight struct {
+	Peer    string `json:"address"`
+	Percent int    `json:"percent"`
+}
+
+// AutoWeightOpt enables the weight auto-tuning, only the round-robin pools are tuned
+func AutoWeightOpt(c config.AutoWeight) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if !c.Enable {
+			return nil
+		}
+		aw := &autoWeight{
+			interval:    time.Duration(c.Interval) * time.Second,
+			step:        c.Step,
+			minPercent:  c.MinPercent,
+			maxPercent:  c.MaxPercent,
+			minRequests: c.MinRequests,
+			prev:        map[string]*stats.Report{},
+		}
+		if aw.interval <= 0 {
+			aw.interval = DEFAULT_AUTO_WEIGHT_INTERVAL
+		}
+		if aw.step <= 0 {
+			aw.step = DEFAULT_AUTO_WEIGHT_STEP
+		}
+		if aw.minPercent <= 0 {
+			aw.minPercent = DEFAULT_AUTO_WEIGHT_MIN_PERCENT
+		}
+		if aw.maxPercent <= 0 {
+			aw.maxPercent = DEFAULT_AUTO_WEIGHT_MAX_PERCENT
+		}
+		if aw.minRequests == 0 {
+			aw.minRequests = DEFAULT_AUTO_WEIGHT_MIN_REQUESTS
+		}
+		if aw.minPercent > roundrobin.DEFAULT_FACTOR || aw.maxPercent < roundrobin.DEFAULT_FACTOR {
+			return ErrAutoWeightRange
+		}
+		vs.autoWeight = aw
+		return nil
+	}
+}
+
+// adjustWeights steps the factor of the peers deviating from the mean of the pool
+func (s *VirtualServer) adjustWeights() {
+	pool, ok := s.Pool.(*roundrobin.Pool)
+	if !ok {
+		return
+	}
+	aw := s.autoWeight
+	samples := s.peerSamples(aw.prev, aw.minRequests)
+	if len(samples) < 2 {
+		return
+	}
+	var errorSum, latencySum float64
+	for _, sample := range samples {
+		errorSum += sample.errorRate
+		latencySum += sample.p99
+	}
+	errorMean := errorSum / float64(len(samples))
+	latencyMean := latencySum / float64(len(samples))
+
+	for _, sample := range samples {
+		factor := pool.Factor(sample.peer)
+		if factor == 0 {
+			continue
+		}
+		worse := sample.errorRate > errorMean*(1+AUTO_WEIGHT_TOLERANCE) ||
+			sample.p99 > latencyMean*(1+AUTO_WEIGHT_TOLERANCE)
+		better := sample.errorRate <= errorMean && sample.p99 < latencyMean*(1-AUTO_WEIGHT_TOLERANCE)
+
+		next := factor
+		if worse {
+			next -= aw.step
+		} else if better {
+			next += aw.step
+		}
+		if next < aw.minPercent {
+			next = aw.minPercent
+		}
+		if next > aw.maxPercent {
+			next = aw.maxPercent
+		}
+		if next == factor {
+			continue
+		}
+		pool.SetFactor(sample.peer, next)
+		log.WithFields(log.Fields{"event": "auto_weight", "vs": s.Name, "peer": sample.peer}).
+			Infof("Weight of peer %s scaled to %d%%, error rate %.2f (mean %.2f), p99 %.0fms (mean %.0fms)",
+				sample.peer, next, sample.errorRate, errorMean, sample.p99, latencyMean)
+	}
+}
+
+func (s *VirtualServer) autoWeightLoop(stop chan struct{}) {
+	ticker := time.NewTicker(s.autoWeight.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.adjustWeights()
+		}
+	}
+}
+
+// PeerWeights returns the percent the weight of the peers is scaled by,
+// empty if the pool is not round-robin
+func (s *VirtualServer) PeerWeights() []PeerWeight {
+	result := []PeerWeight{}
+	pool, ok := s.Pool.(*roundrobin.Pool)
+	if !ok {
+		return result
+	}
+	for _, peer := range pool.Peers() {
+		if factor := pool.Factor(peer); factor > 0 {
+			result = append(result, PeerWeight{Peer: peer, Percent: factor})
+		}
+	}
+	return result
+}
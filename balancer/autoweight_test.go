@@ -0,0 +1,66 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestAutoWeight(t *testing.T) {
+	peers := []string{"127.0.0.1:10001", "127.0.0.1:10002", "127.0.0.1:10003", "127.0.0.1:10004"}
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{
+			{Address: peers[0], Weight: 1},
+			{Address: peers[1], Weight: 1},
+			{Address: peers[2], Weight: 1},
+			{Address: peers[3], Weight: 1},
+		}),
+		AutoWeightOpt(config.AutoWeight{Enable: true, Step: 20, MinRequests: 10}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, DEFAULT_AUTO_WEIGHT_INTERVAL, vs.autoWeight.interval)
+
+	for round := 0; round < 4; round++ {
+		feed(vs, peers[0], 10, "200", 10*time.Millisecond)
+		feed(vs, peers[1], 10, "200", 10*time.Millisecond)
+		feed(vs, peers[2], 10, "200", 100*time.Millisecond)
+		feed(vs, peers[3], 5, "200", 10*time.Millisecond)
+		feed(vs, peers[3], 5, "502", 10*time.Millisecond)
+		vs.adjustWeights()
+	}
+	// bounded by [50, 150]
+	assert.Equal(t, []PeerWeight{
+		{Peer: peers[0], Percent: 150},
+		{Peer: peers[1], Percent: 150},
+		{Peer: peers[2], Percent: 50},
+		{Peer: peers[3], Percent: 50},
+	}, vs.PeerWeights())
+
+	result := map[string]int{}
+	for i := 0; i < 8; i++ {
+		result[vs.Pool.Get()] += 1
+	}
+	assert.Equal(t, map[string]int{peers[0]: 3, peers[1]: 3, peers[2]: 1, peers[3]: 1}, result)
+
+	// too few requests to be adjusted
+	feed(vs, peers[0], 5, "200", time.Second)
+	feed(vs, peers[1], 5, "200", 10*time.Millisecond)
+	vs.adjustWeights()
+	assert.Equal(t, 150, vs.PeerWeights()[0].Percent)
+
+	_, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		AutoWeightOpt(config.AutoWeight{Enable: true, MinPercent: 120}))
+	assert.Equal(t, ErrAutoWeightRange, err)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LBMethodOpt(LB_COSISTENTHASH),
+		PoolOpt([]config.Server{{Address: peers[0], Weight: 1}}),
+		AutoWeightOpt(config.AutoWeight{Enable: true}))
+	require.NoError(t, err)
+	assert.Empty(t, vs.PeerWeights())
+}
@@ -1,7 +1,9 @@
 package balancer
 
 import (
+	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/onestraw/golb/config"
 )
@@ -9,11 +11,23 @@ import (
 type Balancer struct {
 	sync.RWMutex
 	VServers []*VirtualServer
+
+	// options applied to every virtual server
+	opts []VirtualServerOption
+
+	reload_lock sync.Mutex
+	// the last reload, nil if none
+	rollout *Rollout
+	// nil if not in a cluster
+	cluster *Cluster
+	// names of the virtual servers of the configuration, nil if the state is not saved
+	configured map[string]bool
 }
 
-func New(vss []config.VirtualServer) (*Balancer, error) {
+func New(vss []config.VirtualServer, opts ...VirtualServerOption) (*Balancer, error) {
 	b := &Balancer{
 		VServers: []*VirtualServer{},
+		opts:     opts,
 	}
 	for _, vs := range vss {
 		if err := b.AddVirtualServer(&vs); err != nil {
@@ -25,25 +39,147 @@ func New(vss []config.VirtualServer) (*Balancer, error) {
 }
 
 func (b *Balancer) AddVirtualServer(cvs *config.VirtualServer) error {
-	vs, err := NewVirtualServer(
+	vs, err := b.newVirtualServer(cvs)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	for _, v := range b.VServers {
+		if v.Name == vs.Name {
+			return ErrVirtualServerNameExisted
+		}
+	}
+	b.VServers = append(b.VServers, vs)
+
+	return nil
+}
+
+// newVirtualServer creates the virtual server of cvs, it is not added to b
+func (b *Balancer) newVirtualServer(cvs *config.VirtualServer) (*VirtualServer, error) {
+	// also applied to the virtual servers of the rules
+	common := []VirtualServerOption{
+		SlowStartOpt(time.Duration(cvs.SlowStart) * time.Second),
+		LeastTimeOpt(cvs.LeastTime),
+		HedgeOpt(cvs.Hedge.Percentile, time.Duration(cvs.Hedge.DefaultDelay)*time.Millisecond),
+		RangeSplitOpt(cvs.RangeSplit.ChunkSize, cvs.RangeSplit.Concurrency),
+		TombstoneOpt(cvs.TombstoneAfter),
+		OutlierOpt(cvs.OutlierDetection),
+		AutoWeightOpt(cvs.AutoWeight),
+		HealthCheckOpt(cvs.HealthCheck),
+		LimitOpt(cvs.Limits.PeerMaxConns, cvs.Limits.PoolMaxConns, cvs.Limits.QueueSize,
+			time.Duration(cvs.Limits.QueueTimeout)*time.Millisecond),
+		AdaptiveLimitOpt(cvs.Limits.Adaptive, cvs.Limits.QueueSize,
+			time.Duration(cvs.Limits.QueueTimeout)*time.Millisecond),
+		PriorityOpt(cvs.Limits.Priority),
+		ServerTimingOpt(cvs.ServerTiming),
+		PeerHeadersOpt(cvs.PeerHeaders),
+		SlowLogOpt(time.Duration(cvs.SlowLog.Threshold)*time.Millisecond, cvs.SlowLog.File),
+		AccessLogOpt(cvs.AccessLog),
+		ResolveOpt(time.Duration(cvs.ResolveInterval) * time.Second),
+		SLAOpt(cvs.SLA),
+		ErrorPagesOpt(cvs.ErrorPages),
+		KeepAliveOpt(cvs.KeepAlive),
+		UpstreamTLSOpt(cvs.UpstreamTLS),
+		DialOpt(cvs.Dial),
+		FailOnOpt(cvs.FailOn),
+		HashKeyOpt(cvs.HashKey),
+	}
+	common = append(common, b.opts...)
+
+	opts := []VirtualServerOption{
 		NameOpt(cvs.Name),
 		AddressOpt(cvs.Address),
+		ReusePortOpt(cvs.ReusePort),
+		TCPOpt(cvs.TCP),
+		BandwidthOpt(cvs.Bandwidth),
+		HealthzOpt(cvs.HealthzPath),
 		ServerNameOpt(cvs.ServerName),
 		ProtocolOpt(cvs.Protocol),
 		TLSOpt(cvs.CertFile, cvs.KeyFile),
+		TLSPolicyOpt(cvs.TLS),
+		ClientCAOpt(cvs.ClientCAFile, time.Duration(cvs.ClientCAWatch)*time.Second),
 		LBMethodOpt(cvs.LBMethod),
 		PoolOpt(cvs.Pool),
+		ServiceOpt(cvs.Service),
 		RetryOpt(true),
-	)
+		// not applied to the virtual servers of the rules, they serve the rewritten requests
+		HeadersOpt(cvs.Headers),
+		CompressionOpt(cvs.Compression),
+		CacheOpt(cvs.Cache),
+		RewritesOpt(cvs.Rewrites),
+		DebugOpt(cvs.Debug.Token),
+		UpstreamOverrideOpt(cvs.Debug.Upstream, cvs.Debug.AllowFrom),
+		ConnAgeOpt(cvs.ConnectionAge),
+		CriticalOpt(cvs.Critical),
+		RateLimitOpt(cvs.RateLimit),
+		ClientLimitOpt(cvs.Limits.ClientMaxConns),
+		RequestBodyOpt(cvs.MaxBodySize, cvs.RequestBuffering),
+		WAFOpt(cvs.WAF),
+		JWTOpt(cvs.JWT),
+		ClientAuthOpt(cvs.ClientAuth),
+		ForwardAuthOpt(cvs.ForwardAuth),
+		ScriptsOpt(cvs.Scripts),
+		SRVOpt(cvs.SRV.Service, cvs.SRV.Proto, cvs.SRV.Name, time.Duration(cvs.SRV.Interval)*time.Second),
+	}
+	opts = append(opts, common...)
+	opts = append(opts, RulesOpt(cvs.Rules, common...), CanaryOpt(cvs.Canary, common...),
+		MirrorOpt(cvs.Mirror, common...))
+	vs, err := NewVirtualServer(opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	vs.conf = copyConfig(cvs)
+	return vs, nil
+}
 
-	b.Lock()
-	defer b.Unlock()
-	b.VServers = append(b.VServers, vs)
+// copyConfig returns a deep copy of cvs
+func copyConfig(cvs *config.VirtualServer) *config.VirtualServer {
+	data, _ := json.Marshal(cvs)
+	c := &config.VirtualServer{}
+	json.Unmarshal(data, c)
+	return c
+}
 
-	return nil
+// CloneRequest names the copy of a virtual server
+type CloneRequest struct {
+	Name string `json:"name"`
+	// empty means the address of the source
+	Address    string `json:"address"`
+	ServerName string `json:"server_name"`
+	// nil means the pool configured for the source, the peers added at runtime are not copied
+	Pool []config.Server `json:"pool"`
+}
+
+// Clone adds a virtual server with the configuration of the virtual server name, it is not started
+func (b *Balancer) Clone(name string, cr *CloneRequest) (*VirtualServer, error) {
+	src, err := b.FindVirtualServer(name)
+	if err != nil {
+		return nil, err
+	}
+	if src.conf == nil {
+		return nil, ErrConfigNotFound
+	}
+	if cr.Name == "" {
+		return nil, ErrVirtualServerNameEmpty
+	}
+
+	cvs := copyConfig(src.conf)
+	cvs.Name = cr.Name
+	if cr.Address != "" {
+		cvs.Address = cr.Address
+	}
+	if cr.ServerName != "" {
+		cvs.ServerName = cr.ServerName
+	}
+	if cr.Pool != nil {
+		cvs.Pool = cr.Pool
+	}
+	if err := b.AddVirtualServer(cvs); err != nil {
+		return nil, err
+	}
+	return b.FindVirtualServer(cr.Name)
 }
 
 func (b *Balancer) FindVirtualServer(name string) (*VirtualServer, error) {
@@ -57,6 +193,78 @@ func (b *Balancer) FindVirtualServer(name string) (*VirtualServer, error) {
 	return nil, ErrVirtualServerNotFound
 }
 
+// RemoveVirtualServer stops the virtual server name if running, and removes it from b
+func (b *Balancer) RemoveVirtualServer(name string) error {
+	vs, err := b.FindVirtualServer(name)
+	if err != nil {
+		return err
+	}
+	if vs.Status() == STATUS_ENABLED {
+		if err := vs.Stop(); err != nil {
+			return err
+		}
+	}
+	b.swap(vs, nil)
+	return nil
+}
+
+// virtualServers returns a copy of b.VServers
+func (b *Balancer) virtualServers() []*VirtualServer {
+	b.RLock()
+	defer b.RUnlock()
+	return append([]*VirtualServer(nil), b.VServers...)
+}
+
+// StartAll runs the virtual servers not running, all of them are tried,
+// the first error is returned
+func (b *Balancer) StartAll() error {
+	var first error
+	for _, vs := range b.virtualServers() {
+		if vs.Status() == STATUS_ENABLED {
+			continue
+		}
+		if err := vs.Run(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// StopAll stops the running virtual servers, all of them are tried,
+// the first error is returned
+func (b *Balancer) StopAll() error {
+	var first error
+	for _, vs := range b.virtualServers() {
+		if vs.Status() != STATUS_ENABLED {
+			continue
+		}
+		if err := vs.Stop(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Stats returns the statistics of the virtual server name
+func (b *Balancer) Stats(name string) (*VirtualServerStats, error) {
+	vs, err := b.FindVirtualServer(name)
+	if err != nil {
+		return nil, err
+	}
+	return vs.StatsReport(), nil
+}
+
+// StatsReports returns the statistics of all the virtual servers
+func (b *Balancer) StatsReports() []*VirtualServerStats {
+	result := []*VirtualServerStats{}
+	for _, vs := range b.virtualServers() {
+		result = append(result, vs.StatsReport())
+	}
+	return result
+}
+
+// Run runs all the virtual servers, it stops at the first error,
+// e.g. a virtual server is already running, see StartAll
 func (b *Balancer) Run() error {
 	for _, vs := range b.VServers {
 		if err := vs.Run(); err != nil {
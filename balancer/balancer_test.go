@@ -87,6 +87,43 @@ func TestBalancer(t *testing.T) {
 	require.NoError(t, b.Stop())
 }
 
+func TestEmbeddedBalancer(t *testing.T) {
+	s1 := httptest.NewServer(newHandler("s1"))
+	defer s1.Close()
+	pool := []config.Server{{Address: s1.URL[7:], Weight: 1}}
+	b, err := New([]config.VirtualServer{
+		{Name: "web", Address: "127.0.0.1:8117", ServerName: "localhost", Pool: pool},
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.AddVirtualServer(&config.VirtualServer{Name: "api", Address: "127.0.0.1:8118", ServerName: "localhost", Pool: pool}))
+
+	require.NoError(t, b.StartAll())
+	// the running ones are skipped
+	require.NoError(t, b.StartAll())
+	resp, err := request("127.0.0.1:8117")
+	require.NoError(t, err)
+	assert.Equal(t, "s1", resp.Body)
+
+	st, err := b.Stats("web")
+	require.NoError(t, err)
+	assert.Equal(t, "web", st.Name)
+	assert.Contains(t, st.Peers, s1.URL[7:])
+	assert.Len(t, b.StatsReports(), 2)
+	_, err = b.Stats("db")
+	assert.Equal(t, ErrVirtualServerNotFound, err)
+
+	require.NoError(t, b.RemoveVirtualServer("api"))
+	_, err = request("127.0.0.1:8118")
+	assert.Error(t, err)
+	_, err = b.FindVirtualServer("api")
+	assert.Equal(t, ErrVirtualServerNotFound, err)
+	assert.Equal(t, ErrVirtualServerNotFound, b.RemoveVirtualServer("api"))
+
+	require.NoError(t, b.StopAll())
+	require.NoError(t, b.StopAll())
+	assert.Equal(t, STATUS_DISABLED, b.VServers[0].Status())
+}
+
 func TestFindVirtualServer(t *testing.T) {
 	b := mockBalancer(t)
 	vsName := "web"
@@ -98,3 +135,113 @@ func TestFindVirtualServer(t *testing.T) {
 	assert.Equal(t, ErrVirtualServerNotFound, err)
 	assert.Nil(t, vs)
 }
+
+func TestRoute(t *testing.T) {
+	jsonBody := `{"virtual_server":[
+		{"name":"web","address":"127.0.0.1:8091","pool":[{"address":"127.0.0.1:10001","weight":1}],"hedge":{"percentile":95}},
+		{"name":"api","address":"127.0.0.1:8092","server_name":"api.local","range_split":{"chunk_size":1024}}]}`
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := New(c.VServers)
+	require.NoError(t, err)
+
+	result, err := b.Route(&RouteRequest{Host: "localhost", Path: "/index.html"})
+	require.NoError(t, err)
+	assert.Equal(t, "web", result.VirtualServer)
+	assert.Equal(t, []string{"retry", "stats"}, result.Middleware)
+	assert.Equal(t, ROUTE_HEDGE, result.Route)
+	assert.Equal(t, "127.0.0.1:10001", result.Pool)
+	assert.Empty(t, result.Error)
+
+	result, err = b.Route(&RouteRequest{Method: "POST", Host: "localhost"})
+	require.NoError(t, err)
+	assert.Equal(t, ROUTE_PROXY, result.Route)
+
+	result, err = b.Route(&RouteRequest{Host: "api.local", Headers: map[string]string{"Range": "bytes=0-9"}})
+	require.NoError(t, err)
+	assert.Equal(t, "api", result.VirtualServer)
+	assert.Equal(t, ROUTE_PROXY, result.Route)
+	assert.Equal(t, ErrPeerNotFound.ErrMsg, result.Error)
+
+	result, err = b.Route(&RouteRequest{Host: "api.local"})
+	require.NoError(t, err)
+	assert.Equal(t, ROUTE_RANGE_SPLIT, result.Route)
+
+	// the listener is found but rejects the host
+	result, err = b.Route(&RouteRequest{Address: "127.0.0.1:8092", Host: "localhost"})
+	require.NoError(t, err)
+	assert.Equal(t, "api", result.VirtualServer)
+	assert.Equal(t, ErrHostNotMatch.ErrMsg, result.Error)
+
+	_, err = b.Route(&RouteRequest{Host: "unknown"})
+	assert.Equal(t, ErrRouteNotFound, err)
+}
+
+func TestClone(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8096","lb_method":"consistent-hash",
+		"pool":[{"address":"127.0.0.1:10001"},{"address":"127.0.0.1:10002"}],"hedge":{"percentile":95}}]}`
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := New(c.VServers)
+	require.NoError(t, err)
+	b.VServers[0].AddPeer("127.0.0.1:10003")
+
+	vs, err := b.Clone("web", &CloneRequest{Name: "shadow", ServerName: "shadow.local"})
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:8096", vs.Address)
+	assert.Equal(t, "shadow.local", vs.ServerName)
+	assert.Equal(t, LB_COSISTENTHASH, vs.LBMethod)
+	assert.Equal(t, 95.0, vs.hedgePercentile)
+	// the peers added at runtime are not copied
+	assert.Equal(t, "127.0.0.1:10001, 127.0.0.1:10002", vs.Pool.String())
+	assert.Equal(t, "web", b.VServers[0].conf.Name)
+
+	_, err = b.Clone("web", &CloneRequest{})
+	assert.Equal(t, ErrVirtualServerNameEmpty, err)
+	_, err = b.Clone("web", &CloneRequest{Name: "shadow"})
+	assert.Equal(t, ErrVirtualServerNameExisted, err)
+
+	other, err := NewVirtualServer(NameOpt("other"), AddressOpt(":80"))
+	require.NoError(t, err)
+	b.VServers = append(b.VServers, other)
+	_, err = b.Clone("other", &CloneRequest{Name: "copy"})
+	assert.Equal(t, ErrConfigNotFound, err)
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	jsonBody := `{"controller":{"address":":6587","auth":{"username":"admin","password":"admin"}},
+		"virtual_server":[{"name":"web","address":"127.0.0.1:8098",
+		"pool":[{"address":"127.0.0.1:10001"},{"address":"10.0.0.2","scheme":"https","weight":3}],
+		"outlier_detection":{"error_factor":2},"health_check":{"path":"/healthz"},
+		"limits":{"peer_max_conns":10},"srv":{"service":"http","name":"example.com"}}]}`
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := New(c.VServers)
+	require.NoError(t, err)
+	require.NoError(t, b.AddVirtualServer(&config.VirtualServer{Name: "api", Address: "127.0.0.1:8099"}))
+
+	e := b.EffectiveConfig(c)
+	assert.Equal(t, config.REDACTED, e.Controller.Auth.Password)
+	assert.Equal(t, "admin", c.Controller.Auth.Password)
+	require.Len(t, e.VServers, 2)
+
+	web := e.VServers[0]
+	assert.Equal(t, DEFAULT_SERVERNAME, web.ServerName)
+	assert.Equal(t, PROTO_HTTP, web.Protocol)
+	assert.Equal(t, LB_ROUNDROBIN, web.LBMethod)
+	assert.Equal(t, []config.Server{
+		{Address: "127.0.0.1:10001", Weight: 1, Scheme: PROTO_HTTP},
+		{Address: "10.0.0.2:443", Weight: 3, Scheme: PROTO_HTTPS},
+	}, web.Pool)
+	assert.Equal(t, config.OutlierDetection{
+		Interval: 10, ErrorFactor: 2, MinRequests: 5, MaxEjectionPercent: 10, EjectionTime: 30,
+	}, web.OutlierDetection)
+	assert.Equal(t, config.HealthCheck{Path: "/healthz", Interval: 5, Timeout: 2}, web.HealthCheck)
+	assert.Equal(t, config.Limits{PeerMaxConns: 10, QueueTimeout: 1000}, web.Limits)
+	assert.Equal(t, config.SRV{Service: "http", Proto: "tcp", Name: "example.com", Interval: 30}, web.SRV)
+	assert.Equal(t, config.RangeSplit{}, web.RangeSplit)
+
+	// added at runtime
+	assert.Equal(t, "api", e.VServers[1].Name)
+	assert.Empty(t, e.VServers[1].Pool)
+}
@@ -0,0 +1,157 @@
+package balancer
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/onestraw/golb/config"
+)
+
+// DEFAULT_BANDWIDTH_BURST is the bytes sent at once before shaping, the bodies are written in
+// chunks of the burst at most
+const DEFAULT_BANDWIDTH_BURST = 16 << 10
+
+// BandwidthOpt shapes the response bodies of every client connection, and of all the responses
+// of the virtual server, to their bytes per second, see config.Bandwidth
+func BandwidthOpt(c config.Bandwidth) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.PerConnection < 0 || c.Total < 0 || c.Burst < 0 {
+			return ErrNegativeBandwidth
+		}
+		if c.PerConnection == 0 && c.Total == 0 {
+			return nil
+		}
+		if c.Burst == 0 {
+			c.Burst = DEFAULT_BANDWIDTH_BURST
+		}
+		vs.bandwidth = c
+		if c.Total > 0 {
+			vs.bandwidthTotal = newByteBucket(c.Total, c.Burst)
+		}
+		return nil
+	}
+}
+
+// byteBucket is a token bucket of bytes
+type byteBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(rate, burst int) *byteBucket {
+	return &byteBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes n bytes, and returns the time to wait before sending them
+func (b *byteBucket) reserve(n int, now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type connBandwidthKey struct{}
+
+// connBandwidth is the buckets of a client connection, by virtual server
+type connBandwidth struct {
+	sync.Mutex
+	buckets map[*VirtualServer]*byteBucket
+}
+
+// connBucket returns the bucket of the connection of r, or a new one if r is not served by a listener
+func (s *VirtualServer) connBucket(r *http.Request) *byteBucket {
+	cb, ok := r.Context().Value(connBandwidthKey{}).(*connBandwidth)
+	if !ok {
+		return newByteBucket(s.bandwidth.PerConnection, s.bandwidth.Burst)
+	}
+	cb.Lock()
+	defer cb.Unlock()
+	if cb.buckets == nil {
+		cb.buckets = make(map[*VirtualServer]*byteBucket)
+	}
+	b, ok := cb.buckets[s]
+	if !ok {
+		b = newByteBucket(s.bandwidth.PerConnection, s.bandwidth.Burst)
+		cb.buckets[s] = b
+	}
+	return b
+}
+
+// bandwidthWriter writes the body in chunks, waiting for the buckets
+type bandwidthWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*byteBucket
+	chunk   int
+}
+
+func (w *bandwidthWriter) Flush() {
+	flush(w.ResponseWriter)
+}
+
+// Hijack hands the connection over, it is not limited any more
+func (w *bandwidthWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+func (w *bandwidthWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > w.chunk {
+			n = w.chunk
+		}
+		var wait time.Duration
+		now := time.Now()
+		for _, b := range w.buckets {
+			if d := b.reserve(n, now); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-w.ctx.Done():
+				t.Stop()
+				return written, w.ctx.Err()
+			}
+		}
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// withBandwidth shapes the response bodies
+func (s *VirtualServer) withBandwidth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buckets := make([]*byteBucket, 0, 2)
+		if s.bandwidth.PerConnection > 0 {
+			buckets = append(buckets, s.connBucket(r))
+		}
+		if s.bandwidthTotal != nil {
+			buckets = append(buckets, s.bandwidthTotal)
+		}
+		next.ServeHTTP(&bandwidthWriter{w, r.Context(), buckets, s.bandwidth.Burst}, r)
+	})
+}
@@ -0,0 +1,51 @@
+package balancer
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestByteBucket(t *testing.T) {
+	now := time.Now()
+	b := newByteBucket(1000, 500)
+	b.last = now
+	assert.Equal(t, time.Duration(0), b.reserve(500, now))
+	assert.Equal(t, 500*time.Millisecond, b.reserve(500, now))
+	// refilled after a second, minus the deficit
+	assert.Equal(t, time.Duration(0), b.reserve(500, now.Add(time.Second)))
+}
+
+func TestBandwidth(t *testing.T) {
+	_, err := NewVirtualServer(BandwidthOpt(config.Bandwidth{Total: -1}))
+	assert.Equal(t, ErrNegativeBandwidth, err)
+
+	vs, err := NewVirtualServer(NameOpt("bw"), AddressOpt("127.0.0.1:80"),
+		BandwidthOpt(config.Bandwidth{PerConnection: 4000, Burst: 1000}))
+	require.NoError(t, err)
+	assert.Equal(t, 4000, vs.EffectiveConfig().Bandwidth.PerConnection)
+
+	w := &bandwidthWriter{httptest.NewRecorder(), context.Background(),
+		[]*byteBucket{newByteBucket(4000, 1000)}, 1000}
+	start := time.Now()
+	n, err := w.Write(make([]byte, 3000))
+	require.NoError(t, err)
+	assert.Equal(t, 3000, n)
+	// the burst is free, 2000 bytes more at 4000 bytes/sec
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 450*time.Millisecond, elapsed)
+	assert.True(t, elapsed < 2*time.Second, elapsed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = &bandwidthWriter{httptest.NewRecorder(), ctx, []*byteBucket{newByteBucket(10, 10)}, 10}
+	n, err = w.Write(make([]byte, 100))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 10, n)
+}
@@ -0,0 +1,543 @@
+package balancer
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	DEFAULT_CACHE_MAX_SIZE       = 64 << 20
+	DEFAULT_CACHE_MAX_ENTRY_SIZE = 1 << 20
+	CACHE_FILE_SUFFIX            = ".cache"
+)
+
+// cacheable status codes, as in RFC 7231 section 6.1 without the partial responses
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheEntry is a stored response, exported fields are persisted
+type cacheEntry struct {
+	Key     string
+	Path    string
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Stored  time.Time
+	Expires time.Time
+	// names of the request headers the response varies on, sorted
+	Vary []string
+}
+
+// uri returns the key of the entry regardless of its variant
+func (e *cacheEntry) uri() string {
+	return strings.SplitN(e.Key, "\n", 2)[0]
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.Key) + len(e.Body))
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+// variants are the entries of an URI
+type variants struct {
+	vary []string
+	n    int
+}
+
+// cache is a LRU of the responses of a virtual server
+type cache struct {
+	sync.Mutex
+	maxSize      int64
+	maxEntrySize int64
+	defaultTTL   time.Duration
+	ttl          time.Duration
+	dir          string
+
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	// URI -> names of the request headers the responses vary on
+	varies map[string]*variants
+
+	hits   uint64
+	misses uint64
+}
+
+// CacheStats describes the content and the efficiency of the cache
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Size    int64  `json:"size"`
+	MaxSize int64  `json:"max_size"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// CacheOpt caches the responses of the pool, the entries persisted in c.Dir are loaded
+func CacheOpt(c config.Cache) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if !c.Enable {
+			return nil
+		}
+		ca := &cache{
+			maxSize:      c.MaxSize,
+			maxEntrySize: c.MaxEntrySize,
+			defaultTTL:   time.Duration(c.DefaultTTL) * time.Second,
+			ttl:          time.Duration(c.TTL) * time.Second,
+			dir:          c.Dir,
+			lru:          list.New(),
+			entries:      map[string]*list.Element{},
+			varies:       map[string]*variants{},
+		}
+		if ca.maxSize <= 0 {
+			ca.maxSize = DEFAULT_CACHE_MAX_SIZE
+		}
+		if ca.maxEntrySize <= 0 {
+			ca.maxEntrySize = DEFAULT_CACHE_MAX_ENTRY_SIZE
+		}
+		if ca.dir != "" {
+			if err := os.MkdirAll(ca.dir, 0755); err != nil {
+				return err
+			}
+			ca.load()
+		}
+		vs.cache = ca
+		return nil
+	}
+}
+
+// parseCacheControl returns the lower-cased directives of the Cache-Control headers
+func parseCacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			cc[strings.ToLower(name)] = value
+		}
+	}
+	return cc
+}
+
+// uriKey returns the key of r regardless of its variants
+func uriKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// variantKey returns the key of the variant of r for the header names in vary
+func variantKey(uri string, vary []string, r *http.Request) string {
+	if len(vary) == 0 {
+		return uri
+	}
+	var b strings.Builder
+	b.WriteString(uri)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ":" + strings.Join(r.Header[name], ","))
+	}
+	return b.String()
+}
+
+// responseVary returns the sorted names of the Vary headers, false if it varies on *
+func responseVary(h http.Header) ([]string, bool) {
+	names := []string{}
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// lookup returns the fresh response to r, nil if none
+func (ca *cache) lookup(r *http.Request) *cacheEntry {
+	uri := uriKey(r)
+	now := time.Now()
+
+	ca.Lock()
+	defer ca.Unlock()
+	v, ok := ca.varies[uri]
+	if !ok {
+		ca.misses += 1
+		return nil
+	}
+	el, ok := ca.entries[variantKey(uri, v.vary, r)]
+	if !ok {
+		ca.misses += 1
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.Expires) {
+		ca.remove(el)
+		ca.misses += 1
+		return nil
+	}
+	ca.lru.MoveToFront(el)
+	ca.hits += 1
+	return e
+}
+
+// freshness returns how long the response with header h may be cached, 0 if it may not
+func (ca *cache) freshness(h http.Header, now time.Time) time.Duration {
+	cc := parseCacheControl(h)
+	for _, d := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := cc[d]; ok {
+			return 0
+		}
+	}
+	if h.Get("Set-Cookie") != "" {
+		return 0
+	}
+	if ca.ttl > 0 {
+		return ca.ttl
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return 0
+			}
+			return time.Duration(n) * time.Second
+		}
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		return expires.Sub(date)
+	}
+	return ca.defaultTTL
+}
+
+// store caches the response to r, if cacheable
+func (ca *cache) store(r *http.Request, status int, h http.Header, body []byte) {
+	if !cacheableStatus[status] {
+		return
+	}
+	now := time.Now()
+	ttl := ca.freshness(h, now)
+	if ttl <= 0 {
+		return
+	}
+	vary, ok := responseVary(h)
+	if !ok {
+		return
+	}
+	uri := uriKey(r)
+	e := &cacheEntry{
+		Key:     variantKey(uri, vary, r),
+		Path:    r.URL.Path,
+		Status:  status,
+		Header:  h,
+		Body:    body,
+		Stored:  now,
+		Expires: now.Add(ttl),
+		Vary:    vary,
+	}
+	if e.size() > ca.maxEntrySize {
+		return
+	}
+
+	ca.Lock()
+	if v, ok := ca.varies[uri]; ok && strings.Join(v.vary, ",") != strings.Join(vary, ",") {
+		// the variants keyed by the previous Vary are unreachable
+		ca.purge(func(e *cacheEntry) bool {
+			return e.uri() == uri
+		})
+	}
+	ca.add(e)
+	ca.Unlock()
+	ca.persist(e)
+}
+
+// add should be called with the lock held
+func (ca *cache) add(e *cacheEntry) {
+	if el, ok := ca.entries[e.Key]; ok {
+		ca.remove(el)
+	}
+	ca.entries[e.Key] = ca.lru.PushFront(e)
+	v, ok := ca.varies[e.uri()]
+	if !ok {
+		v = &variants{vary: e.Vary}
+		ca.varies[e.uri()] = v
+	}
+	v.n += 1
+	ca.size += e.size()
+	for ca.size > ca.maxSize {
+		ca.remove(ca.lru.Back())
+	}
+}
+
+// remove should be called with the lock held
+func (ca *cache) remove(el *list.Element) {
+	e := ca.lru.Remove(el).(*cacheEntry)
+	delete(ca.entries, e.Key)
+	ca.size -= e.size()
+	if v, ok := ca.varies[e.uri()]; ok {
+		v.n -= 1
+		if v.n <= 0 {
+			delete(ca.varies, e.uri())
+		}
+	}
+	if ca.dir != "" {
+		os.Remove(ca.file(e.Key))
+	}
+}
+
+// purge removes the entries matching, it should be called with the lock held
+func (ca *cache) purge(match func(*cacheEntry) bool) int {
+	n := 0
+	for el := ca.lru.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*cacheEntry)) {
+			ca.remove(el)
+			n += 1
+		}
+		el = next
+	}
+	return n
+}
+
+// file returns the path persisting the entry of key
+func (ca *cache) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(ca.dir, hex.EncodeToString(sum[:])+CACHE_FILE_SUFFIX)
+}
+
+func (ca *cache) persist(e *cacheEntry) {
+	if ca.dir == "" {
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		log.Errorf("Encode cache entry %s err=%v", e.Key, err)
+		return
+	}
+	if err := ioutil.WriteFile(ca.file(e.Key), buf.Bytes(), 0644); err != nil {
+		log.Errorf("Write cache entry %s err=%v", e.Key, err)
+	}
+}
+
+// load adds the fresh entries persisted in the directory, and deletes the others
+func (ca *cache) load() {
+	files, err := filepath.Glob(filepath.Join(ca.dir, "*"+CACHE_FILE_SUFFIX))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	entries := []*cacheEntry{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		e := &cacheEntry{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(e); err != nil || !now.Before(e.Expires) {
+			os.Remove(f)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	// the most recent entries are kept if the cache is full
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Stored.Before(entries[j].Stored)
+	})
+	ca.Lock()
+	defer ca.Unlock()
+	for _, e := range entries {
+		ca.add(e)
+	}
+	log.Infof("Loaded %d cached responses from %s", len(ca.entries), ca.dir)
+}
+
+// cacheWriter copies the response of the pool to store it
+type cacheWriter struct {
+	http.ResponseWriter
+	ca       *cache
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	tooLarge bool
+	// set by noStore
+	noStore bool
+}
+
+type cacheWriterKey struct{}
+
+// noStore keeps the response to r out of the cache, e.g. a response too large to buffer
+func noStore(r *http.Request) {
+	if cw, ok := r.Context().Value(cacheWriterKey{}).(*cacheWriter); ok {
+		cw.noStore = true
+	}
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if w.header != nil {
+		return
+	}
+	w.status = code
+	w.header = w.Header().Clone()
+	w.Header().Set("X-Cache", "MISS")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(data []byte) (int, error) {
+	if w.header == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.tooLarge {
+		if int64(w.body.Len()+len(data)) > w.ca.maxEntrySize {
+			w.tooLarge = true
+			w.body.Reset()
+		} else {
+			w.body.Write(data)
+		}
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *cacheWriter) Flush() {
+	if w.header == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	flush(w.ResponseWriter)
+}
+
+// Hijack hands the connection over, there is no response to store
+func (w *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.noStore = true
+	return hijack(w.ResponseWriter)
+}
+
+// complete reports whether the body has the length announced by the response
+func (w *cacheWriter) complete() bool {
+	cl := w.header.Get("Content-Length")
+	if cl == "" {
+		return true
+	}
+	n, err := strconv.ParseInt(cl, 10, 64)
+	return err == nil && n == int64(w.body.Len())
+}
+
+// serveCache responds r from the cache, or wraps w and r to cache the response.
+// The returned func should be called after the response is written, not if it is aborted
+func (s *VirtualServer) serveCache(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, bool, func()) {
+	ca := s.cache
+	if ca == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		r.Header.Get("Authorization") != "" {
+		return w, r, false, func() {}
+	}
+	cc := parseCacheControl(r.Header)
+	if _, ok := cc["no-store"]; ok {
+		return w, r, false, func() {}
+	}
+	_, noCache := cc["no-cache"]
+	if cc["max-age"] == "0" || r.Header.Get("Pragma") == "no-cache" {
+		noCache = true
+	}
+
+	if !noCache {
+		if e := ca.lookup(r); e != nil {
+			for k, vs := range e.Header {
+				w.Header()[k] = append([]string(nil), vs...)
+			}
+			w.Header().Set("Age", strconv.Itoa(int(time.Since(e.Stored)/time.Second)))
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(e.Status)
+			if r.Method != http.MethodHead {
+				w.Write(e.Body)
+			}
+			return w, r, true, func() {}
+		}
+	}
+	if r.Method == http.MethodHead {
+		w.Header().Set("X-Cache", "MISS")
+		return w, r, false, func() {}
+	}
+
+	cw := &cacheWriter{ResponseWriter: w, ca: ca}
+	r = r.WithContext(context.WithValue(r.Context(), cacheWriterKey{}, cw))
+	return cw, r, false, func() {
+		if cw.header != nil && !cw.tooLarge && !cw.noStore && cw.complete() {
+			ca.store(r, cw.status, cw.header, cw.body.Bytes())
+		}
+	}
+}
+
+// CacheStats returns nil if the cache is not enabled
+func (s *VirtualServer) CacheStats() *CacheStats {
+	ca := s.cache
+	if ca == nil {
+		return nil
+	}
+	ca.Lock()
+	defer ca.Unlock()
+	return &CacheStats{
+		Entries: len(ca.entries),
+		Size:    ca.size,
+		MaxSize: ca.maxSize,
+		Hits:    ca.hits,
+		Misses:  ca.misses,
+	}
+}
+
+// PurgeCache removes the cached responses whose path starts with prefix, all if empty,
+// and returns how many are removed
+func (s *VirtualServer) PurgeCache(prefix string) (int, error) {
+	ca := s.cache
+	if ca == nil {
+		return 0, ErrCacheNotEnabled
+	}
+	ca.Lock()
+	defer ca.Unlock()
+	n := ca.purge(func(e *cacheEntry) bool {
+		return strings.HasPrefix(e.Path, prefix)
+	})
+	log.Infof("[%s] purged %d cached responses with prefix %q", s.Name, n, prefix)
+	return n, nil
+}
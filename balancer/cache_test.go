@@ -0,0 +1,222 @@
+package balancer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func cacheUpstream(calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(calls, 1)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/static/"):
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case r.URL.Path == "/private":
+			w.Header().Set("Cache-Control", "private")
+		case r.URL.Path == "/lang":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			fmt.Fprintf(w, "%s ", r.Header.Get("Accept-Language"))
+		case r.URL.Path == "/expires":
+			w.Header().Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		case r.URL.Path == "/large":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(strings.Repeat("x", 2048)))
+		}
+		fmt.Fprintf(w, "%s %d", r.URL.Path, n)
+	}))
+}
+
+func newCacheVS(t *testing.T, upstream *httptest.Server, c config.Cache) *VirtualServer {
+	c.Enable = true
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		ServerNameOpt("localhost"),
+		PoolOpt([]config.Server{{Address: upstream.URL[7:], Weight: 1}}),
+		CacheOpt(c),
+	)
+	require.NoError(t, err)
+	return vs
+}
+
+func cacheGet(vs *VirtualServer, method, path string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.Host = "localhost"
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	vs.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestCache(t *testing.T) {
+	var calls int32
+	upstream := cacheUpstream(&calls)
+	defer upstream.Close()
+	vs := newCacheVS(t, upstream, config.Cache{MaxEntrySize: 1024})
+
+	tests := []struct {
+		method string
+		path   string
+		header map[string]string
+		xcache string
+		body   string
+	}{
+		{"GET", "/static/a.js", nil, "MISS", "/static/a.js 1"},
+		{"GET", "/static/a.js", nil, "HIT", "/static/a.js 1"},
+		{"HEAD", "/static/a.js", nil, "HIT", ""},
+		{"GET", "/static/a.js?v=2", nil, "MISS", "/static/a.js 2"},
+		// the client asks for a fresh response, which is stored
+		{"GET", "/static/a.js", map[string]string{"Cache-Control": "no-cache"}, "MISS", "/static/a.js 3"},
+		{"GET", "/static/a.js", nil, "HIT", "/static/a.js 3"},
+		{"GET", "/static/a.js", map[string]string{"Cache-Control": "no-store"}, "", "/static/a.js 4"},
+		{"GET", "/static/a.js", map[string]string{"Authorization": "Basic YTpi"}, "", "/static/a.js 5"},
+		{"GET", "/private", nil, "MISS", "/private 6"},
+		{"GET", "/private", nil, "MISS", "/private 7"},
+		// no freshness and no default ttl
+		{"GET", "/index.html", nil, "MISS", "/index.html 8"},
+		{"GET", "/index.html", nil, "MISS", "/index.html 9"},
+		{"GET", "/expires", nil, "MISS", "/expires 10"},
+		{"GET", "/expires", nil, "HIT", "/expires 10"},
+		{"GET", "/lang", map[string]string{"Accept-Language": "en"}, "MISS", "en /lang 11"},
+		{"GET", "/lang", map[string]string{"Accept-Language": "fr"}, "MISS", "fr /lang 12"},
+		{"GET", "/lang", map[string]string{"Accept-Language": "en"}, "HIT", "en /lang 11"},
+		{"GET", "/large", nil, "MISS", strings.Repeat("x", 2048) + "/large 13"},
+		{"GET", "/large", nil, "MISS", strings.Repeat("x", 2048) + "/large 14"},
+		{"POST", "/static/a.js", nil, "", "/static/a.js 15"},
+	}
+	for i, tt := range tests {
+		rr := cacheGet(vs, tt.method, tt.path, tt.header)
+		assert.Equal(t, 200, rr.Code, i)
+		assert.Equal(t, tt.xcache, rr.Header().Get("X-Cache"), i)
+		assert.Equal(t, tt.body, rr.Body.String(), i)
+	}
+
+	st := vs.CacheStats()
+	assert.Equal(t, 5, st.Entries)
+	assert.Equal(t, uint64(5), st.Hits)
+
+	n, err := vs.PurgeCache("/static/")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	rr := cacheGet(vs, "GET", "/static/a.js", nil)
+	assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+	n, err = vs.PurgeCache("")
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, 0, vs.CacheStats().Entries)
+	assert.Equal(t, int64(0), vs.CacheStats().Size)
+	assert.Empty(t, vs.cache.varies)
+}
+
+func TestCacheTTL(t *testing.T) {
+	var calls int32
+	upstream := cacheUpstream(&calls)
+	defer upstream.Close()
+
+	vs := newCacheVS(t, upstream, config.Cache{DefaultTTL: 60})
+	cacheGet(vs, "GET", "/index.html", nil)
+	assert.Equal(t, "HIT", cacheGet(vs, "GET", "/index.html", nil).Header().Get("X-Cache"))
+	// the override does not cache the private responses
+	vs = newCacheVS(t, upstream, config.Cache{TTL: 60})
+	cacheGet(vs, "GET", "/private", nil)
+	assert.Equal(t, "MISS", cacheGet(vs, "GET", "/private", nil).Header().Get("X-Cache"))
+	cacheGet(vs, "GET", "/index.html", nil)
+	assert.Equal(t, "HIT", cacheGet(vs, "GET", "/index.html", nil).Header().Get("X-Cache"))
+
+	// expired
+	vs.cache.Lock()
+	for el := vs.cache.lru.Front(); el != nil; el = el.Next() {
+		el.Value.(*cacheEntry).Expires = time.Now()
+	}
+	vs.cache.Unlock()
+	assert.Equal(t, "MISS", cacheGet(vs, "GET", "/index.html", nil).Header().Get("X-Cache"))
+}
+
+func TestCacheEviction(t *testing.T) {
+	var calls int32
+	upstream := cacheUpstream(&calls)
+	defer upstream.Close()
+	vs := newCacheVS(t, upstream, config.Cache{MaxSize: 300})
+
+	for i := 0; i < 10; i++ {
+		cacheGet(vs, "GET", fmt.Sprintf("/static/%d", i), nil)
+	}
+	st := vs.CacheStats()
+	assert.True(t, st.Size <= 300)
+	assert.True(t, st.Entries < 10)
+	// the least recently used are evicted
+	assert.Equal(t, "HIT", cacheGet(vs, "GET", "/static/9", nil).Header().Get("X-Cache"))
+	assert.Equal(t, "MISS", cacheGet(vs, "GET", "/static/0", nil).Header().Get("X-Cache"))
+}
+
+func TestCacheDir(t *testing.T) {
+	var calls int32
+	upstream := cacheUpstream(&calls)
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "golb-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	vs := newCacheVS(t, upstream, config.Cache{Dir: dir})
+	cacheGet(vs, "GET", "/static/a.js", nil)
+	cacheGet(vs, "GET", "/static/b.js", nil)
+	_, err = vs.PurgeCache("/static/b")
+	require.NoError(t, err)
+
+	// a restart loads the persisted responses
+	vs = newCacheVS(t, upstream, config.Cache{Dir: dir})
+	assert.Equal(t, 1, vs.CacheStats().Entries)
+	rr := cacheGet(vs, "GET", "/static/a.js", nil)
+	assert.Equal(t, "HIT", rr.Header().Get("X-Cache"))
+	assert.Equal(t, "/static/a.js 1", rr.Body.String())
+}
+
+func TestCacheTruncated(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte(strings.Repeat("x", 50)))
+		w.(http.Flusher).Flush()
+		// the peer dies mid-body
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+	}))
+	defer upstream.Close()
+	vs := newCacheVS(t, upstream, config.Cache{})
+	front := httptest.NewServer(vs)
+	defer front.Close()
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", front.URL+"/static/a.js", nil)
+		require.NoError(t, err)
+		req.Host = "localhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.NotEqual(t, "HIT", resp.Header.Get("X-Cache"))
+		}
+		assert.Error(t, err)
+	}
+	// the truncated response is not cached
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, 0, vs.CacheStats().Entries)
+}
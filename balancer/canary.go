@@ -0,0 +1,103 @@
+package balancer
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/onestraw/golb/config"
+)
+
+// canary routes a share of the requests not matching any rule to the pool of its own virtual server
+type canary struct {
+	percent float64
+	headers map[string]string
+	cookies map[string]string
+	vs      *VirtualServer
+	// requests routed to each pool
+	primary uint64
+	canary  uint64
+}
+
+// SplitStats counts the requests routed to the primary and the canary pool
+type SplitStats struct {
+	Percent    float64 `json:"percent"`
+	Primary    uint64  `json:"primary"`
+	Canary     uint64  `json:"canary"`
+	CanaryPool string  `json:"canary_pool"`
+	// the requests of the primary pool are in the stats of the virtual server
+	CanaryStats *VirtualServerStats `json:"canary_stats"`
+}
+
+// CanaryOpt routes c.Percent percent of the requests, and the requests matching all the
+// headers and cookies of c, to the canary pool. opts are applied to the virtual server of the canary.
+// It should be called after NameOpt, AddressOpt and ServerNameOpt
+func CanaryOpt(c config.Canary, opts ...VirtualServerOption) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if len(c.Pool) == 0 {
+			return nil
+		}
+		canaryOpts := []VirtualServerOption{
+			NameOpt(vs.Name + "/canary"),
+			AddressOpt(vs.Address),
+			ServerNameOpt(vs.ServerName),
+			LBMethodOpt(c.LBMethod),
+			PoolOpt(c.Pool),
+		}
+		cvs, err := NewVirtualServer(append(canaryOpts, opts...)...)
+		if err != nil {
+			return err
+		}
+		vs.canary = &canary{
+			percent: c.Percent,
+			headers: c.Headers,
+			cookies: c.Cookies,
+			vs:      cvs,
+		}
+		return nil
+	}
+}
+
+// match returns true if r has all the headers and cookies of the canary
+func (c *canary) match(r *http.Request) bool {
+	if len(c.headers) == 0 && len(c.cookies) == 0 {
+		return false
+	}
+	for k, v := range c.headers {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	for k, v := range c.cookies {
+		cookie, err := r.Cookie(k)
+		if err != nil || cookie.Value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// pick returns true if r should be routed to the canary pool, and counts the split
+func (c *canary) pick(r *http.Request) bool {
+	if c.match(r) || (c.percent > 0 && rand.Float64()*100 < c.percent) {
+		atomic.AddUint64(&c.canary, 1)
+		return true
+	}
+	atomic.AddUint64(&c.primary, 1)
+	return false
+}
+
+// SplitStats returns nil if the canary is not configured
+func (s *VirtualServer) SplitStats() *SplitStats {
+	c := s.canary
+	if c == nil {
+		return nil
+	}
+	return &SplitStats{
+		Percent:     c.percent,
+		Primary:     atomic.LoadUint64(&c.primary),
+		Canary:      atomic.LoadUint64(&c.canary),
+		CanaryPool:  c.vs.Pool.String(),
+		CanaryStats: c.vs.StatsReport(),
+	}
+}
@@ -0,0 +1,71 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestCanary(t *testing.T) {
+	primary := httptest.NewServer(newHandler("primary"))
+	canary := httptest.NewServer(newHandler("canary"))
+	api := httptest.NewServer(newHandler("api"))
+	jsonBody := fmt.Sprintf(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8097",
+		"pool":[{"address":"%s"}],
+		"rules":[{"path_prefix":"/api/","pool":[{"address":"%s"}]}],
+		"canary":{"percent":20,"headers":{"X-Canary":"true"},"cookies":{"release":"beta"},"pool":[{"address":"%s"}]}}]}`,
+		primary.URL[7:], api.URL[7:], canary.URL[7:])
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := New(c.VServers)
+	require.NoError(t, err)
+	vs := b.VServers[0]
+
+	get := func(path string, header, cookie string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = "localhost"
+		if header != "" {
+			r.Header.Set("X-Canary", header)
+		}
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "release", Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		vs.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	result := map[string]int{}
+	for i := 0; i < 1000; i += 1 {
+		result[get("/", "", "")] += 1
+	}
+	assert.InDelta(t, 200, result["canary"], 60)
+	assert.Equal(t, 1000, result["canary"]+result["primary"])
+
+	// both the header and the cookie are required
+	assert.Equal(t, "canary", get("/", "true", "beta"))
+	// the rules are not split
+	assert.Equal(t, "api", get("/api/users", "true", "beta"))
+
+	split := vs.SplitStats()
+	assert.Equal(t, 20.0, split.Percent)
+	assert.Equal(t, uint64(result["primary"]), split.Primary)
+	assert.Equal(t, uint64(result["canary"]+1), split.Canary)
+	assert.Equal(t, canary.URL[7:], split.CanaryPool)
+	assert.Equal(t, "web/canary", split.CanaryStats.Name)
+
+	route, err := b.Route(&RouteRequest{Host: "localhost", Headers: map[string]string{"X-Canary": "true", "Cookie": "release=beta"}})
+	require.NoError(t, err)
+	assert.Equal(t, "web/canary", route.Rule)
+	assert.Equal(t, canary.URL[7:], route.Pool)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), CanaryOpt(config.Canary{Percent: 50}))
+	require.NoError(t, err)
+	assert.Nil(t, vs.SplitStats())
+}
@@ -0,0 +1,215 @@
+package balancer
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	DEFAULT_API_KEY_HEADER = "X-API-Key"
+	DEFAULT_AUTH_REALM     = "golb"
+)
+
+// clientAuth authenticates the clients by basic auth or API key
+type clientAuth struct {
+	// user -> hash of the htpasswd file, nil if basic auth is disabled
+	users     map[string]string
+	realm     string
+	keys      [][]byte
+	keyHeader string
+}
+
+// ClientAuthOpt rejects with a 401 the requests without the credentials of a user of
+// the htpasswd file, or one of the API keys, either is enough if both are configured
+func ClientAuthOpt(c config.ClientAuth) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.Htpasswd == "" && len(c.APIKeys) == 0 {
+			return nil
+		}
+		ca := &clientAuth{realm: c.Realm, keyHeader: c.APIKeyHeader}
+		if ca.realm == "" {
+			ca.realm = DEFAULT_AUTH_REALM
+		}
+		if ca.keyHeader == "" {
+			ca.keyHeader = DEFAULT_API_KEY_HEADER
+		}
+		if c.Htpasswd != "" {
+			users, err := loadHtpasswd(c.Htpasswd)
+			if err != nil {
+				return err
+			}
+			ca.users = users
+		}
+		for _, key := range c.APIKeys {
+			if key == "" {
+				return ErrEmptyAPIKey
+			}
+			ca.keys = append(ca.keys, []byte(key))
+		}
+		vs.clientAuth = ca
+		vs.clientAuthConf = c
+		return nil
+	}
+}
+
+// loadHtpasswd returns the users of an htpasswd file, hashed by
+// htpasswd -B (bcrypt), -m (Apache MD5) or -s (SHA1)
+func loadHtpasswd(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, ErrHtpasswdLine)
+		}
+		hash := line[i+1:]
+		if !isBcrypt(hash) && !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, ErrHtpasswdHash)
+		}
+		users[line[:i]] = hash
+	}
+	return users, scanner.Err()
+}
+
+// isBcrypt returns true if hash is a bcrypt hash, $2y$ of htpasswd -B or $2a$, $2b$ of the other tools
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$")
+}
+
+// checkPassword returns true if password matches the htpasswd hash
+func checkPassword(hash, password string) bool {
+	if isBcrypt(hash) {
+		// bcrypt compares in constant time, and costs as much as the hash asks
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	var computed string
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	} else {
+		parts := strings.SplitN(hash, "$", 4)
+		if len(parts) != 4 {
+			return false
+		}
+		computed = apr1(password, parts[2])
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1 returns the Apache MD5 crypt of password with salt
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 != 0 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+		final = c.Sum(nil)
+	}
+
+	var out []byte
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return magic + salt + "$" + string(out)
+}
+
+// authenticated returns true if r has valid credentials
+func (ca *clientAuth) authenticated(r *http.Request) bool {
+	if key := r.Header.Get(ca.keyHeader); key != "" {
+		for _, k := range ca.keys {
+			if subtle.ConstantTimeCompare([]byte(key), k) == 1 {
+				return true
+			}
+		}
+	}
+	if ca.users != nil {
+		if username, password, ok := r.BasicAuth(); ok {
+			hash, found := ca.users[username]
+			return found && checkPassword(hash, password)
+		}
+	}
+	return false
+}
+
+// withClientAuth passes the authenticated requests only
+func (s *VirtualServer) withClientAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.clientAuth.authenticated(r) {
+			log.WithFields(log.Fields{"event": "client_auth", "vs": s.Name, "remote": r.RemoteAddr}).
+				Infof("Unauthorized %s %s%s", r.Method, r.Host, r.URL)
+			if s.clientAuth.users != nil {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", s.clientAuth.realm))
+			}
+			s.writeError(w, r, ErrUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,92 @@
+package balancer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestHtpasswd(t *testing.T) {
+	// openssl passwd -apr1 -salt saltsalt secret
+	assert.Equal(t, "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", apr1("secret", "saltsalt"))
+	assert.True(t, checkPassword("$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret"))
+	assert.False(t, checkPassword("$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "wrong"))
+	assert.True(t, checkPassword("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret"))
+	assert.False(t, checkPassword("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "Secret"))
+	// htpasswd -B writes $2y$, the other tools $2a$ or $2b$, all the same algorithm
+	for _, prefix := range []string{"$2y$", "$2a$", "$2b$"} {
+		hash := prefix + "05$.EGXiZq33T6G8CqbXUreauN.r4rqyJjvoN.EhW8qEup5BqfHFAbNe"
+		assert.True(t, checkPassword(hash, "secret"), prefix)
+		assert.False(t, checkPassword(hash, "wrong"), prefix)
+	}
+	assert.False(t, checkPassword("$2y$05$abcdefghijklmnopqrstuu", "secret"))
+
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "htpasswd")
+	require.NoError(t, ioutil.WriteFile(file, []byte("alice:$2y$05$.EGXiZq33T6G8CqbXUreauN.r4rqyJjvoN.EhW8qEup5BqfHFAbNe\n"), 0644))
+	users, err := loadHtpasswd(file)
+	require.NoError(t, err)
+	assert.True(t, checkPassword(users["alice"], "secret"))
+	require.NoError(t, ioutil.WriteFile(file, []byte("alice:$1$salt$hash\n"), 0644))
+	_, err = loadHtpasswd(file)
+	assert.Contains(t, err.Error(), ErrHtpasswdHash.Error())
+	require.NoError(t, ioutil.WriteFile(file, []byte("alice\n"), 0644))
+	_, err = loadHtpasswd(file)
+	assert.Contains(t, err.Error(), ErrHtpasswdLine.Error())
+}
+
+func TestClientAuth(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "htpasswd")
+	require.NoError(t, ioutil.WriteFile(file, []byte("# dashboards\nalice:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0644))
+
+	_, err = NewVirtualServer(ClientAuthOpt(config.ClientAuth{APIKeys: []string{""}}))
+	assert.Equal(t, ErrEmptyAPIKey, err)
+
+	c := config.ClientAuth{Htpasswd: file, APIKeys: []string{"k1", "k2"}}
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		ServerNameOpt("localhost"),
+		PoolOpt([]config.Server{{Address: s.URL[7:], Weight: 1}}),
+		ClientAuthOpt(c),
+	)
+	require.NoError(t, err)
+	serve := func(set func(r *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		set(req)
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(func(r *http.Request) {})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="golb"`, w.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusOK, serve(func(r *http.Request) { r.SetBasicAuth("alice", "secret") }).Code)
+	assert.Equal(t, http.StatusOK, serve(func(r *http.Request) { r.SetBasicAuth("bob", "secret") }).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(func(r *http.Request) { r.SetBasicAuth("carol", "secret") }).Code)
+	assert.Equal(t, http.StatusOK, serve(func(r *http.Request) { r.Header.Set("X-Api-Key", "k2") }).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(func(r *http.Request) { r.Header.Set("X-Api-Key", "k3") }).Code)
+
+	assert.Equal(t, c, vs.EffectiveConfig().ClientAuth)
+}
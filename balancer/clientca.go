@@ -0,0 +1,98 @@
+package balancer
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ClientCAOpt requires the clients to present a certificate signed by a CA of caFile,
+// caFile is checked for changes every watch (0 disables it), and may be reloaded by
+// ReloadClientCA. It should be called after ProtocolOpt
+func ClientCAOpt(caFile string, watch time.Duration) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if vs.Protocol != PROTO_HTTPS || caFile == "" {
+			return nil
+		}
+		vs.ClientCAFile = caFile
+		vs.clientCAWatch = watch
+		return vs.ReloadClientCA()
+	}
+}
+
+// ReloadClientCA reads the CA bundle again, the established connections are untouched,
+// the bundle in use is kept on error
+func (s *VirtualServer) ReloadClientCA() error {
+	if s.ClientCAFile == "" {
+		return ErrClientCANotConfigured
+	}
+	s.ca_lock.Lock()
+	defer s.ca_lock.Unlock()
+	info, err := os.Stat(s.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(s.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificate found in %s", s.ClientCAFile)
+	}
+	s.clientCAs.Store(pool)
+	s.clientCAMtime = info.ModTime()
+	log.Infof("[%s] loaded client CA bundle %s", s.Name, s.ClientCAFile)
+	return nil
+}
+
+// verifyClientCert verifies the client certificate chain against the current bundle
+func (s *VirtualServer) verifyClientCert(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("client certificate required")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         s.clientCAs.Load().(*x509.CertPool),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+func (s *VirtualServer) clientCALoop(stop chan struct{}) {
+	ticker := time.NewTicker(s.clientCAWatch)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(s.ClientCAFile)
+			s.ca_lock.Lock()
+			unchanged := err != nil || info.ModTime().Equal(s.clientCAMtime)
+			s.ca_lock.Unlock()
+			if unchanged {
+				continue
+			}
+			if err := s.ReloadClientCA(); err != nil {
+				log.Errorf("[%s] reload client CA err=%v", s.Name, err)
+			}
+		}
+	}
+}
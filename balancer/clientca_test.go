@@ -0,0 +1,99 @@
+package balancer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCert creates a certificate signed by parent, self-signed if parent is nil
+func newCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func pemOf(certs ...*x509.Certificate) []byte {
+	data := []byte{}
+	for _, c := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return data
+}
+
+func TestClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca1, key1 := newCert(t, "ca1", nil, nil)
+	ca2, key2 := newCert(t, "ca2", nil, nil)
+	client1, _ := newCert(t, "client1", ca1, key1)
+	client2, _ := newCert(t, "client2", ca2, key2)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, pemOf(ca1), 0600))
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":443"),
+		ProtocolOpt(PROTO_HTTPS),
+		TLSOpt("../examples/https/server.pem", "../examples/https/server.key"),
+		ClientCAOpt(caFile, 0),
+	)
+	require.NoError(t, err)
+	cfg, err := vs.serverTLSConfig()
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAnyClientCert, cfg.ClientAuth)
+	verify := cfg.VerifyPeerCertificate
+
+	assert.NoError(t, verify([][]byte{client1.Raw}, nil))
+	assert.NotNil(t, verify([][]byte{client2.Raw}, nil))
+	assert.NotNil(t, verify(nil, nil))
+
+	// a new customer CA
+	require.NoError(t, ioutil.WriteFile(caFile, pemOf(ca1, ca2), 0600))
+	require.NoError(t, vs.ReloadClientCA())
+	assert.NoError(t, verify([][]byte{client1.Raw}, nil))
+	assert.NoError(t, verify([][]byte{client2.Raw}, nil))
+
+	// a broken bundle keeps the one in use
+	require.NoError(t, ioutil.WriteFile(caFile, []byte("garbage"), 0600))
+	assert.NotNil(t, vs.ReloadClientCA())
+	assert.NoError(t, verify([][]byte{client2.Raw}, nil))
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), ClientCAOpt(caFile, 0))
+	require.NoError(t, err)
+	assert.Equal(t, "", vs.ClientCAFile)
+	assert.Equal(t, ErrClientCANotConfigured, vs.ReloadClientCA())
+}
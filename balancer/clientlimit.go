@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// clientLimiter bounds the concurrent requests per client IP
+type clientLimiter struct {
+	sync.Mutex
+	max    int
+	active map[string]int
+}
+
+// ClientLimitOpt limits the concurrent requests of every client IP to max, the requests
+// over it get 429. 0 means unlimited
+func ClientLimitOpt(max int) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if max < 0 {
+			return ErrNegativeClientLimit
+		}
+		if max == 0 {
+			return nil
+		}
+		vs.clientLimiter = &clientLimiter{max: max, active: make(map[string]int)}
+		return nil
+	}
+}
+
+func (l *clientLimiter) acquire(client string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.active[client] >= l.max {
+		return false
+	}
+	l.active[client] += 1
+	return true
+}
+
+func (l *clientLimiter) release(client string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.active[client] <= 1 {
+		delete(l.active, client)
+		return
+	}
+	l.active[client] -= 1
+}
+
+// withClientLimit responds 429 to the requests of a client over its concurrent requests
+func withClientLimit(next http.Handler, l *clientLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientIP(r.RemoteAddr)
+		if !l.acquire(client) {
+			log.Warnf("%s - %s %s%s over %d concurrent requests", r.RemoteAddr, r.Method, r.Host, r.URL, l.max)
+			WriteError(w, ErrTooManyRequests)
+			return
+		}
+		defer l.release(client)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,60 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestClientLimit(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer s1.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		PoolOpt([]config.Server{{Address: s1.URL[7:], Weight: 1}}),
+		ClientLimitOpt(1),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 1, vs.EffectiveConfig().Limits.ClientMaxConns)
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+	done := make(chan int)
+	go func() { done <- serve("10.0.0.1:1000").Code }()
+	<-started
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.1:2000").Code)
+
+	go func() { done <- serve("10.0.0.2:1000").Code }()
+	<-started
+	release <- struct{}{}
+	release <- struct{}{}
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	// released
+	go func() { done <- serve("10.0.0.1:3000").Code }()
+	<-started
+	release <- struct{}{}
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Empty(t, vs.clientLimiter.active)
+
+	_, err = NewVirtualServer(ClientLimitOpt(-1))
+	assert.Equal(t, ErrNegativeClientLimit, err)
+}
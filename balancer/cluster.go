@@ -0,0 +1,298 @@
+package balancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	DEFAULT_CLUSTER_INTERVAL = time.Second
+	// a member missing the gossip rounds for CLUSTER_STALE_ROUNDS intervals is forgotten,
+	// the peers it saw failing are marked up again
+	CLUSTER_STALE_ROUNDS = 3
+	// path of the controller receiving the gossip
+	CLUSTER_PATH = "/cluster"
+)
+
+// ClusterState is the gossip of a golb instance to the other members of the cluster
+type ClusterState struct {
+	Node string `json:"node"`
+	// peers failing the health check, ejected or over max fails on the node, by virtual server
+	Down map[string][]string `json:"down,omitempty"`
+	// tokens taken on the node since its previous gossip, by rate limit and client IP
+	Taken map[string]map[string]float64 `json:"taken,omitempty"`
+}
+
+// Member is a golb instance of the cluster, with the last state it gossiped
+type Member struct {
+	Node string              `json:"node"`
+	Seen time.Time           `json:"seen"`
+	Down map[string][]string `json:"down"`
+}
+
+// Cluster shares the peer failures and the rate limit counters of b with the other golb instances,
+// the sticky choices of the hashing methods need no sharing, every instance hashes the same way
+type Cluster struct {
+	b        *Balancer
+	node     string
+	members  []string
+	interval time.Duration
+	auth     config.Authentication
+	client   *http.Client
+
+	lock    sync.Mutex
+	states  map[string]*Member
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+// StartCluster gossips with the members of c every interval until stopped, see config.Cluster
+func (b *Balancer) StartCluster(c config.Cluster) (*Cluster, error) {
+	if c.Node == "" {
+		return nil, ErrClusterNodeEmpty
+	}
+	interval := time.Duration(c.Interval) * time.Second
+	if interval <= 0 {
+		interval = DEFAULT_CLUSTER_INTERVAL
+	}
+	cl := &Cluster{
+		b:        b,
+		node:     c.Node,
+		members:  c.Members,
+		interval: interval,
+		auth:     c.Auth,
+		client:   &http.Client{Timeout: interval},
+		states:   make(map[string]*Member),
+		stop:     make(chan struct{}),
+	}
+	b.Lock()
+	b.cluster = cl
+	b.Unlock()
+	go cl.loop()
+	log.Infof("Cluster node %s gossiping with %s every %s", c.Node, strings.Join(c.Members, ","), interval)
+	return cl, nil
+}
+
+// Cluster returns the cluster of b, nil if not started
+func (b *Balancer) Cluster() *Cluster {
+	b.RLock()
+	defer b.RUnlock()
+	return b.cluster
+}
+
+// Stop stops the gossip, the peers held down by the cluster are marked up
+func (cl *Cluster) Stop() {
+	cl.stopped.Do(func() {
+		close(cl.stop)
+		cl.lock.Lock()
+		cl.states = make(map[string]*Member)
+		cl.lock.Unlock()
+		cl.apply()
+	})
+}
+
+func (cl *Cluster) loop() {
+	ticker := time.NewTicker(cl.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cl.stop:
+			return
+		case <-ticker.C:
+			cl.gossip()
+			cl.expire()
+		}
+	}
+}
+
+// gossip posts the state of this node to every member
+func (cl *Cluster) gossip() {
+	data, _ := json.Marshal(cl.state())
+	for _, m := range cl.members {
+		go func(m string) {
+			req, err := http.NewRequest("POST", strings.TrimSuffix(m, "/")+CLUSTER_PATH, bytes.NewReader(data))
+			if err != nil {
+				log.Errorf("Cluster gossip to %s error=%v", m, err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if cl.auth.Username != "" {
+				req.SetBasicAuth(cl.auth.Username, cl.auth.Password)
+			}
+			resp, err := cl.client.Do(req)
+			if err != nil {
+				log.Warnf("Cluster gossip to %s error=%v", m, err)
+				return
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				log.Warnf("Cluster gossip to %s, status %d", m, resp.StatusCode)
+			}
+		}(m)
+	}
+}
+
+// state returns the state of this node, the tokens taken are counted from the previous call
+func (cl *Cluster) state() *ClusterState {
+	state := &ClusterState{
+		Node:  cl.node,
+		Down:  make(map[string][]string),
+		Taken: make(map[string]map[string]float64),
+	}
+	for _, vs := range cl.b.virtualServers() {
+		if down := vs.failingPeers(); len(down) > 0 {
+			state.Down[vs.Name] = down
+		}
+	}
+	for key, l := range cl.rateLimiters() {
+		if taken := l.drainTaken(); len(taken) > 0 {
+			state.Taken[key] = taken
+		}
+	}
+	return state
+}
+
+// rateLimiters returns the rate limiters of the virtual servers by their cluster-wide key
+func (cl *Cluster) rateLimiters() map[string]*rateLimiter {
+	limiters := make(map[string]*rateLimiter)
+	for _, vs := range cl.b.virtualServers() {
+		if vs.rateLimiter == nil {
+			continue
+		}
+		if vs.rateLimit.Shared != "" {
+			limiters["shared/"+vs.rateLimit.Shared] = vs.rateLimiter
+		} else {
+			limiters["vs/"+vs.Name] = vs.rateLimiter
+		}
+	}
+	return limiters
+}
+
+// Merge applies the state gossiped by another member
+func (cl *Cluster) Merge(state *ClusterState) error {
+	if state.Node == "" || state.Node == cl.node {
+		return ErrClusterNode
+	}
+	now := time.Now()
+	limiters := cl.rateLimiters()
+	for key, taken := range state.Taken {
+		l, ok := limiters[key]
+		if !ok {
+			continue
+		}
+		for client, n := range taken {
+			l.consume(client, n, now)
+		}
+	}
+
+	cl.lock.Lock()
+	if _, ok := cl.states[state.Node]; !ok {
+		log.Infof("Cluster member %s joined", state.Node)
+	}
+	cl.states[state.Node] = &Member{Node: state.Node, Seen: now, Down: state.Down}
+	cl.lock.Unlock()
+	cl.apply()
+	return nil
+}
+
+// expire forgets the members which stopped gossiping
+func (cl *Cluster) expire() {
+	cl.lock.Lock()
+	expired := false
+	for node, m := range cl.states {
+		if time.Since(m.Seen) > CLUSTER_STALE_ROUNDS*cl.interval {
+			log.Warnf("Cluster member %s left, last seen %s", node, m.Seen.Format(time.RFC3339))
+			delete(cl.states, node)
+			expired = true
+		}
+	}
+	cl.lock.Unlock()
+	if expired {
+		cl.apply()
+	}
+}
+
+// apply holds down the peers seen failing by any member
+func (cl *Cluster) apply() {
+	cl.lock.Lock()
+	down := make(map[string]map[string]bool)
+	for _, m := range cl.states {
+		for name, peers := range m.Down {
+			if down[name] == nil {
+				down[name] = make(map[string]bool)
+			}
+			for _, peer := range peers {
+				down[name][peer] = true
+			}
+		}
+	}
+	cl.lock.Unlock()
+	for _, vs := range cl.b.virtualServers() {
+		vs.setClusterDown(down[vs.Name])
+	}
+}
+
+// Members returns the members heard from, sorted by node
+func (cl *Cluster) Members() []Member {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	result := make([]Member, 0, len(cl.states))
+	for _, m := range cl.states {
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Node < result[j].Node
+	})
+	return result
+}
+
+// failingPeers returns the peers seen failing by s itself, not the ones held down by the cluster
+func (s *VirtualServer) failingPeers() []string {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+	result := []string{}
+	for _, peer := range s.Pool.Peers() {
+		_, ejected := s.ejections[peer]
+		if s.unhealthy[peer] || ejected || s.failed(peer) {
+			result = append(result, peer)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// setClusterDown holds down the peers of s seen failing by the cluster, and releases the others
+func (s *VirtualServer) setClusterDown(down map[string]bool) {
+	s.pool_lock.Lock()
+	defer s.pool_lock.Unlock()
+	for peer := range s.clusterDown {
+		if down[peer] {
+			continue
+		}
+		delete(s.clusterDown, peer)
+		if !s.heldDown(peer) && !s.failed(peer) {
+			log.Infof("[%s] peer %s is up in the cluster", s.Name, peer)
+			s.upPeer(peer, REASON_CLUSTER)
+		}
+	}
+	for peer := range down {
+		if s.clusterDown[peer] || !s.hasPeer(peer) {
+			continue
+		}
+		log.Warnf("[%s] peer %s is down in the cluster", s.Name, peer)
+		s.clusterDown[peer] = true
+		s.downPeer(peer, REASON_CLUSTER)
+	}
+}
@@ -0,0 +1,147 @@
+package balancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func newClusterNode(t *testing.T, node string, members ...string) (*Balancer, *Cluster) {
+	b, err := New([]config.VirtualServer{{
+		Name:      "web",
+		Address:   "127.0.0.1:80",
+		Pool:      []config.Server{{Address: "127.0.0.1:10001", Weight: 1}, {Address: "127.0.0.1:10002", Weight: 1}},
+		RateLimit: config.RateLimit{Rate: 0.01, Burst: 2},
+	}})
+	require.NoError(t, err)
+	cl, err := b.StartCluster(config.Cluster{Node: node, Members: members, Interval: 60})
+	require.NoError(t, err)
+	return b, cl
+}
+
+func isDown(vs *VirtualServer, peer string) bool {
+	vs.pool_lock.RLock()
+	defer vs.pool_lock.RUnlock()
+	return vs.down[peer]
+}
+
+func TestClusterPeerDown(t *testing.T) {
+	_, err := (&Balancer{}).StartCluster(config.Cluster{})
+	assert.Equal(t, ErrClusterNodeEmpty, err)
+
+	b, cl := newClusterNode(t, "golb-1")
+	defer cl.Stop()
+	assert.True(t, b.Cluster() == cl)
+	vs, err := b.FindVirtualServer("web")
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrClusterNode, cl.Merge(&ClusterState{Node: "golb-1"}))
+	require.NoError(t, cl.Merge(&ClusterState{Node: "golb-2", Down: map[string][]string{
+		"web": {"127.0.0.1:10001", "127.0.0.1:10009"}, "api": {"127.0.0.1:10002"},
+	}}))
+	assert.True(t, isDown(vs, "127.0.0.1:10001"))
+	assert.False(t, isDown(vs, "127.0.0.1:10002"))
+	// held down by the cluster only, not gossiped back
+	assert.Empty(t, vs.failingPeers())
+	members := cl.Members()
+	require.Len(t, members, 1)
+	assert.Equal(t, "golb-2", members[0].Node)
+
+	require.NoError(t, cl.Merge(&ClusterState{Node: "golb-2"}))
+	assert.False(t, isDown(vs, "127.0.0.1:10001"))
+
+	// a member gone silent is forgotten
+	require.NoError(t, cl.Merge(&ClusterState{Node: "golb-3", Down: map[string][]string{"web": {"127.0.0.1:10002"}}}))
+	assert.True(t, isDown(vs, "127.0.0.1:10002"))
+	cl.lock.Lock()
+	cl.states["golb-3"].Seen = time.Now().Add(-CLUSTER_STALE_ROUNDS * 2 * cl.interval)
+	cl.lock.Unlock()
+	cl.expire()
+	assert.False(t, isDown(vs, "127.0.0.1:10002"))
+	assert.Len(t, cl.Members(), 1)
+}
+
+func TestClusterRateLimit(t *testing.T) {
+	b, cl := newClusterNode(t, "golb-1")
+	defer cl.Stop()
+	vs, err := b.FindVirtualServer("web")
+	require.NoError(t, err)
+
+	// not counted before the first gossip
+	ok, _ := vs.rateLimiter.take("10.0.0.1", time.Now())
+	assert.True(t, ok)
+	assert.Empty(t, cl.state().Taken)
+	ok, _ = vs.rateLimiter.take("10.0.0.1", time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, map[string]map[string]float64{"vs/web": {"10.0.0.1": 1}}, cl.state().Taken)
+	assert.Empty(t, cl.state().Taken)
+
+	// the burst of 10.0.0.2 is taken on another node
+	require.NoError(t, cl.Merge(&ClusterState{Node: "golb-2", Taken: map[string]map[string]float64{
+		"vs/web": {"10.0.0.2": 2}, "vs/api": {"10.0.0.3": 2},
+	}}))
+	ok, _ = vs.rateLimiter.take("10.0.0.2", time.Now())
+	assert.False(t, ok)
+	ok, _ = vs.rateLimiter.take("10.0.0.3", time.Now())
+	assert.True(t, ok)
+}
+
+func TestClusterGossip(t *testing.T) {
+	b2, cl2 := newClusterNode(t, "golb-2")
+	defer cl2.Stop()
+	received := make(chan struct{}, 1)
+	member := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if r.Method != "POST" || r.URL.Path != CLUSTER_PATH || user != "admin" || password != "admin" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var state ClusterState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cl2.Merge(&state)
+		received <- struct{}{}
+	}))
+	defer member.Close()
+
+	b1, err := New([]config.VirtualServer{{
+		Name:    "web",
+		Address: "127.0.0.1:80",
+		Pool:    []config.Server{{Address: "127.0.0.1:10001", Weight: 1}},
+	}})
+	require.NoError(t, err)
+	cl1, err := b1.StartCluster(config.Cluster{Node: "golb-1", Members: []string{member.URL + "/"},
+		Interval: 60, Auth: config.Authentication{Username: "admin", Password: "admin"}})
+	require.NoError(t, err)
+	defer cl1.Stop()
+
+	vs1, err := b1.FindVirtualServer("web")
+	require.NoError(t, err)
+	vs1.pool_lock.Lock()
+	vs1.unhealthy["127.0.0.1:10001"] = true
+	vs1.downPeer("127.0.0.1:10001", REASON_HEALTH)
+	vs1.pool_lock.Unlock()
+
+	cl1.gossip()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gossip not received")
+	}
+	vs2, err := b2.FindVirtualServer("web")
+	require.NoError(t, err)
+	assert.True(t, isDown(vs2, "127.0.0.1:10001"))
+	assert.False(t, isDown(vs2, "127.0.0.1:10002"))
+
+	cl2.Stop()
+	assert.False(t, isDown(vs2, "127.0.0.1:10001"))
+}
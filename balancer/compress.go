@@ -0,0 +1,287 @@
+package balancer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	ENCODING_BR   = "br"
+	ENCODING_GZIP = "gzip"
+
+	DEFAULT_COMPRESS_MIN_SIZE = 1024
+	DEFAULT_BROTLI_LEVEL      = 4
+)
+
+// DefaultCompressEncodings are offered if no encoding is configured, by order of preference
+var DefaultCompressEncodings = []string{ENCODING_BR, ENCODING_GZIP}
+
+// DefaultCompressTypes are compressed if no type is configured
+var DefaultCompressTypes = []string{
+	"text/", "application/json", "application/javascript", "application/xml", "image/svg+xml",
+}
+
+// encoder is a *gzip.Writer or a *brotli.Writer
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compressor encodes the responses, the writers are reused
+type compressor struct {
+	encodings   []string
+	types       []string
+	minSize     int64
+	level       int
+	brotliLevel int
+	writers     map[string]*sync.Pool
+
+	responses uint64
+	inBytes   uint64
+	outBytes  uint64
+}
+
+// CompressionStats counts the compressed responses
+type CompressionStats struct {
+	Responses uint64 `json:"responses"`
+	// bytes of the compressed responses before and after compression
+	InBytes  uint64 `json:"in_bytes"`
+	OutBytes uint64 `json:"out_bytes"`
+	Saved    uint64 `json:"saved"`
+}
+
+// CompressionOpt encodes the responses with brotli or gzip for the clients accepting it
+func CompressionOpt(c config.Compression) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if !c.Enable {
+			return nil
+		}
+		if c.Level < gzip.HuffmanOnly || c.Level > gzip.BestCompression ||
+			c.BrotliLevel < 0 || c.BrotliLevel > brotli.BestCompression {
+			return ErrCompressionLevel
+		}
+		for _, e := range c.Encodings {
+			if e != ENCODING_BR && e != ENCODING_GZIP {
+				return ErrCompressionEncoding
+			}
+		}
+		cp := &compressor{
+			encodings:   c.Encodings,
+			types:       c.Types,
+			minSize:     c.MinSize,
+			level:       c.Level,
+			brotliLevel: c.BrotliLevel,
+		}
+		if len(cp.encodings) == 0 {
+			cp.encodings = DefaultCompressEncodings
+		}
+		if len(cp.types) == 0 {
+			cp.types = DefaultCompressTypes
+		}
+		if cp.minSize <= 0 {
+			cp.minSize = DEFAULT_COMPRESS_MIN_SIZE
+		}
+		if cp.level == 0 {
+			cp.level = gzip.DefaultCompression
+		}
+		if cp.brotliLevel == 0 {
+			cp.brotliLevel = DEFAULT_BROTLI_LEVEL
+		}
+		cp.writers = map[string]*sync.Pool{
+			ENCODING_GZIP: {New: func() interface{} {
+				gz, _ := gzip.NewWriterLevel(nil, cp.level)
+				return gz
+			}},
+			ENCODING_BR: {New: func() interface{} {
+				return brotli.NewWriterLevel(nil, cp.brotliLevel)
+			}},
+		}
+		vs.compressor = cp
+		return nil
+	}
+}
+
+// acceptedEncoding returns the encoding of encodings with the highest q value in the
+// Accept-Encoding of r, the first one for a tie, "" if none is accepted
+func acceptedEncoding(r *http.Request, encodings []string) string {
+	qs := map[string]float64{}
+	for _, v := range r.Header["Accept-Encoding"] {
+		for _, item := range strings.Split(v, ",") {
+			parts := strings.Split(item, ";")
+			coding := strings.ToLower(strings.TrimSpace(parts[0]))
+			q := 1.0
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(param[2:], 64)
+				}
+			}
+			qs[coding] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, e := range encodings {
+		q, ok := qs[e]
+		if !ok {
+			// * stands for the codings not listed
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// compressible returns true if the response with header h and status code should be compressed
+func (cp *compressor) compressible(h http.Header, code int) bool {
+	if code < 200 || code == http.StatusNoContent || code == http.StatusPartialContent ||
+		code == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if l := h.Get("Content-Length"); l != "" {
+		if n, err := strconv.ParseInt(l, 10, 64); err == nil && n < cp.minSize {
+			return false
+		}
+	}
+	contentType := h.Get("Content-Type")
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, t := range cp.types {
+		if contentType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// countWriter counts the bytes written to the client
+type countWriter struct {
+	http.ResponseWriter
+	n uint64
+}
+
+func (w *countWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.n += uint64(n)
+	return n, err
+}
+
+// compressWriter decides to compress when the status is written
+type compressWriter struct {
+	http.ResponseWriter
+	cp          *compressor
+	encoding    string
+	out         *countWriter
+	enc         encoder
+	in          uint64
+	wroteHeader bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if w.cp.compressible(h, code) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		w.out = &countWriter{ResponseWriter: w.ResponseWriter}
+		w.enc = w.cp.writers[w.encoding].Get().(encoder)
+		w.enc.Reset(w.out)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	w.in += uint64(len(data))
+	return w.enc.Write(data)
+}
+
+// Flush sends the data compressed so far
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	flush(w.ResponseWriter)
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+// close flushes the compressed data and records the stats
+func (w *compressWriter) close() {
+	if w.enc == nil {
+		return
+	}
+	w.enc.Close()
+	w.cp.writers[w.encoding].Put(w.enc)
+	w.enc = nil
+	atomic.AddUint64(&w.cp.responses, 1)
+	atomic.AddUint64(&w.cp.inBytes, w.in)
+	atomic.AddUint64(&w.cp.outBytes, w.out.n)
+}
+
+// compress wraps w if r accepts one of the encodings, the returned func should be called after
+// the response is written
+func (s *VirtualServer) compress(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	cp := s.compressor
+	if cp == nil || r.Method == http.MethodHead {
+		return w, func() {}
+	}
+	encoding := acceptedEncoding(r, cp.encodings)
+	if encoding == "" {
+		return w, func() {}
+	}
+	cw := &compressWriter{ResponseWriter: w, cp: cp, encoding: encoding}
+	return cw, cw.close
+}
+
+// CompressionStats returns nil if compression is not enabled
+func (s *VirtualServer) CompressionStats() *CompressionStats {
+	cp := s.compressor
+	if cp == nil {
+		return nil
+	}
+	st := &CompressionStats{
+		Responses: atomic.LoadUint64(&cp.responses),
+		InBytes:   atomic.LoadUint64(&cp.inBytes),
+		OutBytes:  atomic.LoadUint64(&cp.outBytes),
+	}
+	if st.InBytes > st.OutBytes {
+		st.Saved = st.InBytes - st.OutBytes
+	}
+	return st
+}
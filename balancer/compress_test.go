@@ -0,0 +1,143 @@
+package balancer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		expect string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate, gzip;q=0.8", "gzip"},
+		{"br", "br"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, br;q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.5, br;q=0", "gzip"},
+		{"*;q=0.5, gzip;q=0, br;q=0", ""},
+		{"GZIP", "gzip"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept-Encoding", tt.accept)
+		}
+		assert.Equal(t, tt.expect, acceptedEncoding(r, DefaultCompressEncodings), tt.accept)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, br")
+	assert.Equal(t, "gzip", acceptedEncoding(r, []string{ENCODING_GZIP, ENCODING_BR}))
+	assert.Equal(t, "", acceptedEncoding(r, nil))
+}
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat(`{"key":"value"},`, 200)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("Content-Length", fmt.Sprint(len(large)))
+			w.Write([]byte(large))
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("hello"))
+		case "/png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large))
+		case "/encoded":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "deflate")
+			w.Write([]byte(large))
+		}
+	}))
+	defer upstream.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		ServerNameOpt("localhost"),
+		PoolOpt([]config.Server{{Address: upstream.URL[7:], Weight: 1}}),
+		CompressionOpt(config.Compression{Enable: true}),
+	)
+	require.NoError(t, err)
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = "localhost"
+		if accept != "" {
+			r.Header.Set("Accept-Encoding", accept)
+		}
+		rr := httptest.NewRecorder()
+		vs.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := get("/json", "gzip")
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	assert.Empty(t, rr.Header().Get("Content-Length"))
+	assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+	compressed := rr.Body.Len()
+	assert.True(t, compressed < len(large))
+	gz, err := gzip.NewReader(rr.Body)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(data))
+
+	rr = get("/json", "gzip, br")
+	assert.Equal(t, "br", rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+	brCompressed := rr.Body.Len()
+	assert.True(t, brCompressed < len(large))
+	data, err = ioutil.ReadAll(brotli.NewReader(rr.Body))
+	require.NoError(t, err)
+	assert.Equal(t, large, string(data))
+
+	for _, tt := range []struct{ path, accept string }{
+		{"/json", ""},
+		{"/json", "deflate"},
+		{"/small", "gzip"},
+		{"/png", "gzip"},
+		{"/encoded", "gzip"},
+	} {
+		rr = get(tt.path, tt.accept)
+		assert.NotEqual(t, "gzip", rr.Header().Get("Content-Encoding"), tt.path)
+		assert.NotEqual(t, "br", rr.Header().Get("Content-Encoding"), tt.path)
+	}
+
+	st := vs.CompressionStats()
+	assert.Equal(t, uint64(2), st.Responses)
+	assert.Equal(t, uint64(2*len(large)), st.InBytes)
+	assert.Equal(t, uint64(compressed+brCompressed), st.OutBytes)
+	assert.Equal(t, uint64(2*len(large)-compressed-brCompressed), st.Saved)
+
+	_, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		CompressionOpt(config.Compression{Enable: true, Level: 10}))
+	assert.Equal(t, ErrCompressionLevel, err)
+	_, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		CompressionOpt(config.Compression{Enable: true, BrotliLevel: 12}))
+	assert.Equal(t, ErrCompressionLevel, err)
+	_, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		CompressionOpt(config.Compression{Enable: true, Encodings: []string{"deflate"}}))
+	assert.Equal(t, ErrCompressionEncoding, err)
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"))
+	require.NoError(t, err)
+	assert.Nil(t, vs.CompressionStats())
+}
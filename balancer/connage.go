@@ -0,0 +1,351 @@
+package balancer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+// DEFAULT_CONN_AGE_GRACE is the time an aged connection may finish its requests
+const DEFAULT_CONN_AGE_GRACE = 30 * time.Second
+
+// ConnAgeOpt closes the client connections older than max, so the long-lived clients reconnect
+// and are spread again by the load balancers or DNS in front of golb. The next response of an aged
+// connection has "Connection: close", which closes a HTTP/1.1 connection after it, and sends a
+// GOAWAY on a HTTP/2 connection to finish the streams in flight. An idle aged connection is closed
+// at once, and any connection is closed grace (0 means DEFAULT_CONN_AGE_GRACE) after it is aged.
+// A hijacked connection has no request to finish, it is tracked until it is closed and closed at
+// its max age, after a close frame "going away" if it is a WebSocket.
+// The virtual servers sharing an address use the lowest max of them, 0 disables it
+func ConnAgeOpt(c config.ConnectionAge) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.Max <= 0 {
+			return nil
+		}
+		vs.connAge = time.Duration(c.Max) * time.Second
+		vs.connAgeGrace = time.Duration(c.Grace) * time.Second
+		if vs.connAgeGrace <= 0 {
+			vs.connAgeGrace = DEFAULT_CONN_AGE_GRACE
+		}
+		return nil
+	}
+}
+
+type connStartKey struct{}
+
+// agedConn is a client connection tracked for its age
+type agedConn struct {
+	start    time.Time
+	idle     bool
+	aged     bool
+	hijacked bool
+	// set once the hijacked connection is handed over
+	conn  *hijackedConn
+	timer *time.Timer
+}
+
+// connAge returns the lowest max age of the virtual servers and its grace, 0 if disabled
+func (l *listener) connAge() (time.Duration, time.Duration) {
+	l.RLock()
+	defer l.RUnlock()
+
+	var age, grace time.Duration
+	for _, vs := range l.vservers {
+		if vs.connAge > 0 && (age == 0 || vs.connAge < age) {
+			age, grace = vs.connAge, vs.connAgeGrace
+		}
+	}
+	return age, grace
+}
+
+func (l *listener) connContext(ctx context.Context, c net.Conn) context.Context {
+	ctx = context.WithValue(ctx, connBandwidthKey{}, &connBandwidth{})
+	return context.WithValue(ctx, connStartKey{}, time.Now())
+}
+
+func (l *listener) connState(c net.Conn, state http.ConnState) {
+	l.conns_lock.Lock()
+	defer l.conns_lock.Unlock()
+
+	ac, tracked := l.conns[c]
+	switch state {
+	case http.StateNew:
+		age, grace := l.connAge()
+		if age <= 0 {
+			return
+		}
+		ac = &agedConn{start: time.Now()}
+		ac.timer = time.AfterFunc(age, func() { l.expire(c, grace) })
+		l.conns[c] = ac
+	case http.StateActive:
+		if tracked {
+			ac.idle = false
+		}
+	case http.StateIdle:
+		if !tracked {
+			return
+		}
+		ac.idle = true
+		if ac.aged {
+			c.Close()
+		}
+	case http.StateHijacked:
+		// no more state is reported, it is untracked by hijackedConn.Close
+		if tracked {
+			ac.idle = false
+			ac.hijacked = true
+		}
+	case http.StateClosed:
+		if tracked {
+			ac.timer.Stop()
+			delete(l.conns, c)
+		}
+	}
+}
+
+// untrack stops tracking the hijacked connection c
+func (l *listener) untrack(c net.Conn) {
+	l.conns_lock.Lock()
+	defer l.conns_lock.Unlock()
+
+	if ac, ok := l.conns[c]; ok {
+		ac.timer.Stop()
+		delete(l.conns, c)
+	}
+}
+
+// hijacked registers hc, the hijacked connection c handed over
+func (l *listener) hijacked(c net.Conn, hc *hijackedConn) {
+	l.conns_lock.Lock()
+	defer l.conns_lock.Unlock()
+
+	if ac, ok := l.conns[c]; ok {
+		ac.conn = hc
+	}
+}
+
+// expire closes c if it is idle, or else after grace
+func (l *listener) expire(c net.Conn, grace time.Duration) {
+	l.conns_lock.Lock()
+	defer l.conns_lock.Unlock()
+
+	ac, ok := l.conns[c]
+	if !ok {
+		return
+	}
+	ac.aged = true
+	if ac.hijacked {
+		delete(l.conns, c)
+		if ac.conn != nil {
+			// it may wait for the frame being written
+			go ac.conn.goAway(grace)
+			return
+		}
+		log.Infof("%s closing hijacked connection %s at its max age", l.address, c.RemoteAddr())
+		c.Close()
+		return
+	}
+	if ac.idle {
+		c.Close()
+		return
+	}
+	ac.timer = time.AfterFunc(grace, func() {
+		log.Infof("%s closing connection %s, %v after its max age", l.address, c.RemoteAddr(), grace)
+		c.Close()
+	})
+}
+
+// ageWriter closes an aged connection with the response
+type ageWriter struct {
+	http.ResponseWriter
+	l           *listener
+	start       time.Time
+	age         time.Duration
+	wroteHeader bool
+	// the request upgrades to a WebSocket
+	websocket bool
+}
+
+func (w *ageWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if time.Since(w.start) >= w.age {
+			w.Header().Set("Connection", "close")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ageWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	flush(w.ResponseWriter)
+}
+
+func (w *ageWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack hands the connection over, it is still tracked for its age until closed
+func (w *ageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, brw, err := hijack(w.ResponseWriter)
+	if err != nil {
+		return nil, nil, err
+	}
+	hc := &hijackedConn{Conn: c, l: w.l}
+	if w.websocket {
+		hc.frames = &wsFrames{}
+	}
+	w.l.hijacked(c, hc)
+	return hc, brw, nil
+}
+
+// WS_CLOSE_GOING_AWAY is a WebSocket close frame with the status 1001, going away
+var WS_CLOSE_GOING_AWAY = []byte{0x88, 0x02, 0x03, 0xe9}
+
+// hijackedConn untracks the connection when it is closed. The frames written to a WebSocket
+// are followed, so that a close frame is sent between two of them
+type hijackedConn struct {
+	net.Conn
+	l *listener
+
+	sync.Mutex
+	// nil if it is not a WebSocket
+	frames *wsFrames
+	// the close frame is sent once the frame being written ends
+	goingAway bool
+}
+
+func (c *hijackedConn) Write(b []byte) (int, error) {
+	if c.frames == nil {
+		return c.Conn.Write(b)
+	}
+	c.Lock()
+	defer c.Unlock()
+	n, err := c.Conn.Write(b)
+	c.frames.follow(b[:n])
+	if c.goingAway && c.frames.boundary() {
+		c.sendClose()
+	}
+	return n, err
+}
+
+func (c *hijackedConn) Close() error {
+	c.l.untrack(c.Conn)
+	return c.Conn.Close()
+}
+
+// goAway closes c at its max age, a WebSocket after a close frame, sent at once between two
+// frames or else when the frame being written ends, which may take up to grace
+func (c *hijackedConn) goAway(grace time.Duration) {
+	log.Infof("%s closing hijacked connection %s at its max age", c.l.address, c.RemoteAddr())
+	if c.frames == nil {
+		c.Close()
+		return
+	}
+	time.AfterFunc(grace, func() { c.Close() })
+	c.Lock()
+	defer c.Unlock()
+	if c.frames.boundary() {
+		c.sendClose()
+		return
+	}
+	c.goingAway = true
+}
+
+// sendClose writes the close frame and closes c, c should be locked
+func (c *hijackedConn) sendClose() {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Conn.Write(WS_CLOSE_GOING_AWAY)
+	c.Close()
+}
+
+// wsFrames follows the frames written to a WebSocket client, see RFC 6455 section 5.2
+type wsFrames struct {
+	// the start of the header of the next frame
+	header []byte
+	// the bytes left in the payload of the current frame
+	payload uint64
+}
+
+func (f *wsFrames) follow(b []byte) {
+	for len(b) > 0 {
+		if f.payload > 0 {
+			n := uint64(len(b))
+			if n > f.payload {
+				n = f.payload
+			}
+			f.payload -= n
+			b = b[n:]
+			continue
+		}
+		f.header = append(f.header, b[0])
+		b = b[1:]
+		if size, ok := f.headerSize(); ok && len(f.header) == size {
+			f.payload = f.payloadLen()
+			f.header = f.header[:0]
+		}
+	}
+}
+
+// headerSize returns the size of the header, false until its second byte is known
+func (f *wsFrames) headerSize() (int, bool) {
+	if len(f.header) < 2 {
+		return 0, false
+	}
+	size := 2
+	switch f.header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if f.header[1]&0x80 != 0 {
+		// masked
+		size += 4
+	}
+	return size, true
+}
+
+// payloadLen returns the payload length of the complete header
+func (f *wsFrames) payloadLen() uint64 {
+	switch n := f.header[1] & 0x7f; n {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(f.header[2:]))
+	case 127:
+		return binary.BigEndian.Uint64(f.header[2:])
+	default:
+		return uint64(n)
+	}
+}
+
+// boundary reports whether the bytes followed end a frame
+func (f *wsFrames) boundary() bool {
+	return f.payload == 0 && len(f.header) == 0
+}
+
+// withConnAge wraps w if the connections of the listener have a max age
+func (l *listener) withConnAge(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	start, ok := r.Context().Value(connStartKey{}).(time.Time)
+	if !ok {
+		return w
+	}
+	if age, _ := l.connAge(); age > 0 {
+		websocket := strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+		return &ageWriter{ResponseWriter: w, l: l, start: start, age: age, websocket: websocket}
+	}
+	return w
+}
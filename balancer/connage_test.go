@@ -0,0 +1,250 @@
+package balancer
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestConnAge(t *testing.T) {
+	s1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte("s1"))
+	}))
+	defer s1.Close()
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8113"),
+		PoolOpt([]config.Server{{Address: s1.URL[7:], Weight: 1}}),
+		ConnAgeOpt(config.ConnectionAge{Max: 60}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, config.ConnectionAge{Max: 60, Grace: 30}, vs.EffectiveConfig().ConnectionAge)
+	vs.connAge = 200 * time.Millisecond
+	vs.connAgeGrace = time.Second
+	require.NoError(t, vs.Run())
+	defer vs.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8113")
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	get := func(path string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		require.NoError(t, req.Write(conn))
+		resp, err := http.ReadResponse(br, req)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "s1", string(body))
+		return resp
+	}
+
+	assert.False(t, get("/").Close)
+	// aged in the request, closed with the response
+	assert.True(t, get("/slow").Close)
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+
+	// an idle aged connection is closed at once
+	conn2, err := net.Dial("tcp", "127.0.0.1:8113")
+	require.NoError(t, err)
+	defer conn2.Close()
+	conn, br = conn2, bufio.NewReader(conn2)
+	assert.False(t, get("/").Close)
+	conn2.SetReadDeadline(time.Now().Add(time.Second))
+	begin := time.Now()
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, time.Since(begin) < 280*time.Millisecond, "closed after %v", time.Since(begin))
+}
+
+// wsFrame returns a final text frame of payload, masked as sent by a client
+func wsFrame(payload []byte, masked bool) []byte {
+	frame := []byte{0x81}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	if len(payload) < 126 {
+		frame = append(frame, maskBit|byte(len(payload)))
+	} else {
+		frame = append(frame, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	key := []byte{1, 2, 3, 4}
+	frame = append(frame, key...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+// wsReadFrame returns the opcode and the unmasked payload of the next frame
+func wsReadFrame(r *bufio.Reader) (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+	size := int(head[1] & 0x7f)
+	if size == 126 {
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		size = int(ext[0])<<8 | int(ext[1])
+	}
+	key := make([]byte, 4)
+	if head[1]&0x80 != 0 {
+		if _, err := io.ReadFull(r, key); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= key[i%4]
+	}
+	return head[0] & 0x0f, payload, nil
+}
+
+func TestConnAgeHijacked(t *testing.T) {
+	// echoes the messages of a WebSocket, "split" is answered by a frame written in two halves,
+	// the second one after the max age of the client connection
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Flush()
+		for {
+			_, msg, err := wsReadFrame(brw.Reader)
+			if err != nil {
+				return
+			}
+			if string(msg) == "split" {
+				frame := wsFrame([]byte(strings.Repeat("x", 200)), false)
+				conn.Write(frame[:50])
+				time.Sleep(300 * time.Millisecond)
+				conn.Write(frame[50:])
+				continue
+			}
+			conn.Write(wsFrame(msg, false))
+		}
+	}))
+	defer upstream.Close()
+
+	// the response writers wrapped by the options pass the hijack through
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8123"),
+		PoolOpt([]config.Server{{Address: upstream.URL[7:], Weight: 1}}),
+		ConnAgeOpt(config.ConnectionAge{Max: 60}),
+		RetryOpt(true),
+		PeerHeadersOpt(true),
+		ServerTimingOpt(true),
+		CompressionOpt(config.Compression{Enable: true}),
+		BandwidthOpt(config.Bandwidth{PerConnection: 1 << 20}),
+	)
+	require.NoError(t, err)
+	vs.connAge = 200 * time.Millisecond
+	vs.connAgeGrace = time.Second
+	require.NoError(t, vs.Run())
+	defer vs.Stop()
+	l := vs.runningListener()
+	require.NotNil(t, l)
+
+	upgrade := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", "127.0.0.1:8123")
+		require.NoError(t, err)
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n" +
+			"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		conn.Write(wsFrame([]byte("ping"), true))
+		_, msg, err := wsReadFrame(br)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(msg))
+		return conn, br
+	}
+	waitConns := func(n int) {
+		for i := 0; i < 50 && l.activeConns() != n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, n, l.activeConns())
+	}
+	// the close frame "going away" and the end of the connection
+	goneAway := func(br *bufio.Reader) {
+		opcode, msg, err := wsReadFrame(br)
+		require.NoError(t, err)
+		assert.Equal(t, byte(0x8), opcode)
+		assert.Equal(t, []byte{0x03, 0xe9}, msg)
+		_, err = br.ReadByte()
+		assert.Equal(t, io.EOF, err)
+	}
+
+	// untracked when closed
+	conn, _ := upgrade()
+	assert.Equal(t, 1, l.activeConns())
+	conn.Close()
+	waitConns(0)
+
+	// closed at its max age, not after the grace
+	conn, br := upgrade()
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	begin := time.Now()
+	goneAway(br)
+	assert.True(t, time.Since(begin) < 280*time.Millisecond, "closed after %v", time.Since(begin))
+	waitConns(0)
+
+	// the frame being written at the max age is not cut
+	conn, br = upgrade()
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.Write(wsFrame([]byte("split"), true))
+	_, msg, err := wsReadFrame(br)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("x", 200), string(msg))
+	goneAway(br)
+	waitConns(0)
+}
+
+func TestWSFrames(t *testing.T) {
+	f := &wsFrames{}
+	assert.True(t, f.boundary())
+	frame := wsFrame([]byte(strings.Repeat("x", 300)), true)
+	for _, b := range frame[:len(frame)-1] {
+		f.follow([]byte{b})
+		assert.False(t, f.boundary())
+	}
+	f.follow(frame[len(frame)-1:])
+	assert.True(t, f.boundary())
+	f.follow(append(wsFrame(nil, false), wsFrame([]byte("ab"), false)...))
+	assert.True(t, f.boundary())
+}
@@ -0,0 +1,233 @@
+package balancer
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// request header enabling the trace, its value should be the debug token of the virtual server
+	DEBUG_HEADER = "X-Golb-Debug"
+	// response header describing the upstream selection
+	TRACE_HEADER = "X-Golb-Trace"
+	// request header forcing the pool member serving the request
+	UPSTREAM_HEADER = "X-Golb-Upstream"
+)
+
+// DebugOpt adds a X-Golb-Trace header to the responses of the requests whose X-Golb-Debug
+// header is token: the virtual server and lb method serving it, the peers considered
+// with the reason they are skipped, and the peer chosen by each try, an empty token disables it
+func DebugOpt(token string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.debugToken = token
+		return nil
+	}
+}
+
+// UpstreamOverrideOpt sends the requests whose X-Golb-Upstream header is a pool member to it,
+// even if it is down, to debug a single peer, if enable. Only the clients whose IP is in allowFrom,
+// IPs or CIDRs, empty means loopback only, may use the header, it is ignored for the others
+func UpstreamOverrideOpt(enable bool, allowFrom []string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.upstreamOverride = enable
+		vs.upstreamAllowFrom = allowFrom
+		vs.upstreamACL = nil
+		for _, cidr := range allowFrom {
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 8 * len(ip.To4())
+				if bits == 0 {
+					bits = 128
+				}
+				cidr = fmt.Sprintf("%s/%d", cidr, bits)
+			}
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return err
+			}
+			vs.upstreamACL = append(vs.upstreamACL, ipnet)
+		}
+		return nil
+	}
+}
+
+type traceKey struct{}
+
+type upstreamKey struct{}
+
+// upstreamAllowed returns true if the client at remoteAddr may force the upstream
+func upstreamAllowed(remoteAddr string, acl []*net.IPNet) bool {
+	ip := net.ParseIP(clientIP(remoteAddr))
+	if ip == nil {
+		return false
+	}
+	if len(acl) == 0 {
+		return ip.IsLoopback()
+	}
+	for _, ipnet := range acl {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withUpstream keeps the upstream forced by the allowed clients for all the tries,
+// the header is not passed to the peers
+func withUpstream(next http.Handler, acl []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream := r.Header.Get(UPSTREAM_HEADER)
+		if upstream == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(UPSTREAM_HEADER)
+		if !upstreamAllowed(r.RemoteAddr, acl) {
+			log.Warnf("%s - %s %s%s not allowed to force upstream %s", r.RemoteAddr, r.Method, r.Host, r.URL, upstream)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if addr, _, err := peerAddress(upstream, PROTO_HTTP); err == nil {
+			upstream = addr
+		}
+		r = r.WithContext(context.WithValue(r.Context(), upstreamKey{}, upstream))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forcedUpstream returns the upstream forced for r, empty if none
+func forcedUpstream(r *http.Request) string {
+	upstream, _ := r.Context().Value(upstreamKey{}).(string)
+	return upstream
+}
+
+// selectionTrace is shared by the tries of a request
+type selectionTrace struct {
+	sync.Mutex
+	vs         string
+	method     string
+	candidates []string
+	tries      []string
+}
+
+func (t *selectionTrace) String() string {
+	t.Lock()
+	defer t.Unlock()
+	retries := len(t.tries) - 1
+	if retries < 0 {
+		retries = 0
+	}
+	return fmt.Sprintf("vs=%s; method=%s; candidates=%s; tries=%s; retries=%d",
+		t.vs, t.method, strings.Join(t.candidates, ","), strings.Join(t.tries, ","), retries)
+}
+
+// traceWriter sets the trace header right before the status is written
+type traceWriter struct {
+	http.ResponseWriter
+	t           *selectionTrace
+	wroteHeader bool
+}
+
+func (w *traceWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(TRACE_HEADER, w.t.String())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *traceWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	flush(w.ResponseWriter)
+}
+
+func (w *traceWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+func (w *traceWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// withTrace traces the requests debugged by token across the tries,
+// the debug header is not passed to the peers
+func withTrace(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		debug := r.Header.Get(DEBUG_HEADER)
+		if debug == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(DEBUG_HEADER)
+		if subtle.ConstantTimeCompare([]byte(debug), []byte(token)) != 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t := &selectionTrace{}
+		r = r.WithContext(context.WithValue(r.Context(), traceKey{}, t))
+		next.ServeHTTP(&traceWriter{ResponseWriter: w, t: t}, r)
+	})
+}
+
+// traceTry records the peer chosen by a try of r and the pool it is chosen from, if r is traced
+func (s *VirtualServer) traceTry(r *http.Request, peer string, code int) {
+	t, ok := r.Context().Value(traceKey{}).(*selectionTrace)
+	if !ok {
+		return
+	}
+	method := s.LBMethod
+	if method == LB_COSISTENTHASH || method == LB_IPHASH {
+		method += "(key=" + s.hashKey(r) + ")"
+	}
+	candidates := []string{}
+	s.pool_lock.RLock()
+	for _, p := range s.Pool.Peers() {
+		if state := s.peerState(p); state != "" {
+			p += "(" + state + ")"
+		}
+		candidates = append(candidates, p)
+	}
+	s.pool_lock.RUnlock()
+
+	t.Lock()
+	defer t.Unlock()
+	t.vs = s.Name
+	t.method = method
+	t.candidates = candidates
+	t.tries = append(t.tries, fmt.Sprintf("%s:%d", peer, code))
+}
+
+// peerState returns why peer is not selected, empty if it may be, pool_lock should be held
+func (s *VirtualServer) peerState(peer string) string {
+	switch {
+	case s.drained[peer]:
+		return "drained"
+	case s.unhealthy[peer]:
+		return "unhealthy"
+	}
+	if _, ok := s.ejections[peer]; ok {
+		return "ejected"
+	}
+	if f, ok := s.faults[peer]; ok && f.Down {
+		return "fault"
+	}
+	if d, ok := s.decommissions[peer]; ok && d.active() {
+		return "decommissioning"
+	}
+	if s.failed(peer) {
+		return "failed"
+	}
+	return ""
+}
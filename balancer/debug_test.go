@@ -0,0 +1,127 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestDebugTrace(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// not passed to the peers
+		assert.Empty(t, r.Header.Get(DEBUG_HEADER))
+		w.Write([]byte("good"))
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer bad.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8109"),
+		ServerNameOpt("localhost"),
+		PoolOpt([]config.Server{
+			{Address: bad.URL[7:], Weight: 1},
+			{Address: good.URL[7:], Weight: 1},
+			{Address: "127.0.0.1:10001", Weight: 0}}),
+		RetryOpt(true),
+		DebugOpt("secret"),
+	)
+	require.NoError(t, err)
+
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		if token != "" {
+			req.Header.Set(DEBUG_HEADER, token)
+		}
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// retried once the bad peer is chosen
+	var trace string
+	for i := 0; i < 3 && !strings.HasSuffix(trace, "retries=1"); i++ {
+		w := serve("secret")
+		assert.Equal(t, "good", w.Body.String())
+		trace = w.Header().Get(TRACE_HEADER)
+	}
+	assert.Contains(t, trace, "vs=web; method=round-robin; candidates=")
+	assert.Contains(t, trace, "127.0.0.1:10001(drained)")
+	assert.Contains(t, trace, "tries="+bad.URL[7:]+":502,"+good.URL[7:]+":200; retries=1")
+
+	w := serve("")
+	assert.Empty(t, w.Header().Get(TRACE_HEADER))
+	w = serve("wrong")
+	assert.Equal(t, "good", w.Body.String())
+	assert.Empty(t, w.Header().Get(TRACE_HEADER))
+
+	assert.Equal(t, config.Debug{Token: "secret"}, vs.EffectiveConfig().Debug)
+}
+
+func TestUpstreamOverride(t *testing.T) {
+	peer := func(label string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// not passed to the peers
+			assert.Empty(t, r.Header.Get(UPSTREAM_HEADER))
+			w.Write([]byte(label))
+		}))
+	}
+	a, b := peer("a"), peer("b")
+	defer a.Close()
+	defer b.Close()
+
+	newVS := func(allowFrom []string) *VirtualServer {
+		vs, err := NewVirtualServer(
+			NameOpt("web"),
+			AddressOpt("127.0.0.1:8120"),
+			ServerNameOpt("localhost"),
+			PoolOpt([]config.Server{{Address: a.URL[7:], Weight: 1}, {Address: b.URL[7:], Weight: 1}}),
+			RetryOpt(true),
+			UpstreamOverrideOpt(true, allowFrom),
+		)
+		require.NoError(t, err)
+		return vs
+	}
+	serve := func(vs *VirtualServer, remoteAddr, upstream string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(UPSTREAM_HEADER, upstream)
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	vs := newVS(nil)
+	// forced even if down
+	vs.Pool.DownPeer(b.URL[7:])
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "b", serve(vs, "127.0.0.1:5000", b.URL[7:]).Body.String())
+	}
+	// not loopback, ignored
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "a", serve(vs, "192.0.2.1:5000", b.URL[7:]).Body.String())
+	}
+	w := serve(vs, "127.0.0.1:5000", "127.0.0.1:10001")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrUpstreamNotInPool.ErrMsg, w.Body.String())
+
+	vs = newVS([]string{"192.0.2.0/24", "198.51.100.7"})
+	assert.Equal(t, "b", serve(vs, "192.0.2.1:5000", b.URL[7:]).Body.String())
+	assert.Equal(t, "b", serve(vs, "198.51.100.7:5000", b.URL[7:]).Body.String())
+	assert.Equal(t, config.Debug{Upstream: true, AllowFrom: []string{"192.0.2.0/24", "198.51.100.7"}},
+		vs.EffectiveConfig().Debug)
+
+	_, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), UpstreamOverrideOpt(true, []string{"10.0.0.0/33"}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,226 @@
+package balancer
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// decommission states, draining -> verified -> removed, or aborted before removed
+const (
+	DECOMMISSION_DRAINING = "draining"
+	// no traffic in the quiet period, waiting for the confirmation
+	DECOMMISSION_VERIFIED = "verified"
+	DECOMMISSION_REMOVED  = "removed"
+	DECOMMISSION_ABORTED  = "aborted"
+
+	DEFAULT_QUIET_PERIOD = 5 * time.Minute
+)
+
+// interval between the checks of the traffic of the draining peers
+var decommissionTick = time.Second
+
+// Decommission drains a peer, verifies it has no traffic for the quiet period, and removes it
+type Decommission struct {
+	Peer  string `json:"address"`
+	State string `json:"state"`
+	// seconds without traffic before the peer can be removed
+	QuietPeriod int64 `json:"quiet_period"`
+	// remove the peer once verified, without confirmation
+	AutoRemove bool      `json:"auto_remove"`
+	Started    time.Time `json:"started"`
+	// last time a request to the peer was seen completing
+	LastTraffic time.Time `json:"last_traffic"`
+	Updated     time.Time `json:"updated"`
+
+	quiet time.Duration
+	// requests recorded in the stats of the peer at the last check
+	count uint64
+	abort chan struct{}
+}
+
+// active returns true if the peer is held down by the decommission
+func (d *Decommission) active() bool {
+	return d.State == DECOMMISSION_DRAINING || d.State == DECOMMISSION_VERIFIED
+}
+
+// hasPeer returns true if peer is a pool member
+func (s *VirtualServer) hasPeer(peer string) bool {
+	for _, p := range s.Pool.Peers() {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// peerRequests returns the number of the requests completed by peer
+func (s *VirtualServer) peerRequests(peer string) uint64 {
+	s.ss_lock.RLock()
+	defer s.ss_lock.RUnlock()
+	if ss, ok := s.ServerStats[peer]; ok {
+		return ss.Count()
+	}
+	return 0
+}
+
+// StartDecommission stops sending new requests to peer, and removes it after no request is seen
+// completing for quiet (0 means 5 minutes), if autoRemove, or else after ConfirmDecommission
+func (s *VirtualServer) StartDecommission(peer string, quiet time.Duration, autoRemove bool) (*Decommission, error) {
+	if !s.hasPeer(peer) {
+		return nil, ErrPeerNotInPool
+	}
+	if quiet <= 0 {
+		quiet = DEFAULT_QUIET_PERIOD
+	}
+	now := time.Now()
+	d := &Decommission{
+		Peer:        peer,
+		State:       DECOMMISSION_DRAINING,
+		QuietPeriod: int64(quiet / time.Second),
+		AutoRemove:  autoRemove,
+		Started:     now,
+		LastTraffic: now,
+		Updated:     now,
+		quiet:       quiet,
+		count:       s.peerRequests(peer),
+		abort:       make(chan struct{}),
+	}
+
+	s.pool_lock.Lock()
+	if old, ok := s.decommissions[peer]; ok && old.active() {
+		s.pool_lock.Unlock()
+		return nil, ErrDecommissionExisted
+	}
+	s.decommissions[peer] = d
+	s.downPeer(peer, REASON_DECOMMISSION)
+	s.pool_lock.Unlock()
+
+	log.WithFields(log.Fields{"event": "decommission", "vs": s.Name, "peer": peer}).
+		Infof("Draining peer %s, quiet period %v, auto remove %v", peer, quiet, autoRemove)
+	go s.watchDecommission(d)
+	return d.copy(), nil
+}
+
+// copy returns a snapshot of d, pool_lock should be held if d is shared
+func (d *Decommission) copy() *Decommission {
+	return &Decommission{
+		Peer:        d.Peer,
+		State:       d.State,
+		QuietPeriod: d.QuietPeriod,
+		AutoRemove:  d.AutoRemove,
+		Started:     d.Started,
+		LastTraffic: d.LastTraffic,
+		Updated:     d.Updated,
+	}
+}
+
+// setState should be called with pool_lock held
+func (s *VirtualServer) setState(d *Decommission, state string) {
+	log.WithFields(log.Fields{"event": "decommission", "vs": s.Name, "peer": d.Peer}).
+		Infof("Decommission of peer %s: %s -> %s", d.Peer, d.State, state)
+	d.State = state
+	d.Updated = time.Now()
+}
+
+// watchDecommission moves d forward until it is removed or aborted
+func (s *VirtualServer) watchDecommission(d *Decommission) {
+	ticker := time.NewTicker(decommissionTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.abort:
+			return
+		case now := <-ticker.C:
+			count := s.peerRequests(d.Peer)
+			inPool := s.hasPeer(d.Peer)
+
+			s.pool_lock.Lock()
+			if !d.active() {
+				s.pool_lock.Unlock()
+				return
+			}
+			if !inPool {
+				// removed by someone else
+				s.setState(d, DECOMMISSION_REMOVED)
+				s.pool_lock.Unlock()
+				return
+			}
+			if count != d.count {
+				d.count = count
+				d.LastTraffic = now
+				if d.State == DECOMMISSION_VERIFIED {
+					s.setState(d, DECOMMISSION_DRAINING)
+				}
+			}
+			remove := false
+			if d.State == DECOMMISSION_DRAINING && now.Sub(d.LastTraffic) >= d.quiet {
+				if d.AutoRemove {
+					s.setState(d, DECOMMISSION_REMOVED)
+					remove = true
+				} else {
+					s.setState(d, DECOMMISSION_VERIFIED)
+				}
+			}
+			s.pool_lock.Unlock()
+
+			if remove {
+				s.RemovePeer(d.Peer)
+				return
+			}
+		}
+	}
+}
+
+// ConfirmDecommission removes the verified peer
+func (s *VirtualServer) ConfirmDecommission(peer string) error {
+	s.pool_lock.Lock()
+	d, ok := s.decommissions[peer]
+	if !ok || !d.active() {
+		s.pool_lock.Unlock()
+		return ErrDecommissionNotFound
+	}
+	if d.State != DECOMMISSION_VERIFIED {
+		s.pool_lock.Unlock()
+		return ErrDecommissionNotVerified
+	}
+	s.setState(d, DECOMMISSION_REMOVED)
+	close(d.abort)
+	s.pool_lock.Unlock()
+
+	s.RemovePeer(peer)
+	return nil
+}
+
+// AbortDecommission puts the draining or verified peer back to the pool
+func (s *VirtualServer) AbortDecommission(peer string) error {
+	s.pool_lock.Lock()
+	defer s.pool_lock.Unlock()
+
+	d, ok := s.decommissions[peer]
+	if !ok || !d.active() {
+		return ErrDecommissionNotFound
+	}
+	s.setState(d, DECOMMISSION_ABORTED)
+	close(d.abort)
+	if !s.heldDown(peer) && !s.failed(peer) {
+		s.upPeer(peer, REASON_DECOMMISSION)
+	}
+	return nil
+}
+
+// Decommissions returns the decommissions in progress and finished
+func (s *VirtualServer) Decommissions() []Decommission {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+
+	result := []Decommission{}
+	for _, d := range s.decommissions {
+		result = append(result, *d.copy())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Peer < result[j].Peer
+	})
+	return result
+}
@@ -0,0 +1,92 @@
+package balancer
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func decommissionState(vs *VirtualServer, peer string) string {
+	for _, d := range vs.Decommissions() {
+		if d.Peer == peer {
+			return d.State
+		}
+	}
+	return ""
+}
+
+// waitState waits up to a second for the decommission of peer to reach state
+func waitState(t *testing.T, vs *VirtualServer, peer, state string) {
+	deadline := time.Now().Add(time.Second)
+	for decommissionState(vs, peer) != state {
+		require.True(t, time.Now().Before(deadline), "decommission of %s is not %s", peer, state)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDecommission(t *testing.T) {
+	decommissionTick = 10 * time.Millisecond
+	defer func() { decommissionTick = time.Second }()
+
+	peer1, peer2 := "127.0.0.1:10001", "127.0.0.1:10002"
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: peer1, Weight: 1}, {Address: peer2, Weight: 1}}),
+	)
+	require.NoError(t, err)
+
+	_, err = vs.StartDecommission("127.0.0.1:10003", time.Second, false)
+	assert.Equal(t, ErrPeerNotInPool, err)
+	assert.Equal(t, ErrDecommissionNotFound, vs.ConfirmDecommission(peer1))
+	assert.Equal(t, ErrDecommissionNotFound, vs.AbortDecommission(peer1))
+
+	quiet := 100 * time.Millisecond
+	d, err := vs.StartDecommission(peer1, quiet, false)
+	require.NoError(t, err)
+	assert.Equal(t, DECOMMISSION_DRAINING, d.State)
+	_, err = vs.StartDecommission(peer1, quiet, false)
+	assert.Equal(t, ErrDecommissionExisted, err)
+	for i := 0; i < 4; i += 1 {
+		assert.Equal(t, peer2, vs.Pool.Get())
+	}
+	assert.Equal(t, ErrDecommissionNotVerified, vs.ConfirmDecommission(peer1))
+
+	// the in-flight requests completing keep the peer draining
+	w := &LBResponseWriter{code: 200}
+	for i := 0; i < 5; i += 1 {
+		vs.StatsInc(peer1, httptest.NewRequest("GET", "/", nil), w, time.Millisecond)
+		time.Sleep(quiet / 4)
+		assert.Equal(t, DECOMMISSION_DRAINING, decommissionState(vs, peer1))
+	}
+	waitState(t, vs, peer1, DECOMMISSION_VERIFIED)
+
+	// abort puts the peer back
+	require.NoError(t, vs.AbortDecommission(peer1))
+	assert.Equal(t, DECOMMISSION_ABORTED, decommissionState(vs, peer1))
+	result := map[string]int{}
+	for i := 0; i < 4; i += 1 {
+		result[vs.Pool.Get()] += 1
+	}
+	assert.Equal(t, 2, result[peer1])
+
+	// confirm removes the verified peer
+	_, err = vs.StartDecommission(peer1, quiet, false)
+	require.NoError(t, err)
+	waitState(t, vs, peer1, DECOMMISSION_VERIFIED)
+	require.NoError(t, vs.ConfirmDecommission(peer1))
+	assert.Equal(t, DECOMMISSION_REMOVED, decommissionState(vs, peer1))
+	assert.Equal(t, []string{peer2}, vs.Pool.Peers())
+
+	// auto remove
+	_, err = vs.StartDecommission(peer2, quiet, true)
+	require.NoError(t, err)
+	waitState(t, vs, peer2, DECOMMISSION_REMOVED)
+	assert.Empty(t, vs.Pool.Peers())
+	assert.Equal(t, 2, len(vs.Decommissions()))
+}
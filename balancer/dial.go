@@ -0,0 +1,177 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	// the address families of the peers configured by host name
+	DIAL_DUAL        = "dual"
+	DIAL_PREFER_IPV4 = "prefer_ipv4"
+	DIAL_IPV4        = "ipv4"
+	DIAL_IPV6        = "ipv6"
+	// Connection Attempt Delay recommended by RFC 8305
+	DEFAULT_FALLBACK_DELAY = 250 * time.Millisecond
+	DEFAULT_DIAL_TIMEOUT   = 30 * time.Second
+)
+
+// DialOpt sets the address family of the peers configured by host name, and the delay
+// of Happy Eyeballs (RFC 8305) racing their addresses, see config.Dial
+func DialOpt(c config.Dial) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		switch c.Family {
+		case "":
+			c.Family = DIAL_DUAL
+		case DIAL_DUAL, DIAL_PREFER_IPV4, DIAL_IPV4, DIAL_IPV6:
+		default:
+			return ErrDialFamily
+		}
+		if c.FallbackDelay == 0 {
+			c.FallbackDelay = int(DEFAULT_FALLBACK_DELAY / time.Millisecond)
+		}
+		vs.dial = c
+		vs.setDialer()
+		return nil
+	}
+}
+
+// setDialer makes the transport dial the peers with the resolver and the family of vs
+func (vs *VirtualServer) setDialer() {
+	d := &happyDialer{
+		dialer:   &net.Dialer{Timeout: DEFAULT_DIAL_TIMEOUT, KeepAlive: 30 * time.Second},
+		resolver: vs.resolver.Resolver(),
+		family:   vs.dial.Family,
+		delay:    time.Duration(vs.dial.FallbackDelay) * time.Millisecond,
+	}
+	if d.delay == 0 {
+		d.delay = DEFAULT_FALLBACK_DELAY
+	}
+	vs.httpTransport().DialContext = unixDialer(d.DialContext)
+}
+
+// familyAllowed returns true if ip may be dialed with family
+func familyAllowed(ip net.IP, family string) bool {
+	switch family {
+	case DIAL_IPV4:
+		return ip.To4() != nil
+	case DIAL_IPV6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// sortAddrs returns the addresses of family, alternating the families from the preferred one,
+// IPv6 unless family is prefer_ipv4, RFC 8305 section 4
+func sortAddrs(addrs []net.IPAddr, family string) []string {
+	var v4, v6 []string
+	for _, a := range addrs {
+		if !familyAllowed(a.IP, family) {
+			continue
+		}
+		if a.IP.To4() != nil {
+			v4 = append(v4, a.String())
+		} else {
+			v6 = append(v6, a.String())
+		}
+	}
+	first, second := v6, v4
+	if family == DIAL_PREFER_IPV4 {
+		first, second = v4, v6
+	}
+	result := make([]string, 0, len(v4)+len(v6))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			result = append(result, first[i])
+		}
+		if i < len(second) {
+			result = append(result, second[i])
+		}
+	}
+	return result
+}
+
+// happyDialer dials a host name by racing its addresses
+type happyDialer struct {
+	dialer   *net.Dialer
+	resolver *net.Resolver
+	family   string
+	// between the connection attempts, negative waits for the previous one to fail
+	delay time.Duration
+}
+
+func (d *happyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := sortAddrs(addrs, d.family)
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no " + d.family + " address", Addr: host}
+	}
+	return d.race(ctx, network, ips, port)
+}
+
+// race starts a connection attempt to the next address every delay, or as soon as the previous
+// one failed, the first connection established wins and the others are closed, RFC 8305 section 5
+func (d *happyDialer) race(ctx context.Context, network string, ips []string, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next], port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.dialer.DialContext(ctx, network, addr)
+			results <- attempt{conn, err}
+		}()
+	}
+
+	var fallback <-chan time.Time
+	startNext := func() {
+		if next >= len(ips) {
+			return
+		}
+		start()
+		if d.delay > 0 {
+			fallback = time.After(d.delay)
+		}
+	}
+	startNext()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case a := <-results:
+			pending--
+			if a.err == nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if a := <-results; a.conn != nil {
+							a.conn.Close()
+						}
+					}
+				}(pending)
+				return a.conn, nil
+			}
+			lastErr = a.err
+			startNext()
+		case <-fallback:
+			startNext()
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,83 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestSortAddrs(t *testing.T) {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("10.0.0.2")},
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("2001:db8::2")},
+		{IP: net.ParseIP("2001:db8::3")},
+	}
+	assert.Equal(t, []string{"2001:db8::1", "10.0.0.1", "2001:db8::2", "10.0.0.2", "2001:db8::3"},
+		sortAddrs(addrs, DIAL_DUAL))
+	assert.Equal(t, []string{"10.0.0.1", "2001:db8::1", "10.0.0.2", "2001:db8::2", "2001:db8::3"},
+		sortAddrs(addrs, DIAL_PREFER_IPV4))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, sortAddrs(addrs, DIAL_IPV4))
+	assert.Equal(t, []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"}, sortAddrs(addrs, DIAL_IPV6))
+}
+
+func TestHappyDialerRace(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	closed.Close()
+
+	for _, delay := range []time.Duration{time.Hour, -1} {
+		d := &happyDialer{dialer: &net.Dialer{}, delay: delay}
+		// the refused attempt starts the next one without waiting for the delay
+		conn, err := d.race(context.Background(), "tcp", []string{"127.0.0.1", "127.0.0.1"}, port)
+		require.NoError(t, err)
+		conn.Close()
+
+		_, err = d.race(context.Background(), "tcp", []string{"127.0.0.1"}, closedPort)
+		assert.Error(t, err)
+	}
+}
+
+func TestDialIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	peer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("v6 peer"))
+	}))
+	peer.Listener = ln
+	peer.Start()
+	defer peer.Close()
+
+	vs, err := NewVirtualServer(NameOpt("dial"), AddressOpt("127.0.0.1:80"),
+		PoolOpt([]config.Server{{Address: ln.Addr().String(), Weight: 1}}),
+		DialOpt(config.Dial{Family: DIAL_IPV6}))
+	require.NoError(t, err)
+	assert.Equal(t, config.Dial{Family: DIAL_IPV6, FallbackDelay: 250}, vs.dial)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	w := httptest.NewRecorder()
+	vs.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "v6 peer", w.Body.String())
+
+	_, err = NewVirtualServer(NameOpt("dial"), DialOpt(config.Dial{Family: "ipv5"}))
+	assert.Equal(t, ErrDialFamily, err)
+}
@@ -0,0 +1,17 @@
+// package balancer provides the virtual servers of golb, and a Balancer managing them,
+// so golb may be embedded in another Go program instead of run as a binary:
+//
+//	c, err := config.Load("golb.json")
+//	b, err := balancer.New(c.VServers, balancer.EventHandlerOpt(onEvent))
+//	err = b.StartAll()
+//	defer b.StopAll()
+//
+//	err = b.AddVirtualServer(&config.VirtualServer{Name: "api", Address: ":8082", ...})
+//	vs, err := b.FindVirtualServer("api")
+//	err = vs.Run()
+//	stats, err := b.Stats("api")
+//	rollout, err := b.Reload(newConfig.VServers, newConfig.Reload)
+//	err = b.RemoveVirtualServer("api")
+//
+// the options passed to New apply to every virtual server, including the ones added later
+package balancer
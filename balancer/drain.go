@@ -0,0 +1,80 @@
+package balancer
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/leasttime"
+	"github.com/onestraw/golb/p2c"
+	"github.com/onestraw/golb/random"
+	"github.com/onestraw/golb/roundrobin"
+)
+
+// setPeer adds peer with weight, or changes the weight of the existing peer,
+// weight 0 drains it: it stays in the pool and is health-checked, but is not sent any request
+func (s *VirtualServer) setPeer(peer string, weight int, backup bool) {
+	poolWeight := weight
+	if poolWeight == 0 {
+		// kept until the peer is undrained
+		poolWeight = 1
+	}
+	added := !s.hasPeer(peer)
+	s.Pool.Add(peer, poolWeight, backup)
+	if added {
+		s.emit(EVENT_PEER_ADDED, peer, "")
+	}
+	switch pool := s.Pool.(type) {
+	case *roundrobin.Pool:
+		pool.SetWeight(peer, poolWeight)
+	case *leasttime.Pool:
+		pool.SetWeight(peer, poolWeight)
+	case *p2c.Pool:
+		pool.SetWeight(peer, poolWeight)
+	case *random.Pool:
+		pool.SetWeight(peer, poolWeight)
+	}
+
+	s.pool_lock.Lock()
+	defer s.pool_lock.Unlock()
+	if weight == 0 {
+		s.drain(peer)
+	} else {
+		s.undrain(peer)
+	}
+}
+
+// drain should be called with pool_lock held
+func (s *VirtualServer) drain(peer string) {
+	if s.drained[peer] {
+		return
+	}
+	log.WithFields(log.Fields{"event": "drain", "vs": s.Name, "peer": peer}).Infof("Draining peer %s, weight 0", peer)
+	s.drained[peer] = true
+	s.downPeer(peer, REASON_DRAIN)
+}
+
+// undrain should be called with pool_lock held
+func (s *VirtualServer) undrain(peer string) {
+	if !s.drained[peer] {
+		return
+	}
+	log.WithFields(log.Fields{"event": "drain", "vs": s.Name, "peer": peer}).Infof("Undraining peer %s", peer)
+	delete(s.drained, peer)
+	if !s.heldDown(peer) && !s.failed(peer) {
+		s.upPeer(peer, REASON_DRAIN)
+	}
+}
+
+// Drained returns the peers drained by weight 0
+func (s *VirtualServer) Drained() []string {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+
+	result := []string{}
+	for peer := range s.drained {
+		result = append(result, peer)
+	}
+	sort.Strings(result)
+	return result
+}
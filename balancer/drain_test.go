@@ -0,0 +1,88 @@
+package balancer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestDrainByWeight(t *testing.T) {
+	peer1, peer2, peer3 := "127.0.0.1:10001", "127.0.0.1:10002", "127.0.0.1:10003"
+	for _, method := range []string{LB_ROUNDROBIN, LB_COSISTENTHASH} {
+		vs, err := NewVirtualServer(
+			NameOpt("web"),
+			AddressOpt(":80"),
+			LBMethodOpt(method),
+			PoolOpt([]config.Server{{Address: peer1, Weight: 1}, {Address: peer2, Weight: 0}}),
+		)
+		require.NoError(t, err)
+		assert.Equal(t, []string{peer2}, vs.Drained(), method)
+		// drained peers stay in the pool, and are health-checked
+		assert.Equal(t, []string{peer1, peer2}, vs.Pool.Peers(), method)
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, peer1, vs.Pool.Get(fmt.Sprintf("10.0.0.%d", i)), method)
+		}
+
+		// pre-staged
+		_, err = vs.AddServer(config.Server{Address: peer3, Weight: 0})
+		require.NoError(t, err)
+		assert.Equal(t, []string{peer2, peer3}, vs.Drained(), method)
+
+		_, err = vs.AddServer(config.Server{Address: peer2, Weight: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []string{peer3}, vs.Drained(), method)
+		_, err = vs.AddServer(config.Server{Address: peer1, Weight: 0})
+		require.NoError(t, err)
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, peer2, vs.Pool.Get(fmt.Sprintf("10.0.0.%d", i)), method)
+		}
+
+		// not put back by a successful health check or the end of a fault
+		vs.pool_lock.RLock()
+		assert.True(t, vs.heldDown(peer1), method)
+		vs.pool_lock.RUnlock()
+
+		vs.RemovePeer(peer3)
+		assert.Equal(t, []string{peer1}, vs.Drained(), method)
+
+		_, err = vs.AddServer(config.Server{Address: peer3, Weight: -1})
+		assert.Equal(t, ErrNegativeWeight, err)
+	}
+
+	// the weight takes effect on undrain
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: peer1, Weight: 1}, {Address: peer2, Weight: 0}}),
+	)
+	require.NoError(t, err)
+	_, err = vs.AddServer(config.Server{Address: peer2, Weight: 3})
+	require.NoError(t, err)
+	result := map[string]int{}
+	for i := 0; i < 8; i++ {
+		result[vs.Pool.Get()] += 1
+	}
+	assert.Equal(t, 2, result[peer1])
+	assert.Equal(t, 6, result[peer2])
+
+	_, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), PoolOpt([]config.Server{{Address: peer1, Weight: -1}}))
+	assert.Equal(t, ErrNegativeWeight, err)
+}
+
+func TestDrainConfig(t *testing.T) {
+	c, err := config.LoadFromString(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8109",
+		"pool":[{"address":"127.0.0.1:10001"},{"address":"127.0.0.1:10002","weight":0}]}]}`)
+	require.NoError(t, err)
+	assert.Equal(t, config.DEFAULT_WEIGHT, c.VServers[0].Pool[0].Weight)
+	assert.Equal(t, 0, c.VServers[0].Pool[1].Weight)
+
+	b, err := New(c.VServers)
+	require.NoError(t, err)
+	vs := b.VServers[0]
+	assert.Equal(t, []string{"127.0.0.1:10002"}, vs.Drained())
+	assert.Equal(t, 0, vs.EffectiveConfig().Pool[1].Weight)
+}
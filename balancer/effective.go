@@ -0,0 +1,191 @@
+package balancer
+
+import (
+	"time"
+
+	"github.com/onestraw/golb/config"
+)
+
+// effectivePool returns pool with the normalized addresses and schemes
+func effectivePool(pool []config.Server) []config.Server {
+	result := make([]config.Server, len(pool))
+	for i, server := range pool {
+		if addr, scheme, err := peerAddress(server.Address, server.Scheme); err == nil {
+			server.Address = addr
+			server.Scheme = scheme
+		}
+		result[i] = server
+	}
+	return result
+}
+
+// EffectiveConfig returns the configuration of s with the defaults applied,
+// the peers added at runtime are not included
+func (s *VirtualServer) EffectiveConfig() *config.VirtualServer {
+	c := &config.VirtualServer{}
+	if s.conf != nil {
+		c = copyConfig(s.conf)
+	}
+
+	s.RLock()
+	c.Name = s.Name
+	c.Address = s.Address
+	c.ServerName = s.ServerName
+	c.Protocol = s.Protocol
+	c.LBMethod = s.LBMethod
+	s.RUnlock()
+
+	c.CertFile = s.CertFile
+	c.KeyFile = s.KeyFile
+	c.ClientCAFile = s.ClientCAFile
+	c.ClientCAWatch = int(s.clientCAWatch / time.Second)
+	c.Service = s.Service
+	c.Pool = effectivePool(c.Pool)
+	for i, ru := range s.rules {
+		if i < len(c.Rules) {
+			c.Rules[i].LBMethod = ru.vs.LBMethod
+			c.Rules[i].Pool = effectivePool(c.Rules[i].Pool)
+		}
+	}
+	if s.canary != nil {
+		c.Canary.LBMethod = s.canary.vs.LBMethod
+		c.Canary.Pool = effectivePool(c.Canary.Pool)
+	}
+	if s.mirror != nil {
+		c.Mirror.LBMethod = s.mirror.vs.LBMethod
+		c.Mirror.Pool = effectivePool(c.Mirror.Pool)
+		c.Mirror.Timeout = int(s.mirror.timeout / time.Millisecond)
+	}
+
+	if cp := s.compressor; cp != nil {
+		c.Compression = config.Compression{
+			Enable:      true,
+			Encodings:   cp.encodings,
+			Types:       cp.types,
+			MinSize:     cp.minSize,
+			Level:       cp.level,
+			BrotliLevel: cp.brotliLevel,
+		}
+	}
+	if ca := s.cache; ca != nil {
+		c.Cache = config.Cache{
+			Enable:       true,
+			MaxSize:      ca.maxSize,
+			MaxEntrySize: ca.maxEntrySize,
+			DefaultTTL:   int(ca.defaultTTL / time.Second),
+			TTL:          int(ca.ttl / time.Second),
+			Dir:          ca.dir,
+		}
+	}
+	if s.sla != nil {
+		c.SLA = config.SLA{Latency: int(s.sla.latency / time.Millisecond), Tries: s.sla.tries}
+	}
+	c.SlowStart = int(s.slowStart / time.Second)
+	c.LeastTime = s.leastTime
+	c.TombstoneAfter = s.TombstoneAfter
+	c.ResolveInterval = int(s.resolveInterval / time.Second)
+	c.ServerTiming = s.serverTiming
+	c.PeerHeaders = s.peerHeaders
+	c.Debug = config.Debug{Token: s.debugToken, Upstream: s.upstreamOverride, AllowFrom: s.upstreamAllowFrom}
+	c.RateLimit = s.rateLimit
+	c.WAF = s.wafConf
+	if rb := s.requestBody; rb != nil {
+		c.MaxBodySize = rb.maxSize
+		c.RequestBuffering = rb.RequestBuffering
+	}
+	c.JWT = s.jwtConf
+	c.ClientAuth = s.clientAuthConf
+	c.ForwardAuth = s.forwardAuthConf
+	c.ReusePort = s.reusePort
+	c.TCP = s.tcp
+	c.Bandwidth = s.bandwidth
+	c.HealthzPath = s.healthzPath
+	c.KeepAlive = s.keepAlive()
+	c.TLS = s.TLSPolicy()
+	c.UpstreamTLS = s.upstreamTLS
+	c.Dial = s.dial
+	c.ErrorPages = s.errorPagesConf
+	c.Critical = s.critical
+	c.ConnectionAge = config.ConnectionAge{}
+	if s.connAge > 0 {
+		c.ConnectionAge.Max = int(s.connAge / time.Second)
+		c.ConnectionAge.Grace = int(s.connAgeGrace / time.Second)
+	}
+	c.Hedge = config.Hedge{}
+	if s.hedgePercentile > 0 {
+		c.Hedge.Percentile = s.hedgePercentile
+		c.Hedge.DefaultDelay = int(s.hedgeDelay / time.Millisecond)
+	}
+	c.RangeSplit = config.RangeSplit{}
+	if s.rangeChunkSize > 0 {
+		c.RangeSplit.ChunkSize = s.rangeChunkSize
+		c.RangeSplit.Concurrency = s.rangeConcurrency
+	}
+	if od := s.outlier; od != nil {
+		c.OutlierDetection = config.OutlierDetection{
+			Interval:           int(od.interval / time.Second),
+			ErrorFactor:        od.errorFactor,
+			LatencyFactor:      od.latencyFactor,
+			MinRequests:        od.minRequests,
+			MaxEjectionPercent: od.maxEjectionPercent,
+			EjectionTime:       int(od.ejectionTime / time.Second),
+		}
+	}
+	if aw := s.autoWeight; aw != nil {
+		c.AutoWeight = config.AutoWeight{
+			Enable:      true,
+			Interval:    int(aw.interval / time.Second),
+			Step:        aw.step,
+			MinPercent:  aw.minPercent,
+			MaxPercent:  aw.maxPercent,
+			MinRequests: aw.minRequests,
+		}
+	}
+	if s.healthCheck != nil {
+		c.HealthCheck = *s.peerHealthCheck("")
+	}
+	if l := s.limiter; l != nil {
+		c.Limits = config.Limits{
+			PeerMaxConns: l.peerMax,
+			PoolMaxConns: l.poolMax,
+			QueueSize:    l.queueSize,
+			QueueTimeout: int(l.queueTimeout / time.Millisecond),
+			Priority:     l.priority,
+		}
+		if l.adaptive != nil {
+			c.Limits.Adaptive = l.adaptive.AdaptiveLimit
+		}
+	}
+	if l := s.clientLimiter; l != nil {
+		c.Limits.ClientMaxConns = l.max
+	}
+	c.FailOn = s.FailOn()
+	c.HashKey = s.hashKeyTemplate
+	c.SlowLog.Threshold = int(s.slowThreshold / time.Millisecond)
+	c.AccessLog = s.AccessLog()
+	if srv := s.srv; srv != nil {
+		c.SRV = config.SRV{
+			Service:  srv.service,
+			Proto:    srv.proto,
+			Name:     srv.name,
+			Interval: int(srv.interval / time.Second),
+		}
+	}
+	return c
+}
+
+// EffectiveConfig returns base with the virtual servers currently configured in b
+// (including the ones added at runtime) and the secrets redacted
+func (b *Balancer) EffectiveConfig(base *config.Configuration) *config.Configuration {
+	c := &config.Configuration{}
+	if base != nil {
+		*c = *base
+	}
+	b.RLock()
+	c.VServers = make([]config.VirtualServer, len(b.VServers))
+	for i, vs := range b.VServers {
+		c.VServers[i] = *vs.EffectiveConfig()
+	}
+	b.RUnlock()
+	return c.Redacted()
+}
@@ -13,6 +13,50 @@ var (
 	ErrVirtualServerNameExisted    = errors.New("Vritual Server Name Existed")
 	ErrVirtualServerAddressExisted = errors.New("Vritual Server Address Existed")
 	ErrVirtualServerNotFound       = errors.New("Virtaul Server Not Found")
+	ErrPeerStatsNotFound           = errors.New("Peer Stats Not Found")
+	ErrTombstoneNotFound           = errors.New("Tombstone Not Found")
+	ErrRouteNotFound               = errors.New("Route Not Found")
+	ErrClientCANotConfigured       = errors.New("Client CA Not Configured")
+	ErrConfigNotFound              = errors.New("Virtual Server Configuration Not Found")
+	ErrAutoWeightRange             = errors.New("Auto Weight Range Should Include 100 Percent")
+	ErrRedirectCode                = errors.New("Redirect Should Be 301, 302, 303, 307 or 308")
+	ErrStatusClass                 = errors.New("Status Class Should Be 1xx to 5xx")
+	ErrSamplePercent               = errors.New("Sample Percent Should Be In [0, 100]")
+	ErrEmptyAPIKey                 = errors.New("Empty API Key")
+	ErrHtpasswdLine                = errors.New("Htpasswd Line Should Be user:hash")
+	ErrHtpasswdHash                = errors.New("Htpasswd Hash Should Be bcrypt, Apache MD5 Or SHA1")
+	ErrForwardAuthURL              = errors.New("Forward Auth URL Should Be Absolute")
+	ErrClusterNodeEmpty            = errors.New("Cluster Node is not specified")
+	ErrClusterNode                 = errors.New("Cluster State Should Be Of Another Node")
+	ErrNegativeReusePort           = errors.New("Negative Reuse Port")
+	ErrNegativeTCPOption           = errors.New("Negative TCP Option")
+	ErrNegativeBandwidth           = errors.New("Negative Bandwidth")
+	ErrNilInspector                = errors.New("Nil Inspector")
+	ErrAccessLogSink               = errors.New("Unknown Access Log Sink")
+	ErrNegativeAccessLog           = errors.New("Negative Access Log Every Or Slower Than")
+	ErrCompressionLevel            = errors.New("Compression Level Should Be 1 to 9, Brotli Level 1 to 11")
+	ErrCompressionEncoding         = errors.New("Compression Encoding Should Be br Or gzip")
+	ErrCacheNotEnabled             = errors.New("Cache Not Enabled")
+	ErrPeerNotInPool               = errors.New("Peer Not In Pool")
+	ErrDecommissionExisted         = errors.New("Decommission In Progress")
+	ErrDecommissionNotFound        = errors.New("Decommission Not Found")
+	ErrDecommissionNotVerified     = errors.New("Decommission Not Verified")
+	ErrReloadInProgress            = errors.New("Reload In Progress")
+	ErrNegativeWeight              = errors.New("Negative Weight")
+	ErrNegativeMaxFails            = errors.New("Negative Max Fails Or Fail Timeout")
+	ErrHealthCheckType             = errors.New("Health Check Type Should Be http Or grpc")
+	ErrScriptEngine                = errors.New("Script Engine Not Registered")
+	ErrUpstreamTLS                 = errors.New("Invalid Upstream TLS Version Or Cipher Suite")
+	ErrTLSPolicy                   = errors.New("Invalid TLS Version, Cipher Suite Or Curve")
+	ErrDialFamily                  = errors.New("Dial Family Should Be dual, prefer_ipv4, ipv4 Or ipv6")
+	ErrAdaptiveLimit               = errors.New("Adaptive Limit Should Be gradient Or aimd With 0 <= min_limit <= max_limit")
+	ErrRequestBody                 = errors.New("Request Buffering Should Be stream, memory Or spool With Non-negative Sizes")
+	ErrNilMiddleware               = errors.New("Nil Middleware")
+	ErrNegativeRateLimit           = errors.New("Negative Rate Limit")
+	ErrNegativeClientLimit         = errors.New("Negative Client Limit")
+	ErrFailOn                      = errors.New("Fail On Should Be error, timeout, 5xx Or A Status Code")
+	ErrInvalidKeepAlive            = errors.New("Negative Keep-Alive Setting")
+	ErrErrorPageKey                = errors.New("Error Page Should Be A Status Code 4xx/5xx Or peer_not_found")
 )
 
 type BalancerError struct {
@@ -21,10 +65,19 @@ type BalancerError struct {
 }
 
 var (
-	ErrBadRequest       = BalancerError{http.StatusBadRequest, "Reqeust Error"}
-	ErrHostNotMatch     = BalancerError{http.StatusBadRequest, "Host Not Match"}
-	ErrPeerNotFound     = BalancerError{http.StatusBadGateway, "Peer Not Found"}
-	ErrInternalBalancer = BalancerError{http.StatusInternalServerError, "Balancer Internal Error"}
+	ErrBadRequest            = BalancerError{http.StatusBadRequest, "Reqeust Error"}
+	ErrHostNotMatch          = BalancerError{http.StatusBadRequest, "Host Not Match"}
+	ErrUnauthorized          = BalancerError{http.StatusUnauthorized, "Unauthorized"}
+	ErrForbidden             = BalancerError{http.StatusForbidden, "Forbidden"}
+	ErrUpstreamNotInPool     = BalancerError{http.StatusBadRequest, "Upstream Not In Pool"}
+	ErrPeerNotFound          = BalancerError{http.StatusBadGateway, "Peer Not Found"}
+	ErrBadGateway            = BalancerError{http.StatusBadGateway, "Bad Gateway"}
+	ErrServiceUnavailable    = BalancerError{http.StatusServiceUnavailable, "Service Unavailable"}
+	ErrTooManyRequests       = BalancerError{http.StatusTooManyRequests, "Too Many Requests"}
+	ErrRequestEntityTooLarge = BalancerError{http.StatusRequestEntityTooLarge, "Request Entity Too Large"}
+	ErrGatewayTimeout        = BalancerError{http.StatusGatewayTimeout, "Gateway Timeout"}
+	ErrMaintenance           = BalancerError{http.StatusServiceUnavailable, "Service In Maintenance"}
+	ErrInternalBalancer      = BalancerError{http.StatusInternalServerError, "Balancer Internal Error"}
 )
 
 func WriteError(w http.ResponseWriter, err BalancerError) {
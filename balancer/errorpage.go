@@ -0,0 +1,128 @@
+package balancer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	// error page of ErrPeerNotFound, the other pages are keyed by status code
+	PAGE_PEER_NOT_FOUND = "peer_not_found"
+	// request header naming the request in the error pages, generated if missing
+	REQUEST_ID_HEADER = "X-Request-Id"
+
+	DEFAULT_ERROR_CONTENT_TYPE = "text/html; charset=utf-8"
+)
+
+// errorPage is the body of an error response of golb
+type errorPage struct {
+	contentType string
+	tmpl        *template.Template
+}
+
+// ErrorPageData are the variables of an error page template
+type ErrorPageData struct {
+	Status        int
+	StatusText    string
+	Message       string
+	VirtualServer string
+	RequestID     string
+	Host          string
+	Path          string
+	Time          time.Time
+}
+
+// ErrorPagesOpt replaces the bodies of the error responses of golb, e.g. a 502 when the peer
+// is not reachable or 503 when the pool is saturated, the responses of the peers are passed as is.
+// The pages are keyed by status code, or PAGE_PEER_NOT_FOUND if no peer is available,
+// and are a file or an inline template, see ErrorPageData for the variables
+func ErrorPagesOpt(pages map[string]config.ErrorPage) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if len(pages) == 0 {
+			return nil
+		}
+		vs.errorPages = make(map[string]*errorPage, len(pages))
+		for key, p := range pages {
+			if key != PAGE_PEER_NOT_FOUND {
+				if code, err := strconv.Atoi(key); err != nil || code < 400 || code > 599 {
+					return ErrErrorPageKey
+				}
+			}
+			text := p.Template
+			if p.File != "" {
+				data, err := ioutil.ReadFile(p.File)
+				if err != nil {
+					return err
+				}
+				text = string(data)
+			}
+			tmpl, err := template.New(key).Parse(text)
+			if err != nil {
+				return err
+			}
+			contentType := p.ContentType
+			if contentType == "" {
+				contentType = DEFAULT_ERROR_CONTENT_TYPE
+			}
+			vs.errorPages[key] = &errorPage{contentType: contentType, tmpl: tmpl}
+		}
+		vs.errorPagesConf = pages
+		return nil
+	}
+}
+
+// requestID returns the request ID of r, or a new one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(REQUEST_ID_HEADER); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeError responds err with its error page if configured
+func (s *VirtualServer) writeError(w http.ResponseWriter, r *http.Request, err BalancerError) {
+	key := strconv.Itoa(err.StatusCode)
+	if err == ErrPeerNotFound {
+		key = PAGE_PEER_NOT_FOUND
+	}
+	if page, ok := s.errorPages[key]; ok && s.writePage(w, r, page, err) {
+		return
+	}
+	WriteError(w, err)
+}
+
+// writePage returns false if page can not be rendered
+func (s *VirtualServer) writePage(w http.ResponseWriter, r *http.Request, page *errorPage, err BalancerError) bool {
+	data := &ErrorPageData{
+		Status:        err.StatusCode,
+		StatusText:    http.StatusText(err.StatusCode),
+		Message:       err.ErrMsg,
+		VirtualServer: s.Name,
+		RequestID:     requestID(r),
+		Host:          r.Host,
+		Path:          r.URL.Path,
+		Time:          time.Now(),
+	}
+	var body bytes.Buffer
+	if e := page.tmpl.Execute(&body, data); e != nil {
+		log.Errorf("[%s] error page %s error=%v", s.Name, page.tmpl.Name(), e)
+		return false
+	}
+	w.Header().Set("Content-Type", page.contentType)
+	w.Header().Set(REQUEST_ID_HEADER, data.RequestID)
+	w.WriteHeader(err.StatusCode)
+	w.Write(body.Bytes())
+	return true
+}
@@ -0,0 +1,67 @@
+package balancer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestErrorPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "502.html")
+	require.NoError(t, ioutil.WriteFile(file, []byte("<h1>{{.Status}} {{.StatusText}}</h1>"), 0644))
+
+	_, err = NewVirtualServer(ErrorPagesOpt(map[string]config.ErrorPage{"200": {Template: "ok"}}))
+	assert.Equal(t, ErrErrorPageKey, err)
+	_, err = NewVirtualServer(ErrorPagesOpt(map[string]config.ErrorPage{"503": {Template: "{{.Status"}}))
+	assert.Error(t, err)
+
+	// closed, the proxy fails
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8121"),
+		ServerNameOpt("localhost"),
+		PoolOpt([]config.Server{{Address: down.URL[7:], Weight: 1}}),
+		ErrorPagesOpt(map[string]config.ErrorPage{
+			"502": {File: file},
+			PAGE_PEER_NOT_FOUND: {
+				Template:    `{"vs":"{{.VirtualServer}}","id":"{{.RequestID}}","msg":"{{.Message}}"}`,
+				ContentType: "application/json",
+			},
+		}),
+	)
+	require.NoError(t, err)
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		req.Header.Set(REQUEST_ID_HEADER, "abc")
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve()
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "<h1>502 Bad Gateway</h1>", w.Body.String())
+	assert.Equal(t, DEFAULT_ERROR_CONTENT_TYPE, w.Header().Get("Content-Type"))
+	assert.Equal(t, "abc", w.Header().Get(REQUEST_ID_HEADER))
+
+	vs.Pool.DownPeer(down.URL[7:])
+	w = serve()
+	assert.Equal(t, ErrPeerNotFound.StatusCode, w.Code)
+	assert.Equal(t, `{"vs":"web","id":"abc","msg":"`+ErrPeerNotFound.ErrMsg+`"}`, w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, map[string]config.ErrorPage{"502": {File: file}, PAGE_PEER_NOT_FOUND: vs.errorPagesConf[PAGE_PEER_NOT_FOUND]}, vs.EffectiveConfig().ErrorPages)
+}
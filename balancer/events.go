@@ -0,0 +1,183 @@
+package balancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EVENT_PEER_DOWN    = "peer_down"
+	EVENT_PEER_UP      = "peer_up"
+	EVENT_PEER_ADDED   = "peer_added"
+	EVENT_PEER_REMOVED = "peer_removed"
+	EVENT_VS_STARTED   = "vs_started"
+	EVENT_VS_STOPPED   = "vs_stopped"
+
+	// events waiting for the handlers, the newer ones are dropped when it is full
+	EVENT_QUEUE_SIZE        = 1024
+	DEFAULT_WEBHOOK_TIMEOUT = 5 * time.Second
+)
+
+// reasons of peer_down and peer_up
+const (
+	REASON_FAILS        = "fails"
+	REASON_HEALTH       = "health"
+	REASON_OUTLIER      = "outlier"
+	REASON_FAULT        = "fault"
+	REASON_DRAIN        = "drain"
+	REASON_DECOMMISSION = "decommission"
+	REASON_MAINTENANCE  = "maintenance"
+	REASON_TOMBSTONE    = "tombstone"
+	REASON_CLUSTER      = "cluster"
+)
+
+// Event is a change of a peer or a virtual server
+type Event struct {
+	Type          string `json:"type"`
+	VirtualServer string `json:"virtual_server"`
+	Peer          string `json:"peer,omitempty"`
+	// what marked the peer down or up, or removed it
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// EventHandler is called with the events in the order they happen, one at a time,
+// a slow handler delays the next events
+type EventHandler func(Event)
+
+// eventBus calls the handlers in its own goroutine, so the events can be
+// published with the locks of the virtual server held
+type eventBus struct {
+	handlers []EventHandler
+	queue    chan Event
+	once     sync.Once
+}
+
+func (b *eventBus) publish(e Event) {
+	b.once.Do(func() {
+		go b.dispatch()
+	})
+	select {
+	case b.queue <- e:
+	default:
+		log.Warnf("Event queue is full, %s of [%s] %s dropped", e.Type, e.VirtualServer, e.Peer)
+	}
+}
+
+func (b *eventBus) dispatch() {
+	for e := range b.queue {
+		for _, h := range b.handlers {
+			h(e)
+		}
+	}
+}
+
+// EventHandlerOpt calls handlers with the events of the virtual server: peer marked down or up,
+// added or removed, virtual server started or stopped. Passed to New, they receive the events
+// of every virtual server, including the reloaded ones
+func EventHandlerOpt(handlers ...EventHandler) VirtualServerOption {
+	// shared by the virtual servers of the option
+	bus := &eventBus{handlers: handlers, queue: make(chan Event, EVENT_QUEUE_SIZE)}
+	return func(vs *VirtualServer) error {
+		if len(handlers) > 0 {
+			vs.events = append(vs.events, bus)
+		}
+		return nil
+	}
+}
+
+// Webhook returns an EventHandler posting the events to url as JSON,
+// a timeout of 0 means DEFAULT_WEBHOOK_TIMEOUT
+func Webhook(url string, timeout time.Duration) EventHandler {
+	if timeout <= 0 {
+		timeout = DEFAULT_WEBHOOK_TIMEOUT
+	}
+	client := &http.Client{Timeout: timeout}
+	return func(e Event) {
+		data, _ := json.Marshal(e)
+		resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Errorf("Post %s event to webhook error=%v", e.Type, err)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Errorf("Post %s event to webhook, status %d", e.Type, resp.StatusCode)
+		}
+	}
+}
+
+// EventFeed fans the events out to the subscribers, e.g. the clients tailing the controller,
+// a subscriber not keeping up misses the events
+type EventFeed struct {
+	sync.Mutex
+	subscribers map[chan Event]bool
+}
+
+func NewEventFeed() *EventFeed {
+	return &EventFeed{subscribers: map[chan Event]bool{}}
+}
+
+// Handler returns the EventHandler to pass to EventHandlerOpt
+func (f *EventFeed) Handler() EventHandler {
+	return func(e Event) {
+		f.Lock()
+		defer f.Unlock()
+		for c := range f.subscribers {
+			select {
+			case c <- e:
+			default:
+			}
+		}
+	}
+}
+
+// Subscribe returns the events published from now on, until cancel is called
+func (f *EventFeed) Subscribe() (events <-chan Event, cancel func()) {
+	c := make(chan Event, EVENT_QUEUE_SIZE)
+	f.Lock()
+	f.subscribers[c] = true
+	f.Unlock()
+	return c, func() {
+		f.Lock()
+		delete(f.subscribers, c)
+		f.Unlock()
+	}
+}
+
+// emit publishes an event of s to the handlers
+func (s *VirtualServer) emit(typ, peer, reason string) {
+	if len(s.events) == 0 {
+		return
+	}
+	e := Event{Type: typ, VirtualServer: s.Name, Peer: peer, Reason: reason, Time: time.Now()}
+	for _, bus := range s.events {
+		bus.publish(e)
+	}
+}
+
+// downPeer marks peer down, pool_lock should be held
+func (s *VirtualServer) downPeer(peer, reason string) {
+	s.Pool.DownPeer(peer)
+	if !s.down[peer] {
+		s.down[peer] = true
+		s.emit(EVENT_PEER_DOWN, peer, reason)
+	}
+}
+
+// upPeer marks peer up, pool_lock should be held
+func (s *VirtualServer) upPeer(peer, reason string) {
+	s.Pool.UpPeer(peer)
+	if s.down[peer] {
+		delete(s.down, peer)
+		s.emit(EVENT_PEER_UP, peer, reason)
+	}
+}
@@ -0,0 +1,93 @@
+package balancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+// nextEvent waits up to 2 seconds for an event of ch
+func nextEvent(t *testing.T, ch chan Event) Event {
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "no event")
+	}
+	return Event{}
+}
+
+func TestEvents(t *testing.T) {
+	ch := make(chan Event, 16)
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8111"),
+		PoolOpt([]config.Server{{Address: "127.0.0.1:10001", Weight: 1}}),
+		EventHandlerOpt(func(e Event) { ch <- e }),
+	)
+	require.NoError(t, err)
+
+	expect := func(typ, peer, reason string) {
+		e := nextEvent(t, ch)
+		assert.Equal(t, Event{Type: typ, VirtualServer: "web", Peer: peer, Reason: reason}, Event{
+			Type: e.Type, VirtualServer: e.VirtualServer, Peer: e.Peer, Reason: e.Reason})
+		assert.False(t, e.Time.IsZero())
+	}
+
+	require.NoError(t, vs.Run())
+	expect(EVENT_VS_STARTED, "", "")
+
+	_, err = vs.AddServer(config.Server{Address: "127.0.0.1:10002", Weight: 0})
+	require.NoError(t, err)
+	expect(EVENT_PEER_ADDED, "127.0.0.1:10002", "")
+	expect(EVENT_PEER_DOWN, "127.0.0.1:10002", REASON_DRAIN)
+
+	require.NoError(t, vs.InjectFault("127.0.0.1:10001", true, 0, time.Minute))
+	expect(EVENT_PEER_DOWN, "127.0.0.1:10001", REASON_FAULT)
+	vs.ClearFault("127.0.0.1:10001")
+	expect(EVENT_PEER_UP, "127.0.0.1:10001", REASON_FAULT)
+
+	// marked down once
+	for i := 0; i < DEFAULT_MAXFAILS+1; i++ {
+		vs.markFail("127.0.0.1:10001")
+	}
+	expect(EVENT_PEER_DOWN, "127.0.0.1:10001", REASON_FAILS)
+
+	vs.RemovePeer("127.0.0.1:10002")
+	expect(EVENT_PEER_REMOVED, "127.0.0.1:10002", "")
+	vs.RemovePeer("127.0.0.1:10002")
+
+	require.NoError(t, vs.Stop())
+	expect(EVENT_VS_STOPPED, "", "")
+	assert.Empty(t, ch)
+}
+
+func TestWebhook(t *testing.T) {
+	ch := make(chan Event, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		ch <- e
+	}))
+	defer hook.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8111"),
+		PoolOpt([]config.Server{}),
+		EventHandlerOpt(Webhook(hook.URL, 0)),
+	)
+	require.NoError(t, err)
+	vs.AddPeer("127.0.0.1:10001", 1)
+	e := nextEvent(t, ch)
+	assert.Equal(t, EVENT_PEER_ADDED, e.Type)
+	assert.Equal(t, "web", e.VirtualServer)
+	assert.Equal(t, "127.0.0.1:10001", e.Peer)
+}
@@ -0,0 +1,129 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// the outcomes counted as failures of a peer by MaxFails, besides a status code like "503"
+const (
+	FAIL_ON_ERROR   = "error"
+	FAIL_ON_TIMEOUT = "timeout"
+	FAIL_ON_5XX     = "5xx"
+)
+
+// DEFAULT_FAIL_ON counts the connect errors, the timeouts and the 5xx responses
+var DEFAULT_FAIL_ON = []string{FAIL_ON_ERROR, FAIL_ON_TIMEOUT, FAIL_ON_5XX}
+
+// failurePolicy defines which outcomes of a request count as a failure of the peer
+type failurePolicy struct {
+	outcomes []string
+	errors   bool
+	timeouts bool
+	all5xx   bool
+	codes    map[int]bool
+}
+
+func newFailurePolicy(outcomes []string) (*failurePolicy, error) {
+	p := &failurePolicy{outcomes: outcomes, codes: make(map[int]bool)}
+	for _, o := range outcomes {
+		switch o {
+		case FAIL_ON_ERROR:
+			p.errors = true
+		case FAIL_ON_TIMEOUT:
+			p.timeouts = true
+		case FAIL_ON_5XX:
+			p.all5xx = true
+		default:
+			code, err := strconv.Atoi(o)
+			if err != nil || code < 100 || code > 599 {
+				return nil, ErrFailOn
+			}
+			p.codes[code] = true
+		}
+	}
+	return p, nil
+}
+
+var defaultFailurePolicy, _ = newFailurePolicy(DEFAULT_FAIL_ON)
+
+// FailOnOpt sets the outcomes counted by MaxFails, e.g. ["error", "timeout"] so a peer
+// responding 500 to a bad input is not marked down. Empty means DEFAULT_FAIL_ON
+func FailOnOpt(outcomes []string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if len(outcomes) == 0 {
+			return nil
+		}
+		p, err := newFailurePolicy(outcomes)
+		if err != nil {
+			return err
+		}
+		vs.failOn = p
+		return nil
+	}
+}
+
+func (s *VirtualServer) failurePolicy() *failurePolicy {
+	if s.failOn == nil {
+		return defaultFailurePolicy
+	}
+	return s.failOn
+}
+
+// FailOn returns the outcomes counted as failures
+func (s *VirtualServer) FailOn() []string {
+	return append([]string(nil), s.failurePolicy().outcomes...)
+}
+
+// isTimeout reports if err is a timeout of the try or of the connection
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// isFailure reports if a request to a peer ending with code, or with err
+// if the peer was not reached or did not respond, counts as a failure of the peer
+func (s *VirtualServer) isFailure(code int, err error) bool {
+	p := s.failurePolicy()
+	if err != nil {
+		if isTimeout(err) {
+			return p.timeouts
+		}
+		return p.errors
+	}
+	return p.codes[code] || (p.all5xx && code/100 == 5)
+}
+
+// markOutcome counts a failure or a success of peer
+func (s *VirtualServer) markOutcome(peer string, code int, err error) {
+	if s.isFailure(code, err) {
+		s.markFail(peer)
+	} else {
+		s.markSuccess(peer)
+	}
+}
+
+type proxyOutcomeKey struct{}
+
+// proxyOutcome records the error of the reverse proxy, set by proxyError
+type proxyOutcome struct {
+	err error
+}
+
+// withProxyOutcome returns r with an outcome to be filled by proxyError
+func withProxyOutcome(r *http.Request) (*http.Request, *proxyOutcome) {
+	o := &proxyOutcome{}
+	return r.WithContext(context.WithValue(r.Context(), proxyOutcomeKey{}, o)), o
+}
+
+func setProxyOutcome(r *http.Request, err error) {
+	if o, ok := r.Context().Value(proxyOutcomeKey{}).(*proxyOutcome); ok {
+		o.err = err
+	}
+}
@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestIsFailure(t *testing.T) {
+	vs := &VirtualServer{}
+	assert.Equal(t, DEFAULT_FAIL_ON, vs.FailOn())
+	assert.True(t, vs.isFailure(500, nil))
+	assert.True(t, vs.isFailure(0, errors.New("connection refused")))
+	assert.True(t, vs.isFailure(0, context.DeadlineExceeded))
+	assert.False(t, vs.isFailure(404, nil))
+
+	require.NoError(t, FailOnOpt([]string{FAIL_ON_TIMEOUT, "503"})(vs))
+	assert.False(t, vs.isFailure(500, nil))
+	assert.True(t, vs.isFailure(503, nil))
+	assert.False(t, vs.isFailure(0, errors.New("connection refused")))
+	assert.True(t, vs.isFailure(0, context.DeadlineExceeded))
+
+	for _, outcomes := range [][]string{{"4xx"}, {"99"}, {"error", "600"}} {
+		assert.Equal(t, ErrFailOn, FailOnOpt(outcomes)(vs), outcomes)
+	}
+}
+
+func TestFailOn(t *testing.T) {
+	s1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer s1.Close()
+	s2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s2.Close()
+	peer1, peer2 := s1.URL[7:], s2.URL[7:]
+
+	newVS := func(peer string) *VirtualServer {
+		vs, err := NewVirtualServer(
+			NameOpt("web"),
+			AddressOpt("127.0.0.1:80"),
+			PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+			FailOnOpt([]string{FAIL_ON_ERROR, FAIL_ON_TIMEOUT}),
+		)
+		require.NoError(t, err)
+		return vs
+	}
+	vs := newVS(peer1)
+	assert.Equal(t, []string{FAIL_ON_ERROR, FAIL_ON_TIMEOUT}, vs.EffectiveConfig().FailOn)
+
+	serve := func() int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i := 0; i < vs.MaxFails; i++ {
+		assert.Equal(t, http.StatusInternalServerError, serve())
+	}
+	vs.pool_lock.Lock()
+	assert.Zero(t, vs.fails[peer1])
+	vs.pool_lock.Unlock()
+
+	// a connect error still counts
+	vs = newVS(peer2)
+	assert.Equal(t, http.StatusBadGateway, serve())
+	vs.pool_lock.Lock()
+	assert.Equal(t, 1, vs.fails[peer2])
+	vs.pool_lock.Unlock()
+}
+
+func TestPeerMaxFails(t *testing.T) {
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		PoolOpt([]config.Server{
+			{Address: "127.0.0.1:10001", Weight: 1, MaxFails: 1, FailTimeout: 60},
+			{Address: "127.0.0.1:10002", Weight: 1},
+		}),
+	)
+	require.NoError(t, err)
+
+	vs.markFail("127.0.0.1:10001")
+	vs.markFail("127.0.0.1:10002")
+	vs.pool_lock.RLock()
+	assert.True(t, vs.failed("127.0.0.1:10001"))
+	assert.False(t, vs.failed("127.0.0.1:10002"))
+	assert.Equal(t, int64(60), vs.failTimeout("127.0.0.1:10001"))
+	assert.Equal(t, int64(DEFAULT_FAILTIMEOUT), vs.failTimeout("127.0.0.1:10002"))
+	vs.pool_lock.RUnlock()
+
+	// overridden at runtime
+	_, err = vs.AddServer(config.Server{Address: "127.0.0.1:10002", Weight: 1, MaxFails: 2})
+	require.NoError(t, err)
+	vs.markFail("127.0.0.1:10002")
+	vs.pool_lock.RLock()
+	assert.True(t, vs.failed("127.0.0.1:10002"))
+	vs.pool_lock.RUnlock()
+	assert.Equal(t, 2, vs.Members()[1].MaxFails)
+
+	_, err = vs.AddServer(config.Server{Address: "127.0.0.1:10003", MaxFails: -1})
+	assert.Equal(t, ErrNegativeMaxFails, err)
+	_, err = NewVirtualServer(PoolOpt([]config.Server{{Address: "127.0.0.1:10001", FailTimeout: -1}}))
+	assert.Equal(t, ErrNegativeMaxFails, err)
+}
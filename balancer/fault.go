@@ -0,0 +1,103 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MAX_FAULT_DURATION = time.Hour
+)
+
+// Fault is an artificial failure of a peer, used in failover drills
+type Fault struct {
+	Peer    string        `json:"address"`
+	Down    bool          `json:"down"`
+	Latency time.Duration `json:"latency_ns"`
+	Expire  time.Time     `json:"expire"`
+
+	timer *time.Timer
+}
+
+// InjectFault marks peer down and/or delays its requests by latency for duration,
+// a new fault of the same peer replaces the old one
+func (s *VirtualServer) InjectFault(peer string, down bool, latency, duration time.Duration) error {
+	if duration <= 0 || duration > MAX_FAULT_DURATION {
+		return fmt.Errorf("Fault duration should be in range (0, %s]", MAX_FAULT_DURATION)
+	}
+	if !down && latency <= 0 {
+		return fmt.Errorf("Fault should mark the peer down or add latency")
+	}
+
+	f := &Fault{
+		Peer:    peer,
+		Down:    down,
+		Latency: latency,
+		Expire:  time.Now().Add(duration),
+	}
+	s.ClearFault(peer)
+
+	s.pool_lock.Lock()
+	defer s.pool_lock.Unlock()
+	f.timer = time.AfterFunc(duration, func() {
+		log.WithFields(log.Fields{"audit": "fault", "vs": s.Name, "peer": peer}).Infof("Fault expired")
+		s.ClearFault(peer)
+	})
+	s.faults[peer] = f
+	if down {
+		s.downPeer(peer, REASON_FAULT)
+	}
+	return nil
+}
+
+// ClearFault removes the fault of peer, the peer is marked up unless it fails for real
+func (s *VirtualServer) ClearFault(peer string) bool {
+	s.pool_lock.Lock()
+	defer s.pool_lock.Unlock()
+
+	f, ok := s.faults[peer]
+	if !ok {
+		return false
+	}
+	f.timer.Stop()
+	delete(s.faults, peer)
+	if f.Down && !s.heldDown(peer) && !s.failed(peer) {
+		s.upPeer(peer, REASON_FAULT)
+	}
+	return true
+}
+
+func (s *VirtualServer) Faults() []Fault {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+
+	result := []Fault{}
+	for _, f := range s.faults {
+		result = append(result, Fault{Peer: f.Peer, Down: f.Down, Latency: f.Latency, Expire: f.Expire})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Peer < result[j].Peer
+	})
+	return result
+}
+
+// injectLatency sleeps if peer has a latency fault, it returns early if the client gives up
+func (s *VirtualServer) injectLatency(peer string, r *http.Request) {
+	s.pool_lock.RLock()
+	f, ok := s.faults[peer]
+	s.pool_lock.RUnlock()
+	if !ok || f.Latency <= 0 {
+		return
+	}
+
+	t := time.NewTimer(f.Latency)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestInjectFault(t *testing.T) {
+	s1 := httptest.NewServer(newHandler("s1"))
+	defer s1.Close()
+	peer := s1.URL[7:]
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+	)
+	require.NoError(t, err)
+
+	serve := func() (*httptest.ResponseRecorder, time.Duration) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		rr := httptest.NewRecorder()
+		begin := time.Now()
+		vs.ServeHTTP(rr, req)
+		return rr, time.Since(begin)
+	}
+
+	assert.NotNil(t, vs.InjectFault(peer, true, 0, 0))
+	assert.NotNil(t, vs.InjectFault(peer, true, 0, 2*MAX_FAULT_DURATION))
+	assert.NotNil(t, vs.InjectFault(peer, false, 0, time.Second))
+
+	// down
+	require.NoError(t, vs.InjectFault(peer, true, 0, time.Minute))
+	rr, _ := serve()
+	assert.Equal(t, ErrPeerNotFound.StatusCode, rr.Code)
+	faults := vs.Faults()
+	require.Equal(t, 1, len(faults))
+	assert.Equal(t, peer, faults[0].Peer)
+	assert.True(t, faults[0].Down)
+
+	assert.True(t, vs.ClearFault(peer))
+	assert.False(t, vs.ClearFault(peer))
+	rr, _ = serve()
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// latency, replaced by a new fault, and expired
+	require.NoError(t, vs.InjectFault(peer, true, 0, time.Minute))
+	require.NoError(t, vs.InjectFault(peer, false, 200*time.Millisecond, 500*time.Millisecond))
+	rr, cost := serve()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, cost >= 200*time.Millisecond)
+
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 0, len(vs.Faults()))
+	_, cost = serve()
+	assert.True(t, cost < 200*time.Millisecond)
+}
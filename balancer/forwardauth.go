@@ -0,0 +1,136 @@
+package balancer
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	DEFAULT_FORWARD_AUTH_TIMEOUT = 5 * time.Second
+	// body of a denial copied to the client
+	MAX_FORWARD_AUTH_BODY = 64 << 10
+)
+
+// forwardAuth asks an external service whether to proxy the requests
+type forwardAuth struct {
+	url             string
+	client          *http.Client
+	responseHeaders []string
+}
+
+// ForwardAuthOpt sends a GET subrequest with the headers of each request to c.URL,
+// e.g. oauth2-proxy, the request is proxied if it responds 2xx, with c.ResponseHeaders
+// of the auth response, else the auth response is returned to the client, e.g. a redirect
+// to the login page. The original method, scheme, host, URI and client address are in
+// the X-Forwarded-Method, -Proto, -Host, -Uri and -For headers of the subrequest
+func ForwardAuthOpt(c config.ForwardAuth) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.URL == "" {
+			return nil
+		}
+		if u, err := url.Parse(c.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return ErrForwardAuthURL
+		}
+		timeout := time.Duration(c.Timeout) * time.Millisecond
+		if timeout <= 0 {
+			timeout = DEFAULT_FORWARD_AUTH_TIMEOUT
+		}
+		responseHeaders := make([]string, len(c.ResponseHeaders))
+		for i, h := range c.ResponseHeaders {
+			responseHeaders[i] = http.CanonicalHeaderKey(h)
+		}
+		vs.forwardAuth = &forwardAuth{
+			url: c.URL,
+			client: &http.Client{
+				Timeout: timeout,
+				// the redirects are for the client
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			},
+			responseHeaders: responseHeaders,
+		}
+		vs.forwardAuthConf = c
+		return nil
+	}
+}
+
+// subrequest returns the auth request of r
+func (fa *forwardAuth) subrequest(r *http.Request) (*http.Request, error) {
+	req, err := http.NewRequest("GET", fa.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(r.Context())
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Del("Content-Length")
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", scheme)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", clientIP(r.RemoteAddr))
+	return req, nil
+}
+
+// withForwardAuth proxies the requests allowed by the auth service
+func (s *VirtualServer) withForwardAuth(next http.Handler) http.Handler {
+	fa := s.forwardAuth
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// set by the auth service only
+		for _, h := range fa.responseHeaders {
+			r.Header.Del(h)
+		}
+		req, err := fa.subrequest(r)
+		if err != nil {
+			log.Errorf("[%s] forward auth request error=%v", s.Name, err)
+			s.writeError(w, r, ErrInternalBalancer)
+			return
+		}
+		resp, err := fa.client.Do(req)
+		if err != nil {
+			log.Errorf("[%s] forward auth %s error=%v", s.Name, fa.url, err)
+			s.writeError(w, r, ErrBadGateway)
+			return
+		}
+		if resp.StatusCode/100 != 2 {
+			defer resp.Body.Close()
+			log.WithFields(log.Fields{"event": "forward_auth", "vs": s.Name, "remote": r.RemoteAddr}).
+				Infof("Denied %s %s%s: %s", r.Method, r.Host, r.URL, resp.Status)
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			for _, h := range hopHeaders {
+				w.Header().Del(h)
+			}
+			w.Header().Del("Content-Length")
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, io.LimitReader(resp.Body, MAX_FORWARD_AUTH_BODY))
+			return
+		}
+		for _, h := range fa.responseHeaders {
+			if v, ok := resp.Header[h]; ok {
+				r.Header[h] = v
+			}
+		}
+		// drained so the connection to the auth service is reused, not held during the request
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, MAX_FORWARD_AUTH_BODY))
+		resp.Body.Close()
+		next.ServeHTTP(w, r)
+	})
+}
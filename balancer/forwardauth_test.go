@@ -0,0 +1,118 @@
+package balancer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestForwardAuth(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Auth-Request-User")))
+	}))
+	defer s.Close()
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.Header.Get("X-Forwarded-Method") != "POST" ||
+			r.Header.Get("X-Forwarded-Uri") != "/app?x=1" || r.Header.Get("X-Forwarded-Host") != "localhost" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if c, err := r.Cookie("session"); err == nil && c.Value == "alice" {
+			w.Header().Set("X-Auth-Request-User", "alice")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		http.Redirect(w, r, "https://login.example.com/", http.StatusFound)
+	}))
+	defer auth.Close()
+
+	_, err := NewVirtualServer(ForwardAuthOpt(config.ForwardAuth{URL: "/auth"}))
+	assert.Equal(t, ErrForwardAuthURL, err)
+
+	c := config.ForwardAuth{URL: auth.URL, ResponseHeaders: []string{"x-auth-request-user"}}
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		ServerNameOpt("localhost"),
+		PoolOpt([]config.Server{{Address: s.URL[7:], Weight: 1}}),
+		ForwardAuthOpt(c),
+	)
+	require.NoError(t, err)
+	serve := func(set func(r *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/app?x=1", nil)
+		req.Host = "localhost"
+		set(req)
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(func(r *http.Request) { r.Header.Set("X-Auth-Request-User", "mallory") })
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://login.example.com/", w.Header().Get("Location"))
+
+	w = serve(func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: "session", Value: "alice"})
+		r.Header.Set("X-Auth-Request-User", "mallory")
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice", w.Body.String())
+
+	assert.Equal(t, c, vs.EffectiveConfig().ForwardAuth)
+
+	auth.Close()
+	assert.Equal(t, http.StatusBadGateway, serve(func(r *http.Request) {}).Code)
+}
+
+func TestForwardAuthDrained(t *testing.T) {
+	var vs *VirtualServer
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "localhost"
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+	// the outer request is authorized again by the peer while it is being proxied
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/inner" {
+			w.Write([]byte("inner"))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write(serve("/inner").Body.Bytes())
+	}))
+	defer s.Close()
+	var conns int32
+	auth := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("authorized"))
+	}))
+	auth.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	auth.Start()
+	defer auth.Close()
+
+	var err error
+	vs, err = NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		ServerNameOpt("localhost"),
+		PoolOpt([]config.Server{{Address: s.URL[7:], Weight: 1}}),
+		ForwardAuthOpt(config.ForwardAuth{URL: auth.URL}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "inner", serve("/").Body.String())
+	// the auth response is not held during the proxied request, its connection is reused
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
@@ -0,0 +1,47 @@
+package balancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// probeGRPC calls grpc.health.v1.Health/Check of service on host, TLS if scheme is https,
+// the peer is healthy if the service is SERVING
+func probeGRPC(ctx context.Context, host, scheme, service string) error {
+	creds := grpc.WithInsecure()
+	if scheme == PROTO_HTTPS {
+		serverName, _, _ := net.SplitHostPort(host)
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{ServerName: serverName}))
+	}
+	dial := unixDialer((&net.Dialer{}).DialContext)
+	conn, err := grpc.DialContext(ctx, host, creds, grpc.WithBlock(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			dctx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				dctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			return dial(dctx, "tcp", addr)
+		}))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("grpc service %q %s", service, resp.Status)
+	}
+	return nil
+}
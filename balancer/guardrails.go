@@ -0,0 +1,197 @@
+package balancer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	// resource usage over a soft limit, a hard limit, or back under the soft limits
+	EVENT_GUARDRAIL_SOFT  = "guardrail_soft"
+	EVENT_GUARDRAIL_HARD  = "guardrail_hard"
+	EVENT_GUARDRAIL_CLEAR = "guardrail_clear"
+
+	DEFAULT_GUARDRAIL_INTERVAL = 5 * time.Second
+)
+
+// levels of the guardrails
+const (
+	guardOK = iota
+	guardSoft
+	guardHard
+)
+
+var (
+	// share of the new requests shed, bits of a float64
+	guardShed uint64
+	// 1 if the new connections are refused
+	guardRefuse int32
+
+	guard_lock sync.Mutex
+	// why the limits are exceeded, empty if they are not
+	guardReasons []string
+)
+
+// usage of the resources of the process
+type usage struct {
+	fds        int
+	goroutines int
+	heapMB     int
+}
+
+// measure returns the current usage, the file descriptors are counted on Linux only
+func measure() usage {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	u := usage{goroutines: runtime.NumGoroutine(), heapMB: int(m.HeapAlloc >> 20)}
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		u.fds = len(fds)
+	}
+	return u
+}
+
+// evaluate returns the level of u against the limits of c, the share of the requests to shed
+// and why. The share rises from 0 at the soft limit to 1 at the hard limit, or at twice the
+// soft limit if there is no hard one
+func evaluate(c config.Guardrails, u usage) (int, float64, []string) {
+	level, shed := guardOK, 0.0
+	reasons := []string{}
+	check := func(name string, value, soft, hard int) {
+		if hard > 0 && value >= hard {
+			level, shed = guardHard, 1
+			reasons = append(reasons, fmt.Sprintf("%s %d over hard limit %d", name, value, hard))
+			return
+		}
+		if soft <= 0 || value < soft {
+			return
+		}
+		if level < guardSoft {
+			level = guardSoft
+		}
+		top := hard
+		if top <= soft {
+			top = 2 * soft
+		}
+		shed = math.Max(shed, float64(value-soft)/float64(top-soft))
+		reasons = append(reasons, fmt.Sprintf("%s %d over soft limit %d", name, value, soft))
+	}
+	check("fds", u.fds, c.Soft.FDs, c.Hard.FDs)
+	check("goroutines", u.goroutines, c.Soft.Goroutines, c.Hard.Goroutines)
+	check("heap_mb", u.heapMB, c.Soft.HeapMB, c.Hard.HeapMB)
+	return level, math.Min(shed, 1), reasons
+}
+
+// setGuard applies a level, shed share and reasons to the listeners
+func setGuard(level int, shed float64, reasons []string) {
+	atomic.StoreUint64(&guardShed, math.Float64bits(shed))
+	refuse := int32(0)
+	if level == guardHard {
+		refuse = 1
+	}
+	atomic.StoreInt32(&guardRefuse, refuse)
+	guard_lock.Lock()
+	guardReasons = reasons
+	guard_lock.Unlock()
+}
+
+// StartGuardrails checks the resource usage of the process against the limits of c
+// every interval, and sends the level changes to handlers, e.g. Webhook.
+// The returned function stops it and lifts the limits
+func StartGuardrails(c config.Guardrails, handlers ...EventHandler) func() {
+	interval := time.Duration(c.Interval) * time.Second
+	if interval <= 0 {
+		interval = DEFAULT_GUARDRAIL_INTERVAL
+	}
+	bus := &eventBus{handlers: handlers, queue: make(chan Event, EVENT_QUEUE_SIZE)}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := guardOK
+		for {
+			level, shed, reasons := evaluate(c, measure())
+			setGuard(level, shed, reasons)
+			if level != last {
+				alert(bus, level, reasons)
+				last = level
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				setGuard(guardOK, 0, nil)
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+	}
+}
+
+// alert logs a level change and publishes it to bus
+func alert(bus *eventBus, level int, reasons []string) {
+	typ := EVENT_GUARDRAIL_CLEAR
+	switch level {
+	case guardSoft:
+		typ = EVENT_GUARDRAIL_SOFT
+	case guardHard:
+		typ = EVENT_GUARDRAIL_HARD
+	}
+	reason := strings.Join(reasons, ", ")
+	if level == guardOK {
+		log.Infof("Resource usage is back under the soft limits")
+	} else {
+		log.Warnf("Resource usage %s: %s", typ, reason)
+	}
+	if len(bus.handlers) > 0 {
+		bus.publish(Event{Type: typ, Reason: reason, Time: time.Now()})
+	}
+}
+
+// guardrailReasons returns why the resource limits are exceeded, empty if they are not
+func guardrailReasons() []string {
+	guard_lock.Lock()
+	defer guard_lock.Unlock()
+	return guardReasons
+}
+
+// shedByGuard returns true if a new request should be shed by the guardrails
+func shedByGuard() bool {
+	shed := math.Float64frombits(atomic.LoadUint64(&guardShed))
+	return shed > 0 && rand.Float64() < shed
+}
+
+// guardedListener closes the accepted connections over a hard limit
+type guardedListener struct {
+	net.Listener
+}
+
+func (l guardedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || atomic.LoadInt32(&guardRefuse) == 0 {
+			return c, err
+		}
+		c.Close()
+	}
+}
+
+// writeShed responds to a request shed by the guardrails
+func writeShed(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	WriteError(w, ErrServiceUnavailable)
+}
@@ -0,0 +1,125 @@
+package balancer
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestEvaluateGuardrails(t *testing.T) {
+	c := config.Guardrails{
+		Soft: config.ResourceLimits{FDs: 100, Goroutines: 1000},
+		Hard: config.ResourceLimits{FDs: 200},
+	}
+	level, shed, reasons := evaluate(c, usage{fds: 50, goroutines: 10, heapMB: 1000})
+	assert.Equal(t, guardOK, level)
+	assert.Equal(t, 0.0, shed)
+	assert.Empty(t, reasons)
+
+	level, shed, reasons = evaluate(c, usage{fds: 150, goroutines: 10})
+	assert.Equal(t, guardSoft, level)
+	assert.Equal(t, 0.5, shed)
+	assert.Equal(t, []string{"fds 150 over soft limit 100"}, reasons)
+
+	// no hard limit, all shed at twice the soft limit
+	level, shed, reasons = evaluate(c, usage{fds: 150, goroutines: 1750})
+	assert.Equal(t, guardSoft, level)
+	assert.Equal(t, 0.75, shed)
+	assert.Len(t, reasons, 2)
+
+	level, shed, reasons = evaluate(c, usage{fds: 200, goroutines: 1500})
+	assert.Equal(t, guardHard, level)
+	assert.Equal(t, 1.0, shed)
+	assert.Equal(t, []string{"fds 200 over hard limit 200", "goroutines 1500 over soft limit 1000"}, reasons)
+}
+
+func TestGuardrailsShed(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt("127.0.0.1:8116"), PoolOpt([]config.Server{}))
+	require.NoError(t, err)
+	l := &listener{vservers: []*VirtualServer{vs}}
+	defer setGuard(guardOK, 0, nil)
+
+	setGuard(guardSoft, 1, []string{"goroutines 20 over soft limit 10"})
+	rr := httptest.NewRecorder()
+	l.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, 503, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+
+	b := &Balancer{}
+	assert.Equal(t, []string{"goroutines 20 over soft limit 10"}, b.Unready())
+
+	setGuard(guardOK, 0, nil)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	rr = httptest.NewRecorder()
+	l.ServeHTTP(rr, req)
+	// passed to the empty pool
+	assert.Equal(t, 502, rr.Code)
+	assert.Empty(t, b.Unready())
+}
+
+func TestGuardedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:8116")
+	require.NoError(t, err)
+	gl := guardedListener{ln}
+	defer gl.Close()
+	defer setGuard(guardOK, 0, nil)
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := gl.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	setGuard(guardHard, 1, []string{"fds 200 over hard limit 200"})
+	refused, err := net.Dial("tcp", "127.0.0.1:8116")
+	require.NoError(t, err)
+	defer refused.Close()
+	// closed by the listener
+	refused.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = refused.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Len(t, accepted, 0)
+
+	setGuard(guardOK, 0, nil)
+	c, err := net.Dial("tcp", "127.0.0.1:8116")
+	require.NoError(t, err)
+	defer c.Close()
+	select {
+	case a := <-accepted:
+		a.Close()
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+	}
+}
+
+func TestStartGuardrails(t *testing.T) {
+	events := make(chan Event, 4)
+	stop := StartGuardrails(config.Guardrails{Soft: config.ResourceLimits{Goroutines: 1}},
+		func(e Event) { events <- e })
+	select {
+	case e := <-events:
+		assert.Equal(t, EVENT_GUARDRAIL_SOFT, e.Type)
+		assert.Contains(t, e.Reason, "over soft limit 1")
+	case <-time.After(time.Second):
+		t.Fatal("no guardrail event")
+	}
+	assert.NotEmpty(t, guardrailReasons())
+
+	stop()
+	for i := 0; i < 100 && len(guardrailReasons()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(t, guardrailReasons())
+}
@@ -0,0 +1,330 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ENV_LISTENERS lists the addresses of the listeners passed to a child process,
+// separated by comma, the i-th one is the file descriptor 3+i. An address is repeated
+// for each of its SO_REUSEPORT listeners
+const ENV_LISTENERS = "GOLB_LISTENERS"
+
+// systemd socket activation, see sd_listen_fds(3)
+const (
+	ENV_LISTEN_PID     = "LISTEN_PID"
+	ENV_LISTEN_FDS     = "LISTEN_FDS"
+	ENV_LISTEN_FDNAMES = "LISTEN_FDNAMES"
+)
+
+// activatedListener is passed by systemd, and taken by the address it is bound to (ListenStream=),
+// the name (FileDescriptorName=) is only logged
+type activatedListener struct {
+	name string
+	net.Listener
+}
+
+var (
+	handoff_lock sync.Mutex
+	// listeners passed by the parent process and not taken yet, by address, in order
+	inherited = make(map[string][]net.Listener)
+	// whether any listener was passed by the parent process
+	hasInherited bool
+	// listeners passed by systemd and not taken yet
+	activated []activatedListener
+	// listeners to pass to a child process on Upgrade, by address, in order
+	opened      = make(map[string][]*handoffListener)
+	inheritOnce sync.Once
+)
+
+// handoffListener is untracked when closed, so it is not passed on Upgrade
+type handoffListener struct {
+	net.Listener
+	address string
+	once    sync.Once
+	err     error
+}
+
+func (l *handoffListener) Close() error {
+	l.once.Do(func() {
+		handoff_lock.Lock()
+		for i, o := range opened[l.address] {
+			if o == l {
+				opened[l.address] = append(opened[l.address][:i], opened[l.address][i+1:]...)
+				break
+			}
+		}
+		if len(opened[l.address]) == 0 {
+			delete(opened, l.address)
+		}
+		handoff_lock.Unlock()
+		l.err = l.Listener.Close()
+	})
+	return l.err
+}
+
+// inheritListeners registers files as the listeners of addrs, handoff_lock should be held
+func inheritListeners(addrs []string, files []*os.File) error {
+	if len(addrs) != len(files) {
+		return fmt.Errorf("%d addresses for %d listeners", len(addrs), len(files))
+	}
+	for i, f := range files {
+		ln, err := net.FileListener(f)
+		// the listener holds a dup of the descriptor
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherit listener %s error=%v", addrs[i], err)
+		}
+		inherited[addrs[i]] = append(inherited[addrs[i]], ln)
+		hasInherited = true
+	}
+	return nil
+}
+
+// systemdFds returns the number of the file descriptors passed by systemd and their names,
+// the environment variables are unset so they are not passed to the processes started by us
+func systemdFds() (int, []string) {
+	defer func() {
+		os.Unsetenv(ENV_LISTEN_PID)
+		os.Unsetenv(ENV_LISTEN_FDS)
+		os.Unsetenv(ENV_LISTEN_FDNAMES)
+	}()
+	if pid, err := strconv.Atoi(os.Getenv(ENV_LISTEN_PID)); err != nil || pid != os.Getpid() {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(ENV_LISTEN_FDS))
+	if err != nil || n <= 0 {
+		return 0, nil
+	}
+	names := make([]string, n)
+	if env := os.Getenv(ENV_LISTEN_FDNAMES); env != "" {
+		copy(names, strings.Split(env, ":"))
+	}
+	return n, names
+}
+
+// activate registers files as the listeners passed by systemd, handoff_lock should be held
+func activate(names []string, files []*os.File) error {
+	for i, f := range files {
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("activated listener %d (%s) error=%v", i, names[i], err)
+		}
+		activated = append(activated, activatedListener{name: names[i], Listener: ln})
+	}
+	return nil
+}
+
+// listensOn returns true if l is bound to address, an empty or unspecified host
+// matches the unspecified one only
+func (l activatedListener) listensOn(address string) bool {
+	if network, path := listenNetwork(address); network == "unix" {
+		bound, ok := l.Addr().(*net.UnixAddr)
+		return ok && bound.Name == path
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	bound, ok := l.Addr().(*net.TCPAddr)
+	if !ok || strconv.Itoa(bound.Port) != port {
+		return false
+	}
+	if host == "" {
+		return bound.IP.IsUnspecified()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.Equal(bound.IP) || (ip.IsUnspecified() && bound.IP.IsUnspecified())
+}
+
+// takeActivated returns the listener passed by systemd for address, nil if none,
+// handoff_lock should be held
+func takeActivated(address string) net.Listener {
+	for i, l := range activated {
+		if l.listensOn(address) {
+			log.Infof("Listening on %s activated by systemd, name %q", address, l.name)
+			activated = append(activated[:i], activated[i+1:]...)
+			return l.Listener
+		}
+	}
+	return nil
+}
+
+// loadInherited takes the listeners passed by the parent process or by systemd, once
+func loadInherited() {
+	inheritOnce.Do(func() {
+		env := os.Getenv(ENV_LISTENERS)
+		if env == "" {
+			loadActivated()
+			return
+		}
+		// not passed to the processes started by us
+		os.Unsetenv(ENV_LISTENERS)
+		addrs := strings.Split(env, ",")
+		files := make([]*os.File, len(addrs))
+		for i, addr := range addrs {
+			files[i] = os.NewFile(uintptr(3+i), addr)
+		}
+		handoff_lock.Lock()
+		err := inheritListeners(addrs, files)
+		handoff_lock.Unlock()
+		if err != nil {
+			log.Errorf("Inherit listeners %s error=%v", env, err)
+			return
+		}
+		log.Infof("Inherited listeners %s", env)
+	})
+}
+
+func loadActivated() {
+	n, names := systemdFds()
+	if n == 0 {
+		return
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(3+i), names[i])
+	}
+	handoff_lock.Lock()
+	err := activate(names, files)
+	handoff_lock.Unlock()
+	if err != nil {
+		log.Errorf("Socket activation error=%v", err)
+		return
+	}
+	log.Infof("Activated %d listeners by systemd", n)
+}
+
+// Inherited returns true if the process is started by Upgrade
+func Inherited() bool {
+	loadInherited()
+	handoff_lock.Lock()
+	defer handoff_lock.Unlock()
+	return hasInherited
+}
+
+// Listen returns the listener of address passed by the parent process or by systemd, or listens on it,
+// the listener is passed to the child process on Upgrade until closed
+func Listen(address string) (net.Listener, error) {
+	return listenAddress(address, false)
+}
+
+// listenAddress is Listen, the new socket is SO_REUSEPORT if reusePort
+func listenAddress(address string, reusePort bool) (net.Listener, error) {
+	loadInherited()
+	handoff_lock.Lock()
+	defer handoff_lock.Unlock()
+
+	var ln net.Listener
+	if lns := inherited[address]; len(lns) > 0 {
+		ln = lns[0]
+		if inherited[address] = lns[1:]; len(inherited[address]) == 0 {
+			delete(inherited, address)
+		}
+	} else if ln = takeActivated(address); ln == nil {
+		var err error
+		if reusePort {
+			ln, err = listenReusePort(address)
+		} else {
+			network, addr := listenNetwork(address)
+			if network == "unix" {
+				removeStaleSocket(addr)
+			}
+			ln, err = net.Listen(network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	l := &handoffListener{Listener: ln, address: address}
+	opened[address] = append(opened[address], l)
+	return l, nil
+}
+
+// closeInherited closes the listeners of address passed by the parent process and not taken,
+// e.g. the child process runs fewer SO_REUSEPORT listeners, they would get connections never accepted
+func closeInherited(address string) {
+	handoff_lock.Lock()
+	defer handoff_lock.Unlock()
+	for _, ln := range inherited[address] {
+		log.Infof("Closing the inherited listener %s not taken", address)
+		ln.Close()
+	}
+	delete(inherited, address)
+}
+
+// Upgrade starts the executable of the process again with the same arguments,
+// and passes the listeners to it. The process should stop after the child is ready,
+// while the child accepts the new connections
+func Upgrade() (*os.Process, error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	handoff_lock.Lock()
+	addrs := []string{}
+	files := []*os.File{}
+	for addr, lns := range opened {
+		for _, l := range lns {
+			filer, ok := l.Listener.(interface {
+				File() (*os.File, error)
+			})
+			if !ok {
+				continue
+			}
+			// the socket file is used by the child
+			if ul, ok := l.Listener.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+			f, err := filer.File()
+			if err != nil {
+				handoff_lock.Unlock()
+				closeFiles(files)
+				return nil, fmt.Errorf("listener %s error=%v", addr, err)
+			}
+			addrs = append(addrs, addr)
+			files = append(files, f)
+		}
+	}
+	handoff_lock.Unlock()
+	// the child has its own copies
+	defer closeFiles(files)
+
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, ENV_LISTENERS+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, ENV_LISTENERS+"="+strings.Join(addrs, ","))
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	log.Infof("Upgrading to process %d with listeners %s", cmd.Process.Pid, strings.Join(addrs, ","))
+	return cmd.Process, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
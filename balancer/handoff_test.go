@@ -0,0 +1,119 @@
+package balancer
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenInherited(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	f, err := ln.(*net.TCPListener).File()
+	require.NoError(t, err)
+	// the socket is kept open by f, as by a parent process
+	ln.Close()
+
+	handoff_lock.Lock()
+	err = inheritListeners([]string{addr}, []*os.File{f})
+	handoff_lock.Unlock()
+	require.NoError(t, err)
+	defer func() { hasInherited = false }()
+	assert.True(t, Inherited())
+
+	l, err := Listen(addr)
+	require.NoError(t, err)
+	assert.Empty(t, inherited)
+	assert.Contains(t, opened, addr)
+	go http.Serve(l, newHandler("inherited"))
+
+	resp, err := http.Get("http://" + addr + "/")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "inherited", string(body))
+
+	// closed listeners are not passed on upgrade
+	require.NoError(t, l.Close())
+	assert.NotContains(t, opened, addr)
+
+	l, err = Listen(addr)
+	require.NoError(t, err)
+	l.Close()
+
+	handoff_lock.Lock()
+	err = inheritListeners([]string{addr, addr}, []*os.File{})
+	handoff_lock.Unlock()
+	assert.Error(t, err)
+}
+
+func TestSystemdFds(t *testing.T) {
+	os.Setenv(ENV_LISTEN_PID, strconv.Itoa(os.Getpid()))
+	os.Setenv(ENV_LISTEN_FDS, "2")
+	os.Setenv(ENV_LISTEN_FDNAMES, "web")
+	n, names := systemdFds()
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"web", ""}, names)
+	assert.Empty(t, os.Getenv(ENV_LISTEN_FDS))
+
+	// for another process
+	os.Setenv(ENV_LISTEN_PID, "1")
+	os.Setenv(ENV_LISTEN_FDS, "2")
+	n, _ = systemdFds()
+	assert.Equal(t, 0, n)
+}
+
+func TestListenActivated(t *testing.T) {
+	named, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	bound, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	wildcard, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	files := []*os.File{}
+	for _, ln := range []net.Listener{named, bound, wildcard} {
+		f, err := ln.(*net.TCPListener).File()
+		require.NoError(t, err)
+		files = append(files, f)
+		defer ln.Close()
+	}
+
+	handoff_lock.Lock()
+	err = activate([]string{"web", "", ""}, files)
+	handoff_lock.Unlock()
+	require.NoError(t, err)
+	defer func() { activated = nil }()
+
+	port := strconv.Itoa(wildcard.Addr().(*net.TCPAddr).Port)
+	l := activated[2]
+	assert.True(t, l.listensOn(":"+port))
+	assert.True(t, l.listensOn("0.0.0.0:"+port))
+	assert.True(t, l.listensOn("[::]:"+port))
+	assert.False(t, l.listensOn("127.0.0.1:"+port))
+	assert.False(t, l.listensOn(":1"))
+
+	ln, err := Listen(named.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, named.Addr().String(), ln.Addr().String())
+	ln.Close()
+
+	ln, err = Listen(bound.Addr().String())
+	require.NoError(t, err)
+	go http.Serve(ln, newHandler("activated"))
+	resp, err := http.Get("http://" + bound.Addr().String() + "/")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "activated", string(body))
+	ln.Close()
+
+	assert.Len(t, activated, 1)
+	assert.False(t, Inherited())
+}
@@ -0,0 +1,85 @@
+package balancer
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+
+	"github.com/onestraw/golb/config"
+)
+
+// HeadersOpt rewrites the request headers sent to the pool (including the pools
+// of the rules, canary and mirror) and the response headers returned to the clients
+func HeadersOpt(c config.Headers) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if !emptyHeaderRules(c.Request) {
+			vs.requestHeaders = &c.Request
+		}
+		if !emptyHeaderRules(c.Response) {
+			vs.responseHeaders = &c.Response
+		}
+		return nil
+	}
+}
+
+func emptyHeaderRules(c config.HeaderRules) bool {
+	return len(c.Set) == 0 && len(c.Add) == 0 && len(c.Remove) == 0
+}
+
+// rewriteHeader applies c to h, the variables of the values are those of r
+func rewriteHeader(h http.Header, c *config.HeaderRules, r *http.Request) {
+	for _, name := range c.Remove {
+		h.Del(name)
+	}
+	for name, value := range c.Set {
+		h.Set(name, expandVars(value, r))
+	}
+	for name, value := range c.Add {
+		h.Add(name, expandVars(value, r))
+	}
+}
+
+// headerWriter rewrites the response headers right before the status is written
+type headerWriter struct {
+	http.ResponseWriter
+	c           *config.HeaderRules
+	r           *http.Request
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		rewriteHeader(w.Header(), w.c, w.r)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	flush(w.ResponseWriter)
+}
+
+func (w *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+func (w *headerWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// rewriteHeaders rewrites the headers of r, and wraps w if the response headers are rewritten
+func (s *VirtualServer) rewriteHeaders(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if s.requestHeaders != nil {
+		rewriteHeader(r.Header, s.requestHeaders, r)
+	}
+	if s.responseHeaders == nil {
+		return w
+	}
+	return &headerWriter{ResponseWriter: w, c: s.responseHeaders, r: r}
+}
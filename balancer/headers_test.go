@@ -0,0 +1,63 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.2.3")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprintf(w, "env=%s via=%s cookie=%s", r.Header.Get("X-Env"),
+			strings.Join(r.Header["Via"], ","), r.Header.Get("Cookie"))
+	}))
+	defer upstream.Close()
+
+	jsonBody := fmt.Sprintf(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8100",
+		"pool":[{"address":"%s"}],
+		"headers":{
+			"request":{"set":{"X-Env":"prod"},"add":{"Via":"golb"},"remove":["Cookie"]},
+			"response":{"set":{"Strict-Transport-Security":"max-age=31536000"},"add":{"Cache-Control":"private"},"remove":["Server"]}}}]}`,
+		upstream.URL[7:])
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := New(c.VServers)
+	require.NoError(t, err)
+	vs := b.VServers[0]
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "localhost"
+	r.Header.Set("X-Env", "dev")
+	r.Header.Set("Via", "1.1 cdn")
+	r.Header.Set("Cookie", "session=1")
+	rr := httptest.NewRecorder()
+	vs.ServeHTTP(rr, r)
+
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "env=prod via=1.1 cdn,golb cookie=", rr.Body.String())
+	assert.Empty(t, rr.Header().Get("Server"))
+	assert.Equal(t, "max-age=31536000", rr.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, []string{"no-cache", "private"}, rr.Header()["Cache-Control"])
+
+	// the errors of the balancer are rewritten too
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Host = "example.com"
+	rr = httptest.NewRecorder()
+	vs.ServeHTTP(rr, r)
+	assert.Equal(t, 400, rr.Code)
+	assert.Equal(t, "max-age=31536000", rr.Header().Get("Strict-Transport-Security"))
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), HeadersOpt(config.Headers{}))
+	require.NoError(t, err)
+	assert.Nil(t, vs.requestHeaders)
+	assert.Nil(t, vs.responseHeaders)
+}
@@ -0,0 +1,186 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	DEFAULT_HEALTH_CHECK_INTERVAL = 5
+	DEFAULT_HEALTH_CHECK_TIMEOUT  = 2
+	HEALTH_CHECK_HTTP             = "http"
+	HEALTH_CHECK_GRPC             = "grpc"
+	// granularity of the probe schedule
+	HEALTH_CHECK_TICK = time.Second
+)
+
+// HealthCheckOpt probes the peers actively, a peer is marked down by a failed probe
+// and up by a successful one. A pool member may override it, see config.Server
+func HealthCheckOpt(c config.HealthCheck) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.Type != "" && c.Type != HEALTH_CHECK_HTTP && c.Type != HEALTH_CHECK_GRPC {
+			return ErrHealthCheckType
+		}
+		if c.Path == "" && c.Type != HEALTH_CHECK_GRPC {
+			return nil
+		}
+		vs.healthCheck = &c
+		return nil
+	}
+}
+
+// peerHealthCheck returns the health check of peer, the non-zero fields of its override
+// take precedence over the health check of the virtual server, nil if peer is not checked
+func (s *VirtualServer) peerHealthCheck(peer string) *config.HealthCheck {
+	c := config.HealthCheck{}
+	if s.healthCheck != nil {
+		c = *s.healthCheck
+	}
+	s.pool_lock.RLock()
+	o, ok := s.peerChecks[peer]
+	s.pool_lock.RUnlock()
+	if ok {
+		if o.Type != "" {
+			c.Type = o.Type
+		}
+		if o.Path != "" {
+			c.Path = o.Path
+		}
+		if o.Service != "" {
+			c.Service = o.Service
+		}
+		if o.Port > 0 {
+			c.Port = o.Port
+		}
+		if o.Interval > 0 {
+			c.Interval = o.Interval
+		}
+		if o.Timeout > 0 {
+			c.Timeout = o.Timeout
+		}
+	}
+	if c.Path == "" && c.Type != HEALTH_CHECK_GRPC {
+		return nil
+	}
+	if c.Interval <= 0 {
+		c.Interval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+	return &c
+}
+
+// hasHealthCheck returns true if the virtual server or any pool member configures a health check
+func (s *VirtualServer) hasHealthCheck() bool {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+	return s.healthCheck != nil || len(s.peerChecks) > 0
+}
+
+// probe sends GET c.Path to peer, or a grpc health check, the port is replaced by c.Port if set
+func (s *VirtualServer) probe(peer string, c *config.HealthCheck) error {
+	s.rp_lock.RLock()
+	scheme, ok := s.schemes[peer]
+	s.rp_lock.RUnlock()
+	if !ok {
+		scheme = PROTO_HTTP
+	}
+	host := peerHost(peer)
+	if c.Port > 0 && !isUnix(peer) {
+		h, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			return err
+		}
+		host = net.JoinHostPort(h, strconv.Itoa(c.Port))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout)*time.Second)
+	defer cancel()
+	if c.Type == HEALTH_CHECK_GRPC {
+		return probeGRPC(ctx, host, scheme, c.Service)
+	}
+	req, err := http.NewRequest("GET", scheme+"://"+host+c.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.roundTripper().RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkHealth probes peer and marks it down or up on state change
+func (s *VirtualServer) checkHealth(peer string, c *config.HealthCheck) {
+	err := s.probe(peer, c)
+
+	s.pool_lock.Lock()
+	defer s.pool_lock.Unlock()
+	fields := log.Fields{"event": "health", "vs": s.Name, "peer": peer, "path": c.Path}
+	if c.Type == HEALTH_CHECK_GRPC {
+		fields = log.Fields{"event": "health", "vs": s.Name, "peer": peer, "service": c.Service}
+	}
+	if err != nil {
+		if !s.unhealthy[peer] {
+			log.WithFields(fields).Warnf("Peer %s is unhealthy, err=%v", peer, err)
+			s.unhealthy[peer] = true
+			s.downPeer(peer, REASON_HEALTH)
+		}
+		return
+	}
+	s.passWarmup(peer)
+	if !s.unhealthy[peer] {
+		return
+	}
+	delete(s.unhealthy, peer)
+	log.WithFields(fields).Infof("Peer %s is healthy", peer)
+	if !s.heldDown(peer) && !s.failed(peer) {
+		s.upPeer(peer, REASON_HEALTH)
+	}
+}
+
+func (s *VirtualServer) healthLoop(stop chan struct{}) {
+	ticker := time.NewTicker(HEALTH_CHECK_TICK)
+	defer ticker.Stop()
+	// when the peers are probed next
+	next := map[string]time.Time{}
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			peers := s.Pool.Peers()
+			current := make(map[string]bool, len(peers))
+			for _, peer := range peers {
+				current[peer] = true
+				c := s.peerHealthCheck(peer)
+				if c == nil || now.Before(next[peer]) {
+					continue
+				}
+				next[peer] = now.Add(time.Duration(c.Interval) * time.Second)
+				go s.checkHealth(peer, c)
+			}
+			for peer := range next {
+				if !current[peer] {
+					delete(next, peer)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/onestraw/golb/config"
+)
+
+func healthHandler(path string, healthy *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path || atomic.LoadInt32(healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+func TestHealthCheck(t *testing.T) {
+	healthy1, healthy2 := int32(1), int32(1)
+	s1 := httptest.NewServer(healthHandler("/healthz", &healthy1))
+	s2 := httptest.NewServer(healthHandler("/v2/health", &healthy2))
+	peer1, peer2 := s1.URL[7:], s2.URL[7:]
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		HealthCheckOpt(config.HealthCheck{Path: "/healthz", Interval: 10}),
+		PoolOpt([]config.Server{
+			{Address: peer1, Weight: 1},
+			{Address: peer2, Weight: 1, HealthCheck: config.HealthCheck{Path: "/v2/health"}},
+		}),
+	)
+	require.NoError(t, err)
+	assert.True(t, vs.hasHealthCheck())
+
+	c1 := vs.peerHealthCheck(peer1)
+	assert.Equal(t, &config.HealthCheck{Path: "/healthz", Interval: 10, Timeout: DEFAULT_HEALTH_CHECK_TIMEOUT}, c1)
+	c2 := vs.peerHealthCheck(peer2)
+	assert.Equal(t, &config.HealthCheck{Path: "/v2/health", Interval: 10, Timeout: DEFAULT_HEALTH_CHECK_TIMEOUT}, c2)
+
+	vs.checkHealth(peer1, c1)
+	vs.checkHealth(peer2, c2)
+	assert.Empty(t, vs.unhealthy)
+	// the peer does not serve the path of the pool
+	assert.NotNil(t, vs.probe(peer2, c1))
+
+	atomic.StoreInt32(&healthy2, 0)
+	vs.checkHealth(peer2, c2)
+	assert.True(t, vs.unhealthy[peer2])
+	for i := 0; i < 4; i += 1 {
+		assert.Equal(t, peer1, vs.Pool.Get())
+	}
+
+	atomic.StoreInt32(&healthy2, 1)
+	vs.checkHealth(peer2, c2)
+	assert.Empty(t, vs.unhealthy)
+	result := map[string]int{}
+	for i := 0; i < 4; i += 1 {
+		result[vs.Pool.Get()] += 1
+	}
+	assert.Equal(t, 2, result[peer2])
+
+	// the override is dropped when the peer is re-added without it
+	_, err = vs.AddServer(config.Server{Address: peer2, Weight: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "/healthz", vs.peerHealthCheck(peer2).Path)
+
+	// only the pool members configuring a health check are probed
+	vs, err = NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{
+			{Address: peer1, Weight: 1},
+			{Address: peer2, Weight: 1, HealthCheck: config.HealthCheck{Path: "/v2/health", Port: 8080}},
+		}),
+	)
+	require.NoError(t, err)
+	assert.True(t, vs.hasHealthCheck())
+	assert.Nil(t, vs.peerHealthCheck(peer1))
+	assert.Equal(t, 8080, vs.peerHealthCheck(peer2).Port)
+	assert.Equal(t, DEFAULT_HEALTH_CHECK_INTERVAL, vs.peerHealthCheck(peer2).Interval)
+}
+
+func TestStartupGate(t *testing.T) {
+	healthy1, healthy2 := int32(1), int32(0)
+	s1 := httptest.NewServer(healthHandler("/healthz", &healthy1))
+	defer s1.Close()
+	s2 := httptest.NewServer(healthHandler("/healthz", &healthy2))
+	defer s2.Close()
+	peer1, peer2 := s1.URL[7:], s2.URL[7:]
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		HealthCheckOpt(config.HealthCheck{Path: "/healthz", MinHealthy: 2}),
+		PoolOpt([]config.Server{{Address: peer1, Weight: 1}, {Address: peer2, Weight: 1}}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 2, vs.EffectiveConfig().HealthCheck.MinHealthy)
+	assert.Empty(t, vs.warmingUp())
+
+	vs.status = STATUS_ENABLED
+	vs.resetWarmup()
+	assert.Equal(t, "web is warming up, 0 of 2 peers healthy", vs.unready())
+	c := vs.peerHealthCheck(peer1)
+	vs.checkHealth(peer1, c)
+	vs.checkHealth(peer2, c)
+	assert.Equal(t, "web is warming up, 1 of 2 peers healthy", vs.Unhealthy())
+
+	atomic.StoreInt32(&healthy2, 1)
+	vs.checkHealth(peer2, c)
+	assert.Empty(t, vs.unready())
+	// latched
+	atomic.StoreInt32(&healthy2, 0)
+	vs.checkHealth(peer2, c)
+	assert.Empty(t, vs.warmingUp())
+
+	// at most the pool size
+	vs.RemovePeer(peer2)
+	vs.resetWarmup()
+	assert.Equal(t, "web is warming up, 0 of 1 peers healthy", vs.warmingUp())
+	vs.checkHealth(peer1, c)
+	assert.Empty(t, vs.unready())
+}
+
+// grpcHealth serves the services of the map, SERVING if true
+type grpcHealth map[string]bool
+
+func (h grpcHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if h[req.Service] {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	return &healthpb.HealthCheckResponse{Status: status}, nil
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, grpcHealth{"": true, "echo": true, "db": false})
+	go server.Serve(ln)
+	defer server.Stop()
+	peer := ln.Addr().String()
+
+	vs, err := NewVirtualServer(
+		NameOpt("grpc"),
+		AddressOpt("127.0.0.1:80"),
+		PoolOpt([]config.Server{
+			{Address: peer, Weight: 1},
+			{Address: "127.0.0.1:10002", Weight: 1, HealthCheck: config.HealthCheck{Service: "db"}},
+		}),
+		HealthCheckOpt(config.HealthCheck{Type: HEALTH_CHECK_GRPC, Service: "echo", Timeout: 1}),
+	)
+	require.NoError(t, err)
+	c := vs.peerHealthCheck(peer)
+	require.NotNil(t, c)
+	assert.Equal(t, "echo", c.Service)
+	assert.Equal(t, "db", vs.peerHealthCheck("127.0.0.1:10002").Service)
+
+	assert.NoError(t, vs.probe(peer, c))
+	c.Service = ""
+	assert.NoError(t, vs.probe(peer, c))
+	c.Service = "db"
+	assert.Error(t, vs.probe(peer, c))
+	c.Service = "echo"
+	c.Port = 1
+	assert.Error(t, vs.probe(peer, c))
+
+	_, err = NewVirtualServer(HealthCheckOpt(config.HealthCheck{Type: "tcp"}))
+	assert.Equal(t, ErrHealthCheckType, err)
+}
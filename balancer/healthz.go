@@ -0,0 +1,74 @@
+package balancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// HealthzOpt answers the requests of path on the listener of the virtual server with 200 if
+// it has a healthy peer, and 503 otherwise, e.g. for a hardware LB probe. Empty disables it
+func HealthzOpt(path string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.healthzPath = path
+		return nil
+	}
+}
+
+// Unhealthy returns why s should be taken out of rotation, empty if it has a healthy peer
+func (s *VirtualServer) Unhealthy() string {
+	if s.Status() != STATUS_ENABLED {
+		return fmt.Sprintf("%s is %s", s.Name, s.Status())
+	}
+	if s.InMaintenance() {
+		return fmt.Sprintf("%s is in maintenance", s.Name)
+	}
+	if s.availablePeers() == 0 {
+		return fmt.Sprintf("%s has no healthy peer", s.Name)
+	}
+	return s.warmingUp()
+}
+
+// Unhealthy returns why the running virtual servers should be taken out of rotation,
+// empty if all of them have a healthy peer. The disabled virtual servers are not checked
+func (b *Balancer) Unhealthy() []string {
+	reasons := []string{}
+	for _, vs := range b.virtualServers() {
+		if vs.Status() != STATUS_ENABLED {
+			continue
+		}
+		if reason := vs.Unhealthy(); reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+	return reasons
+}
+
+// WriteHealthz writes 200 if there is no reason, 503 with the reasons otherwise
+func WriteHealthz(w http.ResponseWriter, reasons ...string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if len(reasons) == 0 {
+		io.WriteString(w, "OK")
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, reason := range reasons {
+		io.WriteString(w, reason+"\n")
+	}
+}
+
+// withHealthz answers the probes before the middlewares, e.g. the authentication and the rate limit
+func (s *VirtualServer) withHealthz(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != s.healthzPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if reason := s.Unhealthy(); reason != "" {
+			WriteHealthz(w, reason)
+			return
+		}
+		WriteHealthz(w)
+	})
+}
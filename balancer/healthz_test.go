@@ -0,0 +1,59 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestHealthz(t *testing.T) {
+	s1 := httptest.NewServer(newHandler("s1"))
+	defer s1.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		PoolOpt([]config.Server{{Address: s1.URL[7:], Weight: 1}}),
+		HealthzOpt("/healthz"),
+		RateLimitOpt(config.RateLimit{Rate: 0.01, Burst: 1}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "/healthz", vs.EffectiveConfig().HealthzPath)
+	b := &Balancer{VServers: []*VirtualServer{vs}}
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "localhost"
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+	assert.Empty(t, b.Unhealthy())
+	w := serve("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "web is stopped\n", w.Body.String())
+
+	vs.status = STATUS_ENABLED
+	// not rate limited
+	for i := 0; i < 3; i++ {
+		w = serve("/healthz")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "OK", w.Body.String())
+	}
+	assert.Equal(t, http.StatusOK, serve("/").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("/").Code)
+
+	vs.pool_lock.Lock()
+	vs.unhealthy[s1.URL[7:]] = true
+	vs.downPeer(s1.URL[7:], REASON_HEALTH)
+	vs.pool_lock.Unlock()
+	w = serve("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "web has no healthy peer\n", w.Body.String())
+	assert.Equal(t, []string{"web has no healthy peer"}, b.Unhealthy())
+}
@@ -0,0 +1,314 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/stats"
+)
+
+const (
+	DEFAULT_HEDGE_DELAY = 100 * time.Millisecond
+)
+
+// hedgeMethods are idempotent methods which are safe to be sent twice
+var hedgeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+// HedgeOpt enables hedged requests: if the primary peer has not responded
+// within the percentile (0, 100] of its observed latency, the request is also
+// sent to another peer and the first response which is not a failure wins.
+// defaultDelay is used until the primary peer has latency samples.
+func HedgeOpt(percentile float64, defaultDelay time.Duration) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if percentile == 0 {
+			return nil
+		}
+		if percentile < 0 || percentile > 100 {
+			return fmt.Errorf("Hedge percentile %v out of range (0, 100]", percentile)
+		}
+		if defaultDelay <= 0 {
+			defaultDelay = DEFAULT_HEDGE_DELAY
+		}
+		vs.hedgePercentile = percentile
+		vs.hedgeDelay = defaultDelay
+		return nil
+	}
+}
+
+// hedgeable reports whether r may be sent twice, a protocol upgrade is not
+func (s *VirtualServer) hedgeable(r *http.Request) bool {
+	return s.hedgePercentile > 0 && hedgeMethods[r.Method] && (r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0) &&
+		r.Header.Get("Upgrade") == ""
+}
+
+// hedgeDelayOf returns how long to wait for peer before hedging
+func (s *VirtualServer) hedgeDelayOf(peer string) time.Duration {
+	s.ss_lock.RLock()
+	ss, ok := s.ServerStats[peer]
+	s.ss_lock.RUnlock()
+	if ok {
+		if d, ok := ss.LatencyQuantile(s.hedgePercentile / 100); ok {
+			return s.capHedgeDelay(d)
+		}
+	}
+	return s.capHedgeDelay(s.hedgeDelay)
+}
+
+// capHedgeDelay bounds d by half a try of the latency SLA
+func (s *VirtualServer) capHedgeDelay(d time.Duration) time.Duration {
+	if s.sla != nil && d > s.sla.hedgeDelay {
+		return s.sla.hedgeDelay
+	}
+	return d
+}
+
+// hedgeRace chooses the response of a hedged request among its attempts, a response
+// which is not a failure wins at once, a failure waits for the attempts still pending
+type hedgeRace struct {
+	sync.Mutex
+	s        *VirtualServer
+	rw       http.ResponseWriter
+	attempts []*hedgeAttempt
+	// attempts started and without a response yet
+	pending int
+	winner  *hedgeAttempt
+	// a failure waiting for the response of the other attempt
+	held *hedgeAttempt
+}
+
+// start returns a new attempt to peer, nil if a response has already won
+func (h *hedgeRace) start(ctx context.Context, peer string) *hedgeAttempt {
+	h.Lock()
+	defer h.Unlock()
+	if h.winner != nil {
+		return nil
+	}
+	a := &hedgeAttempt{race: h, peer: peer, start: time.Now(), header: http.Header{}, verdict: make(chan bool, 1)}
+	a.ctx, a.cancel = context.WithCancel(ctx)
+	h.attempts = append(h.attempts, a)
+	h.pending++
+	return a
+}
+
+// respond returns whether the response of a wins, it blocks while a failure
+// waits for the other attempt
+func (h *hedgeRace) respond(a *hedgeAttempt, failed bool) bool {
+	h.Lock()
+	h.pending--
+	if h.winner != nil {
+		h.Unlock()
+		return false
+	}
+	if failed && h.pending > 0 {
+		h.held = a
+		h.Unlock()
+		return <-a.verdict
+	}
+	held := h.held
+	h.winner, h.held = a, nil
+	for _, other := range h.attempts {
+		if other != a {
+			other.cancel()
+		}
+	}
+	h.Unlock()
+	if held != nil {
+		held.verdict <- false
+	}
+	return true
+}
+
+// hedgeAttempt is the response writer of an attempt, the response is streamed
+// to the client once it wins, and discarded if it loses
+type hedgeAttempt struct {
+	race    *hedgeRace
+	peer    string
+	start   time.Time
+	ctx     context.Context
+	cancel  context.CancelFunc
+	outcome *proxyOutcome
+	header  http.Header
+	code    int
+	won     bool
+	verdict chan bool
+	// the copy of the response was aborted
+	aborted bool
+}
+
+// err returns the error of the reverse proxy, nil if the peer responded
+func (a *hedgeAttempt) err() error {
+	if a.outcome == nil {
+		return nil
+	}
+	return a.outcome.err
+}
+
+// canceled reports whether a lost before its peer responded
+func (a *hedgeAttempt) canceled() bool {
+	return !a.won && errors.Is(a.err(), context.Canceled) && a.ctx.Err() != nil
+}
+
+func (a *hedgeAttempt) Header() http.Header {
+	return a.header
+}
+
+func (a *hedgeAttempt) WriteHeader(code int) {
+	if a.code != 0 || code < http.StatusOK {
+		// the informational responses are not forwarded
+		return
+	}
+	a.code = code
+	s := a.race.s
+	if a.won = a.race.respond(a, s.isFailure(code, a.err())); !a.won {
+		return
+	}
+	rw := a.race.rw
+	for k, v := range a.header {
+		rw.Header()[k] = v
+	}
+	s.setPeerHeaders(rw.Header(), a.peer, time.Since(a.start))
+	rw.WriteHeader(code)
+}
+
+func (a *hedgeAttempt) Write(data []byte) (int, error) {
+	if a.code == 0 {
+		a.WriteHeader(http.StatusOK)
+	}
+	if !a.won {
+		return len(data), nil
+	}
+	return a.race.rw.Write(data)
+}
+
+func (a *hedgeAttempt) Flush() {
+	if f, ok := a.race.rw.(http.Flusher); ok && a.won {
+		f.Flush()
+	}
+}
+
+// hedgePeer returns a peer other than primary, with a slot taken if the connections
+// are limited, or an empty string if none is free
+func (s *VirtualServer) hedgePeer(r *http.Request, primary string) string {
+	// the pool may return primary again, try a few times
+	for i := 0; i < s.Pool.Size(); i++ {
+		peer := s.Pool.Get(s.hashKey(r))
+		if peer == "" || peer == primary {
+			continue
+		}
+		if s.limiter != nil && !s.limiter.tryAcquirePeer(peer) {
+			return ""
+		}
+		return peer
+	}
+	return ""
+}
+
+// hedge sends r to primary, and to a second peer if primary is slow, the first response
+// which is not a failure is streamed to rw, a failure only if no other attempt is pending.
+// It returns the peer which served the response and its response time
+func (s *VirtualServer) hedge(rw http.ResponseWriter, r *http.Request, primary string) (string, time.Duration) {
+	h := &hedgeRace{s: s, rw: rw}
+	served := make(chan *hedgeAttempt, 1)
+	go s.runHedgeAttempt(h.start(r.Context(), primary), r, served)
+
+	timer := time.NewTimer(s.hedgeDelayOf(primary))
+	defer timer.Stop()
+
+	for {
+		select {
+		case a := <-served:
+			if a.aborted {
+				// as the reverse proxy does, the client connection is aborted
+				panic(http.ErrAbortHandler)
+			}
+			return a.peer, time.Since(a.start)
+		case <-timer.C:
+			peer := s.hedgePeer(r, primary)
+			if peer == "" {
+				continue
+			}
+			a := h.start(r.Context(), peer)
+			if a == nil {
+				if s.limiter != nil {
+					s.limiter.release(peer)
+				}
+				continue
+			}
+			log.Infof("Hedge request %s%s to %s after waiting %s", r.Host, r.URL, peer, primary)
+			go func() {
+				if s.limiter != nil {
+					defer s.limiter.release(a.peer)
+				}
+				s.runHedgeAttempt(a, r, served)
+			}()
+		}
+	}
+}
+
+// runHedgeAttempt proxies r to the peer of a, the winner is sent to served once its response
+// is written, the outcome of a loser is recorded in the stats of its peer
+func (s *VirtualServer) runHedgeAttempt(a *hedgeAttempt, r *http.Request, served chan<- *hedgeAttempt) {
+	defer func() {
+		// the reverse proxy aborts the copy of a response with a panic, e.g. when canceled
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			a.aborted = true
+		}
+		if a.code == 0 {
+			// the other attempts may wait for this one
+			a.WriteHeader(http.StatusBadGateway)
+		}
+		a.cancel()
+		switch {
+		case a.won:
+			s.markOutcome(a.peer, a.code, a.err())
+			served <- a
+		case a.canceled():
+			log.Debugf("Hedge attempt of %s%s to %s canceled", r.Host, r.URL, a.peer)
+			s.peerStats(a.peer).IncCanceled()
+		default:
+			s.markOutcome(a.peer, a.code, a.err())
+			s.peerStats(a.peer).Inc(&stats.Data{
+				StatusCode: strconv.Itoa(a.code),
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Latency:    time.Since(a.start),
+			})
+		}
+	}()
+
+	rp, err := s.getProxy(a.peer)
+	if err != nil {
+		log.Errorf("url.Parse peer=%s, error=%v", a.peer, err)
+		a.WriteHeader(ErrInternalBalancer.StatusCode)
+		a.Write([]byte(ErrInternalBalancer.ErrMsg))
+		return
+	}
+	// the losing attempt is canceled, it is not a proxy error
+	hp := *rp
+	hp.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		if errors.Is(err, context.Canceled) && a.ctx.Err() != nil {
+			setProxyOutcome(req, err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		s.proxyError(w, req, err)
+	}
+	req, outcome := withProxyOutcome(r.WithContext(a.ctx))
+	a.outcome = outcome
+	s.injectLatency(a.peer, req)
+	hp.ServeHTTP(a, req)
+}
@@ -0,0 +1,251 @@
+package balancer
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestHedge(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(newHandler("fast"))
+	defer fast.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8087"),
+		PoolOpt([]config.Server{
+			{Address: slow.URL[7:], Weight: 1},
+			{Address: fast.URL[7:], Weight: 1},
+		}),
+		HedgeOpt(99, 50*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		rr := httptest.NewRecorder()
+		begin := time.Now()
+		vs.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "fast", rr.Body.String())
+		assert.True(t, time.Since(begin) < 500*time.Millisecond)
+	}
+
+	// non-idempotent methods are never hedged
+	results := map[string]int{}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("data"))
+		req.Host = "localhost"
+		rr := httptest.NewRecorder()
+		vs.ServeHTTP(rr, req)
+		results[rr.Body.String()] += 1
+	}
+	assert.Equal(t, 1, results["slow"])
+	assert.Equal(t, 1, results["fast"])
+}
+
+func TestHedgeOpt(t *testing.T) {
+	_, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), HedgeOpt(101, 0))
+	assert.Contains(t, err.Error(), "out of range")
+
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), HedgeOpt(95, 0))
+	require.NoError(t, err)
+	assert.Equal(t, float64(95), vs.hedgePercentile)
+	assert.Equal(t, DEFAULT_HEDGE_DELAY, vs.hedgeDelay)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), HedgeOpt(0, 0))
+	require.NoError(t, err)
+	assert.False(t, vs.hedgeable(httptest.NewRequest("GET", "/", nil)))
+}
+
+func TestHedgeLimit(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(newHandler("fast"))
+	defer fast.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8087"),
+		PoolOpt([]config.Server{
+			{Address: slow.URL[7:], Weight: 1},
+			{Address: fast.URL[7:], Weight: 1},
+		}),
+		HedgeOpt(99, 20*time.Millisecond),
+		LimitOpt(1, 0, 0, 0),
+	)
+	require.NoError(t, err)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	serve := func() string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		rr := httptest.NewRecorder()
+		vs.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		return rr.Body.String()
+	}
+	results := map[string]int{}
+	for i := 0; i < 4; i++ {
+		results[serve()] += 1
+	}
+	assert.Equal(t, 4, results["fast"])
+
+	// the hedged request needs a free slot on its peer
+	require.True(t, vs.limiter.tryAcquirePeer(fast.URL[7:]))
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "slow", serve())
+	}
+	vs.limiter.release(fast.URL[7:])
+	// the slots of the hedged requests are released
+	total := func() int {
+		vs.limiter.Lock()
+		defer vs.limiter.Unlock()
+		return vs.limiter.total
+	}
+	for i := 0; i < 100 && total() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, total())
+	// the canceled attempts are not logged as proxy errors
+	assert.NotContains(t, logs.String(), "context canceled")
+}
+
+func TestHedgePrefersSuccess(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("failing"))
+	}))
+	defer failing.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8087"),
+		PoolOpt([]config.Server{
+			{Address: failing.URL[7:], Weight: 1},
+			{Address: slow.URL[7:], Weight: 1},
+		}),
+		HedgeOpt(99, 10*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	ss := vs.peerStats(failing.URL[7:])
+	// the failure of either peer waits for the other one, still pending
+	for _, primary := range []string{failing.URL[7:], slow.URL[7:]} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		rr := httptest.NewRecorder()
+		peer, _ := vs.hedge(rr, req, primary)
+		assert.Equal(t, slow.URL[7:], peer)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "slow", rr.Body.String())
+
+		// the losing response is in the stats of its peer
+		for i := 0; i < 100 && ss.Report().StatusCode["503"] == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, uint64(1), ss.Report().StatusCode["503"])
+		// its latency would delay the next hedge beyond the failure
+		ss.Reset()
+	}
+}
+
+// streamRecorder passes the writes to a channel as they arrive
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	writes chan string
+}
+
+func (w *streamRecorder) Write(data []byte) (int, error) {
+	w.writes <- string(data)
+	return w.ResponseRecorder.Write(data)
+}
+
+func TestHedgeStreams(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	release := make(chan struct{})
+	stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first,"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("last"))
+	}))
+	defer stream.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8087"),
+		PoolOpt([]config.Server{
+			{Address: slow.URL[7:], Weight: 1},
+			{Address: stream.URL[7:], Weight: 1},
+		}),
+		HedgeOpt(99, 20*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	rw := &streamRecorder{httptest.NewRecorder(), make(chan string, 10)}
+	done := make(chan string)
+	go func() {
+		peer, _ := vs.hedge(rw, req, slow.URL[7:])
+		done <- peer
+	}()
+	// the start of the winning response arrives before its peer has finished
+	select {
+	case first := <-rw.writes:
+		assert.Equal(t, "first,", first)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("the response is not streamed")
+	}
+	close(release)
+	assert.Equal(t, stream.URL[7:], <-done)
+	assert.Equal(t, "first,last", rw.Body.String())
+
+	// the primary is canceled, it is not counted as a response of its peer
+	ss := vs.peerStats(slow.URL[7:])
+	for i := 0; i < 100 && ss.Report().Canceled == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(1), ss.Report().Canceled)
+	assert.Empty(t, ss.Report().StatusCode)
+}
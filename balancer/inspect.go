@@ -0,0 +1,85 @@
+package balancer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/waf"
+)
+
+// DEFAULT_INSPECT_BODY_SIZE is the beginning of the request bodies passed to the inspectors
+const DEFAULT_INSPECT_BODY_SIZE = 64 << 10
+
+// Inspector examines a request before it is proxied, e.g. a web application firewall,
+// body is the beginning of the request body, up to the size set by InspectorOpt.
+// A non-nil error rejects the request with a 403
+type Inspector interface {
+	Inspect(r *http.Request, body []byte) error
+}
+
+// InspectorOpt registers inspectors on the virtual server, called in order after the rate limit,
+// maxBody bytes of the request body are read for them (0 means 64KB, negative none), the largest
+// of the options, the rest is streamed to the peer uninspected. The virtual servers of the rules and the canary serve the
+// requests passed by the inspectors of their parent
+func InspectorOpt(maxBody int64, inspectors ...Inspector) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		for _, in := range inspectors {
+			if in == nil {
+				return ErrNilInspector
+			}
+		}
+		if maxBody == 0 {
+			maxBody = DEFAULT_INSPECT_BODY_SIZE
+		}
+		if maxBody > vs.inspectBody {
+			vs.inspectBody = maxBody
+		}
+		vs.inspectors = append(vs.inspectors, inspectors...)
+		return nil
+	}
+}
+
+// WAFOpt inspects the requests with the default rules of package waf, if enabled
+func WAFOpt(c config.WAF) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if !c.Enable {
+			return nil
+		}
+		vs.wafConf = c
+		return InspectorOpt(int64(c.MaxBodySize), waf.New())(vs)
+	}
+}
+
+// withInspect rejects the requests failing an inspector of s
+func (s *VirtualServer) withInspect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if s.inspectBody > 0 && r.Body != nil && r.Body != http.NoBody {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(r.Body, s.inspectBody))
+			if err != nil {
+				log.Errorf("[%s] read body to inspect error=%v", s.Name, err)
+				s.writeError(w, r, ErrBadRequest)
+				return
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+		for _, in := range s.inspectors {
+			if err := in.Inspect(r, body); err != nil {
+				log.WithFields(log.Fields{"event": "inspect", "vs": s.Name, "remote": r.RemoteAddr}).
+					Warnf("Rejected %s %s%s: %v", r.Method, r.Host, r.URL, err)
+				s.writeError(w, r, ErrForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+type inspectorFunc func(r *http.Request, body []byte) error
+
+func (f inspectorFunc) Inspect(r *http.Request, body []byte) error {
+	return f(r, body)
+}
+
+func TestInspector(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer s.Close()
+
+	_, err := NewVirtualServer(InspectorOpt(0, nil))
+	assert.Equal(t, ErrNilInspector, err)
+
+	var inspected []byte
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		ServerNameOpt("localhost"),
+		PoolOpt([]config.Server{{Address: s.URL[7:], Weight: 1}}),
+		RetryOpt(true),
+		WAFOpt(config.WAF{Enable: true, MaxBodySize: 8}),
+		InspectorOpt(-1, inspectorFunc(func(r *http.Request, body []byte) error {
+			inspected = body
+			if r.Header.Get("X-Deny") != "" {
+				return errors.New("denied")
+			}
+			return nil
+		})),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), vs.inspectBody)
+	serve := func(method, target, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Host = "localhost"
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// the body beyond the inspected size is streamed to the peer
+	w := serve("POST", "/", "hello golb, not inspected", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello golb, not inspected", w.Body.String())
+	assert.Equal(t, "hello go", string(inspected))
+
+	w = serve("GET", "/item?id=1%20UNION%20SELECT%20password%20FROM%20users", "", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrForbidden.ErrMsg)
+	form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	assert.Equal(t, http.StatusForbidden, serve("POST", "/", "<script>", form).Code)
+	assert.Equal(t, http.StatusForbidden, serve("GET", "/", "", http.Header{"X-Deny": {"1"}}).Code)
+
+	assert.Equal(t, config.WAF{Enable: true, MaxBodySize: 8}, vs.EffectiveConfig().WAF)
+}
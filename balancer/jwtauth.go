@@ -0,0 +1,86 @@
+package balancer
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/jwt"
+)
+
+// jwtAuth validates the bearer tokens of the requests
+type jwtAuth struct {
+	validator *jwt.Validator
+	// claim -> request header forwarded to the peers
+	claimHeaders map[string]string
+}
+
+// JWTOpt rejects with a 401 the requests without a valid Bearer JSON Web Token,
+// see config.JWT. The virtual servers of the rules and the canary serve the requests
+// passed by their parent
+func JWTOpt(c config.JWT) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if !c.Enable {
+			return nil
+		}
+		v, err := jwt.New(
+			jwt.SecretOpt(c.Secret),
+			jwt.KeyFileOpt(c.KeyFile),
+			jwt.JWKSOpt(c.JWKSURL, time.Duration(c.JWKSRefresh)*time.Second),
+			jwt.IssuerOpt(c.Issuer),
+			jwt.AudienceOpt(c.Audience),
+			jwt.LeewayOpt(time.Duration(c.Leeway)*time.Second),
+		)
+		if err != nil {
+			return err
+		}
+		vs.jwt = &jwtAuth{validator: v, claimHeaders: make(map[string]string, len(c.ClaimHeaders))}
+		for claim, h := range c.ClaimHeaders {
+			vs.jwt.claimHeaders[claim] = http.CanonicalHeaderKey(h)
+		}
+		vs.jwtConf = c
+		return nil
+	}
+}
+
+// bearerToken returns the token of the Authorization header of r, empty if none
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// withJWT passes the requests with a valid token, their claims forwarded as headers
+func (s *VirtualServer) withJWT(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// set by golb only
+		for _, h := range s.jwt.claimHeaders {
+			r.Header.Del(h)
+		}
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="golb"`)
+			s.writeError(w, r, ErrUnauthorized)
+			return
+		}
+		claims, err := s.jwt.validator.Validate(token)
+		if err != nil {
+			log.WithFields(log.Fields{"event": "jwt", "vs": s.Name, "remote": r.RemoteAddr}).
+				Infof("Rejected %s %s%s: %v", r.Method, r.Host, r.URL, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="golb", error="invalid_token"`)
+			s.writeError(w, r, ErrUnauthorized)
+			return
+		}
+		for claim, h := range s.jwt.claimHeaders {
+			if v := claims.String(claim); v != "" {
+				r.Header.Set(h, v)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
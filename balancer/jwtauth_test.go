@@ -0,0 +1,85 @@
+package balancer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func hs256(t *testing.T, secret string, claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	c, err := json.Marshal(claims)
+	require.NoError(t, err)
+	input := enc([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc(c)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(input))
+	return input + "." + enc(mac.Sum(nil))
+}
+
+func TestJWT(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-User") + "|" + r.Header.Get("X-Roles")))
+	}))
+	defer s.Close()
+
+	_, err := NewVirtualServer(JWTOpt(config.JWT{Enable: true}))
+	assert.Error(t, err)
+
+	c := config.JWT{
+		Enable:       true,
+		Secret:       "secret",
+		Issuer:       "golb",
+		ClaimHeaders: map[string]string{"sub": "x-user", "roles": "X-Roles"},
+	}
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		ServerNameOpt("localhost"),
+		PoolOpt([]config.Server{{Address: s.URL[7:], Weight: 1}}),
+		RetryOpt(true),
+		JWTOpt(c),
+	)
+	require.NoError(t, err)
+	serve := func(auth string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer realm="golb"`, w.Header().Get("WWW-Authenticate"))
+
+	w = serve("Bearer "+hs256(t, "wrong", map[string]interface{}{"iss": "golb"}), nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+	w = serve("Bearer "+hs256(t, "secret", map[string]interface{}{"iss": "other"}), nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// the claim headers sent by the client are dropped
+	token := hs256(t, "secret", map[string]interface{}{"iss": "golb", "sub": "alice", "roles": []string{"admin", "dev"}})
+	w = serve("bearer "+token, http.Header{"X-User": {"mallory"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice|admin,dev", w.Body.String())
+	w = serve("Bearer "+hs256(t, "secret", map[string]interface{}{"iss": "golb"}), http.Header{"X-User": {"mallory"}})
+	assert.Equal(t, "|", w.Body.String())
+
+	assert.Equal(t, c, vs.EffectiveConfig().JWT)
+}
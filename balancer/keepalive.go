@@ -0,0 +1,114 @@
+package balancer
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/onestraw/golb/config"
+)
+
+// defaults of the upstream connection pool, http.DefaultTransport keeps 2 idle connections
+// per peer only, so most connections are closed after a request under concurrency
+const (
+	DEFAULT_MAX_IDLE_CONNS          = 1024
+	DEFAULT_MAX_IDLE_CONNS_PER_HOST = 64
+	DEFAULT_IDLE_CONN_TIMEOUT       = 90 * time.Second
+)
+
+// defaultTransport is http.DefaultTransport dialing the unix peers too
+var defaultTransport = newTransport()
+
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = unixDialer(t.DialContext)
+	return t
+}
+
+// roundTripper returns the transport of the requests to the peers
+func (s *VirtualServer) roundTripper() http.RoundTripper {
+	if s.transport != nil {
+		return s.transport
+	}
+	return defaultTransport
+}
+
+// httpTransport returns the transport of the reverse proxies, a copy of defaultTransport is set if none
+func (vs *VirtualServer) httpTransport() *http.Transport {
+	if t, ok := vs.transport.(*http.Transport); ok {
+		return t
+	}
+	t := newTransport()
+	vs.transport = t
+	return t
+}
+
+// KeepAliveOpt tunes the pool of the connections to the peers, the zero values use the defaults,
+// negative MaxIdleConns means no limit, Disable opens a new connection per request
+func KeepAliveOpt(c config.KeepAlive) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.MaxIdleConnsPerHost < 0 || c.IdleTimeout < 0 {
+			return ErrInvalidKeepAlive
+		}
+		if c.MaxIdleConns == 0 {
+			c.MaxIdleConns = DEFAULT_MAX_IDLE_CONNS
+		} else if c.MaxIdleConns < 0 {
+			c.MaxIdleConns = 0
+		}
+		if c.MaxIdleConnsPerHost == 0 {
+			c.MaxIdleConnsPerHost = DEFAULT_MAX_IDLE_CONNS_PER_HOST
+		}
+		idle := time.Duration(c.IdleTimeout) * time.Second
+		if idle == 0 {
+			idle = DEFAULT_IDLE_CONN_TIMEOUT
+		}
+
+		t := vs.httpTransport()
+		t.MaxIdleConns = c.MaxIdleConns
+		t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+		t.IdleConnTimeout = idle
+		t.DisableKeepAlives = c.Disable
+		return nil
+	}
+}
+
+// keepAlive returns the settings of the connection pool, in the configuration format
+func (s *VirtualServer) keepAlive() config.KeepAlive {
+	t, ok := s.transport.(*http.Transport)
+	if !ok {
+		return config.KeepAlive{}
+	}
+	c := config.KeepAlive{
+		MaxIdleConns:        t.MaxIdleConns,
+		MaxIdleConnsPerHost: t.MaxIdleConnsPerHost,
+		IdleTimeout:         int(t.IdleConnTimeout / time.Second),
+		Disable:             t.DisableKeepAlives,
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = -1
+	}
+	return c
+}
+
+// connInc counts the connection used by the request to peer as new or reused,
+// and its TLS handshake as full or resumed
+func (s *VirtualServer) connInc(peer string, t *timing) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	got, reused := !t.gotConn.IsZero(), t.reused
+	handshake, resumed := t.handshake, t.resumed
+	t.Unlock()
+	if !got {
+		return
+	}
+	s.ss_lock.RLock()
+	ss, ok := s.ServerStats[peer]
+	s.ss_lock.RUnlock()
+	if ok {
+		ss.IncConn(reused)
+		if handshake {
+			ss.IncHandshake(resumed)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestKeepAlive(t *testing.T) {
+	_, err := NewVirtualServer(KeepAliveOpt(config.KeepAlive{IdleTimeout: -1}))
+	assert.Equal(t, ErrInvalidKeepAlive, err)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+	peer := s.URL[7:]
+
+	newVS := func(c config.KeepAlive) *VirtualServer {
+		vs, err := NewVirtualServer(
+			NameOpt("web"),
+			AddressOpt("127.0.0.1:80"),
+			ServerNameOpt("localhost"),
+			PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+			KeepAliveOpt(c),
+		)
+		require.NoError(t, err)
+		return vs
+	}
+	serve := func(vs *VirtualServer, n int) {
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = "localhost"
+			w := httptest.NewRecorder()
+			vs.handler.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+		}
+	}
+
+	vs := newVS(config.KeepAlive{})
+	assert.Equal(t, config.KeepAlive{
+		MaxIdleConns:        DEFAULT_MAX_IDLE_CONNS,
+		MaxIdleConnsPerHost: DEFAULT_MAX_IDLE_CONNS_PER_HOST,
+		IdleTimeout:         int(DEFAULT_IDLE_CONN_TIMEOUT / time.Second),
+	}, vs.EffectiveConfig().KeepAlive)
+	serve(vs, 5)
+	r := vs.StatsReport().Peers[peer]
+	assert.Equal(t, uint64(1), r.NewConns)
+	assert.Equal(t, uint64(4), r.ReusedConns)
+	assert.Equal(t, float64(80), r.ReuseRate)
+
+	vs = newVS(config.KeepAlive{MaxIdleConns: -1, Disable: true})
+	assert.Equal(t, -1, vs.EffectiveConfig().KeepAlive.MaxIdleConns)
+	serve(vs, 3)
+	r = vs.StatsReport().Peers[peer]
+	assert.Equal(t, uint64(3), r.NewConns)
+	assert.Equal(t, uint64(0), r.ReusedConns)
+}
@@ -0,0 +1,269 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/onestraw/golb/config"
+)
+
+const DEFAULT_QUEUE_TIMEOUT = time.Second
+
+var errSaturated = errors.New("saturated")
+
+// connLimiter bounds the concurrent requests per peer and per pool,
+// the requests over the limits wait in a bounded queue
+type connLimiter struct {
+	sync.Mutex
+	peerMax      int
+	poolMax      int
+	queueSize    int
+	queueTimeout time.Duration
+	priority     config.Priority
+	// path prefixes of priority.Routes, the longest first
+	prefixes []string
+	// nil means the static poolMax
+	adaptive *adaptiveLimit
+
+	active  map[string]int
+	total   int
+	waiting []*waiter
+	// closed and replaced on every release to wake up the waiting requests
+	released chan struct{}
+	// when a request was last rejected as saturated
+	shedAt time.Time
+}
+
+// LimitOpt limits the concurrent requests to peerMax per peer and poolMax for the pool,
+// 0 means unlimited. Up to queueSize requests wait queueTimeout for a free slot, the
+// others get 503. The range requests are not counted, the hedged requests are only
+// sent to a peer with a free slot
+func LimitOpt(peerMax, poolMax, queueSize int, queueTimeout time.Duration) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if peerMax <= 0 && poolMax <= 0 {
+			return nil
+		}
+		vs.limiter = newConnLimiter(peerMax, poolMax, queueSize, queueTimeout)
+		return nil
+	}
+}
+
+func newConnLimiter(peerMax, poolMax, queueSize int, queueTimeout time.Duration) *connLimiter {
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	if queueTimeout <= 0 {
+		queueTimeout = DEFAULT_QUEUE_TIMEOUT
+	}
+	return &connLimiter{
+		peerMax:      peerMax,
+		poolMax:      poolMax,
+		queueSize:    queueSize,
+		queueTimeout: queueTimeout,
+		active:       map[string]int{},
+		released:     make(chan struct{}),
+	}
+}
+
+// waiter is a request in the queue
+type waiter struct {
+	priority int
+	// closed when a request of a higher priority takes its place
+	shed chan struct{}
+}
+
+// PriorityOpt orders the queue of LimitOpt by the priority of the requests, see config.Priority
+func PriorityOpt(c config.Priority) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		l := vs.limiter
+		if l == nil {
+			return nil
+		}
+		l.priority = c
+		l.prefixes = l.prefixes[:0]
+		for prefix := range c.Routes {
+			l.prefixes = append(l.prefixes, prefix)
+		}
+		sort.Slice(l.prefixes, func(i, j int) bool {
+			return len(l.prefixes[i]) > len(l.prefixes[j])
+		})
+		return nil
+	}
+}
+
+// priorityOf returns the priority of r: its header, else its longest route, else the default
+func (l *connLimiter) priorityOf(r *http.Request) int {
+	if h := l.priority.Header; h != "" {
+		if p, err := strconv.Atoi(r.Header.Get(h)); err == nil {
+			return p
+		}
+	}
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return l.priority.Routes[prefix]
+		}
+	}
+	return l.priority.Default
+}
+
+// retryAfter is the Retry-After seconds of a shed request, the queue timeout rounded up
+func (l *connLimiter) retryAfter() string {
+	return strconv.Itoa(int((l.queueTimeout + time.Second - 1) / time.Second))
+}
+
+// outranked returns true if a request of a higher priority than p is waiting, the lock should be held
+func (l *connLimiter) outranked(p int) bool {
+	for _, w := range l.waiting {
+		if w.priority > p {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue adds a waiter of priority p, shedding the newest of the lowest priority waiters
+// if the queue is full. It returns nil if p is not higher, the lock should be held
+func (l *connLimiter) enqueue(p int) *waiter {
+	if len(l.waiting) >= l.queueSize {
+		lowest := -1
+		for i, w := range l.waiting {
+			if lowest < 0 || w.priority <= l.waiting[lowest].priority {
+				lowest = i
+			}
+		}
+		if lowest < 0 || l.waiting[lowest].priority >= p {
+			return nil
+		}
+		close(l.waiting[lowest].shed)
+		l.waiting = append(l.waiting[:lowest], l.waiting[lowest+1:]...)
+	}
+	w := &waiter{priority: p, shed: make(chan struct{})}
+	l.waiting = append(l.waiting, w)
+	return w
+}
+
+// dequeue removes w if it is still waiting and wakes up the others, the lock should be held
+func (l *connLimiter) dequeue(w *waiter) {
+	for i := range l.waiting {
+		if l.waiting[i] == w {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			close(l.released)
+			l.released = make(chan struct{})
+			return
+		}
+	}
+}
+
+// tryAcquire takes a slot on a peer returned by pick, the lock should be held.
+// It returns false if saturated, and an empty peer if pick finds none
+func (l *connLimiter) tryAcquire(pick func() string, tries int) (string, bool) {
+	if max := l.poolLimit(); max > 0 && l.total >= max {
+		return "", false
+	}
+	for i := 0; i < tries; i++ {
+		peer := pick()
+		if peer == "" {
+			return "", true
+		}
+		if l.peerMax <= 0 || l.active[peer] < l.peerMax {
+			l.active[peer] += 1
+			l.total += 1
+			return peer, true
+		}
+	}
+	return "", false
+}
+
+// tryAcquirePeer takes a slot on peer if one is free and no request is waiting,
+// e.g. for a hedged request which is not worth waiting for
+func (l *connLimiter) tryAcquirePeer(peer string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.waiting) > 0 {
+		return false
+	}
+	_, ok := l.tryAcquire(func() string { return peer }, 1)
+	return ok
+}
+
+// acquire returns a peer with a free slot, tries is the number of picks before
+// considering all the peers saturated. The waiting requests of a higher priority
+// take the free slots first
+func (l *connLimiter) acquire(ctx context.Context, pick func() string, tries, priority int) (string, error) {
+	if tries < 1 {
+		tries = 1
+	}
+	var timer *time.Timer
+	var queued *waiter
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		if queued != nil {
+			l.Lock()
+			l.dequeue(queued)
+			l.Unlock()
+		}
+	}()
+
+	for {
+		l.Lock()
+		if !l.outranked(priority) {
+			peer, ok := l.tryAcquire(pick, tries)
+			if ok {
+				l.Unlock()
+				return peer, nil
+			}
+		}
+		if queued == nil {
+			if queued = l.enqueue(priority); queued == nil {
+				l.shedAt = time.Now()
+				l.Unlock()
+				return "", errSaturated
+			}
+			timer = time.NewTimer(l.queueTimeout)
+		}
+		released := l.released
+		l.Unlock()
+
+		select {
+		case <-released:
+		case <-queued.shed:
+			l.Lock()
+			l.shedAt = time.Now()
+			l.Unlock()
+			return "", errSaturated
+		case <-timer.C:
+			l.Lock()
+			l.shedAt = time.Now()
+			l.Unlock()
+			return "", errSaturated
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// shedding returns true if a request was rejected as saturated in the last window
+func (l *connLimiter) shedding(window time.Duration) bool {
+	l.Lock()
+	defer l.Unlock()
+	return !l.shedAt.IsZero() && time.Since(l.shedAt) < window
+}
+
+func (l *connLimiter) release(peer string) {
+	l.Lock()
+	defer l.Unlock()
+	l.total -= 1
+	if l.active[peer] -= 1; l.active[peer] <= 0 {
+		delete(l.active, peer)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
@@ -0,0 +1,162 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func alternate(peers ...string) func() string {
+	i := 0
+	return func() string {
+		peer := peers[i%len(peers)]
+		i += 1
+		return peer
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LimitOpt(1, 0, 1, 100*time.Millisecond))
+	require.NoError(t, err)
+	l := vs.limiter
+	pick := alternate("a", "b")
+	ctx := context.Background()
+
+	peer, err := l.acquire(ctx, pick, 2, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "a", peer)
+	peer, err = l.acquire(ctx, pick, 2, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "b", peer)
+
+	// waits in the queue until a slot is released
+	done := make(chan string)
+	go func() {
+		peer, err := l.acquire(ctx, pick, 2, 0)
+		assert.NoError(t, err)
+		done <- peer
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// the queue is full
+	_, err = l.acquire(ctx, pick, 2, 0)
+	assert.Equal(t, errSaturated, err)
+
+	l.release("b")
+	assert.Equal(t, "b", <-done)
+
+	// queue timeout
+	begin := time.Now()
+	_, err = l.acquire(ctx, pick, 2, 0)
+	assert.Equal(t, errSaturated, err)
+	assert.True(t, time.Since(begin) >= 100*time.Millisecond)
+
+	l.release("a")
+	l.release("b")
+	assert.Equal(t, 0, l.total)
+	assert.Empty(t, l.active)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LimitOpt(0, 0, 10, 0))
+	require.NoError(t, err)
+	assert.Nil(t, vs.limiter)
+}
+
+func TestPoolMaxConns(t *testing.T) {
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-unblock
+		w.Write([]byte("ok"))
+	}))
+	defer peer.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: peer.URL[7:], Weight: 1}}),
+		LimitOpt(0, 1, 0, 0),
+	)
+	require.NoError(t, err)
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		rr := httptest.NewRecorder()
+		vs.ServeHTTP(rr, req)
+		return rr
+	}
+	first := make(chan int)
+	go func() { first <- serve().Code }()
+	<-entered
+
+	rr := serve()
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	close(unblock)
+	assert.Equal(t, http.StatusOK, <-first)
+
+	go func() { <-entered }()
+	assert.Equal(t, http.StatusOK, serve().Code)
+}
+
+func TestPriorityQueue(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LimitOpt(0, 1, 1, time.Second),
+		PriorityOpt(config.Priority{
+			Header:  "X-Priority",
+			Routes:  map[string]int{"/api": 5, "/api/admin": 10},
+			Default: 1,
+		}))
+	require.NoError(t, err)
+	l := vs.limiter
+
+	priority := func(path, header string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if header != "" {
+			req.Header.Set("X-Priority", header)
+		}
+		return l.priorityOf(req)
+	}
+	assert.Equal(t, 1, priority("/", ""))
+	assert.Equal(t, 5, priority("/api/users", ""))
+	assert.Equal(t, 10, priority("/api/admin/users", ""))
+	assert.Equal(t, 3, priority("/api/admin/users", "3"))
+	assert.Equal(t, 5, priority("/api/users", "high"))
+
+	pick := alternate("a")
+	ctx := context.Background()
+	_, err = l.acquire(ctx, pick, 1, 0)
+	require.NoError(t, err)
+
+	low := make(chan error)
+	go func() {
+		_, err := l.acquire(ctx, pick, 1, 1)
+		low <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// the full queue keeps its request of the same priority
+	_, err = l.acquire(ctx, pick, 1, 1)
+	assert.Equal(t, errSaturated, err)
+	assert.True(t, l.shedding(time.Second))
+
+	// and sheds it for a higher one
+	high := make(chan error)
+	go func() {
+		_, err := l.acquire(ctx, pick, 1, 5)
+		high <- err
+	}()
+	assert.Equal(t, errSaturated, <-low)
+
+	l.release("a")
+	assert.NoError(t, <-high)
+	l.release("a")
+	assert.Equal(t, 0, l.total)
+	assert.Empty(t, l.waiting)
+	assert.Equal(t, "1", l.retryAfter())
+}
@@ -0,0 +1,246 @@
+package balancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listener is shared by the running virtual servers on the same address,
+// requests are dispatched by Host header, TLS handshakes by SNI
+type listener struct {
+	sync.RWMutex
+	address  string
+	protocol string
+	server   *http.Server
+	vservers []*VirtualServer
+
+	// client connections tracked for their age
+	conns_lock sync.Mutex
+	conns      map[net.Conn]*agedConn
+}
+
+var (
+	listeners      = make(map[string]*listener)
+	listeners_lock sync.Mutex
+)
+
+// listen registers vs to the listener of its address, and starts the listener if vs is the first one
+func listen(vs *VirtualServer) error {
+	listeners_lock.Lock()
+	defer listeners_lock.Unlock()
+
+	l, ok := listeners[vs.Address]
+	if ok {
+		return l.add(vs)
+	}
+
+	l = &listener{address: vs.Address, protocol: vs.Protocol, conns: make(map[net.Conn]*agedConn)}
+	if err := l.add(vs); err != nil {
+		return err
+	}
+	var lns []net.Listener
+	if vs.reusePort > 0 {
+		var err error
+		if lns, err = ListenReusePort(vs.Address, vs.reusePort); err != nil {
+			return err
+		}
+	} else {
+		ln, err := Listen(vs.Address)
+		if err != nil {
+			return err
+		}
+		lns = []net.Listener{ln}
+	}
+	l.server = &http.Server{Addr: vs.Address, Handler: l, ConnState: l.connState, ConnContext: l.connContext}
+	if vs.Protocol == PROTO_HTTPS {
+		l.server.TLSConfig = &tls.Config{
+			GetCertificate:     l.getCertificate,
+			GetConfigForClient: l.getConfigForClient,
+		}
+	}
+	listeners[vs.Address] = l
+
+	for _, ln := range lns {
+		ln, err := tuneListener(ln, vs.tcp)
+		if err != nil {
+			log.Errorf("%s tune listener error=%v", vs.Address, err)
+		}
+		go l.serve(guardedListener{ln})
+	}
+	return nil
+}
+
+// serve accepts the connections of ln, one of the sockets of l
+func (l *listener) serve(ln net.Listener) {
+	var err error
+	if l.protocol == PROTO_HTTPS {
+		err = l.server.ServeTLS(ln, "", "")
+	} else {
+		err = l.server.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Errorf("%s Serve error=%v", l.address, err)
+		listeners_lock.Lock()
+		if listeners[l.address] == l {
+			delete(listeners, l.address)
+		}
+		listeners_lock.Unlock()
+	}
+}
+
+// unlisten removes vs from the listener of its address, and shuts down the listener if vs is the last one,
+// waiting for its active connections until ctx is done
+func unlisten(ctx context.Context, vs *VirtualServer) error {
+	listeners_lock.Lock()
+	l, ok := listeners[vs.Address]
+	if !ok {
+		listeners_lock.Unlock()
+		return nil
+	}
+	if l.remove(vs) > 0 {
+		listeners_lock.Unlock()
+		return nil
+	}
+	delete(listeners, vs.Address)
+	listeners_lock.Unlock()
+
+	return l.server.Shutdown(ctx)
+}
+
+func (l *listener) add(vs *VirtualServer) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if vs.Protocol != l.protocol {
+		return fmt.Errorf("%s is listened with %s, not %s", l.address, l.protocol, vs.Protocol)
+	}
+	for _, v := range l.vservers {
+		if v.ServerName == vs.ServerName {
+			return fmt.Errorf("server name %s is used by %s on %s", vs.ServerName, v.Name, l.address)
+		}
+	}
+	if vs.Protocol == PROTO_HTTPS {
+		cfg, err := vs.serverTLSConfig()
+		if err != nil {
+			return err
+		}
+		vs.tlsConfig = cfg
+	}
+	l.vservers = append(l.vservers, vs)
+	return nil
+}
+
+// replace puts vs in place of old in the listener of their address, the listener is kept open,
+// false if old is not listened or vs can not share the listener
+func replace(old, vs *VirtualServer) (bool, error) {
+	if old.Address != vs.Address || old.Protocol != vs.Protocol {
+		return false, nil
+	}
+	listeners_lock.Lock()
+	defer listeners_lock.Unlock()
+
+	l, ok := listeners[vs.Address]
+	if !ok {
+		return false, nil
+	}
+	return l.replace(old, vs)
+}
+
+func (l *listener) replace(old, vs *VirtualServer) (bool, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	index := -1
+	for i, v := range l.vservers {
+		if v == old {
+			index = i
+		} else if v.ServerName == vs.ServerName {
+			return false, fmt.Errorf("server name %s is used by %s on %s", vs.ServerName, v.Name, l.address)
+		}
+	}
+	if index < 0 {
+		return false, nil
+	}
+	if vs.Protocol == PROTO_HTTPS {
+		cfg, err := vs.serverTLSConfig()
+		if err != nil {
+			return false, err
+		}
+		vs.tlsConfig = cfg
+	}
+	l.vservers[index] = vs
+	return true, nil
+}
+
+// remove returns the number of the remaining virtual servers
+func (l *listener) remove(vs *VirtualServer) int {
+	l.Lock()
+	defer l.Unlock()
+
+	for i, v := range l.vservers {
+		if v == vs {
+			l.vservers = append(l.vservers[:i], l.vservers[i+1:]...)
+			break
+		}
+	}
+	return len(l.vservers)
+}
+
+// find returns the virtual server serving host, if no one matches,
+// the only virtual server is returned to reject the request by itself
+func (l *listener) find(host string) *VirtualServer {
+	l.RLock()
+	defer l.RUnlock()
+
+	for _, vs := range l.vservers {
+		if vs.ServerName == host {
+			return vs
+		}
+	}
+	if len(l.vservers) == 1 {
+		return l.vservers[0]
+	}
+	return nil
+}
+
+func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if shedByGuard() {
+		writeShed(w)
+		return
+	}
+	vs := l.find(r.Host)
+	if vs == nil {
+		log.Errorf("Host not match, address=%s, host=%s", l.address, r.Host)
+		WriteError(w, ErrHostNotMatch)
+		return
+	}
+	vs.handler.ServeHTTP(l.withConnAge(w, r), r)
+}
+
+func (l *listener) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if vs := l.find(hello.ServerName); vs != nil {
+		return vs.tlsConfig, nil
+	}
+	// fall back to getCertificate
+	return nil, nil
+}
+
+func (l *listener) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if len(l.vservers) == 0 {
+		return nil, fmt.Errorf("no virtual server on %s", l.address)
+	}
+	cfg := l.vservers[0].tlsConfig
+	if cfg.GetCertificate != nil {
+		return cfg.GetCertificate(hello)
+	}
+	return &cfg.Certificates[0], nil
+}
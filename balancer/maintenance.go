@@ -0,0 +1,70 @@
+package balancer
+
+import (
+	"sort"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maintenance is the administrative state of a virtual server and of its peers, distinct from
+// the health: the peers in maintenance are sent no request but keep their configuration and stats
+type Maintenance struct {
+	// the virtual server responds 503 to all the requests, its listener is kept
+	Enabled bool     `json:"enabled"`
+	Peers   []string `json:"peers"`
+}
+
+// SetMaintenance puts s in maintenance, or back in service
+func (s *VirtualServer) SetMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.maintenance, v) == v {
+		return
+	}
+	log.WithFields(log.Fields{"event": "maintenance", "vs": s.Name}).Infof("Maintenance %v", on)
+}
+
+// InMaintenance returns true if s responds 503 to all the requests
+func (s *VirtualServer) InMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+// SetPeerMaintenance stops sending requests to peer, or resumes it unless it is down for another reason
+func (s *VirtualServer) SetPeerMaintenance(peer string, on bool) error {
+	if !s.hasPeer(peer) {
+		return ErrPeerNotInPool
+	}
+
+	s.pool_lock.Lock()
+	defer s.pool_lock.Unlock()
+	if s.maintained[peer] == on {
+		return nil
+	}
+	log.WithFields(log.Fields{"event": "maintenance", "vs": s.Name, "peer": peer}).Infof("Maintenance of peer %s %v", peer, on)
+	if on {
+		s.maintained[peer] = true
+		s.downPeer(peer, REASON_MAINTENANCE)
+		return nil
+	}
+	delete(s.maintained, peer)
+	if !s.heldDown(peer) && !s.failed(peer) {
+		s.upPeer(peer, REASON_MAINTENANCE)
+	}
+	return nil
+}
+
+// Maintenance returns the maintenance state of s and the peers in maintenance
+func (s *VirtualServer) Maintenance() Maintenance {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+
+	m := Maintenance{Enabled: s.InMaintenance(), Peers: []string{}}
+	for peer := range s.maintained {
+		m.Peers = append(m.Peers, peer)
+	}
+	sort.Strings(m.Peers)
+	return m
+}
@@ -0,0 +1,68 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestMaintenance(t *testing.T) {
+	peer1, peer2 := "127.0.0.1:10001", "127.0.0.1:10002"
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		ServerNameOpt("localhost"),
+		CriticalOpt(true),
+		PoolOpt([]config.Server{{Address: peer1, Weight: 1}, {Address: peer2, Weight: 1}}),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrPeerNotInPool, vs.SetPeerMaintenance("127.0.0.1:10003", true))
+	require.NoError(t, vs.SetPeerMaintenance(peer2, true))
+	assert.Equal(t, Maintenance{Peers: []string{peer2}}, vs.Maintenance())
+	// kept in the pool, not sent any request
+	assert.Equal(t, []string{peer1, peer2}, vs.Pool.Peers())
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, peer1, vs.Pool.Get(fmt.Sprintf("10.0.0.%d", i)))
+	}
+
+	// not put back by the end of a fault
+	require.NoError(t, vs.InjectFault(peer2, true, 0, MAX_FAULT_DURATION))
+	vs.ClearFault(peer2)
+	vs.pool_lock.RLock()
+	assert.True(t, vs.heldDown(peer2))
+	vs.pool_lock.RUnlock()
+
+	// nor out of maintenance while down for another reason
+	require.NoError(t, vs.InjectFault(peer2, true, 0, MAX_FAULT_DURATION))
+	require.NoError(t, vs.SetPeerMaintenance(peer2, false))
+	vs.pool_lock.RLock()
+	assert.True(t, vs.heldDown(peer2))
+	vs.pool_lock.RUnlock()
+	vs.ClearFault(peer2)
+	vs.pool_lock.RLock()
+	assert.False(t, vs.heldDown(peer2))
+	vs.pool_lock.RUnlock()
+	assert.Equal(t, Maintenance{Peers: []string{}}, vs.Maintenance())
+
+	vs.SetMaintenance(true)
+	assert.Equal(t, Maintenance{Enabled: true, Peers: []string{}}, vs.Maintenance())
+	// as if running
+	vs.statusSwitch(STATUS_ENABLED)
+	assert.Equal(t, "web is in maintenance", vs.unready())
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	w := httptest.NewRecorder()
+	vs.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), ErrMaintenance.ErrMsg)
+
+	vs.SetMaintenance(false)
+	assert.False(t, vs.InMaintenance())
+}
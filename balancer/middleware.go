@@ -0,0 +1,34 @@
+package balancer
+
+import (
+	"net/http"
+)
+
+// Middleware wraps the handler of a virtual server, e.g. to authenticate, log or rewrite
+// the requests. It may answer a request itself without calling next
+type Middleware func(next http.Handler) http.Handler
+
+// MiddlewareOpt registers middlewares on the virtual server, they are called in the order
+// registered, the first one first, across the options too. They run once per request, before
+// the rate limit, the debug trace, the SLA and the retries of the balancer, and the virtual
+// servers of the rules and the canary serve the requests passed by the middlewares of their parent.
+// Passed to New, they are registered on every virtual server, including the reloaded ones
+func MiddlewareOpt(mws ...Middleware) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		for _, mw := range mws {
+			if mw == nil {
+				return ErrNilMiddleware
+			}
+		}
+		vs.middlewares = append(vs.middlewares, mws...)
+		return nil
+	}
+}
+
+// chain wraps h with mws, the first one outermost
+func chain(h http.Handler, mws []Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
@@ -0,0 +1,74 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestMiddleware(t *testing.T) {
+	tries := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		w.Write([]byte(strings.Join(r.Header["X-Order"], ",")))
+	}))
+	defer peer.Close()
+
+	calls := 0
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				r.Header.Add("X-Order", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	c, err := config.LoadFromString(fmt.Sprintf(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8110",
+		"server_name":"localhost","pool":[{"address":"%s"}]}]}`, peer.URL[7:]))
+	require.NoError(t, err)
+	b, err := New(c.VServers, MiddlewareOpt(auth, mark("a")), MiddlewareOpt(mark("b")))
+	require.NoError(t, err)
+	vs, err := b.FindVirtualServer("web")
+	require.NoError(t, err)
+
+	serve := func(authorized bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		if authorized {
+			req.Header.Set("Authorization", "Bearer token")
+		}
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(false)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, 0, tries)
+
+	w = serve(true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "a,b", w.Body.String())
+	assert.Equal(t, 2, calls)
+
+	_, err = NewVirtualServer(NameOpt("web"), AddressOpt("127.0.0.1:8110"), MiddlewareOpt(nil))
+	assert.Equal(t, ErrNilMiddleware, err)
+}
@@ -0,0 +1,149 @@
+package balancer
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	DEFAULT_MIRROR_TIMEOUT = 5 * time.Second
+	// requests with a larger or unknown body are not mirrored
+	MIRROR_MAX_BODY = 1 << 20
+	// shadow requests in flight, the others are dropped
+	MIRROR_MAX_INFLIGHT = 100
+)
+
+// mirror sends a copy of a share of the requests to the pool of its own virtual server,
+// the shadow responses are discarded
+type mirror struct {
+	percent  float64
+	timeout  time.Duration
+	vs       *VirtualServer
+	inflight int64
+	mirrored uint64
+	dropped  uint64
+}
+
+// MirrorStats counts the shadow requests
+type MirrorStats struct {
+	Percent  float64 `json:"percent"`
+	Mirrored uint64  `json:"mirrored"`
+	// skipped for a large body or too many shadow requests in flight
+	Dropped    uint64              `json:"dropped"`
+	MirrorPool string              `json:"mirror_pool"`
+	Stats      *VirtualServerStats `json:"stats"`
+}
+
+// discardWriter is the response writer of the shadow requests
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
+
+// MirrorOpt mirrors c.Percent percent of the requests to the shadow pool asynchronously,
+// opts are applied to the virtual server of the shadow pool.
+// It should be called after NameOpt, AddressOpt and ServerNameOpt
+func MirrorOpt(c config.Mirror, opts ...VirtualServerOption) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if len(c.Pool) == 0 || c.Percent <= 0 {
+			return nil
+		}
+		mirrorOpts := []VirtualServerOption{
+			NameOpt(vs.Name + "/mirror"),
+			AddressOpt(vs.Address),
+			ServerNameOpt(vs.ServerName),
+			LBMethodOpt(c.LBMethod),
+			PoolOpt(c.Pool),
+		}
+		mvs, err := NewVirtualServer(append(mirrorOpts, opts...)...)
+		if err != nil {
+			return err
+		}
+		m := &mirror{
+			percent: c.Percent,
+			timeout: time.Duration(c.Timeout) * time.Millisecond,
+			vs:      mvs,
+		}
+		if m.timeout <= 0 {
+			m.timeout = DEFAULT_MIRROR_TIMEOUT
+		}
+		vs.mirror = m
+		return nil
+	}
+}
+
+// shadow sends a copy of r to the shadow pool if r is picked, the body of r is buffered
+// and r is returned with a fresh body
+func (m *mirror) shadow(r *http.Request) *http.Request {
+	if m.percent < 100 && rand.Float64()*100 >= m.percent {
+		return r
+	}
+	hasBody := r.Body != nil && r.Body != http.NoBody
+	if hasBody && (r.ContentLength < 0 || r.ContentLength > MIRROR_MAX_BODY) {
+		atomic.AddUint64(&m.dropped, 1)
+		return r
+	}
+	if atomic.AddInt64(&m.inflight, 1) > MIRROR_MAX_INFLIGHT {
+		atomic.AddInt64(&m.inflight, -1)
+		atomic.AddUint64(&m.dropped, 1)
+		return r
+	}
+
+	var body []byte
+	if hasBody {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			atomic.AddInt64(&m.inflight, -1)
+			atomic.AddUint64(&m.dropped, 1)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			return r
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	shadow := r.Clone(ctx)
+	if hasBody {
+		shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	atomic.AddUint64(&m.mirrored, 1)
+	go func() {
+		defer cancel()
+		defer atomic.AddInt64(&m.inflight, -1)
+		m.vs.ServeHTTP(&discardWriter{header: http.Header{}}, shadow)
+	}()
+	return r
+}
+
+// MirrorStats returns nil if the mirror is not configured
+func (s *VirtualServer) MirrorStats() *MirrorStats {
+	m := s.mirror
+	if m == nil {
+		return nil
+	}
+	return &MirrorStats{
+		Percent:    m.percent,
+		Mirrored:   atomic.LoadUint64(&m.mirrored),
+		Dropped:    atomic.LoadUint64(&m.dropped),
+		MirrorPool: m.vs.Pool.String(),
+		Stats:      m.vs.StatsReport(),
+	}
+}
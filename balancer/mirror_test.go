@@ -0,0 +1,71 @@
+package balancer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func echoHandler(label string, bodies chan string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if bodies != nil {
+			bodies <- string(body)
+		}
+		w.Write([]byte(label + " " + string(body)))
+	})
+}
+
+func TestMirror(t *testing.T) {
+	shadowBodies := make(chan string, 10)
+	primary := httptest.NewServer(echoHandler("primary", nil))
+	shadow := httptest.NewServer(echoHandler("shadow", shadowBodies))
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: primary.URL[7:], Weight: 1}}),
+		MirrorOpt(config.Mirror{Percent: 100, Pool: []config.Server{{Address: shadow.URL[7:], Weight: 1}}}),
+	)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("POST", "/orders", strings.NewReader("order-1"))
+	r.Host = "localhost"
+	w := httptest.NewRecorder()
+	vs.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "primary order-1", w.Body.String())
+
+	select {
+	case body := <-shadowBodies:
+		assert.Equal(t, "order-1", body)
+	case <-time.After(time.Second):
+		t.Fatal("the request is not mirrored")
+	}
+
+	// the body is too large to be buffered
+	r = httptest.NewRequest("POST", "/orders", strings.NewReader(strings.Repeat("x", MIRROR_MAX_BODY+1)))
+	r.Host = "localhost"
+	w = httptest.NewRecorder()
+	vs.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stats := vs.MirrorStats()
+	assert.Equal(t, uint64(1), stats.Mirrored)
+	assert.Equal(t, uint64(1), stats.Dropped)
+	assert.Equal(t, shadow.URL[7:], stats.MirrorPool)
+	assert.Equal(t, "web/mirror", stats.Stats.Name)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		MirrorOpt(config.Mirror{Pool: []config.Server{{Address: shadow.URL[7:], Weight: 1}}}))
+	require.NoError(t, err)
+	assert.Nil(t, vs.MirrorStats())
+}
@@ -0,0 +1,150 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OCSP_WATCH is the interval the OCSP file of the https listeners is checked for a new response
+var OCSP_WATCH = time.Minute
+
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// the subset of RFC 6960 needed to find the next update of a response
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []ocspSingleResponse
+	Extensions     []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID           asn1.RawValue
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspNextUpdate returns the next update of the DER OCSP response, the zero time if it has none
+func ocspNextUpdate(der []byte) (time.Time, error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return time.Time{}, err
+	}
+	if resp.Status != 0 {
+		return time.Time{}, fmt.Errorf("OCSP response status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return time.Time{}, fmt.Errorf("OCSP response type %v", resp.Response.ResponseType)
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return time.Time{}, err
+	}
+	if len(basic.TBSResponseData.Responses) != 1 {
+		return time.Time{}, fmt.Errorf("OCSP response of %d certificates", len(basic.TBSResponseData.Responses))
+	}
+	return basic.TBSResponseData.Responses[0].NextUpdate, nil
+}
+
+// ocspStaple is the certificate of a tlsPolicy with its OCSP response, stapled until the next update
+type ocspStaple struct {
+	cert       *tls.Certificate
+	stapled    *tls.Certificate
+	nextUpdate time.Time
+}
+
+// reloadOCSP reads the OCSP file again, the staple in use is kept on error
+func (p *tlsPolicy) reloadOCSP() error {
+	p.ocsp_lock.Lock()
+	defer p.ocsp_lock.Unlock()
+	return p.loadOCSP()
+}
+
+// loadOCSP staples the OCSP file to p.cert, should be called with ocsp_lock held
+func (p *tlsPolicy) loadOCSP() error {
+	info, err := os.Stat(p.conf.OCSPFile)
+	if err != nil {
+		return err
+	}
+	der, err := ioutil.ReadFile(p.conf.OCSPFile)
+	if err != nil {
+		return err
+	}
+	nextUpdate, err := ocspNextUpdate(der)
+	if err != nil {
+		return fmt.Errorf("%s: %v", p.conf.OCSPFile, err)
+	}
+	cert, stapled := p.cert, p.cert
+	stapled.OCSPStaple = der
+	p.staple.Store(&ocspStaple{cert: &cert, stapled: &stapled, nextUpdate: nextUpdate})
+	p.ocspMtime = info.ModTime()
+	return nil
+}
+
+// getCertificate returns the certificate with the OCSP response, without it past its next update
+func (p *tlsPolicy) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	staple := p.staple.Load().(*ocspStaple)
+	if !staple.nextUpdate.IsZero() && time.Now().After(staple.nextUpdate) {
+		return staple.cert, nil
+	}
+	return staple.stapled, nil
+}
+
+func (s *VirtualServer) ocspLoop(stop chan struct{}) {
+	p := s.tlsPolicy
+	ticker := time.NewTicker(OCSP_WATCH)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(p.conf.OCSPFile)
+			p.ocsp_lock.Lock()
+			unchanged := err != nil || info.ModTime().Equal(p.ocspMtime)
+			p.ocsp_lock.Unlock()
+			if unchanged {
+				continue
+			}
+			if err := p.reloadOCSP(); err != nil {
+				log.Errorf("[%s] reload OCSP response err=%v", s.Name, err)
+			} else {
+				log.Infof("[%s] reloaded OCSP response %s", s.Name, p.conf.OCSPFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+// ocspDER returns a good OCSP response, unsigned, with nextUpdate
+func ocspDER(t *testing.T, nextUpdate time.Time) []byte {
+	now := time.Now().UTC().Truncate(time.Second)
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData: ocspResponseData{
+			RawResponderID: asn1.RawValue{FullBytes: []byte{0xa2, 0x02, 0x04, 0x00}},
+			ProducedAt:     now,
+			Responses: []ocspSingleResponse{{
+				CertID:     asn1.RawValue{FullBytes: []byte{0x30, 0x00}},
+				Good:       true,
+				ThisUpdate: now,
+				NextUpdate: nextUpdate.UTC().Truncate(time.Second),
+			}},
+		},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}},
+		Signature:          asn1.BitString{Bytes: []byte{0}, BitLength: 8},
+	})
+	require.NoError(t, err)
+	der, err := asn1.Marshal(ocspResponse{Response: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basic}})
+	require.NoError(t, err)
+	return der
+}
+
+func TestOCSPNextUpdate(t *testing.T) {
+	next := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	nextUpdate, err := ocspNextUpdate(ocspDER(t, next))
+	require.NoError(t, err)
+	assert.True(t, next.Equal(nextUpdate))
+
+	nextUpdate, err = ocspNextUpdate(ocspDER(t, time.Time{}))
+	require.NoError(t, err)
+	assert.True(t, nextUpdate.IsZero())
+
+	_, err = ocspNextUpdate([]byte("staple"))
+	assert.Error(t, err)
+	// tryLater
+	_, err = ocspNextUpdate([]byte{0x30, 0x03, 0x0a, 0x01, 0x03})
+	assert.EqualError(t, err, "OCSP response status 3")
+}
+
+func TestOCSPReload(t *testing.T) {
+	defer func(watch time.Duration) { OCSP_WATCH = watch }(OCSP_WATCH)
+	OCSP_WATCH = 10 * time.Millisecond
+
+	f, err := ioutil.TempFile("", "ocsp.der")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.Close()
+	mtime := time.Now()
+	write := func(der []byte) {
+		require.NoError(t, ioutil.WriteFile(f.Name(), der, 0644))
+		mtime = mtime.Add(time.Second)
+		require.NoError(t, os.Chtimes(f.Name(), mtime, mtime))
+	}
+	first := ocspDER(t, time.Now().Add(time.Hour))
+	write(first)
+
+	vs, err := NewVirtualServer(
+		NameOpt("tls"),
+		AddressOpt("127.0.0.1:8443"),
+		ProtocolOpt(PROTO_HTTPS),
+		TLSOpt("../examples/https/server.pem", "../examples/https/server.key"),
+		TLSPolicyOpt(config.TLS{OCSPFile: f.Name()}),
+	)
+	require.NoError(t, err)
+	cfg, err := vs.serverTLSConfig()
+	require.NoError(t, err)
+	staple := func() []byte {
+		cc, sc := net.Pipe()
+		defer cc.Close()
+		defer sc.Close()
+		go tls.Server(sc, cfg).Handshake()
+		conn := tls.Client(cc, &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, conn.Handshake())
+		return conn.ConnectionState().OCSPResponse
+	}
+	assert.Equal(t, first, staple())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go vs.ocspLoop(stop)
+	eventually := func(expected []byte) {
+		for i := 0; i < 100 && string(staple()) != string(expected); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, expected, staple())
+	}
+	second := ocspDER(t, time.Now().Add(2*time.Hour))
+	write(second)
+	eventually(second)
+
+	// an invalid response is not stapled, the previous one is kept
+	write([]byte("staple"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, second, staple())
+
+	// a response past its next update is not stapled
+	write(ocspDER(t, time.Now().Add(-time.Second)))
+	eventually(nil)
+}
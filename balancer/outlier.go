@@ -0,0 +1,227 @@
+package balancer
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/stats"
+)
+
+const (
+	DEFAULT_OUTLIER_INTERVAL      = 10 * time.Second
+	DEFAULT_OUTLIER_EJECTION_TIME = 30 * time.Second
+	DEFAULT_OUTLIER_MIN_REQUESTS  = 5
+	DEFAULT_MAX_EJECTION_PERCENT  = 10
+)
+
+// outlierDetection ejects the peers whose 5xx rate or p99 latency in the last interval
+// is more than a factor of the mean of the pool
+type outlierDetection struct {
+	interval           time.Duration
+	errorFactor        float64
+	latencyFactor      float64
+	minRequests        uint64
+	maxEjectionPercent int
+	ejectionTime       time.Duration
+	// reports taken by the previous evaluation
+	prev map[string]*stats.Report
+}
+
+// Ejection is a peer taken out of the pool by outlier detection
+type Ejection struct {
+	Peer   string    `json:"address"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// OutlierOpt enables outlier detection if any factor is greater than 0,
+// complementing the consecutive failures counted by MaxFails
+func OutlierOpt(c config.OutlierDetection) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.ErrorFactor <= 0 && c.LatencyFactor <= 0 {
+			return nil
+		}
+		od := &outlierDetection{
+			interval:           time.Duration(c.Interval) * time.Second,
+			errorFactor:        c.ErrorFactor,
+			latencyFactor:      c.LatencyFactor,
+			minRequests:        c.MinRequests,
+			maxEjectionPercent: c.MaxEjectionPercent,
+			ejectionTime:       time.Duration(c.EjectionTime) * time.Second,
+			prev:               map[string]*stats.Report{},
+		}
+		if od.interval <= 0 {
+			od.interval = DEFAULT_OUTLIER_INTERVAL
+		}
+		if od.minRequests == 0 {
+			od.minRequests = DEFAULT_OUTLIER_MIN_REQUESTS
+		}
+		if od.maxEjectionPercent <= 0 || od.maxEjectionPercent > 100 {
+			od.maxEjectionPercent = DEFAULT_MAX_EJECTION_PERCENT
+		}
+		if od.ejectionTime <= 0 {
+			od.ejectionTime = DEFAULT_OUTLIER_EJECTION_TIME
+		}
+		vs.outlier = od
+		return nil
+	}
+}
+
+type peerSample struct {
+	peer      string
+	errorRate float64
+	p99       float64
+}
+
+// samples returns the error rate and p99 latency of the peers since the previous call
+func (s *VirtualServer) samples() []peerSample {
+	return s.peerSamples(s.outlier.prev, s.outlier.minRequests)
+}
+
+// peerSamples returns the error rate and p99 latency of the peers having at least
+// minRequests since the reports in prev, which are replaced by the current ones
+func (s *VirtualServer) peerSamples(prev map[string]*stats.Report, minRequests uint64) []peerSample {
+	s.ss_lock.RLock()
+	reports := make(map[string]*stats.Report, len(s.ServerStats))
+	for peer, st := range s.ServerStats {
+		if peer != LB_ERROR_PEER {
+			reports[peer] = st.Report()
+		}
+	}
+	s.ss_lock.RUnlock()
+
+	result := []peerSample{}
+	for peer, cur := range reports {
+		last := prev[peer]
+		prev[peer] = cur
+		if last != nil && last.Latency.Count > cur.Latency.Count {
+			// the stats were reset
+			last = nil
+		}
+		delta := cur.Sub(last)
+		if delta.Latency.Count < minRequests {
+			continue
+		}
+		var errors uint64
+		for code, n := range delta.StatusCode {
+			if strings.HasPrefix(code, "5") {
+				errors += n
+			}
+		}
+		p99 := delta.Latency.P99
+		if p99 == 0 {
+			// beyond the largest bucket, it is at least the bound
+			p99 = stats.LatencyBuckets[len(stats.LatencyBuckets)-1]
+		}
+		result = append(result, peerSample{
+			peer:      peer,
+			errorRate: float64(errors) / float64(delta.Latency.Count),
+			p99:       float64(p99),
+		})
+	}
+	for peer := range prev {
+		if _, ok := reports[peer]; !ok {
+			delete(prev, peer)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].peer < result[j].peer
+	})
+	return result
+}
+
+// detectOutliers ejects the outliers and brings back the peers whose ejection expired
+func (s *VirtualServer) detectOutliers() {
+	od := s.outlier
+	now := time.Now()
+
+	s.pool_lock.Lock()
+	for peer, e := range s.ejections {
+		if now.Before(e.Until) {
+			continue
+		}
+		delete(s.ejections, peer)
+		if !s.heldDown(peer) && !s.failed(peer) {
+			log.WithFields(log.Fields{"event": "outlier", "vs": s.Name, "peer": peer}).Infof("Peer %s is back from ejection", peer)
+			s.upPeer(peer, REASON_OUTLIER)
+		}
+	}
+	ejected := len(s.ejections)
+	s.pool_lock.Unlock()
+
+	samples := s.samples()
+	if len(samples) < 2 {
+		return
+	}
+	var errorSum, latencySum float64
+	for _, sample := range samples {
+		errorSum += sample.errorRate
+		latencySum += sample.p99
+	}
+	errorMean := errorSum / float64(len(samples))
+	latencyMean := latencySum / float64(len(samples))
+
+	maxEjected := s.Pool.Size() * od.maxEjectionPercent / 100
+	for _, sample := range samples {
+		reason := ""
+		if od.errorFactor > 0 && sample.errorRate > 0 && sample.errorRate > od.errorFactor*errorMean {
+			reason = "error rate"
+		} else if od.latencyFactor > 0 && sample.p99 > od.latencyFactor*latencyMean {
+			reason = "latency"
+		}
+		if reason == "" {
+			continue
+		}
+
+		s.pool_lock.Lock()
+		if _, ok := s.ejections[sample.peer]; ok {
+			s.pool_lock.Unlock()
+			continue
+		}
+		if ejected >= maxEjected {
+			s.pool_lock.Unlock()
+			log.Warnf("[%s] outlier %s not ejected, max ejection percent %d%% reached", s.Name, sample.peer, od.maxEjectionPercent)
+			continue
+		}
+		s.ejections[sample.peer] = &Ejection{Peer: sample.peer, Reason: reason, Until: now.Add(od.ejectionTime)}
+		s.downPeer(sample.peer, REASON_OUTLIER)
+		ejected += 1
+		s.pool_lock.Unlock()
+
+		log.WithFields(log.Fields{"event": "outlier", "vs": s.Name, "peer": sample.peer, "reason": reason}).
+			Warnf("Peer %s is ejected for %v, error rate %.2f (mean %.2f), p99 %.0fms (mean %.0fms)",
+				sample.peer, od.ejectionTime, sample.errorRate, errorMean, sample.p99, latencyMean)
+	}
+}
+
+func (s *VirtualServer) outlierLoop(stop chan struct{}) {
+	ticker := time.NewTicker(s.outlier.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.detectOutliers()
+		}
+	}
+}
+
+// Ejections returns the peers currently ejected by outlier detection
+func (s *VirtualServer) Ejections() []Ejection {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+
+	result := []Ejection{}
+	for _, e := range s.ejections {
+		result = append(result, *e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Peer < result[j].Peer
+	})
+	return result
+}
@@ -0,0 +1,91 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/stats"
+)
+
+func newOutlierVS(t *testing.T, maxEjectionPercent int) *VirtualServer {
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{
+			{Address: "127.0.0.1:10001", Weight: 1},
+			{Address: "127.0.0.1:10002", Weight: 1},
+			{Address: "127.0.0.1:10003", Weight: 1},
+			{Address: "127.0.0.1:10004", Weight: 1},
+		}),
+		OutlierOpt(config.OutlierDetection{ErrorFactor: 2, LatencyFactor: 2, MaxEjectionPercent: maxEjectionPercent}),
+	)
+	require.NoError(t, err)
+	return vs
+}
+
+func feed(vs *VirtualServer, peer string, n int, code string, latency time.Duration) {
+	if _, ok := vs.ServerStats[peer]; !ok {
+		vs.ServerStats[peer] = stats.New()
+	}
+	for i := 0; i < n; i++ {
+		vs.ServerStats[peer].Inc(&stats.Data{StatusCode: code, Method: "GET", Path: "/", Latency: latency})
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	vs := newOutlierVS(t, 50)
+	assert.Equal(t, DEFAULT_OUTLIER_INTERVAL, vs.outlier.interval)
+
+	feed(vs, "127.0.0.1:10001", 10, "200", 10*time.Millisecond)
+	feed(vs, "127.0.0.1:10002", 10, "200", 10*time.Millisecond)
+	feed(vs, "127.0.0.1:10003", 10, "200", time.Second)
+	feed(vs, "127.0.0.1:10004", 5, "200", 10*time.Millisecond)
+	feed(vs, "127.0.0.1:10004", 5, "502", 10*time.Millisecond)
+	// too few requests to be evaluated
+	feed(vs, LB_ERROR_PEER, 3, "502", 0)
+
+	vs.detectOutliers()
+	ejections := vs.Ejections()
+	require.Len(t, ejections, 2)
+	assert.Equal(t, "127.0.0.1:10003", ejections[0].Peer)
+	assert.Equal(t, "latency", ejections[0].Reason)
+	assert.Equal(t, "127.0.0.1:10004", ejections[1].Peer)
+	assert.Equal(t, "error rate", ejections[1].Reason)
+	for i := 0; i < 4; i++ {
+		peer := vs.Pool.Get()
+		assert.True(t, peer == "127.0.0.1:10001" || peer == "127.0.0.1:10002", peer)
+	}
+
+	// nothing new in the interval, the ejections expire
+	vs.pool_lock.Lock()
+	for _, e := range vs.ejections {
+		e.Until = time.Now().Add(-time.Second)
+	}
+	vs.pool_lock.Unlock()
+	vs.detectOutliers()
+	assert.Empty(t, vs.Ejections())
+	result := map[string]int{}
+	for i := 0; i < 4; i++ {
+		result[vs.Pool.Get()] += 1
+	}
+	assert.Equal(t, 4, len(result))
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	vs := newOutlierVS(t, 25)
+	feed(vs, "127.0.0.1:10001", 10, "200", 10*time.Millisecond)
+	feed(vs, "127.0.0.1:10002", 10, "200", 10*time.Millisecond)
+	feed(vs, "127.0.0.1:10003", 10, "200", time.Second)
+	feed(vs, "127.0.0.1:10004", 10, "503", 10*time.Millisecond)
+
+	vs.detectOutliers()
+	assert.Len(t, vs.Ejections(), 1)
+
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), OutlierOpt(config.OutlierDetection{}))
+	require.NoError(t, err)
+	assert.Nil(t, vs.outlier)
+}
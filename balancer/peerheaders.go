@@ -0,0 +1,62 @@
+package balancer
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// response headers naming the peer which served the request and its response time
+const (
+	UPSTREAM_ADDR_HEADER = "X-Upstream-Addr"
+	UPSTREAM_TIME_HEADER = "X-Upstream-Response-Time"
+)
+
+// PeerHeadersOpt adds the X-Upstream-Addr and X-Upstream-Response-Time headers to the responses,
+// the response time is in seconds with a millisecond resolution, until the response header
+func PeerHeadersOpt(enable bool) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.peerHeaders = enable
+		return nil
+	}
+}
+
+// setPeerHeaders sets the peer headers to h if enabled, d is the response time of peer
+func (s *VirtualServer) setPeerHeaders(h http.Header, peer string, d time.Duration) {
+	if !s.peerHeaders {
+		return
+	}
+	h.Set(UPSTREAM_ADDR_HEADER, peer)
+	h.Set(UPSTREAM_TIME_HEADER, fmt.Sprintf("%.3f", d.Seconds()))
+}
+
+// peerHeadersWriter sets the peer headers right before the status is written
+type peerHeadersWriter struct {
+	http.ResponseWriter
+	s     *VirtualServer
+	peer  string
+	start time.Time
+}
+
+func (w *peerHeadersWriter) WriteHeader(code int) {
+	w.s.setPeerHeaders(w.Header(), w.peer, time.Since(w.start))
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *peerHeadersWriter) Flush() {
+	flush(w.ResponseWriter)
+}
+
+func (w *peerHeadersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+// withPeerHeaders wraps rw if the peer headers are enabled
+func (s *VirtualServer) withPeerHeaders(rw http.ResponseWriter, peer string) http.ResponseWriter {
+	if !s.peerHeaders {
+		return rw
+	}
+	return &peerHeadersWriter{rw, s, peer, time.Now()}
+}
@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestPeerHeaders(t *testing.T) {
+	peer := func() *httptest.Server {
+		var s *httptest.Server
+		s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(s.URL[7:]))
+		}))
+		return s
+	}
+	a, b := peer(), peer()
+	defer a.Close()
+	defer b.Close()
+
+	newVS := func(enable bool) *VirtualServer {
+		vs, err := NewVirtualServer(
+			NameOpt("web"),
+			AddressOpt("127.0.0.1:80"),
+			ServerNameOpt("localhost"),
+			PoolOpt([]config.Server{{Address: a.URL[7:], Weight: 1}, {Address: b.URL[7:], Weight: 1}}),
+			RetryOpt(true),
+			PeerHeadersOpt(enable),
+		)
+		require.NoError(t, err)
+		return vs
+	}
+	serve := func(vs *VirtualServer) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+
+	vs := newVS(true)
+	served := map[string]int{}
+	for i := 0; i < 4; i++ {
+		w := serve(vs)
+		assert.Equal(t, w.Body.String(), w.Header().Get(UPSTREAM_ADDR_HEADER))
+		served[w.Header().Get(UPSTREAM_ADDR_HEADER)]++
+		d, err := strconv.ParseFloat(w.Header().Get(UPSTREAM_TIME_HEADER), 64)
+		assert.NoError(t, err)
+		assert.True(t, d >= 0 && d < 1)
+	}
+	assert.Equal(t, map[string]int{a.URL[7:]: 2, b.URL[7:]: 2}, served)
+	assert.True(t, vs.EffectiveConfig().PeerHeaders)
+
+	w := serve(newVS(false))
+	assert.Empty(t, w.Header().Get(UPSTREAM_ADDR_HEADER))
+	assert.Empty(t, w.Header().Get(UPSTREAM_TIME_HEADER))
+}
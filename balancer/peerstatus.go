@@ -0,0 +1,46 @@
+package balancer
+
+import (
+	"encoding/json"
+
+	"github.com/onestraw/golb/config"
+)
+
+// PeerStatus is a pool member with its state, the weight 0 ones are drained
+type PeerStatus struct {
+	config.Server
+	Down        bool `json:"down"`
+	Maintenance bool `json:"maintenance"`
+}
+
+// UnmarshalJSON decodes the state too, the one of config.Server being promoted would skip it
+func (p *PeerStatus) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.Server); err != nil {
+		return err
+	}
+	var state struct {
+		Down        bool `json:"down"`
+		Maintenance bool `json:"maintenance"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	p.Down, p.Maintenance = state.Down, state.Maintenance
+	return nil
+}
+
+// Peers returns the state of the pool members, sorted by address, see Members
+func (s *VirtualServer) Peers() []PeerStatus {
+	members := s.Members()
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+	result := make([]PeerStatus, 0, len(members))
+	for _, m := range members {
+		result = append(result, PeerStatus{
+			Server:      m,
+			Down:        s.down[m.Address],
+			Maintenance: s.maintained[m.Address],
+		})
+	}
+	return result
+}
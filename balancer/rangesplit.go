@@ -0,0 +1,279 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_RANGE_CONCURRENCY = 4
+	// attempts to fetch a chunk, on different peers if possible
+	RANGE_CHUNK_TRY = 2
+)
+
+// hopHeaders are not forwarded to the peers, refer to net/http/httputil
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RangeSplitOpt fetches the GET responses larger than chunkSize bytes in ranged
+// subrequests of chunkSize, sent in parallel to the peers of the pool, and reassembles
+// them for the client. 0 disables it. The peers should support range requests.
+func RangeSplitOpt(chunkSize int64, concurrency int) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if chunkSize < 0 {
+			return fmt.Errorf("Range split chunk size %d should not be negative", chunkSize)
+		}
+		if concurrency <= 0 {
+			concurrency = DEFAULT_RANGE_CONCURRENCY
+		}
+		vs.rangeChunkSize = chunkSize
+		vs.rangeConcurrency = concurrency
+		return nil
+	}
+}
+
+func (s *VirtualServer) rangeSplittable(r *http.Request) bool {
+	return s.rangeChunkSize > 0 && r.Method == http.MethodGet && r.Header.Get("Range") == "" &&
+		(r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0)
+}
+
+// parseContentRange parses "bytes <start>-<end>/<total>"
+func parseContentRange(h string) (start, end, total int64, ok bool) {
+	if !strings.HasPrefix(h, "bytes ") {
+		return
+	}
+	h = h[len("bytes "):]
+	slash := strings.Index(h, "/")
+	dash := strings.Index(h, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return
+	}
+	var err error
+	if start, err = strconv.ParseInt(h[:dash], 10, 64); err != nil {
+		return
+	}
+	if end, err = strconv.ParseInt(h[dash+1:slash], 10, 64); err != nil {
+		return
+	}
+	if total, err = strconv.ParseInt(h[slash+1:], 10, 64); err != nil {
+		return
+	}
+	return start, end, total, start <= end && end < total
+}
+
+// fetchRange sends r to peer asking for bytes [start, end]
+func (s *VirtualServer) fetchRange(ctx context.Context, r *http.Request, peer string, start, end int64) (*http.Response, error) {
+	s.rp_lock.RLock()
+	scheme, ok := s.schemes[peer]
+	s.rp_lock.RUnlock()
+	if !ok {
+		scheme = PROTO_HTTP
+	}
+	target, err := url.Parse(scheme + "://" + peerHost(peer) + r.URL.RequestURI())
+	if err != nil {
+		return nil, err
+	}
+
+	outreq := r.WithContext(ctx)
+	outreq.URL = target
+	outreq.RequestURI = ""
+	outreq.Header = http.Header{}
+	for k, v := range r.Header {
+		outreq.Header[k] = v
+	}
+	for _, h := range hopHeaders {
+		outreq.Header.Del(h)
+	}
+	outreq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	return s.roundTripper().RoundTrip(outreq)
+}
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// fetchChunk gets bytes [start, end] of the object identified by etag from any peer
+func (s *VirtualServer) fetchChunk(ctx context.Context, r *http.Request, primary, etag string, start, end int64) ([]byte, error) {
+	var lastErr error
+	for i := 0; i < RANGE_CHUNK_TRY; i++ {
+		peer := s.Pool.Get(s.hashKey(r))
+		if peer == "" {
+			peer = primary
+		}
+		s.injectLatency(peer, r)
+		resp, err := s.fetchRange(ctx, r, peer, start, end)
+		if err != nil {
+			lastErr = err
+			s.markOutcome(peer, 0, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		rs, re, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		switch {
+		case err != nil:
+			lastErr = err
+		case resp.StatusCode != http.StatusPartialContent || !ok || rs != start || re != end || int64(len(data)) != end-start+1:
+			lastErr = fmt.Errorf("peer %s responds %s, Content-Range %q", peer, resp.Status, resp.Header.Get("Content-Range"))
+		case etag != "" && resp.Header.Get("ETag") != etag:
+			lastErr = fmt.Errorf("peer %s returns a different version of the object", peer)
+		default:
+			s.markSuccess(peer)
+			return data, nil
+		}
+		if s.isFailure(resp.StatusCode, nil) {
+			s.markFail(peer)
+		}
+	}
+	return nil, lastErr
+}
+
+// splitRange serves r by ranged subrequests, it returns the peer of the first chunk
+func (s *VirtualServer) splitRange(rw http.ResponseWriter, r *http.Request, primary string) string {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// the object may be too large to buffer
+	noStore(r)
+
+	chunk := s.rangeChunkSize
+	s.injectLatency(primary, r)
+	start := time.Now()
+	resp, err := s.fetchRange(ctx, r, primary, 0, chunk-1)
+	if err != nil {
+		log.Errorf("Range request to peer=%s, error=%v", primary, err)
+		s.markOutcome(primary, 0, err)
+		s.writeError(rw, r, ErrBadGateway)
+		return primary
+	}
+	defer resp.Body.Close()
+	s.setPeerHeaders(rw.Header(), primary, time.Since(start))
+
+	_, end, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if resp.StatusCode != http.StatusPartialContent || !ok {
+		// the peer ignores range requests, pass the response through
+		s.markOutcome(primary, resp.StatusCode, nil)
+		for k, v := range resp.Header {
+			rw.Header()[k] = v
+		}
+		rw.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(rw, resp.Body); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		return primary
+	}
+
+	// the first chunk is read whole, so a failure is still answered by a 502
+	first, err := ioutil.ReadAll(resp.Body)
+	if err == nil && int64(len(first)) != end+1 {
+		err = fmt.Errorf("peer %s returns %d bytes of range 0-%d", primary, len(first), end)
+	}
+	if err != nil {
+		log.Errorf("Range request to peer=%s, error=%v", primary, err)
+		s.markOutcome(primary, 0, err)
+		s.writeError(rw, r, ErrBadGateway)
+		return primary
+	}
+	s.markOutcome(primary, resp.StatusCode, nil)
+
+	for k, v := range resp.Header {
+		rw.Header()[k] = v
+	}
+	rw.Header().Del("Content-Range")
+	rw.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+	// written when the second chunk is fetched too, or failed with a 502
+	writeHead := func() {
+		rw.WriteHeader(http.StatusOK)
+		if _, err := rw.Write(first); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	etag := resp.Header.Get("ETag")
+	n := int((total - end - 1 + chunk - 1) / chunk)
+	results := make([]chan *chunkResult, n)
+	for i := range results {
+		results[i] = make(chan *chunkResult, 1)
+	}
+	// limit the chunks in flight or buffered
+	sem := make(chan struct{}, s.rangeConcurrency)
+	go func() {
+		for i := 0; i < n; i++ {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			start := end + 1 + int64(i)*chunk
+			stop := start + chunk - 1
+			if stop >= total {
+				stop = total - 1
+			}
+			go func(i int, start, stop int64) {
+				data, err := s.fetchChunk(ctx, r, primary, etag, start, stop)
+				results[i] <- &chunkResult{data, err}
+			}(i, start, stop)
+		}
+	}()
+
+	if n == 0 {
+		writeHead()
+	}
+	for i := 0; i < n; i++ {
+		res := <-results[i]
+		<-sem
+		if res.err != nil && i == 0 {
+			log.Errorf("Range split %s%s failed, error=%v", r.Host, r.URL, res.err)
+			for k := range resp.Header {
+				rw.Header().Del(k)
+			}
+			s.writeError(rw, r, ErrBadGateway)
+			return primary
+		}
+		if res.err != nil {
+			// the status is already sent, abort the response
+			log.Errorf("Range split %s%s aborted, error=%v", r.Host, r.URL, res.err)
+			panic(http.ErrAbortHandler)
+		}
+		if i == 0 {
+			writeHead()
+		}
+		if _, err := rw.Write(res.data); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+	return primary
+}
+
+// withRangeSplit sends the split requests to s past next, e.g. the retry: the split
+// responses are streamed to the client, not buffered whole, and their chunks are retried
+// by fetchChunk
+func (s *VirtualServer) withRangeSplit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.rangeSplittable(r) {
+			s.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestRangeSplit(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	ranged := map[string]int{}
+	newPeer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") != "" {
+				ranged[name] += 1
+			}
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+		}))
+	}
+	p1 := newPeer("p1")
+	defer p1.Close()
+	p2 := newPeer("p2")
+	defer p2.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8088"),
+		PoolOpt([]config.Server{
+			{Address: p1.URL[7:], Weight: 1},
+			{Address: p2.URL[7:], Weight: 1},
+		}),
+		RangeSplitOpt(128, 1),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/file", nil)
+	req.Host = "localhost"
+	rr := httptest.NewRecorder()
+	vs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "1000", rr.Header().Get("Content-Length"))
+	assert.Empty(t, rr.Header().Get("Content-Range"))
+	assert.Equal(t, content, rr.Body.String())
+	assert.Equal(t, 8, ranged["p1"]+ranged["p2"])
+	assert.True(t, ranged["p1"] > 0 && ranged["p2"] > 0)
+
+	// the client's own range requests are proxied as is
+	req = httptest.NewRequest("GET", "/file", nil)
+	req.Host = "localhost"
+	req.Header.Set("Range", "bytes=10-19")
+	rr = httptest.NewRecorder()
+	vs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "0123456789", rr.Body.String())
+}
+
+func TestRangeSplitUnsupported(t *testing.T) {
+	peer := httptest.NewServer(newHandler("whole"))
+	defer peer.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8089"),
+		PoolOpt([]config.Server{{Address: peer.URL[7:], Weight: 1}}),
+		RangeSplitOpt(2, 0),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, DEFAULT_RANGE_CONCURRENCY, vs.rangeConcurrency)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	rr := httptest.NewRecorder()
+	vs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "whole", rr.Body.String())
+
+	// requests with a body are not split
+	req = httptest.NewRequest("GET", "/", bytes.NewReader([]byte("data")))
+	assert.False(t, vs.rangeSplittable(req))
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, end, total, ok := parseContentRange("bytes 0-127/1000")
+	assert.True(t, ok)
+	assert.Equal(t, []int64{0, 127, 1000}, []int64{start, end, total})
+
+	for _, h := range []string{"", "bytes */1000", "bytes 10-5/1000", "bytes 0-1000/1000", "items 0-1/2"} {
+		_, _, _, ok := parseContentRange(h)
+		assert.False(t, ok, h)
+	}
+}
+
+func TestRangeSplitFailure(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	var failFrom int64 = -1
+	var calls int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if f := atomic.LoadInt64(&failFrom); f >= 0 && r.Header.Get("Range") == fmt.Sprintf("bytes=%d-%d", f, f+127) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}))
+	defer peer.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8088"),
+		ServerNameOpt("localhost"),
+		PoolOpt([]config.Server{{Address: peer.URL[7:], Weight: 1}}),
+		RetryOpt(true),
+		CacheOpt(config.Cache{Enable: true, MaxEntrySize: 4096}),
+		RangeSplitOpt(128, 2),
+	)
+	require.NoError(t, err)
+	vs.MaxFails = 100
+	front := httptest.NewServer(vs.handler)
+	defer front.Close()
+	get := func() (*http.Response, string, error) {
+		req, err := http.NewRequest("GET", front.URL+"/file", nil)
+		require.NoError(t, err)
+		req.Host = "localhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp, string(body), err
+	}
+
+	resp, body, err := get()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, body)
+	// the split responses are neither cached nor retried whole
+	assert.Equal(t, 0, vs.CacheStats().Entries)
+	assert.Equal(t, int32(8), atomic.SwapInt32(&calls, 0))
+
+	// the second chunk fails before the status is sent
+	atomic.StoreInt64(&failFrom, 128)
+	resp, body, err = get()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.NotEqual(t, content[:128], body)
+
+	// a later chunk aborts the response
+	atomic.StoreInt64(&failFrom, 512)
+	_, _, err = get()
+	assert.Error(t, err)
+	assert.Equal(t, 0, vs.CacheStats().Entries)
+}
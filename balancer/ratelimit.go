@@ -0,0 +1,162 @@
+package balancer
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+// idle buckets are dropped at most once per RATE_LIMIT_SWEEP
+const RATE_LIMIT_SWEEP = time.Minute
+
+var (
+	rate_limit_lock sync.Mutex
+	// rate limiters by shared name
+	sharedLimiters = make(map[string]*rateLimiter)
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client IP
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time
+	// tokens taken by client since the last gossip, nil until a cluster gossips them
+	taken map[string]float64
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, buckets: make(map[string]*bucket), swept: time.Now()}
+}
+
+// RateLimitOpt limits the requests of every client IP by c, see config.RateLimit.
+// A shared limiter has the rate and burst of the virtual server configured last
+func RateLimitOpt(c config.RateLimit) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.Rate < 0 || c.Burst < 0 {
+			return ErrNegativeRateLimit
+		}
+		if c.Rate == 0 {
+			return nil
+		}
+		burst := float64(c.Burst)
+		if c.Burst == 0 {
+			burst = math.Max(1, c.Rate)
+		}
+		vs.rateLimit = c
+		if c.Shared == "" {
+			vs.rateLimiter = newRateLimiter(c.Rate, burst)
+			return nil
+		}
+
+		rate_limit_lock.Lock()
+		defer rate_limit_lock.Unlock()
+		l, ok := sharedLimiters[c.Shared]
+		if !ok {
+			l = newRateLimiter(c.Rate, burst)
+			sharedLimiters[c.Shared] = l
+		}
+		l.Lock()
+		if l.rate != c.Rate || l.burst != burst {
+			log.Warnf("[%s] sets the rate limit %q to %v/s, burst %v", vs.Name, c.Shared, c.Rate, burst)
+			l.rate, l.burst = c.Rate, burst
+		}
+		l.Unlock()
+		vs.rateLimiter = l
+		return nil
+	}
+}
+
+// take takes a token of client, or returns the time to wait for one
+func (l *rateLimiter) take(client string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.swept) >= RATE_LIMIT_SWEEP {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		if l.taken != nil {
+			l.taken[client]++
+		}
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets refilled by now, they are the same as new ones, l should be locked
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.swept = now
+}
+
+// drainTaken returns the tokens taken since the last call, and starts counting them on the first one
+func (l *rateLimiter) drainTaken() map[string]float64 {
+	l.Lock()
+	defer l.Unlock()
+	taken := l.taken
+	l.taken = make(map[string]float64)
+	return taken
+}
+
+// consume takes n tokens of client taken by another golb instance, the bucket is emptied at most
+func (l *rateLimiter) consume(client string, n float64, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	b.tokens = math.Max(0, b.tokens-n)
+}
+
+// clientIP returns the host of the remote address
+func clientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// withRateLimit responds 429 to the requests over the rate limit of the client,
+// the retries of a request are not counted
+func withRateLimit(next http.Handler, l *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientIP(r.RemoteAddr)
+		if ok, wait := l.take(client, time.Now()); !ok {
+			log.Warnf("%s - %s %s%s rate limited", r.RemoteAddr, r.Method, r.Host, r.URL)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			WriteError(w, ErrTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
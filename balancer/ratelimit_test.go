@@ -0,0 +1,80 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		ok, _ := l.take("10.0.0.1", now)
+		assert.True(t, ok)
+	}
+	ok, wait := l.take("10.0.0.1", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	// another client
+	ok, _ = l.take("10.0.0.2", now)
+	assert.True(t, ok)
+
+	ok, _ = l.take("10.0.0.1", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+
+	// the refilled buckets are dropped
+	l.sweep(now.Add(10 * time.Second))
+	assert.Empty(t, l.buckets)
+}
+
+func TestRateLimitShared(t *testing.T) {
+	s1 := httptest.NewServer(newHandler("s1"))
+	defer s1.Close()
+	defer func() {
+		rate_limit_lock.Lock()
+		delete(sharedLimiters, "clients")
+		rate_limit_lock.Unlock()
+	}()
+
+	newVS := func(name string) *VirtualServer {
+		vs, err := NewVirtualServer(
+			NameOpt(name),
+			AddressOpt("127.0.0.1:8112"),
+			PoolOpt([]config.Server{{Address: s1.URL[7:], Weight: 1}}),
+			RateLimitOpt(config.RateLimit{Rate: 0.01, Burst: 2, Shared: "clients"}),
+		)
+		require.NoError(t, err)
+		return vs
+	}
+	web, api := newVS("web"), newVS("api")
+	assert.True(t, web.rateLimiter == api.rateLimiter)
+	assert.Equal(t, config.RateLimit{Rate: 0.01, Burst: 2, Shared: "clients"}, web.EffectiveConfig().RateLimit)
+
+	serve := func(vs *VirtualServer, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, serve(web, "10.0.0.1:1000").Code)
+	assert.Equal(t, http.StatusOK, serve(api, "10.0.0.1:2000").Code)
+	w := serve(web, "10.0.0.1:3000")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "100", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, serve(web, "10.0.0.2:1000").Code)
+	assert.Equal(t, http.StatusOK, serve(api, "10.0.0.2:1000").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(api, "10.0.0.2:1000").Code)
+
+	_, err := NewVirtualServer(NameOpt("web"), AddressOpt("127.0.0.1:8112"),
+		RateLimitOpt(config.RateLimit{Rate: -1}))
+	assert.Equal(t, ErrNegativeRateLimit, err)
+}
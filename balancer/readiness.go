@@ -0,0 +1,77 @@
+package balancer
+
+import (
+	"fmt"
+	"time"
+)
+
+// SHED_WINDOW is how long a critical virtual server is unready after shedding a request
+const SHED_WINDOW = 10 * time.Second
+
+// CriticalOpt makes the balancer unready if the virtual server can not serve, see Balancer.Unready
+func CriticalOpt(critical bool) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.critical = critical
+		return nil
+	}
+}
+
+// availablePeers returns the number of the peers of the pool that may be selected, a peer
+// marked down by fails counts once its fail timeout is over, as it is marked up by the next request
+func (s *VirtualServer) availablePeers() int {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+
+	now := time.Now().Unix()
+	n := 0
+	for _, peer := range s.Pool.Peers() {
+		if s.heldDown(peer) {
+			continue
+		}
+		if s.failed(peer) && now-s.timeout[peer] < s.failTimeout(peer) {
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// unready returns why s can not serve, empty if it can
+func (s *VirtualServer) unready() string {
+	if s.Status() != STATUS_ENABLED {
+		return fmt.Sprintf("%s is %s", s.Name, s.Status())
+	}
+	if s.InMaintenance() {
+		return fmt.Sprintf("%s is in maintenance", s.Name)
+	}
+	if s.availablePeers() == 0 {
+		return fmt.Sprintf("%s has no healthy peer", s.Name)
+	}
+	if reason := s.warmingUp(); reason != "" {
+		return reason
+	}
+	if s.limiter != nil && s.limiter.shedding(SHED_WINDOW) {
+		return fmt.Sprintf("%s is shedding requests", s.Name)
+	}
+	return ""
+}
+
+// Unready returns why the balancer can not serve usefully, empty if ready: a critical
+// virtual server is not running, has no healthy peer, is warming up, or shed a request over
+// its limits in the last SHED_WINDOW. The other virtual servers are not checked.
+// The resource usage over the limits of the guardrails makes it unready too
+func (b *Balancer) Unready() []string {
+	b.RLock()
+	defer b.RUnlock()
+
+	reasons := append([]string{}, guardrailReasons()...)
+	for _, vs := range b.VServers {
+		if !vs.critical {
+			continue
+		}
+		if reason := vs.unready(); reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+	return reasons
+}
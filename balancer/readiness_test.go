@@ -0,0 +1,59 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnready(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("s1"))
+	}))
+	defer s1.Close()
+
+	b, err := New(loadVServers(t, `{"virtual_server":[
+		{"name":"web","address":"127.0.0.1:8114","critical":true,"pool":[{"address":"%s"}],
+			"limits":{"pool_max_conns":1}},
+		{"name":"api","address":"127.0.0.1:8115","pool":[{"address":"127.0.0.1:10001"}]}]}`, s1.URL[7:]))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web is stopped"}, b.Unready())
+	require.NoError(t, b.Run())
+	defer b.Stop()
+	assert.Empty(t, b.Unready())
+
+	web, _ := b.FindVirtualServer("web")
+	require.NoError(t, web.InjectFault(s1.URL[7:], true, 0, time.Minute))
+	assert.Equal(t, []string{"web has no healthy peer"}, b.Unready())
+	web.ClearFault(s1.URL[7:])
+	// not critical
+	api, _ := b.FindVirtualServer("api")
+	require.NoError(t, api.Stop())
+	assert.Empty(t, b.Unready())
+
+	done := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:8114/slow", nil)
+		req.Host = "localhost"
+		client := &http.Client{Transport: &http.Transport{}}
+		client.Do(req)
+		close(done)
+	}()
+	// the pool slot is taken by the slow request
+	<-started
+	resp, err := request("127.0.0.1:8114")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, []string{"web is shedding requests"}, b.Unready())
+	close(release)
+	<-done
+}
@@ -0,0 +1,385 @@
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	RELOAD_ADD    = "add"
+	RELOAD_UPDATE = "update"
+	RELOAD_REMOVE = "remove"
+
+	ROLLOUT_RUNNING = "running"
+	ROLLOUT_DONE    = "done"
+	// halted by a failed change or an error rate spike, the applied changes are reverted
+	ROLLOUT_ROLLED_BACK = "rolled_back"
+)
+
+// unit of config.Reload.Pause
+var reloadPauseUnit = time.Second
+
+// ReloadChange is a virtual server added, updated or removed by a reload
+type ReloadChange struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Batch  int    `json:"batch"`
+	// in effect, false before it is applied or after it is reverted
+	Applied bool `json:"applied"`
+
+	old *VirtualServer
+	vs  *VirtualServer
+	// whether old was running when the change was applied
+	enabled bool
+}
+
+// Rollout reports the progress of a reload
+type Rollout struct {
+	State   string         `json:"state"`
+	Changes []ReloadChange `json:"changes"`
+	Batches int            `json:"batches"`
+	// batches applied and watched without an error rate spike
+	Verified int       `json:"verified"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Updated  time.Time `json:"updated"`
+}
+
+// copy returns a snapshot of r without the virtual servers, reload_lock should be held
+func (r *Rollout) copy() *Rollout {
+	c := *r
+	c.Changes = make([]ReloadChange, len(r.Changes))
+	for i := range r.Changes {
+		ch := &r.Changes[i]
+		c.Changes[i] = ReloadChange{Name: ch.Name, Action: ch.Action, Batch: ch.Batch, Applied: ch.Applied}
+	}
+	return &c
+}
+
+// sameConfig returns true if the virtual server configured by conf needs no change for cvs
+func sameConfig(conf, cvs *config.VirtualServer) bool {
+	if conf == nil {
+		return false
+	}
+	a, _ := json.Marshal(conf)
+	b, _ := json.Marshal(cvs)
+	return string(a) == string(b)
+}
+
+// plan creates the virtual servers added or updated by vss, the ones not in vss are removed
+func (b *Balancer) plan(vss []config.VirtualServer) ([]ReloadChange, error) {
+	b.RLock()
+	current := append([]*VirtualServer{}, b.VServers...)
+	b.RUnlock()
+	byName := make(map[string]*VirtualServer, len(current))
+	for _, vs := range current {
+		byName[vs.Name] = vs
+	}
+
+	changes := []ReloadChange{}
+	seen := make(map[string]bool, len(vss))
+	for i := range vss {
+		cvs := &vss[i]
+		if seen[cvs.Name] {
+			return nil, ErrVirtualServerNameExisted
+		}
+		seen[cvs.Name] = true
+		old, ok := byName[cvs.Name]
+		if ok && sameConfig(old.conf, cvs) {
+			continue
+		}
+		vs, err := b.newVirtualServer(cvs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cvs.Name, err)
+		}
+		action := RELOAD_ADD
+		if ok {
+			action = RELOAD_UPDATE
+		}
+		changes = append(changes, ReloadChange{Name: cvs.Name, Action: action, old: old, vs: vs})
+	}
+	for _, vs := range current {
+		if !seen[vs.Name] {
+			changes = append(changes, ReloadChange{Name: vs.Name, Action: RELOAD_REMOVE, old: vs})
+		}
+	}
+	return changes, nil
+}
+
+// Reload applies the virtual servers of a reloaded configuration, the changed ones are rolled
+// out in the background by c, see config.Reload. The virtual servers added at runtime are removed
+// if not in vss, and nothing is applied if any virtual server of vss is invalid
+func (b *Balancer) Reload(vss []config.VirtualServer, c config.Reload) (*Rollout, error) {
+	b.reload_lock.Lock()
+	defer b.reload_lock.Unlock()
+
+	if b.rollout != nil && b.rollout.State == ROLLOUT_RUNNING {
+		return nil, ErrReloadInProgress
+	}
+	changes, err := b.plan(vss)
+	if err != nil {
+		return nil, err
+	}
+
+	size := c.BatchSize
+	if size <= 0 || size > len(changes) {
+		size = len(changes)
+	}
+	now := time.Now()
+	r := &Rollout{State: ROLLOUT_DONE, Changes: changes, Started: now, Updated: now}
+	if size > 0 {
+		for i := range changes {
+			changes[i].Batch = i/size + 1
+		}
+		r.State = ROLLOUT_RUNNING
+		r.Batches = (len(changes) + size - 1) / size
+	}
+	b.rollout = r
+	b.setConfigured(vss)
+
+	names := make([]string, len(changes))
+	for i, ch := range changes {
+		names[i] = ch.Action + " " + ch.Name
+	}
+	log.WithFields(log.Fields{"event": "reload"}).
+		Infof("Reloading %d virtual servers in %d batches: %s", len(changes), r.Batches, strings.Join(names, ", "))
+	if r.State == ROLLOUT_RUNNING {
+		go b.roll(r, c)
+	}
+	return r.copy(), nil
+}
+
+// Rollout returns the progress of the last reload, nil if none
+func (b *Balancer) Rollout() *Rollout {
+	b.reload_lock.Lock()
+	defer b.reload_lock.Unlock()
+	if b.rollout == nil {
+		return nil
+	}
+	return b.rollout.copy()
+}
+
+// roll applies the changes of r batch by batch, and reverts them if a batch fails
+func (b *Balancer) roll(r *Rollout, c config.Reload) {
+	pause := time.Duration(c.Pause) * reloadPauseUnit
+	for batch := 1; batch <= r.Batches; batch++ {
+		var err error
+		for i := range r.Changes {
+			ch := &r.Changes[i]
+			if ch.Batch != batch {
+				continue
+			}
+			if err = b.apply(ch); err != nil {
+				err = fmt.Errorf("%s %s: %v", ch.Action, ch.Name, err)
+				b.revert(ch)
+				break
+			}
+			b.reload_lock.Lock()
+			ch.Applied = true
+			r.Updated = time.Now()
+			b.reload_lock.Unlock()
+		}
+		if err == nil && pause > 0 {
+			time.Sleep(pause)
+			err = verifyBatch(r, batch, c)
+		}
+		if err != nil {
+			b.rollback(r, err)
+			return
+		}
+		log.WithFields(log.Fields{"event": "reload"}).Infof("Reload batch %d/%d is applied", batch, r.Batches)
+		b.reload_lock.Lock()
+		r.Verified = batch
+		r.Updated = time.Now()
+		b.reload_lock.Unlock()
+	}
+
+	b.reload_lock.Lock()
+	r.State = ROLLOUT_DONE
+	r.Updated = time.Now()
+	b.reload_lock.Unlock()
+}
+
+// rollback reverts the applied changes of r, the last applied first
+func (b *Balancer) rollback(r *Rollout, cause error) {
+	log.WithFields(log.Fields{"event": "reload"}).Warnf("Reload is halted, rolling back, err=%v", cause)
+	for i := len(r.Changes) - 1; i >= 0; i-- {
+		ch := &r.Changes[i]
+		if !ch.Applied {
+			continue
+		}
+		b.revert(ch)
+		b.reload_lock.Lock()
+		ch.Applied = false
+		b.reload_lock.Unlock()
+	}
+
+	b.reload_lock.Lock()
+	r.State = ROLLOUT_ROLLED_BACK
+	r.Error = cause.Error()
+	r.Updated = time.Now()
+	b.reload_lock.Unlock()
+}
+
+// verifyBatch returns an error if the virtual servers of batch served too many 5xx responses
+func verifyBatch(r *Rollout, batch int, c config.Reload) error {
+	if c.MaxErrorPercent <= 0 {
+		return nil
+	}
+	var requests, errors uint64
+	for _, ch := range r.Changes {
+		if ch.Batch == batch && ch.vs != nil {
+			n, e := ch.vs.requestErrors()
+			requests += n
+			errors += e
+		}
+	}
+	if requests == 0 || requests < c.MinRequests {
+		log.WithFields(log.Fields{"event": "reload"}).
+			Infof("Reload batch %d served %d requests, not checked", batch, requests)
+		return nil
+	}
+	percent := float64(errors) * 100 / float64(requests)
+	if percent > c.MaxErrorPercent {
+		return fmt.Errorf("batch %d error rate %.1f%% > %.1f%%", batch, percent, c.MaxErrorPercent)
+	}
+	return nil
+}
+
+// requestErrors returns the number of the requests served by s and the 5xx responses among them
+func (s *VirtualServer) requestErrors() (uint64, uint64) {
+	s.ss_lock.RLock()
+	defer s.ss_lock.RUnlock()
+
+	var requests, errors uint64
+	for _, ss := range s.ServerStats {
+		report := ss.Report()
+		requests += report.Latency.Count
+		for code, n := range report.StatusCode {
+			if strings.HasPrefix(code, "5") {
+				errors += n
+			}
+		}
+	}
+	return requests, errors
+}
+
+// apply puts ch in effect
+func (b *Balancer) apply(ch *ReloadChange) error {
+	switch ch.Action {
+	case RELOAD_ADD:
+		b.swap(nil, ch.vs)
+		return ch.vs.Run()
+	case RELOAD_UPDATE:
+		ch.enabled = ch.old.Status() == STATUS_ENABLED
+		if err := ch.vs.takeOver(ch.old); err != nil {
+			return err
+		}
+		b.swap(ch.old, ch.vs)
+	case RELOAD_REMOVE:
+		ch.enabled = ch.old.Status() == STATUS_ENABLED
+		if ch.enabled {
+			if err := ch.old.Stop(); err != nil {
+				return err
+			}
+		}
+		b.swap(ch.old, nil)
+	}
+	return nil
+}
+
+// revert puts back the virtual server replaced or removed by ch, partially applied or not
+func (b *Balancer) revert(ch *ReloadChange) {
+	var err error
+	switch ch.Action {
+	case RELOAD_ADD:
+		if ch.vs.Status() == STATUS_ENABLED {
+			err = ch.vs.Stop()
+		}
+		b.swap(ch.vs, nil)
+	case RELOAD_UPDATE:
+		if ch.vs.Status() == STATUS_ENABLED {
+			err = ch.old.takeOver(ch.vs)
+		} else if ch.enabled && ch.old.Status() != STATUS_ENABLED {
+			err = ch.old.Run()
+		}
+		b.swap(ch.vs, ch.old)
+	case RELOAD_REMOVE:
+		b.swap(nil, ch.old)
+		if ch.enabled && ch.old.Status() != STATUS_ENABLED {
+			err = ch.old.Run()
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"event": "reload"}).Errorf("Revert %s %s error=%v", ch.Action, ch.Name, err)
+	}
+}
+
+// swap puts to in place of from in b.VServers, from is removed if to is nil,
+// and to is appended if from is not found
+func (b *Balancer) swap(from, to *VirtualServer) {
+	b.Lock()
+	defer b.Unlock()
+
+	result := make([]*VirtualServer, 0, len(b.VServers)+1)
+	placed := to == nil
+	for _, v := range b.VServers {
+		if v == from || v == to {
+			if !placed {
+				result = append(result, to)
+				placed = true
+			}
+			continue
+		}
+		result = append(result, v)
+	}
+	if !placed {
+		result = append(result, to)
+	}
+	b.VServers = result
+}
+
+// takeOver runs s in place of old if old is running, the listener of their address is
+// kept open if they can share it
+func (s *VirtualServer) takeOver(old *VirtualServer) error {
+	if old.Status() != STATUS_ENABLED {
+		return nil
+	}
+	ok, err := replace(old, s)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := old.Stop(); err != nil {
+			return err
+		}
+		return s.Run()
+	}
+
+	log.Infof("Replacing [%s] on %s", old.Name, s.Address)
+	if old.stopLoops != nil {
+		close(old.stopLoops)
+		old.stopLoops = nil
+	}
+	old.statusSwitch(STATUS_DISABLED)
+	// serving without a break, the startup gate is kept open
+	old.pool_lock.RLock()
+	warmedUp := old.warmedUp
+	old.pool_lock.RUnlock()
+	s.resetWarmup()
+	if warmedUp {
+		s.pool_lock.Lock()
+		s.warmedUp = true
+		s.pool_lock.Unlock()
+	}
+	s.stopLoops = make(chan struct{})
+	s.startLoops(s.stopLoops)
+	s.statusSwitch(STATUS_ENABLED)
+	return nil
+}
@@ -0,0 +1,136 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+// waitRollout waits up to 2 seconds for the last reload of b to reach state
+func waitRollout(t *testing.T, b *Balancer, state string) *Rollout {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r := b.Rollout()
+		require.NotNil(t, r)
+		if r.State == state {
+			return r
+		}
+		require.True(t, time.Now().Before(deadline), "reload is %s, not %s", r.State, state)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func loadVServers(t *testing.T, format string, args ...interface{}) []config.VirtualServer {
+	c, err := config.LoadFromString(fmt.Sprintf(format, args...))
+	require.NoError(t, err)
+	return c.VServers
+}
+
+func TestReload(t *testing.T) {
+	s1 := httptest.NewServer(newHandler("s1"))
+	defer s1.Close()
+	s2 := httptest.NewServer(newHandler("s2"))
+	defer s2.Close()
+
+	b, err := New(loadVServers(t, `{"virtual_server":[
+		{"name":"web","address":"127.0.0.1:8103","pool":[{"address":"%s"}]},
+		{"name":"api","address":"127.0.0.1:8104","pool":[{"address":"%s"}]},
+		{"name":"old","address":"127.0.0.1:8105","pool":[{"address":"%s"}]}]}`,
+		s1.URL[7:], s1.URL[7:], s1.URL[7:]))
+	require.NoError(t, err)
+	require.NoError(t, b.Run())
+	defer b.Stop()
+	api, _ := b.FindVirtualServer("api")
+
+	vss := loadVServers(t, `{"virtual_server":[
+		{"name":"web","address":"127.0.0.1:8103","pool":[{"address":"%s"}]},
+		{"name":"api","address":"127.0.0.1:8104","pool":[{"address":"%s"}]},
+		{"name":"new","address":"127.0.0.1:8106","pool":[{"address":"%s"}]}]}`,
+		s2.URL[7:], s1.URL[7:], s2.URL[7:])
+	_, err = b.Reload(vss, config.Reload{BatchSize: 1})
+	require.NoError(t, err)
+	r := waitRollout(t, b, ROLLOUT_DONE)
+	assert.Equal(t, 3, r.Batches)
+	assert.Equal(t, 3, r.Verified)
+	require.Len(t, r.Changes, 3)
+	assert.Equal(t, ReloadChange{Name: "web", Action: RELOAD_UPDATE, Batch: 1, Applied: true}, r.Changes[0])
+	assert.Equal(t, ReloadChange{Name: "new", Action: RELOAD_ADD, Batch: 2, Applied: true}, r.Changes[1])
+	assert.Equal(t, ReloadChange{Name: "old", Action: RELOAD_REMOVE, Batch: 3, Applied: true}, r.Changes[2])
+
+	for addr, body := range map[string]string{"127.0.0.1:8103": "s2", "127.0.0.1:8104": "s1", "127.0.0.1:8106": "s2"} {
+		resp, err := request(addr)
+		require.NoError(t, err)
+		assert.Equal(t, body, resp.Body, addr)
+	}
+	_, err = request("127.0.0.1:8105")
+	assert.Error(t, err)
+	_, err = b.FindVirtualServer("old")
+	assert.Equal(t, ErrVirtualServerNotFound, err)
+	// unchanged
+	vs, _ := b.FindVirtualServer("api")
+	assert.True(t, vs == api)
+
+	r, err = b.Reload(vss, config.Reload{BatchSize: 1})
+	require.NoError(t, err)
+	assert.Equal(t, ROLLOUT_DONE, r.State)
+	assert.Empty(t, r.Changes)
+
+	// nothing is applied if a virtual server is invalid
+	_, err = b.Reload(loadVServers(t, `{"virtual_server":[
+		{"name":"web","address":"127.0.0.1:8103","rules":[{"path_regex":"("}]}]}`), config.Reload{})
+	assert.Error(t, err)
+	assert.Len(t, b.VServers, 3)
+}
+
+func TestReloadRollback(t *testing.T) {
+	reloadPauseUnit = 50 * time.Millisecond
+	defer func() { reloadPauseUnit = time.Second }()
+
+	s1 := httptest.NewServer(newHandler("s1"))
+	defer s1.Close()
+	s2 := httptest.NewServer(newHandler("s2"))
+	defer s2.Close()
+
+	b, err := New(loadVServers(t, `{"virtual_server":[
+		{"name":"web","address":"127.0.0.1:8107","pool":[{"address":"%s"}]},
+		{"name":"api","address":"127.0.0.1:8108","pool":[{"address":"%s"}]}]}`,
+		s1.URL[7:], s1.URL[7:]))
+	require.NoError(t, err)
+	require.NoError(t, b.Run())
+	defer b.Stop()
+
+	// the new pool of web is down
+	vss := loadVServers(t, `{"virtual_server":[
+		{"name":"web","address":"127.0.0.1:8107","pool":[{"address":"127.0.0.1:1"}]},
+		{"name":"api","address":"127.0.0.1:8108","pool":[{"address":"%s"}]}]}`,
+		s2.URL[7:])
+	c := config.Reload{BatchSize: 1, Pause: 4, MaxErrorPercent: 50, MinRequests: 2}
+	_, err = b.Reload(vss, c)
+	require.NoError(t, err)
+	_, err = b.Reload(vss, c)
+	assert.Equal(t, ErrReloadInProgress, err)
+
+	for i := 0; i < 3; i++ {
+		resp, err := request("127.0.0.1:8107")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	}
+	r := waitRollout(t, b, ROLLOUT_ROLLED_BACK)
+	assert.Equal(t, 0, r.Verified)
+	assert.Contains(t, r.Error, "batch 1")
+	assert.False(t, r.Changes[0].Applied)
+	assert.False(t, r.Changes[1].Applied)
+
+	for _, addr := range []string{"127.0.0.1:8107", "127.0.0.1:8108"} {
+		resp, err := request(addr)
+		require.NoError(t, err)
+		assert.Equal(t, "s1", resp.Body, addr)
+	}
+}
@@ -0,0 +1,164 @@
+package balancer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+const (
+	// the request bodies are sent to the peer as they are read, read whole in memory
+	// first, or in memory up to a threshold and in a temporary file above
+	BUFFERING_STREAM        = "stream"
+	BUFFERING_MEMORY        = "memory"
+	BUFFERING_SPOOL         = "spool"
+	DEFAULT_SPOOL_THRESHOLD = 1 << 20
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// requestBody bounds and buffers the request bodies
+type requestBody struct {
+	maxSize int64
+	config.RequestBuffering
+}
+
+// RequestBodyOpt answers 413 to the request bodies over maxSize bytes, 0 means unlimited,
+// and buffers them as configured by c, see config.RequestBuffering
+func RequestBodyOpt(maxSize int64, c config.RequestBuffering) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if maxSize < 0 || c.SpoolThreshold < 0 {
+			return ErrRequestBody
+		}
+		switch c.Mode {
+		case "":
+			c.Mode = BUFFERING_STREAM
+		case BUFFERING_STREAM, BUFFERING_MEMORY, BUFFERING_SPOOL:
+		default:
+			return ErrRequestBody
+		}
+		if c.Mode == BUFFERING_SPOOL && c.SpoolThreshold == 0 {
+			c.SpoolThreshold = DEFAULT_SPOOL_THRESHOLD
+		}
+		if maxSize == 0 && c.Mode == BUFFERING_STREAM {
+			return nil
+		}
+		vs.requestBody = &requestBody{maxSize: maxSize, RequestBuffering: c}
+		return nil
+	}
+}
+
+// limitedBody fails the reads beyond left bytes with errBodyTooLarge
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.left {
+		n, b.left = int(b.left), -1
+		return n, errBodyTooLarge
+	}
+	b.left -= int64(n)
+	return n, err
+}
+
+// buffer reads body whole, it returns a reader of the body at every call and
+// the function releasing the temporary file
+func (rb *requestBody) buffer(body io.Reader) (open func() io.ReadCloser, size int64, release func(), err error) {
+	var buf bytes.Buffer
+	limit := int64(-1)
+	if rb.Mode == BUFFERING_SPOOL {
+		limit = rb.SpoolThreshold
+	}
+	if limit < 0 {
+		_, err = buf.ReadFrom(body)
+	} else {
+		_, err = io.CopyN(&buf, body, limit+1)
+		if err == io.EOF {
+			err = nil
+		} else if err == nil {
+			return rb.spool(&buf, body)
+		}
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	data := buf.Bytes()
+	open = func() io.ReadCloser {
+		return ioutil.NopCloser(bytes.NewReader(data))
+	}
+	return open, int64(len(data)), func() {}, nil
+}
+
+// spool writes head and the rest of body to a temporary file, removed at once so
+// nothing is left behind by a crash, and closed by release
+func (rb *requestBody) spool(head *bytes.Buffer, body io.Reader) (func() io.ReadCloser, int64, func(), error) {
+	f, err := ioutil.TempFile(rb.TempDir, "golb-body-")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	os.Remove(f.Name())
+	size, err := io.Copy(f, io.MultiReader(head, body))
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, err
+	}
+	open := func() io.ReadCloser {
+		return ioutil.NopCloser(io.NewSectionReader(f, 0, size))
+	}
+	return open, size, func() { f.Close() }, nil
+}
+
+// withRequestBody rejects the request bodies over the size limit, and buffers them
+func (s *VirtualServer) withRequestBody(next http.Handler) http.Handler {
+	rb := s.requestBody
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if rb.maxSize > 0 {
+			if r.ContentLength > rb.maxSize {
+				w.Header().Set("Connection", "close")
+				s.writeError(w, r, ErrRequestEntityTooLarge)
+				return
+			}
+			r.Body = &limitedBody{ReadCloser: r.Body, left: rb.maxSize}
+		}
+		// a streamed body can not be replayed, so it is not retried, see retry.Retry
+		if rb.Mode != BUFFERING_STREAM {
+			open, size, release, err := rb.buffer(r.Body)
+			if err == errBodyTooLarge {
+				w.Header().Set("Connection", "close")
+				s.writeError(w, r, ErrRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				log.Errorf("[%s] buffer request body error=%v", s.Name, err)
+				s.writeError(w, r, ErrBadRequest)
+				return
+			}
+			defer release()
+			r.Body, r.ContentLength, r.TransferEncoding = open(), size, nil
+			r.GetBody = func() (io.ReadCloser, error) {
+				return open(), nil
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,217 @@
+package balancer
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/retry"
+)
+
+// chunked hides the length of the body from the request
+type chunked struct {
+	io.Reader
+}
+
+func TestRequestBody(t *testing.T) {
+	type received struct {
+		length int64
+		body   string
+	}
+	got := make(chan received, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/upload" {
+			return
+		}
+		// a streamed body cut at the limit never completes
+		if body, err := ioutil.ReadAll(r.Body); err == nil {
+			got <- received{r.ContentLength, string(body)}
+		}
+	}))
+	defer peer.Close()
+
+	dir, err := ioutil.TempDir("", "golb-body")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	serve := func(vs *VirtualServer, body io.Reader) int {
+		req := httptest.NewRequest("POST", "/upload", body)
+		req.Host = "localhost"
+		if _, ok := body.(chunked); ok {
+			req.ContentLength = -1
+		}
+		rr := httptest.NewRecorder()
+		vs.handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	for _, c := range []config.RequestBuffering{
+		{Mode: BUFFERING_STREAM},
+		{Mode: BUFFERING_MEMORY},
+		{Mode: BUFFERING_SPOOL, SpoolThreshold: 4, TempDir: dir},
+	} {
+		vs, err := NewVirtualServer(NameOpt("web"), AddressOpt("127.0.0.1:80"),
+			PoolOpt([]config.Server{{Address: peer.URL[7:], Weight: 1}}), RequestBodyOpt(10, c))
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, serve(vs, chunked{strings.NewReader("0123456789")}), c.Mode)
+		r := <-got
+		assert.Equal(t, "0123456789", r.body, c.Mode)
+		if c.Mode == BUFFERING_STREAM {
+			assert.Equal(t, int64(-1), r.length)
+		} else {
+			// the peer gets the length of a buffered body
+			assert.Equal(t, int64(10), r.length, c.Mode)
+		}
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, serve(vs, strings.NewReader("0123456789a")), c.Mode)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, serve(vs, chunked{strings.NewReader("0123456789a")}), c.Mode)
+		// the oversized body is not a failure of the peer
+		assert.Equal(t, 0, vs.fails[peer.URL[7:]], c.Mode)
+		select {
+		case r := <-got:
+			assert.Fail(t, "oversized body received", "%s: %v", c.Mode, r)
+		default:
+		}
+	}
+	// the spooled bodies leave no file behind
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt("127.0.0.1:80"), RequestBodyOpt(0, config.RequestBuffering{}))
+	require.NoError(t, err)
+	assert.Nil(t, vs.requestBody)
+	for _, c := range []config.RequestBuffering{{Mode: "disk"}, {SpoolThreshold: -1}} {
+		_, err = NewVirtualServer(NameOpt("web"), AddressOpt("127.0.0.1:80"), RequestBodyOpt(0, c))
+		assert.Equal(t, ErrRequestBody, err)
+	}
+	_, err = NewVirtualServer(NameOpt("web"), AddressOpt("127.0.0.1:80"), RequestBodyOpt(-1, config.RequestBuffering{}))
+	assert.Equal(t, ErrRequestBody, err)
+}
+
+func TestRequestBodyStreamed(t *testing.T) {
+	started := make(chan string, 1)
+	got := make(chan string, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := make([]byte, len("first,"))
+		if _, err := io.ReadFull(r.Body, first); err != nil {
+			return
+		}
+		started <- string(first)
+		// a body cut at the limit never completes
+		if rest, err := ioutil.ReadAll(r.Body); err == nil {
+			got <- string(first) + string(rest)
+		}
+	}))
+	defer peer.Close()
+
+	// the virtual servers of the configuration retry, a streamed body is not read before the proxy
+	vs, err := (&Balancer{}).newVirtualServer(&config.VirtualServer{
+		Name: "web", Address: "127.0.0.1:80", ServerName: "localhost",
+		Pool: []config.Server{{Address: peer.URL[7:], Weight: 1}}, MaxBodySize: 10,
+	})
+	require.NoError(t, err)
+	require.True(t, vs.retry)
+
+	serve := func(rest string) *httptest.ResponseRecorder {
+		body, w := io.Pipe()
+		req := httptest.NewRequest("POST", "/upload", body)
+		req.Host = "localhost"
+		req.ContentLength = -1
+		rr := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			vs.handler.ServeHTTP(rr, req)
+			close(done)
+		}()
+		w.Write([]byte("first,"))
+		// the peer gets the start of the body before the client has sent the rest
+		select {
+		case first := <-started:
+			assert.Equal(t, "first,", first)
+		case <-time.After(2 * time.Second):
+			t.Fatal("the body is not streamed")
+		}
+		w.Write([]byte(rest))
+		w.Close()
+		<-done
+		return rr
+	}
+	assert.Equal(t, http.StatusOK, serve("last").Code)
+	assert.Equal(t, "first,last", <-got)
+
+	rr := serve("0123456789")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Equal(t, "close", rr.Header().Get("Connection"))
+	assert.Equal(t, 0, vs.fails[peer.URL[7:]])
+	select {
+	case body := <-got:
+		assert.Fail(t, "oversized body received", "%s", body)
+	default:
+	}
+}
+
+// zeros reads zero bytes forever
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestRequestBodySpoolRetried(t *testing.T) {
+	const size = 32 << 20
+	var tries int
+	got := make(chan int64, retry.TRY)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		got <- n
+		if tries++; tries == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer peer.Close()
+
+	dir, err := ioutil.TempDir("", "golb-body")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := config.RequestBuffering{Mode: BUFFERING_SPOOL, SpoolThreshold: 1024, TempDir: dir}
+	vs, err := (&Balancer{}).newVirtualServer(&config.VirtualServer{
+		Name: "web", Address: "127.0.0.1:80", ServerName: "localhost",
+		Pool: []config.Server{{Address: peer.URL[7:], Weight: 1}}, RequestBuffering: c,
+	})
+	require.NoError(t, err)
+	require.True(t, vs.retry)
+
+	req := httptest.NewRequest("POST", "/upload", chunked{io.LimitReader(zeros{}, size)})
+	req.Host = "localhost"
+	req.ContentLength = -1
+	rr := httptest.NewRecorder()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	vs.handler.ServeHTTP(rr, req)
+	runtime.ReadMemStats(&after)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	// the failed try is replayed from the temporary file
+	assert.Equal(t, int64(size), <-got)
+	assert.Equal(t, int64(size), <-got)
+	// the body is never held whole in memory
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < size/4, "%d bytes allocated", after.TotalAlloc-before.TotalAlloc)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,84 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hostEntry is a pool member configured by host name, its addresses become the peers
+type hostEntry struct {
+	host   string
+	port   string
+	weight int
+	// resolved peers, address -> weight
+	known map[string]int
+}
+
+// ResolveOpt re-resolves the pool members configured by host name every interval,
+// each A/AAAA record becomes a peer. 0 disables it, the host name is then resolved
+// when dialing. Peers using https keep the host name for certificate verification.
+func ResolveOpt(interval time.Duration) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if interval < 0 {
+			interval = 0
+		}
+		vs.resolveInterval = interval
+		return nil
+	}
+}
+
+// addHostEntry records a pool member if its host is not an IP literal
+func (s *VirtualServer) addHostEntry(addr, scheme string, weight int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || isUnix(addr) || net.ParseIP(host) != nil || scheme == PROTO_HTTPS {
+		return
+	}
+	s.hostnames[addr] = &hostEntry{host: host, port: port, weight: weight, known: map[string]int{}}
+}
+
+// resolve updates the peers of every host name, the old peers are kept on failure
+func (s *VirtualServer) resolve() {
+	for addr, entry := range s.hostnames {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ips, err := s.resolver.LookupHost(ctx, entry.host)
+		cancel()
+		if err != nil || len(ips) == 0 {
+			log.Errorf("[%s] resolve %s err=%v", s.Name, entry.host, err)
+			continue
+		}
+		sort.Strings(ips)
+
+		desired := make(map[string]int, len(ips))
+		for _, ip := range ips {
+			if familyAllowed(net.ParseIP(ip), s.dial.Family) {
+				desired[net.JoinHostPort(ip, entry.port)] = entry.weight
+			}
+		}
+		if len(desired) == 0 {
+			log.Errorf("[%s] resolve %s: no %s address", s.Name, entry.host, s.dial.Family)
+			continue
+		}
+		if len(entry.known) == 0 {
+			// replace the unresolved member
+			s.Pool.Remove(addr)
+		}
+		s.SyncPeers("dns "+entry.host, entry.known, desired)
+	}
+}
+
+func (s *VirtualServer) resolveLoop(stop chan struct{}) {
+	ticker := time.NewTicker(s.resolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.resolve()
+		}
+	}
+}
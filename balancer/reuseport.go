@@ -0,0 +1,71 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ReusePortOpt opens n listener sockets on the address of the virtual server with SO_REUSEPORT,
+// the kernel spreads the connections between them, each accepted by its own goroutine, and
+// other processes may listen on the address with SO_REUSEPORT too. 0 means one socket without it.
+// The virtual servers sharing the address use the sockets of the first one started
+func ReusePortOpt(n int) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if n < 0 {
+			return ErrNegativeReusePort
+		}
+		vs.reusePort = n
+		return nil
+	}
+}
+
+// reusePortControl sets SO_REUSEPORT on the socket before it is bound
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// listenReusePort listens on address with SO_REUSEPORT
+func listenReusePort(address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// ListenReusePort returns n listeners of address with SO_REUSEPORT, each one is taken as
+// Listen does and passed on Upgrade, the inherited ones beyond n are closed.
+// The sockets are opened as many as possible, an error is returned if none is
+func ListenReusePort(address string, n int) ([]net.Listener, error) {
+	if isUnix(address) {
+		// a socket path is bound once
+		ln, err := Listen(address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	defer closeInherited(address)
+	first, err := listenAddress(address, true)
+	if err != nil {
+		return nil, err
+	}
+	lns := []net.Listener{first}
+	for i := 1; i < n; i++ {
+		ln, err := listenAddress(address, true)
+		if err != nil {
+			// e.g. the inherited socket is not SO_REUSEPORT
+			log.Errorf("%s listener %d/%d error=%v", address, i+1, n, err)
+			break
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
@@ -0,0 +1,103 @@
+package balancer
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestListenReusePort(t *testing.T) {
+	lns, err := ListenReusePort("127.0.0.1:8122", 3)
+	require.NoError(t, err)
+	require.Len(t, lns, 3)
+	for _, ln := range lns {
+		assert.Equal(t, "127.0.0.1:8122", ln.Addr().String())
+	}
+	// all passed on upgrade
+	handoff_lock.Lock()
+	assert.Len(t, opened["127.0.0.1:8122"], 3)
+	handoff_lock.Unlock()
+	// not SO_REUSEPORT
+	_, err = net.Listen("tcp", "127.0.0.1:8122")
+	assert.Error(t, err)
+	for _, ln := range lns {
+		require.NoError(t, ln.Close())
+	}
+}
+
+func TestListenReusePortInherited(t *testing.T) {
+	const addr = "127.0.0.1:8126"
+	lns, err := ListenReusePort(addr, 3)
+	require.NoError(t, err)
+	files := []*os.File{}
+	for _, ln := range lns {
+		f, err := ln.(*handoffListener).Listener.(*net.TCPListener).File()
+		require.NoError(t, err)
+		files = append(files, f)
+		// the socket is kept open by f, as by a parent process
+		require.NoError(t, ln.Close())
+	}
+	handoff_lock.Lock()
+	assert.NotContains(t, opened, addr)
+	err = inheritListeners([]string{addr, addr, addr}, files)
+	passed := inherited[addr]
+	handoff_lock.Unlock()
+	require.NoError(t, err)
+	defer func() { hasInherited = false }()
+	require.Len(t, passed, 3)
+
+	// each listener is taken once, the one beyond n is closed
+	lns, err = ListenReusePort(addr, 2)
+	require.NoError(t, err)
+	require.Len(t, lns, 2)
+	for i, ln := range lns {
+		assert.Equal(t, passed[i], ln.(*handoffListener).Listener)
+	}
+	handoff_lock.Lock()
+	assert.Empty(t, inherited)
+	assert.Len(t, opened[addr], 2)
+	handoff_lock.Unlock()
+	_, err = passed[2].Accept()
+	assert.Error(t, err)
+	for _, ln := range lns {
+		require.NoError(t, ln.Close())
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	_, err := NewVirtualServer(ReusePortOpt(-1))
+	assert.Equal(t, ErrNegativeReusePort, err)
+
+	s := httptest.NewServer(newHandler("s1"))
+	defer s.Close()
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8122"),
+		ServerNameOpt("localhost"),
+		ReusePortOpt(4),
+		PoolOpt([]config.Server{{Address: s.URL[7:], Weight: 1}}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, vs.Run())
+	defer vs.Stop()
+	assert.Equal(t, 4, vs.EffectiveConfig().ReusePort)
+
+	for i := 0; i < 8; i++ {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:8122/", nil)
+		require.NoError(t, err)
+		req.Host = "localhost"
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "s1", string(body))
+	}
+}
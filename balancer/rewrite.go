@@ -0,0 +1,92 @@
+package balancer
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+// urlRewrite replaces the matching part of the request URI, or redirects to it
+type urlRewrite struct {
+	regex       *regexp.Regexp
+	replacement string
+	redirect    int
+}
+
+// RewritesOpt rewrites the URI of the requests sent to the pool, or redirects them,
+// by the first matching rewrite
+func RewritesOpt(rewrites []config.Rewrite) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		for _, c := range rewrites {
+			switch c.Redirect {
+			case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+				http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			default:
+				return ErrRedirectCode
+			}
+			re, err := regexp.Compile(c.Regex)
+			if err != nil {
+				return err
+			}
+			vs.rewrites = append(vs.rewrites, &urlRewrite{
+				regex:       re,
+				replacement: c.Replacement,
+				redirect:    c.Redirect,
+			})
+		}
+		return nil
+	}
+}
+
+// replace returns the URI of r replaced, false if it does not match
+func (rw *urlRewrite) replace(r *http.Request) (string, bool) {
+	uri := r.URL.RequestURI()
+	if !rw.regex.MatchString(uri) {
+		return "", false
+	}
+	scheme := PROTO_HTTP
+	if r.TLS != nil {
+		scheme = PROTO_HTTPS
+	}
+	repl := strings.NewReplacer("{host}", r.Host, "{scheme}", scheme).Replace(rw.replacement)
+	return rw.regex.ReplaceAllString(uri, repl), true
+}
+
+// applyRewrites returns r with the URI rewritten, or the location and status code
+// to redirect r to
+func (s *VirtualServer) applyRewrites(r *http.Request) (*http.Request, string, int) {
+	for _, rw := range s.rewrites {
+		uri, ok := rw.replace(r)
+		if !ok {
+			continue
+		}
+		if rw.redirect != 0 {
+			return r, uri, rw.redirect
+		}
+		u, err := url.ParseRequestURI(uri)
+		if err != nil {
+			log.Errorf("[%s] rewrite %s to %s, err=%v", s.Name, r.URL.RequestURI(), uri, err)
+			return r, "", 0
+		}
+		outURL := *r.URL
+		outURL.Path = u.Path
+		outURL.RawPath = u.RawPath
+		outURL.RawQuery = u.RawQuery
+		outreq := r.WithContext(r.Context())
+		outreq.URL = &outURL
+		return outreq, "", 0
+	}
+	return r, "", 0
+}
+
+// redirect responds code with location
+func redirect(w http.ResponseWriter, r *http.Request, location string, code int) {
+	log.Infof("%s - %s %s%s %s redirect %d %s", r.RemoteAddr, r.Method, r.Host, r.URL, r.Proto, code, location)
+	w.Header().Set("Location", location)
+	w.WriteHeader(code)
+}
@@ -0,0 +1,72 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestRewrites(t *testing.T) {
+	web := httptest.NewServer(pathHandler("web"))
+	api := httptest.NewServer(pathHandler("api"))
+	defer web.Close()
+	defer api.Close()
+	jsonBody := fmt.Sprintf(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8101",
+		"pool":[{"address":"%s"}],
+		"rewrites":[
+			{"regex":"^/old/(?P<rest>.*)$","replacement":"{scheme}://{host}/new/${rest}","redirect":301},
+			{"regex":"^/blog/([0-9]+)$","replacement":"/posts?id=$1"},
+			{"regex":"^/v1/","replacement":"/api/v2/"}],
+		"rules":[{"path_prefix":"/api/","strip_prefix":true,"pool":[{"address":"%s"}]}]}]}`,
+		web.URL[7:], api.URL[7:])
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := New(c.VServers)
+	require.NoError(t, err)
+	vs := b.VServers[0]
+	require.Len(t, vs.rewrites, 3)
+
+	tests := []struct {
+		path     string
+		code     int
+		body     string
+		location string
+	}{
+		{"/index.html", 200, "web /index.html", ""},
+		{"/old/a/b?x=1", 301, "", "http://localhost/new/a/b?x=1"},
+		{"/blog/42", 200, "web /posts?id=42", ""},
+		{"/blog/latest", 200, "web /blog/latest", ""},
+		// the rules match the rewritten path
+		{"/v1/users?id=1", 200, "api /v2/users?id=1", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Host = "localhost"
+		rr := httptest.NewRecorder()
+		vs.ServeHTTP(rr, r)
+		assert.Equal(t, tt.code, rr.Code, tt.path)
+		assert.Equal(t, tt.body, rr.Body.String(), tt.path)
+		assert.Equal(t, tt.location, rr.Header().Get("Location"), tt.path)
+	}
+
+	result, err := b.Route(&RouteRequest{Host: "localhost", Path: "/old/x"})
+	require.NoError(t, err)
+	assert.Equal(t, ROUTE_REDIRECT, result.Route)
+	assert.Equal(t, "http://localhost/new/x", result.Location)
+	result, err = b.Route(&RouteRequest{Host: "localhost", Path: "/blog/7"})
+	require.NoError(t, err)
+	assert.Equal(t, ROUTE_PROXY, result.Route)
+	assert.Equal(t, "/posts", result.Path)
+
+	_, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		RewritesOpt([]config.Rewrite{{Regex: "^/", Replacement: "/x", Redirect: 200}}))
+	assert.Equal(t, ErrRedirectCode, err)
+	_, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		RewritesOpt([]config.Rewrite{{Regex: "(", Replacement: "/x"}}))
+	assert.NotNil(t, err)
+}
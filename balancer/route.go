@@ -0,0 +1,159 @@
+package balancer
+
+import (
+	"net/http"
+)
+
+const (
+	ROUTE_PROXY       = "proxy"
+	ROUTE_HEDGE       = "hedge"
+	ROUTE_RANGE_SPLIT = "range_split"
+	ROUTE_REDIRECT    = "redirect"
+)
+
+// RouteRequest describes a synthetic request for a routing dry-run
+type RouteRequest struct {
+	Method string `json:"method"`
+	// listening address of the virtual server, empty matches any
+	Address string            `json:"address"`
+	Host    string            `json:"host"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+}
+
+// RouteResult reports how a request would be handled, no traffic is sent
+type RouteResult struct {
+	VirtualServer string `json:"virtual_server"`
+	Address       string `json:"address"`
+	Status        string `json:"status"`
+	// handlers applied in order before the route
+	Middleware []string `json:"middleware"`
+	// name of the matching rule or canary, empty if the pool of the virtual server is used
+	Rule string `json:"rule,omitempty"`
+	// path sent to the pool
+	Path  string `json:"path"`
+	Route string `json:"route"`
+	// where the request is redirected to
+	Location string `json:"location,omitempty"`
+	LBMethod string `json:"lb_method"`
+	Pool     string `json:"pool"`
+	// derived from the latency SLA of the virtual server or of the rule
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+	// why the request would be rejected
+	Error string `json:"error,omitempty"`
+}
+
+func (rr *RouteRequest) request() (*http.Request, error) {
+	method := rr.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := rr.Path
+	if path == "" {
+		path = "/"
+	}
+	r, err := http.NewRequest(method, "http://"+rr.Host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Host = rr.Host
+	for k, v := range rr.Headers {
+		r.Header.Set(k, v)
+	}
+	return r, nil
+}
+
+// Route reports which virtual server and pool would serve rr
+func (b *Balancer) Route(rr *RouteRequest) (*RouteResult, error) {
+	r, err := rr.request()
+	if err != nil {
+		return nil, err
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+	var candidate *VirtualServer
+	for _, vs := range b.VServers {
+		if rr.Address != "" && vs.Address != rr.Address {
+			continue
+		}
+		if vs.ServerName == r.Host {
+			return vs.route(r), nil
+		}
+		if candidate == nil {
+			candidate = vs
+		}
+	}
+	// the listener matches, but the virtual server rejects the host
+	if rr.Address != "" && candidate != nil {
+		return candidate.route(r), nil
+	}
+	return nil, ErrRouteNotFound
+}
+
+func (s *VirtualServer) route(r *http.Request) *RouteResult {
+	s.RLock()
+	defer s.RUnlock()
+
+	result := &RouteResult{
+		VirtualServer: s.Name,
+		Address:       s.Address,
+		Status:        s.Status(),
+		Middleware:    []string{},
+	}
+	if s.retry {
+		result.Middleware = append(result.Middleware, "retry")
+	}
+
+	var location string
+	var code int
+	if r, location, code = s.applyRewrites(r); code != 0 {
+		result.Path = r.URL.Path
+		result.Route = ROUTE_REDIRECT
+		result.Location = location
+		return result
+	}
+
+	// the virtual server of the matching rule serves the request
+	target := s
+	if ru := s.matchRule(r); ru != nil {
+		target = ru.vs
+		r = ru.rewrite(r)
+		result.Rule = target.Name
+		target.RLock()
+		defer target.RUnlock()
+	} else if s.canary != nil && s.canary.match(r) {
+		// the requests split by percent are reported to the primary pool
+		target = s.canary.vs
+		result.Rule = target.Name
+		target.RLock()
+		defer target.RUnlock()
+	}
+	result.Path = r.URL.Path
+	result.Timeouts = target.Timeouts()
+	result.LBMethod = target.LBMethod
+	result.Pool = target.Pool.String()
+
+	result.Middleware = append(result.Middleware, "stats")
+	target.pool_lock.RLock()
+	if len(target.faults) > 0 {
+		result.Middleware = append(result.Middleware, "fault")
+	}
+	target.pool_lock.RUnlock()
+
+	switch {
+	case target.rangeSplittable(r):
+		result.Route = ROUTE_RANGE_SPLIT
+	case target.hedgeable(r):
+		result.Route = ROUTE_HEDGE
+	default:
+		result.Route = ROUTE_PROXY
+	}
+
+	if r.Host != s.ServerName {
+		result.Error = ErrHostNotMatch.ErrMsg
+	} else if target.Pool.Size() == 0 {
+		result.Error = ErrPeerNotFound.ErrMsg
+	}
+	return result
+}
@@ -0,0 +1,114 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/onestraw/golb/config"
+)
+
+// rule routes the matching requests to the pool of its own virtual server,
+// which is never listened and shares the background loops of its owner
+type rule struct {
+	pathPrefix  string
+	pathRegex   *regexp.Regexp
+	methods     map[string]bool
+	headers     map[string]string
+	vars        map[string]string
+	stripPrefix bool
+	vs          *VirtualServer
+}
+
+// RulesOpt routes the requests by path prefix or regex, method, headers and variables to the pools
+// of rules, the first matching rule wins and the pool of vs serves the others.
+// opts are applied to the virtual servers of the rules.
+// It should be called after NameOpt, AddressOpt and ServerNameOpt
+func RulesOpt(rules []config.Rule, opts ...VirtualServerOption) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		for i, c := range rules {
+			ru := &rule{
+				pathPrefix:  c.PathPrefix,
+				methods:     make(map[string]bool),
+				headers:     c.Headers,
+				vars:        c.Vars,
+				stripPrefix: c.StripPrefix,
+			}
+			if c.PathRegex != "" {
+				re, err := regexp.Compile(c.PathRegex)
+				if err != nil {
+					return err
+				}
+				ru.pathRegex = re
+			}
+			for _, m := range c.Methods {
+				ru.methods[strings.ToUpper(m)] = true
+			}
+			ruleOpts := []VirtualServerOption{
+				NameOpt(fmt.Sprintf("%s/rule%d", vs.Name, i)),
+				AddressOpt(vs.Address),
+				ServerNameOpt(vs.ServerName),
+				LBMethodOpt(c.LBMethod),
+				PoolOpt(c.Pool),
+			}
+			ruleOpts = append(ruleOpts, opts...)
+			rvs, err := NewVirtualServer(append(ruleOpts, SLAOpt(c.SLA))...)
+			if err != nil {
+				return err
+			}
+			ru.vs = rvs
+			vs.rules = append(vs.rules, ru)
+		}
+		return nil
+	}
+}
+
+func (ru *rule) match(r *http.Request) bool {
+	if ru.pathPrefix != "" && !strings.HasPrefix(r.URL.Path, ru.pathPrefix) {
+		return false
+	}
+	if ru.pathRegex != nil && !ru.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(ru.methods) > 0 && !ru.methods[r.Method] {
+		return false
+	}
+	for k, v := range ru.headers {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	for template, v := range ru.vars {
+		if expandVars(template, r) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// rewrite returns the request sent to the pool of the rule
+func (ru *rule) rewrite(r *http.Request) *http.Request {
+	if !ru.stripPrefix || ru.pathPrefix == "" {
+		return r
+	}
+	u := *r.URL
+	u.Path = strings.TrimPrefix(u.Path, ru.pathPrefix)
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	u.RawPath = ""
+	outreq := r.WithContext(r.Context())
+	outreq.URL = &u
+	return outreq
+}
+
+// matchRule returns the first rule matching r, nil if none
+func (s *VirtualServer) matchRule(r *http.Request) *rule {
+	for _, ru := range s.rules {
+		if ru.match(r) {
+			return ru
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func pathHandler(label string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(label + " " + r.URL.RequestURI()))
+	})
+}
+
+func TestRules(t *testing.T) {
+	web := httptest.NewServer(pathHandler("web"))
+	api := httptest.NewServer(pathHandler("api"))
+	static := httptest.NewServer(pathHandler("static"))
+	v2 := httptest.NewServer(pathHandler("v2"))
+	jsonBody := fmt.Sprintf(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8095",
+		"pool":[{"address":"%s"}],
+		"rules":[
+			{"path_prefix":"/api/","strip_prefix":true,"pool":[{"address":"%s"}]},
+			{"path_regex":"\\.(css|js)$","methods":["get"],"pool":[{"address":"%s"}]},
+			{"headers":{"X-Version":"v2"},"lb_method":"consistent-hash","pool":[{"address":"%s"}]}]}]}`,
+		web.URL[7:], api.URL[7:], static.URL[7:], v2.URL[7:])
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := New(c.VServers)
+	require.NoError(t, err)
+	vs := b.VServers[0]
+	require.Len(t, vs.rules, 3)
+
+	tests := []struct {
+		method string
+		path   string
+		header string
+		body   string
+	}{
+		{"GET", "/index.html", "", "web /index.html"},
+		{"GET", "/api/users?id=1", "", "api /users?id=1"},
+		{"GET", "/api", "", "web /api"},
+		{"GET", "/assets/app.css", "", "static /assets/app.css"},
+		{"POST", "/assets/app.css", "", "web /assets/app.css"},
+		{"GET", "/index.html", "v2", "v2 /index.html"},
+		// the first matching rule wins
+		{"GET", "/api/app.js", "v2", "api /app.js"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.Host = "localhost"
+		if tt.header != "" {
+			r.Header.Set("X-Version", tt.header)
+		}
+		w := httptest.NewRecorder()
+		vs.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, tt.body, w.Body.String())
+	}
+
+	result, err := b.Route(&RouteRequest{Host: "localhost", Path: "/api/users"})
+	require.NoError(t, err)
+	assert.Equal(t, "web", result.VirtualServer)
+	assert.Equal(t, "web/rule0", result.Rule)
+	assert.Equal(t, "/users", result.Path)
+	assert.Equal(t, api.URL[7:], result.Pool)
+
+	result, err = b.Route(&RouteRequest{Host: "localhost", Headers: map[string]string{"X-Version": "v2"}})
+	require.NoError(t, err)
+	assert.Equal(t, "web/rule2", result.Rule)
+	assert.Equal(t, LB_COSISTENTHASH, result.LBMethod)
+
+	result, err = b.Route(&RouteRequest{Host: "localhost", Path: "/index.html"})
+	require.NoError(t, err)
+	assert.Empty(t, result.Rule)
+	assert.Equal(t, web.URL[7:], result.Pool)
+
+	_, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), RulesOpt([]config.Rule{{PathRegex: "("}}))
+	assert.NotNil(t, err)
+}
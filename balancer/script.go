@@ -0,0 +1,167 @@
+package balancer
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+// ScriptEngine compiles the user-supplied filters of a language, e.g. Lua or WASM,
+// it is registered by the program embedding the balancer, see RegisterScriptEngine
+type ScriptEngine interface {
+	Compile(name string, source []byte) (ScriptFilter, error)
+}
+
+// ScriptFilter runs at the request and response phases, it is called concurrently
+type ScriptFilter interface {
+	// OnRequest is called before the routing, setting ctx.Status answers the request
+	OnRequest(ctx *ScriptContext) error
+	// OnResponse is called before the response header is written to the client
+	OnResponse(ctx *ScriptContext) error
+}
+
+// ScriptContext is shared by the phases of a request
+type ScriptContext struct {
+	// the request headers may be changed in the request phase
+	Request *http.Request
+	// response header, sent with Body if Status is set in the request phase
+	Header http.Header
+	// status of the response, 0 in the request phase unless set by a filter
+	Status int
+	Body   []byte
+	// peer forced for the request, set in the request phase, empty means the load balancing
+	Upstream string
+	// remote_addr, host, method, uri and vs, the filters may add their own to pass them on
+	Vars map[string]string
+}
+
+var (
+	scriptEnginesMu sync.RWMutex
+	scriptEngines   = make(map[string]ScriptEngine)
+)
+
+// RegisterScriptEngine makes an engine available to the scripts of the configuration by name,
+// e.g. "lua" or "wasm", it panics if the engine is nil or name is registered twice
+func RegisterScriptEngine(name string, engine ScriptEngine) {
+	scriptEnginesMu.Lock()
+	defer scriptEnginesMu.Unlock()
+	if engine == nil {
+		panic("balancer: RegisterScriptEngine engine is nil")
+	}
+	if _, dup := scriptEngines[name]; dup {
+		panic("balancer: RegisterScriptEngine called twice for engine " + name)
+	}
+	scriptEngines[name] = engine
+}
+
+// ScriptsOpt runs the filters of scripts in order, before the other checks of the virtual server
+func ScriptsOpt(scripts []config.Script) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		for _, sc := range scripts {
+			scriptEnginesMu.RLock()
+			engine, ok := scriptEngines[sc.Engine]
+			scriptEnginesMu.RUnlock()
+			if !ok {
+				return ErrScriptEngine
+			}
+			source, err := ioutil.ReadFile(sc.File)
+			if err != nil {
+				return err
+			}
+			filter, err := engine.Compile(sc.File, source)
+			if err != nil {
+				return err
+			}
+			vs.middlewares = append(vs.middlewares, scriptMiddleware(vs, sc.File, filter))
+		}
+		return nil
+	}
+}
+
+// scriptWriter runs the response phase right before the status is written
+type scriptWriter struct {
+	http.ResponseWriter
+	ctx    *ScriptContext
+	name   string
+	filter ScriptFilter
+	done   bool
+}
+
+func (w *scriptWriter) WriteHeader(code int) {
+	if !w.done {
+		w.done = true
+		w.ctx.Header = w.Header()
+		w.ctx.Status = code
+		if err := w.filter.OnResponse(w.ctx); err != nil {
+			log.Errorf("script %s: response phase of %s%s, error=%v", w.name, w.ctx.Request.Host, w.ctx.Request.URL, err)
+		} else if w.ctx.Status > 0 {
+			code = w.ctx.Status
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *scriptWriter) Write(data []byte) (int, error) {
+	if !w.done {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *scriptWriter) Flush() {
+	if !w.done {
+		w.WriteHeader(http.StatusOK)
+	}
+	flush(w.ResponseWriter)
+}
+
+// Hijack hands the connection over, the on_response phase does not run
+func (w *scriptWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+// scriptMiddleware wraps the request and the response of the virtual server with filter
+func scriptMiddleware(vs *VirtualServer, name string, filter ScriptFilter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := &ScriptContext{
+				Request: r,
+				Header:  w.Header(),
+				Vars: map[string]string{
+					"remote_addr": r.RemoteAddr,
+					"host":        r.Host,
+					"method":      r.Method,
+					"uri":         r.URL.RequestURI(),
+					"vs":          vs.Name,
+				},
+			}
+			if err := filter.OnRequest(ctx); err != nil {
+				log.Errorf("script %s: request phase of %s%s, error=%v", name, r.Host, r.URL, err)
+				vs.writeError(w, r, ErrInternalBalancer)
+				return
+			}
+			if ctx.Status > 0 {
+				w.WriteHeader(ctx.Status)
+				w.Write(ctx.Body)
+				return
+			}
+			r = ctx.Request
+			if ctx.Upstream != "" {
+				upstream := ctx.Upstream
+				if addr, _, err := peerAddress(upstream, PROTO_HTTP); err == nil {
+					upstream = addr
+				}
+				r = r.WithContext(context.WithValue(r.Context(), upstreamKey{}, upstream))
+			}
+			ctx.Request = r
+			next.ServeHTTP(&scriptWriter{ResponseWriter: w, ctx: ctx, name: name, filter: filter}, r)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package balancer
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+// lineEngine compiles a script of "phase key value" lines
+type lineEngine struct{}
+
+type lineFilter [][]string
+
+func (lineEngine) Compile(name string, source []byte) (ScriptFilter, error) {
+	f := lineFilter{}
+	for _, line := range strings.Split(strings.TrimSpace(string(source)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.New("bad line " + line)
+		}
+		f = append(f, fields)
+	}
+	return f, nil
+}
+
+func (f lineFilter) OnRequest(ctx *ScriptContext) error {
+	for _, l := range f {
+		switch l[0] + " " + l[1] {
+		case "request deny":
+			if ctx.Request.Header.Get("X-Bucket") == l[2] {
+				ctx.Status = http.StatusForbidden
+				ctx.Body = []byte("denied")
+			}
+		case "request upstream":
+			ctx.Upstream = l[2]
+		case "request fail":
+			return errors.New(l[2])
+		}
+	}
+	ctx.Vars["bucket"] = "b" + ctx.Request.Header.Get("X-Bucket")
+	return nil
+}
+
+func (f lineFilter) OnResponse(ctx *ScriptContext) error {
+	for _, l := range f {
+		if l[0] == "response" && l[1] == "header" {
+			ctx.Header.Set(l[2], ctx.Vars["bucket"]+" "+ctx.Vars["vs"])
+		}
+	}
+	return nil
+}
+
+func TestScripts(t *testing.T) {
+	RegisterScriptEngine("line", lineEngine{})
+	assert.Panics(t, func() { RegisterScriptEngine("line", lineEngine{}) })
+
+	s1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("s1"))
+	}))
+	defer s1.Close()
+	s2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("s2"))
+	}))
+	defer s2.Close()
+
+	dir, err := ioutil.TempDir("", "golb-script")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	write := func(name, source string) string {
+		file := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(file, []byte(source), 0644))
+		return file
+	}
+
+	newVS := func(scripts ...config.Script) (*VirtualServer, error) {
+		return NewVirtualServer(
+			NameOpt("web"),
+			AddressOpt("127.0.0.1:80"),
+			PoolOpt([]config.Server{{Address: s1.URL[7:], Weight: 1}, {Address: s2.URL[7:], Weight: 1}}),
+			ScriptsOpt(scripts),
+		)
+	}
+	vs, err := newVS(config.Script{Engine: "line", File: write("ab.line",
+		"request deny 7\nrequest upstream "+s2.URL[7:]+"\nresponse header X-Bucket")})
+	require.NoError(t, err)
+	serve := func(bucket string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		req.Header.Set("X-Bucket", bucket)
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < 4; i++ {
+		w := serve("1")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "s2", w.Body.String())
+		assert.Equal(t, "b1 web", w.Header().Get("X-Bucket"))
+	}
+	w := serve("7")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "denied", w.Body.String())
+
+	vs, err = newVS(config.Script{Engine: "line", File: write("fail.line", "request fail oops")})
+	require.NoError(t, err)
+	assert.Equal(t, ErrInternalBalancer.StatusCode, serve("1").Code)
+
+	_, err = newVS(config.Script{Engine: "wasm", File: write("a.wasm", "")})
+	assert.Equal(t, ErrScriptEngine, err)
+	_, err = newVS(config.Script{Engine: "line", File: write("bad.line", "request")})
+	assert.Error(t, err)
+}
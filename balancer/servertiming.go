@@ -0,0 +1,69 @@
+package balancer
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ServerTimingOpt adds a Server-Timing header with the phases measured by the proxy:
+// lb-select, connect and upstream-ttfb. The transfer phase is sent as a trailer,
+// which is dropped if the response has a Content-Length
+func ServerTimingOpt(enable bool) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.serverTiming = enable
+		return nil
+	}
+}
+
+// durMs returns end - begin in milliseconds, 0 if either is unknown
+func durMs(begin, end time.Time) float64 {
+	if begin.IsZero() || end.IsZero() || end.Before(begin) {
+		return 0
+	}
+	return float64(end.Sub(begin)) / float64(time.Millisecond)
+}
+
+// serverTimingWriter sets the Server-Timing header right before the status is written
+type serverTimingWriter struct {
+	http.ResponseWriter
+	t *timing
+}
+
+func (w *serverTimingWriter) WriteHeader(code int) {
+	w.t.Lock()
+	value := fmt.Sprintf("lb-select;dur=%.1f, connect;dur=%.1f, upstream-ttfb;dur=%.1f",
+		durMs(w.t.start, w.t.proxyStart), durMs(w.t.proxyStart, w.t.gotConn), durMs(w.t.wroteRequest, w.t.firstByte))
+	w.t.Unlock()
+	w.Header().Add("Server-Timing", value)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverTimingWriter) Flush() {
+	flush(w.ResponseWriter)
+}
+
+func (w *serverTimingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+// withServerTiming wraps rw if Server-Timing is enabled
+func (s *VirtualServer) withServerTiming(rw http.ResponseWriter, t *timing) http.ResponseWriter {
+	if !s.serverTiming || t == nil {
+		return rw
+	}
+	return &serverTimingWriter{rw, t}
+}
+
+// addTransferTiming sends the transfer phase as a trailer
+func (s *VirtualServer) addTransferTiming(rw http.ResponseWriter, t *timing) {
+	if !s.serverTiming || t == nil {
+		return
+	}
+	t.Lock()
+	transfer := durMs(t.firstByte, time.Now())
+	t.Unlock()
+	rw.Header().Set(http.TrailerPrefix+"Server-Timing", fmt.Sprintf("transfer;dur=%.1f", transfer))
+}
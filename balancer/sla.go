@@ -0,0 +1,133 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/retry"
+)
+
+// startKey is the context key of the time a request is received
+type startKey struct{}
+
+// sla derives the timeouts of a virtual server from its latency target
+type sla struct {
+	latency    time.Duration
+	tries      int
+	tryTimeout time.Duration
+	// upper bound of the hedging delay
+	hedgeDelay time.Duration
+}
+
+// Timeouts are derived from the latency SLA, in milliseconds
+type Timeouts struct {
+	Deadline   int64 `json:"deadline"`
+	TryTimeout int64 `json:"try_timeout"`
+	// default delay before hedging, 0 if hedging is disabled
+	HedgeDelay int64 `json:"hedge_delay"`
+}
+
+// SLAOpt derives the timeouts from c, it overrides the SLA set by a previous SLAOpt
+// only if c.Latency > 0
+func SLAOpt(c config.SLA) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.Latency <= 0 {
+			return nil
+		}
+		tries := c.Tries
+		if tries <= 0 {
+			tries = retry.TRY
+		}
+		latency := time.Duration(c.Latency) * time.Millisecond
+		vs.sla = &sla{
+			latency:    latency,
+			tries:      tries,
+			tryTimeout: latency / time.Duration(tries),
+			hedgeDelay: latency / time.Duration(tries) / 2,
+		}
+		return nil
+	}
+}
+
+// hasSLA returns true if s or any of its rules has a SLA
+func (s *VirtualServer) hasSLA() bool {
+	if s.sla != nil {
+		return true
+	}
+	for _, ru := range s.rules {
+		if ru.vs.sla != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// withStart records when the request is received, the SLA counts from it across the tries
+func withStart(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), startKey{}, time.Now())))
+	})
+}
+
+// tryRequest returns r with the deadline of a try, false if the SLA is already missed
+func (s *VirtualServer) tryRequest(r *http.Request) (*http.Request, context.CancelFunc, bool) {
+	now := time.Now()
+	start, ok := r.Context().Value(startKey{}).(time.Time)
+	if !ok {
+		start = now
+	}
+	deadline := start.Add(s.sla.latency)
+	if !now.Before(deadline) {
+		return r, func() {}, false
+	}
+	if d := now.Add(s.sla.tryTimeout); d.Before(deadline) {
+		deadline = d
+	}
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	return r.WithContext(ctx), cancel, true
+}
+
+// proxyError responds 504 if the try timed out, 502 otherwise, with the error page if configured
+func (s *VirtualServer) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Errorf("http: proxy error: %v", err)
+	e := ErrBadGateway
+	if errors.Is(err, errBodyTooLarge) {
+		// the fault of the client, not of the peer
+		w.Header().Set("Connection", "close")
+		e = ErrRequestEntityTooLarge
+	} else {
+		setProxyOutcome(r, err)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		e = ErrGatewayTimeout
+	}
+	if page, ok := s.errorPages[strconv.Itoa(e.StatusCode)]; ok && s.writePage(w, r, page, e) {
+		return
+	}
+	w.WriteHeader(e.StatusCode)
+}
+
+// Timeouts returns nil if s has no SLA
+func (s *VirtualServer) Timeouts() *Timeouts {
+	if s.sla == nil {
+		return nil
+	}
+	t := &Timeouts{
+		Deadline:   int64(s.sla.latency / time.Millisecond),
+		TryTimeout: int64(s.sla.tryTimeout / time.Millisecond),
+	}
+	if s.hedgePercentile > 0 {
+		delay := s.hedgeDelay
+		if delay > s.sla.hedgeDelay {
+			delay = s.sla.hedgeDelay
+		}
+		t.HedgeDelay = int64(delay / time.Millisecond)
+	}
+	return t
+}
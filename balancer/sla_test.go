@@ -0,0 +1,98 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestSLATimeouts(t *testing.T) {
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8102"),
+		HedgeOpt(99, 200*time.Millisecond),
+		SLAOpt(config.SLA{Latency: 300, Tries: 3}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, &Timeouts{Deadline: 300, TryTimeout: 100, HedgeDelay: 50}, vs.Timeouts())
+	assert.Equal(t, 50*time.Millisecond, vs.hedgeDelayOf("127.0.0.1:10001"))
+	assert.Equal(t, config.SLA{Latency: 300, Tries: 3}, vs.EffectiveConfig().SLA)
+
+	// the tries default to the ones of the retry
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt("127.0.0.1:8102"), SLAOpt(config.SLA{Latency: 300}))
+	require.NoError(t, err)
+	assert.Equal(t, &Timeouts{Deadline: 300, TryTimeout: 100}, vs.Timeouts())
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt("127.0.0.1:8102"))
+	require.NoError(t, err)
+	assert.Nil(t, vs.Timeouts())
+}
+
+func TestSLARule(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8102",
+		"sla":{"latency":1000,"tries":2},
+		"pool":[{"address":"127.0.0.1:10001"}],
+		"rules":[
+			{"path_prefix":"/api/","sla":{"latency":90,"tries":3},"pool":[{"address":"127.0.0.1:10002"}]},
+			{"path_prefix":"/static/","pool":[{"address":"127.0.0.1:10003"}]}]}]}`
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := New(c.VServers)
+	require.NoError(t, err)
+
+	tests := []struct {
+		path     string
+		timeouts *Timeouts
+	}{
+		{"/", &Timeouts{Deadline: 1000, TryTimeout: 500}},
+		{"/api/users", &Timeouts{Deadline: 90, TryTimeout: 30}},
+		{"/static/a.css", &Timeouts{Deadline: 1000, TryTimeout: 500}},
+	}
+	for _, tt := range tests {
+		result, err := b.Route(&RouteRequest{Address: "127.0.0.1:8102", Path: tt.path})
+		require.NoError(t, err)
+		assert.Equal(t, tt.timeouts, result.Timeouts, tt.path)
+	}
+}
+
+func TestSLADeadline(t *testing.T) {
+	var count int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8102"),
+		PoolOpt([]config.Server{{Address: slow.URL[7:], Weight: 1}}),
+		RetryOpt(true),
+		SLAOpt(config.SLA{Latency: 200, Tries: 2}),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	rr := httptest.NewRecorder()
+	begin := time.Now()
+	vs.handler.ServeHTTP(rr, req)
+	elapsed := time.Since(begin)
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	// the retries share the deadline of the SLA
+	assert.True(t, elapsed < 500*time.Millisecond, fmt.Sprintf("elapsed %v", elapsed))
+	assert.True(t, elapsed >= 200*time.Millisecond, fmt.Sprintf("elapsed %v", elapsed))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+}
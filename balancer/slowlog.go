@@ -0,0 +1,126 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// timing records the phases of a proxied request for the slow log
+type timing struct {
+	sync.Mutex
+	start        time.Time
+	proxyStart   time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	reused       bool
+	// a TLS handshake succeeded, resuming a session
+	handshake bool
+	resumed   bool
+}
+
+func (t *timing) set(field *time.Time) {
+	t.Lock()
+	*field = time.Now()
+	t.Unlock()
+}
+
+func (t *timing) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectStart:      func(string, string) { t.set(&t.connectStart) },
+		ConnectDone:       func(string, string, error) { t.set(&t.connectDone) },
+		TLSHandshakeStart: func() { t.set(&t.tlsStart) },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.set(&t.tlsDone)
+			if err == nil {
+				t.Lock()
+				t.handshake, t.resumed = true, state.DidResume
+				t.Unlock()
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.set(&t.gotConn)
+			t.Lock()
+			t.reused = info.Reused
+			t.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.set(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.set(&t.firstByte) },
+	}
+}
+
+// span returns end - begin in milliseconds, 0 if either is unknown
+func span(begin, end time.Time) int64 {
+	if begin.IsZero() || end.IsZero() || end.Before(begin) {
+		return 0
+	}
+	return int64(end.Sub(begin) / time.Millisecond)
+}
+
+// SlowLogOpt logs the requests taking threshold or longer to file with a timing breakdown,
+// an empty file means the main log. 0 disables it
+func SlowLogOpt(threshold time.Duration, file string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if threshold <= 0 {
+			return nil
+		}
+		vs.slowThreshold = threshold
+		vs.slowLog = log.StandardLogger()
+		if file != "" {
+			f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			vs.slowLog = log.New()
+			vs.slowLog.Out = f
+			vs.slowLog.Formatter = &log.TextFormatter{FullTimestamp: true, DisableColors: true}
+		}
+		return nil
+	}
+}
+
+// traceSlow returns r with a client trace recording t, for the slow log, Server-Timing and the connection stats
+func (s *VirtualServer) traceSlow(r *http.Request, t *timing) *http.Request {
+	if t == nil {
+		return r
+	}
+	t.set(&t.proxyStart)
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), t.trace()))
+}
+
+// logSlow logs the request if it took longer than the threshold. The phases are
+// queue (before proxying, including injected latency), conn (waiting for a connection),
+// dial, tls, ttfb (from the request written to the first response byte) and transfer
+func (s *VirtualServer) logSlow(r *http.Request, peer string, code int, t *timing, end time.Time) {
+	if s.slowLog == nil || t == nil || end.Sub(t.start) < s.slowThreshold {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	s.slowLog.WithFields(log.Fields{
+		"vs":          s.Name,
+		"peer":        peer,
+		"client":      r.RemoteAddr,
+		"method":      r.Method,
+		"url":         r.Host + r.URL.String(),
+		"code":        code,
+		"total_ms":    span(t.start, end),
+		"queue_ms":    span(t.start, t.proxyStart),
+		"conn_ms":     span(t.proxyStart, t.gotConn),
+		"dial_ms":     span(t.connectStart, t.connectDone),
+		"tls_ms":      span(t.tlsStart, t.tlsDone),
+		"ttfb_ms":     span(t.wroteRequest, t.firstByte),
+		"transfer_ms": span(t.firstByte, end),
+		"reused":      t.reused,
+	}).Warn("slow request")
+}
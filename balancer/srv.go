@@ -0,0 +1,102 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const DEFAULT_SRV_INTERVAL = 30 * time.Second
+
+// srvEntry populates the pool from the SRV records of _service._proto.name
+type srvEntry struct {
+	service  string
+	proto    string
+	name     string
+	interval time.Duration
+	// peers added from the records, address -> weight
+	known map[string]int
+	// overridden by tests
+	lookup func(ctx context.Context, service, proto, name string) ([]*net.SRV, error)
+}
+
+func (e *srvEntry) String() string {
+	return fmt.Sprintf("_%s._%s.%s", e.service, e.proto, e.name)
+}
+
+// SRVOpt adds a peer for each SRV record of _service._proto.name, with the port and
+// weight of the record, and looks the records up again every interval. Only the records
+// of the lowest priority are used. An empty name disables it.
+func SRVOpt(service, proto, name string, interval time.Duration) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if name == "" {
+			return nil
+		}
+		if proto == "" {
+			proto = "tcp"
+		}
+		if interval <= 0 {
+			interval = DEFAULT_SRV_INTERVAL
+		}
+		vs.srv = &srvEntry{
+			service:  service,
+			proto:    proto,
+			name:     name,
+			interval: interval,
+			known:    map[string]int{},
+		}
+		return nil
+	}
+}
+
+// resolveSRV updates the peers from the SRV records, the old peers are kept on failure
+func (s *VirtualServer) resolveSRV() {
+	lookup := s.srv.lookup
+	if lookup == nil {
+		lookup = s.resolver.LookupSRV
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	srvs, err := lookup(ctx, s.srv.service, s.srv.proto, s.srv.name)
+	cancel()
+	if err != nil || len(srvs) == 0 {
+		log.Errorf("[%s] lookup SRV %s err=%v", s.Name, s.srv, err)
+		return
+	}
+
+	desired := map[string]int{}
+	for _, srv := range srvs {
+		// the records are sorted by priority
+		if srv.Priority != srvs[0].Priority {
+			break
+		}
+		// "." means the service is not available at this domain
+		target := strings.TrimSuffix(srv.Target, ".")
+		if target == "" {
+			continue
+		}
+		weight := int(srv.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		desired[net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))] = weight
+	}
+	s.SyncPeers("srv "+s.srv.String(), s.srv.known, desired)
+}
+
+func (s *VirtualServer) srvLoop(stop chan struct{}) {
+	ticker := time.NewTicker(s.srv.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.resolveSRV()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package balancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+// the state is saved at most once per STATE_SAVE_INTERVAL
+const STATE_SAVE_INTERVAL = time.Second
+
+// Members returns the pool members configured or added by AddServer, sorted by address,
+// the peers of the service discovery are not included
+func (s *VirtualServer) Members() []config.Server {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+	result := make([]config.Server, 0, len(s.members))
+	for _, m := range s.members {
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+// setConfigured records the virtual servers of the configuration if the state is saved
+func (b *Balancer) setConfigured(vss []config.VirtualServer) {
+	b.Lock()
+	defer b.Unlock()
+	if b.configured == nil {
+		return
+	}
+	b.configured = make(map[string]bool, len(vss))
+	for _, vs := range vss {
+		b.configured[vs.Name] = true
+	}
+}
+
+// State returns the topology of b changed from the configuration, nil if not saved
+func (b *Balancer) State() *config.State {
+	b.RLock()
+	configured := b.configured
+	b.RUnlock()
+	if configured == nil {
+		return nil
+	}
+
+	st := &config.State{Pools: map[string][]config.Server{}, Added: []config.VirtualServer{}, Removed: []string{}}
+	names := map[string]bool{}
+	for _, vs := range b.virtualServers() {
+		names[vs.Name] = true
+		if configured[vs.Name] {
+			st.Pools[vs.Name] = vs.Members()
+			continue
+		}
+		c := &config.VirtualServer{Name: vs.Name, Address: vs.Address}
+		if vs.conf != nil {
+			c = copyConfig(vs.conf)
+		}
+		c.Pool = vs.Members()
+		st.Added = append(st.Added, *c)
+	}
+	for name := range configured {
+		if !names[name] {
+			st.Removed = append(st.Removed, name)
+		}
+	}
+	sort.Strings(st.Removed)
+	return st
+}
+
+// SaveState saves the changes to the virtual servers of vss made at runtime to file, every
+// STATE_SAVE_INTERVAL if any, until stopped, see config.State. The reloads replace vss
+func (b *Balancer) SaveState(file string, vss []config.VirtualServer) (stop func()) {
+	b.Lock()
+	b.configured = map[string]bool{}
+	b.Unlock()
+	b.setConfigured(vss)
+
+	var saved []byte
+	save := func() {
+		st := b.State()
+		data, _ := json.Marshal(st)
+		if bytes.Equal(data, saved) {
+			return
+		}
+		if err := config.SaveState(file, st); err != nil {
+			log.Errorf("Save state %s error=%v", file, err)
+			return
+		}
+		saved = data
+		log.Debugf("Saved state %s", file)
+	}
+	save()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(STATE_SAVE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				save()
+				return
+			case <-ticker.C:
+				save()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,77 @@
+package balancer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestSaveState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+
+	vss := []config.VirtualServer{
+		{Name: "web", Address: "127.0.0.1:80", Pool: []config.Server{{Address: "127.0.0.1:10001", Weight: 1}}},
+		{Name: "api", Address: "127.0.0.1:81"},
+	}
+	b, err := New(vss)
+	require.NoError(t, err)
+	assert.Nil(t, b.State())
+
+	stop := b.SaveState(file, vss)
+	st, err := config.LoadState(file)
+	require.NoError(t, err)
+	assert.Equal(t, &config.State{
+		Pools: map[string][]config.Server{
+			"web": {{Address: "127.0.0.1:10001", Weight: 1, Scheme: PROTO_HTTP}},
+			"api": {},
+		},
+		Added:   []config.VirtualServer{},
+		Removed: []string{},
+	}, st)
+
+	web, err := b.FindVirtualServer("web")
+	require.NoError(t, err)
+	_, err = web.AddServer(config.Server{Address: "127.0.0.1:10002", Weight: 3, Backup: true})
+	require.NoError(t, err)
+	web.RemovePeer("127.0.0.1:10001")
+	// discovered, not saved
+	web.AddPeer("127.0.0.1:10005")
+	require.NoError(t, b.RemoveVirtualServer("api"))
+	_, err = b.Clone("web", &CloneRequest{Name: "staging", Address: "127.0.0.1:82"})
+	require.NoError(t, err)
+	stop()
+
+	st, err = config.LoadState(file)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]config.Server{
+		"web": {{Address: "127.0.0.1:10002", Weight: 3, Scheme: PROTO_HTTP, Backup: true}},
+	}, st.Pools)
+	assert.Equal(t, []string{"api"}, st.Removed)
+	require.Len(t, st.Added, 1)
+	assert.Equal(t, "staging", st.Added[0].Name)
+	assert.Equal(t, "127.0.0.1:82", st.Added[0].Address)
+	assert.Equal(t, []config.Server{{Address: "127.0.0.1:10001", Weight: 1, Scheme: PROTO_HTTP}}, st.Added[0].Pool)
+
+	// a reload applies the configuration as is
+	_, err = b.Reload(vss, config.Reload{})
+	require.NoError(t, err)
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Rollout().State == ROLLOUT_RUNNING {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+	st = b.State()
+	assert.Empty(t, st.Added)
+	assert.Empty(t, st.Removed)
+	assert.Contains(t, st.Pools, "api")
+}
@@ -0,0 +1,98 @@
+package balancer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/stats"
+)
+
+const DEFAULT_STATS_SAVE_INTERVAL = time.Minute
+
+// savedStats are the counters of the peers by virtual server name
+type savedStats map[string]map[string]*stats.Report
+
+// LoadStats adds the counters saved by SaveStats to the virtual servers of the same name,
+// a missing file is not an error
+func (b *Balancer) LoadStats(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := savedStats{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for _, vs := range b.virtualServers() {
+		if peers, ok := saved[vs.Name]; ok {
+			vs.restoreStats(peers)
+		}
+	}
+	return nil
+}
+
+// SaveStats saves the counters of the peers of the virtual servers to file every interval,
+// 0 means DEFAULT_STATS_SAVE_INTERVAL, and once more when stopped
+func (b *Balancer) SaveStats(file string, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = DEFAULT_STATS_SAVE_INTERVAL
+	}
+	save := func() {
+		saved := savedStats{}
+		for _, vs := range b.virtualServers() {
+			saved[vs.Name] = vs.StatsReport().Peers
+		}
+		data, err := json.Marshal(saved)
+		if err == nil {
+			err = config.WriteFileAtomic(file, data)
+		}
+		if err != nil {
+			log.Errorf("Save stats %s error=%v", file, err)
+			return
+		}
+		log.Debugf("Saved stats %s", file)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				save()
+				return
+			case <-ticker.C:
+				save()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// restoreStats adds the saved counters of the peers
+func (s *VirtualServer) restoreStats(peers map[string]*stats.Report) {
+	s.ss_lock.Lock()
+	defer s.ss_lock.Unlock()
+	for peer, r := range peers {
+		ss, ok := s.ServerStats[peer]
+		if !ok {
+			ss = stats.New()
+			s.ServerStats[peer] = ss
+		}
+		ss.Restore(r)
+	}
+}
@@ -0,0 +1,59 @@
+package balancer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestSaveStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "stats.json")
+
+	vss := []config.VirtualServer{
+		{Name: "web", Address: "127.0.0.1:80", Pool: []config.Server{{Address: "127.0.0.1:10001", Weight: 1}}},
+	}
+	b, err := New(vss)
+	require.NoError(t, err)
+	require.NoError(t, b.LoadStats(file))
+
+	web, err := b.FindVirtualServer("web")
+	require.NoError(t, err)
+	inc := func(vs *VirtualServer) {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := &LBResponseWriter{ResponseWriter: httptest.NewRecorder(), code: http.StatusOK, bytes: 100}
+		vs.StatsInc("127.0.0.1:10001", req, w, time.Millisecond)
+	}
+	inc(web)
+	inc(web)
+	stop := b.SaveStats(file, time.Hour)
+	stop()
+
+	// a restart adds the saved counters to the new ones
+	b, err = New(vss)
+	require.NoError(t, err)
+	web, err = b.FindVirtualServer("web")
+	require.NoError(t, err)
+	inc(web)
+	require.NoError(t, b.LoadStats(file))
+	report := web.StatsReport()
+	peer := report.Peers["127.0.0.1:10001"]
+	require.NotNil(t, peer)
+	assert.Equal(t, uint64(3), peer.StatusCode["200"])
+	assert.Equal(t, uint64(300), peer.OutBytes)
+	assert.Equal(t, uint64(3), peer.Latency.Count)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("{"), 0600))
+	assert.Error(t, b.LoadStats(file))
+}
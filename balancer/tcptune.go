@@ -0,0 +1,106 @@
+package balancer
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/onestraw/golb/config"
+)
+
+// TCPOpt tunes the listener sockets of the virtual server and its client connections, see config.TCP.
+// The virtual servers sharing the address use the options of the first one started
+func TCPOpt(c config.TCP) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if c.KeepAliveIdle < 0 || c.KeepAliveInterval < 0 || c.KeepAliveCount < 0 ||
+			c.DeferAccept < 0 || c.Backlog < 0 || c.Linger < -1 {
+			return ErrNegativeTCPOption
+		}
+		vs.tcp = c
+		return nil
+	}
+}
+
+// tunedListener sets the options of the accepted connections
+type tunedListener struct {
+	net.Listener
+	tcp config.TCP
+}
+
+// tuneListener sets the options of the listener socket of ln, and returns the listener tuning its
+// connections. The listener is returned as is if c has no option, and with an error if it is not TCP
+func tuneListener(ln net.Listener, c config.TCP) (net.Listener, error) {
+	if c == (config.TCP{}) {
+		return ln, nil
+	}
+	tuned := tunedListener{Listener: ln, tcp: c}
+	if c.DeferAccept == 0 && c.Backlog == 0 {
+		return tuned, nil
+	}
+	inner := ln
+	if h, ok := ln.(*handoffListener); ok {
+		inner = h.Listener
+	}
+	sc, ok := inner.(syscall.Conn)
+	if !ok {
+		return tuned, ErrNotSupportedProto
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return tuned, err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		if c.DeferAccept > 0 {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, c.DeferAccept)
+		}
+		if serr == nil && c.Backlog > 0 {
+			// listening again only changes the backlog
+			serr = unix.Listen(int(fd), c.Backlog)
+		}
+	}); err != nil {
+		return tuned, err
+	}
+	return tuned, serr
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		if err := l.tune(tc); err != nil {
+			log.Warnf("Tune connection of %s error=%v", tc.RemoteAddr(), err)
+		}
+	}
+	return c, nil
+}
+
+func (l tunedListener) tune(tc *net.TCPConn) error {
+	c := l.tcp
+	if c.DisableNoDelay {
+		if err := tc.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if c.KeepAliveIdle > 0 || c.KeepAliveInterval > 0 || c.KeepAliveCount > 0 {
+		if err := tc.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     time.Duration(c.KeepAliveIdle) * time.Second,
+			Interval: time.Duration(c.KeepAliveInterval) * time.Second,
+			Count:    c.KeepAliveCount,
+		}); err != nil {
+			return err
+		}
+	}
+	if c.Linger > 0 {
+		return tc.SetLinger(c.Linger)
+	} else if c.Linger < 0 {
+		return tc.SetLinger(0)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package balancer
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/onestraw/golb/config"
+)
+
+func sockopt(t *testing.T, c syscall.Conn, level, opt int) int {
+	raw, err := c.SyscallConn()
+	require.NoError(t, err)
+	var value int
+	var serr error
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		value, serr = unix.GetsockoptInt(int(fd), level, opt)
+	}))
+	require.NoError(t, serr)
+	return value
+}
+
+func TestTuneListener(t *testing.T) {
+	_, err := NewVirtualServer(TCPOpt(config.TCP{Linger: -2}))
+	assert.Equal(t, ErrNegativeTCPOption, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	same, err := tuneListener(ln, config.TCP{})
+	require.NoError(t, err)
+	assert.True(t, same == ln)
+
+	c := config.TCP{DisableNoDelay: true, KeepAliveIdle: 30, KeepAliveInterval: 10, KeepAliveCount: 4,
+		DeferAccept: 5, Backlog: 16, Linger: 3}
+	tuned, err := tuneListener(ln, c)
+	require.NoError(t, err)
+	assert.NotZero(t, sockopt(t, ln.(*net.TCPListener), unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT))
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	// deferred until the first data
+	client.Write([]byte("GET"))
+	conn, err := tuned.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	tc := conn.(*net.TCPConn)
+	assert.Equal(t, 0, sockopt(t, tc, unix.IPPROTO_TCP, unix.TCP_NODELAY))
+	assert.Equal(t, 1, sockopt(t, tc, unix.SOL_SOCKET, unix.SO_KEEPALIVE))
+	assert.Equal(t, 30, sockopt(t, tc, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE))
+	assert.Equal(t, 10, sockopt(t, tc, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL))
+	assert.Equal(t, 4, sockopt(t, tc, unix.IPPROTO_TCP, unix.TCP_KEEPCNT))
+	raw, err := tc.SyscallConn()
+	require.NoError(t, err)
+	var linger *unix.Linger
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		linger, err = unix.GetsockoptLinger(int(fd), unix.SOL_SOCKET, unix.SO_LINGER)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), linger.Onoff)
+	assert.Equal(t, int32(3), linger.Linger)
+
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt("127.0.0.1:80"), TCPOpt(c))
+	require.NoError(t, err)
+	assert.Equal(t, c, vs.EffectiveConfig().TCP)
+}
@@ -0,0 +1,107 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/onestraw/golb/config"
+)
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// DEFAULT_ALPN is offered by the https listeners if none is configured
+var DEFAULT_ALPN = []string{"h2", "http/1.1"}
+
+// tlsPolicy is the TLS policy of the https listener of a virtual server, checked by TLSPolicyOpt
+type tlsPolicy struct {
+	conf         config.TLS
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+
+	// guards the reload, cert and ocspMtime
+	ocsp_lock sync.Mutex
+	cert      tls.Certificate
+	ocspMtime time.Time
+	staple    atomic.Value
+}
+
+// TLSPolicyOpt restricts the TLS of the https listener for the server name of vs,
+// e.g. TLS 1.2+ with the AEAD ciphers only, see config.TLS
+func TLSPolicyOpt(c config.TLS) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		p := &tlsPolicy{conf: c}
+		for _, v := range []struct {
+			name    string
+			version *uint16
+		}{{c.MinVersion, &p.minVersion}, {c.MaxVersion, &p.maxVersion}} {
+			if v.name == "" {
+				continue
+			}
+			version, ok := tlsVersions[v.name]
+			if !ok {
+				return ErrTLSPolicy
+			}
+			*v.version = version
+		}
+		if p.maxVersion != 0 && p.minVersion > p.maxVersion {
+			return ErrTLSPolicy
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := cipherSuite(name)
+			if !ok {
+				return ErrTLSPolicy
+			}
+			p.cipherSuites = append(p.cipherSuites, id)
+		}
+		for _, name := range c.Curves {
+			curve, ok := tlsCurves[name]
+			if !ok {
+				return ErrTLSPolicy
+			}
+			p.curves = append(p.curves, curve)
+		}
+		vs.tlsPolicy = p
+		return nil
+	}
+}
+
+// apply restricts cfg by p, and staples the OCSP response to cert by cfg.GetCertificate
+func (p *tlsPolicy) apply(cfg *tls.Config, cert tls.Certificate) error {
+	if p == nil {
+		return nil
+	}
+	cfg.MinVersion = p.minVersion
+	cfg.MaxVersion = p.maxVersion
+	cfg.CipherSuites = p.cipherSuites
+	cfg.CurvePreferences = p.curves
+	if len(p.conf.ALPN) > 0 {
+		cfg.NextProtos = p.conf.ALPN
+	}
+	if p.conf.OCSPFile != "" {
+		p.ocsp_lock.Lock()
+		defer p.ocsp_lock.Unlock()
+		p.cert = cert
+		if err := p.loadOCSP(); err != nil {
+			return err
+		}
+		cfg.GetCertificate = p.getCertificate
+	}
+	return nil
+}
+
+// TLSPolicy returns the TLS policy of the https listener, the zero value if none
+func (s *VirtualServer) TLSPolicy() config.TLS {
+	if s.tlsPolicy == nil {
+		return config.TLS{}
+	}
+	return s.tlsPolicy.conf
+}
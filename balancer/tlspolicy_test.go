@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	for _, c := range []config.TLS{
+		{MaxVersion: "2.0"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{CipherSuites: []string{"TLS_NOPE"}},
+		{Curves: []string{"P224"}},
+	} {
+		_, err := NewVirtualServer(TLSPolicyOpt(c))
+		assert.Equal(t, ErrTLSPolicy, err, c)
+	}
+
+	ocsp, err := ioutil.TempFile("", "ocsp.der")
+	require.NoError(t, err)
+	defer os.Remove(ocsp.Name())
+	staple := ocspDER(t, time.Now().Add(time.Hour))
+	ocsp.Write(staple)
+	ocsp.Close()
+
+	c := config.TLS{
+		MinVersion:   "1.2",
+		MaxVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		Curves:       []string{"P256"},
+		ALPN:         []string{"http/1.1"},
+		OCSPFile:     ocsp.Name(),
+	}
+	vs, err := NewVirtualServer(
+		NameOpt("tls"),
+		AddressOpt("127.0.0.1:8443"),
+		ProtocolOpt(PROTO_HTTPS),
+		TLSOpt("../examples/https/server.pem", "../examples/https/server.key"),
+		TLSPolicyOpt(c),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, c, vs.EffectiveConfig().TLS)
+	cfg, err := vs.serverTLSConfig()
+	require.NoError(t, err)
+
+	handshake := func(client *tls.Config) (tls.ConnectionState, error) {
+		cc, sc := net.Pipe()
+		defer cc.Close()
+		defer sc.Close()
+		go tls.Server(sc, cfg).Handshake()
+		conn := tls.Client(cc, client)
+		err := conn.Handshake()
+		return conn.ConnectionState(), err
+	}
+	state, err := handshake(&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+	assert.Equal(t, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, state.CipherSuite)
+	assert.Equal(t, "http/1.1", state.NegotiatedProtocol)
+	assert.Equal(t, staple, state.OCSPResponse)
+
+	_, err = handshake(&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11})
+	assert.Error(t, err)
+	_, err = handshake(&tls.Config{InsecureSkipVerify: true,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}})
+	assert.Error(t, err)
+}
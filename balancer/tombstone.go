@@ -0,0 +1,78 @@
+package balancer
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tombstone is a peer removed from the pool after being down for too long,
+// it is not retried any more but kept for visibility until resurrected
+type Tombstone struct {
+	Peer      string    `json:"address"`
+	DownSince time.Time `json:"down_since"`
+	BuriedAt  time.Time `json:"buried_at"`
+}
+
+// TombstoneOpt moves a peer continuously down for seconds to the tombstone list, 0 disables it
+func TombstoneOpt(seconds int64) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if seconds < 0 {
+			seconds = 0
+		}
+		vs.TombstoneAfter = seconds
+		return nil
+	}
+}
+
+// bury should be called with pool_lock held
+func (s *VirtualServer) bury(peer string) {
+	t := &Tombstone{
+		Peer:      peer,
+		DownSince: time.Unix(s.downSince[peer], 0),
+		BuriedAt:  time.Now(),
+	}
+	s.tombstones[peer] = t
+	delete(s.fails, peer)
+	delete(s.timeout, peer)
+	delete(s.downSince, peer)
+	delete(s.down, peer)
+	s.Pool.Remove(peer)
+	s.emit(EVENT_PEER_REMOVED, peer, REASON_TOMBSTONE)
+
+	log.WithFields(log.Fields{"event": "tombstone", "vs": s.Name, "peer": peer, "down_since": t.DownSince}).
+		Warnf("Peer %s is down for more than %ds, moved to tombstones", peer, s.TombstoneAfter)
+}
+
+func (s *VirtualServer) Tombstones() []Tombstone {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+
+	result := []Tombstone{}
+	for _, t := range s.tombstones {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Peer < result[j].Peer
+	})
+	return result
+}
+
+// Resurrect puts a buried peer back to the pool
+func (s *VirtualServer) Resurrect(peer string, weight int) error {
+	s.pool_lock.Lock()
+	_, ok := s.tombstones[peer]
+	delete(s.tombstones, peer)
+	s.pool_lock.Unlock()
+	if !ok {
+		return ErrTombstoneNotFound
+	}
+
+	if weight <= 0 {
+		weight = 1
+	}
+	log.WithFields(log.Fields{"event": "resurrect", "vs": s.Name, "peer": peer}).Infof("Peer %s is resurrected", peer)
+	s.AddPeer(peer, weight)
+	return nil
+}
@@ -0,0 +1,75 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UNIX_PREFIX marks the address of a listener or a peer as a unix domain socket path,
+// e.g. unix:/run/php-fpm.sock
+const UNIX_PREFIX = "unix:"
+
+// isUnix returns true if addr is a unix domain socket address
+func isUnix(addr string) bool {
+	return strings.HasPrefix(addr, UNIX_PREFIX)
+}
+
+// listenNetwork returns the network and the address to listen on for address
+func listenNetwork(address string) (string, string) {
+	if isUnix(address) {
+		return "unix", strings.TrimPrefix(address, UNIX_PREFIX)
+	}
+	return "tcp", address
+}
+
+// removeStaleSocket removes the socket file at path if no one accepts on it,
+// e.g. left by a crashed process, so it can be listened again
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// the socket paths of the unix peers by their synthetic host name
+var unixHosts sync.Map
+
+// peerHost returns the host:port of the URLs sent to peer, a unix peer is given a host
+// name which the transport dials as its socket, one per path so their connections are pooled apart
+func peerHost(peer string) string {
+	if !isUnix(peer) {
+		return peer
+	}
+	path := strings.TrimPrefix(peer, UNIX_PREFIX)
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	host := fmt.Sprintf("%x.unix", h.Sum64())
+	unixHosts.Store(host, path)
+	return host
+}
+
+// unixDialer dials the socket of the unix peers, and the other addresses with dial
+func unixDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host := addr
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			host = h
+		}
+		if path, ok := unixHosts.Load(host); ok {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path.(string))
+		}
+		return dial(ctx, network, addr)
+	}
+}
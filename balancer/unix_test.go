@@ -0,0 +1,71 @@
+package balancer
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb-unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	peerPath := filepath.Join(dir, "peer.sock")
+	ln, err := net.Listen("unix", peerPath)
+	require.NoError(t, err)
+	peer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unix peer " + r.URL.Path))
+	})}
+	go peer.Serve(ln)
+	defer peer.Close()
+
+	addr, scheme, err := peerAddress("unix:"+peerPath, "")
+	require.NoError(t, err)
+	assert.Equal(t, "unix:"+peerPath, addr)
+	assert.Equal(t, PROTO_HTTP, scheme)
+
+	// a socket file left by a crashed process
+	lbPath := filepath.Join(dir, "lb.sock")
+	stale, err := net.Listen("unix", lbPath)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("unix"),
+		AddressOpt("unix:"+lbPath),
+		PoolOpt([]config.Server{{Address: "unix:" + peerPath, Weight: 1}}),
+		HealthCheckOpt(config.HealthCheck{Path: "/health", Timeout: 1}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, vs.Run())
+	defer vs.Stop()
+	assert.NoError(t, vs.probe("unix:"+peerPath, vs.peerHealthCheck("unix:"+peerPath)))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", lbPath)
+		},
+	}}
+	resp, err := client.Get("http://localhost/x")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "unix peer /x", string(body))
+
+	require.NoError(t, vs.Stop())
+	_, err = os.Stat(lbPath)
+	assert.True(t, os.IsNotExist(err))
+}
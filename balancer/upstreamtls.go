@@ -0,0 +1,78 @@
+package balancer
+
+import (
+	"crypto/tls"
+
+	"github.com/onestraw/golb/config"
+)
+
+// DEFAULT_TLS_SESSION_CACHE is the number of the TLS sessions to the peers kept for resumption,
+// sparing a full handshake to the connections reopened to a peer
+const DEFAULT_TLS_SESSION_CACHE = 64
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuite returns the id of the cipher suite name, false if unknown
+func cipherSuite(name string) (uint16, bool) {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+// UpstreamTLSOpt tunes the TLS client of the connections to the https peers, see config.UpstreamTLS
+func UpstreamTLSOpt(c config.UpstreamTLS) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		conf := &tls.Config{NextProtos: c.ALPN}
+		if c.SessionCacheSize == 0 {
+			c.SessionCacheSize = DEFAULT_TLS_SESSION_CACHE
+		}
+		if c.SessionCacheSize > 0 {
+			conf.ClientSessionCache = tls.NewLRUClientSessionCache(c.SessionCacheSize)
+		}
+		for _, v := range []struct {
+			name    string
+			version *uint16
+		}{{c.MinVersion, &conf.MinVersion}, {c.MaxVersion, &conf.MaxVersion}} {
+			if v.name == "" {
+				continue
+			}
+			version, ok := tlsVersions[v.name]
+			if !ok {
+				return ErrUpstreamTLS
+			}
+			*v.version = version
+		}
+		if conf.MaxVersion != 0 && conf.MinVersion > conf.MaxVersion {
+			return ErrUpstreamTLS
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := cipherSuite(name)
+			if !ok {
+				return ErrUpstreamTLS
+			}
+			conf.CipherSuites = append(conf.CipherSuites, id)
+		}
+
+		t := vs.httpTransport()
+		t.TLSClientConfig = conf
+		if len(c.ALPN) > 0 {
+			// HTTP/2 is negotiated only if offered
+			t.ForceAttemptHTTP2 = false
+			for _, proto := range c.ALPN {
+				if proto == "h2" {
+					t.ForceAttemptHTTP2 = true
+				}
+			}
+		}
+		vs.upstreamTLS = c
+		return nil
+	}
+}
@@ -0,0 +1,62 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	for _, c := range []config.UpstreamTLS{
+		{MinVersion: "1.4"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{CipherSuites: []string{"TLS_NOPE"}},
+	} {
+		_, err := NewVirtualServer(UpstreamTLSOpt(c))
+		assert.Equal(t, ErrUpstreamTLS, err, c)
+	}
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	defer s.Close()
+	peer := s.URL[8:]
+
+	c := config.UpstreamTLS{
+		MaxVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		ALPN:         []string{"http/1.1"},
+	}
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1, Scheme: PROTO_HTTPS}}),
+		KeepAliveOpt(config.KeepAlive{Disable: true}),
+		UpstreamTLSOpt(c),
+	)
+	require.NoError(t, err)
+	c.SessionCacheSize = DEFAULT_TLS_SESSION_CACHE
+	assert.Equal(t, c, vs.EffectiveConfig().UpstreamTLS)
+	tr := vs.httpTransport()
+	assert.False(t, tr.ForceAttemptHTTP2)
+	assert.Equal(t, uint16(tls.VersionTLS12), tr.TLSClientConfig.MaxVersion)
+	tr.TLSClientConfig.RootCAs = s.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "HTTP/1.1", w.Body.String())
+	}
+	r := vs.StatsReport().Peers[peer]
+	assert.Equal(t, uint64(1), r.FullHandshakes)
+	assert.Equal(t, uint64(2), r.ResumedHandshakes)
+}
@@ -0,0 +1,129 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HashKeyOpt sets the template of the key hashed by the chash and ip_hash methods, e.g.
+// "$cookie_session" or "$header_x_user", a request expanding it to empty hashes its client address
+func HashKeyOpt(template string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.hashKeyTemplate = template
+		return nil
+	}
+}
+
+// requestVars holds the state of a request which is not in the request itself,
+// it is shared by the virtual servers of the rules and the canary of the request
+type requestVars struct {
+	sync.Mutex
+	start  time.Time
+	peer   string
+	status int
+}
+
+type requestVarsKey struct{}
+
+// withRequestVars returns r with the state of its variables, r if it already has one
+func withRequestVars(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(requestVarsKey{}).(*requestVars); ok {
+		return r
+	}
+	rv := &requestVars{start: time.Now()}
+	return r.WithContext(context.WithValue(r.Context(), requestVarsKey{}, rv))
+}
+
+// setUpstreamVar records the peer serving r, for $upstream_addr
+func setUpstreamVar(r *http.Request, peer string) {
+	if rv, ok := r.Context().Value(requestVarsKey{}).(*requestVars); ok {
+		rv.Lock()
+		rv.peer = peer
+		rv.Unlock()
+	}
+}
+
+// setStatusVar records the status of the response to r, for $status
+func setStatusVar(r *http.Request, code int) {
+	if rv, ok := r.Context().Value(requestVarsKey{}).(*requestVars); ok {
+		rv.Lock()
+		rv.status = code
+		rv.Unlock()
+	}
+}
+
+// lookupVar returns the variable name of r, empty if unknown or not set yet
+func lookupVar(name string, r *http.Request) string {
+	switch {
+	case name == "$":
+		return "$"
+	case strings.HasPrefix(name, "header_"):
+		return r.Header.Get(strings.Replace(name[len("header_"):], "_", "-", -1))
+	case strings.HasPrefix(name, "cookie_"):
+		if c, err := r.Cookie(name[len("cookie_"):]); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	switch name {
+	case "remote_addr":
+		return r.RemoteAddr
+	case "remote_ip":
+		return clientIP(r.RemoteAddr)
+	case "host":
+		return r.Host
+	case "method":
+		return r.Method
+	case "uri":
+		return r.URL.RequestURI()
+	case "path":
+		return r.URL.Path
+	case "args":
+		return r.URL.RawQuery
+	case "scheme":
+		if r.TLS != nil {
+			return PROTO_HTTPS
+		}
+		return PROTO_HTTP
+	case "protocol":
+		return r.Proto
+	}
+
+	rv, ok := r.Context().Value(requestVarsKey{}).(*requestVars)
+	if !ok {
+		return ""
+	}
+	rv.Lock()
+	defer rv.Unlock()
+	switch name {
+	case "upstream_addr":
+		return rv.peer
+	case "status":
+		if rv.status == 0 {
+			return ""
+		}
+		return strconv.Itoa(rv.status)
+	case "request_time":
+		return fmt.Sprintf("%.3f", time.Since(rv.start).Seconds())
+	}
+	return ""
+}
+
+// expandVars replaces $name or ${name} in s by the variables of r, evaluated on use:
+// $remote_addr, $remote_ip, $host, $method, $uri, $path, $args, $scheme, $protocol,
+// $upstream_addr, $status, $request_time (seconds), $header_<name> with _ for -,
+// $cookie_<name>. $$ is a literal $, an unknown variable is empty
+func expandVars(s string, r *http.Request) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	return os.Expand(s, func(name string) string {
+		return lookupVar(name, r)
+	})
+}
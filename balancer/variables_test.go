@@ -0,0 +1,100 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestExpandVars(t *testing.T) {
+	req := httptest.NewRequest("GET", "/a/b?c=1", nil)
+	req.Host = "localhost"
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-User-Id", "u1")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+
+	assert.Equal(t, "plain", expandVars("plain", req))
+	assert.Equal(t, "10.0.0.1:1234 10.0.0.1 GET localhost /a/b?c=1 /a/b c=1 http",
+		expandVars("$remote_addr $remote_ip $method $host $uri $path $args $scheme", req))
+	assert.Equal(t, "u1/s1/", expandVars("${header_x_user_id}/$cookie_session/$cookie_none", req))
+	assert.Equal(t, "$5 ", expandVars("$$5 $unknown", req))
+	// not served yet
+	assert.Equal(t, "", expandVars("$upstream_addr$status$request_time", req))
+
+	req = withRequestVars(req)
+	assert.Equal(t, req, withRequestVars(req))
+	setUpstreamVar(req, "127.0.0.1:10001")
+	setStatusVar(req, 200)
+	assert.Equal(t, "127.0.0.1:10001 200", expandVars("$upstream_addr $status", req))
+	assert.Regexp(t, `^\d+\.\d{3}$`, expandVars("$request_time", req))
+}
+
+func TestVariables(t *testing.T) {
+	newPeer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Seen-Bucket", r.Header.Get("X-Bucket"))
+			w.Write([]byte(name))
+		}))
+	}
+	s1, s2, s3 := newPeer("s1"), newPeer("s2"), newPeer("s3")
+	defer s1.Close()
+	defer s2.Close()
+	defer s3.Close()
+
+	var lines []string
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:80"),
+		LBMethodOpt(LB_COSISTENTHASH),
+		PoolOpt([]config.Server{{Address: s1.URL[7:], Weight: 1}, {Address: s2.URL[7:], Weight: 1}}),
+		HashKeyOpt("$cookie_session"),
+		HeadersOpt(config.Headers{
+			Request:  config.HeaderRules{Set: map[string]string{"X-Bucket": "$cookie_bucket"}},
+			Response: config.HeaderRules{Set: map[string]string{"X-Served-By": "$upstream_addr"}},
+		}),
+		AccessLogOpt(config.AccessLog{Format: "$method $uri $status $upstream_addr"}),
+		RulesOpt([]config.Rule{{
+			Vars: map[string]string{"$cookie_beta": "1"},
+			Pool: []config.Server{{Address: s3.URL[7:], Weight: 1}},
+		}}),
+	)
+	require.NoError(t, err)
+	vs.accessSink = func(severity int, line string, fields map[string]string) error {
+		lines = append(lines, line)
+		return nil
+	}
+	assert.Equal(t, "$cookie_session", vs.EffectiveConfig().HashKey)
+
+	serve := func(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/x", nil)
+		req.Host = "localhost"
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		vs.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(&http.Cookie{Name: "session", Value: "abc"}, &http.Cookie{Name: "bucket", Value: "b7"})
+	require.Equal(t, http.StatusOK, w.Code)
+	first := w.Body.String()
+	assert.Equal(t, "b7", w.Header().Get("X-Seen-Bucket"))
+	peer := w.Header().Get("X-Served-By")
+	assert.Contains(t, []string{s1.URL[7:], s2.URL[7:]}, peer)
+	assert.Equal(t, []string{"GET /x 200 " + peer}, lines)
+	// the same session sticks to a peer
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, serve(&http.Cookie{Name: "session", Value: "abc"}).Body.String())
+	}
+
+	// routed by a variable
+	w = serve(&http.Cookie{Name: "beta", Value: "1"})
+	assert.Equal(t, "s3", w.Body.String())
+	assert.Equal(t, s3.URL[7:], w.Header().Get("X-Served-By"))
+}
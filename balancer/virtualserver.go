@@ -1,8 +1,11 @@
 package balancer
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -11,12 +14,17 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/onestraw/golb/chash"
 	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/dns"
+	"github.com/onestraw/golb/leasttime"
+	"github.com/onestraw/golb/p2c"
+	"github.com/onestraw/golb/random"
 	"github.com/onestraw/golb/retry"
 	"github.com/onestraw/golb/roundrobin"
 	"github.com/onestraw/golb/stats"
@@ -25,6 +33,10 @@ import (
 const (
 	LB_ROUNDROBIN    = "round-robin"
 	LB_COSISTENTHASH = "consistent-hash"
+	LB_LEASTTIME     = "least_time"
+	LB_P2C           = "p2c"
+	LB_RANDOM        = "random"
+	LB_IPHASH        = "ip_hash"
 	PROTO_HTTP       = "http"
 	PROTO_HTTPS      = "https"
 	PROTO_GRPC       = "grpc"
@@ -34,11 +46,15 @@ const (
 	DEFAULT_SERVERNAME  = "localhost"
 	DEFAULT_FAILTIMEOUT = 7
 	DEFAULT_MAXFAILS    = 2
+
+	// stats key of the requests not sent to any peer
+	LB_ERROR_PEER = "Load Balancer Error"
 )
 
 type Pooler interface {
 	String() string
 	Size() int
+	Peers() []string
 	Get(args ...interface{}) string
 	Add(addr string, args ...interface{})
 	Remove(addr string)
@@ -56,28 +72,209 @@ type VirtualServer struct {
 	KeyFile    string
 	LBMethod   string
 	Pool       Pooler
+	// service discovered to populate the pool
+	Service string
+	// applied before the rules
+	rewrites []*urlRewrite
+	// requests matching a rule are served by the pool of the rule
+	rules []*rule
+	// nil if the canary is not configured
+	canary *canary
+	// nil if the mirror is not configured
+	mirror *mirror
+	// nil if the headers are not rewritten
+	requestHeaders  *config.HeaderRules
+	responseHeaders *config.HeaderRules
+	// nil if the responses are not compressed
+	compressor *compressor
+	// nil if the responses are not cached
+	cache *cache
+	// nil if no latency SLA is set
+	sla *sla
+	// configuration the virtual server is created from, nil if created by options
+	conf *config.VirtualServer
 
 	// maximum fails before mark peer down
 	MaxFails int
 	fails    map[string]int
+	// outcomes counted by MaxFails, nil means DEFAULT_FAIL_ON
+	failOn *failurePolicy
+	// template of the key of the hashing methods, empty means the client address
+	hashKeyTemplate string
+	// TLS client settings of the connections to the peers, with the defaults applied
+	upstreamTLS config.UpstreamTLS
 
 	// timeout before retry a down peer
 	FailTimeout int64
 	timeout     map[string]int64
 
-	// used for fails/timeout
+	// injected faults
+	faults map[string]*Fault
+
+	// nil if outlier detection is disabled
+	outlier   *outlierDetection
+	ejections map[string]*Ejection
+	// nil if weight auto-tuning is disabled
+	autoWeight *autoWeight
+
+	// nil if only the pool members configuring a health check are probed
+	healthCheck *config.HealthCheck
+	// health check overrides of the pool members
+	peerChecks map[string]config.HealthCheck
+	// peers failing the health check
+	unhealthy map[string]bool
+	// false until healthCheck.MinHealthy peers pass a probe after Run, see warmingUp
+	warmedUp   bool
+	warmPassed map[string]bool
+	// peers drained by weight 0
+	drained map[string]bool
+	// peers in maintenance, and 1 if the virtual server is
+	maintained  map[string]bool
+	maintenance int32
+	// peers marked down, for the events
+	down map[string]bool
+	// peers seen failing by the other members of the cluster
+	clusterDown map[string]bool
+	// listener sockets with SO_REUSEPORT, 0 means one without
+	reusePort int
+	// socket options of the listener and the client connections
+	tcp config.TCP
+	// zero if the response bodies are not shaped
+	bandwidth      config.Bandwidth
+	bandwidthTotal *byteBucket
+	// pool members configured or added by AddServer, not the discovered ones, for the state file
+	members map[string]config.Server
+	// decommissions in progress or finished, by peer
+	decommissions map[string]*Decommission
+
+	// seconds a peer is continuously down before moved to tombstones, 0 means never
+	TombstoneAfter int64
+	downSince      map[string]int64
+	tombstones     map[string]*Tombstone
+
+	// used for fails/timeout/faults
 	pool_lock sync.RWMutex
 
 	retry bool
 
+	// window to ramp up the weight of new or recovered peers, round-robin only
+	slowStart time.Duration
+
 	ReverseProxy map[string]*httputil.ReverseProxy
 	rp_lock      sync.RWMutex
+	// peers not using plain http, guarded by rp_lock
+	schemes map[string]string
+	// transport used by reverse proxies, nil means http.DefaultTransport
+	transport http.RoundTripper
+	// nil means the host resolver
+	resolver *dns.Resolver
+	// address family and Happy Eyeballs delay of the peers configured by host name
+	dial config.Dial
+
+	// pool members configured by host name, only used if resolveInterval > 0
+	hostnames       map[string]*hostEntry
+	resolveInterval time.Duration
+	// pool members from SRV records, nil if not configured
+	srv *srvEntry
+
+	// CA bundle verifying the client certificates, https only
+	ClientCAFile  string
+	clientCAs     atomic.Value
+	clientCAWatch time.Duration
+	// guards the reload and clientCAMtime
+	ca_lock       sync.Mutex
+	clientCAMtime time.Time
+
+	// *accessLog, the filters of the access log lines
+	accessLog atomic.Value
+	// requests seen by the 1 in N sampling of the access log
+	accessLogCount uint64
+	// answered with the health of the peers, empty if not
+	healthzPath string
+	// nil writes the access log lines to the log
+	accessSink       accessSink
+	accessSinkConfig config.AccessLogSink
+
+	// closed on Stop to end the background loops
+	stopLoops chan struct{}
 
 	ServerStats map[string]*stats.Stats
 	ss_lock     sync.RWMutex
+	// client traffic by source network
+	ClientStats *stats.SubnetStats
+	// requests to the peers by second, and client requests in progress
+	requests       *stats.Rate
+	activeRequests int64
+
+	// range splitting, disabled if rangeChunkSize is 0
+	rangeChunkSize   int64
+	rangeConcurrency int
+
+	// nil if the connections are not limited
+	limiter *connLimiter
+
+	// tunes the least_time pool
+	leastTime config.LeastTime
+
+	// nil if the requests are not rate limited
+	rateLimiter *rateLimiter
+	rateLimit   config.RateLimit
+	// nil if the concurrent requests per client are unlimited
+	clientLimiter *clientLimiter
 
-	server *http.Server
-	status string
+	// nil if the slow log is disabled
+	slowLog       *log.Logger
+	slowThreshold time.Duration
+	serverTiming  bool
+	// X-Upstream-Addr and X-Upstream-Response-Time response headers
+	peerHeaders bool
+	// examine the requests, with the first inspectBody bytes of their body
+	inspectors  []Inspector
+	inspectBody int64
+	wafConf     config.WAF
+	// nil if the request bodies are neither limited nor buffered
+	requestBody *requestBody
+	// nil if the requests are not authenticated by JWT
+	jwt     *jwtAuth
+	jwtConf config.JWT
+	// nil if the clients are not authenticated by basic auth or API key
+	clientAuth     *clientAuth
+	clientAuthConf config.ClientAuth
+	// nil if the requests are not authorized by an external service
+	forwardAuth     *forwardAuth
+	forwardAuthConf config.ForwardAuth
+	// the balancer is unready if it can not serve
+	critical bool
+	// max age of the client connections, 0 disables it
+	connAge      time.Duration
+	connAgeGrace time.Duration
+	// requests with this X-Golb-Debug header are traced, empty disables it
+	debugToken string
+	// X-Golb-Upstream is used by the clients in upstreamACL
+	upstreamOverride  bool
+	upstreamAllowFrom []string
+	upstreamACL       []*net.IPNet
+	// bodies of the error responses by status code or PAGE_PEER_NOT_FOUND
+	errorPages     map[string]*errorPage
+	errorPagesConf map[string]config.ErrorPage
+	// registered by MiddlewareOpt, wrap the handler
+	middlewares []Middleware
+	// registered by EventHandlerOpt
+	events []*eventBus
+
+	// hedged requests, disabled if hedgePercentile is 0
+	hedgePercentile float64
+	hedgeDelay      time.Duration
+
+	// vs, or wrapped by retry
+	handler http.Handler
+	// certificate and client auth selected by SNI, https only
+	tlsConfig *tls.Config
+	// nil allows the Go defaults
+	tlsPolicy *tlsPolicy
+	// not guarded by the lock held by the requests, so the status is switched while they are served
+	status_lock sync.Mutex
+	status      string
 }
 
 type VirtualServerOption func(*VirtualServer) error
@@ -149,7 +346,7 @@ func LBMethodOpt(method string) VirtualServerOption {
 		if method == "" {
 			method = LB_ROUNDROBIN
 		}
-		if method != LB_ROUNDROBIN && method != LB_COSISTENTHASH {
+		if method != LB_ROUNDROBIN && method != LB_COSISTENTHASH && method != LB_LEASTTIME && method != LB_P2C && method != LB_RANDOM && method != LB_IPHASH {
 			return ErrNotSupportedMethod
 		}
 		vs.LBMethod = method
@@ -157,24 +354,134 @@ func LBMethodOpt(method string) VirtualServerOption {
 	}
 }
 
+// LeastTimeOpt tunes the least_time method, see leasttime.New
+func LeastTimeOpt(c config.LeastTime) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.leastTime = c
+		if p, ok := vs.Pool.(*leasttime.Pool); ok {
+			p.Configure(c.Connections, c.P2C)
+		}
+		return nil
+	}
+}
+
+// peerAddress validates the scheme and appends its default port if addr has none
+func peerAddress(addr, scheme string) (string, string, error) {
+	if scheme == "" {
+		scheme = PROTO_HTTP
+	}
+	port := ""
+	switch scheme {
+	case PROTO_HTTP:
+		port = "80"
+	case PROTO_HTTPS:
+		port = "443"
+	default:
+		return "", "", ErrNotSupportedProto
+	}
+	if addr == "" || isUnix(addr) {
+		return addr, scheme, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return addr, scheme, nil
+}
+
 func PoolOpt(peers []config.Server) VirtualServerOption {
 	return func(vs *VirtualServer) error {
+		servers := make([]config.Server, len(peers))
+		for i, peer := range peers {
+			addr, scheme, err := peerAddress(peer.Address, peer.Scheme)
+			if err != nil {
+				return err
+			}
+			if peer.Weight < 0 {
+				return ErrNegativeWeight
+			}
+			if peer.MaxFails < 0 || peer.FailTimeout < 0 {
+				return ErrNegativeMaxFails
+			}
+			if scheme != PROTO_HTTP {
+				vs.schemes[addr] = scheme
+			}
+			vs.addHostEntry(addr, scheme, peer.Weight)
+			if peer.HealthCheck != (config.HealthCheck{}) {
+				vs.peerChecks[addr] = peer.HealthCheck
+			}
+			servers[i] = config.Server{Address: addr, Weight: peer.Weight, Scheme: scheme, Backup: peer.Backup}
+			vs.members[addr] = config.Server{Address: addr, Weight: peer.Weight, Scheme: scheme,
+				Backup: peer.Backup, HealthCheck: peer.HealthCheck, MaxFails: peer.MaxFails,
+				FailTimeout: peer.FailTimeout}
+		}
+
 		method := vs.LBMethod
 		if method == LB_ROUNDROBIN {
 			pairs := make(map[string]int)
-			for _, peer := range peers {
-				pairs[peer.Address] = peer.Weight
+			for _, peer := range servers {
+				if !peer.Backup {
+					// drained below
+					pairs[peer.Address] = peer.Weight
+					if peer.Weight == 0 {
+						pairs[peer.Address] = 1
+					}
+				}
 			}
 			vs.Pool = roundrobin.CreatePool(pairs)
-		} else if method == LB_COSISTENTHASH {
-			addrs := make([]string, len(peers))
-			for i, peer := range peers {
-				addrs[i] = peer.Address
+		} else if method == LB_COSISTENTHASH || method == LB_IPHASH {
+			addrs := []string{}
+			for _, peer := range servers {
+				if !peer.Backup {
+					addrs = append(addrs, peer.Address)
+				}
 			}
 			vs.Pool = chash.CreatePool(addrs)
+		} else if method == LB_LEASTTIME {
+			pairs := make(map[string]int)
+			for _, peer := range servers {
+				if !peer.Backup {
+					pairs[peer.Address] = peer.Weight
+				}
+			}
+			vs.Pool = leasttime.CreatePool(pairs, vs.leastTime.Connections, vs.leastTime.P2C)
+		} else if method == LB_P2C {
+			pairs := make(map[string]int)
+			for _, peer := range servers {
+				if !peer.Backup {
+					pairs[peer.Address] = peer.Weight
+				}
+			}
+			vs.Pool = p2c.CreatePool(pairs)
+		} else if method == LB_RANDOM {
+			pairs := make(map[string]int)
+			for _, peer := range servers {
+				if !peer.Backup {
+					pairs[peer.Address] = peer.Weight
+				}
+			}
+			vs.Pool = random.CreatePool(pairs)
 		} else {
 			return ErrNotSupportedMethod
 		}
+		for _, peer := range servers {
+			if peer.Backup {
+				weight := peer.Weight
+				if weight == 0 {
+					weight = 1
+				}
+				vs.Pool.Add(peer.Address, weight, true)
+			}
+			if peer.Weight == 0 {
+				vs.drain(peer.Address)
+			}
+		}
+		return nil
+	}
+}
+
+func ServiceOpt(service string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.Service = service
 		return nil
 	}
 }
@@ -186,19 +493,59 @@ func RetryOpt(enable bool) VirtualServerOption {
 	}
 }
 
+// SlowStartOpt ramps the weight of the peers added or marked up at runtime from 1
+// to their full weight over d, it has no effect on consistent-hash, ip_hash, least_time, p2c and random pools
+func SlowStartOpt(d time.Duration) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if d < 0 {
+			d = 0
+		}
+		vs.slowStart = d
+		return nil
+	}
+}
+
+// ResolverOpt makes the reverse proxies resolve peer host names with r
+func ResolverOpt(r *dns.Resolver) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if r == nil {
+			return nil
+		}
+		vs.resolver = r
+		vs.setDialer()
+		return nil
+	}
+}
+
 func NewVirtualServer(opts ...VirtualServerOption) (*VirtualServer, error) {
 	vs := &VirtualServer{
-		Protocol:     PROTO_HTTP,
-		ServerName:   DEFAULT_SERVERNAME,
-		LBMethod:     LB_ROUNDROBIN,
-		MaxFails:     DEFAULT_MAXFAILS,
-		FailTimeout:  DEFAULT_FAILTIMEOUT,
-		retry:        false,
-		fails:        make(map[string]int),
-		timeout:      make(map[string]int64),
-		ReverseProxy: make(map[string]*httputil.ReverseProxy),
-		ServerStats:  make(map[string]*stats.Stats),
-		status:       STATUS_DISABLED,
+		Protocol:      PROTO_HTTP,
+		ServerName:    DEFAULT_SERVERNAME,
+		LBMethod:      LB_ROUNDROBIN,
+		MaxFails:      DEFAULT_MAXFAILS,
+		FailTimeout:   DEFAULT_FAILTIMEOUT,
+		retry:         false,
+		fails:         make(map[string]int),
+		timeout:       make(map[string]int64),
+		faults:        make(map[string]*Fault),
+		ejections:     make(map[string]*Ejection),
+		peerChecks:    make(map[string]config.HealthCheck),
+		unhealthy:     make(map[string]bool),
+		drained:       make(map[string]bool),
+		maintained:    make(map[string]bool),
+		down:          make(map[string]bool),
+		clusterDown:   make(map[string]bool),
+		members:       make(map[string]config.Server),
+		decommissions: make(map[string]*Decommission),
+		downSince:     make(map[string]int64),
+		tombstones:    make(map[string]*Tombstone),
+		ReverseProxy:  make(map[string]*httputil.ReverseProxy),
+		schemes:       make(map[string]string),
+		hostnames:     make(map[string]*hostEntry),
+		ServerStats:   make(map[string]*stats.Stats),
+		ClientStats:   stats.NewSubnetStats(),
+		requests:      stats.NewRate(),
+		status:        STATUS_DISABLED,
 	}
 	for _, opt := range opts {
 		if err := opt(vs); err != nil {
@@ -211,9 +558,53 @@ func NewVirtualServer(opts ...VirtualServerOption) (*VirtualServer, error) {
 	if vs.Address == "" {
 		return nil, AddressOpt("")(vs)
 	}
-	vs.server = &http.Server{Addr: vs.Address, Handler: vs}
+	if p, ok := vs.Pool.(*roundrobin.Pool); ok && vs.slowStart > 0 {
+		p.SetSlowStart(vs.slowStart)
+	}
+	vs.handler = vs
 	if vs.retry {
-		vs.server.Handler = retry.Retry(vs)
+		vs.handler = retry.Retry(vs)
+		if vs.rangeChunkSize > 0 {
+			vs.handler = vs.withRangeSplit(vs.handler)
+		}
+	}
+	vs.handler = vs.withActive(vs.handler)
+	if vs.bandwidth != (config.Bandwidth{}) {
+		vs.handler = vs.withBandwidth(vs.handler)
+	}
+	if vs.hasSLA() {
+		vs.handler = withStart(vs.handler)
+	}
+	if vs.debugToken != "" {
+		vs.handler = withTrace(vs.handler, vs.debugToken)
+	}
+	if vs.upstreamOverride {
+		vs.handler = withUpstream(vs.handler, vs.upstreamACL)
+	}
+	if len(vs.inspectors) > 0 {
+		vs.handler = vs.withInspect(vs.handler)
+	}
+	if vs.requestBody != nil {
+		vs.handler = vs.withRequestBody(vs.handler)
+	}
+	if vs.forwardAuth != nil {
+		vs.handler = vs.withForwardAuth(vs.handler)
+	}
+	if vs.jwt != nil {
+		vs.handler = vs.withJWT(vs.handler)
+	}
+	if vs.clientAuth != nil {
+		vs.handler = vs.withClientAuth(vs.handler)
+	}
+	if vs.clientLimiter != nil {
+		vs.handler = withClientLimit(vs.handler, vs.clientLimiter)
+	}
+	if vs.rateLimiter != nil {
+		vs.handler = withRateLimit(vs.handler, vs.rateLimiter)
+	}
+	vs.handler = chain(vs.handler, vs.middlewares)
+	if vs.healthzPath != "" {
+		vs.handler = vs.withHealthz(vs.handler)
 	}
 
 	return vs, nil
@@ -236,19 +627,117 @@ func (w *LBResponseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+func (w *LBResponseWriter) Flush() {
+	flush(w.ResponseWriter)
+}
+
+// Hijack hands the connection over, e.g. to the reverse proxy switching to a WebSocket
+// after the peer answered 101
+func (w *LBResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, brw, err := hijack(w.ResponseWriter)
+	if err == nil {
+		w.code = http.StatusSwitchingProtocols
+	}
+	return c, brw, err
+}
+
+// flush flushes w if it can, for the response writers wrapping another one
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// hijack hijacks the connection of w if it can, for the response writers wrapping another one
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// hashKey returns the key of r for the hashing methods, the client IP for ip_hash,
+// so a client sticks to a peer across its connections, or else the client address
+func (s *VirtualServer) hashKey(r *http.Request) string {
+	if s.hashKeyTemplate != "" {
+		if key := expandVars(s.hashKeyTemplate, r); key != "" {
+			return key
+		}
+	}
+	if s.LBMethod == LB_IPHASH {
+		return clientIP(r.RemoteAddr)
+	}
+	return r.RemoteAddr
+}
+
 // ServeHTTP dispatch the request between backend servers
 func (s *VirtualServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.InMaintenance() {
+		s.writeError(w, r, ErrMaintenance)
+		return
+	}
+	r = withRequestVars(r)
+	w = s.rewriteHeaders(w, r)
+	w, done := s.compress(w, r)
+	defer done()
+	if len(s.rewrites) > 0 {
+		var location string
+		var code int
+		if r, location, code = s.applyRewrites(r); code != 0 {
+			redirect(w, r, location, code)
+			return
+		}
+	}
+	w, r, hit, stored := s.serveCache(w, r)
+	if hit {
+		return
+	}
+	defer func() {
+		// the response aborted by a panic, e.g. http.ErrAbortHandler of a peer failing
+		// mid-body, is truncated
+		if p := recover(); p != nil {
+			panic(p)
+		}
+		stored()
+	}()
+	if s.mirror != nil {
+		r = s.mirror.shadow(r)
+	}
+	if ru := s.matchRule(r); ru != nil {
+		ru.vs.ServeHTTP(w, ru.rewrite(r))
+		return
+	}
+	if s.canary != nil && s.canary.pick(r) {
+		s.canary.vs.ServeHTTP(w, r)
+		return
+	}
+
 	timeBegin := time.Now()
 	rw := &LBResponseWriter{w, http.StatusOK, 0}
 	var peer string
+	// the response time of the peer, the latency in its stats
+	var upstream time.Duration
+	// also counts the new and reused connections
+	tm := &timing{start: timeBegin}
 	defer func() {
+		if peer != "" {
+			setUpstreamVar(r, peer)
+		}
+		setStatusVar(r, rw.code)
 		if peer == "" {
-			peer = "Load Balancer Error"
+			peer = LB_ERROR_PEER
 		}
-		s.StatsInc(peer, r, rw)
+		timeEnd := time.Now()
+		cost := timeEnd.Sub(timeBegin)
+		s.StatsInc(peer, r, rw, upstream)
+		s.connInc(peer, tm)
+		s.logSlow(r, peer, rw.code, tm, timeEnd)
+		s.traceTry(r, peer, rw.code)
 
-		cost := time.Now().Sub(timeBegin) / time.Millisecond
-		log.Infof("%s - %s %s%s %s %dms- %d", r.RemoteAddr, r.Method, r.Host, r.URL, r.Proto, cost, rw.code)
+		if !s.logSampled(rw.code, cost) {
+			return
+		}
+		s.logAccess(r, rw.code, cost)
 	}()
 
 	s.RLock()
@@ -256,87 +745,244 @@ func (s *VirtualServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if r.Host != s.ServerName {
 		log.Errorf("Host not match, host=%s", r.Host)
-		WriteError(rw, ErrHostNotMatch)
+		s.writeError(rw, r, ErrHostNotMatch)
 		return
 	}
 
+	if s.sla != nil {
+		var cancel context.CancelFunc
+		var ok bool
+		if r, cancel, ok = s.tryRequest(r); !ok {
+			log.Errorf("[%s] latency SLA %v missed before the try", s.Name, s.sla.latency)
+			s.writeError(rw, r, ErrGatewayTimeout)
+			return
+		}
+		defer cancel()
+	}
+
 	s.pool_lock.Lock()
 	now := time.Now().Unix()
 	for k, v := range s.timeout {
-		if s.fails[k] >= s.MaxFails && now-v >= s.FailTimeout {
+		if s.heldDown(k) {
+			continue
+		}
+		if s.failed(k) && now-v >= s.failTimeout(k) {
+			if since, ok := s.downSince[k]; ok && s.TombstoneAfter > 0 && now-since >= s.TombstoneAfter {
+				s.bury(k)
+				continue
+			}
 			log.Infof("Mark up peer: %s", k)
-			s.Pool.UpPeer(k)
+			s.upPeer(k, REASON_FAILS)
 			s.fails[k] = 0
 		}
 	}
 	s.pool_lock.Unlock()
 
-	// use client's address as hash key if using consistent-hash method
-	peer = s.Pool.Get(r.RemoteAddr)
+	forced := forcedUpstream(r)
+	if forced != "" && !s.hasPeer(forced) {
+		log.Errorf("[%s] forced upstream %s not in pool", s.Name, forced)
+		s.writeError(rw, r, ErrUpstreamNotInPool)
+		return
+	}
+	pick := func() string {
+		if forced != "" {
+			return forced
+		}
+		// use client's address as hash key if using consistent-hash or ip_hash method
+		return s.Pool.Get(s.hashKey(r))
+	}
+	if s.limiter != nil {
+		var err error
+		peer, err = s.limiter.acquire(r.Context(), pick, s.Pool.Size(), s.limiter.priorityOf(r))
+		if err != nil {
+			log.Errorf("[%s] no free connection slot, error=%v", s.Name, err)
+			rw.Header().Set("Retry-After", s.limiter.retryAfter())
+			s.writeError(rw, r, ErrServiceUnavailable)
+			return
+		}
+		if peer != "" {
+			acquired, chosen := time.Now(), peer
+			defer func() {
+				s.limiter.sample(time.Since(acquired), rw.code/100 == 5)
+				s.limiter.release(chosen)
+			}()
+		}
+	} else {
+		peer = pick()
+	}
 	if peer == "" {
 		log.Errorf("Get peer failed: %v", ErrPeerNotFound.ErrMsg)
-		WriteError(rw, ErrPeerNotFound)
+		s.writeError(rw, r, ErrPeerNotFound)
+		return
+	}
+	setUpstreamVar(r, peer)
+	active := s.peerStats(peer)
+	active.IncActive(1)
+	defer active.IncActive(-1)
+	if lt, ok := s.Pool.(*leasttime.Pool); ok {
+		// the hedged and range requests are not counted
+		chosen := peer
+		lt.Acquire(chosen)
+		defer func() {
+			lt.Release(chosen, time.Since(timeBegin), rw.code/100 == 5)
+		}()
+	}
+	if pc, ok := s.Pool.(*p2c.Pool); ok {
+		pc.Acquire(peer)
+		defer pc.Release(peer)
+	}
+
+	if s.rangeSplittable(r) {
+		upstreamStart := time.Now()
+		peer = s.splitRange(rw, r, peer)
+		upstream = time.Since(upstreamStart)
+		return
+	}
+
+	if s.hedgeable(r) {
+		peer, upstream = s.hedge(rw, r, peer)
+		return
+	}
+
+	rp, err := s.getProxy(peer)
+	if err != nil {
+		log.Errorf("url.Parse peer=%s, error=%v", peer, err)
+		s.writeError(rw, r, ErrInternalBalancer)
 		return
 	}
 
+	// an injected latency fault is part of the response time of the peer
+	upstreamStart := time.Now()
+	s.injectLatency(peer, r)
+	r, outcome := withProxyOutcome(r)
+	rp.ServeHTTP(s.withPeerHeaders(s.withServerTiming(rw, tm), peer), s.traceSlow(r, tm))
+	upstream = time.Since(upstreamStart)
+	s.addTransferTiming(rw, tm)
+
+	s.markOutcome(peer, rw.code, outcome.err)
+}
+
+// getProxy returns the reverse proxy of peer, creates one if not existed
+func (s *VirtualServer) getProxy(peer string) (*httputil.ReverseProxy, error) {
 	s.rp_lock.RLock()
 	rp, ok := s.ReverseProxy[peer]
+	scheme, hasScheme := s.schemes[peer]
 	s.rp_lock.RUnlock()
-	if !ok {
-		target, err := url.Parse("http://" + peer)
-		if err != nil {
-			log.Errorf("url.Parse peer=%s, error=%v", peer, err)
-			WriteError(rw, ErrInternalBalancer)
-			return
-		}
-		log.Infof("%v", target)
-		s.rp_lock.Lock()
-		// double check to avoid that the proxy is created while applying the lock
-		if rp, ok = s.ReverseProxy[peer]; !ok {
-			rp = httputil.NewSingleHostReverseProxy(target)
-			s.ReverseProxy[peer] = rp
-		}
-		s.rp_lock.Unlock()
+	if ok {
+		return rp, nil
 	}
 
-	rp.ServeHTTP(rw, r)
+	if !hasScheme {
+		scheme = PROTO_HTTP
+	}
+	target, err := url.Parse(scheme + "://" + peerHost(peer))
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("%v", target)
+	s.rp_lock.Lock()
+	// double check to avoid that the proxy is created while applying the lock
+	if rp, ok = s.ReverseProxy[peer]; !ok {
+		rp = httputil.NewSingleHostReverseProxy(target)
+		rp.ErrorHandler = s.proxyError
+		rp.Transport = s.roundTripper()
+		s.ReverseProxy[peer] = rp
+	}
+	s.rp_lock.Unlock()
+	return rp, nil
+}
 
-	if rw.code/100 == 5 {
-		s.pool_lock.Lock()
-		if _, ok := s.fails[peer]; !ok {
-			s.fails[peer] = 0
-		}
-		s.fails[peer] += 1
-		if s.fails[peer] >= s.MaxFails {
-			log.Infof("Mark down peer: %s", peer)
-			s.Pool.DownPeer(peer)
-			s.timeout[peer] = time.Now().Unix()
+// maxFails returns the MaxFails of peer, overridden by its pool member if set,
+// should be called with pool_lock held
+func (s *VirtualServer) maxFails(peer string) int {
+	if m := s.members[peer].MaxFails; m > 0 {
+		return m
+	}
+	return s.MaxFails
+}
+
+// failTimeout returns the FailTimeout of peer, overridden by its pool member if set,
+// should be called with pool_lock held
+func (s *VirtualServer) failTimeout(peer string) int64 {
+	if t := s.members[peer].FailTimeout; t > 0 {
+		return t
+	}
+	return s.FailTimeout
+}
+
+// failed returns true if peer reached its max fails, should be called with pool_lock held
+func (s *VirtualServer) failed(peer string) bool {
+	return s.fails[peer] >= s.maxFails(peer)
+}
+
+// markFail counts a failure of peer, and marks it down when reaching its max fails
+func (s *VirtualServer) markFail(peer string) {
+	s.pool_lock.Lock()
+	defer s.pool_lock.Unlock()
+
+	if _, ok := s.fails[peer]; !ok {
+		s.fails[peer] = 0
+	}
+	s.fails[peer] += 1
+	if s.failed(peer) {
+		log.Infof("Mark down peer: %s", peer)
+		s.downPeer(peer, REASON_FAILS)
+		s.timeout[peer] = time.Now().Unix()
+		if _, ok := s.downSince[peer]; !ok {
+			s.downSince[peer] = s.timeout[peer]
 		}
+	}
+}
+
+// markSuccess ends the continuous down period of peer
+func (s *VirtualServer) markSuccess(peer string) {
+	s.pool_lock.RLock()
+	_, ok := s.downSince[peer]
+	s.pool_lock.RUnlock()
+	if ok {
+		s.pool_lock.Lock()
+		delete(s.downSince, peer)
 		s.pool_lock.Unlock()
 	}
 }
 
-func (s *VirtualServer) StatsInc(addr string, r *http.Request, w *LBResponseWriter) {
+// peerStats returns the stats of addr, created if missing
+func (s *VirtualServer) peerStats(addr string) *stats.Stats {
 	s.ss_lock.RLock()
 	ss, ok := s.ServerStats[addr]
 	s.ss_lock.RUnlock()
-	if !ok {
-		s.ss_lock.Lock()
+	if ok {
+		return ss
+	}
+	s.ss_lock.Lock()
+	defer s.ss_lock.Unlock()
+	if ss, ok = s.ServerStats[addr]; !ok {
 		ss = stats.New()
 		s.ServerStats[addr] = ss
-		s.ss_lock.Unlock()
 	}
+	return ss
+}
+
+// StatsInc counts the response w to r in the stats of peer addr, latency is the response time of the peer
+func (s *VirtualServer) StatsInc(addr string, r *http.Request, w *LBResponseWriter, latency time.Duration) {
+	ss := s.peerStats(addr)
 	data := &stats.Data{
 		StatusCode: strconv.Itoa(w.code),
 		Method:     r.Method,
 		Path:       r.URL.Path,
 		InBytes:    uint64(r.ContentLength),
 		OutBytes:   uint64(w.bytes),
+		Latency:    latency,
 	}
 	ss.Inc(data)
+	s.requests.Inc(time.Now())
+	s.ClientStats.Inc(r.RemoteAddr, data.InBytes, data.OutBytes)
 }
 
 func (s *VirtualServer) Stats() string {
+	s.ss_lock.RLock()
+	defer s.ss_lock.RUnlock()
+
 	keys := []string{}
 	for key, _ := range s.ServerStats {
 		keys = append(keys, key)
@@ -346,83 +992,349 @@ func (s *VirtualServer) Stats() string {
 	result := []string{
 		fmt.Sprintf("Pool-%s", s.Name),
 	}
+	peers := make(map[string]*stats.Report, len(keys))
 	for _, peer := range keys {
 		ss := s.ServerStats[peer]
 		result = append(result, fmt.Sprintf("%s\n%s\n------", peer, ss))
+		peers[peer] = ss.Report()
 	}
+	result = append(result, fmt.Sprintf("Total\n%s\n------", s.aggregate(peers)))
 	return strings.Join(result, "\n")
 }
 
+// VirtualServerStats is the structured form of Stats()
+type VirtualServerStats struct {
+	Name    string                         `json:"name"`
+	Total   *AggregateStats                `json:"total"`
+	Peers   map[string]*stats.Report       `json:"peers"`
+	Clients map[string]stats.SubnetCounter `json:"clients,omitempty"`
+}
+
+func (s *VirtualServer) StatsReport() *VirtualServerStats {
+	s.ss_lock.RLock()
+	defer s.ss_lock.RUnlock()
+
+	result := &VirtualServerStats{
+		Name:  s.Name,
+		Peers: make(map[string]*stats.Report, len(s.ServerStats)),
+	}
+	for peer, ss := range s.ServerStats {
+		result.Peers[peer] = ss.Report()
+	}
+	result.Total = s.aggregate(result.Peers)
+	result.Clients = s.ClientStats.Report()
+	return result
+}
+
+// StatsDelta is like StatsReport but returns the increments since the last call
+func (s *VirtualServer) StatsDelta() *VirtualServerStats {
+	s.ss_lock.RLock()
+	defer s.ss_lock.RUnlock()
+
+	result := &VirtualServerStats{
+		Name:  s.Name,
+		Peers: make(map[string]*stats.Report, len(s.ServerStats)),
+	}
+	for peer, ss := range s.ServerStats {
+		result.Peers[peer] = ss.Delta()
+	}
+	result.Total = s.aggregate(result.Peers)
+	return result
+}
+
+// ResetStats clears the statistics of peer, or of all peers if peer is empty
+func (s *VirtualServer) ResetStats(peer string) error {
+	s.ss_lock.RLock()
+	defer s.ss_lock.RUnlock()
+
+	if peer == "" {
+		for _, ss := range s.ServerStats {
+			ss.Reset()
+		}
+		s.ClientStats.Reset()
+		s.requests.Reset()
+		return nil
+	}
+	ss, ok := s.ServerStats[peer]
+	if !ok {
+		return ErrPeerStatsNotFound
+	}
+	ss.Reset()
+	return nil
+}
+
 func (s *VirtualServer) AddPeer(addr string, args ...interface{}) {
+	added := !s.hasPeer(addr)
 	s.Pool.Add(addr, args...)
+	if added {
+		s.emit(EVENT_PEER_ADDED, addr, "")
+	}
+}
+
+// AddServer adds a pool member with its own scheme, and returns the normalized peer address
+func (s *VirtualServer) AddServer(server config.Server) (string, error) {
+	addr, scheme, err := peerAddress(server.Address, server.Scheme)
+	if err != nil {
+		return "", err
+	}
+	if server.Weight < 0 {
+		return "", ErrNegativeWeight
+	}
+	if server.MaxFails < 0 || server.FailTimeout < 0 {
+		return "", ErrNegativeMaxFails
+	}
+
+	s.rp_lock.Lock()
+	// drop the cached proxy if the scheme of an existing peer changed
+	if old, ok := s.schemes[addr]; (ok && old != scheme) || (!ok && scheme != PROTO_HTTP) {
+		delete(s.ReverseProxy, addr)
+	}
+	if scheme == PROTO_HTTP {
+		delete(s.schemes, addr)
+	} else {
+		s.schemes[addr] = scheme
+	}
+	s.rp_lock.Unlock()
+
+	s.pool_lock.Lock()
+	if server.HealthCheck != (config.HealthCheck{}) {
+		s.peerChecks[addr] = server.HealthCheck
+	} else {
+		delete(s.peerChecks, addr)
+	}
+	s.members[addr] = config.Server{Address: addr, Weight: server.Weight, Scheme: scheme,
+		Backup: server.Backup, HealthCheck: server.HealthCheck, MaxFails: server.MaxFails,
+		FailTimeout: server.FailTimeout}
+	s.pool_lock.Unlock()
+
+	s.setPeer(addr, server.Weight, server.Backup)
+	return addr, nil
+}
+
+// SyncPeers makes the peers previously added by a discovery source equal to desired,
+// both known and desired map address to weight, known is updated in place.
+// A peer whose weight changed is re-added, the other peers of the pool are untouched.
+func (s *VirtualServer) SyncPeers(source string, known, desired map[string]int) {
+	for addr, weight := range known {
+		if w, ok := desired[addr]; !ok || w != weight {
+			log.Infof("[%s] %s remove peer %s", s.Name, source, addr)
+			s.RemovePeer(addr)
+			delete(known, addr)
+		}
+	}
+	for addr, weight := range desired {
+		if _, ok := known[addr]; !ok {
+			log.Infof("[%s] %s add peer %s, weight %d", s.Name, source, addr, weight)
+			s.setPeer(addr, weight, false)
+			known[addr] = weight
+		}
+	}
 }
 
 func (s *VirtualServer) RemovePeer(addr string) {
+	s.ClearFault(addr)
+
 	s.pool_lock.Lock()
 	delete(s.fails, addr)
 	delete(s.timeout, addr)
+	delete(s.downSince, addr)
+	delete(s.tombstones, addr)
+	delete(s.ejections, addr)
+	delete(s.peerChecks, addr)
+	delete(s.unhealthy, addr)
+	delete(s.drained, addr)
+	delete(s.maintained, addr)
+	delete(s.down, addr)
+	delete(s.clusterDown, addr)
+	delete(s.members, addr)
 	s.pool_lock.Unlock()
 
 	s.rp_lock.Lock()
 	delete(s.ReverseProxy, addr)
+	delete(s.schemes, addr)
 	s.rp_lock.Unlock()
 
 	s.ss_lock.Lock()
 	delete(s.ServerStats, addr)
 	s.ss_lock.Unlock()
 
+	removed := s.hasPeer(addr)
 	s.Pool.Remove(addr)
+	if removed {
+		s.emit(EVENT_PEER_REMOVED, addr, "")
+	}
+}
+
+// heldDown returns true if peer is kept down by an injected fault, an ejection,
+// a failed health check, a decommission, a maintenance, the cluster or a drain, pool_lock should be held
+func (s *VirtualServer) heldDown(peer string) bool {
+	if f, ok := s.faults[peer]; ok && f.Down {
+		return true
+	}
+	if _, ok := s.ejections[peer]; ok {
+		return true
+	}
+	if s.unhealthy[peer] {
+		return true
+	}
+	if d, ok := s.decommissions[peer]; ok && d.active() {
+		return true
+	}
+	if s.maintained[peer] {
+		return true
+	}
+	if s.clusterDown[peer] {
+		return true
+	}
+	return s.drained[peer]
 }
 
 func (s *VirtualServer) statusSwitch(status string) {
-	s.Lock()
-	defer s.Unlock()
+	s.status_lock.Lock()
+	changed := s.status != status
 	s.status = status
+	s.status_lock.Unlock()
+	if !changed {
+		return
+	}
+	if status == STATUS_ENABLED {
+		s.emit(EVENT_VS_STARTED, "", "")
+	} else {
+		s.emit(EVENT_VS_STOPPED, "", "")
+	}
 }
 
 func (s *VirtualServer) Status() string {
-	s.RLock()
-	defer s.RUnlock()
+	s.status_lock.Lock()
+	defer s.status_lock.Unlock()
 	return s.status
 }
 
-func (s *VirtualServer) ListenAndServe() error {
-	switch s.Protocol {
-	case PROTO_HTTP:
-		return s.server.ListenAndServe()
-	case PROTO_HTTPS:
-		return s.server.ListenAndServeTLS(s.CertFile, s.KeyFile)
+func (s *VirtualServer) serverTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		NextProtos: DEFAULT_ALPN,
+	}
+	if err := s.tlsPolicy.apply(cfg, cert); err != nil {
+		return nil, err
+	}
+	if cfg.GetCertificate == nil {
+		cfg.Certificates = []tls.Certificate{cert}
 	}
-	return ErrNotSupportedProto
+	if s.ClientCAFile != "" {
+		// verified against the current bundle, see verifyClientCert
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = s.verifyClientCert
+	}
+	return cfg, nil
 }
 
 func (s *VirtualServer) Run() error {
 	if s.Status() == STATUS_ENABLED {
 		return fmt.Errorf("%s is already enabled", s.Name)
 	}
+	if err := listen(s); err != nil {
+		return err
+	}
+
+	s.resetWarmup()
+	s.stopLoops = make(chan struct{})
+	s.startLoops(s.stopLoops)
+
+	log.Infof("Starting [%s], listen %s, server name %s, proto %s, method %s, pool %v",
+		s.Name, s.Address, s.ServerName, s.Protocol, s.LBMethod, s.Pool)
+	s.statusSwitch(STATUS_ENABLED)
+
+	return nil
+}
+
+// startLoops starts the background loops of s and its rules, they end when stop is closed
+func (s *VirtualServer) startLoops(stop chan struct{}) {
+	if s.resolveInterval > 0 && len(s.hostnames) > 0 {
+		s.resolve()
+		go s.resolveLoop(stop)
+	}
+	if s.srv != nil {
+		s.resolveSRV()
+		go s.srvLoop(stop)
+	}
+	if s.outlier != nil {
+		go s.outlierLoop(stop)
+	}
+	if s.autoWeight != nil {
+		go s.autoWeightLoop(stop)
+	}
+	if s.hasHealthCheck() {
+		go s.healthLoop(stop)
+	}
+	if s.ClientCAFile != "" && s.clientCAWatch > 0 {
+		go s.clientCALoop(stop)
+	}
+	if s.Protocol == PROTO_HTTPS && s.tlsPolicy != nil && s.tlsPolicy.conf.OCSPFile != "" {
+		go s.ocspLoop(stop)
+	}
+	for _, ru := range s.rules {
+		ru.vs.startLoops(stop)
+	}
+	if s.canary != nil {
+		s.canary.vs.startLoops(stop)
+	}
+	if s.mirror != nil {
+		s.mirror.vs.startLoops(stop)
+	}
+}
 
-	log.Infof("Starting [%s], listen %s, proto %s, method %s, pool %v",
-		s.Name, s.Address, s.Protocol, s.LBMethod, s.Pool)
+// RunContext runs s like Run, bounded by ctx: if ctx is done first, ctx.Err() is returned,
+// and s is stopped once its startup, e.g. the first resolution of its peers, is over
+func (s *VirtualServer) RunContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
 	go func() {
-		s.statusSwitch(STATUS_ENABLED)
-		err := s.ListenAndServe()
-		if err != nil {
-			log.Errorf("%s ListenAndServe error=%v", s.Name, err)
-		}
+		done <- s.Run()
 	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		go func() {
+			if err := <-done; err == nil {
+				s.Stop()
+			}
+		}()
+		return ctx.Err()
+	}
+}
 
+// Stop stops s and waits for the active connections of its listener, see Shutdown
+func (s *VirtualServer) Stop() error {
+	if s.Status() == STATUS_DISABLED {
+		return fmt.Errorf("%s is already disabled", s.Name)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		return fmt.Errorf("%s Shutdown error=%v", s.Name, err)
+	}
 	return nil
 }
 
-func (s *VirtualServer) Stop() error {
+// Shutdown stops s, and waits for the active connections of its listener to end until ctx is done,
+// like http.Server.Shutdown: s is stopped and its listener closed in any case, and ctx.Err() is returned
+// if the connections are still active. A listener shared with another running virtual server is kept open
+func (s *VirtualServer) Shutdown(ctx context.Context) error {
 	if s.Status() == STATUS_DISABLED {
 		return fmt.Errorf("%s is already disabled", s.Name)
 	}
 
 	log.Infof("Stopping [%s]", s.Name)
-	if err := s.server.Shutdown(context.Background()); err != nil {
-		return fmt.Errorf("%s Shutdown error=%v", s.Name, err)
+	if s.stopLoops != nil {
+		close(s.stopLoops)
+		s.stopLoops = nil
 	}
+	err := unlisten(ctx, s)
 	s.statusSwitch(STATUS_DISABLED)
-	return nil
+	return err
 }
@@ -1,18 +1,29 @@
 package balancer
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/p2c"
 )
 
 var (
@@ -60,8 +71,10 @@ func TestVirtualServer(t *testing.T) {
 	assert.Equal(t, 5, result["s2"])
 
 	// test stats
-	expectStats := fmt.Sprintf("Pool-web\n%s\nstatus_code: 200:5\nmethod: GET:5\npath: /:5\nrecv_bytes: 0\nsend_bytes: 10\n------\n%s\nstatus_code: 200:5\nmethod: GET:5\npath: /:5\nrecv_bytes: 0\nsend_bytes: 10\n------", S1, S2)
-	assert.Equal(t, expectStats, vs.Stats())
+	latency := `latency: p50:\d+ms, p90:\d+ms, p99:\d+ms\nconns: new:\d+, reused:\d+`
+	expectStats := fmt.Sprintf("^Pool-web\n%s\nstatus_code: 200:5\nmethod: GET:5\npath: /:5\nrecv_bytes: 0\nsend_bytes: 10\n%s\n------\n%s\nstatus_code: 200:5\nmethod: GET:5\npath: /:5\nrecv_bytes: 0\nsend_bytes: 10\n%s\n------\nTotal\nrequests: 10, qps: [\\d.]+, errors: 0 \\(0\\.00%%\\), recv_bytes: 0, send_bytes: 20, active_requests: 0, active_conns: \\d+\n------$",
+		regexp.QuoteMeta(S1), latency, regexp.QuoteMeta(S2), latency)
+	assert.Regexp(t, expectStats, vs.Stats())
 
 	// test pool
 	assert.Equal(t, 2, vs.Pool.Size())
@@ -153,6 +166,69 @@ func TestVirtualServerError(t *testing.T) {
 	assert.Equal(t, STATUS_DISABLED, vs.Status())
 }
 
+func TestPeerAddress(t *testing.T) {
+	tests := []struct {
+		addr, scheme       string
+		expAddr, expScheme string
+	}{
+		{"127.0.0.1:8000", "", "127.0.0.1:8000", PROTO_HTTP},
+		{"127.0.0.1", "", "127.0.0.1:80", PROTO_HTTP},
+		{"127.0.0.1", "https", "127.0.0.1:443", PROTO_HTTPS},
+		{"[::1]", "https", "[::1]:443", PROTO_HTTPS},
+		{"example.com:8443", "https", "example.com:8443", PROTO_HTTPS},
+	}
+	for _, tt := range tests {
+		addr, scheme, err := peerAddress(tt.addr, tt.scheme)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expAddr, addr)
+		assert.Equal(t, tt.expScheme, scheme)
+	}
+
+	_, _, err := peerAddress("127.0.0.1", "ftp")
+	assert.Equal(t, ErrNotSupportedProto, err)
+}
+
+func TestMixedSchemePool(t *testing.T) {
+	s1 := httptest.NewServer(newHandler("plain"))
+	s2 := httptest.NewTLSServer(newHandler("tls"))
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8086"),
+		PoolOpt([]config.Server{
+			{Address: s1.URL[7:], Weight: 1},
+			{Address: s2.URL[8:], Weight: 1, Scheme: PROTO_HTTPS},
+		}),
+	)
+	require.NoError(t, err)
+	// trust the self-signed certificate of the test server
+	vs.transport = s2.Client().Transport
+
+	require.NoError(t, vs.Run())
+	time.Sleep(time.Second)
+
+	result := map[string]int{}
+	for i := 0; i < 4; i += 1 {
+		resp, err := request("127.0.0.1:8086")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		result[resp.Body] += 1
+	}
+	assert.Equal(t, 2, result["plain"])
+	assert.Equal(t, 2, result["tls"])
+
+	// switch the peer back to http
+	addr, err := vs.AddServer(config.Server{Address: s2.URL[8:], Weight: 1})
+	require.NoError(t, err)
+	assert.Equal(t, s2.URL[8:], addr)
+	_, ok := vs.ReverseProxy[addr]
+	assert.False(t, ok)
+
+	_, err = vs.AddServer(config.Server{Address: "127.0.0.1", Scheme: "ftp"})
+	assert.Equal(t, ErrNotSupportedProto, err)
+
+	require.NoError(t, vs.Stop())
+}
+
 func TestOpt(t *testing.T) {
 	vs, err := NewVirtualServer()
 	assert.Nil(t, vs)
@@ -211,3 +287,563 @@ func TestOpt(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, true, vs.retry)
 }
+
+func TestTombstone(t *testing.T) {
+	peer := "127.0.0.1:12346"
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+		TombstoneOpt(1),
+	)
+	require.NoError(t, err)
+	vs.FailTimeout = 0
+
+	serve := func() int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		rr := httptest.NewRecorder()
+		vs.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	for i := 0; i < DEFAULT_MAXFAILS; i++ {
+		assert.Equal(t, http.StatusBadGateway, serve())
+	}
+	assert.Equal(t, 0, len(vs.Tombstones()))
+
+	time.Sleep(time.Second)
+	assert.Equal(t, ErrPeerNotFound.StatusCode, serve())
+	assert.Equal(t, 0, vs.Pool.Size())
+	tombstones := vs.Tombstones()
+	require.Equal(t, 1, len(tombstones))
+	assert.Equal(t, peer, tombstones[0].Peer)
+
+	assert.Equal(t, ErrTombstoneNotFound, vs.Resurrect("127.0.0.1:1", 1))
+	require.NoError(t, vs.Resurrect(peer, 0))
+	assert.Equal(t, 1, vs.Pool.Size())
+	assert.Equal(t, 0, len(vs.Tombstones()))
+}
+
+func TestResolve(t *testing.T) {
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{
+			{Address: "localhost:10001", Weight: 2},
+			{Address: "127.0.0.1:10002", Weight: 1},
+			{Address: "secure.example.com", Weight: 1, Scheme: PROTO_HTTPS},
+		}),
+		ResolveOpt(time.Second),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(vs.hostnames))
+
+	vs.resolve()
+	peers := vs.Pool.String()
+	assert.Contains(t, peers, "127.0.0.1:10001")
+	assert.Contains(t, peers, "127.0.0.1:10002")
+	assert.Contains(t, peers, "secure.example.com:443")
+	assert.NotContains(t, peers, "localhost")
+	assert.Equal(t, 2, vs.hostnames["localhost:10001"].known["127.0.0.1:10001"])
+
+	// resolving again changes nothing
+	vs.resolve()
+	assert.Equal(t, peers, vs.Pool.String())
+}
+
+func TestResolveSRV(t *testing.T) {
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: "127.0.0.1:10001", Weight: 1}}),
+		SRVOpt("http", "", "web.service.consul", 0),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "_http._tcp.web.service.consul", vs.srv.String())
+	assert.Equal(t, DEFAULT_SRV_INTERVAL, vs.srv.interval)
+
+	records := []*net.SRV{
+		{Target: "node1.consul.", Port: 8080, Priority: 1, Weight: 3},
+		{Target: "node2.consul.", Port: 8081, Priority: 1, Weight: 0},
+		{Target: "backup.consul.", Port: 8080, Priority: 2, Weight: 1},
+	}
+	vs.srv.lookup = func(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+		return records, nil
+	}
+	vs.resolveSRV()
+	assert.Equal(t, map[string]int{"node1.consul:8080": 3, "node2.consul:8081": 1}, vs.srv.known)
+	assert.Equal(t, 3, vs.Pool.Size())
+
+	records = records[1:]
+	vs.resolveSRV()
+	assert.Equal(t, map[string]int{"node2.consul:8081": 1}, vs.srv.known)
+	assert.Equal(t, "127.0.0.1:10001, node2.consul:8081", vs.Pool.String())
+
+	// the peers are kept if the lookup fails
+	vs.srv.lookup = func(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+		return nil, fmt.Errorf("no such host")
+	}
+	vs.resolveSRV()
+	assert.Equal(t, 2, vs.Pool.Size())
+}
+
+func TestSlowStart(t *testing.T) {
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: "127.0.0.1:10001", Weight: 5}}),
+		SlowStartOpt(time.Hour),
+	)
+	require.NoError(t, err)
+	vs.AddPeer("127.0.0.1:10002", 5)
+
+	result := map[string]int{}
+	for i := 0; i < 12; i++ {
+		result[vs.Pool.Get()] += 1
+	}
+	assert.Equal(t, 10, result["127.0.0.1:10001"])
+	assert.Equal(t, 2, result["127.0.0.1:10002"])
+}
+
+func TestBackupPeer(t *testing.T) {
+	for _, method := range []string{LB_ROUNDROBIN, LB_COSISTENTHASH, LB_LEASTTIME, LB_P2C, LB_RANDOM, LB_IPHASH} {
+		vs, err := NewVirtualServer(
+			NameOpt("web"),
+			AddressOpt(":80"),
+			LBMethodOpt(method),
+			PoolOpt([]config.Server{
+				{Address: "127.0.0.1:10001", Weight: 1},
+				{Address: "127.0.0.1:10002", Weight: 1, Backup: true},
+			}),
+		)
+		require.NoError(t, err)
+		addr, err := vs.AddServer(config.Server{Address: "127.0.0.1:10003", Weight: 1, Backup: true})
+		require.NoError(t, err)
+		assert.Equal(t, "127.0.0.1:10003", addr)
+		assert.Equal(t, "127.0.0.1:10001, 127.0.0.1:10002 (backup), 127.0.0.1:10003 (backup)", vs.Pool.String())
+
+		assert.Equal(t, "127.0.0.1:10001", vs.Pool.Get("10.0.0.1:5000"))
+		vs.Pool.DownPeer("127.0.0.1:10001")
+		assert.Contains(t, vs.Pool.Get("10.0.0.1:5000"), "127.0.0.1:1000")
+		assert.NotEqual(t, "127.0.0.1:10001", vs.Pool.Get("10.0.0.1:5000"))
+	}
+}
+
+func TestIPHash(t *testing.T) {
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		LBMethodOpt(LB_IPHASH),
+		PoolOpt([]config.Server{
+			{Address: "127.0.0.1:10001", Weight: 1},
+			{Address: "127.0.0.1:10002", Weight: 1},
+			{Address: "127.0.0.1:10003", Weight: 1},
+		}),
+	)
+	require.NoError(t, err)
+
+	get := func(remoteAddr string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		return vs.Pool.Get(vs.hashKey(r))
+	}
+	// the port of the client is not hashed
+	peer := get("10.0.0.1:5000")
+	for port := 5001; port < 5010; port++ {
+		assert.Equal(t, peer, get(fmt.Sprintf("10.0.0.1:%d", port)))
+	}
+
+	others := map[string]string{}
+	for i := 2; i < 50; i++ {
+		ip := fmt.Sprintf("10.0.0.%d:5000", i)
+		others[ip] = get(ip)
+	}
+	vs.Pool.DownPeer(peer)
+	assert.NotEqual(t, peer, get("10.0.0.1:5000"))
+	for ip, p := range others {
+		if p != peer {
+			assert.Equal(t, p, get(ip))
+		}
+	}
+}
+
+func TestLeastTime(t *testing.T) {
+	fast := httptest.NewServer(newHandler("fast"))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		LBMethodOpt(LB_LEASTTIME),
+		PoolOpt([]config.Server{{Address: fast.URL[7:], Weight: 1}, {Address: slow.URL[7:], Weight: 1}}),
+		LeastTimeOpt(config.LeastTime{Connections: true}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, config.LeastTime{Connections: true}, vs.EffectiveConfig().LeastTime)
+
+	count := map[string]int{}
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		rr := httptest.NewRecorder()
+		vs.ServeHTTP(rr, req)
+		count[rr.Body.String()]++
+	}
+	// the slow peer is tried once at most, until its response time decays
+	assert.True(t, count["slow"] <= 1, "%v", count)
+	assert.True(t, count["fast"] >= 19, "%v", count)
+}
+
+func TestP2C(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("busy"))
+	}))
+	defer busy.Close()
+	idle := httptest.NewServer(newHandler("idle"))
+	defer idle.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		LBMethodOpt(LB_P2C),
+		PoolOpt([]config.Server{{Address: busy.URL[7:], Weight: 1}, {Address: idle.URL[7:], Weight: 1}}),
+	)
+	require.NoError(t, err)
+	vs.Pool.DownPeer(idle.URL[7:])
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("GET", "/slow", nil)
+		req.Host = "localhost"
+		vs.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+	vs.Pool.UpPeer(idle.URL[7:])
+
+	// the busy peer has a request in flight
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "localhost"
+		rr := httptest.NewRecorder()
+		vs.ServeHTTP(rr, req)
+		assert.Equal(t, "idle", rr.Body.String())
+	}
+	close(release)
+	<-done
+	assert.Equal(t, 0, vs.Pool.(*p2c.Pool).Active(busy.URL[7:]))
+}
+
+func TestSlowLog(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer slow.Close()
+
+	f, err := ioutil.TempFile("", "slow.log")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: slow.URL[7:], Weight: 1}}),
+		SlowLogOpt(50*time.Millisecond, f.Name()),
+	)
+	require.NoError(t, err)
+
+	for _, path := range []string{"/fast", "/slow"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "localhost"
+		rr := httptest.NewRecorder()
+		vs.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], "url=localhost/slow")
+	assert.Regexp(t, `ttfb_ms=(9\d|1\d\d) `, lines[0])
+	assert.Contains(t, lines[0], "peer=\""+slow.URL[7:]+"\"")
+}
+
+func TestServerTiming(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		// larger than the server buffer, so the response is chunked and has trailers
+		w.Write(bytes.Repeat([]byte("a"), 8192))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("b"))
+	}))
+	defer peer.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		ServerNameOpt("127.0.0.1"),
+		PoolOpt([]config.Server{{Address: peer.URL[7:], Weight: 1}}),
+		ServerTimingOpt(true),
+	)
+	require.NoError(t, err)
+	lb := httptest.NewServer(vs)
+	defer lb.Close()
+
+	req, err := http.NewRequest("GET", lb.URL, nil)
+	require.NoError(t, err)
+	req.Host = "127.0.0.1"
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, 8193, len(body))
+
+	assert.Regexp(t, `^lb-select;dur=\d+\.\d, connect;dur=\d+\.\d, upstream-ttfb;dur=(19|[2-9]\d)\.\d$`, resp.Header.Get("Server-Timing"))
+	assert.Regexp(t, `^transfer;dur=\d+\.\d$`, resp.Trailer.Get("Server-Timing"))
+}
+
+func TestFlush(t *testing.T) {
+	release := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("first,"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("last"))
+	}))
+	defer peer.Close()
+
+	// the response writers wrapped by the options pass the flushes through
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		ServerNameOpt("127.0.0.1"),
+		PoolOpt([]config.Server{{Address: peer.URL[7:], Weight: 1}}),
+		RetryOpt(false),
+		PeerHeadersOpt(true),
+		ServerTimingOpt(true),
+		CompressionOpt(config.Compression{Enable: true, MinSize: 1}),
+		BandwidthOpt(config.Bandwidth{PerConnection: 1 << 20}),
+	)
+	require.NoError(t, err)
+	lb := httptest.NewServer(vs.handler)
+	defer lb.Close()
+
+	for _, encoding := range []string{"", "gzip", "br"} {
+		req, err := http.NewRequest("GET", lb.URL, nil)
+		require.NoError(t, err)
+		req.Host = "127.0.0.1"
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, encoding, resp.Header.Get("Content-Encoding"))
+		var body io.Reader = resp.Body
+		switch encoding {
+		case "gzip":
+			body, err = gzip.NewReader(resp.Body)
+			require.NoError(t, err)
+		case "br":
+			body = brotli.NewReader(resp.Body)
+		}
+		// the start of the response arrives before the peer has finished
+		first := make([]byte, len("first,"))
+		_, err = io.ReadFull(body, first)
+		require.NoError(t, err, encoding)
+		assert.Equal(t, "first,", string(first))
+		release <- struct{}{}
+		rest, _ := ioutil.ReadAll(body)
+		resp.Body.Close()
+		assert.Equal(t, "last", string(rest))
+	}
+}
+
+func TestPeerLatency(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer peer.Close()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: peer.URL[7:], Weight: 1}}),
+		LimitOpt(0, 1, 1, time.Second),
+	)
+	require.NoError(t, err)
+
+	// the request waits in the queue first
+	require.True(t, vs.limiter.tryAcquirePeer(peer.URL[7:]))
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		vs.limiter.release(peer.URL[7:])
+	}()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	rr := httptest.NewRecorder()
+	vs.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// the latency of the peer is its response time, not the queueing
+	latency, ok := vs.peerStats(peer.URL[7:]).LatencyQuantile(1)
+	require.True(t, ok)
+	assert.True(t, latency < 200*time.Millisecond, "latency %v", latency)
+}
+
+func TestVirtualHost(t *testing.T) {
+	s1 := httptest.NewServer(newHandler("a"))
+	s2 := httptest.NewServer(newHandler("b"))
+	newVS := func(name, serverName, peer string) *VirtualServer {
+		vs, err := NewVirtualServer(
+			NameOpt(name),
+			AddressOpt("127.0.0.1:8093"),
+			ServerNameOpt(serverName),
+			PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+		)
+		require.NoError(t, err)
+		return vs
+	}
+	vsA := newVS("a", "a.example.com", s1.URL[7:])
+	vsB := newVS("b", "b.example.com", s2.URL[7:])
+	require.NoError(t, vsA.Run())
+	require.NoError(t, vsB.Run())
+	time.Sleep(time.Second)
+
+	get := func(host string) (int, string) {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:8093/", nil)
+		require.NoError(t, err)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	code, body := get("a.example.com")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "a", body)
+	code, body = get("b.example.com")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "b", body)
+	code, _ = get("c.example.com")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// the server name is used on the address
+	dup := newVS("dup", "a.example.com", s2.URL[7:])
+	assert.NotNil(t, dup.Run())
+	vs, err := NewVirtualServer(NameOpt("tls"), AddressOpt("127.0.0.1:8093"), ProtocolOpt(PROTO_HTTPS),
+		TLSOpt("../examples/https/server.pem", "../examples/https/server.key"))
+	require.NoError(t, err)
+	assert.NotNil(t, vs.Run())
+
+	// the listener is kept until the last one stops
+	require.NoError(t, vsA.Stop())
+	code, _ = get("a.example.com")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = get("b.example.com")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "b", body)
+	require.NoError(t, vsB.Stop())
+	_, err = http.Get("http://127.0.0.1:8093/")
+	assert.NotNil(t, err)
+
+	// restart on the released address
+	require.NoError(t, vsA.Run())
+	time.Sleep(100 * time.Millisecond)
+	code, body = get("a.example.com")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "a", body)
+	require.NoError(t, vsA.Stop())
+}
+
+func TestVirtualHostSNI(t *testing.T) {
+	newVS := func(name, serverName string) *VirtualServer {
+		vs, err := NewVirtualServer(
+			NameOpt(name),
+			AddressOpt("127.0.0.1:8094"),
+			ServerNameOpt(serverName),
+			ProtocolOpt(PROTO_HTTPS),
+			TLSOpt("../examples/https/server.pem", "../examples/https/server.key"),
+		)
+		require.NoError(t, err)
+		return vs
+	}
+	vsA := newVS("a", "a.example.com")
+	vsB := newVS("b", "b.example.com")
+	require.NoError(t, vsA.Run())
+	require.NoError(t, vsB.Run())
+	defer vsA.Stop()
+	defer vsB.Stop()
+
+	l := listeners["127.0.0.1:8094"]
+	require.NotNil(t, l)
+	cfg, err := l.getConfigForClient(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+	require.NoError(t, err)
+	assert.True(t, cfg == vsB.tlsConfig)
+	cfg, err = l.getConfigForClient(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	require.NoError(t, err)
+	assert.True(t, cfg == vsA.tlsConfig)
+	// unknown SNI falls back to the certificate of the first one
+	cfg, err = l.getConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Nil(t, cfg)
+	cert, err := l.getCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, vsA.tlsConfig.Certificates[0].Certificate, cert.Certificate)
+}
+
+func TestRunContextShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt("127.0.0.1:8119"),
+		PoolOpt([]config.Server{{Address: slow.URL[7:], Weight: 1}}),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, vs.RunContext(ctx))
+	assert.Equal(t, STATUS_DISABLED, vs.Status())
+
+	require.NoError(t, vs.RunContext(context.Background()))
+	go request("127.0.0.1:8119")
+	<-started
+
+	// the request is still active
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, vs.Shutdown(ctx))
+	assert.Equal(t, STATUS_DISABLED, vs.Status())
+	_, err = request("127.0.0.1:8119")
+	assert.Error(t, err)
+	assert.Error(t, vs.Shutdown(context.Background()))
+}
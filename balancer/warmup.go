@@ -0,0 +1,55 @@
+package balancer
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minHealthy returns the peers to pass a probe before s is ready after it starts,
+// at most the size of the pool, 0 if there is no startup gate
+func (s *VirtualServer) minHealthy() int {
+	if s.healthCheck == nil || s.healthCheck.MinHealthy <= 0 {
+		return 0
+	}
+	if n := len(s.Pool.Peers()); n < s.healthCheck.MinHealthy {
+		return n
+	}
+	return s.healthCheck.MinHealthy
+}
+
+// resetWarmup closes the startup gate of s, until minHealthy peers pass a probe. The gate of
+// a virtual server never run is open
+func (s *VirtualServer) resetWarmup() {
+	s.pool_lock.Lock()
+	defer s.pool_lock.Unlock()
+	s.warmedUp = s.minHealthy() == 0
+	s.warmPassed = make(map[string]bool)
+}
+
+// passWarmup counts a successful probe of peer, the pool lock should be held
+func (s *VirtualServer) passWarmup(peer string) {
+	if s.warmedUp || s.warmPassed == nil {
+		return
+	}
+	s.warmPassed[peer] = true
+	if min := s.minHealthy(); len(s.warmPassed) >= min {
+		log.Infof("[%s] warmed up, %d peers healthy", s.Name, len(s.warmPassed))
+		s.warmedUp = true
+		s.warmPassed = nil
+	}
+}
+
+// warmingUp returns why s is not ready yet after it started, empty if its startup gate is open
+func (s *VirtualServer) warmingUp() string {
+	s.pool_lock.RLock()
+	defer s.pool_lock.RUnlock()
+	if s.warmedUp || s.warmPassed == nil {
+		return ""
+	}
+	min := s.minHealthy()
+	if len(s.warmPassed) >= min {
+		return ""
+	}
+	return fmt.Sprintf("%s is warming up, %d of %d peers healthy", s.Name, len(s.warmPassed), min)
+}
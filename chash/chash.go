@@ -21,6 +21,8 @@ type Pool struct {
 	sortedHashes []uint32
 	nodes        map[string]bool
 	downNum      int
+	// ring of the backup peers, used only if all the primary peers are down
+	backup *Pool
 }
 
 func New() *Pool {
@@ -50,17 +52,76 @@ func (p *Pool) String() string {
 	for key, _ := range p.nodes {
 		result = append(result, key)
 	}
+	if p.backup != nil {
+		for key, _ := range p.backup.nodes {
+			result = append(result, key+" (backup)")
+		}
+	}
 	sort.Strings(result)
 	return strings.Join(result, ", ")
 }
 
+// Size returns the number of peers, including the backup peers
 func (p *Pool) Size() int {
 	p.RLock()
 	defer p.RUnlock()
+	size := p.size()
+	if p.backup != nil {
+		size += p.backup.Size()
+	}
+	return size
+}
+
+// Peers returns the sorted addresses of the peers, including the backup peers
+func (p *Pool) Peers() []string {
+	p.RLock()
+	defer p.RUnlock()
+	result := []string{}
+	for key, _ := range p.nodes {
+		result = append(result, key)
+	}
+	if p.backup != nil {
+		result = append(result, p.backup.Peers()...)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// size returns the number of primary peers, the lock should be held
+func (p *Pool) size() int {
 	return len(p.sortedHashes) / p.replica
 }
 
+// ownerOf returns the ring holding addr, nil if not found
+func (p *Pool) ownerOf(addr string) *Pool {
+	p.RLock()
+	defer p.RUnlock()
+	if _, ok := p.nodes[addr]; ok {
+		return p
+	}
+	if p.backup != nil {
+		return p.backup.ownerOf(addr)
+	}
+	return nil
+}
+
+// Add adds a peer, args are the weight (ignored) and whether it is a backup
 func (p *Pool) Add(addr string, args ...interface{}) {
+	if p.ownerOf(addr) != nil {
+		return
+	}
+	if len(args) > 1 {
+		if backup, _ := args[1].(bool); backup {
+			p.Lock()
+			if p.backup == nil {
+				p.backup = New()
+			}
+			p.Unlock()
+			p.backup.Add(addr)
+			return
+		}
+	}
+
 	p.Lock()
 	defer p.Unlock()
 
@@ -85,6 +146,10 @@ func (p *Pool) Add(addr string, args ...interface{}) {
 }
 
 func (p *Pool) Remove(peerAddr string) {
+	if owner := p.ownerOf(peerAddr); owner != nil && owner != p {
+		owner.Remove(peerAddr)
+		return
+	}
 	p.Lock()
 	defer p.Unlock()
 
@@ -111,6 +176,10 @@ func (p *Pool) Remove(peerAddr string) {
 }
 
 func (p *Pool) setPeerStatus(peerAddr string, isDown bool) {
+	if owner := p.ownerOf(peerAddr); owner != nil && owner != p {
+		owner.setPeerStatus(peerAddr, isDown)
+		return
+	}
 	p.Lock()
 	defer p.Unlock()
 
@@ -141,7 +210,8 @@ func (p *Pool) UpPeer(addr string) {
 }
 
 // Get use a key to map the backend server
-// key may be a cookie or request_uri
+// key may be a cookie or request_uri,
+// the backup ring is used only if all the primary peers are down
 func (p *Pool) Get(args ...interface{}) string {
 	if len(args) == 0 {
 		return ""
@@ -152,21 +222,38 @@ func (p *Pool) Get(args ...interface{}) string {
 		return ""
 	}
 
+	if peer := p.get(key); peer != "" {
+		return peer
+	}
+	p.RLock()
+	backup := p.backup
+	p.RUnlock()
+	if backup != nil {
+		return backup.get(key)
+	}
+	return ""
+}
+
+func (p *Pool) get(key string) string {
 	p.RLock()
 	defer p.RUnlock()
 
-	if len(p.vNodes) <= 0 || p.downNum >= p.Size() {
+	if len(p.vNodes) <= 0 || p.downNum >= p.size() {
 		return ""
 	}
 
 	h := p.hash(key)
 	idx := sort.Search(len(p.sortedHashes), func(i int) bool {
-		return p.sortedHashes[i] >= h && !p.vNodes[p.sortedHashes[i]].down
+		return p.sortedHashes[i] >= h
 	})
-	if idx >= len(p.sortedHashes) {
-		idx = 0
+	// the next node up clockwise, so only the keys of a down peer are remapped
+	for i := 0; i < len(p.sortedHashes); i++ {
+		peer := p.vNodes[p.sortedHashes[(idx+i)%len(p.sortedHashes)]]
+		if !peer.down {
+			return peer.addr
+		}
 	}
-	return p.vNodes[p.sortedHashes[idx]].addr
+	return ""
 }
 
 func CreatePool(addrs []string) *Pool {
@@ -140,3 +140,53 @@ func TestDownPeer(t *testing.T) {
 		assert.Equal(t, "", result, fmt.Sprintf("%d. got %q, expected '' after down all", i, result))
 	}
 }
+
+func TestBackup(t *testing.T) {
+	pool := CreatePool([]string{"1.1.1.1", "2.2.2.2"})
+	pool.Add("9.9.9.9", 1, true)
+	pool.Add("9.9.9.9", 1, true)
+	assert.Equal(t, 3, pool.Size())
+	assert.Equal(t, "1.1.1.1, 2.2.2.2, 9.9.9.9 (backup)", pool.String())
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2", "9.9.9.9"}, pool.Peers())
+
+	for _, key := range []string{"/a", "/b", "/c", "/d"} {
+		assert.NotEqual(t, "9.9.9.9", pool.Get(key))
+	}
+
+	pool.DownPeer("1.1.1.1")
+	pool.DownPeer("2.2.2.2")
+	assert.Equal(t, "9.9.9.9", pool.Get("/a"))
+
+	pool.DownPeer("9.9.9.9")
+	assert.Equal(t, "", pool.Get("/a"))
+
+	pool.UpPeer("9.9.9.9")
+	pool.UpPeer("2.2.2.2")
+	assert.Equal(t, "2.2.2.2", pool.Get("/a"))
+
+	pool.Remove("9.9.9.9")
+	assert.Equal(t, 2, pool.Size())
+}
+
+func TestDownRemapsItsKeysOnly(t *testing.T) {
+	pool := CreatePool([]string{"1.1.1.1", "2.2.2.2", "3.3.3.3"})
+	before := map[string]string{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("10.0.0.%d", i)
+		before[key] = pool.Get(key)
+	}
+
+	pool.DownPeer("2.2.2.2")
+	for key, peer := range before {
+		if peer == "2.2.2.2" {
+			assert.NotEqual(t, "2.2.2.2", pool.Get(key))
+		} else {
+			assert.Equal(t, peer, pool.Get(key), key)
+		}
+	}
+
+	pool.UpPeer("2.2.2.2")
+	for key, peer := range before {
+		assert.Equal(t, peer, pool.Get(key), key)
+	}
+}
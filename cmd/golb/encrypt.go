@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/onestraw/golb/config"
+)
+
+// encrypt prints the value read from stdin encrypted by the key of GOLB_CONFIG_KEY,
+// to put in the configuration in place of a password or token, e.g.
+//
+//	echo -n 's3cret' | GOLB_CONFIG_KEY=$(openssl rand -base64 32) golb encrypt
+func encrypt(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	fs.Parse(args)
+
+	key, err := config.KeyFromEnv()
+	if err != nil {
+		return err
+	}
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && value == "" {
+		return fmt.Errorf("read the value from stdin error=%v", err)
+	}
+	encrypted, err := config.Encrypt(key, strings.TrimRight(value, "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(encrypted)
+	return nil
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/lua"
 	"github.com/onestraw/golb/service"
 )
 
@@ -14,12 +19,46 @@ func init() {
 		//DisableColors: true,
 	}
 	logrus.SetFormatter(formatter)
+
+	balancer.RegisterScriptEngine(lua.ENGINE, lua.Engine{})
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "route" {
+		if err := route(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "encrypt" {
+		if err := encrypt(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var flagConfig = flag.String("config", "golb.json", "json configuration file")
+	var flagTest = flag.Bool("t", false, "validate the configuration file and exit")
 	flag.Parse()
 
+	if *flagTest {
+		if err := config.ValidateFile(*flagConfig); err != nil {
+			if verr, ok := err.(*config.ValidationError); ok {
+				for _, p := range verr.Problems {
+					fmt.Fprintln(os.Stderr, p)
+				}
+			} else {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			fmt.Fprintf(os.Stderr, "configuration file %s test failed\n", *flagConfig)
+			os.Exit(1)
+		}
+		fmt.Printf("configuration file %s test is successful\n", *flagConfig)
+		return
+	}
+
 	s, err := service.New(*flagConfig)
 	if err != nil {
 		panic(err)
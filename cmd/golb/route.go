@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/onestraw/golb/balancer"
+)
+
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlag) Set(value string) error {
+	kv := strings.SplitN(value, ":", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("header %q should be in the form of 'Name: value'", value)
+	}
+	h[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	return nil
+}
+
+// route asks the controller how a synthetic request would be routed, e.g.
+//
+//	golb route -controller 127.0.0.1:6587 -user admin:admin -host localhost -path /index.html -H 'Accept: */*'
+func route(args []string) error {
+	fs := flag.NewFlagSet("route", flag.ExitOnError)
+	controller := fs.String("controller", "127.0.0.1:6587", "controller address")
+	user := fs.String("user", "", "controller credentials, username:password")
+	headers := headerFlag{}
+	req := &balancer.RouteRequest{Headers: headers}
+	fs.StringVar(&req.Method, "method", "GET", "request method")
+	fs.StringVar(&req.Address, "address", "", "listening address of the virtual server, empty matches any")
+	fs.StringVar(&req.Host, "host", "localhost", "request host")
+	fs.StringVar(&req.Path, "path", "/", "request path")
+	fs.Var(headers, "H", "request header 'Name: value', repeatable")
+	fs.Parse(args)
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest("POST", "http://"+*controller+"/route", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if *user != "" {
+		up := strings.SplitN(*user, ":", 2)
+		if len(up) != 2 {
+			return fmt.Errorf("user %q should be in the form of username:password", *user)
+		}
+		httpReq.SetBasicAuth(up[0], up[1])
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, data)
+	}
+
+	var result balancer.RouteResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "virtual server: %s (%s, %s)\n", result.VirtualServer, result.Address, result.Status)
+	fmt.Fprintf(os.Stdout, "middleware:     %s\n", strings.Join(result.Middleware, " -> "))
+	fmt.Fprintf(os.Stdout, "route:          %s\n", result.Route)
+	fmt.Fprintf(os.Stdout, "pool (%s): %s\n", result.LBMethod, result.Pool)
+	if result.Error != "" {
+		fmt.Fprintf(os.Stdout, "rejected:       %s\n", result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+// golbctl is a command line client of the golb controller API, it prints tables,
+// or the JSON of the API with -json for scripting, e.g.
+//
+//	golbctl -controller 127.0.0.1:6587 -user admin:admin peers web
+//	golbctl drain web 127.0.0.1:10001
+//	golbctl -json stats web | jq '.peers'
+//
+// The controller address and credentials default to $GOLB_CONTROLLER and $GOLB_USER
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/controller"
+	"github.com/onestraw/golb/stats"
+)
+
+const usage = `usage: golbctl [flags] <command> [arguments]
+
+commands:
+  vs                              list the virtual servers
+  peers <vs>                      list the pool members of a virtual server
+  stats [vs]                      show the stats of the pool members
+  add <vs> <address> [weight]     add a pool member, weight 1 by default
+  remove <vs> <address>           remove a pool member
+  drain <vs> <address>            drain a pool member, its weight set to 0
+  weight <vs> <address> <weight>  change the weight of a pool member
+  reload [file]                   reload the virtual servers of a configuration file,
+                                  or show the progress of the last reload
+  events                          tail the events
+  top [-interval 1s] [vs]         live view of the rates, errors, active requests and latency
+
+flags:
+`
+
+func main() {
+	fs := flag.NewFlagSet("golbctl", flag.ExitOnError)
+	c := &client{out: os.Stdout}
+	fs.StringVar(&c.controller, "controller", env("GOLB_CONTROLLER", "127.0.0.1:6587"), "controller address")
+	fs.StringVar(&c.user, "user", os.Getenv("GOLB_USER"), "controller credentials, username:password")
+	fs.BoolVar(&c.json, "json", false, "print the JSON of the API")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := c.run(fs.Arg(0), fs.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func env(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
+
+type client struct {
+	controller string
+	user       string
+	json       bool
+	out        io.Writer
+}
+
+func (c *client) run(command string, args []string) error {
+	if command == "top" {
+		return c.top(args)
+	}
+	nargs := map[string][2]int{
+		"vs": {0, 0}, "peers": {1, 1}, "stats": {0, 1}, "add": {2, 3}, "remove": {2, 2},
+		"drain": {2, 2}, "weight": {3, 3}, "reload": {0, 1}, "events": {0, 0},
+	}
+	n, ok := nargs[command]
+	if !ok {
+		return fmt.Errorf("unknown command %q, see golbctl -h", command)
+	}
+	if len(args) < n[0] || len(args) > n[1] {
+		return fmt.Errorf("wrong number of arguments of %s, see golbctl -h", command)
+	}
+
+	switch command {
+	case "vs":
+		return c.listVirtualServers()
+	case "peers":
+		return c.listPeers(args[0])
+	case "stats":
+		name := ""
+		if len(args) > 0 {
+			name = args[0]
+		}
+		return c.stats(name)
+	case "add":
+		weight := 1
+		if len(args) > 2 {
+			w, err := strconv.Atoi(args[2])
+			if err != nil {
+				return fmt.Errorf("weight %q should be an integer", args[2])
+			}
+			weight = w
+		}
+		return c.print(c.do("POST", "/vs/"+args[0]+"/pool", config.Server{Address: args[1], Weight: weight}))
+	case "remove":
+		return c.print(c.do("DELETE", "/vs/"+args[0]+"/pool", config.Server{Address: args[1]}))
+	case "drain":
+		return c.setWeight(args[0], args[1], 0)
+	case "weight":
+		w, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("weight %q should be an integer", args[2])
+		}
+		return c.setWeight(args[0], args[1], w)
+	case "reload":
+		if len(args) == 0 {
+			return c.reloadStatus()
+		}
+		return c.reload(args[0])
+	default:
+		return c.tailEvents()
+	}
+}
+
+// request sends body, JSON encoded unless nil or already bytes, to the controller
+func (c *client) request(method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if data, ok := body.([]byte); ok {
+		reader = bytes.NewReader(data)
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://"+c.controller+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if c.user != "" {
+		up := strings.SplitN(c.user, ":", 2)
+		if len(up) != 2 {
+			return nil, fmt.Errorf("user %q should be in the form of username:password", c.user)
+		}
+		req.SetBasicAuth(up[0], up[1])
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// do returns the response body of a request
+func (c *client) do(method, path string, body interface{}) ([]byte, error) {
+	resp, err := c.request(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// get decodes the JSON response of path into v, and prints it as is with -json
+func (c *client) get(path string, v interface{}) (printed bool, err error) {
+	data, err := c.do("GET", path, nil)
+	if err != nil {
+		return false, err
+	}
+	if c.json {
+		_, err := c.out.Write(data)
+		return true, err
+	}
+	return false, json.Unmarshal(data, v)
+}
+
+func (c *client) print(data []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, strings.TrimSpace(string(data)))
+	return nil
+}
+
+// table prints the rows aligned, under header
+func (c *client) table(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func (c *client) listVirtualServers() error {
+	var vss []controller.VirtualServerInfo
+	if printed, err := c.get("/vs?format=json", &vss); printed || err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, vs := range vss {
+		up := 0
+		for _, p := range vs.Peers {
+			if !p.Down && !p.Maintenance && p.Weight > 0 {
+				up += 1
+			}
+		}
+		rows = append(rows, []string{vs.Name, vs.Address, vs.Status, vs.LBMethod,
+			fmt.Sprintf("%d/%d", up, len(vs.Peers))})
+	}
+	return c.table([]string{"NAME", "ADDRESS", "STATUS", "LB_METHOD", "PEERS_UP"}, rows)
+}
+
+// peerState returns up, down, drained or maintenance, a drained peer is also down
+func peerState(p balancer.PeerStatus) string {
+	switch {
+	case p.Maintenance:
+		return "maintenance"
+	case p.Weight == 0:
+		return "drained"
+	case p.Down:
+		return "down"
+	}
+	return "up"
+}
+
+func (c *client) listPeers(name string) error {
+	var vs controller.VirtualServerInfo
+	if printed, err := c.get("/vs/"+name+"?format=json", &vs); printed || err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, p := range vs.Peers {
+		rows = append(rows, []string{p.Address, p.Scheme, strconv.Itoa(p.Weight),
+			strconv.FormatBool(p.Backup), peerState(p)})
+	}
+	return c.table([]string{"ADDRESS", "SCHEME", "WEIGHT", "BACKUP", "STATE"}, rows)
+}
+
+func (c *client) stats(name string) error {
+	if c.json && name == "" {
+		return c.print(c.do("GET", "/stats?format=json", nil))
+	}
+	var reports []balancer.VirtualServerStats
+	data, err := c.do("GET", "/stats?format=json", nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return err
+	}
+	found := false
+	rows := [][]string{}
+	for _, vs := range reports {
+		if name != "" && vs.Name != name {
+			continue
+		}
+		found = true
+		if c.json {
+			return json.NewEncoder(c.out).Encode(vs)
+		}
+		peers := make([]string, 0, len(vs.Peers))
+		for peer := range vs.Peers {
+			peers = append(peers, peer)
+		}
+		sort.Strings(peers)
+		for _, peer := range peers {
+			r := vs.Peers[peer]
+			errors := errors5xx(r)
+			var requests uint64
+			p50, p99 := "-", "-"
+			if r.Latency != nil && r.Latency.Count > 0 {
+				requests = r.Latency.Count
+				p50, p99 = stats.FormatQuantile(r.Latency.P50), stats.FormatQuantile(r.Latency.P99)
+			}
+			rows = append(rows, []string{vs.Name, peer, strconv.FormatUint(requests, 10),
+				strconv.FormatUint(errors, 10), strconv.FormatUint(r.InBytes, 10),
+				strconv.FormatUint(r.OutBytes, 10), p50, p99})
+		}
+	}
+	if name != "" && !found {
+		return fmt.Errorf("virtual server %s not found", name)
+	}
+	return c.table([]string{"VS", "PEER", "REQUESTS", "5XX", "RECV_BYTES", "SEND_BYTES", "P50_MS", "P99_MS"}, rows)
+}
+
+// setWeight posts the pool member back with another weight, its other settings kept
+func (c *client) setWeight(name, address string, weight int) error {
+	var vs controller.VirtualServerInfo
+	data, err := c.do("GET", "/vs/"+name+"?format=json", nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &vs); err != nil {
+		return err
+	}
+	for _, p := range vs.Peers {
+		if p.Address == address {
+			server := p.Server
+			server.Weight = weight
+			return c.print(c.do("POST", "/vs/"+name+"/pool", server))
+		}
+	}
+	return fmt.Errorf("%s is not a pool member of %s", address, name)
+}
+
+func (c *client) reload(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	data, err = c.do("POST", "/reload", data)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.print(data, nil)
+	}
+	var rollout balancer.Rollout
+	if err := json.Unmarshal(data, &rollout); err != nil {
+		return c.print(data, nil)
+	}
+	return c.printRollout(&rollout)
+}
+
+func (c *client) reloadStatus() error {
+	var rollout balancer.Rollout
+	if printed, err := c.get("/reload", &rollout); printed || err != nil {
+		return err
+	}
+	return c.printRollout(&rollout)
+}
+
+func (c *client) printRollout(r *balancer.Rollout) error {
+	fmt.Fprintf(c.out, "state: %s, batches verified: %d/%d, started: %s\n",
+		r.State, r.Verified, r.Batches, r.Started.Format(time.RFC3339))
+	if r.Error != "" {
+		fmt.Fprintf(c.out, "error: %s\n", r.Error)
+	}
+	rows := [][]string{}
+	for _, ch := range r.Changes {
+		rows = append(rows, []string{ch.Name, ch.Action, strconv.Itoa(ch.Batch), strconv.FormatBool(ch.Applied)})
+	}
+	return c.table([]string{"VS", "ACTION", "BATCH", "APPLIED"}, rows)
+}
+
+// tailEvents prints the events until the controller closes the stream
+func (c *client) tailEvents() error {
+	resp, err := c.request("GET", "/events", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if c.json {
+			fmt.Fprintln(c.out, scanner.Text())
+			continue
+		}
+		var e balancer.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "%s  %-12s  %s  %s  %s\n", e.Time.Format(time.RFC3339), e.Type,
+			e.VirtualServer, e.Peer, e.Reason)
+	}
+	return scanner.Err()
+}
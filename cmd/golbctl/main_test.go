@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/controller"
+	"github.com/onestraw/golb/stats"
+)
+
+var (
+	testWeb = controller.VirtualServerInfo{
+		Name: "web", Address: "127.0.0.1:8081", Status: "running", LBMethod: "round-robin",
+		Peers: []balancer.PeerStatus{
+			{Server: config.Server{Address: "127.0.0.1:10001", Weight: 1, Scheme: "http"}},
+			{Server: config.Server{Address: "127.0.0.1:10002", Weight: 0, Scheme: "http", MaxFails: 3}},
+			{Server: config.Server{Address: "127.0.0.1:10003", Weight: 2, Scheme: "https", Backup: true}, Down: true},
+		},
+	}
+	testAPI = controller.VirtualServerInfo{
+		Name: "api", Address: "127.0.0.1:8082", Status: "stopped", LBMethod: "least-time",
+		Peers: []balancer.PeerStatus{
+			{Server: config.Server{Address: "127.0.0.1:10004", Weight: 1}, Maintenance: true},
+		},
+	}
+	testStats = []balancer.VirtualServerStats{{
+		Name: "web",
+		Peers: map[string]*stats.Report{
+			"127.0.0.1:10002": {StatusCode: map[string]uint64{}},
+			"127.0.0.1:10001": {
+				StatusCode: map[string]uint64{"200": 8, "502": 1, "503": 1},
+				InBytes:    100, OutBytes: 2000,
+				Latency: &stats.LatencyReport{Count: 10, P50: 5, P99: 0},
+			},
+		},
+	}}
+	testRollout = balancer.Rollout{
+		State:   "verifying",
+		Batches: 2, Verified: 1,
+		Error:   "error rate of web 10.0%",
+		Started: time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC),
+		Changes: []balancer.ReloadChange{
+			{Name: "web", Action: "update", Batch: 1, Applied: true},
+			{Name: "api", Action: "add", Batch: 2},
+		},
+	}
+	testEvents = []balancer.Event{
+		{Type: "peer_down", VirtualServer: "web", Peer: "127.0.0.1:10003", Reason: "health check",
+			Time: time.Date(2026, 10, 16, 8, 0, 1, 0, time.UTC)},
+		{Type: "vs_started", VirtualServer: "api", Time: time.Date(2026, 10, 16, 8, 0, 2, 0, time.UTC)},
+	}
+)
+
+// controllerStub serves the controller API from the fixtures above, with the credentials admin:admin,
+// and records the requests that change something
+type controllerStub struct {
+	*httptest.Server
+	sync.Mutex
+	requests []string
+}
+
+func newControllerStub(t *testing.T) *controllerStub {
+	s := &controllerStub{}
+	reply := func(w http.ResponseWriter, v interface{}) {
+		assert.NoError(t, json.NewEncoder(w).Encode(v))
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "admin" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.RequestURI() {
+		case "GET /vs?format=json":
+			reply(w, []controller.VirtualServerInfo{testWeb, testAPI})
+		case "GET /vs/web?format=json":
+			reply(w, testWeb)
+		case "GET /stats?format=json":
+			reply(w, testStats)
+		case "GET /reload":
+			reply(w, testRollout)
+		case "GET /events":
+			for _, e := range testEvents {
+				reply(w, e)
+			}
+		case "POST /vs/web/pool", "DELETE /vs/web/pool", "POST /reload":
+			body, _ := ioutil.ReadAll(r.Body)
+			s.Lock()
+			s.requests = append(s.requests, r.Method+" "+r.URL.Path+" "+strings.TrimSpace(string(body)))
+			s.Unlock()
+			if r.URL.Path == "/reload" {
+				reply(w, testRollout)
+				return
+			}
+			w.Write([]byte("OK\n"))
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+func (s *controllerStub) changes() []string {
+	s.Lock()
+	defer s.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+func TestRunArgs(t *testing.T) {
+	s := newControllerStub(t)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"list"}, `unknown command "list", see golbctl -h`},
+		{[]string{"vs", "web"}, "wrong number of arguments of vs, see golbctl -h"},
+		{[]string{"peers"}, "wrong number of arguments of peers, see golbctl -h"},
+		{[]string{"stats", "web", "api"}, "wrong number of arguments of stats, see golbctl -h"},
+		{[]string{"add", "web"}, "wrong number of arguments of add, see golbctl -h"},
+		{[]string{"add", "web", "127.0.0.1:10005", "1", "2"}, "wrong number of arguments of add, see golbctl -h"},
+		{[]string{"add", "web", "127.0.0.1:10005", "heavy"}, `weight "heavy" should be an integer`},
+		{[]string{"weight", "web", "127.0.0.1:10001"}, "wrong number of arguments of weight, see golbctl -h"},
+		{[]string{"weight", "web", "127.0.0.1:10001", "1.5"}, `weight "1.5" should be an integer`},
+		{[]string{"drain", "web", "127.0.0.1:10009"}, "127.0.0.1:10009 is not a pool member of web"},
+		{[]string{"reload", "a.json", "b.json"}, "wrong number of arguments of reload, see golbctl -h"},
+		{[]string{"events", "web"}, "wrong number of arguments of events, see golbctl -h"},
+		{[]string{"top", "web", "api"}, "usage: golbctl top [-interval 1s] [-n 0] [-batch] [vs]"},
+		{[]string{"top", "-interval", "0s"}, "usage: golbctl top [-interval 1s] [-n 0] [-batch] [vs]"},
+		{[]string{"peers", "nope"}, "404 Not Found: Not Found"},
+		{[]string{"stats", "nope"}, "virtual server nope not found"},
+	} {
+		out := &bytes.Buffer{}
+		c := &client{controller: s.URL[7:], user: "admin:admin", out: out}
+		err := c.run(tc.args[0], tc.args[1:])
+		assert.EqualError(t, err, tc.err, "%v", tc.args)
+		assert.Empty(t, out.String(), "%v", tc.args)
+	}
+	assert.Empty(t, s.changes())
+
+	for _, user := range []string{"admin", "admin:guess", ""} {
+		c := &client{controller: s.URL[7:], user: user, out: &bytes.Buffer{}}
+		err := c.run("vs", nil)
+		if user == "admin" {
+			assert.EqualError(t, err, `user "admin" should be in the form of username:password`)
+		} else {
+			assert.EqualError(t, err, "401 Unauthorized: Unauthorized", user)
+		}
+	}
+}
+
+func TestRunOutput(t *testing.T) {
+	s := newControllerStub(t)
+	defer s.Close()
+	f, err := ioutil.TempFile("", "golb.json")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.Write([]byte(`{"virtual_servers":[]}`))
+	f.Close()
+	rollout := `state: verifying, batches verified: 1/2, started: 2026-10-16T08:00:00Z
+error: error rate of web 10.0%
+VS   ACTION  BATCH  APPLIED
+web  update  1      true
+api  add     2      false
+`
+
+	for _, tc := range []struct {
+		args    []string
+		json    bool
+		out     string
+		changes []string
+	}{
+		{
+			args: []string{"vs"},
+			out: `NAME  ADDRESS         STATUS   LB_METHOD    PEERS_UP
+web   127.0.0.1:8081  running  round-robin  1/3
+api   127.0.0.1:8082  stopped  least-time   0/1
+`,
+		},
+		{
+			args: []string{"peers", "web"},
+			out: `ADDRESS          SCHEME  WEIGHT  BACKUP  STATE
+127.0.0.1:10001  http    1       false   up
+127.0.0.1:10002  http    0       false   drained
+127.0.0.1:10003  https   2       true    down
+`,
+		},
+		{
+			args: []string{"stats"},
+			out: `VS   PEER             REQUESTS  5XX  RECV_BYTES  SEND_BYTES  P50_MS  P99_MS
+web  127.0.0.1:10001  10        2    100         2000        5       >10000
+web  127.0.0.1:10002  0         0    0           0           -       -
+`,
+		},
+		{
+			args: []string{"stats", "web"},
+			json: true,
+			out:  mustJSON(t, testStats[0]),
+		},
+		{
+			args: []string{"peers", "web"},
+			json: true,
+			out:  mustJSON(t, testWeb),
+		},
+		{
+			args:    []string{"add", "web", "127.0.0.1:10005"},
+			out:     "OK\n",
+			changes: []string{`POST /vs/web/pool ` + mustCompactJSON(t, config.Server{Address: "127.0.0.1:10005", Weight: 1})},
+		},
+		{
+			args:    []string{"add", "web", "127.0.0.1:10005", "3"},
+			out:     "OK\n",
+			changes: []string{`POST /vs/web/pool ` + mustCompactJSON(t, config.Server{Address: "127.0.0.1:10005", Weight: 3})},
+		},
+		{
+			args:    []string{"remove", "web", "127.0.0.1:10001"},
+			out:     "OK\n",
+			changes: []string{`DELETE /vs/web/pool ` + mustCompactJSON(t, config.Server{Address: "127.0.0.1:10001"})},
+		},
+		{
+			// the other settings of the peer are kept
+			args: []string{"weight", "web", "127.0.0.1:10002", "5"},
+			out:  "OK\n",
+			changes: []string{`POST /vs/web/pool ` + mustCompactJSON(t,
+				config.Server{Address: "127.0.0.1:10002", Weight: 5, Scheme: "http", MaxFails: 3})},
+		},
+		{
+			args: []string{"drain", "web", "127.0.0.1:10003"},
+			out:  "OK\n",
+			changes: []string{`POST /vs/web/pool ` + mustCompactJSON(t,
+				config.Server{Address: "127.0.0.1:10003", Weight: 0, Scheme: "https", Backup: true})},
+		},
+		{
+			args: []string{"reload"},
+			out:  rollout,
+		},
+		{
+			args:    []string{"reload", f.Name()},
+			out:     rollout,
+			changes: []string{`POST /reload {"virtual_servers":[]}`},
+		},
+		{
+			args: []string{"events"},
+			// the empty peer and reason are padded
+			out: "2026-10-16T08:00:01Z  peer_down     web  127.0.0.1:10003  health check\n" +
+				"2026-10-16T08:00:02Z  vs_started    api    \n",
+		},
+		{
+			args: []string{"events"},
+			json: true,
+			out:  mustJSON(t, testEvents[0]) + mustJSON(t, testEvents[1]),
+		},
+	} {
+		out := &bytes.Buffer{}
+		c := &client{controller: s.URL[7:], user: "admin:admin", json: tc.json, out: out}
+		require.NoError(t, c.run(tc.args[0], tc.args[1:]), "%v", tc.args)
+		assert.Equal(t, tc.out, out.String(), "%v", tc.args)
+		assert.Equal(t, tc.changes, s.changes(), "%v", tc.args)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(data) + "\n"
+}
+
+func mustCompactJSON(t *testing.T, v interface{}) string {
+	return strings.TrimSpace(mustJSON(t, v))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/stats"
+)
+
+// clears the terminal and moves the cursor home
+const clearScreen = "\033[H\033[2J"
+
+// top redraws the rates of the virtual servers and their peers every interval, e.g.
+//
+//	golbctl top -interval 2s web
+func (c *client) top(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Second, "refresh interval")
+	n := fs.Int("n", 0, "number of refreshes, 0 runs until interrupted")
+	batch := fs.Bool("batch", false, "print the frames one after the other instead of redrawing")
+	fs.Parse(args)
+	if fs.NArg() > 1 || *interval <= 0 {
+		return fmt.Errorf("usage: golbctl top [-interval 1s] [-n 0] [-batch] [vs]")
+	}
+	name := fs.Arg(0)
+
+	var prev map[string]*balancer.VirtualServerStats
+	var prevAt time.Time
+	for i := 0; *n == 0 || i < *n; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		data, err := c.do("GET", "/stats?format=json", nil)
+		if err != nil {
+			return err
+		}
+		var reports []*balancer.VirtualServerStats
+		if err := json.Unmarshal(data, &reports); err != nil {
+			return err
+		}
+		now := time.Now()
+		cur := topStats(reports, name)
+		if name != "" && len(cur) == 0 {
+			return fmt.Errorf("virtual server %s not found", name)
+		}
+		if !*batch {
+			io.WriteString(c.out, clearScreen)
+		}
+		fmt.Fprintf(c.out, "golb top - %s, controller %s, every %s\n\n", now.Format("15:04:05"), c.controller, *interval)
+		io.WriteString(c.out, renderTop(cur, prev, now.Sub(prevAt)))
+		prev, prevAt = cur, now
+	}
+	return nil
+}
+
+// topStats returns the stats of the virtual server name by name, all of them if name is empty
+func topStats(reports []*balancer.VirtualServerStats, name string) map[string]*balancer.VirtualServerStats {
+	cur := make(map[string]*balancer.VirtualServerStats, len(reports))
+	for _, vs := range reports {
+		if name == "" || vs.Name == name {
+			cur[vs.Name] = vs
+		}
+	}
+	return cur
+}
+
+// errors5xx returns the 5xx responses of r
+func errors5xx(r *stats.Report) uint64 {
+	var n uint64
+	for code, count := range r.StatusCode {
+		if strings.HasPrefix(code, "5") {
+			n += count
+		}
+	}
+	return n
+}
+
+func errorRate(errors, requests uint64) string {
+	if requests == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(errors)*100/float64(requests))
+}
+
+// interval returns the increments of a peer since prev, the totals if there is no
+// prev or its stats were reset
+func interval(cur, prev *stats.Report) *stats.Report {
+	if prev == nil || cur.Latency == nil || prev.Latency == nil || cur.Latency.Count < prev.Latency.Count {
+		prev = nil
+	}
+	return cur.Sub(prev)
+}
+
+// renderTop returns the table of the virtual servers of cur with their peers, the rates and the latency
+// over elapsed since prev, or since the start if prev is nil
+func renderTop(cur, prev map[string]*balancer.VirtualServerStats, elapsed time.Duration) string {
+	names := make([]string, 0, len(cur))
+	for name := range cur {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	perSecond := func(n uint64) string {
+		if prev == nil {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f", float64(n)/elapsed.Seconds())
+	}
+	var out bytes.Buffer
+	w := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VS/PEER\tREQ/S\t5XX\tACTIVE\tCONNS\tNEW_CONN/S\tP50_MS\tP99_MS")
+	for _, name := range names {
+		vs := cur[name]
+		var last *balancer.VirtualServerStats
+		if prev != nil {
+			last = prev[name]
+		}
+		total := vs.Total
+		if total == nil {
+			total = &balancer.AggregateStats{}
+		}
+		var requests, errors uint64
+		peers := make([]string, 0, len(vs.Peers))
+		deltas := make(map[string]*stats.Report, len(vs.Peers))
+		for peer, r := range vs.Peers {
+			var p *stats.Report
+			if last != nil {
+				p = last.Peers[peer]
+			}
+			d := interval(r, p)
+			deltas[peer] = d
+			requests += d.Latency.Count
+			errors += errors5xx(d)
+			peers = append(peers, peer)
+		}
+		sort.Strings(peers)
+		fmt.Fprintf(w, "%s\t%.1f\t%s\t%d\t%d\t\t\t\n", name, total.QPS, errorRate(errors, requests),
+			total.ActiveRequests, total.ActiveConns)
+		for _, peer := range peers {
+			d := deltas[peer]
+			p50, p99 := "-", "-"
+			if d.Latency.Count > 0 {
+				p50, p99 = stats.FormatQuantile(d.Latency.P50), stats.FormatQuantile(d.Latency.P99)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%d\t\t%s\t%s\t%s\n", peer, perSecond(d.Latency.Count),
+				errorRate(errors5xx(d), d.Latency.Count), d.Active, perSecond(d.NewConns), p50, p99)
+		}
+	}
+	w.Flush()
+	return out.String()
+}
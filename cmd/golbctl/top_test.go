@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/stats"
+)
+
+func latency(samples ...uint64) *stats.LatencyReport {
+	h := stats.NewHistogram()
+	for _, ms := range samples {
+		h.Observe(ms)
+	}
+	return h.Report()
+}
+
+func repeat(ms uint64, n int) []uint64 {
+	samples := make([]uint64, n)
+	for i := range samples {
+		samples[i] = ms
+	}
+	return samples
+}
+
+func TestRenderTop(t *testing.T) {
+	prev := []*balancer.VirtualServerStats{{
+		Name:  "web",
+		Total: &balancer.AggregateStats{QPS: 7},
+		Peers: map[string]*stats.Report{
+			"127.0.0.1:10001": {
+				StatusCode: map[string]uint64{"200": 10},
+				Latency:    latency(repeat(5, 10)...),
+				NewConns:   2,
+			},
+			"127.0.0.1:10002": {
+				StatusCode: map[string]uint64{"200": 3, "503": 1},
+				Latency:    latency(repeat(100, 4)...),
+				NewConns:   1,
+			},
+		},
+	}}
+	// 2s later, the stats of 10002 were reset
+	cur := []*balancer.VirtualServerStats{
+		{
+			Name:  "web",
+			Total: &balancer.AggregateStats{QPS: 6, ActiveRequests: 1, ActiveConns: 3},
+			Peers: map[string]*stats.Report{
+				"127.0.0.1:10001": {
+					StatusCode: map[string]uint64{"200": 18, "502": 2},
+					Latency:    latency(append(repeat(5, 10), repeat(50, 10)...)...),
+					NewConns:   4,
+					Active:     1,
+				},
+				"127.0.0.1:10002": {
+					StatusCode: map[string]uint64{"200": 2},
+					Latency:    latency(1, 1),
+					NewConns:   1,
+				},
+			},
+		},
+		{Name: "api", Peers: map[string]*stats.Report{}},
+	}
+
+	assert.Len(t, topStats(cur, ""), 2)
+	assert.Empty(t, topStats(cur, "nope"))
+	web := topStats(cur, "web")
+	assert.Len(t, web, 1)
+
+	// the totals on the first frame
+	assert.Equal(t, ""+
+		"VS/PEER            REQ/S  5XX    ACTIVE  CONNS  NEW_CONN/S  P50_MS  P99_MS\n"+
+		"api                0.0    -      0       0                          \n"+
+		"web                6.0    9.1%   1       3                          \n"+
+		"  127.0.0.1:10001  -      10.0%  1              -           5       50\n"+
+		"  127.0.0.1:10002  -      0.0%   0              -           1       1\n",
+		renderTop(topStats(cur, ""), nil, 0))
+
+	// the increments over the elapsed time, or the totals of the peers reset since prev
+	assert.Equal(t, ""+
+		"VS/PEER            REQ/S  5XX    ACTIVE  CONNS  NEW_CONN/S  P50_MS  P99_MS\n"+
+		"web                6.0    16.7%  1       3                          \n"+
+		"  127.0.0.1:10001  5.0    20.0%  1              1.0         50      50\n"+
+		"  127.0.0.1:10002  1.0    0.0%   0              0.5         1       1\n",
+		renderTop(web, topStats(prev, "web"), 2*time.Second))
+}
@@ -3,8 +3,8 @@ package config
 import (
 	"encoding/json"
 	"errors"
-	"os"
-	"strings"
+	"io/ioutil"
+	"path/filepath"
 )
 
 var (
@@ -14,20 +14,572 @@ var (
 	ErrVirtualServerAddressEmpty = errors.New("Vritual Server Address is not specified")
 )
 
+// DEFAULT_WEIGHT is the weight of a server whose weight is omitted in JSON
+const DEFAULT_WEIGHT = 1
+
 type Server struct {
+	// host:port, or unix:/path/to/sock
 	Address string `json:"address"`
-	Weight  int    `json:"weight"`
+	// 0 drains the server, it stays in the pool and is health-checked, but receives no request
+	Weight int `json:"weight"`
+	// http (default) or https, used to talk to this peer
+	Scheme string `json:"scheme"`
+	// receives traffic only when all the primary peers are down
+	Backup bool `json:"backup"`
+	// the non-zero fields override the health check of the virtual server
+	HealthCheck HealthCheck `json:"health_check"`
+	// failures before the peer is marked down, 0 means the max fails of the virtual server
+	MaxFails int `json:"max_fails"`
+	// seconds before a peer marked down by failures is retried, 0 means the fail timeout
+	// of the virtual server
+	FailTimeout int64 `json:"fail_timeout"`
+}
+
+// UnmarshalJSON defaults the omitted weight to DEFAULT_WEIGHT, an explicit 0 drains the server
+func (s *Server) UnmarshalJSON(data []byte) error {
+	type server Server
+	v := server{Weight: DEFAULT_WEIGHT}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*s = Server(v)
+	return nil
+}
+
+// HealthCheck probes the peers with GET requests, a peer is down after a failed probe
+// (connection error, timeout or status >= 400), and up after a successful one
+type HealthCheck struct {
+	// http (default) probes GET path, grpc calls grpc.health.v1.Health/Check
+	Type string `json:"type"`
+	// empty disables the http health check
+	Path string `json:"path"`
+	// service name asked by the grpc health check, empty means the whole server
+	Service string `json:"service"`
+	// 0 means the port of the peer
+	Port int `json:"port"`
+	// seconds between probes, 0 means 5
+	Interval int `json:"interval"`
+	// seconds to wait for the response, 0 means 2
+	Timeout int `json:"timeout"`
+	// peers to pass a probe after the virtual server starts before it is ready and healthy,
+	// at most the pool size, 0 disables the startup gate
+	MinHealthy int `json:"min_healthy"`
+}
+
+type Hedge struct {
+	// percentile (0, 100] of the peer latency to wait before hedging, 0 disables hedging
+	Percentile float64 `json:"percentile"`
+	// delay in milliseconds used until the peer has latency samples
+	DefaultDelay int `json:"default_delay"`
+}
+
+type RangeSplit struct {
+	// bytes of each ranged subrequest, 0 disables range splitting
+	ChunkSize int64 `json:"chunk_size"`
+	// maximum subrequests in flight
+	Concurrency int `json:"concurrency"`
+}
+
+// Rule routes the requests matching all of its conditions to its own pool,
+// the rules are evaluated in order, the pool of the virtual server serves the others
+type Rule struct {
+	PathPrefix string `json:"path_prefix"`
+	PathRegex  string `json:"path_regex"`
+	// empty matches any method
+	Methods []string `json:"methods"`
+	// header name -> value, all of them should match
+	Headers map[string]string `json:"headers"`
+	// template -> value, all of them should match, e.g. {"$cookie_beta":"1"}, see Variables
+	Vars map[string]string `json:"vars"`
+	// remove path_prefix from the path sent to the pool
+	StripPrefix bool     `json:"strip_prefix"`
+	LBMethod    string   `json:"lb_method"`
+	Pool        []Server `json:"pool"`
+	// empty means the SLA of the virtual server
+	SLA SLA `json:"sla"`
+}
+
+// Rewrite replaces the part of the request URI (path and query) matching regex,
+// the first matching rewrite wins, and is applied before the rules
+type Rewrite struct {
+	Regex string `json:"regex"`
+	// $1 or ${name} expands to a group of regex, {host} and {scheme} to the ones of the request
+	Replacement string `json:"replacement"`
+	// 301, 302, 303, 307 or 308 responds a redirect to the replaced URI instead, 0 rewrites
+	// the request sent to the pool
+	Redirect int `json:"redirect"`
+}
+
+// HeaderRules rewrites headers, remove is applied first, then set and add
+// The values may use the variables, $upstream_addr and $status are empty in the request headers
+type HeaderRules struct {
+	// header name -> value, replaces the existing values
+	Set map[string]string `json:"set"`
+	// header name -> value, appended to the existing values
+	Add    map[string]string `json:"add"`
+	Remove []string          `json:"remove"`
+}
+
+// Headers rewrites the request headers sent to the pool and the response headers returned to the clients
+type Headers struct {
+	Request  HeaderRules `json:"request"`
+	Response HeaderRules `json:"response"`
+}
+
+// SLA is the latency target of the responses, the timeouts are derived from it: the tries
+// of a request end by latency, each try is given latency / tries, and the hedged requests
+// are sent after half a try at most
+type SLA struct {
+	// milliseconds, 0 disables it
+	Latency int `json:"latency"`
+	// tries within the latency, 0 means the tries of the retry (3)
+	Tries int `json:"tries"`
+}
+
+// Canary routes a share of the requests to its own pool, the requests matching
+// a rule are not split
+type Canary struct {
+	// percent [0, 100] of the requests routed to the canary pool
+	Percent float64 `json:"percent"`
+	// the requests having all of these headers and cookies are always routed to the canary pool
+	Headers  map[string]string `json:"headers"`
+	Cookies  map[string]string `json:"cookies"`
+	LBMethod string            `json:"lb_method"`
+	// empty disables the canary
+	Pool []Server `json:"pool"`
+}
+
+// Mirror sends a copy of a share of the requests to its own pool, the responses are discarded
+type Mirror struct {
+	// percent (0, 100] of the requests mirrored, 0 disables the mirror
+	Percent  float64  `json:"percent"`
+	LBMethod string   `json:"lb_method"`
+	Pool     []Server `json:"pool"`
+	// milliseconds to wait for a shadow response, 0 means 5000
+	Timeout int `json:"timeout"`
+}
+
+// OutlierDetection ejects a peer when its 5xx rate or p99 latency in an interval
+// is more than a factor of the mean of the pool
+type OutlierDetection struct {
+	// seconds between evaluations, 0 means 10
+	Interval int `json:"interval"`
+	// 0 disables the check
+	ErrorFactor   float64 `json:"error_factor"`
+	LatencyFactor float64 `json:"latency_factor"`
+	// requests in the interval for a peer to be evaluated, 0 means 5
+	MinRequests uint64 `json:"min_requests"`
+	// percent of the pool ejected at most at the same time, 0 means 10
+	MaxEjectionPercent int `json:"max_ejection_percent"`
+	// seconds an outlier is ejected, 0 means 30
+	EjectionTime int `json:"ejection_time"`
+}
+
+// AutoWeight scales the weights of the round-robin peers by their error rate and p99 latency
+// relative to the mean of the pool, one step per interval, within [min_percent, max_percent]
+type AutoWeight struct {
+	Enable bool `json:"enable"`
+	// seconds between adjustments, 0 means 30
+	Interval int `json:"interval"`
+	// percent of the configured weight per adjustment, 0 means 10
+	Step int `json:"step"`
+	// bounds of the scaled weight in percent of the configured weight, 0 means 50 and 150
+	MinPercent int `json:"min_percent"`
+	MaxPercent int `json:"max_percent"`
+	// requests in the interval for a peer to be adjusted, 0 means 20
+	MinRequests uint64 `json:"min_requests"`
+}
+
+type Limits struct {
+	// concurrent requests per peer, 0 means unlimited
+	PeerMaxConns int `json:"peer_max_conns"`
+	// concurrent requests of the pool, 0 means unlimited
+	PoolMaxConns int `json:"pool_max_conns"`
+	// requests waiting for a free slot, 0 responds 503 immediately
+	QueueSize int `json:"queue_size"`
+	// milliseconds a request waits in the queue, 0 means 1000
+	QueueTimeout int `json:"queue_timeout"`
+	// concurrent requests per client IP, the requests over it get 429, 0 means unlimited
+	ClientMaxConns int `json:"client_max_conns"`
+	// order of the queue
+	Priority Priority `json:"priority"`
+	// pool_max_conns inferred from the latency, pool_max_conns is then its ceiling
+	Adaptive AdaptiveLimit `json:"adaptive"`
+}
+
+// AdaptiveLimit infers the concurrent requests the pool can take from its latency,
+// instead of a static pool_max_conns, the requests over it wait in the queue or get 503
+type AdaptiveLimit struct {
+	// gradient lowers the limit as the latency rises over its long term average (Netflix
+	// style), aimd adds 1 per request and backs off by 10% on a 5xx, empty disables it
+	Algorithm string `json:"algorithm"`
+	// 0 means 20
+	InitialLimit int `json:"initial_limit"`
+	// 0 means 1
+	MinLimit int `json:"min_limit"`
+	// 0 means 1000
+	MaxLimit int `json:"max_limit"`
+}
+
+// Priority orders the requests waiting in the queue of the limits, the higher priorities
+// take the free slots first, and a full queue sheds its lowest priority request for a
+// higher one. The shed requests get 503 with Retry-After
+type Priority struct {
+	// request header with an integer priority, e.g. set by a trusted edge, empty disables it
+	Header string `json:"header"`
+	// priorities by path prefix, the longest prefix wins, used without the header
+	Routes map[string]int `json:"routes"`
+	// priority of the other requests
+	Default int `json:"default"`
+}
+
+// RateLimit is a token bucket per client IP, the requests over it get 429
+type RateLimit struct {
+	// requests per second, 0 disables it
+	Rate float64 `json:"rate"`
+	// requests a client may send at once, 0 means max(1, rate)
+	Burst int `json:"burst"`
+	// the virtual servers with the same shared name have the same buckets, so a client
+	// has one budget across their listeners, HTTP and HTTPS, empty means not shared
+	Shared string `json:"shared"`
+}
+
+// LeastTime tunes the least_time method
+type LeastTime struct {
+	// multiply the response time by the requests in flight plus one
+	Connections bool `json:"connections"`
+	// compare two random peers instead of all of them (power of two choices)
+	P2C bool `json:"p2c"`
+}
+
+// ConnectionAge closes the client connections older than Max seconds, so the long-lived clients
+// reconnect and are spread again, HTTP/2 connections are sent a GOAWAY
+type ConnectionAge struct {
+	// 0 disables it
+	Max int `json:"max"`
+	// seconds an aged connection may finish its requests, 0 means 30
+	Grace int `json:"grace"`
+}
+
+type SlowLog struct {
+	// milliseconds from which a request is logged, 0 disables the slow log
+	Threshold int `json:"threshold"`
+	// empty means the main log
+	File string `json:"file"`
+}
+
+// Compression encodes the responses of the pool with brotli or gzip for the clients accepting it,
+// the responses already encoded, ranges and the ones smaller than min_size are sent as is
+type Compression struct {
+	Enable bool `json:"enable"`
+	// "br" and "gzip" by order of preference when the client accepts both with the same q value,
+	// empty means ["br", "gzip"]
+	Encodings []string `json:"encodings"`
+	// content types compressed, "text/" matches any text subtype, empty means the common text types
+	Types []string `json:"types"`
+	// bytes, the responses with a smaller Content-Length are not compressed, 0 means 1024
+	MinSize int64 `json:"min_size"`
+	// gzip level 1 to 9, 0 means the default level
+	Level int `json:"level"`
+	// brotli quality 1 to 11, 0 means 4, the higher levels are too slow for on-the-fly compression
+	BrotliLevel int `json:"brotli_level"`
+}
+
+// Cache stores the cacheable GET responses of the pool, honoring Cache-Control, Expires and Vary
+type Cache struct {
+	Enable bool `json:"enable"`
+	// bytes of the cached responses, 0 means 64MB
+	MaxSize int64 `json:"max_size"`
+	// bytes, larger responses are not cached, 0 means 1MB
+	MaxEntrySize int64 `json:"max_entry_size"`
+	// seconds the responses without Cache-Control max-age or Expires are cached, 0 means not cached
+	DefaultTTL int `json:"default_ttl"`
+	// seconds overriding the freshness set by the pool, 0 means not overridden
+	TTL int `json:"ttl"`
+	// directory persisting the cached responses across restarts, empty means memory only
+	Dir string `json:"dir"`
+}
+
+// AccessLog filters the access log lines: errors_only and slower_than select the requests logged,
+// either one is enough if both are set, then 1 in every and the percent of sample of them are logged
+type AccessLog struct {
+	// status class ("1xx" to "5xx") -> percent [0, 100] of the requests logged,
+	// the classes not listed are always logged, e.g. {"2xx":10,"3xx":10}
+	Sample map[string]float64 `json:"sample"`
+	// log 1 in every requests, 0 or 1 logs all of them
+	Every int `json:"every"`
+	// log the 4xx and 5xx responses only
+	ErrorsOnly bool `json:"errors_only"`
+	// log the requests taking at least milliseconds only, 0 disables it
+	SlowerThan int `json:"slower_than"`
+	// ships the lines to syslog or journald instead of the log, it is not changed at runtime
+	Sink AccessLogSink `json:"sink"`
+	// template of the lines, e.g. "$remote_addr $host $uri $status $upstream_addr $request_time",
+	// empty means the default line
+	Format string `json:"format"`
+}
+
+// AccessLogSink sends the access log lines at the priority of their status: err for 5xx,
+// warning for 4xx and info for the others. The virtual servers with the same sink share it
+type AccessLogSink struct {
+	// syslog or journald, empty writes the lines to the log
+	Type string `json:"type"`
+	// of syslog: udp://host:514, tcp://host:601 or unix:///dev/log, empty means unix:///dev/log
+	Address string `json:"address"`
+	// of syslog, e.g. local0, empty means daemon
+	Facility string `json:"facility"`
+	// APP-NAME of syslog and SYSLOG_IDENTIFIER of journald, empty means golb
+	Tag string `json:"tag"`
+}
+
+// SRV populates the pool from the records of _service._proto.name
+type SRV struct {
+	Service string `json:"service"`
+	Proto   string `json:"proto"`
+	Name    string `json:"name"`
+	// seconds between lookups, 0 means 30
+	Interval int `json:"interval"`
 }
 
 type VirtualServer struct {
-	Name       string   `json:"name"`
-	Address    string   `json:"address"`
-	ServerName string   `json:"server_name"`
-	Protocol   string   `json:"protocol"`
-	CertFile   string   `json:"cert_file"`
-	KeyFile    string   `json:"key_file"`
-	LBMethod   string   `json:"lb_method"`
-	Pool       []Server `json:"pool"`
+	Name string `json:"name"`
+	// host:port, or unix:/path/to/sock
+	Address string `json:"address"`
+	// listener sockets opened with SO_REUSEPORT on the address, 0 means one without it
+	ReusePort  int    `json:"reuse_port"`
+	ServerName string `json:"server_name"`
+	Protocol   string `json:"protocol"`
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	// CA bundle to require and verify client certificates (mTLS)
+	ClientCAFile string `json:"client_ca_file"`
+	// seconds between checks of client_ca_file for changes, 0 disables it
+	ClientCAWatch int         `json:"client_ca_watch"`
+	LBMethod      string      `json:"lb_method"`
+	LeastTime     LeastTime   `json:"least_time"`
+	Pool          []Server    `json:"pool"`
+	Rewrites      []Rewrite   `json:"rewrites"`
+	Rules         []Rule      `json:"rules"`
+	Canary        Canary      `json:"canary"`
+	Mirror        Mirror      `json:"mirror"`
+	Headers       Headers     `json:"headers"`
+	Compression   Compression `json:"compression"`
+	Cache         Cache       `json:"cache"`
+	SLA           SLA         `json:"sla"`
+	// name of the service populating the pool by service discovery
+	Service    string     `json:"service"`
+	Hedge      Hedge      `json:"hedge"`
+	RangeSplit RangeSplit `json:"range_split"`
+	// seconds to ramp up the weight of new or recovered peers, 0 disables it
+	SlowStart        int              `json:"slow_start"`
+	OutlierDetection OutlierDetection `json:"outlier_detection"`
+	AutoWeight       AutoWeight       `json:"auto_weight"`
+	HealthCheck      HealthCheck      `json:"health_check"`
+	SlowLog          SlowLog          `json:"slow_log"`
+	AccessLog        AccessLog        `json:"access_log"`
+	Limits           Limits           `json:"limits"`
+	RateLimit        RateLimit        `json:"rate_limit"`
+	ConnectionAge    ConnectionAge    `json:"connection_age"`
+	// the readiness of golb depends on the virtual server, see GET /ready of the controller
+	Critical bool `json:"critical"`
+	// add a Server-Timing response header with the phases measured by the proxy
+	ServerTiming bool `json:"server_timing"`
+	// add X-Upstream-Addr and X-Upstream-Response-Time response headers naming the peer which served the request
+	PeerHeaders bool  `json:"peer_headers"`
+	Debug       Debug `json:"debug"`
+	// seconds a peer is continuously down before moved to tombstones, 0 means never
+	TombstoneAfter int64 `json:"tombstone_after"`
+	// seconds to re-resolve the pool members configured by host name, 0 means never
+	ResolveInterval int `json:"resolve_interval"`
+	SRV             SRV `json:"srv"`
+	// bodies of the error responses of golb by status code, or peer_not_found if no peer is available
+	ErrorPages map[string]ErrorPage `json:"error_pages"`
+	// pool of the connections to the peers
+	KeepAlive KeepAlive `json:"keepalive"`
+	WAF       WAF       `json:"waf"`
+	JWT       JWT       `json:"jwt"`
+	// bytes of a request body, the larger ones get 413, 0 means unlimited
+	MaxBodySize      int64            `json:"max_body_size"`
+	RequestBuffering RequestBuffering `json:"request_buffering"`
+	// basic auth or API key, either is enough if both are configured
+	ClientAuth  ClientAuth  `json:"client_auth"`
+	ForwardAuth ForwardAuth `json:"forward_auth"`
+	TCP         TCP         `json:"tcp"`
+	Bandwidth   Bandwidth   `json:"bandwidth"`
+	// answered by golb on the listener, 200 if a peer is healthy and 503 otherwise, e.g. /healthz
+	// for a hardware LB probe, empty disables it
+	HealthzPath string `json:"healthz_path"`
+	// outcomes counted as failures of a peer: "error" (connect error), "timeout", "5xx"
+	// or a status code like "503", empty means error, timeout and 5xx
+	FailOn []string `json:"fail_on"`
+	// filters run in order at the request and response phases
+	Scripts []Script `json:"scripts"`
+	// template of the key hashed by the chash and ip_hash methods, e.g. "$cookie_session",
+	// empty or an empty expansion means the client address
+	HashKey     string      `json:"hash_key"`
+	UpstreamTLS UpstreamTLS `json:"upstream_tls"`
+	// policy of the https listener for server_name
+	TLS  TLS  `json:"tls"`
+	Dial Dial `json:"dial"`
+}
+
+// RequestBuffering controls how the request bodies are sent to the peers
+type RequestBuffering struct {
+	// stream (default) sends a body as it is read, memory reads it whole first, spool reads
+	// it whole too, in memory up to spool_threshold bytes and in a temporary file above.
+	// A buffered body is retried as is, and the peer gets its Content-Length, a streamed
+	// body is not retried
+	Mode string `json:"mode"`
+	// 0 means 1 MiB
+	SpoolThreshold int64 `json:"spool_threshold"`
+	// directory of the temporary files, empty means the system one
+	TempDir string `json:"temp_dir"`
+}
+
+// Dial tunes the connections to the peers configured by host name, their A and AAAA records
+type Dial struct {
+	// dual (default, IPv6 first), prefer_ipv4, ipv4 or ipv6
+	Family string `json:"family"`
+	// milliseconds between the connection attempts of Happy Eyeballs (RFC 8305) to the addresses
+	// of a host name, 0 means 250, negative tries them one after the other
+	FallbackDelay int `json:"fallback_delay"`
+}
+
+// TLS restricts the TLS negotiated by the clients of an https virtual server, the zero
+// values mean the Go defaults
+type TLS struct {
+	// "1.0" to "1.3"
+	MinVersion string `json:"min_version"`
+	MaxVersion string `json:"max_version"`
+	// names of crypto/tls, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, the TLS 1.3 suites are
+	// not configurable
+	CipherSuites []string `json:"cipher_suites"`
+	// X25519, P256, P384 or P521, in the order of preference
+	Curves []string `json:"curves"`
+	// protocols offered by ALPN, empty means h2 and http/1.1
+	ALPN []string `json:"alpn"`
+	// DER OCSP response stapled to the certificate until its next update, read on start and reload
+	// and checked for changes every minute, it is refreshed by an external job, e.g. openssl ocsp
+	OCSPFile string `json:"ocsp_file"`
+}
+
+// UpstreamTLS tunes the TLS client of the connections to the https peers
+type UpstreamTLS struct {
+	// sessions cached for resumption, 0 means 64, negative disables the resumption
+	SessionCacheSize int `json:"session_cache_size"`
+	// "1.0" to "1.3", empty means the Go defaults
+	MinVersion string `json:"min_version"`
+	MaxVersion string `json:"max_version"`
+	// names of crypto/tls, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, empty means the Go defaults,
+	// the TLS 1.3 suites are not configurable
+	CipherSuites []string `json:"cipher_suites"`
+	// protocols offered by ALPN, e.g. ["http/1.1"], HTTP/2 is used only if "h2" is listed,
+	// empty means h2 and http/1.1
+	ALPN []string `json:"alpn"`
+}
+
+// Script is a request filter of a language whose engine is registered by the program
+// embedding the balancer, golb registers "lua", see package lua
+type Script struct {
+	Engine string `json:"engine"`
+	File   string `json:"file"`
+}
+
+// Bandwidth shapes the response bodies in bytes per second, 0 means no limit
+type Bandwidth struct {
+	// of every client connection
+	PerConnection int `json:"per_connection"`
+	// of all the responses of the virtual server
+	Total int `json:"total"`
+	// bytes sent at once before shaping, 0 means 16384
+	Burst int `json:"burst"`
+}
+
+// TCP tunes the listener sockets and the client connections, the zero values keep the defaults
+type TCP struct {
+	// turns Nagle's algorithm on, TCP_NODELAY is set by default
+	DisableNoDelay bool `json:"disable_nodelay"`
+	// seconds idle before the keepalive probes, seconds between the probes, and the probes
+	// unanswered before the connection is dropped, 0 means the default of Go: 15, 15 and 9
+	KeepAliveIdle     int `json:"keepalive_idle"`
+	KeepAliveInterval int `json:"keepalive_interval"`
+	KeepAliveCount    int `json:"keepalive_count"`
+	// seconds a connection waits for its first data before it is accepted (TCP_DEFER_ACCEPT)
+	DeferAccept int `json:"defer_accept"`
+	// connections queued before accepted, capped by net.core.somaxconn
+	Backlog int `json:"backlog"`
+	// seconds to send the unsent data on close (SO_LINGER), -1 resets the connection at once
+	Linger int `json:"linger"`
+}
+
+// ForwardAuth authorizes the requests by a subrequest to an external service, e.g. oauth2-proxy,
+// a 2xx response lets the request through, the others are returned to the client
+type ForwardAuth struct {
+	// empty disables it
+	URL string `json:"url"`
+	// milliseconds, 0 means 5000
+	Timeout int `json:"timeout"`
+	// headers of the auth response copied to the proxied request, e.g. ["X-Auth-Request-User"]
+	ResponseHeaders []string `json:"response_headers"`
+}
+
+// ClientAuth authenticates the clients by the users of an htpasswd file
+// (htpasswd -B, -m or -s), or static API keys
+type ClientAuth struct {
+	Htpasswd string `json:"htpasswd"`
+	// realm of the basic auth, "golb" if empty
+	Realm   string   `json:"realm"`
+	APIKeys []string `json:"api_keys"`
+	// header of the API key, X-API-Key if empty
+	APIKeyHeader string `json:"api_key_header"`
+}
+
+// JWT authenticates the requests by a Bearer JSON Web Token, signed with secret (HMAC),
+// the key of key_file (PEM RSA/ECDSA public key or certificate), or a key of jwks_url
+type JWT struct {
+	Enable  bool   `json:"enable"`
+	Secret  string `json:"secret"`
+	KeyFile string `json:"key_file"`
+	JWKSURL string `json:"jwks_url"`
+	// seconds between the fetches of jwks_url, 0 means an hour
+	JWKSRefresh int `json:"jwks_refresh"`
+	// required iss and aud claims, empty means not checked
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// seconds of clock skew tolerated
+	Leeway int `json:"leeway"`
+	// claim -> request header forwarded to the peers, e.g. {"sub":"X-User"},
+	// the headers sent by the clients are removed
+	ClaimHeaders map[string]string `json:"claim_headers"`
+}
+
+// WAF rejects with a 403 the requests matching the SQL injection and cross-site scripting
+// patterns of package waf, in the path, the query, the Cookie, Referer and User-Agent headers and the body
+type WAF struct {
+	Enable bool `json:"enable"`
+	// bytes of the request body inspected, 0 means 64KB, negative none
+	MaxBodySize int `json:"max_body_size"`
+}
+
+// KeepAlive tunes the reuse of the connections to the peers, the zero values are
+// 1024 idle connections, 64 per peer, closed after 90 seconds idle
+type KeepAlive struct {
+	// negative means no limit
+	MaxIdleConns        int `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"`
+	// seconds
+	IdleTimeout int `json:"idle_timeout"`
+	// a new connection per request
+	Disable bool `json:"disable"`
+}
+
+// ErrorPage is a Go text/template, from a file or inline, with the variables
+// {{.Status}}, {{.StatusText}}, {{.Message}}, {{.VirtualServer}}, {{.RequestID}}, {{.Host}}, {{.Path}} and {{.Time}}
+type ErrorPage struct {
+	File     string `json:"file"`
+	Template string `json:"template"`
+	// empty means text/html; charset=utf-8
+	ContentType string `json:"content_type"`
 }
 
 type Authentication struct {
@@ -38,6 +590,20 @@ type Authentication struct {
 type Controller struct {
 	Address string         `json:"address"`
 	Auth    Authentication `json:"auth"`
+	// serves the stats and health endpoints on a separate address too
+	Metrics MetricsListener `json:"metrics"`
+	// serves /debug/pprof and /debug/vars, behind the authentication
+	Debug bool `json:"debug"`
+	// serves the web UI on /ui/, behind the authentication
+	UI bool `json:"ui"`
+}
+
+// MetricsListener serves the read-only endpoints, e.g. to the monitoring network
+type MetricsListener struct {
+	// empty disables the listener
+	Address string `json:"address"`
+	// an empty username disables the authentication
+	Auth Authentication `json:"auth"`
 }
 
 type ServiceDiscovery struct {
@@ -47,37 +613,216 @@ type ServiceDiscovery struct {
 	CertFile      string `json:"cert_file"`
 	KeyFile       string `json:"key_file"`
 	TrustedCAFile string `json:"trusted_ca_file"`
+	// consul ACL token, kubernetes bearer token, or gce access token
+	Token string `json:"token"`
+	// seconds between polls of the cloud APIs (ec2, gce), 0 means 60
+	Interval int `json:"interval"`
+}
+
+type DNS struct {
+	Servers    []string `json:"servers"`
+	Protocol   string   `json:"protocol"`
+	ServerName string   `json:"server_name"`
+	// query timeout in seconds
+	Timeout int `json:"timeout"`
 }
 
 type Configuration struct {
+	DNS              DNS              `json:"dns"`
 	ServiceDiscovery ServiceDiscovery `json:"service_discovery"`
 	Controller       Controller       `json:"controller"`
 	VServers         []VirtualServer  `json:"virtual_server"`
+	Reload           Reload           `json:"reload"`
+	Events           Events           `json:"events"`
+	Guardrails       Guardrails       `json:"guardrails"`
+	Cluster          Cluster          `json:"cluster"`
+	Failover         Failover         `json:"failover"`
+	// file saving the topology changed at runtime, see State, empty disables it
+	StateFile string    `json:"state_file"`
+	Log       Log       `json:"log"`
+	Stats     StatsFile `json:"stats"`
 }
 
-func Load(configFile string) (*Configuration, error) {
-	file, err := os.Open(configFile)
-	if err != nil {
-		return nil, err
+// StatsFile checkpoints the counters of the pool members to a file and adds them back on
+// startup, so the long-term totals (requests, bytes, latency) are not reset by a deploy
+type StatsFile struct {
+	// empty disables it
+	File string `json:"file"`
+	// seconds between the checkpoints, 0 means 60
+	Interval int `json:"interval"`
+	// starts with fresh counters instead of those of the file, which is still written
+	Fresh bool `json:"fresh"`
+}
+
+// Log configures the logging, it is applied again on reload
+type Log struct {
+	// panic, fatal, error, warning, info or debug, empty means info
+	Level string `json:"level"`
+	// text or json, empty means text
+	Format string `json:"format"`
+	// stdout, stderr, syslog, journald, a syslog address (udp://host:514, tcp://host:601,
+	// unix:///dev/log) or the path of a file, empty means stderr
+	Output string `json:"output"`
+	// level by package, e.g. {"balancer": "debug", "discovery": "error"}
+	Modules map[string]string `json:"modules"`
+}
+
+// Failover elects the master of the golb nodes sharing a virtual IP, keepalived style: the nodes
+// advertise their priority over UDP, the highest alive is the master, and the notify scripts move
+// the virtual IP, e.g. "ip addr add $GOLB_VIRTUAL_IP dev eth0"
+type Failover struct {
+	// UDP address receiving the advertisements, e.g. 10.0.0.1:1985, empty disables the failover
+	Address string `json:"address"`
+	// UDP addresses of the other nodes
+	Peers []string `json:"peers"`
+	// 1 to 255, 0 means 100, the highest alive is the master
+	Priority int `json:"priority"`
+	// seconds between the advertisements, 0 means 1, the master is down after missing 3
+	Interval int `json:"interval"`
+	// a backup of higher priority waits for the master to fail instead of taking over
+	NoPreempt bool `json:"nopreempt"`
+	// shared by the nodes to authenticate the advertisements
+	Secret string `json:"secret"`
+	// passed to the scripts in GOLB_VIRTUAL_IP
+	VirtualIP string `json:"virtual_ip"`
+	// shell commands run on becoming the master or a backup
+	NotifyMaster string `json:"notify_master"`
+	NotifyBackup string `json:"notify_backup"`
+}
+
+// Cluster shares the peer failures and the rate limit counters between golb instances, each
+// instance posts its state to the controllers of the other members every interval, so the farm
+// marks a failing peer down together and limits a client by its requests to all the instances
+type Cluster struct {
+	// unique name of this instance, empty disables the cluster
+	Node string `json:"node"`
+	// controller URLs of the other instances, e.g. http://10.0.0.2:6587
+	Members []string `json:"members"`
+	// seconds between the gossip rounds, 0 means 1
+	Interval int `json:"interval"`
+	// credentials of the controllers of the members, an empty username means the ones of this controller
+	Auth Authentication `json:"auth"`
+}
+
+// Guardrails watches the resource usage of golb itself. Over a soft limit, a share of the new
+// requests is shed, rising to all of them at the hard limit, and an alert is sent to the events.
+// Over a hard limit, the new connections are refused too
+type Guardrails struct {
+	// seconds between the checks, 0 means 5
+	Interval int            `json:"interval"`
+	Soft     ResourceLimits `json:"soft"`
+	Hard     ResourceLimits `json:"hard"`
+}
+
+// ResourceLimits of the process, 0 means no limit
+type ResourceLimits struct {
+	// open file descriptors, including the connections
+	FDs        int `json:"fds"`
+	Goroutines int `json:"goroutines"`
+	// allocated heap in MB
+	HeapMB int `json:"heap_mb"`
+}
+
+// Events posts the peer and virtual server events, e.g. a peer marked down, to a webhook
+type Events struct {
+	// URL of the webhook, empty disables it
+	Webhook string `json:"webhook"`
+	// seconds to wait for the webhook, 0 means 5
+	Timeout int `json:"timeout"`
+}
+
+// Reload rolls out the virtual servers changed by a reloaded configuration in batches,
+// the added, changed and removed ones, each batch is watched for pause seconds
+// before the next one, and all the changes are rolled back if its error rate spikes
+type Reload struct {
+	// virtual servers changed at a time, 0 means all of them at once
+	BatchSize int `json:"batch_size"`
+	Pause     int `json:"pause"`
+	// percent of 5xx responses a batch may serve, 0 disables the check
+	MaxErrorPercent float64 `json:"max_error_percent"`
+	// a batch serving fewer requests is not checked
+	MinRequests uint64 `json:"min_requests"`
+}
+
+// Debug adds a X-Golb-Trace response header describing the upstream selection
+// to the requests whose X-Golb-Debug header is the token
+type Debug struct {
+	// empty disables it
+	Token string `json:"token"`
+	// the requests whose X-Golb-Upstream header is a pool member are sent to it, even if it is down
+	Upstream bool `json:"upstream"`
+	// IPs or CIDRs of the clients allowed to use X-Golb-Upstream, empty means loopback only
+	AllowFrom []string `json:"allow_from"`
+}
+
+// REDACTED replaces the secrets in the dumped configuration
+const REDACTED = "******"
+
+// Redacted returns a copy of c with the secrets replaced by REDACTED
+func (c *Configuration) Redacted() *Configuration {
+	r := *c
+	if r.Controller.Auth.Password != "" {
+		r.Controller.Auth.Password = REDACTED
+	}
+	if r.Controller.Metrics.Auth.Password != "" {
+		r.Controller.Metrics.Auth.Password = REDACTED
+	}
+	if r.ServiceDiscovery.Token != "" {
+		r.ServiceDiscovery.Token = REDACTED
+	}
+	// the URL of a webhook usually embeds its token
+	if r.Events.Webhook != "" {
+		r.Events.Webhook = REDACTED
+	}
+	if r.Cluster.Auth.Password != "" {
+		r.Cluster.Auth.Password = REDACTED
+	}
+	if r.Failover.Secret != "" {
+		r.Failover.Secret = REDACTED
 	}
-	defer file.Close()
+	r.VServers = append([]VirtualServer(nil), c.VServers...)
+	for i := range r.VServers {
+		if r.VServers[i].Debug.Token != "" {
+			r.VServers[i].Debug.Token = REDACTED
+		}
+		if r.VServers[i].JWT.Secret != "" {
+			r.VServers[i].JWT.Secret = REDACTED
+		}
+		if keys := r.VServers[i].ClientAuth.APIKeys; len(keys) > 0 {
+			r.VServers[i].ClientAuth.APIKeys = make([]string, len(keys))
+			for j := range keys {
+				r.VServers[i].ClientAuth.APIKeys[j] = REDACTED
+			}
+		}
+	}
+	return &r
+}
 
-	c := &Configuration{}
-	decoder := json.NewDecoder(file)
-	if err = decoder.Decode(c); err != nil {
+// Load loads the configuration file, see preprocess for the environment variables,
+// includes and defaults
+func Load(configFile string) (*Configuration, error) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
 		return nil, err
 	}
-	if err = c.check(); err != nil {
+	abs, err := filepath.Abs(configFile)
+	if err != nil {
 		return nil, err
 	}
-	return c, nil
+	return load(data, filepath.Dir(abs), []string{abs})
 }
 
+// LoadFromString loads the configuration, the included files are relative to the working directory
 func LoadFromString(config string) (*Configuration, error) {
-	var err error
-	c := &Configuration{}
-	decoder := json.NewDecoder(strings.NewReader(config))
-	if err = decoder.Decode(c); err != nil {
+	return load([]byte(config), ".", nil)
+}
+
+func load(data []byte, dir string, files []string) (*Configuration, error) {
+	c, _, err := decode(data, dir, files)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.decrypt(); err != nil {
 		return nil, err
 	}
 	if err = c.check(); err != nil {
@@ -1,7 +1,12 @@
 package config
 
 import (
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -107,3 +112,242 @@ func TestCheckVirtualServerAddress(t *testing.T) {
 	assert.Equal(t, ErrVirtualServerAddressEmpty, err)
 	assert.Nil(t, c)
 }
+
+func TestRedacted(t *testing.T) {
+	c := &Configuration{
+		Controller: Controller{Address: ":6587", Auth: Authentication{Username: "admin", Password: "secret"},
+			Metrics: MetricsListener{Address: ":6588", Auth: Authentication{Username: "prom", Password: "scrape"}}},
+		ServiceDiscovery: ServiceDiscovery{Type: "consul", Token: "acl-token"},
+		Events:           Events{Webhook: "https://hooks.example.com/services/T000/B000/token", Timeout: 3},
+		Cluster:          Cluster{Auth: Authentication{Username: "golb", Password: "cluster"}},
+		Failover:         Failover{Secret: "vrrp"},
+		VServers: []VirtualServer{{Name: "web", Debug: Debug{Token: "debug-token"}, JWT: JWT{Secret: "jwt-secret"},
+			ClientAuth: ClientAuth{APIKeys: []string{"key"}}}},
+	}
+	r := c.Redacted()
+	assert.Equal(t, "admin", r.Controller.Auth.Username)
+	assert.Equal(t, REDACTED, r.Controller.Auth.Password)
+	assert.Equal(t, REDACTED, r.Controller.Metrics.Auth.Password)
+	assert.Equal(t, REDACTED, r.ServiceDiscovery.Token)
+	// the original is untouched
+	assert.Equal(t, "secret", c.Controller.Auth.Password)
+	assert.Equal(t, REDACTED, r.VServers[0].Debug.Token)
+	assert.Equal(t, "debug-token", c.VServers[0].Debug.Token)
+	assert.Equal(t, REDACTED, r.VServers[0].JWT.Secret)
+	assert.Equal(t, "jwt-secret", c.VServers[0].JWT.Secret)
+	assert.Equal(t, []string{REDACTED}, r.VServers[0].ClientAuth.APIKeys)
+	assert.Equal(t, []string{"key"}, c.VServers[0].ClientAuth.APIKeys)
+	assert.Equal(t, REDACTED, r.Events.Webhook)
+	assert.Equal(t, 3, r.Events.Timeout)
+	assert.Equal(t, "https://hooks.example.com/services/T000/B000/token", c.Events.Webhook)
+	// every field which may be encrypted is a secret
+	for name, field := range r.secrets() {
+		assert.Equal(t, REDACTED, *field, name)
+	}
+
+	assert.Empty(t, (&Configuration{}).Redacted().ServiceDiscovery.Token)
+}
+
+func TestDecrypt(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	password, err := Encrypt(key, "secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(password, ENCRYPTED_PREFIX))
+	token, err := Encrypt(key, "debug-token")
+	require.NoError(t, err)
+	jsonBody := fmt.Sprintf(`{"controller":{"auth":{"username":"admin","password":%q}},`+
+		`"virtual_server":[{"name":"web","address":":80","debug":{"token":%q}}]}`, password, token)
+
+	os.Unsetenv(ENV_CONFIG_KEY)
+	_, err = LoadFromString(jsonBody)
+	assert.Equal(t, ErrConfigKeyEmpty, err)
+
+	os.Setenv(ENV_CONFIG_KEY, base64.StdEncoding.EncodeToString(key))
+	defer os.Unsetenv(ENV_CONFIG_KEY)
+	c, err := LoadFromString(jsonBody)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", c.Controller.Auth.Password)
+	assert.Equal(t, "debug-token", c.VServers[0].Debug.Token)
+
+	// another key
+	key[0] = 0xff
+	os.Setenv(ENV_CONFIG_KEY, base64.StdEncoding.EncodeToString(key))
+	_, err = LoadFromString(jsonBody)
+	assert.Error(t, err)
+
+	// the plaintext values need no key
+	os.Unsetenv(ENV_CONFIG_KEY)
+	c, err = LoadFromString(`{"controller":{"auth":{"username":"admin","password":"secret"}}}`)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", c.Controller.Auth.Password)
+
+	SetDecrypter(func(ciphertext []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(ciphertext))), nil
+	})
+	defer SetDecrypter(nil)
+	c, err = LoadFromString(`{"service_discovery":{"token":"enc:` + base64.StdEncoding.EncodeToString([]byte("kms")) + `"}}`)
+	require.NoError(t, err)
+	assert.Equal(t, "KMS", c.ServiceDiscovery.Token)
+}
+
+func TestValidate(t *testing.T) {
+	valid := `{"controller":{"address":"127.0.0.1:6587"},"virtual_server":[
+		{"name":"web","address":"127.0.0.1:8081","server_name":"localhost","pool":[{"address":"127.0.0.1:10001"},{"address":"10.0.0.2"}]},
+		{"name":"api","address":"127.0.0.1:8081","server_name":"api.local","rules":[{"path_prefix":"/v1","pool":[{"address":"[::1]:10003"}]}]}]}`
+	assert.NoError(t, Validate([]byte(valid)))
+
+	invalid := `{"controller":{"address":"127.0.0.1:70000","adress":":6587"},"cluster":{"members":["10.0.0.2:6587"]},"failover":{"address":"127.0.0.1:1985"},
+		"log":{"level":"verbose","modules":{"balancer":"trace"}},"virtual_server":[
+		{"name":"web","address":"127.0.0.1:8081","server_name":"localhost","lb_mthod":"p2c",
+		 "pool":[{"address":"127.0.0.1:10001","weight":-1,"wieght":2},{"address":"127.0.0.1:10001"}]},
+		{"name":"web","address":"127.0.0.1:8081","server_name":"localhost"},
+		{"name":"tls","address":"127.0.0.1:8081","protocol":"https","cert_file":"no_cert.pem"},
+		{"name":"bad","address":"8082","health_check":{"port":65536},"debug":{"allow_from":["10.0.0.1","10.0.0.0/33"]},
+		 "compression":{"enable":true,"encodings":["br","deflate"],"brotli_level":12}}]}`
+	err := Validate([]byte(invalid))
+	require.IsType(t, &ValidationError{}, err)
+	assert.Equal(t, []string{
+		"unknown field controller.adress",
+		"unknown field virtual_server.0.lb_mthod",
+		"unknown field virtual_server.0.pool.0.wieght",
+		`cluster: member "10.0.0.2:6587" should be an absolute URL`,
+		"cluster: node should be set with members",
+		`controller.address "127.0.0.1:70000": invalid port "70000"`,
+		"failover: peers should be set",
+		`log: module balancer: unknown level "trace"`,
+		`log: unknown level "verbose"`,
+		`virtual_server bad: address "8082": address 8082: missing port in address`,
+		"virtual_server bad: compression: level should be 1 to 9, brotli_level 1 to 11",
+		`virtual_server bad: compression: unknown encoding "deflate"`,
+		`virtual_server bad: debug.allow_from "10.0.0.0/33": invalid CIDR address: 10.0.0.0/33`,
+		"virtual_server bad: health_check port 65536 out of range",
+		"virtual_server tls: address 127.0.0.1:8081 is used by http, not https",
+		`virtual_server tls: cert_file "no_cert.pem" does not exist`,
+		"virtual_server tls: https needs cert_file and key_file",
+		"virtual_server web: Vritual Server Duplicated",
+		"virtual_server web: pool member 127.0.0.1:10001: Pool Member Duplicated",
+		"virtual_server web: pool member 127.0.0.1:10001: negative weight -1",
+		`virtual_server web: server name "localhost" on 127.0.0.1:8081 is used by web`,
+	}, err.(*ValidationError).Problems)
+
+	_, ok := Validate([]byte("not json")).(*ValidationError)
+	assert.False(t, ok)
+	assert.Error(t, ValidateFile("no_file.json"))
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("GOLB_TEST_ADDRESS", "127.0.0.1:8081")
+	os.Setenv("GOLB_TEST_PASSWORD", `p"a\ss`)
+	defer os.Unsetenv("GOLB_TEST_ADDRESS")
+	defer os.Unsetenv("GOLB_TEST_PASSWORD")
+
+	c, err := LoadFromString(`{"controller":{"auth":{"password":"${GOLB_TEST_PASSWORD}"}},
+		"virtual_server":[{"name":"web","address":"${GOLB_TEST_ADDRESS}",
+		"rewrites":[{"regex":"^/(?P<name>\\w+)$","replacement":"/x/${name}"}]}]}`)
+	require.NoError(t, err)
+	assert.Equal(t, `p"a\ss`, c.Controller.Auth.Password)
+	assert.Equal(t, "127.0.0.1:8081", c.VServers[0].Address)
+	// undefined, kept for the rewrite
+	assert.Equal(t, "/x/${name}", c.VServers[0].Rewrites[0].Replacement)
+}
+
+func TestDefaults(t *testing.T) {
+	c, err := LoadFromString(`{"defaults":{"server_name":"localhost","lb_method":"p2c",
+		"health_check":{"path":"/health","interval":10},"pool":[{"address":"127.0.0.1:10001"}]},
+		"virtual_server":[
+		{"name":"web","address":":8081"},
+		{"name":"api","address":":8082","lb_method":"round-robin","health_check":{"interval":3},
+		 "pool":[{"address":"127.0.0.1:10002","weight":2}]}]}`)
+	require.NoError(t, err)
+	web, api := c.VServers[0], c.VServers[1]
+	assert.Equal(t, "localhost", web.ServerName)
+	assert.Equal(t, "p2c", web.LBMethod)
+	assert.Equal(t, HealthCheck{Path: "/health", Interval: 10}, web.HealthCheck)
+	assert.Equal(t, []Server{{Address: "127.0.0.1:10001", Weight: 1}}, web.Pool)
+
+	assert.Equal(t, "localhost", api.ServerName)
+	assert.Equal(t, "round-robin", api.LBMethod)
+	// merged field by field
+	assert.Equal(t, HealthCheck{Path: "/health", Interval: 3}, api.HealthCheck)
+	assert.Equal(t, []Server{{Address: "127.0.0.1:10002", Weight: 2}}, api.Pool)
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "vs"), 0755))
+
+	ioutil.WriteFile(filepath.Join(dir, "golb.json"), []byte(`{"controller":{"address":":6587"},
+		"defaults":{"server_name":"localhost"},
+		"virtual_server":[{"name":"web","address":":8081"}],"include":["vs/*.json"]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "vs", "b.json"), []byte(`{"virtual_server":[{"name":"b","address":":8083"}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "vs", "a.json"), []byte(`{"controller":{"address":":1"},
+		"defaults":{"lb_method":"random"},"virtual_server":[{"name":"a","address":":8082"}]}`), 0644)
+
+	c, err := Load(filepath.Join(dir, "golb.json"))
+	require.NoError(t, err)
+	assert.Equal(t, ":6587", c.Controller.Address)
+	require.Len(t, c.VServers, 3)
+	assert.Equal(t, "web", c.VServers[0].Name)
+	assert.Equal(t, "localhost", c.VServers[0].ServerName)
+	// sorted by file name, with the defaults of their file
+	assert.Equal(t, "a", c.VServers[1].Name)
+	assert.Equal(t, "random", c.VServers[1].LBMethod)
+	assert.Equal(t, "", c.VServers[1].ServerName)
+	assert.Equal(t, "b", c.VServers[2].Name)
+	assert.NoError(t, ValidateFile(filepath.Join(dir, "golb.json")))
+
+	// the names are checked across the files
+	ioutil.WriteFile(filepath.Join(dir, "vs", "c.json"), []byte(`{"virtual_server":[{"name":"web","address":":8084"}]}`), 0644)
+	_, err = Load(filepath.Join(dir, "golb.json"))
+	assert.Equal(t, ErrVirtualServerDuplicated, err)
+
+	ioutil.WriteFile(filepath.Join(dir, "vs", "c.json"), []byte(`{"include":["../golb.json"]}`), 0644)
+	_, err = Load(filepath.Join(dir, "golb.json"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ErrIncludeCycle.Error())
+}
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+
+	st, err := LoadState(file)
+	require.NoError(t, err)
+	assert.Nil(t, st)
+
+	st = &State{
+		Pools:   map[string][]Server{"web": {{Address: "127.0.0.1:10003", Weight: 2}}},
+		Added:   []VirtualServer{{Name: "staging", Address: "127.0.0.1:9081"}, {Name: "api", Address: "127.0.0.1:9082"}},
+		Removed: []string{"redis"},
+	}
+	require.NoError(t, SaveState(file, st))
+	fi, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	loaded, err := LoadState(file)
+	require.NoError(t, err)
+	assert.Equal(t, st, loaded)
+	// no temporary file left
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	c, err := LoadFromString(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","pool":[{"address":"127.0.0.1:10001"}]},
+		{"name":"redis","address":"127.0.0.1:6379"},{"name":"api","address":"127.0.0.1:8082"}]}`)
+	require.NoError(t, err)
+	c.MergeState(loaded)
+	require.Len(t, c.VServers, 3)
+	assert.Equal(t, "web", c.VServers[0].Name)
+	assert.Equal(t, []Server{{Address: "127.0.0.1:10003", Weight: 2}}, c.VServers[0].Pool)
+	// the configuration wins over an added one of the same name
+	assert.Equal(t, "api", c.VServers[1].Name)
+	assert.Equal(t, "127.0.0.1:8082", c.VServers[1].Address)
+	assert.Equal(t, "staging", c.VServers[2].Name)
+}
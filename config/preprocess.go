@@ -0,0 +1,159 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+var ErrIncludeCycle = errors.New("Include Cycle")
+
+// ${NAME} of an environment variable
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} in data by the JSON escaped value of the environment variable NAME,
+// the undefined ones are kept, e.g. the ${name} groups of the rewrite replacements
+func expandEnv(data []byte) []byte {
+	return envVar.ReplaceAllFunc(data, func(m []byte) []byte {
+		value, ok := os.LookupEnv(string(envVar.FindSubmatch(m)[1]))
+		if !ok {
+			return m
+		}
+		escaped, _ := json.Marshal(value)
+		return escaped[1 : len(escaped)-1]
+	})
+}
+
+// preprocess returns the JSON object of data with the environment variables expanded,
+// the defaults applied, and the virtual servers of the included files appended:
+//
+//	"defaults": {...} is a virtual server whose fields are taken by the virtual servers
+//	of the file not setting them, the objects are merged field by field
+//	"include": ["vs/*.json"] appends the virtual servers of the files matching the patterns,
+//	relative to dir, in the order of the patterns and the file names, the other sections
+//	of the included files are ignored
+//
+// files are the absolute paths of the including files, to detect cycles
+func preprocess(data []byte, dir string, files []string) (map[string]interface{}, error) {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(expandEnv(data), &obj); err != nil {
+		return nil, err
+	}
+
+	vss, _ := obj["virtual_server"].([]interface{})
+	if defaults, ok := obj["defaults"]; ok {
+		d, ok := defaults.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("defaults should be an object")
+		}
+		// the included virtual servers have the defaults of their own file
+		for i, vs := range vss {
+			if m, ok := vs.(map[string]interface{}); ok {
+				vss[i] = merge(d, m)
+			}
+		}
+		delete(obj, "defaults")
+	}
+
+	if include, ok := obj["include"]; ok {
+		patterns, ok := include.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("include should be a list of file patterns")
+		}
+		for _, p := range patterns {
+			pattern, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("include should be a list of file patterns")
+			}
+			included, err := includeFiles(pattern, dir, files)
+			if err != nil {
+				return nil, err
+			}
+			vss = append(vss, included...)
+		}
+		delete(obj, "include")
+	}
+	if vss != nil {
+		obj["virtual_server"] = vss
+	}
+	return obj, nil
+}
+
+// includeFiles returns the virtual servers of the files matching pattern
+func includeFiles(pattern, dir string, files []string) ([]interface{}, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	vss := []interface{}{}
+	for _, file := range matches {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f == abs {
+				return nil, fmt.Errorf("%s: %v", file, ErrIncludeCycle)
+			}
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		obj, err := preprocess(data, filepath.Dir(abs), append(files, abs))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if v, ok := obj["virtual_server"].([]interface{}); ok {
+			vss = append(vss, v...)
+		}
+	}
+	return vss, nil
+}
+
+// merge returns the fields of defaults not in obj added to obj, the objects merged recursively
+func merge(defaults, obj map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		result[k] = v
+	}
+	for k, dv := range defaults {
+		v, ok := result[k]
+		if !ok {
+			result[k] = dv
+			continue
+		}
+		dm, dok := dv.(map[string]interface{})
+		m, ok := v.(map[string]interface{})
+		if dok && ok {
+			result[k] = merge(dm, m)
+		}
+	}
+	return result
+}
+
+// decode preprocesses data included from dir, and decodes the configuration
+func decode(data []byte, dir string, files []string) (*Configuration, map[string]interface{}, error) {
+	obj, err := preprocess(data, dir, files)
+	if err != nil {
+		return nil, nil, err
+	}
+	processed, err := json.Marshal(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &Configuration{}
+	if err := json.Unmarshal(processed, c); err != nil {
+		return nil, nil, err
+	}
+	return c, obj, nil
+}
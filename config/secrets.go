@@ -0,0 +1,149 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// prefix of the encrypted values, followed by the base64 of the nonce and the AES-GCM ciphertext
+	ENCRYPTED_PREFIX = "enc:"
+	// base64 of the 32 bytes AES-256 key decrypting the values
+	ENV_CONFIG_KEY = "GOLB_CONFIG_KEY"
+)
+
+var (
+	ErrConfigKeyEmpty   = errors.New("Config Key is not specified")
+	ErrInvalidConfigKey = errors.New("Config Key should be 32 bytes in base64")
+	ErrInvalidEncrypted = errors.New("Encrypted Value is invalid")
+)
+
+// Decrypter returns the plaintext of an encrypted value, without ENCRYPTED_PREFIX and base64
+type Decrypter func(ciphertext []byte) ([]byte, error)
+
+var (
+	decrypter_lock sync.Mutex
+	decrypter      Decrypter
+)
+
+// SetDecrypter decrypts the values by d instead of the key of ENV_CONFIG_KEY,
+// e.g. to unwrap them by a KMS, nil restores the default
+func SetDecrypter(d Decrypter) {
+	decrypter_lock.Lock()
+	defer decrypter_lock.Unlock()
+	decrypter = d
+}
+
+// Encrypt returns the value of plaintext to put in the configuration, encrypted by key
+func Encrypt(key []byte, plaintext string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return ENCRYPTED_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// KeyFromEnv returns the key of ENV_CONFIG_KEY
+func KeyFromEnv() ([]byte, error) {
+	env := os.Getenv(ENV_CONFIG_KEY)
+	if env == "" {
+		return nil, ErrConfigKeyEmpty
+	}
+	key, err := base64.StdEncoding.DecodeString(env)
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidConfigKey
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidConfigKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyDecrypter decrypts the values encrypted by Encrypt with key
+func keyDecrypter(key []byte) (Decrypter, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return func(ciphertext []byte) ([]byte, error) {
+		if len(ciphertext) < aead.NonceSize() {
+			return nil, ErrInvalidEncrypted
+		}
+		nonce := ciphertext[:aead.NonceSize()]
+		return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], nil)
+	}, nil
+}
+
+// secrets returns the fields of c which may be encrypted
+func (c *Configuration) secrets() map[string]*string {
+	fields := map[string]*string{
+		"controller.auth.password":         &c.Controller.Auth.Password,
+		"controller.metrics.auth.password": &c.Controller.Metrics.Auth.Password,
+		"service_discovery.token":          &c.ServiceDiscovery.Token,
+		"events.webhook":                   &c.Events.Webhook,
+		"cluster.auth.password":            &c.Cluster.Auth.Password,
+		"failover.secret":                  &c.Failover.Secret,
+	}
+	for i := range c.VServers {
+		fields[c.VServers[i].Name+".debug.token"] = &c.VServers[i].Debug.Token
+		fields[c.VServers[i].Name+".jwt.secret"] = &c.VServers[i].JWT.Secret
+		for j := range c.VServers[i].ClientAuth.APIKeys {
+			fields[fmt.Sprintf("%s.client_auth.api_keys.%d", c.VServers[i].Name, j)] = &c.VServers[i].ClientAuth.APIKeys[j]
+		}
+	}
+	return fields
+}
+
+// decrypt replaces the encrypted values of c by their plaintext, the key is only
+// needed if any value is encrypted
+func (c *Configuration) decrypt() error {
+	decrypter_lock.Lock()
+	d := decrypter
+	decrypter_lock.Unlock()
+
+	for name, field := range c.secrets() {
+		if !strings.HasPrefix(*field, ENCRYPTED_PREFIX) {
+			continue
+		}
+		if d == nil {
+			key, err := KeyFromEnv()
+			if err != nil {
+				return err
+			}
+			if d, err = keyDecrypter(key); err != nil {
+				return err
+			}
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(*field, ENCRYPTED_PREFIX))
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, ErrInvalidEncrypted)
+		}
+		plaintext, err := d(ciphertext)
+		if err != nil {
+			return fmt.Errorf("decrypt %s error=%v", name, err)
+		}
+		*field = string(plaintext)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// State is the topology changed at runtime, e.g. by the controller, saved to the state file
+// and merged into the configuration on startup, so the changes survive a restart.
+// A reload applies the configuration as is, and the state is saved again from it
+type State struct {
+	// pool members of the virtual servers of the configuration, by name
+	Pools map[string][]Server `json:"pools"`
+	// virtual servers added at runtime, e.g. cloned
+	Added []VirtualServer `json:"added"`
+	// names of the virtual servers of the configuration removed at runtime
+	Removed []string `json:"removed"`
+}
+
+// LoadState loads the state file, nil if it does not exist
+func LoadState(file string) (*State, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SaveState writes s to file atomically, by renaming a temporary file of the same directory,
+// only the owner can read it as it may have the secrets of the added virtual servers
+func SaveState(file string, s *State) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(file, data)
+}
+
+// WriteFileAtomic writes data to file by renaming a temporary file of the same directory,
+// readable by the owner only
+func WriteFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// MergeState applies s to the virtual servers of c: the removed ones are dropped, the pools
+// are replaced and the added ones appended, unless the configuration has one of the same name
+func (c *Configuration) MergeState(s *State) {
+	removed := map[string]bool{}
+	for _, name := range s.Removed {
+		removed[name] = true
+	}
+	vss := make([]VirtualServer, 0, len(c.VServers)+len(s.Added))
+	names := map[string]bool{}
+	for _, vs := range c.VServers {
+		if removed[vs.Name] {
+			continue
+		}
+		if pool, ok := s.Pools[vs.Name]; ok {
+			vs.Pool = pool
+		}
+		vss = append(vss, vs)
+		names[vs.Name] = true
+	}
+	for _, vs := range s.Added {
+		if !names[vs.Name] {
+			vss = append(vss, vs)
+		}
+	}
+	c.VServers = vss
+}
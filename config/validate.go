@@ -0,0 +1,374 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationError lists all the problems found in a configuration
+type ValidationError struct {
+	Problems []string `json:"problems"`
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// ValidateFile validates the configuration file, see Validate
+func ValidateFile(configFile string) error {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+	return validate(data, filepath.Dir(abs), []string{abs})
+}
+
+// Validate checks the JSON configuration data without loading it: the fields unknown to golb,
+// then the checks of Configuration.Validate. The included files are relative to the working
+// directory, and the encrypted values are not decrypted.
+// It returns a *ValidationError listing all the problems, or the error of invalid JSON
+func Validate(data []byte) error {
+	return validate(data, ".", nil)
+}
+
+func validate(data []byte, dir string, files []string) error {
+	c, raw, err := decode(data, dir, files)
+	if err != nil {
+		return err
+	}
+	problems := unknownFields("", raw, reflect.TypeOf(*c))
+	if err := c.Validate(); err != nil {
+		problems = append(problems, err.(*ValidationError).Problems...)
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// unknownFields returns the keys of raw which are not fields of t, prefixed by their path
+func unknownFields(path string, raw interface{}, t reflect.Type) []string {
+	problems := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return problems
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = f.Name
+			}
+			fields[name] = f.Type
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ft, ok := fields[key]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("unknown field %s%s", path, key))
+				continue
+			}
+			problems = append(problems, unknownFields(path+key+".", obj[key], ft)...)
+		}
+	case reflect.Slice:
+		arr, ok := raw.([]interface{})
+		if !ok {
+			return problems
+		}
+		for i, v := range arr {
+			problems = append(problems, unknownFields(fmt.Sprintf("%s%d.", path, i), v, t.Elem())...)
+		}
+	}
+	return problems
+}
+
+// Validate checks the configuration and returns a *ValidationError listing all the problems:
+// duplicate or empty virtual server names, addresses shared by different protocols or server names,
+// invalid addresses, ports, weights and CIDRs, duplicate pool members, and missing certificate files
+func (c *Configuration) Validate() error {
+	problems := []string{}
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, addr := range []struct{ name, value string }{
+		{"controller.address", c.Controller.Address},
+		{"controller.metrics.address", c.Controller.Metrics.Address},
+	} {
+		if addr.value == "" {
+			continue
+		}
+		if err := checkAddress(addr.value, true); err != nil {
+			add("%s %q: %v", addr.name, addr.value, err)
+		}
+	}
+
+	if !logLevels[strings.ToLower(c.Log.Level)] {
+		add("log: unknown level %q", c.Log.Level)
+	}
+	for module, level := range c.Log.Modules {
+		if level == "" || !logLevels[strings.ToLower(level)] {
+			add("log: module %s: unknown level %q", module, level)
+		}
+	}
+	if f := c.Log.Format; f != "" && f != "text" && f != "json" {
+		add("log: unknown format %q", f)
+	}
+
+	if len(c.Cluster.Members) > 0 && c.Cluster.Node == "" {
+		add("cluster: node should be set with members")
+	}
+	for _, m := range c.Cluster.Members {
+		if u, err := url.Parse(m); err != nil || u.Scheme == "" || u.Host == "" {
+			add("cluster: member %q should be an absolute URL", m)
+		}
+	}
+	if c.Cluster.Interval < 0 {
+		add("cluster: negative interval")
+	}
+	if c.Stats.Interval < 0 {
+		add("stats: negative interval")
+	}
+
+	if f := c.Failover; f.Address != "" {
+		for _, addr := range append([]string{f.Address}, f.Peers...) {
+			if err := checkAddress(addr, true); err != nil {
+				add("failover: address %q: %v", addr, err)
+			}
+		}
+		if len(f.Peers) == 0 {
+			add("failover: peers should be set")
+		}
+		if f.Priority < 0 || f.Priority > 255 {
+			add("failover: priority %d out of range [1, 255]", f.Priority)
+		}
+		if f.Interval < 0 {
+			add("failover: negative interval")
+		}
+	}
+
+	names := map[string]bool{}
+	protocols := map[string]string{}
+	serverNames := map[string]string{}
+	for i, vs := range c.VServers {
+		prefix := fmt.Sprintf("virtual_server %d", i)
+		if vs.Name == "" {
+			add("%s: %v", prefix, ErrVirtualServerNameEmpty)
+		} else {
+			prefix = "virtual_server " + vs.Name
+			if names[vs.Name] {
+				add("%s: %v", prefix, ErrVirtualServerDuplicated)
+			}
+			names[vs.Name] = true
+		}
+
+		if vs.Address == "" {
+			add("%s: %v", prefix, ErrVirtualServerAddressEmpty)
+		} else if err := checkAddress(vs.Address, true); err != nil {
+			add("%s: address %q: %v", prefix, vs.Address, err)
+		} else {
+			protocol := vs.Protocol
+			if protocol == "" {
+				protocol = "http"
+			}
+			if p, ok := protocols[vs.Address]; ok && p != protocol {
+				add("%s: address %s is used by %s, not %s", prefix, vs.Address, p, protocol)
+			}
+			protocols[vs.Address] = protocol
+			key := vs.Address + " " + vs.ServerName
+			if other, ok := serverNames[key]; ok {
+				add("%s: server name %q on %s is used by %s", prefix, vs.ServerName, vs.Address, other)
+			}
+			serverNames[key] = vs.Name
+		}
+
+		if vs.Protocol == "https" {
+			if vs.CertFile == "" || vs.KeyFile == "" {
+				add("%s: https needs cert_file and key_file", prefix)
+			}
+		}
+		for _, f := range []struct{ name, value string }{
+			{"cert_file", vs.CertFile}, {"key_file", vs.KeyFile}, {"client_ca_file", vs.ClientCAFile},
+			{"jwt.key_file", vs.JWT.KeyFile}, {"client_auth.htpasswd", vs.ClientAuth.Htpasswd},
+		} {
+			if f.value == "" {
+				continue
+			}
+			if _, err := os.Stat(f.value); err != nil {
+				add("%s: %s %q does not exist", prefix, f.name, f.value)
+			}
+		}
+		checkHealthCheck := func(name string, hc HealthCheck) {
+			if hc.Port < 0 || hc.Port > 65535 {
+				add("%s: %s port %d out of range", prefix, name, hc.Port)
+			}
+			if hc.Type != "" && hc.Type != "http" && hc.Type != "grpc" {
+				add("%s: %s: unknown type %q", prefix, name, hc.Type)
+			}
+		}
+		checkHealthCheck("health_check", vs.HealthCheck)
+		if vs.HealthCheck.MinHealthy < 0 {
+			add("%s: health_check: negative min_healthy", prefix)
+		}
+		for _, cidr := range vs.Debug.AllowFrom {
+			if !strings.Contains(cidr, "/") && net.ParseIP(cidr) != nil {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				add("%s: debug.allow_from %q: %v", prefix, cidr, err)
+			}
+		}
+		if j := vs.JWT; j.Enable && j.Secret == "" && j.KeyFile == "" && j.JWKSURL == "" {
+			add("%s: jwt needs secret, key_file or jwks_url", prefix)
+		}
+		if vs.ReusePort < 0 {
+			add("%s: negative reuse_port", prefix)
+		}
+		if tcp := vs.TCP; tcp.KeepAliveIdle < 0 || tcp.KeepAliveInterval < 0 || tcp.KeepAliveCount < 0 ||
+			tcp.DeferAccept < 0 || tcp.Backlog < 0 || tcp.Linger < -1 {
+			add("%s: tcp: negative option", prefix)
+		}
+		if p := vs.HealthzPath; p != "" && !strings.HasPrefix(p, "/") {
+			add("%s: healthz_path %q should start with /", prefix, p)
+		}
+		if sink := vs.AccessLog.Sink; sink.Type != "" && sink.Type != "syslog" && sink.Type != "journald" {
+			add("%s: access_log: unknown sink %q", prefix, sink.Type)
+		}
+		if bw := vs.Bandwidth; bw.PerConnection < 0 || bw.Total < 0 || bw.Burst < 0 {
+			add("%s: negative bandwidth", prefix)
+		}
+		if vs.Limits.ClientMaxConns < 0 {
+			add("%s: limits: negative client_max_conns", prefix)
+		}
+		if a := vs.Limits.Adaptive; a.Algorithm != "" && a.Algorithm != "gradient" && a.Algorithm != "aimd" {
+			add("%s: limits: unknown adaptive algorithm %q", prefix, a.Algorithm)
+		} else if a.InitialLimit < 0 || a.MinLimit < 0 || a.MaxLimit < 0 || (a.MaxLimit > 0 && a.MinLimit > a.MaxLimit) {
+			add("%s: limits: adaptive limits should be 0 <= min_limit <= max_limit", prefix)
+		}
+		if m := vs.RequestBuffering.Mode; m != "" && m != "stream" && m != "memory" && m != "spool" {
+			add("%s: request_buffering: unknown mode %q", prefix, m)
+		}
+		if vs.MaxBodySize < 0 || vs.RequestBuffering.SpoolThreshold < 0 {
+			add("%s: negative max_body_size or spool_threshold", prefix)
+		}
+		for route := range vs.Limits.Priority.Routes {
+			if !strings.HasPrefix(route, "/") {
+				add("%s: limits: priority route %q should start with /", prefix, route)
+			}
+		}
+		checkVersions := func(name string, versions ...string) {
+			for _, v := range versions {
+				if v != "" && v != "1.0" && v != "1.1" && v != "1.2" && v != "1.3" {
+					add("%s: %s: unknown version %q", prefix, name, v)
+				}
+			}
+		}
+		checkVersions("upstream_tls", vs.UpstreamTLS.MinVersion, vs.UpstreamTLS.MaxVersion)
+		checkVersions("tls", vs.TLS.MinVersion, vs.TLS.MaxVersion)
+		if f := vs.Dial.Family; f != "" && f != "dual" && f != "prefer_ipv4" && f != "ipv4" && f != "ipv6" {
+			add("%s: dial: unknown family %q", prefix, f)
+		}
+		for j, sc := range vs.Scripts {
+			if sc.Engine == "" || sc.File == "" {
+				add("%s: scripts.%d: engine and file are required", prefix, j)
+			}
+		}
+		for _, o := range vs.FailOn {
+			if code, err := strconv.Atoi(o); o != "error" && o != "timeout" && o != "5xx" && (err != nil || code < 100 || code > 599) {
+				add("%s: fail_on: unknown outcome %q", prefix, o)
+			}
+		}
+		if c := vs.Compression; c.Level < 0 || c.Level > 9 || c.BrotliLevel < 0 || c.BrotliLevel > 11 {
+			add("%s: compression: level should be 1 to 9, brotli_level 1 to 11", prefix)
+		}
+		for _, e := range vs.Compression.Encodings {
+			if e != "br" && e != "gzip" {
+				add("%s: compression: unknown encoding %q", prefix, e)
+			}
+		}
+		if ka := vs.KeepAlive; ka.MaxIdleConnsPerHost < 0 || ka.IdleTimeout < 0 {
+			add("%s: keepalive: negative max_idle_conns_per_host or idle_timeout", prefix)
+		}
+
+		pools := map[string][]Server{"pool": vs.Pool, "canary.pool": vs.Canary.Pool}
+		for j, rule := range vs.Rules {
+			pools[fmt.Sprintf("rules.%d.pool", j)] = rule.Pool
+		}
+		for name, pool := range pools {
+			seen := map[string]bool{}
+			for _, peer := range pool {
+				if err := checkAddress(peer.Address, false); err != nil {
+					add("%s: %s member %q: %v", prefix, name, peer.Address, err)
+				}
+				if peer.Weight < 0 {
+					add("%s: %s member %s: negative weight %d", prefix, name, peer.Address, peer.Weight)
+				}
+				if peer.MaxFails < 0 || peer.FailTimeout < 0 {
+					add("%s: %s member %s: negative max_fails or fail_timeout", prefix, name, peer.Address)
+				}
+				if seen[peer.Address] {
+					add("%s: %s member %s: %v", prefix, name, peer.Address, ErrPoolMemberDuplicated)
+				}
+				seen[peer.Address] = true
+				checkHealthCheck(name+" member "+peer.Address+" health_check", peer.HealthCheck)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// checkAddress returns why addr is not host:port with a valid port,
+// the port may be omitted if not required
+// logLevels are the levels of logrus, empty means the default
+var logLevels = map[string]bool{
+	"": true, "panic": true, "fatal": true, "error": true, "warn": true, "warning": true, "info": true, "debug": true,
+}
+
+func checkAddress(addr string, portRequired bool) error {
+	if addr == "" {
+		return fmt.Errorf("empty address")
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		if addr == "unix:" {
+			return fmt.Errorf("empty socket path")
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host := strings.Trim(addr, "[]")
+		if !portRequired && (!strings.Contains(host, ":") || net.ParseIP(host) != nil) {
+			return nil
+		}
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
@@ -5,17 +5,78 @@
 // - Authentication
 // 	Basic HTTP Auth
 //
+// - Metrics listener
+//	the Stats, Stats increments, Health and Readiness endpoints are also served on {metrics_address}
+//	if configured, with their own Basic HTTP Auth, or none if the username is empty
+//
+// - Debug, if enabled: the pprof profiles (CPU, heap, goroutines, ...) and the expvar variables
+//	GET http://{controller_address}/debug/pprof/
+//	GET http://{controller_address}/debug/pprof/profile?seconds=30
+//	GET http://{controller_address}/debug/vars
+//
+// - Web UI, if enabled: the LB instances, the state of their pool members and their traffic,
+//   with buttons to drain, reweight or maintain the members and to enable or disable the LB instances
+//	GET http://{controller_address}/ui/
+//
+// - Health of the controller
+//	GET http://{controller_address}/health
+//
+// - Readiness, 503 with the reasons if a critical LB instance is not running, has no healthy peer
+//   or fewer than health_check.min_healthy since it started,
+//   shed requests over its limits in the last 10 seconds, or golb is over the limits of its guardrails,
+//   e.g. for a Kubernetes readiness probe
+//	GET http://{controller_address}/ready
+//
+// - Health of the peers, 503 with the reasons if a running LB instance, or the LB instance name,
+//   has no healthy peer, e.g. for an upstream hardware LB or a Kubernetes probe
+//	GET http://{controller_address}/healthz
+//	GET http://{controller_address}/vs/{name}/healthz
+//
 // - Stats
 //	GET http://{controller_address}/stats
+//	GET http://{controller_address}/stats?format=json
+//
+// - Stats increments since the previous call, for pollers computing rates
+//	GET http://{controller_address}/stats/delta
+//
+// - Stats summed over all LB instances: requests, QPS, error rate, active requests and connections
+//	GET http://{controller_address}/stats/total
 //
-// - List All LB instance
+// - Reset Stats of all LB instances
+//	DELETE http://{controller_address}/stats
+//
+// - Reset Stats of LB instance, or of one of its pool members
+//	DELETE http://{controller_address}/vs/{name}/stats
+//	DELETE http://{controller_address}/vs/{name}/stats?peer=127.0.0.1:10001
+//
+// - Effective configuration, the defaults applied and the secrets redacted
+//	GET http://{controller_address}/config
+//
+// - Validate a configuration without applying it, 400 with the problems found
+//	POST http://{controller_address}/config/validate
+//	Body: {"virtual_server":[...]}
+//
+// - Reload the LB instances, the changed ones are rolled out in batches and rolled back
+//   if the error rate of a batch spikes, the ones not in virtual_server are removed
+//	POST http://{controller_address}/reload
+//	Body: {"virtual_server":[...],"reload":{"batch_size":2,"pause":30,"max_error_percent":5,"min_requests":100}}
+//
+// - Progress of the last reload, state is running, done or rolled_back
+//	GET http://{controller_address}/reload
+//
+// - List All LB instance, with their pool members and their state as JSON
 //	GET http://{controller_address}/vs
+//	GET http://{controller_address}/vs?format=json
 //
 // - Add LB instance
 //	POST http://{controller_address}/vs
 //	Body {"name":"redis","address":"127.0.0.1:6379"}
 //	Example: curl -XPOST -u admin:admin -H 'content-type: application/json' -d '{"name":"redis","address":"127.0.0.1:6379"}' http://127.0.0.1:6587/vs
 //
+// - Clone LB instance with its configuration, optionally with another pool, the clone is not started
+//	POST http://{controller_address}/vs/{name}/clone
+//	Body {"name":"web-staging","address":"127.0.0.1:9081","pool":[{"address":"127.0.0.1:10011"}]}
+//
 // - Enable LB instance
 //	POST http://{controller_address}/vs/{name}
 //	Body {"action":"enable"}
@@ -24,12 +85,18 @@
 //	POST http://{controller_address}/vs/{name}
 //	Body {"action":"disable"}
 //
-// - List pool member of LB instance
+// - List pool member of LB instance, and the members drained by weight 0
 //	GET http://{controller_address}/vs/{name}
+//	GET http://{controller_address}/vs/{name}?format=json
 //
 // - Add pool member to LB instance
 //	POST http://{controller_address}/vs/{name}/pool
 //	Body: {"address":"127.0.0.1:10003","weight":2}
+//	Body: {"address":"10.0.0.3","scheme":"https"} (port defaults to 443 for https, 80 for http)
+//	Body: {"address":"127.0.0.1:10009","backup":true} (only used when all the primary peers are down)
+//	Body: {"address":"127.0.0.1:10004","max_fails":10,"fail_timeout":30} (overrides the passive health check)
+//	Body: {"address":"127.0.0.1:10003","weight":0} (drained: health-checked but sent no request, the weight
+//	      of an existing member is changed, so it is pre-staged, drained and undrained by the weight alone)
 //	Example: curl -XPOST -u admin:admin -H 'content-type: application/json' -d '{"address":"127.0.0.1:10003"}' http://127.0.0.1:6587/vs/web/pool
 //
 // - Remove pool member from LB instance
@@ -37,48 +104,276 @@
 //	Body: {"address":"127.0.0.1:10002"}
 //	Example: curl -XDELETE -u admin:admin -H 'content-type: application/json' -d '{"address":"127.0.0.1:10002"}' http://127.0.0.1:6587/vs/web/pool
 //
+// - Maintenance of LB instance, and its pool members in maintenance
+//	GET http://{controller_address}/vs/{name}/maintenance
+//
+// - Put pool member in maintenance, it is sent no request but keeps its configuration and stats,
+//   or put the LB instance in maintenance without address, it responds 503 with its listener kept
+//	POST http://{controller_address}/vs/{name}/maintenance
+//	Body: {"address":"127.0.0.1:10001","enable":true}
+//	Body: {"enable":false}
+//
+// - List injected faults of LB instance
+//	GET http://{controller_address}/vs/{name}/fault
+//
+// - Inject a fault to pool member for failover drills, latency in milliseconds, duration in seconds
+//	POST http://{controller_address}/vs/{name}/fault
+//	Body: {"address":"127.0.0.1:10001","down":true,"latency":200,"duration":60}
+//
+// - Clear the fault of pool member
+//	DELETE http://{controller_address}/vs/{name}/fault
+//	Body: {"address":"127.0.0.1:10001"}
+//
+// - List peers removed after being down for longer than tombstone_after
+//	GET http://{controller_address}/vs/{name}/tombstone
+//
+// - Put a tombstoned peer back to the pool
+//	DELETE http://{controller_address}/vs/{name}/tombstone
+//	Body: {"address":"127.0.0.1:10001","weight":1}
+//
+// - List peers ejected by outlier detection
+//	GET http://{controller_address}/vs/{name}/outlier
+//
+// - Percent the weights of the pool members are scaled by, tuned if auto_weight is enabled
+//	GET http://{controller_address}/vs/{name}/auto_weight
+//
+// - List peer decommissions, state is draining, verified, removed or aborted
+//	GET http://{controller_address}/vs/{name}/decommission
+//
+// - Drain pool member, it is verified after no traffic in quiet_period seconds (default 300),
+//   and removed on confirm, or automatically if auto_remove
+//	POST http://{controller_address}/vs/{name}/decommission
+//	Body: {"action":"start","address":"127.0.0.1:10001","quiet_period":600,"auto_remove":false}
+//
+// - Remove the verified pool member, or abort the decommission and put it back to the pool
+//	POST http://{controller_address}/vs/{name}/decommission
+//	Body: {"action":"confirm","address":"127.0.0.1:10001"}
+//	Body: {"action":"abort","address":"127.0.0.1:10001"}
+//
+// - Requests split between the primary and the canary pool, with the stats of the canary pool
+//	GET http://{controller_address}/vs/{name}/canary
+//
+// - Requests mirrored to the shadow pool, with the stats of the shadow pool
+//	GET http://{controller_address}/vs/{name}/mirror
+//
+// - Responses compressed, with the bytes saved
+//	GET http://{controller_address}/vs/{name}/compression
+//
+// - Cached responses, hits and misses
+//	GET http://{controller_address}/vs/{name}/cache
+//
+// - Purge the cached responses whose path starts with path, all of them if empty
+//	DELETE http://{controller_address}/vs/{name}/cache
+//	Body: {"path":"/static/"}
+//
+// - Filters of the access log: percent of the requests logged by status class (the others are
+//   always logged), 1 in every requests, the errors only, the requests slower than milliseconds only
+//	GET http://{controller_address}/vs/{name}/access_log
+//
+// - Change the access log filters at runtime, an empty body logs all the requests
+//	POST http://{controller_address}/vs/{name}/access_log
+//	Body: {"sample":{"2xx":10,"3xx":10}}
+//	Body: {"every":100,"errors_only":true,"slower_than":500}
+//
+// - Reload the client certificate CA bundle of an mTLS LB instance
+//	POST http://{controller_address}/vs/{name}/client_ca
+//
+// - Members of the cluster heard from, with the peers they see failing by LB instance
+//	GET http://{controller_address}/cluster
+//
+// - Gossip of another golb instance of the cluster, posted every cluster interval
+//	POST http://{controller_address}/cluster
+//	Body: {"node":"golb-2","down":{"web":["127.0.0.1:10001"]},"taken":{"vs/web":{"10.0.0.9":3}}}
+//
+// - Failover state of this node, master or backup, and the master heard from
+//	GET http://{controller_address}/failover
+//
+// - Tail the events (peer down/up, added/removed, LB instance started/stopped), one JSON object per line
+//	GET http://{controller_address}/events
+//
+// - Dry-run routing of a synthetic request, no traffic is sent
+//	POST http://{controller_address}/route
+//	Body: {"method":"GET","address":"127.0.0.1:8081","host":"localhost","path":"/","headers":{"Accept":"*/*"}}
+//
 package controller
 
 import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/onestraw/golb/balancer"
 	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/failover"
 )
 
 type Controller struct {
 	Address string
 	Auth    *Authentication
+	// serves the metrics endpoints only, empty disables it
+	MetricsAddress string
+	// serves the pprof and expvar endpoints
+	Debug bool
+	// serves the web UI
+	UI bool
+	// nil disables the authentication of the metrics listener
+	MetricsAuth *Authentication
+	// the loaded configuration dumped by /config, the virtual servers are taken from the balancer
+	Config *config.Configuration
+	// nil if no floating IP failover
+	Failover *failover.Node
+	// streamed by /events, nil disables it
+	Events *balancer.EventFeed
 }
 
 func New(ctlCfg *config.Controller) *Controller {
-	return &Controller{
-		Address: ctlCfg.Address,
-		Auth:    &Authentication{ctlCfg.Auth.Username, ctlCfg.Auth.Password},
+	c := &Controller{
+		Address:        ctlCfg.Address,
+		Auth:           &Authentication{ctlCfg.Auth.Username, ctlCfg.Auth.Password},
+		MetricsAddress: ctlCfg.Metrics.Address,
+		Debug:          ctlCfg.Debug,
+		UI:             ctlCfg.UI,
+	}
+	if auth := ctlCfg.Metrics.Auth; auth.Username != "" {
+		c.MetricsAuth = &Authentication{auth.Username, auth.Password}
+	}
+	return c
+}
+
+// metricsRoutes adds the read-only endpoints safe to expose to the monitoring network
+func metricsRoutes(r *mux.Router, balancer *balancer.Balancer) {
+	r.Handle("/health", Health()).Methods("GET")
+	r.Handle("/ready", Ready(balancer)).Methods("GET")
+	r.Handle("/healthz", Healthz(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/healthz", VirtualServerHealthz(balancer)).Methods("GET")
+	r.Handle("/stats", &StatsHandler{balancer}).Methods("GET")
+	r.Handle("/stats/delta", StatsDelta(balancer)).Methods("GET")
+	r.Handle("/stats/total", TotalStats(balancer)).Methods("GET")
+}
+
+// MetricsHandler returns the handler of the metrics listener
+func (c *Controller) MetricsHandler(balancer *balancer.Balancer) http.Handler {
+	r := mux.NewRouter()
+	metricsRoutes(r, balancer)
+	if c.MetricsAuth == nil {
+		return r
 	}
+	return BasicAuth(c.MetricsAuth)(r)
 }
 
 func (c *Controller) Run(balancer *balancer.Balancer) {
 	r := mux.NewRouter()
-	r.Handle("/stats", &StatsHandler{balancer}).Methods("GET")
+	metricsRoutes(r, balancer)
+	r.Handle("/stats", ResetStats(balancer)).Methods("DELETE")
+	r.Handle("/config", EffectiveConfig(balancer, c.Config)).Methods("GET")
+	r.Handle("/config/validate", ValidateConfig()).Methods("POST")
 	r.Handle("/vs", AddVirtualServer(balancer)).Methods("POST")
 	r.Handle("/vs", ListAllVirtualServer(balancer)).Methods("GET")
 	r.Handle("/vs/{name}", ModifyVirtualServerStatus(balancer)).Methods("POST")
 	r.Handle("/vs/{name}", ListVirtualServer(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/clone", CloneVirtualServer(balancer)).Methods("POST")
 	r.Handle("/vs/{name}/pool", AddPoolMember(balancer)).Methods("POST")
 	r.Handle("/vs/{name}/pool", DeletePoolMember(balancer)).Methods("DELETE")
+	r.Handle("/vs/{name}/stats", ResetVirtualServerStats(balancer)).Methods("DELETE")
+	r.Handle("/vs/{name}/maintenance", GetMaintenance(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/maintenance", SetMaintenance(balancer)).Methods("POST")
+	r.Handle("/vs/{name}/fault", ListFault(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/fault", InjectFault(balancer)).Methods("POST")
+	r.Handle("/vs/{name}/fault", ClearFault(balancer)).Methods("DELETE")
+	r.Handle("/vs/{name}/tombstone", ListTombstone(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/tombstone", ResurrectPeer(balancer)).Methods("DELETE")
+	r.Handle("/vs/{name}/outlier", ListEjection(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/auto_weight", ListPeerWeight(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/decommission", ListDecommission(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/decommission", Decommission(balancer)).Methods("POST")
+	r.Handle("/vs/{name}/canary", ListSplitStats(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/mirror", ListMirrorStats(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/compression", ListCompressionStats(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/cache", ListCacheStats(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/cache", PurgeCache(balancer)).Methods("DELETE")
+	r.Handle("/vs/{name}/access_log", GetAccessLog(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/access_log", SetAccessLog(balancer)).Methods("POST")
+	r.Handle("/vs/{name}/client_ca", ReloadClientCA(balancer)).Methods("POST")
+	r.Handle("/route", DryRunRoute(balancer)).Methods("POST")
+	r.Handle("/reload", GetReload(balancer)).Methods("GET")
+	r.Handle("/reload", Reload(balancer)).Methods("POST")
+	r.Handle("/cluster", ListClusterMember(balancer)).Methods("GET")
+	r.Handle("/cluster", MergeClusterState(balancer)).Methods("POST")
+	r.Handle("/failover", FailoverStatus(c.Failover)).Methods("GET")
+	r.Handle("/events", TailEvents(c.Events)).Methods("GET")
+	if c.Debug {
+		debugRoutes(r)
+	}
+	if c.UI {
+		uiRoutes(r)
+	}
 	go func() {
-		if err := http.ListenAndServe(c.Address, BasicAuth(c.Auth)(r)); err != nil {
+		if err := serve(c.Address, BasicAuth(c.Auth)(r)); err != nil {
 			panic(err)
 		}
 	}()
+	if c.MetricsAddress != "" {
+		go func() {
+			if err := serve(c.MetricsAddress, c.MetricsHandler(balancer)); err != nil {
+				panic(err)
+			}
+		}()
+	}
+}
+
+// serve takes over the listener of address on upgrade, see balancer.Upgrade
+func serve(address string, handler http.Handler) error {
+	ln, err := balancer.Listen(address)
+	if err != nil {
+		return err
+	}
+	return http.Serve(ln, handler)
+}
+
+func Health() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	})
+}
+
+func Ready(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reasons := b.Unready(); len(reasons) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, strings.Join(reasons, "\n"))
+			return
+		}
+		io.WriteString(w, "OK")
+	})
+}
+
+func Healthz(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		balancer.WriteHealthz(w, b.Unhealthy()...)
+	})
+}
+
+func VirtualServerHealthz(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vs, err := b.FindVirtualServer(mux.Vars(r)["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		if reason := vs.Unhealthy(); reason != "" {
+			balancer.WriteHealthz(w, reason)
+			return
+		}
+		balancer.WriteHealthz(w)
+	})
 }
 
 type StatsHandler struct {
@@ -86,17 +381,109 @@ type StatsHandler struct {
 }
 
 func (h *StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.balancer.StatsReports())
+		return
+	}
+
 	result := []string{}
 	for _, vs := range h.balancer.VServers {
 		s := vs.Stats()
-		log.Infof(s)
+		log.Info(s)
 		result = append(result, s)
 	}
 	io.WriteString(w, strings.Join(result, "\n"))
 }
 
+// StatsDelta returns JSON statistics accumulated since the previous call
+func StatsDelta(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := []*balancer.VirtualServerStats{}
+		for _, vs := range b.VServers {
+			result = append(result, vs.StatsDelta())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// TotalStats returns the JSON statistics summed over all the virtual servers
+func TotalStats(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.AggregateStats())
+	})
+}
+
+func ResetStats(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, vs := range b.VServers {
+			vs.ResetStats("")
+		}
+		io.WriteString(w, "Reset stats success")
+	})
+}
+
+func ResetVirtualServerStats(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+
+		if err := vs.ResetStats(r.URL.Query().Get("peer")); err != nil {
+			log.Errorf("ResetStats err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "Reset stats success")
+	})
+}
+
+func EffectiveConfig(b *balancer.Balancer, base *config.Configuration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(b.EffectiveConfig(base))
+	})
+}
+
+// VirtualServerInfo is the JSON form of the LB instance listings
+type VirtualServerInfo struct {
+	Name     string                `json:"name"`
+	Address  string                `json:"address"`
+	Status   string                `json:"status"`
+	LBMethod string                `json:"lb_method"`
+	Peers    []balancer.PeerStatus `json:"peers"`
+}
+
+func virtualServerInfo(vs *balancer.VirtualServer) *VirtualServerInfo {
+	return &VirtualServerInfo{
+		Name:     vs.Name,
+		Address:  vs.Address,
+		Status:   vs.Status(),
+		LBMethod: vs.LBMethod,
+		Peers:    vs.Peers(),
+	}
+}
+
 func ListAllVirtualServer(b *balancer.Balancer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "json" {
+			result := []*VirtualServerInfo{}
+			for _, vs := range b.VServers {
+				result = append(result, virtualServerInfo(vs))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+			return
+		}
 		for _, vs := range b.VServers {
 			data := fmt.Sprintf("Name:%s, Address:%s, Status:%s, Pool:\n%s\n\n",
 				vs.Name, vs.Address, vs.Status(), vs.Pool)
@@ -115,7 +502,20 @@ func ListVirtualServer(b *balancer.Balancer) http.Handler {
 			WriteBadRequest(w, err)
 			return
 		}
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(virtualServerInfo(vs))
+			return
+		}
 		msg := vs.Pool.String()
+		if drained := vs.Drained(); len(drained) > 0 {
+			msg += "\nDrained: " + strings.Join(drained, ", ")
+		}
+		if m := vs.Maintenance(); m.Enabled {
+			msg += "\nIn maintenance"
+		} else if len(m.Peers) > 0 {
+			msg += "\nMaintenance: " + strings.Join(m.Peers, ", ")
+		}
 		io.WriteString(w, msg)
 	})
 }
@@ -187,6 +587,28 @@ func AddVirtualServer(b *balancer.Balancer) http.Handler {
 	})
 }
 
+func CloneVirtualServer(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cr balancer.CloneRequest
+		if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+			log.Errorf("Decode request err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+
+		vars := mux.Vars(r)
+		vs, err := b.Clone(vars["name"], &cr)
+		if err != nil {
+			log.Errorf("Clone err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		log.Infof("Cloned %s to %s, listen %s, pool %v", vars["name"], vs.Name, vs.Address, vs.Pool)
+
+		io.WriteString(w, "Clone success")
+	})
+}
+
 func decodeServer(r *http.Request) (*config.Server, error) {
 	var server config.Server
 	decoder := json.NewDecoder(r.Body)
@@ -215,11 +637,11 @@ func AddPoolMember(b *balancer.Balancer) http.Handler {
 			return
 		}
 
-		weight := server.Weight
-		if weight <= 0 {
-			weight = 1
+		if _, err := vs.AddServer(*server); err != nil {
+			log.Errorf("AddServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
 		}
-		vs.AddPeer(server.Address, weight)
 		io.WriteString(w, "Add peer success")
 	})
 }
@@ -244,3 +666,604 @@ func DeletePoolMember(b *balancer.Balancer) http.Handler {
 		io.WriteString(w, "Remove peer success")
 	})
 }
+
+func ListTombstone(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs.Tombstones())
+	})
+}
+
+func ResurrectPeer(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		server, err := decodeServer(r)
+		if err != nil {
+			WriteBadRequest(w, err)
+			return
+		}
+
+		if err := vs.Resurrect(server.Address, server.Weight); err != nil {
+			log.Errorf("Resurrect err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "Resurrect peer success")
+	})
+}
+
+type MaintenanceRequest struct {
+	// empty means the LB instance
+	Address string `json:"address"`
+	Enable  bool   `json:"enable"`
+}
+
+func GetMaintenance(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs.Maintenance())
+	})
+}
+
+func SetMaintenance(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+
+		var req MaintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Errorf("Decode request err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+
+		if req.Address == "" {
+			vs.SetMaintenance(req.Enable)
+		} else if err := vs.SetPeerMaintenance(req.Address, req.Enable); err != nil {
+			log.Errorf("SetPeerMaintenance err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		audit(r, "maintenance", name, "Set maintenance", log.Fields{"peer": req.Address, "enable": req.Enable})
+		io.WriteString(w, "Set maintenance success")
+	})
+}
+
+type FaultRequest struct {
+	Address string `json:"address"`
+	Down    bool   `json:"down"`
+	// milliseconds
+	Latency int `json:"latency"`
+	// seconds
+	Duration int `json:"duration"`
+}
+
+// audit logs the operations of kind, e.g. "fault", with the operator
+func audit(r *http.Request, kind, vs, msg string, fields log.Fields) {
+	username, _, _ := r.BasicAuth()
+	entry := log.WithFields(log.Fields{"audit": kind, "vs": vs, "user": username, "remote": r.RemoteAddr})
+	entry.WithFields(fields).Info(msg)
+}
+
+func ListFault(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs.Faults())
+	})
+}
+
+func InjectFault(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+
+		var req FaultRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Errorf("Decode request err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+
+		latency := time.Duration(req.Latency) * time.Millisecond
+		duration := time.Duration(req.Duration) * time.Second
+		if err := vs.InjectFault(req.Address, req.Down, latency, duration); err != nil {
+			log.Errorf("InjectFault err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		audit(r, "fault", name, "Inject fault", log.Fields{
+			"peer": req.Address, "down": req.Down, "latency": latency, "duration": duration,
+		})
+		io.WriteString(w, "Inject fault success")
+	})
+}
+
+func ClearFault(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		server, err := decodeServer(r)
+		if err != nil {
+			WriteBadRequest(w, err)
+			return
+		}
+
+		if !vs.ClearFault(server.Address) {
+			WriteError(w, ErrFaultNotFound)
+			return
+		}
+		audit(r, "fault", name, "Clear fault", log.Fields{"peer": server.Address})
+		io.WriteString(w, "Clear fault success")
+	})
+}
+
+func ListPeerWeight(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs.PeerWeights())
+	})
+}
+
+type DecommissionRequest struct {
+	Action  string `json:"action"`
+	Address string `json:"address"`
+	// seconds
+	QuietPeriod int  `json:"quiet_period"`
+	AutoRemove  bool `json:"auto_remove"`
+}
+
+func ListDecommission(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs.Decommissions())
+	})
+}
+
+func Decommission(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+
+		var req DecommissionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Errorf("Decode request err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+
+		switch req.Action {
+		case "start":
+			quiet := time.Duration(req.QuietPeriod) * time.Second
+			_, err = vs.StartDecommission(req.Address, quiet, req.AutoRemove)
+		case "confirm":
+			err = vs.ConfirmDecommission(req.Address)
+		case "abort":
+			err = vs.AbortDecommission(req.Address)
+		default:
+			WriteError(w, ErrUnknownAction)
+			return
+		}
+		if err != nil {
+			log.Errorf("Decommission %s err=%v", req.Action, err)
+			WriteBadRequest(w, err)
+			return
+		}
+		username, _, _ := r.BasicAuth()
+		log.WithFields(log.Fields{
+			"audit": "decommission", "vs": name, "user": username, "remote": r.RemoteAddr,
+			"peer": req.Address, "action": req.Action,
+		}).Info("Decommission")
+		io.WriteString(w, fmt.Sprintf("Decommission %s success", req.Action))
+	})
+}
+
+func ListEjection(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs.Ejections())
+	})
+}
+
+func ListSplitStats(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		split := vs.SplitStats()
+		if split == nil {
+			WriteError(w, ErrNoCanary)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(split)
+	})
+}
+
+func ListMirrorStats(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		stats := vs.MirrorStats()
+		if stats == nil {
+			WriteError(w, ErrNoMirror)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+}
+
+func ListCompressionStats(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		stats := vs.CompressionStats()
+		if stats == nil {
+			WriteError(w, ErrNoCompression)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+}
+
+func ListCacheStats(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		stats := vs.CacheStats()
+		if stats == nil {
+			WriteError(w, ErrNoCache)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+}
+
+type PurgeRequest struct {
+	// path prefix, empty purges all
+	Path string `json:"path"`
+}
+
+func PurgeCache(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+
+		var req PurgeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			log.Errorf("Decode request err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		n, err := vs.PurgeCache(req.Path)
+		if err != nil {
+			WriteError(w, ErrNoCache)
+			return
+		}
+		io.WriteString(w, fmt.Sprintf("Purged %d cached responses", n))
+	})
+}
+
+func GetAccessLog(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs.AccessLog())
+	})
+}
+
+func SetAccessLog(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+
+		var c config.AccessLog
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			log.Errorf("Decode request err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		if err := vs.SetAccessLog(c); err != nil {
+			log.Errorf("SetAccessLog err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		log.Infof("[%s] access log %+v", vs.Name, c)
+		io.WriteString(w, "Set access log success")
+	})
+}
+
+func ReloadClientCA(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vs, err := b.FindVirtualServer(vars["name"])
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		if err := vs.ReloadClientCA(); err != nil {
+			log.Errorf("ReloadClientCA err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "Reload client CA success")
+	})
+}
+
+// DryRunRoute reports which virtual server, middleware and pool would serve a request
+func DryRunRoute(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req balancer.RouteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Errorf("Decode request err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		result, err := b.Route(&req)
+		if err == balancer.ErrRouteNotFound {
+			WriteError(w, ErrRouteNotFound)
+			return
+		}
+		if err != nil {
+			WriteBadRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+func GetReload(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rollout := b.Rollout()
+		if rollout == nil {
+			WriteError(w, ErrNoReload)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rollout)
+	})
+}
+
+// ValidateConfig checks the configuration of the body, see config.Validate
+func ValidateConfig() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Errorf("Read request err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		err = config.Validate(body)
+		if verr, ok := err.(*config.ValidationError); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(verr)
+			return
+		}
+		if err != nil {
+			WriteBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "Configuration is valid")
+	})
+}
+
+func Reload(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Errorf("Read request err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		c, err := config.LoadFromString(string(body))
+		if err != nil {
+			log.Errorf("Load configuration err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		rollout, err := b.Reload(c.VServers, c.Reload)
+		if err != nil {
+			log.Errorf("Reload err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		username, _, _ := r.BasicAuth()
+		log.WithFields(log.Fields{
+			"audit": "reload", "user": username, "remote": r.RemoteAddr, "changes": len(rollout.Changes),
+		}).Info("Reload")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rollout)
+	})
+}
+
+// ListClusterMember returns the members of the cluster heard from
+func ListClusterMember(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cluster := b.Cluster()
+		if cluster == nil {
+			WriteError(w, ErrNoCluster)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cluster.Members())
+	})
+}
+
+// MergeClusterState applies the gossip of another member of the cluster
+func MergeClusterState(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cluster := b.Cluster()
+		if cluster == nil {
+			WriteError(w, ErrNoCluster)
+			return
+		}
+		var state balancer.ClusterState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			log.Errorf("Decode request err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		if err := cluster.Merge(&state); err != nil {
+			log.Errorf("Merge cluster state err=%v", err)
+			WriteBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "OK")
+	})
+}
+
+// FailoverStatus returns the failover state of node
+func FailoverStatus(node *failover.Node) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if node == nil {
+			WriteError(w, ErrNoFailover)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(node.Status())
+	})
+}
+
+// TailEvents streams the events published from the request on, one JSON object per line
+func TailEvents(feed *balancer.EventFeed) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if feed == nil {
+			WriteError(w, ErrNoEvents)
+			return
+		}
+		events, cancel := feed.Subscribe()
+		defer cancel()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case e := <-events:
+				if err := encoder.Encode(e); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
@@ -6,16 +6,19 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/onestraw/golb/balancer"
 	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/failover"
 	"github.com/onestraw/golb/stats"
 )
 
@@ -58,6 +61,60 @@ func TestListAllVirtualServer(t *testing.T) {
 	testCtrlSuit(t, h, req, 200, expect)
 }
 
+func TestListVirtualServerJSON(t *testing.T) {
+	b := mockBalancer(t)
+	rr := httptest.NewRecorder()
+	ListAllVirtualServer(b).ServeHTTP(rr, httptest.NewRequest("GET", "/vs?format=json", nil))
+	require.Equal(t, 200, rr.Code)
+	var vss []VirtualServerInfo
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &vss))
+	require.Len(t, vss, 1)
+	assert.Equal(t, "web", vss[0].Name)
+	assert.Equal(t, "round-robin", vss[0].LBMethod)
+	require.Len(t, vss[0].Peers, 2)
+	assert.Equal(t, "127.0.0.1:10002", vss[0].Peers[1].Address)
+	assert.Equal(t, 2, vss[0].Peers[1].Weight)
+	assert.False(t, vss[0].Peers[1].Down)
+
+	vs, err := b.FindVirtualServer("web")
+	require.NoError(t, err)
+	require.NoError(t, vs.SetPeerMaintenance("127.0.0.1:10001", true))
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/vs/web?format=json", nil), map[string]string{"name": "web"})
+	rr = httptest.NewRecorder()
+	ListVirtualServer(b).ServeHTTP(rr, req)
+	require.Equal(t, 200, rr.Code)
+	var info VirtualServerInfo
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	assert.True(t, info.Peers[0].Maintenance)
+}
+
+func TestTailEvents(t *testing.T) {
+	testCtrlSuit(t, TailEvents(nil), httptest.NewRequest("GET", "/events", nil), 404, ErrNoEvents.ErrMsg)
+
+	feed := balancer.NewEventFeed()
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8082","pool":[{"address":"127.0.0.1:10001","weight":1}]}]}`
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := balancer.New(c.VServers, balancer.EventHandlerOpt(feed.Handler()))
+	require.NoError(t, err)
+	vs, err := b.FindVirtualServer("web")
+	require.NoError(t, err)
+
+	server := httptest.NewServer(TailEvents(feed))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	vs.RemovePeer("127.0.0.1:10001")
+	var e balancer.Event
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&e))
+	assert.Equal(t, balancer.EVENT_PEER_REMOVED, e.Type)
+	assert.Equal(t, "web", e.VirtualServer)
+	assert.Equal(t, "127.0.0.1:10001", e.Peer)
+}
+
 func TestListVirtualServer(t *testing.T) {
 	b := mockBalancer(t)
 	h := ListVirtualServer(b)
@@ -89,10 +146,87 @@ func TestStatsHandler(t *testing.T) {
 	b.VServers[0].ServerStats["127.0.0.1:10002"].Inc(data)
 	data.StatusCode = "500"
 	b.VServers[0].ServerStats["127.0.0.1:10001"].Inc(data)
-	expect := "Pool-web\n127.0.0.1:10001\nstatus_code: 200:2, 500:1\nmethod: POST:3\npath: test/:3\nrecv_bytes: 30\nsend_bytes: 60\n------\n127.0.0.1:10002\nstatus_code: 200:1\nmethod: POST:1\npath: test/:1\nrecv_bytes: 10\nsend_bytes: 20\n------"
+	expect := "Pool-web\n127.0.0.1:10001\nstatus_code: 200:2, 500:1\nmethod: POST:3\npath: test/:3\nrecv_bytes: 30\nsend_bytes: 60\nlatency: p50:1ms, p90:1ms, p99:1ms\nconns: new:0, reused:0\n------\n127.0.0.1:10002\nstatus_code: 200:1\nmethod: POST:1\npath: test/:1\nrecv_bytes: 10\nsend_bytes: 20\nlatency: p50:1ms, p90:1ms, p99:1ms\nconns: new:0, reused:0\n------\nTotal\nrequests: 4, qps: 0.0, errors: 1 (25.00%), recv_bytes: 40, send_bytes: 80, active_requests: 0, active_conns: 0\n------"
 	testCtrlSuit(t, h, req, 200, expect)
 }
 
+func TestStatsHandlerJSON(t *testing.T) {
+	b := mockBalancer(t)
+	h := &StatsHandler{b}
+	req := httptest.NewRequest("GET", "/stats?format=json", nil)
+	b.VServers[0].ServerStats["127.0.0.1:10001"] = stats.New()
+	b.VServers[0].ServerStats["127.0.0.1:10001"].Inc(&stats.Data{StatusCode: "200", Method: "GET", Path: "/", OutBytes: 20})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var result []balancer.VirtualServerStats
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+	require.Equal(t, 1, len(result))
+	assert.Equal(t, "web", result[0].Name)
+	peer := result[0].Peers["127.0.0.1:10001"]
+	require.NotNil(t, peer)
+	assert.Equal(t, uint64(1), peer.StatusCode["200"])
+	assert.Equal(t, uint64(20), peer.OutBytes)
+	assert.Equal(t, uint64(1), peer.Latency.Count)
+	assert.Equal(t, 0, len(result[0].Clients))
+}
+
+func TestTotalStats(t *testing.T) {
+	b := mockBalancer(t)
+	ss := stats.New()
+	ss.Inc(&stats.Data{StatusCode: "200", Method: "GET", Path: "/", OutBytes: 20})
+	ss.Inc(&stats.Data{StatusCode: "502", Method: "GET", Path: "/", OutBytes: 10})
+	b.VServers[0].ServerStats["127.0.0.1:10001"] = ss
+
+	rr := httptest.NewRecorder()
+	TotalStats(b).ServeHTTP(rr, httptest.NewRequest("GET", "/stats/total", nil))
+	assert.Equal(t, 200, rr.Code)
+	var result balancer.AggregateStats
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+	assert.Equal(t, uint64(2), result.Requests)
+	assert.Equal(t, uint64(1), result.Errors)
+	assert.Equal(t, float64(50), result.ErrorRate)
+	assert.Equal(t, uint64(30), result.OutBytes)
+}
+
+func TestResetAndDeltaStats(t *testing.T) {
+	b := mockBalancer(t)
+	data := &stats.Data{StatusCode: "200", Method: "GET", Path: "/"}
+	b.VServers[0].ServerStats["127.0.0.1:10001"] = stats.New()
+	b.VServers[0].ServerStats["127.0.0.1:10001"].Inc(data)
+
+	delta := func() *stats.Report {
+		rr := httptest.NewRecorder()
+		StatsDelta(b).ServeHTTP(rr, httptest.NewRequest("GET", "/stats/delta", nil))
+		var result []balancer.VirtualServerStats
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+		return result[0].Peers["127.0.0.1:10001"]
+	}
+	assert.Equal(t, uint64(1), delta().StatusCode["200"])
+	assert.Equal(t, 0, len(delta().StatusCode))
+
+	h := ResetVirtualServerStats(b)
+	req := httptest.NewRequest("DELETE", "/vs/web/stats?peer=127.0.0.1:10002", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, h, req, 400, balancer.ErrPeerStatsNotFound.Error())
+
+	req = httptest.NewRequest("DELETE", "/vs/web/stats?peer=127.0.0.1:10001", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, h, req, 200, "Reset stats success")
+	assert.Equal(t, 0, len(b.VServers[0].ServerStats["127.0.0.1:10001"].StatusCode))
+
+	req = httptest.NewRequest("DELETE", "/vs/db/stats", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "db"})
+	testCtrlSuit(t, h, req, 400, balancer.ErrVirtualServerNotFound.Error())
+
+	b.VServers[0].ServerStats["127.0.0.1:10001"].Inc(data)
+	testCtrlSuit(t, ResetStats(b), httptest.NewRequest("DELETE", "/stats", nil), 200, "Reset stats success")
+	assert.Equal(t, 0, len(b.VServers[0].ServerStats["127.0.0.1:10001"].StatusCode))
+}
+
 func TestModifyVirtualServerStatus(t *testing.T) {
 	b := mockBalancer(t)
 	h := ModifyVirtualServerStatus(b)
@@ -200,3 +334,488 @@ func TestDeletePoolMember(t *testing.T) {
 	req = mux.SetURLVars(req, map[string]string{"name": "web"})
 	testCtrlSuit(t, h, req, 400, "EOF")
 }
+
+func TestFault(t *testing.T) {
+	b := mockBalancer(t)
+	vars := map[string]string{"name": "web"}
+
+	body, _ := json.Marshal(map[string]interface{}{"address": "127.0.0.1:10001", "down": true, "duration": 60})
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/fault", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, InjectFault(b), req, 200, "Inject fault success")
+
+	body, _ = json.Marshal(map[string]interface{}{"address": "127.0.0.1:10001", "down": true})
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/fault", bytes.NewReader(body)), vars)
+	rr := httptest.NewRecorder()
+	InjectFault(b).ServeHTTP(rr, req)
+	assert.Equal(t, 400, rr.Code)
+
+	rr = httptest.NewRecorder()
+	ListFault(b).ServeHTTP(rr, mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/fault", nil), vars))
+	var faults []balancer.Fault
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&faults))
+	require.Equal(t, 1, len(faults))
+	assert.Equal(t, "127.0.0.1:10001", faults[0].Peer)
+
+	body, _ = json.Marshal(map[string]string{"address": "127.0.0.1:10001"})
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/vs/web/fault", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, ClearFault(b), req, 200, "Clear fault success")
+
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/vs/web/fault", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, ClearFault(b), req, 404, ErrFaultNotFound.ErrMsg)
+
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/vs/db/fault", bytes.NewReader(body)), map[string]string{"name": "db"})
+	testCtrlSuit(t, ClearFault(b), req, 400, balancer.ErrVirtualServerNotFound.Error())
+}
+
+func TestMaintenance(t *testing.T) {
+	b := mockBalancer(t)
+	vars := map[string]string{"name": "web"}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	body, _ := json.Marshal(map[string]interface{}{"address": "127.0.0.1:10001", "enable": true})
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/maintenance", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, SetMaintenance(b), req, 200, "Set maintenance success")
+	assert.Contains(t, logs.String(), "audit=maintenance")
+	assert.NotContains(t, logs.String(), "audit=fault")
+
+	body, _ = json.Marshal(map[string]interface{}{"enable": true})
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/maintenance", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, SetMaintenance(b), req, 200, "Set maintenance success")
+
+	body, _ = json.Marshal(map[string]interface{}{"address": "127.0.0.1:10009", "enable": true})
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/maintenance", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, SetMaintenance(b), req, 400, balancer.ErrPeerNotInPool.Error())
+
+	rr := httptest.NewRecorder()
+	GetMaintenance(b).ServeHTTP(rr, mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/maintenance", nil), vars))
+	var m balancer.Maintenance
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&m))
+	assert.Equal(t, balancer.Maintenance{Enabled: true, Peers: []string{"127.0.0.1:10001"}}, m)
+}
+
+func TestListPeerWeight(t *testing.T) {
+	b := mockBalancer(t)
+
+	rr := httptest.NewRecorder()
+	ListPeerWeight(b).ServeHTTP(rr, mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/auto_weight", nil), map[string]string{"name": "web"}))
+	var weights []balancer.PeerWeight
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&weights))
+	assert.Equal(t, []balancer.PeerWeight{
+		{Peer: "127.0.0.1:10001", Percent: 100},
+		{Peer: "127.0.0.1:10002", Percent: 100},
+	}, weights)
+}
+
+func TestAccessLog(t *testing.T) {
+	b := mockBalancer(t)
+	vars := map[string]string{"name": "web"}
+
+	body := `{"sample":{"2XX":10,"3xx":0}}`
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/access_log", strings.NewReader(body)), vars)
+	testCtrlSuit(t, SetAccessLog(b), req, 200, "Set access log success")
+
+	rr := httptest.NewRecorder()
+	GetAccessLog(b).ServeHTTP(rr, mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/access_log", nil), vars))
+	var c config.AccessLog
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&c))
+	assert.Equal(t, map[string]float64{"2xx": 10, "3xx": 0}, c.Sample)
+
+	body = `{"sample":{"6xx":10}}`
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/access_log", strings.NewReader(body)), vars)
+	testCtrlSuit(t, SetAccessLog(b), req, 400, balancer.ErrStatusClass.Error())
+
+	body = `{"sample":{"5xx":200}}`
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/access_log", strings.NewReader(body)), vars)
+	testCtrlSuit(t, SetAccessLog(b), req, 400, balancer.ErrSamplePercent.Error())
+
+	body = `{"every":100,"errors_only":true,"slower_than":500}`
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/access_log", strings.NewReader(body)), vars)
+	testCtrlSuit(t, SetAccessLog(b), req, 200, "Set access log success")
+	rr = httptest.NewRecorder()
+	GetAccessLog(b).ServeHTTP(rr, mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/access_log", nil), vars))
+	c = config.AccessLog{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&c))
+	assert.Equal(t, config.AccessLog{Every: 100, ErrorsOnly: true, SlowerThan: 500}, c)
+}
+
+func TestDecommission(t *testing.T) {
+	b := mockBalancer(t)
+	vars := map[string]string{"name": "web"}
+
+	body, _ := json.Marshal(map[string]interface{}{"action": "start", "address": "127.0.0.1:10001", "quiet_period": 60})
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/decommission", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, Decommission(b), req, 200, "Decommission start success")
+
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/decommission", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, Decommission(b), req, 400, balancer.ErrDecommissionExisted.Error())
+
+	rr := httptest.NewRecorder()
+	ListDecommission(b).ServeHTTP(rr, mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/decommission", nil), vars))
+	var decommissions []balancer.Decommission
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&decommissions))
+	require.Equal(t, 1, len(decommissions))
+	assert.Equal(t, "127.0.0.1:10001", decommissions[0].Peer)
+	assert.Equal(t, balancer.DECOMMISSION_DRAINING, decommissions[0].State)
+	assert.Equal(t, int64(60), decommissions[0].QuietPeriod)
+
+	body, _ = json.Marshal(map[string]string{"action": "confirm", "address": "127.0.0.1:10001"})
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/decommission", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, Decommission(b), req, 400, balancer.ErrDecommissionNotVerified.Error())
+
+	body, _ = json.Marshal(map[string]string{"action": "abort", "address": "127.0.0.1:10001"})
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/decommission", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, Decommission(b), req, 200, "Decommission abort success")
+
+	body, _ = json.Marshal(map[string]string{"action": "drain", "address": "127.0.0.1:10001"})
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/decommission", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, Decommission(b), req, 400, ErrUnknownAction.ErrMsg)
+}
+
+func TestTombstone(t *testing.T) {
+	b := mockBalancer(t)
+	vars := map[string]string{"name": "web"}
+
+	rr := httptest.NewRecorder()
+	ListTombstone(b).ServeHTTP(rr, mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/tombstone", nil), vars))
+	assert.Equal(t, "[]\n", rr.Body.String())
+
+	body, _ := json.Marshal(map[string]string{"address": "127.0.0.1:10001"})
+	req := mux.SetURLVars(httptest.NewRequest("DELETE", "/vs/web/tombstone", bytes.NewReader(body)), vars)
+	testCtrlSuit(t, ResurrectPeer(b), req, 400, balancer.ErrTombstoneNotFound.Error())
+}
+
+func TestListEjection(t *testing.T) {
+	b := mockBalancer(t)
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/outlier", nil), map[string]string{"name": "web"})
+	testCtrlSuit(t, ListEjection(b), req, 200, "[]\n")
+}
+
+func TestDryRunRoute(t *testing.T) {
+	b := mockBalancer(t)
+
+	req := httptest.NewRequest("POST", "/route", strings.NewReader(`{"method":"GET","host":"localhost","path":"/"}`))
+	rr := httptest.NewRecorder()
+	DryRunRoute(b).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var result balancer.RouteResult
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+	assert.Equal(t, "web", result.VirtualServer)
+	assert.Equal(t, balancer.ROUTE_PROXY, result.Route)
+	assert.Equal(t, "127.0.0.1:10001, 127.0.0.1:10002", result.Pool)
+
+	req = httptest.NewRequest("POST", "/route", strings.NewReader(`{"host":"example.com"}`))
+	testCtrlSuit(t, DryRunRoute(b), req, 404, ErrRouteNotFound.ErrMsg)
+
+	req = httptest.NewRequest("POST", "/route", strings.NewReader(`{`))
+	testCtrlSuit(t, DryRunRoute(b), req, 400, "unexpected EOF")
+}
+
+func TestReloadClientCA(t *testing.T) {
+	b := mockBalancer(t)
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/client_ca", nil), map[string]string{"name": "web"})
+	testCtrlSuit(t, ReloadClientCA(b), req, 400, balancer.ErrClientCANotConfigured.Error())
+
+	req = mux.SetURLVars(req, map[string]string{"name": "not_exist"})
+	testCtrlSuit(t, ReloadClientCA(b), req, 400, balancer.ErrVirtualServerNotFound.Error())
+}
+
+func TestCloneVirtualServer(t *testing.T) {
+	b := mockBalancer(t)
+	h := CloneVirtualServer(b)
+	body, _ := json.Marshal(map[string]interface{}{
+		"name":    "web-staging",
+		"address": "127.0.0.1:9081",
+		"pool":    []map[string]interface{}{{"address": "127.0.0.1:10011"}},
+	})
+	req := httptest.NewRequest("POST", "/vs/web/clone", bytes.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, h, req, 200, "Clone success")
+
+	require.Equal(t, 2, len(b.VServers))
+	vs := b.VServers[1]
+	assert.Equal(t, "web-staging", vs.Name)
+	assert.Equal(t, "127.0.0.1:9081", vs.Address)
+	assert.Equal(t, b.VServers[0].LBMethod, vs.LBMethod)
+	assert.Equal(t, "127.0.0.1:10011", vs.Pool.String())
+	assert.Equal(t, balancer.STATUS_DISABLED, vs.Status())
+
+	// the name is used
+	req = httptest.NewRequest("POST", "/vs/web/clone", bytes.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, h, req, 400, balancer.ErrVirtualServerNameExisted.Error())
+
+	req = httptest.NewRequest("POST", "/vs/db/clone", bytes.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"name": "db"})
+	testCtrlSuit(t, h, req, 400, balancer.ErrVirtualServerNotFound.Error())
+}
+
+func TestListSplitStats(t *testing.T) {
+	b := mockBalancer(t)
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/canary", nil), map[string]string{"name": "web"})
+	testCtrlSuit(t, ListSplitStats(b), req, 404, ErrNoCanary.ErrMsg)
+
+	require.NoError(t, b.AddVirtualServer(&config.VirtualServer{
+		Name:    "canary",
+		Address: "127.0.0.1:8083",
+		Canary:  config.Canary{Percent: 10, Pool: []config.Server{{Address: "127.0.0.1:10003", Weight: 1}}},
+	}))
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/vs/canary/canary", nil), map[string]string{"name": "canary"})
+	rr := httptest.NewRecorder()
+	ListSplitStats(b).ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+	var split balancer.SplitStats
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&split))
+	assert.Equal(t, 10.0, split.Percent)
+	assert.Equal(t, "127.0.0.1:10003", split.CanaryPool)
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	b := mockBalancer(t)
+	base := &config.Configuration{Controller: config.Controller{Address: ":6587", Auth: config.Authentication{Username: "admin", Password: "admin"}}}
+	req := httptest.NewRequest("GET", "/config", nil)
+	rr := httptest.NewRecorder()
+	EffectiveConfig(b, base).ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+
+	var c config.Configuration
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&c))
+	assert.Equal(t, config.REDACTED, c.Controller.Auth.Password)
+	require.Len(t, c.VServers, 1)
+	assert.Equal(t, "web", c.VServers[0].Name)
+	assert.Equal(t, "http", c.VServers[0].Protocol)
+}
+
+func TestListMirrorStats(t *testing.T) {
+	b := mockBalancer(t)
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/mirror", nil), map[string]string{"name": "web"})
+	testCtrlSuit(t, ListMirrorStats(b), req, 404, ErrNoMirror.ErrMsg)
+}
+
+func TestListCompressionStats(t *testing.T) {
+	b := mockBalancer(t)
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/compression", nil), map[string]string{"name": "web"})
+	testCtrlSuit(t, ListCompressionStats(b), req, 404, ErrNoCompression.ErrMsg)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	b := mockBalancer(t)
+	c := New(&config.Controller{
+		Address: ":6587",
+		Auth:    config.Authentication{Username: "admin", Password: "admin"},
+		Metrics: config.MetricsListener{Address: ":6588", Auth: config.Authentication{Username: "prom", Password: "scrape"}},
+	})
+	assert.Equal(t, ":6588", c.MetricsAddress)
+	h := c.MetricsHandler(b)
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	testCtrlSuit(t, h, req, 401, ErrUnauthorized.ErrMsg)
+	req = httptest.NewRequest("GET", "/health", nil)
+	req.SetBasicAuth("admin", "admin")
+	testCtrlSuit(t, h, req, 401, ErrUnauthorized.ErrMsg)
+	req = httptest.NewRequest("GET", "/health", nil)
+	req.SetBasicAuth("prom", "scrape")
+	testCtrlSuit(t, h, req, 200, "OK")
+
+	rr := httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/stats?format=json", nil)
+	req.SetBasicAuth("prom", "scrape")
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+
+	// the control endpoints are not served
+	for _, method := range []string{"GET", "POST"} {
+		rr = httptest.NewRecorder()
+		req = httptest.NewRequest(method, "/vs", nil)
+		req.SetBasicAuth("prom", "scrape")
+		h.ServeHTTP(rr, req)
+		assert.Equal(t, 404, rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", "/stats", nil)
+	req.SetBasicAuth("prom", "scrape")
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, 405, rr.Code)
+
+	// no authentication without a username
+	c = New(&config.Controller{Address: ":6587", Metrics: config.MetricsListener{Address: ":6588"}})
+	assert.Nil(t, c.MetricsAuth)
+	testCtrlSuit(t, c.MetricsHandler(b), httptest.NewRequest("GET", "/health", nil), 200, "OK")
+}
+
+func TestCache(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8082","pool":[{"address":"127.0.0.1:10001"}],"cache":{"enable":true}}]}`
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := balancer.New(c.VServers)
+	require.NoError(t, err)
+	vars := map[string]string{"name": "web"}
+
+	rr := httptest.NewRecorder()
+	ListCacheStats(b).ServeHTTP(rr, mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/cache", nil), vars))
+	var stats balancer.CacheStats
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stats))
+	assert.Equal(t, int64(balancer.DEFAULT_CACHE_MAX_SIZE), stats.MaxSize)
+
+	req := mux.SetURLVars(httptest.NewRequest("DELETE", "/vs/web/cache", nil), vars)
+	testCtrlSuit(t, PurgeCache(b), req, 200, "Purged 0 cached responses")
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/vs/web/cache", strings.NewReader(`{"path":"/static/"}`)), vars)
+	testCtrlSuit(t, PurgeCache(b), req, 200, "Purged 0 cached responses")
+
+	b = mockBalancer(t)
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/cache", nil), vars)
+	testCtrlSuit(t, ListCacheStats(b), req, 404, ErrNoCache.ErrMsg)
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/vs/web/cache", nil), vars)
+	testCtrlSuit(t, PurgeCache(b), req, 404, ErrNoCache.ErrMsg)
+}
+
+func TestValidateConfig(t *testing.T) {
+	req := httptest.NewRequest("POST", "/config/validate", strings.NewReader(`{"virtual_server":[{"name":"web","address":":8081"}]}`))
+	testCtrlSuit(t, ValidateConfig(), req, 200, "Configuration is valid")
+
+	req = httptest.NewRequest("POST", "/config/validate", strings.NewReader(`{"virtual_server":[{"name":"web"}],"reloads":{}}`))
+	rr := httptest.NewRecorder()
+	ValidateConfig().ServeHTTP(rr, req)
+	assert.Equal(t, 400, rr.Code)
+	var verr config.ValidationError
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&verr))
+	assert.Equal(t, []string{"unknown field reloads", "virtual_server web: " + config.ErrVirtualServerAddressEmpty.Error()}, verr.Problems)
+}
+
+func TestCluster(t *testing.T) {
+	b := mockBalancer(t)
+	testCtrlSuit(t, ListClusterMember(b), httptest.NewRequest("GET", "/cluster", nil), 404, ErrNoCluster.ErrMsg)
+
+	cluster, err := b.StartCluster(config.Cluster{Node: "golb-1"})
+	require.NoError(t, err)
+	defer cluster.Stop()
+	req := httptest.NewRequest("POST", "/cluster", strings.NewReader(`{"node":"golb-1"}`))
+	testCtrlSuit(t, MergeClusterState(b), req, 400, balancer.ErrClusterNode.Error())
+	req = httptest.NewRequest("POST", "/cluster", strings.NewReader(`{"node":"golb-2","down":{"web":["127.0.0.1:10001"]}}`))
+	testCtrlSuit(t, MergeClusterState(b), req, 200, "OK")
+
+	rr := httptest.NewRecorder()
+	ListClusterMember(b).ServeHTTP(rr, httptest.NewRequest("GET", "/cluster", nil))
+	var members []balancer.Member
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&members))
+	require.Len(t, members, 1)
+	assert.Equal(t, "golb-2", members[0].Node)
+	assert.Equal(t, map[string][]string{"web": {"127.0.0.1:10001"}}, members[0].Down)
+}
+
+func TestFailoverStatus(t *testing.T) {
+	testCtrlSuit(t, FailoverStatus(nil), httptest.NewRequest("GET", "/failover", nil), 404, ErrNoFailover.ErrMsg)
+
+	node, err := failover.New(failover.AddressOpt("127.0.0.1:1985"), failover.PeersOpt([]string{"127.0.0.1:1986"}))
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	FailoverStatus(node).ServeHTTP(rr, httptest.NewRequest("GET", "/failover", nil))
+	var status failover.Status
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+	assert.Equal(t, "127.0.0.1:1985", status.Address)
+	assert.Equal(t, failover.STATE_INIT, status.State)
+}
+
+func TestReload(t *testing.T) {
+	b := mockBalancer(t)
+	testCtrlSuit(t, GetReload(b), httptest.NewRequest("GET", "/reload", nil), 404, ErrNoReload.ErrMsg)
+
+	req := httptest.NewRequest("POST", "/reload", strings.NewReader(`{"virtual_server":[{"name":"web"}]}`))
+	testCtrlSuit(t, Reload(b), req, 400, config.ErrVirtualServerAddressEmpty.Error())
+
+	body := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8082","server_name":"localhost",
+		"pool":[{"address":"127.0.0.1:10003"}]}],"reload":{"batch_size":1}}`
+	rr := httptest.NewRecorder()
+	Reload(b).ServeHTTP(rr, httptest.NewRequest("POST", "/reload", strings.NewReader(body)))
+	require.Equal(t, 200, rr.Code)
+	var rollout balancer.Rollout
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&rollout))
+	require.Len(t, rollout.Changes, 1)
+	assert.Equal(t, balancer.RELOAD_UPDATE, rollout.Changes[0].Action)
+
+	deadline := time.Now().Add(time.Second)
+	for rollout.State != balancer.ROLLOUT_DONE {
+		require.True(t, time.Now().Before(deadline), "reload is %s", rollout.State)
+		time.Sleep(10 * time.Millisecond)
+		rr = httptest.NewRecorder()
+		GetReload(b).ServeHTTP(rr, httptest.NewRequest("GET", "/reload", nil))
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&rollout))
+	}
+	vs, err := b.FindVirtualServer("web")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:10003"}, vs.Pool.Peers())
+}
+
+func TestDrainPoolMember(t *testing.T) {
+	b := mockBalancer(t)
+	vars := map[string]string{"name": "web"}
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/pool", strings.NewReader(`{"address":"127.0.0.1:10001","weight":0}`)), vars)
+	testCtrlSuit(t, AddPoolMember(b), req, 200, "Add peer success")
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/vs/web", nil), vars)
+	testCtrlSuit(t, ListVirtualServer(b), req, 200, "127.0.0.1:10001, 127.0.0.1:10002\nDrained: 127.0.0.1:10001")
+
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/pool", strings.NewReader(`{"address":"127.0.0.1:10001","weight":-1}`)), vars)
+	testCtrlSuit(t, AddPoolMember(b), req, 400, balancer.ErrNegativeWeight.Error())
+
+	// the weight defaults to 1
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/vs/web/pool", strings.NewReader(`{"address":"127.0.0.1:10001"}`)), vars)
+	testCtrlSuit(t, AddPoolMember(b), req, 200, "Add peer success")
+	assert.Empty(t, b.VServers[0].Drained())
+}
+
+func TestReady(t *testing.T) {
+	b := mockBalancer(t)
+	testCtrlSuit(t, Ready(b), httptest.NewRequest("GET", "/ready", nil), 200, "OK")
+
+	c, err := config.LoadFromString(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8082","critical":true,
+		"pool":[{"address":"127.0.0.1:10001"}]},{"name":"api","address":"127.0.0.1:8083","critical":true}]}`)
+	require.NoError(t, err)
+	b, err = balancer.New(c.VServers)
+	require.NoError(t, err)
+	testCtrlSuit(t, Ready(b), httptest.NewRequest("GET", "/ready", nil), 503, "web is stopped\napi is stopped")
+}
+
+func TestHealthz(t *testing.T) {
+	b := mockBalancer(t)
+	// the stopped virtual servers are not checked
+	testCtrlSuit(t, Healthz(b), httptest.NewRequest("GET", "/healthz", nil), 200, "OK")
+
+	h := VirtualServerHealthz(b)
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/vs/web/healthz", nil), map[string]string{"name": "web"})
+	testCtrlSuit(t, h, req, 503, "web is stopped\n")
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/vs/none/healthz", nil), map[string]string{"name": "none"})
+	testCtrlSuit(t, h, req, 400, balancer.ErrVirtualServerNotFound.Error())
+}
+
+func TestDebugRoutes(t *testing.T) {
+	r := mux.NewRouter()
+	debugRoutes(r)
+	for path, expect := range map[string]string{
+		"/debug/pprof/":                  "goroutine",
+		"/debug/pprof/goroutine?debug=1": "goroutine profile",
+		"/debug/pprof/cmdline":           "",
+		"/debug/vars":                    "memstats",
+	} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, 200, rr.Code, path)
+		assert.Contains(t, rr.Body.String(), expect, path)
+	}
+}
+
+func TestUIRoutes(t *testing.T) {
+	r := mux.NewRouter()
+	uiRoutes(r)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/ui/", nil))
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "DENY", rr.Header().Get("X-Frame-Options"))
+	assert.Contains(t, rr.Body.String(), `call("GET", "/vs?format=json")`)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/ui", nil))
+	assert.Equal(t, http.StatusMovedPermanently, rr.Code)
+	assert.Equal(t, "/ui/", rr.Header().Get("Location"))
+}
@@ -0,0 +1,19 @@
+package controller
+
+import (
+	"expvar"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+// debugRoutes adds the pprof profiles and the expvar variables under /debug
+func debugRoutes(r *mux.Router) {
+	r.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// the index, and the named profiles: heap, goroutine, allocs, block, mutex, threadcreate
+	r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+}
@@ -14,6 +14,16 @@ func (ce *ControllerError) Error() string {
 var (
 	ErrUnauthorized  = &ControllerError{http.StatusUnauthorized, "Unauthorized"}
 	ErrUnknownAction = &ControllerError{http.StatusBadRequest, "Unknown action"}
+	ErrFaultNotFound = &ControllerError{http.StatusNotFound, "Fault not found"}
+	ErrRouteNotFound = &ControllerError{http.StatusNotFound, "Route not found"}
+	ErrNoCanary      = &ControllerError{http.StatusNotFound, "Canary not configured"}
+	ErrNoMirror      = &ControllerError{http.StatusNotFound, "Mirror not configured"}
+	ErrNoCompression = &ControllerError{http.StatusNotFound, "Compression not enabled"}
+	ErrNoCache       = &ControllerError{http.StatusNotFound, "Cache not enabled"}
+	ErrNoReload      = &ControllerError{http.StatusNotFound, "No reload"}
+	ErrNoCluster     = &ControllerError{http.StatusNotFound, "Cluster not enabled"}
+	ErrNoFailover    = &ControllerError{http.StatusNotFound, "Failover not enabled"}
+	ErrNoEvents      = &ControllerError{http.StatusNotFound, "Events not enabled"}
 )
 
 func WriteError(w http.ResponseWriter, err *ControllerError) {
@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// uiRoutes adds the web UI under /ui/, a single page calling the other endpoints
+// with the credentials the browser asked for it
+func uiRoutes(r *mux.Router) {
+	r.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently)).Methods("GET")
+	r.Handle("/ui/", UI()).Methods("GET")
+}
+
+func UI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		io.WriteString(w, uiPage)
+	})
+}
+
+// uiPage polls /vs and /stats every UI_REFRESH milliseconds, draws the requests and the
+// 5xx per second of the last minute, and drains, reweights or maintains the peers
+const uiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>golb</title>
+<style>
+body { font: 14px sans-serif; margin: 20px; color: #222; }
+h1 { font-size: 20px; }
+.vs { border: 1px solid #ccc; border-radius: 4px; padding: 10px 14px; margin-bottom: 16px; }
+.vs h2 { font-size: 16px; margin: 0 0 6px 0; }
+.meta { color: #666; }
+table { border-collapse: collapse; margin-top: 8px; }
+th, td { text-align: left; padding: 3px 12px 3px 0; }
+.up { color: #080; } .down { color: #c00; } .drained, .maintenance, .stopped { color: #a60; }
+button { margin-right: 4px; }
+canvas { border: 1px solid #eee; margin-top: 6px; }
+#error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>golb</h1>
+<div id="error"></div>
+<div id="vservers"></div>
+<script>
+var UI_REFRESH = 2000, POINTS = 30;
+var series = {}, last = {};
+
+function el(tag, attrs, children) {
+  var e = document.createElement(tag);
+  for (var k in attrs || {}) {
+    if (k === "onclick") { e.onclick = attrs[k]; } else { e.setAttribute(k, attrs[k]); }
+  }
+  (children || []).forEach(function (c) {
+    e.appendChild(typeof c === "string" ? document.createTextNode(c) : c);
+  });
+  return e;
+}
+
+function call(method, path, body) {
+  return fetch(path, {
+    method: method, credentials: "same-origin",
+    headers: body ? {"Content-Type": "application/json"} : {},
+    body: body ? JSON.stringify(body) : undefined
+  }).then(function (resp) {
+    return resp.text().then(function (text) {
+      if (!resp.ok) { throw new Error(resp.status + " " + text); }
+      return text;
+    });
+  });
+}
+
+function action(method, path, body) {
+  call(method, path, body).then(refresh, function (err) { alert(err.message); });
+}
+
+function state(p) {
+  if (p.maintenance) { return "maintenance"; }
+  if (p.weight === 0) { return "drained"; }
+  return p.down ? "down" : "up";
+}
+
+function withWeight(p, weight) {
+  var server = Object.assign({}, p);
+  delete server.down; delete server.maintenance;
+  server.weight = weight;
+  return server;
+}
+
+function peerRow(vs, p) {
+  var path = "/vs/" + encodeURIComponent(vs.name);
+  var buttons = [];
+  if (p.weight > 0) {
+    buttons.push(el("button", {onclick: function () { action("POST", path + "/pool", withWeight(p, 0)); }}, ["Drain"]));
+  }
+  buttons.push(el("button", {onclick: function () {
+    var w = prompt("Weight of " + p.address, p.weight || 1);
+    if (w !== null && /^\d+$/.test(w)) { action("POST", path + "/pool", withWeight(p, parseInt(w, 10))); }
+  }}, [p.weight > 0 ? "Weight" : "Enable"]));
+  buttons.push(el("button", {onclick: function () {
+    action("POST", path + "/maintenance", {address: p.address, enable: !p.maintenance});
+  }}, [p.maintenance ? "End maintenance" : "Maintenance"]));
+  var s = state(p);
+  return el("tr", {}, [el("td", {}, [p.address]), el("td", {}, [p.scheme]), el("td", {}, [String(p.weight)]),
+    el("td", {}, [p.backup ? "backup" : ""]), el("td", {"class": s}, [s]), el("td", {}, buttons)]);
+}
+
+function draw(canvas, points) {
+  var ctx = canvas.getContext("2d"), w = canvas.width, h = canvas.height;
+  var max = 1;
+  points.forEach(function (p) { max = Math.max(max, p.requests); });
+  ctx.clearRect(0, 0, w, h);
+  [["requests", "#36c"], ["errors", "#c00"]].forEach(function (serie) {
+    ctx.strokeStyle = serie[1];
+    ctx.beginPath();
+    points.forEach(function (p, i) {
+      var x = i * w / (POINTS - 1), y = h - 2 - p[serie[0]] * (h - 4) / max;
+      if (i === 0) { ctx.moveTo(x, y); } else { ctx.lineTo(x, y); }
+    });
+    ctx.stroke();
+  });
+  ctx.fillStyle = "#666";
+  ctx.fillText(max.toFixed(1) + " req/s", 4, 12);
+}
+
+// record appends the requests and 5xx per second since the previous poll
+function record(stat, now) {
+  var requests = 0, errors = 0;
+  for (var peer in stat.peers) {
+    var r = stat.peers[peer];
+    requests += r.latency ? r.latency.count : 0;
+    for (var code in r.status_code) { if (code[0] === "5") { errors += r.status_code[code]; } }
+  }
+  var prev = last[stat.name], points = series[stat.name] || [];
+  if (prev && requests >= prev.requests) {
+    var seconds = (now - prev.time) / 1000;
+    points.push({requests: (requests - prev.requests) / seconds, errors: (errors - prev.errors) / seconds});
+    if (points.length > POINTS) { points.shift(); }
+  }
+  series[stat.name] = points;
+  last[stat.name] = {requests: requests, errors: errors, time: now};
+}
+
+function render(vservers, stats) {
+  var byName = {};
+  stats.forEach(function (s) { byName[s.name] = s; });
+  var root = document.getElementById("vservers");
+  root.innerHTML = "";
+  vservers.forEach(function (vs) {
+    var path = "/vs/" + encodeURIComponent(vs.name);
+    var total = (byName[vs.name] || {}).total || {};
+    var enabled = vs.status !== "stopped";
+    var rows = [el("tr", {}, ["Address", "Scheme", "Weight", "", "State", ""].map(function (t) { return el("th", {}, [t]); }))];
+    vs.peers.forEach(function (p) { rows.push(peerRow(vs, p)); });
+    var canvas = el("canvas", {width: 600, height: 80});
+    root.appendChild(el("div", {"class": "vs"}, [
+      el("h2", {}, [vs.name + " ", el("span", {"class": vs.status}, ["(" + vs.status + ")"]), " ",
+        el("button", {onclick: function () { action("POST", path, {action: enabled ? "disable" : "enable"}); }},
+          [enabled ? "Disable" : "Enable"])]),
+      el("div", {"class": "meta"}, [vs.address + ", " + vs.lb_method + ", " +
+        (total.qps || 0).toFixed(1) + " req/s, " + (total.error_rate || 0).toFixed(2) + "% 5xx, " +
+        (total.active_requests || 0) + " active requests, " + (total.active_conns || 0) + " connections"]),
+      canvas, el("table", {}, rows)]));
+    draw(canvas, series[vs.name] || []);
+  });
+}
+
+function refresh() {
+  Promise.all([call("GET", "/vs?format=json"), call("GET", "/stats?format=json")]).then(function (res) {
+    var vservers = JSON.parse(res[0]), stats = JSON.parse(res[1]), now = Date.now();
+    stats.forEach(function (s) { record(s, now); });
+    document.getElementById("error").textContent = "";
+    render(vservers, stats);
+  }, function (err) {
+    document.getElementById("error").textContent = err.message;
+  });
+}
+
+refresh();
+setInterval(refresh, UI_REFRESH);
+</script>
+</body>
+</html>
+`
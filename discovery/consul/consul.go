@@ -0,0 +1,185 @@
+// package consul populates the pools from the Consul health API
+//
+// a virtual server with "service" configured is watched with blocking queries on
+//
+//	GET /v1/health/service/<service>?passing=true
+//
+// only the instances passing all health checks are kept in the pool,
+// the peer weight is taken from a "weight=<n>" tag, default 1, "weight=0" drains the peer
+//
+// the peers configured statically in the pool are never removed
+package consul
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/pkg/transport"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/dns"
+)
+
+const (
+	WEIGHT_TAG_PREFIX = "weight="
+	WAIT_TIME         = "5m"
+	RETRY_INTERVAL    = 5 * time.Second
+)
+
+type ConsulClient struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+func New(address, token, certFile, keyFile, trustedCAFile string, resolver *dns.Resolver) (*ConsulClient, error) {
+	var tlsConfig *tls.Config
+	if certFile != "" && keyFile != "" {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      certFile,
+			KeyFile:       keyFile,
+			TrustedCAFile: trustedCAFile,
+		}
+		var err error
+		tlsConfig, err = tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !strings.Contains(address, "://") {
+		scheme := "http"
+		if tlsConfig != nil {
+			scheme = "https"
+		}
+		address = scheme + "://" + address
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	t.DialContext = resolver.Dialer(5 * time.Second).DialContext
+	return &ConsulClient{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		client:  &http.Client{Transport: t},
+	}, nil
+}
+
+// Instance is a healthy service instance
+type Instance struct {
+	Address string
+	Weight  int
+}
+
+type serviceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+	}
+}
+
+func (e *serviceEntry) instance() Instance {
+	host := e.Service.Address
+	if host == "" {
+		host = e.Node.Address
+	}
+	weight := 1
+	for _, tag := range e.Service.Tags {
+		if strings.HasPrefix(tag, WEIGHT_TAG_PREFIX) {
+			if w, err := strconv.Atoi(tag[len(WEIGHT_TAG_PREFIX):]); err == nil && w >= 0 {
+				weight = w
+			}
+		}
+	}
+	return Instance{
+		Address: net.JoinHostPort(host, strconv.Itoa(e.Service.Port)),
+		Weight:  weight,
+	}
+}
+
+// Healthy does a blocking query, it returns when the instances change after index,
+// or the wait time expires
+func (cc *ConsulClient) Healthy(service string, index uint64) ([]Instance, uint64, error) {
+	u := fmt.Sprintf("%s/v1/health/service/%s?passing=true&wait=%s&index=%d",
+		cc.address, url.PathEscape(service), WAIT_TIME, index)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, index, err
+	}
+	if cc.token != "" {
+		req.Header.Set("X-Consul-Token", cc.token)
+	}
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return nil, index, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, index, fmt.Errorf("consul responds %s", resp.Status)
+	}
+
+	var entries []serviceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, index, err
+	}
+	if idx, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64); err == nil {
+		// reset the index if it goes backwards, refer to consul blocking queries
+		if idx < index {
+			idx = 0
+		}
+		index = idx
+	}
+
+	instances := make([]Instance, len(entries))
+	for i := range entries {
+		instances[i] = entries[i].instance()
+	}
+	return instances, index, nil
+}
+
+func desired(instances []Instance) map[string]int {
+	result := make(map[string]int, len(instances))
+	for _, ins := range instances {
+		result[ins.Address] = ins.Weight
+	}
+	return result
+}
+
+func (cc *ConsulClient) watch(vs *balancer.VirtualServer) {
+	known := map[string]int{}
+	var index uint64
+	for {
+		instances, next, err := cc.Healthy(vs.Service, index)
+		if err != nil {
+			log.Errorf("[%s] consul watch service %q err=%v", vs.Name, vs.Service, err)
+			time.Sleep(RETRY_INTERVAL)
+			continue
+		}
+		vs.SyncPeers("consul", known, desired(instances))
+		index = next
+	}
+}
+
+func (cc *ConsulClient) Run(balancer *balancer.Balancer) {
+	balancer.RLock()
+	defer balancer.RUnlock()
+
+	for _, vs := range balancer.VServers {
+		if vs.Service == "" {
+			continue
+		}
+		log.Infof("[%s] watching consul service %q", vs.Name, vs.Service)
+		go cc.watch(vs)
+	}
+}
@@ -0,0 +1,75 @@
+package consul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/config"
+)
+
+const entries = `[
+	{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"","Port":8080,"Tags":["weight=3"]}},
+	{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"10.0.0.2","Port":8080,"Tags":["v1","weight=x"]}}
+]`
+
+func TestHealthy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/health/service/web", r.URL.Path)
+		assert.Equal(t, "true", r.URL.Query().Get("passing"))
+		assert.Equal(t, "secret", r.Header.Get("X-Consul-Token"))
+		w.Header().Set("X-Consul-Index", "42")
+		w.Write([]byte(entries))
+	}))
+	defer ts.Close()
+
+	cc, err := New(ts.URL[7:], "secret", "", "", "", nil)
+	require.NoError(t, err)
+	instances, index, err := cc.Healthy("web", 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), index)
+	assert.Equal(t, []Instance{{"10.0.0.1:8080", 3}, {"10.0.0.2:8080", 1}}, instances)
+
+	// index goes backwards
+	_, index, err = cc.Healthy("web", 100)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), index)
+}
+
+func TestHealthyError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	cc, err := New(ts.URL, "", "", "", "", nil)
+	require.NoError(t, err)
+	_, index, err := cc.Healthy("web", 7)
+	assert.Contains(t, err.Error(), "403")
+	assert.Equal(t, uint64(7), index)
+}
+
+func TestDesired(t *testing.T) {
+	vs, err := balancer.NewVirtualServer(
+		balancer.NameOpt("web"),
+		balancer.AddressOpt(":80"),
+		balancer.PoolOpt([]config.Server{{Address: "127.0.0.1:10001", Weight: 1}}),
+	)
+	require.NoError(t, err)
+
+	known := map[string]int{}
+	vs.SyncPeers("consul", known, desired([]Instance{{"10.0.0.1:8080", 1}, {"10.0.0.2:8080", 1}}))
+	assert.Equal(t, "10.0.0.1:8080, 10.0.0.2:8080, 127.0.0.1:10001", vs.Pool.String())
+
+	vs.SyncPeers("consul", known, desired([]Instance{{"10.0.0.2:8080", 2}}))
+	assert.Equal(t, "10.0.0.2:8080, 127.0.0.1:10001", vs.Pool.String())
+	assert.Equal(t, map[string]int{"10.0.0.2:8080": 2}, known)
+
+	// static peers are kept
+	vs.SyncPeers("consul", known, desired(nil))
+	assert.Equal(t, "127.0.0.1:10001", vs.Pool.String())
+}
@@ -4,11 +4,27 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/discovery/consul"
+	"github.com/onestraw/golb/discovery/ec2"
 	"github.com/onestraw/golb/discovery/etcd"
+	"github.com/onestraw/golb/discovery/gce"
+	"github.com/onestraw/golb/discovery/kubernetes"
+	"github.com/onestraw/golb/dns"
+)
+
+const (
+	TYPE_ETCD       = "etcd"
+	TYPE_CONSUL     = "consul"
+	TYPE_KUBERNETES = "kubernetes"
+	TYPE_EC2        = "ec2"
+	TYPE_GCE        = "gce"
+
+	DEFAULT_POLL_INTERVAL = 60 * time.Second
 )
 
 type ServiceDiscovery struct {
@@ -19,10 +35,14 @@ type ServiceDiscovery struct {
 	CertFile      string
 	KeyFile       string
 	TrustedCAFile string
+	Token         string
+	Resolver      *dns.Resolver
+	// used by the backends polling cloud APIs
+	Interval time.Duration
 }
 
 func New(opts ...ServiceDiscoveryOption) (*ServiceDiscovery, error) {
-	sd := &ServiceDiscovery{Enabled: false}
+	sd := &ServiceDiscovery{Enabled: false, Interval: DEFAULT_POLL_INTERVAL}
 	for _, opt := range opts {
 		if err := opt(sd); err != nil {
 			return sd, err
@@ -36,7 +56,9 @@ type ServiceDiscoveryOption func(*ServiceDiscovery) error
 
 func TypeOpt(t string) ServiceDiscoveryOption {
 	return func(sd *ServiceDiscovery) error {
-		if t != "etcd" {
+		switch t {
+		case TYPE_ETCD, TYPE_CONSUL, TYPE_KUBERNETES, TYPE_EC2, TYPE_GCE:
+		default:
 			return fmt.Errorf("service discovery type %q currently not supported", t)
 		}
 		sd.Type = t
@@ -44,9 +66,11 @@ func TypeOpt(t string) ServiceDiscoveryOption {
 	}
 }
 
+// ClusterOpt should be called after TypeOpt, kubernetes uses the in-cluster API server if empty.
+// It is the region for ec2, and the project for gce
 func ClusterOpt(c string) ServiceDiscoveryOption {
 	return func(sd *ServiceDiscovery) error {
-		if c == "" {
+		if c == "" && sd.Type != TYPE_KUBERNETES {
 			return fmt.Errorf("Cluster can not be empty")
 		}
 		sd.Cluster = c
@@ -54,8 +78,12 @@ func ClusterOpt(c string) ServiceDiscoveryOption {
 	}
 }
 
+// PrefixOpt is used by etcd only, it should be called after TypeOpt
 func PrefixOpt(p string) ServiceDiscoveryOption {
 	return func(sd *ServiceDiscovery) error {
+		if sd.Type != TYPE_ETCD {
+			return nil
+		}
 		p = strings.TrimSuffix(p, "/")
 		if p == "" {
 			return fmt.Errorf("Prefix can not be empty")
@@ -70,8 +98,18 @@ func PrefixOpt(p string) ServiceDiscoveryOption {
 		return nil
 	}
 }
+
+// TokenOpt sets the consul ACL token, the kubernetes bearer token or the gce access token
+func TokenOpt(token string) ServiceDiscoveryOption {
+	return func(sd *ServiceDiscovery) error {
+		sd.Token = token
+		return nil
+	}
+}
+
 func SecurityOpt(certFile, keyFile, trustedCAFile string) ServiceDiscoveryOption {
 	return func(sd *ServiceDiscovery) error {
+		sd.TrustedCAFile = trustedCAFile
 		if certFile == "" && keyFile == "" {
 			log.Infof("Service discovery security (https) is disabled")
 			return nil
@@ -84,7 +122,24 @@ func SecurityOpt(certFile, keyFile, trustedCAFile string) ServiceDiscoveryOption
 		}
 		sd.CertFile = certFile
 		sd.KeyFile = keyFile
-		sd.TrustedCAFile = trustedCAFile
+		return nil
+	}
+}
+
+// IntervalOpt sets how often ec2 and gce are polled, 0 means DEFAULT_POLL_INTERVAL
+func IntervalOpt(interval time.Duration) ServiceDiscoveryOption {
+	return func(sd *ServiceDiscovery) error {
+		if interval > 0 {
+			sd.Interval = interval
+		}
+		return nil
+	}
+}
+
+// ResolverOpt resolves the cluster endpoints with r instead of the host resolver
+func ResolverOpt(r *dns.Resolver) ServiceDiscoveryOption {
+	return func(sd *ServiceDiscovery) error {
+		sd.Resolver = r
 		return nil
 	}
 }
@@ -95,10 +150,31 @@ func (sd *ServiceDiscovery) Run(balancer *balancer.Balancer) {
 		return
 	}
 
-	cli, err := etcd.New(sd.Cluster, sd.Prefix, sd.CertFile, sd.KeyFile, sd.TrustedCAFile)
-	if err != nil {
-		log.Errorf("etcd.New() err=%v", err)
-		return
+	switch sd.Type {
+	case TYPE_ETCD:
+		cli, err := etcd.New(sd.Cluster, sd.Prefix, sd.CertFile, sd.KeyFile, sd.TrustedCAFile, sd.Resolver)
+		if err != nil {
+			log.Errorf("etcd.New() err=%v", err)
+			return
+		}
+		go cli.Run(balancer)
+	case TYPE_CONSUL:
+		cli, err := consul.New(sd.Cluster, sd.Token, sd.CertFile, sd.KeyFile, sd.TrustedCAFile, sd.Resolver)
+		if err != nil {
+			log.Errorf("consul.New() err=%v", err)
+			return
+		}
+		cli.Run(balancer)
+	case TYPE_KUBERNETES:
+		cli, err := kubernetes.New(sd.Cluster, sd.Token, sd.CertFile, sd.KeyFile, sd.TrustedCAFile, sd.Resolver)
+		if err != nil {
+			log.Errorf("kubernetes.New() err=%v", err)
+			return
+		}
+		cli.Run(balancer)
+	case TYPE_EC2:
+		ec2.New(sd.Cluster, sd.Interval, sd.Resolver).Run(balancer)
+	case TYPE_GCE:
+		gce.New(sd.Cluster, sd.Token, sd.Interval, sd.Resolver).Run(balancer)
 	}
-	go cli.Run(balancer)
 }
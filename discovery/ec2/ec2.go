@@ -0,0 +1,314 @@
+// package ec2 populates the pools from the running EC2 instances with a tag
+//
+// a virtual server with "service" configured as "<tag-key>=<tag-value>:<port>" polls
+//
+//	DescribeInstances Filter tag:<tag-key>=<tag-value>, instance-state-name=running
+//
+// and adds the private IP address of each instance with the port.
+// "cluster" is the region. The credentials are read from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or from the instance profile.
+package ec2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/dns"
+)
+
+const (
+	API_VERSION  = "2016-11-15"
+	SERVICE_NAME = "ec2"
+	METADATA_URL = "http://169.254.169.254/latest"
+	// refresh the instance profile credentials before they expire
+	CREDENTIALS_EARLY_EXPIRY = 5 * time.Minute
+)
+
+type Credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+type EC2Client struct {
+	region   string
+	endpoint string
+	metadata string
+	interval time.Duration
+	client   *http.Client
+
+	lock  sync.Mutex
+	creds *Credentials
+}
+
+func New(region string, interval time.Duration, resolver *dns.Resolver) *EC2Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = resolver.Dialer(5 * time.Second).DialContext
+	return &EC2Client{
+		region:   region,
+		endpoint: fmt.Sprintf("https://ec2.%s.amazonaws.com", region),
+		metadata: METADATA_URL,
+		interval: interval,
+		client:   &http.Client{Transport: t, Timeout: 30 * time.Second},
+	}
+}
+
+// Target is the tagged instances backing a pool
+type Target struct {
+	TagKey   string
+	TagValue string
+	Port     string
+}
+
+// ParseTarget parses "<tag-key>=<tag-value>:<port>"
+func ParseTarget(service string) (*Target, error) {
+	idx := strings.LastIndex(service, ":")
+	eq := strings.Index(service, "=")
+	if idx < 0 || eq <= 0 || eq > idx {
+		return nil, fmt.Errorf("service %q should be <tag-key>=<tag-value>:<port>", service)
+	}
+	if _, err := strconv.Atoi(service[idx+1:]); err != nil {
+		return nil, fmt.Errorf("service %q has an invalid port", service)
+	}
+	return &Target{TagKey: service[:eq], TagValue: service[eq+1 : idx], Port: service[idx+1:]}, nil
+}
+
+// credentials returns the credentials from the environment or the instance profile
+func (c *EC2Client) credentials() (*Credentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &Credentials{
+			AccessKeyId:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.creds != nil && time.Now().Add(CREDENTIALS_EARLY_EXPIRY).Before(c.creds.Expiration) {
+		return c.creds, nil
+	}
+
+	// IMDSv2 session token
+	req, _ := http.NewRequest("PUT", c.metadata+"/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := c.readMetadata(req)
+	if err != nil {
+		return nil, err
+	}
+	get := func(path string) (string, error) {
+		req, _ := http.NewRequest("GET", c.metadata+"/meta-data/iam/security-credentials/"+path, nil)
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		return c.readMetadata(req)
+	}
+	role, err := get("")
+	if err != nil {
+		return nil, err
+	}
+	data, err := get(strings.TrimSpace(strings.SplitN(role, "\n", 2)[0]))
+	if err != nil {
+		return nil, err
+	}
+	creds := &Credentials{}
+	if err := json.Unmarshal([]byte(data), creds); err != nil {
+		return nil, err
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+func (c *EC2Client) readMetadata(req *http.Request) (string, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata responds %s", resp.Status)
+	}
+	return string(data), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds the AWS Signature Version 4 headers to a request without body
+func sign(req *http.Request, creds *Credentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(v[0])
+		}
+	}
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// RFC 3986 encoding, url.Values encodes the space as '+'
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, query, canonicalHeaders, signedHeaders, hexSHA256(""),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyId, scope, signedHeaders, signature))
+}
+
+type describeInstancesResponse struct {
+	Reservations []struct {
+		Instances []struct {
+			InstanceId       string `xml:"instanceId"`
+			PrivateIpAddress string `xml:"privateIpAddress"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+// Instances returns the private IP addresses of the running instances of target
+func (c *EC2Client) Instances(t *Target) ([]string, error) {
+	creds, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []string{}
+	nextToken := ""
+	for {
+		query := url.Values{}
+		query.Set("Action", "DescribeInstances")
+		query.Set("Version", API_VERSION)
+		query.Set("Filter.1.Name", "tag:"+t.TagKey)
+		query.Set("Filter.1.Value.1", t.TagValue)
+		query.Set("Filter.2.Name", "instance-state-name")
+		query.Set("Filter.2.Value.1", "running")
+		if nextToken != "" {
+			query.Set("NextToken", nextToken)
+		}
+		req, err := http.NewRequest("GET", c.endpoint+"/?"+strings.Replace(query.Encode(), "+", "%20", -1), nil)
+		if err != nil {
+			return nil, err
+		}
+		sign(req, creds, c.region, SERVICE_NAME, time.Now())
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("ec2 responds %s: %s", resp.Status, data)
+		}
+
+		var result describeInstancesResponse
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+		for _, r := range result.Reservations {
+			for _, i := range r.Instances {
+				if i.PrivateIpAddress != "" {
+					ips = append(ips, i.PrivateIpAddress)
+				}
+			}
+		}
+		if result.NextToken == "" {
+			return ips, nil
+		}
+		nextToken = result.NextToken
+	}
+}
+
+func (c *EC2Client) poll(vs *balancer.VirtualServer, t *Target) {
+	known := map[string]int{}
+	for {
+		ips, err := c.Instances(t)
+		if err != nil {
+			log.Errorf("[%s] ec2 describe instances %s=%s err=%v", vs.Name, t.TagKey, t.TagValue, err)
+		} else {
+			desired := map[string]int{}
+			for _, ip := range ips {
+				desired[net.JoinHostPort(ip, t.Port)] = 1
+			}
+			vs.SyncPeers("ec2", known, desired)
+		}
+		time.Sleep(c.interval)
+	}
+}
+
+func (c *EC2Client) Run(balancer *balancer.Balancer) {
+	balancer.RLock()
+	defer balancer.RUnlock()
+
+	for _, vs := range balancer.VServers {
+		if vs.Service == "" {
+			continue
+		}
+		t, err := ParseTarget(vs.Service)
+		if err != nil {
+			log.Errorf("[%s] %v", vs.Name, err)
+			continue
+		}
+		log.Infof("[%s] polling ec2 instances tagged %s=%s", vs.Name, t.TagKey, t.TagValue)
+		go c.poll(vs, t)
+	}
+}
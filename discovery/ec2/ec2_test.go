@@ -0,0 +1,93 @@
+package ec2
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const page1 = `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+	<reservationSet><item><instancesSet>
+		<item><instanceId>i-1</instanceId><privateIpAddress>10.0.0.1</privateIpAddress></item>
+		<item><instanceId>i-2</instanceId><privateIpAddress>10.0.0.2</privateIpAddress></item>
+	</instancesSet></item></reservationSet>
+	<nextToken>page2</nextToken>
+</DescribeInstancesResponse>`
+
+const page2 = `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+	<reservationSet><item><instancesSet>
+		<item><instanceId>i-3</instanceId><privateIpAddress>10.0.0.3</privateIpAddress></item>
+	</instancesSet></item></reservationSet>
+</DescribeInstancesResponse>`
+
+func TestParseTarget(t *testing.T) {
+	target, err := ParseTarget("role=web:8080")
+	require.NoError(t, err)
+	assert.Equal(t, Target{"role", "web", "8080"}, *target)
+
+	for _, s := range []string{"role=web", "=web:80", "role:80", "role=web:http"} {
+		_, err = ParseTarget(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+// get-vanilla of the AWS Signature Version 4 test suite
+func TestSign(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+	creds := &Credentials{AccessKeyId: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	sign(req, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func TestInstances(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/api/token":
+			fmt.Fprint(w, "session")
+			return
+		case r.URL.Path == "/meta-data/iam/security-credentials/":
+			assert.Equal(t, "session", r.Header.Get("X-aws-ec2-metadata-token"))
+			fmt.Fprint(w, "golb-role")
+			return
+		case r.URL.Path == "/meta-data/iam/security-credentials/golb-role":
+			fmt.Fprintf(w, `{"AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"tok","Expiration":"%s"}`,
+				time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+			return
+		}
+
+		query := r.URL.Query()
+		assert.Equal(t, "DescribeInstances", query.Get("Action"))
+		assert.Equal(t, "tag:role", query.Get("Filter.1.Name"))
+		assert.Equal(t, "web server", query.Get("Filter.1.Value.1"))
+		assert.Equal(t, "running", query.Get("Filter.2.Value.1"))
+		assert.Equal(t, "tok", r.Header.Get("X-Amz-Security-Token"))
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		if query.Get("NextToken") == "page2" {
+			fmt.Fprint(w, page2)
+			return
+		}
+		fmt.Fprint(w, page1)
+	}))
+	defer ts.Close()
+
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	c := New("us-east-1", time.Minute, nil)
+	c.endpoint, c.metadata = ts.URL, ts.URL
+
+	ips, err := c.Instances(&Target{"role", "web server", "80"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, ips)
+	assert.Equal(t, "AKID", c.creds.AccessKeyId)
+}
@@ -12,6 +12,9 @@
 //
 // currently we only support add/remove peer in virtualserver
 // (/<prefix>/virtualserver/<vs_name>/pool/<127.0.0.1:8001>/address, 127.0.0.1:8001)
+//
+// backends should register themselves with a lease (see Register), so that
+// they leave the pool automatically when they stop refreshing the lease
 
 package etcd
 
@@ -19,6 +22,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
@@ -26,16 +30,20 @@ import (
 	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/coreos/etcd/pkg/transport"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 
 	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/dns"
 )
 
 type EtcdClient struct {
 	prefix string
 	cli    *clientv3.Client
+	// peers added by etcd, vs name -> peer address
+	known map[string]map[string]bool
 }
 
-func New(endpoints, prefix, certFile, keyFile, trustedCAFile string) (*EtcdClient, error) {
+func New(endpoints, prefix, certFile, keyFile, trustedCAFile string, resolver *dns.Resolver) (*EtcdClient, error) {
 	var err error
 	var tlsConfig *tls.Config
 	if certFile != "" && keyFile != "" {
@@ -49,10 +57,20 @@ func New(endpoints, prefix, certFile, keyFile, trustedCAFile string) (*EtcdClien
 			return nil, err
 		}
 	}
+	var dialOpts []grpc.DialOption
+	if resolver != nil {
+		dialOpts = append(dialOpts, grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			if idx := strings.Index(addr, "://"); idx >= 0 {
+				addr = addr[idx+3:]
+			}
+			return resolver.Dialer(timeout).Dial("tcp", addr)
+		}))
+	}
 	cli, err := clientv3.New(clientv3.Config{
 		Endpoints:   strings.Split(endpoints, ","),
 		DialTimeout: 5 * time.Second,
 		TLS:         tlsConfig,
+		DialOptions: dialOpts,
 	})
 	if err != nil {
 		return nil, err
@@ -61,6 +79,7 @@ func New(endpoints, prefix, certFile, keyFile, trustedCAFile string) (*EtcdClien
 	return &EtcdClient{
 		prefix: prefix,
 		cli:    cli,
+		known:  map[string]map[string]bool{},
 	}, nil
 }
 
@@ -74,6 +93,8 @@ type session struct {
 }
 
 const (
+	RETRY_INTERVAL = 5 * time.Second
+
 	VS_PREFIX     = "virtualserver"
 	POOL_PREFIX   = "pool"
 	ADDRESS_LABEL = "address"
@@ -101,25 +122,26 @@ func newSession(ev *clientv3.Event) (*session, error) {
 }
 
 func (ec *EtcdClient) Run(balancer *balancer.Balancer) {
+	defer ec.cli.Close()
+
 	log.Infof(`Currently we only support add/remove peer in virtualserver, the key format:
 	/<prefix>/virtualserver/<virtualserver_name>/pool/<peer_address>/address`)
 
-	// a. read the existing key
-	resp, err := ec.cli.Get(context.Background(), ec.prefix, clientv3.WithPrefix())
-	if err != nil {
-		log.Errorf("Get %q err=%v", ec.prefix, err)
-	} else {
-		for _, kv := range resp.Kvs {
-			ev := &clientv3.Event{Kv: kv, Type: mvccpb.PUT}
-			if err := ec.dispatch(balancer, ev); err != nil {
-				log.Errorf("handle '%v' err=%v", ev, err)
-			}
-		}
-	}
-	// b. watch the updates
 	for {
-		rch := ec.cli.Watch(context.Background(), ec.prefix, clientv3.WithPrefix())
+		// a. read the existing keys, and drop the peers which left while not watching
+		rev, err := ec.sync(balancer)
+		if err != nil {
+			log.Errorf("Get %q err=%v", ec.prefix, err)
+			time.Sleep(RETRY_INTERVAL)
+			continue
+		}
+		// b. watch the updates since the revision read
+		rch := ec.cli.Watch(context.Background(), ec.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
 		for wresp := range rch {
+			if err := wresp.Err(); err != nil {
+				log.Errorf("Watch %q err=%v", ec.prefix, err)
+				break
+			}
 			for _, ev := range wresp.Events {
 				if err := ec.dispatch(balancer, ev); err != nil {
 					log.Errorf("handle '%v' err=%v", ev, err)
@@ -127,7 +149,67 @@ func (ec *EtcdClient) Run(balancer *balancer.Balancer) {
 			}
 		}
 	}
-	ec.cli.Close()
+}
+
+// sync makes the peers added by etcd equal to the keys under prefix,
+// it returns the revision of the read
+func (ec *EtcdClient) sync(balancer *balancer.Balancer) (int64, error) {
+	resp, err := ec.cli.Get(context.Background(), ec.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	desired := map[string]map[string]bool{}
+	for _, kv := range resp.Kvs {
+		s, err := newSession(&clientv3.Event{Kv: kv, Type: mvccpb.PUT})
+		if err != nil {
+			log.Errorf("handle %q err=%v", kv.Key, err)
+			continue
+		}
+		if _, ok := desired[s.vsName]; !ok {
+			desired[s.vsName] = map[string]bool{}
+		}
+		desired[s.vsName][s.peer] = true
+	}
+
+	for vsName, peers := range ec.known {
+		for peer := range peers {
+			if !desired[vsName][peer] {
+				ec.remove(balancer, vsName, peer)
+			}
+		}
+	}
+	for vsName, peers := range desired {
+		for peer := range peers {
+			if err := ec.add(balancer, vsName, peer); err != nil {
+				log.Errorf("add peer %s to %q err=%v", peer, vsName, err)
+			}
+		}
+	}
+	return resp.Header.Revision, nil
+}
+
+func (ec *EtcdClient) add(balancer *balancer.Balancer, vsName, peer string) error {
+	vs, err := balancer.FindVirtualServer(vsName)
+	if err != nil {
+		return err
+	}
+	vs.AddPeer(peer)
+	if _, ok := ec.known[vsName]; !ok {
+		ec.known[vsName] = map[string]bool{}
+	}
+	ec.known[vsName][peer] = true
+	return nil
+}
+
+func (ec *EtcdClient) remove(balancer *balancer.Balancer, vsName, peer string) error {
+	delete(ec.known[vsName], peer)
+	vs, err := balancer.FindVirtualServer(vsName)
+	if err != nil {
+		return err
+	}
+	vs.RemovePeer(peer)
+	return nil
 }
 
 func (ec *EtcdClient) dispatch(balancer *balancer.Balancer, ev *clientv3.Event) error {
@@ -136,15 +218,44 @@ func (ec *EtcdClient) dispatch(balancer *balancer.Balancer, ev *clientv3.Event)
 	if err != nil {
 		return err
 	}
-	vs, err := balancer.FindVirtualServer(s.vsName)
+
+	if s.isDelete {
+		return ec.remove(balancer, s.vsName, s.peer)
+	}
+	return ec.add(balancer, s.vsName, s.peer)
+}
+
+// PeerKey returns the key registering peer to the pool of vsName
+func PeerKey(prefix, vsName, peer string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s/%s", prefix, VS_PREFIX, vsName, POOL_PREFIX, peer, ADDRESS_LABEL)
+}
+
+// Register puts the key of peer with a lease of ttl seconds, and keeps the lease alive
+// until ctx is done, then the key is deleted. If the peer dies, etcd removes the key
+// when the lease expires and golb drops the peer.
+func Register(ctx context.Context, cli *clientv3.Client, prefix, vsName, peer string, ttl int64) error {
+	lease, err := cli.Grant(ctx, ttl)
 	if err != nil {
 		return err
 	}
-
-	if s.isDelete {
-		vs.RemovePeer(s.peer)
-	} else {
-		vs.AddPeer(s.peer)
+	key := PeerKey(prefix, vsName, peer)
+	if _, err := cli.Put(ctx, key, peer, clientv3.WithLease(lease.ID)); err != nil {
+		return err
+	}
+	ch, err := cli.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return err
 	}
+
+	go func() {
+		// drain the keepalive responses until ctx is done or the lease is lost
+		for range ch {
+		}
+		revokeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := cli.Revoke(revokeCtx, lease.ID); err != nil {
+			log.Errorf("revoke lease of %q err=%v", key, err)
+		}
+	}()
 	return nil
 }
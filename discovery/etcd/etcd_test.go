@@ -0,0 +1,36 @@
+package etcd
+
+import (
+	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSession(t *testing.T) {
+	key := PeerKey("/golb", "web", "127.0.0.1:8001")
+	assert.Equal(t, "/golb/virtualserver/web/pool/127.0.0.1:8001/address", key)
+
+	ev := &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte("127.0.0.1:8001")}}
+	s, err := newSession(ev)
+	require.NoError(t, err)
+	assert.False(t, s.isDelete)
+	assert.Equal(t, "web", s.vsName)
+	assert.Equal(t, "127.0.0.1:8001", s.peer)
+
+	// the value is empty on deletion
+	ev = &clientv3.Event{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte(key)}}
+	s, err = newSession(ev)
+	require.NoError(t, err)
+	assert.True(t, s.isDelete)
+
+	ev = &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte("127.0.0.1:8002")}}
+	_, err = newSession(ev)
+	assert.NotNil(t, err)
+
+	ev = &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("/golb/virtualserver/web/address")}}
+	_, err = newSession(ev)
+	assert.Contains(t, err.Error(), "unidentified key")
+}
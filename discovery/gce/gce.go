@@ -0,0 +1,232 @@
+// package gce populates the pools from the running instances of GCE instance groups
+//
+// a virtual server with "service" configured as "<zone>/<instance-group>:<port>" polls
+//
+//	POST /compute/v1/projects/<project>/zones/<zone>/instanceGroups/<instance-group>/listInstances
+//
+// and adds the internal IP address of each instance with the port.
+// "cluster" is the project. The access token is "token" if configured,
+// otherwise the token of the default service account from the metadata server.
+package gce
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/dns"
+)
+
+const (
+	COMPUTE_URL  = "https://compute.googleapis.com/compute/v1"
+	METADATA_URL = "http://metadata.google.internal/computeMetadata/v1"
+	// refresh the metadata server token before it expires
+	TOKEN_EARLY_EXPIRY = time.Minute
+)
+
+type GCEClient struct {
+	project  string
+	endpoint string
+	metadata string
+	interval time.Duration
+	client   *http.Client
+
+	lock        sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	// the token is configured, never refreshed
+	staticToken bool
+}
+
+func New(project, token string, interval time.Duration, resolver *dns.Resolver) *GCEClient {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = resolver.Dialer(5 * time.Second).DialContext
+	return &GCEClient{
+		project:     project,
+		endpoint:    COMPUTE_URL,
+		metadata:    METADATA_URL,
+		interval:    interval,
+		client:      &http.Client{Transport: t, Timeout: 30 * time.Second},
+		token:       token,
+		staticToken: token != "",
+	}
+}
+
+// Target is the instance group backing a pool
+type Target struct {
+	Zone  string
+	Group string
+	Port  string
+}
+
+// ParseTarget parses "<zone>/<instance-group>:<port>"
+func ParseTarget(service string) (*Target, error) {
+	slash := strings.Index(service, "/")
+	idx := strings.LastIndex(service, ":")
+	if slash <= 0 || idx < slash+2 {
+		return nil, fmt.Errorf("service %q should be <zone>/<instance-group>:<port>", service)
+	}
+	if _, err := strconv.Atoi(service[idx+1:]); err != nil {
+		return nil, fmt.Errorf("service %q has an invalid port", service)
+	}
+	return &Target{Zone: service[:slash], Group: service[slash+1 : idx], Port: service[idx+1:]}, nil
+}
+
+// accessToken returns the configured token or the one of the default service account
+func (c *GCEClient) accessToken() (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.staticToken || (c.token != "" && time.Now().Add(TOKEN_EARLY_EXPIRY).Before(c.tokenExpiry)) {
+		return c.token, nil
+	}
+
+	req, _ := http.NewRequest("GET", c.metadata+"/instance/service-accounts/default/token", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := c.do(req, &result); err != nil {
+		return "", err
+	}
+	c.token = result.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+func (c *GCEClient) do(req *http.Request, v interface{}) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responds %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *GCEClient) call(method, path string, query url.Values, body interface{}, v interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if body != nil {
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	u := fmt.Sprintf("%s/projects/%s/%s?%s", c.endpoint, url.PathEscape(c.project), path, query.Encode())
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.do(req, v)
+}
+
+// Instances returns the internal IP addresses of the running instances of target
+func (c *GCEClient) Instances(t *Target) ([]string, error) {
+	zone := "zones/" + url.PathEscape(t.Zone)
+
+	// the members of the group are instance URLs
+	members := map[string]bool{}
+	query := url.Values{}
+	for {
+		var result struct {
+			Items []struct {
+				Instance string `json:"instance"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		path := zone + "/instanceGroups/" + url.PathEscape(t.Group) + "/listInstances"
+		if err := c.call("POST", path, query, map[string]string{"instanceState": "RUNNING"}, &result); err != nil {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			members[item.Instance] = true
+		}
+		if result.NextPageToken == "" {
+			break
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+	if len(members) == 0 {
+		return []string{}, nil
+	}
+
+	ips := []string{}
+	query = url.Values{}
+	for {
+		var result struct {
+			Items []struct {
+				SelfLink          string `json:"selfLink"`
+				NetworkInterfaces []struct {
+					NetworkIP string `json:"networkIP"`
+				} `json:"networkInterfaces"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := c.call("GET", zone+"/instances", query, nil, &result); err != nil {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			if members[item.SelfLink] && len(item.NetworkInterfaces) > 0 {
+				ips = append(ips, item.NetworkInterfaces[0].NetworkIP)
+			}
+		}
+		if result.NextPageToken == "" {
+			return ips, nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+func (c *GCEClient) poll(vs *balancer.VirtualServer, t *Target) {
+	known := map[string]int{}
+	for {
+		ips, err := c.Instances(t)
+		if err != nil {
+			log.Errorf("[%s] gce list instances of %s/%s err=%v", vs.Name, t.Zone, t.Group, err)
+		} else {
+			desired := map[string]int{}
+			for _, ip := range ips {
+				desired[net.JoinHostPort(ip, t.Port)] = 1
+			}
+			vs.SyncPeers("gce", known, desired)
+		}
+		time.Sleep(c.interval)
+	}
+}
+
+func (c *GCEClient) Run(balancer *balancer.Balancer) {
+	balancer.RLock()
+	defer balancer.RUnlock()
+
+	for _, vs := range balancer.VServers {
+		if vs.Service == "" {
+			continue
+		}
+		t, err := ParseTarget(vs.Service)
+		if err != nil {
+			log.Errorf("[%s] %v", vs.Name, err)
+			continue
+		}
+		log.Infof("[%s] polling gce instance group %s/%s", vs.Name, t.Zone, t.Group)
+		go c.poll(vs, t)
+	}
+}
@@ -0,0 +1,66 @@
+package gce
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	target, err := ParseTarget("us-central1-a/web:8080")
+	require.NoError(t, err)
+	assert.Equal(t, Target{"us-central1-a", "web", "8080"}, *target)
+
+	for _, s := range []string{"us-central1-a/web", "/web:80", "us-central1-a/:80", "us-central1-a/web:http"} {
+		_, err = ParseTarget(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/instance/service-accounts/default/token" {
+			assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+			fmt.Fprint(w, `{"access_token":"ya29","expires_in":3600}`)
+			return
+		}
+		assert.Equal(t, "Bearer ya29", r.Header.Get("Authorization"))
+		link := ts.URL + "/projects/demo/zones/us-central1-a/instances/"
+		switch r.URL.Path {
+		case "/projects/demo/zones/us-central1-a/instanceGroups/web/listInstances":
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "RUNNING", body["instanceState"])
+			if r.URL.Query().Get("pageToken") == "" {
+				fmt.Fprintf(w, `{"items":[{"instance":"%sweb-1"}],"nextPageToken":"p2"}`, link)
+				return
+			}
+			fmt.Fprintf(w, `{"items":[{"instance":"%sweb-2"}]}`, link)
+		case "/projects/demo/zones/us-central1-a/instances":
+			fmt.Fprintf(w, `{"items":[
+				{"selfLink":"%[1]sweb-1","networkInterfaces":[{"networkIP":"10.128.0.1"}]},
+				{"selfLink":"%[1]sweb-2","networkInterfaces":[{"networkIP":"10.128.0.2"}]},
+				{"selfLink":"%[1]sother","networkInterfaces":[{"networkIP":"10.128.0.3"}]}]}`, link)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	c := New("demo", "", time.Minute, nil)
+	c.endpoint, c.metadata = ts.URL, ts.URL
+
+	ips, err := c.Instances(&Target{"us-central1-a", "web", "80"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.128.0.1", "10.128.0.2"}, ips)
+
+	_, err = c.Instances(&Target{"us-central1-a", "api", "80"})
+	assert.Contains(t, err.Error(), "404")
+}
@@ -0,0 +1,300 @@
+// package kubernetes populates the pools from Kubernetes EndpointSlices
+//
+// a virtual server with "service" configured as "<namespace>/<name>[:<port>]" watches
+//
+//	GET /apis/discovery.k8s.io/v1/namespaces/<namespace>/endpointslices?labelSelector=kubernetes.io/service-name=<name>
+//
+// the port is a port name or number, default to the first port of the slice.
+// only the ready endpoints are kept in the pool, the terminating pods are drained.
+//
+// golb authenticates with the service account when running in the cluster,
+// otherwise "cluster" is the API server URL, "token" the bearer token,
+// "cert_file"/"key_file" the client certificate and "trusted_ca_file" the CA
+package kubernetes
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/pkg/transport"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/dns"
+)
+
+const (
+	SERVICE_ACCOUNT_DIR = "/var/run/secrets/kubernetes.io/serviceaccount"
+	SERVICE_NAME_LABEL  = "kubernetes.io/service-name"
+	WATCH_TIMEOUT       = 300
+	RETRY_INTERVAL      = 5 * time.Second
+)
+
+type KubernetesClient struct {
+	server    string
+	token     string
+	tokenFile string
+	client    *http.Client
+}
+
+func New(server, token, certFile, keyFile, trustedCAFile string, resolver *dns.Resolver) (*KubernetesClient, error) {
+	kc := &KubernetesClient{server: server, token: token}
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a kubernetes cluster, the API server should be specified")
+		}
+		kc.server = "https://" + net.JoinHostPort(host, port)
+		if token == "" {
+			kc.tokenFile = SERVICE_ACCOUNT_DIR + "/token"
+		}
+		if trustedCAFile == "" {
+			trustedCAFile = SERVICE_ACCOUNT_DIR + "/ca.crt"
+		}
+	}
+	kc.server = strings.TrimSuffix(kc.server, "/")
+
+	var tlsConfig *tls.Config
+	if strings.HasPrefix(kc.server, "https://") {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      certFile,
+			KeyFile:       keyFile,
+			TrustedCAFile: trustedCAFile,
+		}
+		var err error
+		tlsConfig, err = tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	t.DialContext = resolver.Dialer(5 * time.Second).DialContext
+	kc.client = &http.Client{Transport: t}
+	return kc, nil
+}
+
+// Target is the service backing a pool
+type Target struct {
+	Namespace string
+	Name      string
+	Port      string
+}
+
+// ParseTarget parses "<namespace>/<name>[:<port>]"
+func ParseTarget(service string) (*Target, error) {
+	t := &Target{}
+	idx := strings.Index(service, "/")
+	if idx <= 0 || idx == len(service)-1 {
+		return nil, fmt.Errorf("service %q should be <namespace>/<name>[:<port>]", service)
+	}
+	t.Namespace, t.Name = service[:idx], service[idx+1:]
+	if idx := strings.LastIndex(t.Name, ":"); idx >= 0 {
+		t.Name, t.Port = t.Name[:idx], t.Name[idx+1:]
+	}
+	return t, nil
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int32  `json:"port"`
+	} `json:"ports"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+}
+
+type sliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string        `json:"type"`
+	Object endpointSlice `json:"object"`
+}
+
+// port returns the port of target in slice, empty if not found
+func (t *Target) port(slice *endpointSlice) string {
+	if _, err := strconv.Atoi(t.Port); err == nil {
+		return t.Port
+	}
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if t.Port == "" || (p.Name != nil && *p.Name == t.Port) {
+			return strconv.Itoa(int(*p.Port))
+		}
+	}
+	return ""
+}
+
+// desired returns the ready endpoints of all slices
+func (t *Target) desired(slices map[string]*endpointSlice) map[string]int {
+	result := map[string]int{}
+	for _, slice := range slices {
+		port := t.port(slice)
+		if port == "" {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			cond := ep.Conditions
+			// a nil ready condition means ready
+			if (cond.Ready != nil && !*cond.Ready) || (cond.Terminating != nil && *cond.Terminating) {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				result[net.JoinHostPort(addr, port)] = 1
+			}
+		}
+	}
+	return result
+}
+
+func (kc *KubernetesClient) get(u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := kc.token
+	if kc.tokenFile != "" {
+		// the projected token is rotated, read it every time
+		data, err := ioutil.ReadFile(kc.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes responds %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (kc *KubernetesClient) url(t *Target, query url.Values) string {
+	query.Set("labelSelector", SERVICE_NAME_LABEL+"="+t.Name)
+	return fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		kc.server, url.PathEscape(t.Namespace), query.Encode())
+}
+
+// List returns the endpoint slices of target and the resource version
+func (kc *KubernetesClient) List(t *Target) (map[string]*endpointSlice, string, error) {
+	resp, err := kc.get(kc.url(t, url.Values{}))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var list sliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	slices := map[string]*endpointSlice{}
+	for i := range list.Items {
+		slices[list.Items[i].Metadata.Name] = &list.Items[i]
+	}
+	return slices, list.Metadata.ResourceVersion, nil
+}
+
+// Watch applies the changes since resourceVersion to slices, and calls onChange after
+// each change, it returns when the watch ends
+func (kc *KubernetesClient) Watch(t *Target, resourceVersion string, slices map[string]*endpointSlice, onChange func()) error {
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("timeoutSeconds", strconv.Itoa(WATCH_TIMEOUT))
+	resp, err := kc.get(kc.url(t, query))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var ev watchEvent
+		if err := decoder.Decode(&ev); err != nil {
+			return nil
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			slice := ev.Object
+			slices[slice.Metadata.Name] = &slice
+		case "DELETED":
+			delete(slices, ev.Object.Metadata.Name)
+		case "ERROR":
+			// e.g. 410 Gone, the resource version is too old, list again
+			return fmt.Errorf("watch error event")
+		default:
+			continue
+		}
+		onChange()
+	}
+}
+
+func (kc *KubernetesClient) watch(vs *balancer.VirtualServer, t *Target) {
+	known := map[string]int{}
+	for {
+		slices, rv, err := kc.List(t)
+		if err != nil {
+			log.Errorf("[%s] kubernetes list %s/%s err=%v", vs.Name, t.Namespace, t.Name, err)
+			time.Sleep(RETRY_INTERVAL)
+			continue
+		}
+		vs.SyncPeers("kubernetes", known, t.desired(slices))
+
+		err = kc.Watch(t, rv, slices, func() {
+			vs.SyncPeers("kubernetes", known, t.desired(slices))
+		})
+		if err != nil {
+			log.Errorf("[%s] kubernetes watch %s/%s err=%v", vs.Name, t.Namespace, t.Name, err)
+			time.Sleep(RETRY_INTERVAL)
+		}
+	}
+}
+
+func (kc *KubernetesClient) Run(balancer *balancer.Balancer) {
+	balancer.RLock()
+	defer balancer.RUnlock()
+
+	for _, vs := range balancer.VServers {
+		if vs.Service == "" {
+			continue
+		}
+		t, err := ParseTarget(vs.Service)
+		if err != nil {
+			log.Errorf("[%s] %v", vs.Name, err)
+			continue
+		}
+		log.Infof("[%s] watching kubernetes service %s/%s", vs.Name, t.Namespace, t.Name)
+		go kc.watch(vs, t)
+	}
+}
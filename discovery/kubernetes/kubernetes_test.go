@@ -0,0 +1,85 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const listBody = `{"metadata":{"resourceVersion":"100"},"items":[
+	{"metadata":{"name":"web-abc"},"ports":[{"name":"metrics","port":9090},{"name":"http","port":8080}],"endpoints":[
+		{"addresses":["10.1.0.1"],"conditions":{"ready":true}},
+		{"addresses":["10.1.0.2"],"conditions":{}},
+		{"addresses":["10.1.0.3"],"conditions":{"ready":false}},
+		{"addresses":["10.1.0.4"],"conditions":{"ready":true,"terminating":true}}
+	]}
+]}`
+
+const watchEvents = `{"type":"MODIFIED","object":{"metadata":{"name":"web-abc"},"ports":[{"name":"http","port":8080}],"endpoints":[{"addresses":["10.1.0.1"],"conditions":{"ready":true}}]}}
+{"type":"ADDED","object":{"metadata":{"name":"web-def"},"ports":[{"name":"http","port":8080}],"endpoints":[{"addresses":["10.1.0.9"]}]}}
+{"type":"DELETED","object":{"metadata":{"name":"web-abc"}}}
+`
+
+func TestParseTarget(t *testing.T) {
+	target, err := ParseTarget("default/web:http")
+	require.NoError(t, err)
+	assert.Equal(t, Target{"default", "web", "http"}, *target)
+
+	target, err = ParseTarget("default/web")
+	require.NoError(t, err)
+	assert.Equal(t, Target{"default", "web", ""}, *target)
+
+	for _, s := range []string{"web", "/web", "default/"} {
+		_, err = ParseTarget(s)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestListWatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices", r.URL.Path)
+		assert.Equal(t, SERVICE_NAME_LABEL+"=web", r.URL.Query().Get("labelSelector"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("watch") != "" {
+			assert.Equal(t, "100", r.URL.Query().Get("resourceVersion"))
+			fmt.Fprint(w, watchEvents)
+			return
+		}
+		fmt.Fprint(w, listBody)
+	}))
+	defer ts.Close()
+
+	kc, err := New(ts.URL, "secret", "", "", "", nil)
+	require.NoError(t, err)
+
+	target := &Target{"default", "web", "http"}
+	slices, rv, err := kc.List(target)
+	require.NoError(t, err)
+	assert.Equal(t, "100", rv)
+	assert.Equal(t, map[string]int{"10.1.0.1:8080": 1, "10.1.0.2:8080": 1}, target.desired(slices))
+
+	// default to the first port
+	assert.Equal(t, map[string]int{"10.1.0.1:9090": 1, "10.1.0.2:9090": 1}, (&Target{Port: ""}).desired(slices))
+	assert.Equal(t, map[string]int{"10.1.0.1:80": 1, "10.1.0.2:80": 1}, (&Target{Port: "80"}).desired(slices))
+	assert.Equal(t, map[string]int{}, (&Target{Port: "grpc"}).desired(slices))
+
+	changes := []map[string]int{}
+	err = kc.Watch(target, rv, slices, func() {
+		changes = append(changes, target.desired(slices))
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]int{
+		{"10.1.0.1:8080": 1},
+		{"10.1.0.1:8080": 1, "10.1.0.9:8080": 1},
+		{"10.1.0.9:8080": 1},
+	}, changes)
+}
+
+func TestNewOutOfCluster(t *testing.T) {
+	_, err := New("", "", "", "", "", nil)
+	assert.Contains(t, err.Error(), "not running in a kubernetes cluster")
+}
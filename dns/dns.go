@@ -0,0 +1,213 @@
+// package dns provides a pluggable resolver used by golb's own name resolutions
+// (upstream peers, service discovery endpoints) instead of the host resolver
+//
+// supported protocols
+//   - udp: plain DNS over UDP (default)
+//   - tcp: plain DNS over TCP
+//   - tls: DNS over TLS (RFC 7858), server port defaults to 853
+//   - https: DNS over HTTPS (RFC 8484), a server is an URL, or a host[:port]
+//     queried at /dns-query, the host name of an URL is resolved by the host resolver
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PROTO_UDP   = "udp"
+	PROTO_TCP   = "tcp"
+	PROTO_TLS   = "tls"
+	PROTO_HTTPS = "https"
+
+	DEFAULT_PORT     = "53"
+	DEFAULT_TLS_PORT = "853"
+	DEFAULT_TIMEOUT  = 5 * time.Second
+	DEFAULT_DOH_PATH = "/dns-query"
+)
+
+// Resolver sends queries to the configured name servers in turn
+type Resolver struct {
+	Servers    []string
+	Protocol   string
+	ServerName string
+	Timeout    time.Duration
+
+	next     uint64
+	resolver *net.Resolver
+	client   *http.Client
+}
+
+type ResolverOption func(*Resolver) error
+
+func ServersOpt(servers []string) ResolverOption {
+	return func(r *Resolver) error {
+		if len(servers) == 0 {
+			return fmt.Errorf("DNS servers can not be empty")
+		}
+		r.Servers = servers
+		return nil
+	}
+}
+
+func ProtocolOpt(proto string) ResolverOption {
+	return func(r *Resolver) error {
+		if proto == "" {
+			proto = PROTO_UDP
+		}
+		if proto != PROTO_UDP && proto != PROTO_TCP && proto != PROTO_TLS && proto != PROTO_HTTPS {
+			return fmt.Errorf("DNS protocol %q currently not supported", proto)
+		}
+		r.Protocol = proto
+		return nil
+	}
+}
+
+// ServerNameOpt sets the name used to verify the certificate of DNS over TLS and HTTPS servers
+func ServerNameOpt(name string) ResolverOption {
+	return func(r *Resolver) error {
+		r.ServerName = name
+		return nil
+	}
+}
+
+func TimeoutOpt(timeout time.Duration) ResolverOption {
+	return func(r *Resolver) error {
+		if timeout <= 0 {
+			timeout = DEFAULT_TIMEOUT
+		}
+		r.Timeout = timeout
+		return nil
+	}
+}
+
+func New(opts ...ResolverOption) (*Resolver, error) {
+	r := &Resolver{
+		Protocol: PROTO_UDP,
+		Timeout:  DEFAULT_TIMEOUT,
+	}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.Servers) == 0 {
+		return nil, ServersOpt(nil)(r)
+	}
+
+	// the servers are normalized in a copy, the slice of the caller is left alone
+	servers := make([]string, len(r.Servers))
+	for i, server := range r.Servers {
+		switch {
+		case r.Protocol == PROTO_HTTPS:
+			if !strings.Contains(server, "://") {
+				server = PROTO_HTTPS + "://" + server + DEFAULT_DOH_PATH
+			}
+			u, err := url.Parse(server)
+			if err != nil || u.Scheme != PROTO_HTTPS || u.Host == "" {
+				return nil, fmt.Errorf("invalid DNS over HTTPS server %q", r.Servers[i])
+			}
+		case r.Protocol == PROTO_TLS:
+			server = withPort(server, DEFAULT_TLS_PORT)
+		default:
+			server = withPort(server, DEFAULT_PORT)
+		}
+		servers[i] = server
+	}
+	r.Servers = servers
+
+	if r.Protocol == PROTO_HTTPS {
+		r.client = &http.Client{
+			Timeout: r.Timeout,
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{ServerName: r.ServerName},
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		}
+	}
+
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial:     r.dial,
+	}
+	return r, nil
+}
+
+func withPort(server, port string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(strings.Trim(server, "[]"), port)
+	}
+	return server
+}
+
+// dial ignores the name server picked from /etc/resolv.conf and connects to ours
+func (r *Resolver) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	idx := atomic.AddUint64(&r.next, 1) - 1
+	server := r.Servers[idx%uint64(len(r.Servers))]
+
+	d := &net.Dialer{Timeout: r.Timeout}
+	switch r.Protocol {
+	case PROTO_TCP:
+		return d.DialContext(ctx, "tcp", server)
+	case PROTO_TLS:
+		serverName := r.ServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(server)
+		}
+		conn, err := d.DialContext(ctx, "tcp", server)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	case PROTO_HTTPS:
+		return &dohConn{ctx: ctx, client: r.client, url: server}, nil
+	}
+	return d.DialContext(ctx, network, server)
+}
+
+func (r *Resolver) String() string {
+	if r.Protocol == PROTO_HTTPS {
+		return strings.Join(r.Servers, ",")
+	}
+	return fmt.Sprintf("%s://%s", r.Protocol, strings.Join(r.Servers, ","))
+}
+
+// Resolver returns the underlying *net.Resolver, nil receiver means the host resolver
+func (r *Resolver) Resolver() *net.Resolver {
+	if r == nil {
+		return net.DefaultResolver
+	}
+	return r.resolver
+}
+
+// Dialer returns a *net.Dialer resolving host names with r
+func (r *Resolver) Dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Resolver:  r.Resolver(),
+	}
+}
+
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.Resolver().LookupHost(ctx, host)
+}
+
+// LookupSRV returns the SRV records of _service._proto.name sorted by priority
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	_, srvs, err := r.Resolver().LookupSRV(ctx, service, proto, name)
+	return srvs, err
+}
@@ -0,0 +1,154 @@
+package dns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// answer answers every A query with 10.1.2.3,
+// and every SRV query with "10 5 8080 node.golb.test."
+func answer(query []byte) []byte {
+	// keep header and question only, drop the EDNS record
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	resp := append([]byte{}, query[:end]...)
+	// QR=1, RD=1, RA=1
+	resp[2], resp[3] = 0x81, 0x80
+	resp[6], resp[7], resp[10], resp[11] = 0, 0, 0, 0
+	if qtype := resp[end-3]; qtype == 1 {
+		resp[7] = 1
+		resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 1, 2, 3)
+	} else if qtype == 33 {
+		resp[7] = 1
+		resp = append(resp, 0xc0, 0x0c, 0, 33, 0, 1, 0, 0, 0, 60, 0, 22, 0, 10, 0, 5, 0x1f, 0x90)
+		resp = append(resp, 4, 'n', 'o', 'd', 'e', 4, 'g', 'o', 'l', 'b', 4, 't', 'e', 's', 't', 0)
+	}
+	return resp
+}
+
+func fakeServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(answer(buf[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestNew(t *testing.T) {
+	r, err := New()
+	assert.Nil(t, r)
+	assert.NotNil(t, err)
+
+	r, err = New(ServersOpt([]string{"1.1.1.1"}), ProtocolOpt("doh"))
+	assert.Nil(t, r)
+	assert.Contains(t, err.Error(), "not supported")
+
+	servers := []string{"1.1.1.1", "[::1]", "8.8.8.8:5353"}
+	r, err = New(ServersOpt(servers), ProtocolOpt(""), TimeoutOpt(0))
+	require.NoError(t, err)
+	assert.Equal(t, PROTO_UDP, r.Protocol)
+	assert.Equal(t, DEFAULT_TIMEOUT, r.Timeout)
+	assert.Equal(t, []string{"1.1.1.1:53", "[::1]:53", "8.8.8.8:5353"}, r.Servers)
+	assert.Equal(t, []string{"1.1.1.1", "[::1]", "8.8.8.8:5353"}, servers)
+
+	r, err = New(ServersOpt([]string{"1.1.1.1"}), ProtocolOpt(PROTO_TLS))
+	require.NoError(t, err)
+	assert.Equal(t, "tls://1.1.1.1:853", r.String())
+
+	r, err = New(ServersOpt([]string{"1.1.1.1", "https://dns.google/resolve"}), ProtocolOpt(PROTO_HTTPS))
+	require.NoError(t, err)
+	assert.Equal(t, "https://1.1.1.1/dns-query,https://dns.google/resolve", r.String())
+
+	r, err = New(ServersOpt([]string{"http://1.1.1.1/dns-query"}), ProtocolOpt(PROTO_HTTPS))
+	assert.Nil(t, r)
+	assert.Contains(t, err.Error(), "invalid DNS over HTTPS server")
+}
+
+func TestLookupHost(t *testing.T) {
+	r, err := New(ServersOpt([]string{fakeServer(t)}), TimeoutOpt(time.Second))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	addrs, err := r.LookupHost(ctx, "backend.golb.test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.2.3"}, addrs)
+}
+
+func TestLookupSRV(t *testing.T) {
+	r, err := New(ServersOpt([]string{fakeServer(t)}), TimeoutOpt(time.Second))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	srvs, err := r.LookupSRV(ctx, "http", "tcp", "backend.golb.test")
+	require.NoError(t, err)
+	require.Len(t, srvs, 1)
+	assert.Equal(t, &net.SRV{Target: "node.golb.test.", Port: 8080, Priority: 10, Weight: 5}, srvs[0])
+}
+
+func TestNilResolver(t *testing.T) {
+	var r *Resolver
+	assert.Equal(t, net.DefaultResolver, r.Resolver())
+	assert.NotNil(t, r.Dialer(time.Second))
+}
+
+func TestLookupHTTPS(t *testing.T) {
+	var queries int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.URL.Path != DEFAULT_DOH_PATH ||
+			req.Header.Get("Content-Type") != DOH_MEDIA_TYPE {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&queries, 1)
+		query, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", DOH_MEDIA_TYPE)
+		w.Write(answer(query))
+	}))
+	defer srv.Close()
+
+	r, err := New(ServersOpt([]string{srv.Listener.Addr().String()}), ProtocolOpt(PROTO_HTTPS), TimeoutOpt(time.Second))
+	require.NoError(t, err)
+	r.client = srv.Client()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	addrs, err := r.LookupHost(ctx, "backend.golb.test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.2.3"}, addrs)
+
+	srvs, err := r.LookupSRV(ctx, "http", "tcp", "backend.golb.test")
+	require.NoError(t, err)
+	require.Len(t, srvs, 1)
+	assert.Equal(t, uint16(8080), srvs[0].Port)
+	assert.NotZero(t, atomic.LoadInt32(&queries))
+
+	// an error status is an error of the lookup, not an empty answer
+	r, err = New(ServersOpt([]string{srv.URL + "/other"}), ProtocolOpt(PROTO_HTTPS), TimeoutOpt(time.Second))
+	require.NoError(t, err)
+	r.client = srv.Client()
+	_, err = r.LookupHost(ctx, "backend.golb.test")
+	assert.Error(t, err)
+}
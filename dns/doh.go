@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+const DOH_MEDIA_TYPE = "application/dns-message"
+
+// dohAddr is the address of a DNS over HTTPS server, i.e. its URL
+type dohAddr string
+
+func (a dohAddr) Network() string { return PROTO_HTTPS }
+func (a dohAddr) String() string  { return string(a) }
+
+// dohConn looks like a DNS over TCP stream to the resolver of net,
+// every length-prefixed query written is POSTed to the server (RFC 8484)
+// and its answer is buffered, length-prefixed, for the following reads
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+
+	wbuf bytes.Buffer
+	rbuf bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.wbuf.Write(b)
+	for c.wbuf.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.wbuf.Bytes()))
+		if c.wbuf.Len() < 2+size {
+			break
+		}
+		c.wbuf.Next(2)
+		answer, err := c.query(c.wbuf.Next(size))
+		if err != nil {
+			return 0, err
+		}
+		if len(answer) > 0xffff {
+			return 0, fmt.Errorf("DNS answer from %s too large: %d bytes", c.url, len(answer))
+		}
+		var prefix [2]byte
+		binary.BigEndian.PutUint16(prefix[:], uint16(len(answer)))
+		c.rbuf.Write(prefix[:])
+		c.rbuf.Write(answer)
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) query(msg []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", DOH_MEDIA_TYPE)
+	req.Header.Set("Accept", DOH_MEDIA_TYPE)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS server %s answered %s", c.url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 0x10000))
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr("") }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
@@ -19,7 +19,6 @@ type option struct {
 	pool        string
 	etcd_server string
 	ttl         int64
-	hbi         time.Duration
 	tbe         time.Duration
 }
 
@@ -29,8 +28,7 @@ func newOption() *option {
 	flag.StringVar(&opt.addr, "addr", "127.0.0.1:50001", "serving ip:port address")
 	flag.StringVar(&opt.pool, "pool", "web", "pool name")
 	flag.StringVar(&opt.etcd_server, "etcd_server", "http://127.0.0.1:2379", "register etcd address")
-	flag.Int64Var(&opt.ttl, "ttl", 15, "time to live, it should be greater than heartbeat_interval")
-	flag.DurationVar(&opt.hbi, "hbi", time.Second*10, "heartbeat interval")
+	flag.Int64Var(&opt.ttl, "ttl", 15, "lease time to live, the peer is removed if not refreshed in time")
 	flag.DurationVar(&opt.tbe, "tbe", time.Second*3, "timeout before exit")
 	flag.Parse()
 	return &opt
@@ -39,7 +37,7 @@ func newOption() *option {
 func main() {
 	opt := newOption()
 
-	if err := Register(opt.prefix, opt.pool, opt.addr, opt.etcd_server, opt.hbi, opt.ttl); err != nil {
+	if err := Register(opt.prefix, opt.pool, opt.addr, opt.etcd_server, opt.ttl); err != nil {
 		panic(err)
 	}
 
@@ -1,27 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
-	"time"
 
 	clientv3 "github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/context"
+
+	"github.com/onestraw/golb/discovery/etcd"
 )
 
 var (
 	etcd_client *clientv3.Client
-	serviceKey  string
-	stopSignal  = make(chan bool, 1)
+	stopSignal  context.CancelFunc
 )
 
-// Register add serverAddr to poolName in etcd endpoints
-func Register(prefix, poolName, serverAddr, endpoints string, interval time.Duration, TTL int64) error {
-	serviceValue := serverAddr
-	serviceKey = fmt.Sprintf("%s/virtualserver/%s/pool/%s/address", prefix, poolName, serverAddr)
-
+// Register add serverAddr to poolName in etcd endpoints,
+// the key is bound to a lease of TTL seconds which is kept alive until UnRegister
+func Register(prefix, poolName, serverAddr, endpoints string, TTL int64) error {
 	client, err := clientv3.New(clientv3.Config{
 		Endpoints: strings.Split(endpoints, ","),
 	})
@@ -30,45 +27,22 @@ func Register(prefix, poolName, serverAddr, endpoints string, interval time.Dura
 	}
 	etcd_client = client
 
-	// interval should be less than TTL
-	// it's heartbeat, update the lease every interval before the lease expired
-	go func() {
-		ticker := time.NewTicker(interval)
-		for {
-			resp, _ := client.Grant(context.TODO(), int64(TTL))
-			if _, err := client.Get(context.Background(), serviceKey); err != nil {
-				if err == rpctypes.ErrKeyNotFound {
-					if _, err := client.Put(context.TODO(), serviceKey, serviceValue, clientv3.WithLease(resp.ID)); err != nil {
-						log.Errorf("set service %q with ttl to etcd failed: %s", poolName, err.Error())
-					}
-				} else {
-					log.Errorf("service %q connect to etcd failed: %s", poolName, err.Error())
-				}
-			} else {
-				if _, err := client.Put(context.Background(), serviceKey, serviceValue, clientv3.WithLease(resp.ID)); err != nil {
-					log.Errorf("refresh service %q with ttl to etcd failed: %s", poolName, err.Error())
-				}
-			}
-
-			select {
-			case <-stopSignal:
-				ticker.Stop()
-				return
-			case <-ticker.C:
-			}
-		}
-	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := etcd.Register(ctx, client, prefix, poolName, serverAddr, TTL); err != nil {
+		cancel()
+		return fmt.Errorf("register service %q to etcd failed: %v", poolName, err)
+	}
+	stopSignal = cancel
 	return nil
 }
 
 // UnRegister remove server from pool
 func UnRegister() error {
-	stopSignal <- true
-	stopSignal = make(chan bool, 1) // just a hack to avoid multi UnRegister deadlock
-	if _, err := etcd_client.Delete(context.Background(), serviceKey); err != nil {
-		log.Errorf("unregister %q failed: %s.", serviceKey, err.Error())
-		return err
+	if stopSignal == nil {
+		return nil
 	}
-	log.Infof("unregister %v done.", serviceKey)
+	stopSignal()
+	stopSignal = nil
+	log.Infof("unregister done.")
 	return nil
 }
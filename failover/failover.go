@@ -0,0 +1,398 @@
+// package failover elects the master of the golb nodes sharing a virtual IP, in the style
+// of VRRP/keepalived, so a failed balancer is replaced without a DNS change
+//
+// election
+//   - every node advertises its priority over UDP to the other nodes each interval
+//   - the highest priority alive is the master, an equal priority is broken by the higher address
+//   - a backup takes over when the master misses 3 advertisements, or at once when the master
+//     stops and advertises priority 0
+//   - with preempt, a backup of higher priority takes over from a running master
+//
+// the hooks are called on the transitions, e.g. scripts adding or removing the virtual IP
+package failover
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	STATE_INIT   = "init"
+	STATE_BACKUP = "backup"
+	STATE_MASTER = "master"
+
+	DEFAULT_INTERVAL = time.Second
+	DEFAULT_PRIORITY = 100
+	MAX_PRIORITY     = 255
+	// advertisements missed before the master is down
+	MASTER_DOWN_ADVERTS = 3
+	MAX_ADVERT_SIZE     = 1024
+
+	ENV_STATE      = "GOLB_FAILOVER_STATE"
+	ENV_FROM       = "GOLB_FAILOVER_FROM"
+	ENV_VIRTUAL_IP = "GOLB_VIRTUAL_IP"
+)
+
+// Transition is a change of the state of the node
+type Transition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+// Hook is called with the transitions in order, the election waits for it
+type Hook func(Transition)
+
+// Script returns a Hook running command by sh on the transitions to state, with the
+// transition and virtualIP in the environment variables ENV_STATE, ENV_FROM and ENV_VIRTUAL_IP
+func Script(state, command, virtualIP string) Hook {
+	return func(t Transition) {
+		if t.To != state || command == "" {
+			return
+		}
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(), ENV_STATE+"="+t.To, ENV_FROM+"="+t.From, ENV_VIRTUAL_IP+"="+virtualIP)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Errorf("Failover %s script error=%v, output=%s", state, err, out)
+			return
+		}
+		log.Infof("Failover %s script done", state)
+	}
+}
+
+// advert is the advertisement of a node, MAC is the hex HMAC-SHA256 of node and priority if a secret is set
+type advert struct {
+	Node     string `json:"node"`
+	Priority int    `json:"priority"`
+	MAC      string `json:"mac,omitempty"`
+}
+
+// Status of the node, and of the master heard from if a backup
+type Status struct {
+	Address        string    `json:"address"`
+	State          string    `json:"state"`
+	Priority       int       `json:"priority"`
+	Since          time.Time `json:"since"`
+	Master         string    `json:"master,omitempty"`
+	MasterPriority int       `json:"master_priority,omitempty"`
+}
+
+type Node struct {
+	Address  string
+	Peers    []string
+	Priority int
+	Interval time.Duration
+	Preempt  bool
+
+	secret []byte
+	hooks  []Hook
+
+	lock   sync.Mutex
+	status Status
+	conn   net.PacketConn
+	peers  []*net.UDPAddr
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type NodeOption func(*Node) error
+
+// AddressOpt sets the UDP address receiving the advertisements, it also identifies the node
+func AddressOpt(address string) NodeOption {
+	return func(n *Node) error {
+		if _, err := net.ResolveUDPAddr("udp", address); err != nil {
+			return fmt.Errorf("failover address %q: %v", address, err)
+		}
+		n.Address = address
+		return nil
+	}
+}
+
+// PeersOpt sets the UDP addresses of the other nodes
+func PeersOpt(peers []string) NodeOption {
+	return func(n *Node) error {
+		if len(peers) == 0 {
+			return fmt.Errorf("failover peers can not be empty")
+		}
+		n.Peers = peers
+		return nil
+	}
+}
+
+// PriorityOpt sets the priority, 0 means DEFAULT_PRIORITY
+func PriorityOpt(priority int) NodeOption {
+	return func(n *Node) error {
+		if priority == 0 {
+			priority = DEFAULT_PRIORITY
+		}
+		if priority < 1 || priority > MAX_PRIORITY {
+			return fmt.Errorf("failover priority %d out of range [1, %d]", priority, MAX_PRIORITY)
+		}
+		n.Priority = priority
+		return nil
+	}
+}
+
+// IntervalOpt sets the interval of the advertisements, 0 means DEFAULT_INTERVAL
+func IntervalOpt(interval time.Duration) NodeOption {
+	return func(n *Node) error {
+		if interval <= 0 {
+			interval = DEFAULT_INTERVAL
+		}
+		n.Interval = interval
+		return nil
+	}
+}
+
+// PreemptOpt lets a backup of higher priority take over from a running master
+func PreemptOpt(preempt bool) NodeOption {
+	return func(n *Node) error {
+		n.Preempt = preempt
+		return nil
+	}
+}
+
+// SecretOpt authenticates the advertisements by secret, shared by all the nodes
+func SecretOpt(secret string) NodeOption {
+	return func(n *Node) error {
+		if secret != "" {
+			n.secret = []byte(secret)
+		}
+		return nil
+	}
+}
+
+func HookOpt(hooks ...Hook) NodeOption {
+	return func(n *Node) error {
+		n.hooks = append(n.hooks, hooks...)
+		return nil
+	}
+}
+
+func New(opts ...NodeOption) (*Node, error) {
+	n := &Node{
+		Priority: DEFAULT_PRIORITY,
+		Interval: DEFAULT_INTERVAL,
+		Preempt:  true,
+	}
+	for _, opt := range opts {
+		if err := opt(n); err != nil {
+			return nil, err
+		}
+	}
+	if n.Address == "" {
+		return nil, fmt.Errorf("failover address can not be empty")
+	}
+	if len(n.Peers) == 0 {
+		return nil, PeersOpt(nil)(n)
+	}
+	for _, peer := range n.Peers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return nil, fmt.Errorf("failover peer %q: %v", peer, err)
+		}
+		n.peers = append(n.peers, addr)
+	}
+	n.status = Status{Address: n.Address, State: STATE_INIT, Priority: n.Priority, Since: time.Now()}
+	return n, nil
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("%s priority %d", n.Address, n.Priority)
+}
+
+// Run starts the election as a backup, the address may still be held by the parent
+// process on upgrade, so it is retried for a master down interval
+func (n *Node) Run() error {
+	deadline := time.Now().Add(n.masterDown())
+	for {
+		conn, err := net.ListenPacket("udp", n.Address)
+		if err == nil {
+			n.conn = conn
+			break
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(n.Interval / 4)
+	}
+	n.stop = make(chan struct{})
+	n.done = make(chan struct{})
+	adverts := make(chan advert)
+	go n.receive(adverts)
+	go n.elect(adverts)
+	return nil
+}
+
+// Stop advertises priority 0 if the master, so a backup takes over at once,
+// and transitions to backup
+func (n *Node) Stop() {
+	if n.stop == nil {
+		return
+	}
+	close(n.stop)
+	<-n.done
+	n.conn.Close()
+}
+
+// Status returns the status of the node
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.status
+}
+
+// masterDown is the time a backup waits for the advertisements of the master, the skew
+// lets the backup of the highest priority take over first
+func (n *Node) masterDown() time.Duration {
+	return MASTER_DOWN_ADVERTS*n.Interval + n.skew()
+}
+
+func (n *Node) skew() time.Duration {
+	return time.Duration(MAX_PRIORITY+1-n.Priority) * n.Interval / (MAX_PRIORITY + 1)
+}
+
+func (n *Node) mac(node string, priority int) string {
+	h := hmac.New(sha256.New, n.secret)
+	fmt.Fprintf(h, "%s %d", node, priority)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// receive passes the authenticated advertisements of the other nodes to adverts until stopped
+func (n *Node) receive(adverts chan<- advert) {
+	buf := make([]byte, MAX_ADVERT_SIZE)
+	for {
+		size, from, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var a advert
+		if err := json.Unmarshal(buf[:size], &a); err != nil {
+			log.Warnf("Failover advertisement from %s error=%v", from, err)
+			continue
+		}
+		if n.secret != nil && !hmac.Equal([]byte(a.MAC), []byte(n.mac(a.Node, a.Priority))) {
+			log.Warnf("Failover advertisement from %s not authenticated", from)
+			continue
+		}
+		if a.Node == n.Address {
+			continue
+		}
+		select {
+		case adverts <- a:
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// advertise sends priority to the other nodes
+func (n *Node) advertise(priority int) {
+	a := advert{Node: n.Address, Priority: priority}
+	if n.secret != nil {
+		a.MAC = n.mac(a.Node, a.Priority)
+	}
+	data, _ := json.Marshal(a)
+	for _, peer := range n.peers {
+		if _, err := n.conn.WriteTo(data, peer); err != nil {
+			log.Warnf("Failover advertisement to %s error=%v", peer, err)
+		}
+	}
+}
+
+// higher returns true if a wins the election against n
+func (n *Node) higher(a advert) bool {
+	return a.Priority > n.Priority || (a.Priority == n.Priority && a.Node > n.Address)
+}
+
+func (n *Node) transition(state string, master advert) {
+	n.lock.Lock()
+	t := Transition{From: n.status.State, To: state, Time: time.Now()}
+	n.status.Master, n.status.MasterPriority = master.Node, master.Priority
+	if t.From != t.To {
+		n.status.State, n.status.Since = state, t.Time
+	}
+	n.lock.Unlock()
+	if t.From == t.To {
+		return
+	}
+	log.WithFields(log.Fields{"event": "failover", "node": n.Address, "from": t.From}).Warnf("Failover %s", t.To)
+	for _, h := range n.hooks {
+		h(t)
+	}
+}
+
+func (n *Node) elect(adverts <-chan advert) {
+	defer close(n.done)
+	n.transition(STATE_BACKUP, advert{})
+	timer := time.NewTimer(n.masterDown())
+	defer timer.Stop()
+	ticker := time.NewTicker(n.Interval)
+	defer ticker.Stop()
+
+	// the timer may have fired while receiving an advertisement
+	reset := func(d time.Duration) {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d)
+	}
+	master := false
+	becomeMaster := func() {
+		master = true
+		n.advertise(n.Priority)
+		n.transition(STATE_MASTER, advert{})
+	}
+	becomeBackup := func(a advert) {
+		master = false
+		reset(n.masterDown())
+		n.transition(STATE_BACKUP, a)
+	}
+	for {
+		select {
+		case <-n.stop:
+			if master {
+				n.advertise(0)
+			}
+			n.transition(STATE_BACKUP, advert{})
+			return
+		case <-timer.C:
+			if !master {
+				becomeMaster()
+			}
+		case <-ticker.C:
+			if master {
+				n.advertise(n.Priority)
+			}
+		case a := <-adverts:
+			switch {
+			case master && a.Priority == 0:
+				// a master stopping, keep the backups from taking over
+				n.advertise(n.Priority)
+			case master && n.higher(a):
+				becomeBackup(a)
+			case master:
+				// the other master yields on ours
+				n.advertise(n.Priority)
+			case a.Priority == 0:
+				reset(n.skew())
+			case !n.Preempt || n.higher(a):
+				becomeBackup(a)
+			}
+		}
+	}
+}
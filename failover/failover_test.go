@@ -0,0 +1,129 @@
+package failover
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testInterval = 50 * time.Millisecond
+
+// freeAddress returns a UDP address of the loopback not in use
+func freeAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func waitState(t *testing.T, n *Node, state string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for n.Status().State != state {
+		require.True(t, time.Now().Before(deadline), "%s is %s, not %s", n, n.Status().State, state)
+		time.Sleep(testInterval / 5)
+	}
+}
+
+func TestNodeOptions(t *testing.T) {
+	_, err := New(PeersOpt([]string{"127.0.0.1:1985"}))
+	assert.EqualError(t, err, "failover address can not be empty")
+	_, err = New(AddressOpt("127.0.0.1:1985"))
+	assert.EqualError(t, err, "failover peers can not be empty")
+	_, err = New(PriorityOpt(256))
+	assert.EqualError(t, err, "failover priority 256 out of range [1, 255]")
+
+	n, err := New(AddressOpt("127.0.0.1:1985"), PeersOpt([]string{"127.0.0.1:1986"}), PriorityOpt(0), IntervalOpt(0))
+	require.NoError(t, err)
+	assert.Equal(t, DEFAULT_PRIORITY, n.Priority)
+	assert.Equal(t, DEFAULT_INTERVAL, n.Interval)
+	assert.True(t, n.Preempt)
+	assert.Equal(t, STATE_INIT, n.Status().State)
+	// the highest priority waits the least
+	assert.Equal(t, 3*time.Second+609375*time.Microsecond, n.masterDown())
+	assert.True(t, n.higher(advert{Node: "127.0.0.1:1984", Priority: 101}))
+	assert.True(t, n.higher(advert{Node: "127.0.0.1:1986", Priority: 100}))
+	assert.False(t, n.higher(advert{Node: "127.0.0.1:1984", Priority: 100}))
+}
+
+func TestElection(t *testing.T) {
+	addr1, addr2 := freeAddress(t), freeAddress(t)
+	transitions := make(chan Transition, 16)
+	newNode := func(addr, peer string, priority int, secret string, hooks ...Hook) *Node {
+		n, err := New(AddressOpt(addr), PeersOpt([]string{peer}), PriorityOpt(priority),
+			IntervalOpt(testInterval), SecretOpt(secret), HookOpt(hooks...))
+		require.NoError(t, err)
+		require.NoError(t, n.Run())
+		return n
+	}
+
+	n1 := newNode(addr1, addr2, 200, "s3cret")
+	n2 := newNode(addr2, addr1, 100, "s3cret", func(t Transition) { transitions <- t })
+	defer n2.Stop()
+	waitState(t, n1, STATE_MASTER)
+	waitState(t, n2, STATE_BACKUP)
+	assert.Equal(t, STATE_INIT, (<-transitions).From)
+	// the backup keeps hearing the master
+	time.Sleep(5 * testInterval)
+	status := n2.Status()
+	assert.Equal(t, STATE_BACKUP, status.State)
+	assert.Equal(t, addr1, status.Master)
+	assert.Equal(t, 200, status.MasterPriority)
+
+	// the backup takes over at once when the master stops
+	start := time.Now()
+	n1.Stop()
+	assert.Equal(t, STATE_BACKUP, n1.Status().State)
+	waitState(t, n2, STATE_MASTER)
+	assert.True(t, time.Since(start) < MASTER_DOWN_ADVERTS*testInterval)
+	tr := <-transitions
+	assert.Equal(t, STATE_BACKUP, tr.From)
+	assert.Equal(t, STATE_MASTER, tr.To)
+
+	// the higher priority preempts when back
+	n1 = newNode(addr1, addr2, 200, "s3cret")
+	defer n1.Stop()
+	waitState(t, n1, STATE_MASTER)
+	waitState(t, n2, STATE_BACKUP)
+	assert.Equal(t, STATE_BACKUP, (<-transitions).To)
+}
+
+func TestElectionSecret(t *testing.T) {
+	addr1, addr2 := freeAddress(t), freeAddress(t)
+	n1, err := New(AddressOpt(addr1), PeersOpt([]string{addr2}), PriorityOpt(200),
+		IntervalOpt(testInterval), SecretOpt("s3cret"))
+	require.NoError(t, err)
+	require.NoError(t, n1.Run())
+	defer n1.Stop()
+	n2, err := New(AddressOpt(addr2), PeersOpt([]string{addr1}), IntervalOpt(testInterval), SecretOpt("other"))
+	require.NoError(t, err)
+	require.NoError(t, n2.Run())
+	defer n2.Stop()
+
+	// the advertisements of n1 are dropped
+	waitState(t, n1, STATE_MASTER)
+	waitState(t, n2, STATE_MASTER)
+}
+
+func TestScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "vip")
+
+	h := Script(STATE_MASTER, `echo "$GOLB_FAILOVER_FROM $GOLB_FAILOVER_STATE $GOLB_VIRTUAL_IP" > `+file, "10.0.0.100/24")
+	h(Transition{From: STATE_INIT, To: STATE_BACKUP})
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+
+	h(Transition{From: STATE_BACKUP, To: STATE_MASTER})
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "backup master 10.0.0.100/24", strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,9 @@
+// package jwt validates JSON Web Tokens (RFC 7519)
+//
+// the tokens are signed with HMAC (HS256, HS384, HS512), RSA (RS256, RS384, RS512)
+// or ECDSA (ES256, ES384, ES512). The keys are a shared secret, a PEM public key or
+// certificate, or the JSON Web Key Set of the issuer, refreshed periodically and
+// when a token names an unknown key. An HMAC token is only accepted with the secret,
+// so a public key can not be used as an HMAC secret by an attacker. The expiration,
+// not-before, issuer and audience claims are checked
+package jwt
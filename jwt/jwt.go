@@ -0,0 +1,311 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed   = errors.New("malformed token")
+	ErrAlgorithm   = errors.New("unsupported signing algorithm")
+	ErrKeyNotFound = errors.New("no key to verify the token")
+	ErrSignature   = errors.New("invalid signature")
+	ErrExpired     = errors.New("token expired")
+	ErrNotYetValid = errors.New("token not valid yet")
+	ErrIssuer      = errors.New("invalid issuer")
+	ErrAudience    = errors.New("invalid audience")
+	ErrNoKey       = errors.New("a secret, a key file or a JWKS URL is needed")
+)
+
+// hashes of the signing algorithms
+var hashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// Claims are the payload of a token
+type Claims map[string]interface{}
+
+// String returns the claim name as a header value: strings as is, arrays joined by
+// commas, the others JSON encoded, empty if missing
+func (c Claims) String(name string) string {
+	switch v := c[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, e := range v {
+			values[i] = Claims{"e": e}.String("e")
+		}
+		return strings.Join(values, ",")
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// time returns the numeric date claim name, false if missing
+func (c Claims) time(name string) (time.Time, bool, error) {
+	v, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false, ErrMalformed
+	}
+	return time.Unix(int64(f), 0), true, nil
+}
+
+// audience returns true if aud, a string or an array, contains audience
+func (c Claims) audience(audience string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Validator checks the signature and the claims of the tokens
+type Validator struct {
+	secret []byte
+	// of the key file
+	key  crypto.PublicKey
+	jwks *jwks
+
+	issuer   string
+	audience string
+	// clock skew tolerated on exp and nbf
+	leeway time.Duration
+	now    func() time.Time
+}
+
+type Option func(*Validator) error
+
+// SecretOpt verifies the HMAC tokens with secret
+func SecretOpt(secret string) Option {
+	return func(v *Validator) error {
+		if secret != "" {
+			v.secret = []byte(secret)
+		}
+		return nil
+	}
+}
+
+// KeyFileOpt verifies the RSA and ECDSA tokens with the PEM public key or certificate of file
+func KeyFileOpt(file string) Option {
+	return func(v *Validator) error {
+		if file == "" {
+			return nil
+		}
+		key, err := loadKeyFile(file)
+		if err != nil {
+			return err
+		}
+		v.key = key
+		return nil
+	}
+}
+
+// JWKSOpt verifies the RSA and ECDSA tokens with the keys served at url,
+// fetched again every refresh (0 means an hour)
+func JWKSOpt(url string, refresh time.Duration) Option {
+	return func(v *Validator) error {
+		if url != "" {
+			v.jwks = newJWKS(url, refresh)
+		}
+		return nil
+	}
+}
+
+// IssuerOpt requires the iss claim to be issuer
+func IssuerOpt(issuer string) Option {
+	return func(v *Validator) error {
+		v.issuer = issuer
+		return nil
+	}
+}
+
+// AudienceOpt requires the aud claim to contain audience
+func AudienceOpt(audience string) Option {
+	return func(v *Validator) error {
+		v.audience = audience
+		return nil
+	}
+}
+
+// LeewayOpt tolerates a clock skew of d on the exp and nbf claims
+func LeewayOpt(d time.Duration) Option {
+	return func(v *Validator) error {
+		v.leeway = d
+		return nil
+	}
+}
+
+func New(opts ...Option) (*Validator, error) {
+	v := &Validator{now: time.Now}
+	for _, opt := range opts {
+		if err := opt(v); err != nil {
+			return nil, err
+		}
+	}
+	if v.secret == nil && v.key == nil && v.jwks == nil {
+		return nil, ErrNoKey
+	}
+	return v, nil
+}
+
+func decodeSegment(s string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// Validate returns the claims of token if its signature and claims are valid
+func (v *Validator) Validate(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if err := v.verify(h, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.check(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verify checks the signature of input by the algorithm and the key of h
+func (v *Validator) verify(h header, input string, sig []byte) error {
+	if len(h.Alg) != 5 {
+		return ErrAlgorithm
+	}
+	hash, ok := hashes[h.Alg[2:]]
+	if !ok {
+		return ErrAlgorithm
+	}
+
+	switch h.Alg[:2] {
+	case "HS":
+		if v.secret == nil {
+			return ErrKeyNotFound
+		}
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write([]byte(input))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrSignature
+		}
+		return nil
+	case "RS", "ES":
+	default:
+		return ErrAlgorithm
+	}
+
+	digest := hash.New()
+	digest.Write([]byte(input))
+	sum := digest.Sum(nil)
+	keys := v.keys(h.Kid)
+	if len(keys) == 0 {
+		return ErrKeyNotFound
+	}
+	for _, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if h.Alg[:2] == "RS" && rsa.VerifyPKCS1v15(key, hash, sum, sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if h.Alg[:2] != "ES" || len(sig) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, sum, r, s) {
+				return nil
+			}
+		}
+	}
+	return ErrSignature
+}
+
+// keys returns the public keys which may have signed a token naming kid
+func (v *Validator) keys(kid string) []crypto.PublicKey {
+	keys := []crypto.PublicKey{}
+	if v.key != nil {
+		keys = append(keys, v.key)
+	}
+	if v.jwks != nil {
+		keys = append(keys, v.jwks.get(kid)...)
+	}
+	return keys
+}
+
+// check checks the registered claims
+func (v *Validator) check(claims Claims) error {
+	now := v.now()
+	exp, ok, err := claims.time("exp")
+	if err != nil {
+		return err
+	}
+	if ok && !now.Before(exp.Add(v.leeway)) {
+		return ErrExpired
+	}
+	nbf, ok, err := claims.time("nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(v.leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return ErrIssuer
+	}
+	if v.audience != "" && !claims.audience(v.audience) {
+		return ErrAudience
+	}
+	return nil
+}
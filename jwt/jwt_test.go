@@ -0,0 +1,187 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// sign returns a token of claims signed by key with alg
+func sign(t *testing.T, alg, kid string, key interface{}, claims Claims) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	c, _ := json.Marshal(claims)
+	input := b64(h) + "." + b64(c)
+	hash := hashes[alg[2:]]
+	digest := hash.New()
+	digest.Write([]byte(input))
+	sum := digest.Sum(nil)
+
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, key)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, sum)
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum)
+		require.NoError(t, err)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	return input + "." + b64(sig)
+}
+
+func TestHMAC(t *testing.T) {
+	_, err := New()
+	assert.Equal(t, ErrNoKey, err)
+
+	v, err := New(SecretOpt("secret"), IssuerOpt("golb"), AudienceOpt("web"), LeewayOpt(time.Minute))
+	require.NoError(t, err)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	valid := Claims{"iss": "golb", "aud": []interface{}{"api", "web"}, "sub": "alice",
+		"exp": float64(now.Add(time.Hour).Unix()), "roles": []interface{}{"admin", 42.0}}
+
+	claims, err := v.Validate(sign(t, "HS256", "", []byte("secret"), valid))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.String("sub"))
+	assert.Equal(t, "admin,42", claims.String("roles"))
+	assert.Equal(t, "", claims.String("missing"))
+	_, err = v.Validate(sign(t, "HS512", "", []byte("secret"), valid))
+	assert.NoError(t, err)
+
+	cases := []struct {
+		token string
+		err   error
+	}{
+		{"a.b", ErrMalformed},
+		{"a.b.c", ErrMalformed},
+		{sign(t, "HS256", "", []byte("wrong"), valid), ErrSignature},
+		// no RSA key
+		{sign(t, "RS256", "", []byte("secret"), valid), ErrKeyNotFound},
+		{sign(t, "HS256", "", []byte("secret"), Claims{"iss": "golb", "aud": "web", "exp": float64(now.Add(-2 * time.Minute).Unix())}), ErrExpired},
+		{sign(t, "HS256", "", []byte("secret"), Claims{"iss": "golb", "aud": "web", "nbf": float64(now.Add(2 * time.Minute).Unix())}), ErrNotYetValid},
+		{sign(t, "HS256", "", []byte("secret"), Claims{"iss": "other", "aud": "web"}), ErrIssuer},
+		{sign(t, "HS256", "", []byte("secret"), Claims{"iss": "golb", "aud": "api"}), ErrAudience},
+		{sign(t, "HS256", "", []byte("secret"), Claims{"iss": "golb", "aud": "web", "exp": "tomorrow"}), ErrMalformed},
+	}
+	for i, c := range cases {
+		_, err := v.Validate(c.token)
+		assert.Equal(t, c.err, err, i)
+	}
+	// within the leeway
+	_, err = v.Validate(sign(t, "HS256", "", []byte("secret"), Claims{"iss": "golb", "aud": "web", "exp": float64(now.Add(-30 * time.Second).Unix())}))
+	assert.NoError(t, err)
+
+	h := b64([]byte(`{"alg":"none"}`))
+	_, err = v.Validate(h + "." + b64([]byte(`{}`)) + ".")
+	assert.Equal(t, ErrAlgorithm, err)
+}
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	file := filepath.Join(dir, "rsa.pem")
+	require.NoError(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	v, err := New(KeyFileOpt(file))
+	require.NoError(t, err)
+	_, err = v.Validate(sign(t, "RS256", "", rsaKey, Claims{"sub": "alice"}))
+	assert.NoError(t, err)
+	// the public key is not an HMAC secret
+	_, err = v.Validate(sign(t, "HS256", "", der, Claims{"sub": "alice"}))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = v.Validate(sign(t, "ES256", "", mustECDSA(t), Claims{"sub": "alice"}))
+	assert.Equal(t, ErrSignature, err)
+
+	bad := filepath.Join(dir, "bad.pem")
+	require.NoError(t, ioutil.WriteFile(bad, []byte("not a key"), 0644))
+	_, err = New(KeyFileOpt(bad))
+	assert.Error(t, err)
+	_, err = New(KeyFileOpt(filepath.Join(dir, "missing.pem")))
+	assert.Error(t, err)
+}
+
+func mustECDSA(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey := mustECDSA(t)
+	rotated := mustECDSA(t)
+
+	var fetches int32
+	var served atomic.Value
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": "r1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+	}
+	served.Store(keys)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": served.Load()})
+	}))
+	defer s.Close()
+
+	v, err := New(JWKSOpt(s.URL, 0))
+	require.NoError(t, err)
+	_, err = v.Validate(sign(t, "RS256", "r1", rsaKey, Claims{}))
+	assert.NoError(t, err)
+	_, err = v.Validate(sign(t, "ES256", "e1", ecKey, Claims{}))
+	assert.NoError(t, err)
+	// no kid, all the keys are tried
+	_, err = v.Validate(sign(t, "ES256", "", ecKey, Claims{}))
+	assert.NoError(t, err)
+	_, err = v.Validate(sign(t, "RS256", "e1", rsaKey, Claims{}))
+	assert.Equal(t, ErrSignature, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// an unknown key is fetched again, at most once a minute
+	served.Store(append(keys, map[string]string{"kty": "EC", "kid": "e2", "crv": "P-256", "x": b64(rotated.X.Bytes()), "y": b64(rotated.Y.Bytes())}))
+	_, err = v.Validate(sign(t, "ES256", "e2", rotated, Claims{}))
+	assert.Equal(t, ErrKeyNotFound, err)
+	v.jwks.fetched = time.Now().Add(-JWKS_MIN_REFRESH)
+	_, err = v.Validate(sign(t, "ES256", "e2", rotated, Claims{}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+	assert.Equal(t, 3, len(v.jwks.keys))
+}
@@ -0,0 +1,208 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_JWKS_REFRESH = time.Hour
+	// minimum interval between the fetches triggered by unknown keys
+	JWKS_MIN_REFRESH = time.Minute
+)
+
+// keyError wraps the errors of the keys
+func keyError(format string, args ...interface{}) error {
+	return fmt.Errorf("jwt key: "+format, args...)
+}
+
+// loadKeyFile returns the PEM public key or the key of the PEM certificate of file
+func loadKeyFile(file string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, keyError("%s is not PEM encoded", file)
+	}
+	var key crypto.PublicKey
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, keyError("%s is not a RSA or ECDSA key", file)
+}
+
+// jwk is a JSON Web Key (RFC 7517), the RSA and EC public keys only
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// publicKey returns the key of k
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, keyError("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, keyError("point of %q is not on the curve", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, keyError("unsupported key type %q", k.Kty)
+}
+
+// jwks caches the JSON Web Key Set served at url
+type jwks struct {
+	sync.Mutex
+	url     string
+	refresh time.Duration
+	client  *http.Client
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newJWKS(url string, refresh time.Duration) *jwks {
+	if refresh <= 0 {
+		refresh = DEFAULT_JWKS_REFRESH
+	}
+	return &jwks{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// fetch replaces the keys by the ones served, the keys not for signatures are skipped
+func (j *jwks) fetch() error {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return keyError("%s responds %s", j.url, resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnf("JWKS %s key %q: %v", j.url, k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	j.keys = keys
+	return nil
+}
+
+// get returns the key kid, or all the keys if kid is empty. The keys are fetched if
+// older than the refresh interval, or kid is unknown or the last fetch failed, at most once a minute
+func (j *jwks) get(kid string) []crypto.PublicKey {
+	j.Lock()
+	defer j.Unlock()
+
+	age := time.Since(j.fetched)
+	_, known := j.keys[kid]
+	stale := j.fetched.IsZero() || age >= j.refresh
+	if j.keys == nil || (kid != "" && !known) {
+		stale = stale || age >= JWKS_MIN_REFRESH
+	}
+	if stale {
+		j.fetched = time.Now()
+		if err := j.fetch(); err != nil {
+			log.Errorf("Fetch JWKS %s error=%v", j.url, err)
+		}
+	}
+	if kid != "" {
+		if key, ok := j.keys[kid]; ok {
+			return []crypto.PublicKey{key}
+		}
+		return nil
+	}
+	keys := make([]crypto.PublicKey, 0, len(j.keys))
+	for _, key := range j.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,13 @@
+// package leasttime provides least response time balancing
+//
+// every peer has an exponentially weighted moving average (EWMA) of its response times,
+// decayed by the time between the samples, so the recent responses count the most,
+// and raised at once by a slower response (peak EWMA).
+// The peer with the lowest cost, the EWMA divided by the weight, gets the request.
+// The cost is optionally multiplied by the requests in flight plus one, so a fast peer
+// is not overloaded, and the peers may be compared two at a time, picked at random
+// (the power of two choices), to spread the requests of concurrent balancers
+//
+// the P2C+EWMA algorithm of Finagle
+// https://twitter.github.io/finagle/guide/Clients.html#power-of-two-choices-p2c-least-loaded
+package leasttime
@@ -0,0 +1,281 @@
+package leasttime
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// time constant of the EWMA, a sample older by DEFAULT_DECAY counts e times less
+	DEFAULT_DECAY = 10 * time.Second
+	// a failed request counts as slow as FAIL_PENALTY at least,
+	// so a peer failing fast is not preferred
+	FAIL_PENALTY = time.Second
+)
+
+// Peer represents a backend server
+type Peer struct {
+	addr   string
+	weight int
+	down   bool
+	// only used when all the primary peers are down
+	backup bool
+	// EWMA of the response times in seconds, 0 until the first sample
+	ewma float64
+	// when the last sample was observed
+	last   time.Time
+	active int
+}
+
+// Pool is a group of Peers, one Peer can not belong to multiple Pool
+type Pool struct {
+	sync.Mutex
+	peers []*Peer
+	decay time.Duration
+	// multiply the cost by the requests in flight plus one
+	connections bool
+	// compare two random peers instead of all of them
+	p2c  bool
+	rand *rand.Rand
+}
+
+// New returns a pool multiplying the cost by the requests in flight plus one if connections,
+// and comparing two random peers if p2c
+func New(connections, p2c bool) *Pool {
+	return &Pool{
+		decay:       DEFAULT_DECAY,
+		connections: connections,
+		p2c:         p2c,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Configure changes how the peers are compared, see New
+func (p *Pool) Configure(connections, p2c bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.connections = connections
+	p.p2c = p2c
+}
+
+func CreatePool(pairs map[string]int, connections, p2c bool) *Pool {
+	pool := New(connections, p2c)
+	for addr, weight := range pairs {
+		pool.Add(addr, weight)
+	}
+	return pool
+}
+
+func (p *Pool) String() string {
+	p.Lock()
+	defer p.Unlock()
+	result := []string{}
+	for _, peer := range p.peers {
+		if peer.backup {
+			result = append(result, peer.addr+" (backup)")
+		} else {
+			result = append(result, peer.addr)
+		}
+	}
+	sort.Strings(result)
+	return strings.Join(result, ", ")
+}
+
+func (p *Pool) Size() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.peers)
+}
+
+// Peers returns the sorted addresses of the peers, including the backup peers
+func (p *Pool) Peers() []string {
+	p.Lock()
+	defer p.Unlock()
+	result := make([]string, 0, len(p.peers))
+	for _, peer := range p.peers {
+		result = append(result, peer.addr)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// find returns the peer of addr, nil if not found, the lock should be held
+func (p *Pool) find(addr string) *Peer {
+	for _, peer := range p.peers {
+		if peer.addr == addr {
+			return peer
+		}
+	}
+	return nil
+}
+
+// Add adds a peer, args are the weight (default 1) and whether it is a backup
+func (p *Pool) Add(addr string, args ...interface{}) {
+	if addr == "" {
+		return
+	}
+	peer := &Peer{addr: addr, weight: 1}
+	if len(args) > 0 {
+		if w, ok := args[0].(int); ok && w > 0 {
+			peer.weight = w
+		}
+	}
+	if len(args) > 1 {
+		peer.backup, _ = args[1].(bool)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.find(addr) != nil {
+		return
+	}
+	p.peers = append(p.peers, peer)
+}
+
+func (p *Pool) Remove(addr string) {
+	p.Lock()
+	defer p.Unlock()
+	for i, peer := range p.peers {
+		if peer.addr == addr {
+			p.peers = append(p.peers[:i], p.peers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *Pool) setPeerStatus(addr string, isDown bool) {
+	p.Lock()
+	defer p.Unlock()
+	if peer := p.find(addr); peer != nil {
+		peer.down = isDown
+	}
+}
+
+func (p *Pool) DownPeer(addr string) {
+	p.setPeerStatus(addr, true)
+}
+
+func (p *Pool) UpPeer(addr string) {
+	p.setPeerStatus(addr, false)
+}
+
+// SetWeight changes the weight of peer, weight <= 0 is ignored
+func (p *Pool) SetWeight(addr string, weight int) {
+	if weight <= 0 {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if peer := p.find(addr); peer != nil {
+		peer.weight = weight
+	}
+}
+
+// cost returns the score of peer, the lower the better, the lock should be held.
+// The EWMA of a peer not chosen for a while decays, so a slow peer is tried again
+func (p *Pool) cost(peer *Peer, now time.Time) float64 {
+	ewma := peer.ewma
+	if !peer.last.IsZero() {
+		ewma *= math.Exp(-float64(now.Sub(peer.last)) / float64(p.decay))
+	}
+	cost := ewma / float64(peer.weight)
+	if p.connections {
+		// the idle peers without a sample compare by the requests in flight
+		cost = (cost + 1e-9) * float64(peer.active+1)
+	}
+	return cost
+}
+
+// Get returns the peer of the lowest cost,
+// the backup peers are used only if all the primary peers are down
+func (p *Pool) Get(args ...interface{}) string {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	if peer := p.get(false, now); peer != "" {
+		return peer
+	}
+	return p.get(true, now)
+}
+
+func (p *Pool) get(backup bool, now time.Time) string {
+	candidates := make([]*Peer, 0, len(p.peers))
+	for _, peer := range p.peers {
+		if !peer.down && peer.backup == backup {
+			candidates = append(candidates, peer)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	if p.p2c && len(candidates) > 2 {
+		i := p.rand.Intn(len(candidates))
+		j := p.rand.Intn(len(candidates) - 1)
+		if j >= i {
+			j++
+		}
+		candidates = []*Peer{candidates[i], candidates[j]}
+	}
+
+	var best *Peer
+	var bestCost float64
+	for _, peer := range candidates {
+		cost := p.cost(peer, now)
+		if best == nil || cost < bestCost {
+			best, bestCost = peer, cost
+		}
+	}
+	return best.addr
+}
+
+// Acquire counts a request in flight to peer, it should be released by Release
+func (p *Pool) Acquire(addr string) {
+	p.Lock()
+	defer p.Unlock()
+	if peer := p.find(addr); peer != nil {
+		peer.active++
+	}
+}
+
+// Release ends a request to peer, which took d, failed if the peer should be avoided
+func (p *Pool) Release(addr string, d time.Duration, failed bool) {
+	p.Lock()
+	defer p.Unlock()
+	if peer := p.find(addr); peer != nil {
+		if peer.active > 0 {
+			peer.active--
+		}
+		if failed && d < FAIL_PENALTY {
+			d = FAIL_PENALTY
+		}
+		p.observe(peer, d, time.Now())
+	}
+}
+
+// observe adds the sample d to the EWMA of peer, the lock should be held
+func (p *Pool) observe(peer *Peer, d time.Duration, now time.Time) {
+	sample := d.Seconds()
+	if peer.last.IsZero() || sample > peer.ewma {
+		// peak sensitive, a slower peer is avoided at once
+		peer.ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(peer.last)) / float64(p.decay))
+		peer.ewma = peer.ewma*w + sample*(1-w)
+	}
+	peer.last = now
+}
+
+// Latency returns the EWMA of the response times of peer, 0 if unknown
+func (p *Pool) Latency(addr string) time.Duration {
+	p.Lock()
+	defer p.Unlock()
+	if peer := p.find(addr); peer != nil {
+		return time.Duration(peer.ewma * float64(time.Second))
+	}
+	return 0
+}
@@ -0,0 +1,112 @@
+package leasttime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetLeastTime(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1, "c": 1}, false, false)
+	assert.Equal(t, "a, b, c", pool.String())
+	assert.Equal(t, 3, pool.Size())
+
+	now := time.Now()
+	pool.Lock()
+	pool.observe(pool.find("a"), 30*time.Millisecond, now)
+	pool.observe(pool.find("b"), 10*time.Millisecond, now)
+	pool.observe(pool.find("c"), 20*time.Millisecond, now)
+	pool.Unlock()
+	assert.Equal(t, "b", pool.Get())
+	assert.Equal(t, "b", pool.Get())
+
+	pool.DownPeer("b")
+	assert.Equal(t, "c", pool.Get())
+	pool.UpPeer("b")
+
+	// a slower response counts at once
+	pool.Release("b", 50*time.Millisecond, false)
+	assert.Equal(t, 50*time.Millisecond, pool.Latency("b"))
+	assert.Equal(t, "c", pool.Get())
+
+	// a failed response counts as FAIL_PENALTY
+	pool.Release("c", time.Millisecond, true)
+	assert.Equal(t, FAIL_PENALTY, pool.Latency("c"))
+	assert.Equal(t, "a", pool.Get())
+
+	// twice the weight, half the cost
+	pool.SetWeight("b", 2)
+	pool.Lock()
+	pool.find("a").ewma = 0.030
+	pool.find("b").ewma = 0.050
+	pool.Unlock()
+	assert.Equal(t, "b", pool.Get())
+}
+
+func TestEWMA(t *testing.T) {
+	pool := New(false, false)
+	pool.Add("a", 1)
+	now := time.Now()
+	pool.Lock()
+	defer pool.Unlock()
+	peer := pool.find("a")
+	pool.observe(peer, 100*time.Millisecond, now)
+	// a sample DEFAULT_DECAY later weighs 1 - 1/e
+	pool.observe(peer, 0, now.Add(DEFAULT_DECAY))
+	assert.InDelta(t, 0.1/2.718281828, peer.ewma, 1e-6)
+
+	// the cost of an idle peer decays
+	assert.InDelta(t, peer.ewma/2.718281828, pool.cost(peer, now.Add(2*DEFAULT_DECAY)), 1e-6)
+}
+
+func TestConnections(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1}, true, false)
+	// the peers without a sample compare by the requests in flight
+	pool.Acquire("a")
+	assert.Equal(t, "b", pool.Get())
+	pool.Acquire("b")
+	pool.Acquire("b")
+	assert.Equal(t, "a", pool.Get())
+
+	now := time.Now()
+	pool.Lock()
+	pool.observe(pool.find("a"), 10*time.Millisecond, now)
+	pool.observe(pool.find("b"), 15*time.Millisecond, now)
+	pool.Unlock()
+	// 10ms * (2 in flight + 1) > 15ms * 1
+	pool.Acquire("a")
+	pool.Release("b", 15*time.Millisecond, false)
+	pool.Release("b", 15*time.Millisecond, false)
+	assert.Equal(t, "b", pool.Get())
+}
+
+func TestP2C(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1, "c": 1}, false, true)
+	now := time.Now()
+	pool.Lock()
+	pool.observe(pool.find("a"), 10*time.Millisecond, now)
+	pool.observe(pool.find("b"), 20*time.Millisecond, now)
+	pool.observe(pool.find("c"), 30*time.Millisecond, now)
+	pool.Unlock()
+
+	count := map[string]int{}
+	for i := 0; i < 300; i++ {
+		count[pool.Get()]++
+	}
+	// the slowest peer always loses, the fastest one always wins
+	assert.Equal(t, 0, count["c"])
+	assert.True(t, count["a"] > count["b"], "%v", count)
+}
+
+func TestBackupPeer(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1}, false, false)
+	pool.Add("z", 1, true)
+	assert.Equal(t, "a, z (backup)", pool.String())
+	assert.Equal(t, "a", pool.Get())
+	pool.DownPeer("a")
+	assert.Equal(t, "z", pool.Get())
+	pool.Remove("z")
+	assert.Equal(t, "", pool.Get())
+	assert.Equal(t, []string{"a"}, pool.Peers())
+}
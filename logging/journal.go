@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const JOURNALD_SOCKET = "/run/systemd/journal/socket"
+
+// Journal sends entries to journald with its native protocol
+type Journal struct {
+	conn *net.UnixConn
+}
+
+// DialJournal connects to JOURNALD_SOCKET
+func DialJournal() (*Journal, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: JOURNALD_SOCKET, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{conn}, nil
+}
+
+// journalField returns key as a journal field name, upper case letters, digits and underscores
+// not starting with an underscore
+func journalField(key string) string {
+	b := []byte(strings.ToUpper(key))
+	for i, c := range b {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return strings.TrimLeft(string(b), "_0123456789")
+}
+
+// writeJournalField appends a field, the values with a newline are sent length-prefixed
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	if key == "" {
+		return
+	}
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	buf.WriteString(key + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// Send sends msg at severity with identifier as SYSLOG_IDENTIFIER, the fields are
+// journal fields, e.g. peer as PEER
+func (j *Journal) Send(severity int, identifier, msg string, fields map[string]string) error {
+	buf := &bytes.Buffer{}
+	writeJournalField(buf, "MESSAGE", msg)
+	writeJournalField(buf, "PRIORITY", fmt.Sprint(severity))
+	writeJournalField(buf, "SYSLOG_IDENTIFIER", identifier)
+	for k, v := range fields {
+		writeJournalField(buf, journalField(k), v)
+	}
+	_, err := j.conn.Write(buf.Bytes())
+	return err
+}
+
+func (j *Journal) Close() error {
+	return j.conn.Close()
+}
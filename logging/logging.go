@@ -0,0 +1,281 @@
+// package logging configures the logrus logger of golb: the level, the format, the output
+// (stdout, stderr, a file, syslog or journald) and the level of every package, e.g. debug
+// for the balancer only. The entries can also be passed to a Logger implemented by the user
+package logging
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+
+	OUTPUT_STDOUT   = "stdout"
+	OUTPUT_STDERR   = "stderr"
+	OUTPUT_SYSLOG   = "syslog"
+	OUTPUT_JOURNALD = "journald"
+
+	// trimmed from the packages of golb to name the modules, e.g. balancer or discovery/kubernetes
+	MODULE_PREFIX = "github.com/onestraw/golb/"
+	// frames walked to find the caller of logrus
+	MAX_CALLER_DEPTH = 32
+)
+
+// Logger receives the entries at their module level or above, module is the package of the caller
+// if levels by module are configured, empty otherwise
+type Logger interface {
+	Log(module string, e *log.Entry) error
+}
+
+// Handler passes the entries of logrus to its Logger
+type Handler struct {
+	level   log.Level
+	modules map[string]log.Level
+	format  string
+	output  string
+	logger  Logger
+}
+
+type Option func(h *Handler) error
+
+// LevelOpt sets the level of the modules without their own level, empty means info
+func LevelOpt(level string) Option {
+	return func(h *Handler) error {
+		if level == "" {
+			return nil
+		}
+		l, err := log.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		h.level = l
+		return nil
+	}
+}
+
+// ModulesOpt sets the level by module, a module also sets the level of its subpackages,
+// e.g. discovery for discovery/kubernetes
+func ModulesOpt(levels map[string]string) Option {
+	return func(h *Handler) error {
+		for module, level := range levels {
+			l, err := log.ParseLevel(level)
+			if err != nil {
+				return fmt.Errorf("module %s: %v", module, err)
+			}
+			h.modules[strings.Trim(module, "/")] = l
+		}
+		return nil
+	}
+}
+
+// FormatOpt sets the format of the built-in outputs, text or json, empty means text
+func FormatOpt(format string) Option {
+	return func(h *Handler) error {
+		switch format {
+		case "", FORMAT_TEXT:
+			h.format = FORMAT_TEXT
+		case FORMAT_JSON:
+			h.format = FORMAT_JSON
+		default:
+			return fmt.Errorf("unknown log format %q", format)
+		}
+		return nil
+	}
+}
+
+// OutputOpt sets the built-in output: stdout, stderr, syslog (the local socket), journald, a syslog
+// address (udp://host:514, tcp://host:601 or unix:///dev/log), or the path of a file the entries
+// are appended to. Empty means stderr
+func OutputOpt(output string) Option {
+	return func(h *Handler) error {
+		h.output = output
+		return nil
+	}
+}
+
+// LoggerOpt passes the entries to logger instead of the built-in output
+func LoggerOpt(logger Logger) Option {
+	return func(h *Handler) error {
+		h.logger = logger
+		return nil
+	}
+}
+
+func New(opts ...Option) (*Handler, error) {
+	h := &Handler{level: log.InfoLevel, modules: make(map[string]log.Level), format: FORMAT_TEXT}
+	for _, opt := range opts {
+		if err := opt(h); err != nil {
+			return nil, err
+		}
+	}
+	if h.logger != nil {
+		return h, nil
+	}
+	logger, err := newOutput(h.output, h.format)
+	if err != nil {
+		return nil, err
+	}
+	h.logger = logger
+	return h, nil
+}
+
+func (h *Handler) String() string {
+	modules := []string{}
+	for module, level := range h.modules {
+		modules = append(modules, module+":"+level.String())
+	}
+	return fmt.Sprintf("level=%s format=%s output=%s modules=[%s]", h.level, h.format, h.output,
+		strings.Join(modules, ","))
+}
+
+// maxLevel returns the most verbose level of the modules, let through logrus
+func (h *Handler) maxLevel() log.Level {
+	level := h.level
+	for _, l := range h.modules {
+		if l > level {
+			level = l
+		}
+	}
+	return level
+}
+
+// Install makes h the output of logger, logger should not be in use yet, see Configure
+func (h *Handler) Install(logger *log.Logger) {
+	logger.SetLevel(h.maxLevel())
+	logger.Out = ioutil.Discard
+	logger.Formatter = discardFormatter{}
+	logger.Hooks = make(log.LevelHooks)
+	logger.AddHook(h)
+}
+
+// Close closes the output, the entries logged after are dropped
+func (h *Handler) Close() error {
+	if c, ok := h.logger.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (h *Handler) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire passes e to the Logger if it is at the level of its module or above
+func (h *Handler) Fire(e *log.Entry) error {
+	module := ""
+	level := h.level
+	if len(h.modules) > 0 {
+		module = callerModule()
+		level = h.moduleLevel(module)
+	}
+	if e.Level > level {
+		return nil
+	}
+	return h.logger.Log(module, e)
+}
+
+// moduleLevel returns the level of module or of its closest parent configured
+func (h *Handler) moduleLevel(module string) log.Level {
+	for m := module; m != ""; {
+		if l, ok := h.modules[m]; ok {
+			return l
+		}
+		i := strings.LastIndex(m, "/")
+		if i < 0 {
+			break
+		}
+		m = m[:i]
+	}
+	return h.level
+}
+
+// callerModule returns the package calling logrus, without MODULE_PREFIX
+func callerModule() string {
+	pcs := make([]uintptr, MAX_CALLER_DEPTH)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	inLogrus := false
+	for {
+		frame, more := frames.Next()
+		pkg := funcPackage(frame.Function)
+		if strings.HasSuffix(pkg, "/sirupsen/logrus") {
+			inLogrus = true
+		} else if inLogrus {
+			return moduleName(pkg)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// funcPackage returns the package of the function name returned by the runtime,
+// e.g. github.com/onestraw/golb/balancer for github.com/onestraw/golb/balancer.(*VirtualServer).Run
+func funcPackage(function string) string {
+	slash := strings.LastIndex(function, "/")
+	if dot := strings.Index(function[slash+1:], "."); dot >= 0 {
+		return function[:slash+1+dot]
+	}
+	return function
+}
+
+// moduleName trims MODULE_PREFIX and the vendor directory of pkg
+func moduleName(pkg string) string {
+	if i := strings.LastIndex(pkg, "/vendor/"); i >= 0 {
+		return pkg[i+len("/vendor/"):]
+	}
+	return strings.TrimPrefix(pkg, MODULE_PREFIX)
+}
+
+// discardFormatter skips the formatting of logrus, the entries are formatted by the Logger of the Handler
+type discardFormatter struct{}
+
+func (discardFormatter) Format(e *log.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+var (
+	install sync.Once
+	// the Handler of the standard logger, swapped by Configure
+	standard atomic.Value
+)
+
+// standardHook passes the entries of the standard logger to the Handler configured last
+type standardHook struct{}
+
+func (standardHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (standardHook) Fire(e *log.Entry) error {
+	return standard.Load().(*Handler).Fire(e)
+}
+
+// Configure makes a Handler of the options the output of the standard logger of logrus, in use.
+// The Handler configured before is closed, e.g. on reload
+func Configure(opts ...Option) (*Handler, error) {
+	h, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	prev, _ := standard.Load().(*Handler)
+	standard.Store(h)
+	install.Do(func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetFormatter(discardFormatter{})
+		log.AddHook(standardHook{})
+	})
+	log.SetLevel(h.maxLevel())
+	if prev != nil {
+		prev.Close()
+	}
+	return h, nil
+}
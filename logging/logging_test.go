@@ -0,0 +1,148 @@
+package logging
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type entry struct {
+	module string
+	level  log.Level
+	msg    string
+}
+
+type recorder struct {
+	entries []entry
+}
+
+func (r *recorder) Log(module string, e *log.Entry) error {
+	r.entries = append(r.entries, entry{module, e.Level, e.Message})
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	_, err := New(LevelOpt("verbose"))
+	assert.Error(t, err)
+	_, err = New(FormatOpt("xml"))
+	assert.Error(t, err)
+	_, err = New(ModulesOpt(map[string]string{"balancer": ""}))
+	assert.Error(t, err)
+
+	r := &recorder{}
+	h, err := New(LevelOpt("warning"), LoggerOpt(r))
+	require.NoError(t, err)
+	logger := log.New()
+	h.Install(logger)
+	logger.Info("dropped")
+	logger.WithField("peer", "127.0.0.1:80").Warn("down")
+	assert.Equal(t, []entry{{"", log.WarnLevel, "down"}}, r.entries)
+
+	// the debug entries of this package only
+	r = &recorder{}
+	h, err = New(LevelOpt("error"), ModulesOpt(map[string]string{"logging": "debug"}), LoggerOpt(r))
+	require.NoError(t, err)
+	logger = log.New()
+	h.Install(logger)
+	assert.Equal(t, log.DebugLevel, logger.Level)
+	logger.Debugf("peer %s", "up")
+	assert.Equal(t, []entry{{"logging", log.DebugLevel, "peer up"}}, r.entries)
+}
+
+func TestModule(t *testing.T) {
+	assert.Equal(t, "github.com/onestraw/golb/balancer",
+		funcPackage("github.com/onestraw/golb/balancer.(*VirtualServer).Run.func1"))
+	assert.Equal(t, "main", funcPackage("main.main"))
+	assert.Equal(t, "discovery/kubernetes", moduleName("github.com/onestraw/golb/discovery/kubernetes"))
+	assert.Equal(t, "github.com/sirupsen/logrus",
+		moduleName("github.com/onestraw/golb/vendor/github.com/sirupsen/logrus"))
+
+	h, err := New(LevelOpt("info"), LoggerOpt(&recorder{}),
+		ModulesOpt(map[string]string{"discovery": "debug", "discovery/consul": "error"}))
+	require.NoError(t, err)
+	assert.Equal(t, log.DebugLevel, h.moduleLevel("discovery/kubernetes"))
+	assert.Equal(t, log.ErrorLevel, h.moduleLevel("discovery/consul"))
+	assert.Equal(t, log.InfoLevel, h.moduleLevel("balancer"))
+}
+
+func TestFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "golb.log")
+
+	h, err := New(OutputOpt(file), FormatOpt(FORMAT_JSON), ModulesOpt(map[string]string{"logging": "info"}))
+	require.NoError(t, err)
+	logger := log.New()
+	h.Install(logger)
+	logger.WithField("vs", "web").Info("started")
+	require.NoError(t, h.Close())
+
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"module":"logging"`)
+	assert.Contains(t, string(data), `"msg":"started"`)
+	assert.Contains(t, string(data), `"vs":"web"`)
+}
+
+func TestJournalField(t *testing.T) {
+	assert.Equal(t, "PEER_ADDR", journalField("peer-addr"))
+	assert.Equal(t, "ERR", journalField("_err"))
+}
+
+func TestSyslog(t *testing.T) {
+	_, err := DialSyslog("http://127.0.0.1:514", "", IDENTIFIER)
+	assert.Error(t, err)
+	_, err = DialSyslog("udp://127.0.0.1:514", "local9", IDENTIFIER)
+	assert.Error(t, err)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	s, err := DialSyslog("udp://"+pc.LocalAddr().String(), "local0", IDENTIFIER)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, "udp://"+pc.LocalAddr().String(), s.String())
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 6000, time.UTC)
+	assert.Equal(t, fmt.Sprintf(`<131>1 2026-01-02T03:04:05.000006Z %s golb %d access [golb@32473 a_b="1" path="/x\]\"y"] down`,
+		s.hostname, os.Getpid()),
+		s.format(SEVERITY_ERR, "access", "down", map[string]string{"path": `/x]"y`, "a b": "1"}, now))
+
+	require.NoError(t, s.Send(SEVERITY_INFO, "", "up", nil))
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "<134>1 "), string(buf[:n]))
+	assert.True(t, strings.HasSuffix(string(buf[:n]), " - - up"), string(buf[:n]))
+
+	// octet counting over TCP, and the entries of the standard output
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	h, err := New(OutputOpt("tcp://"+ln.Addr().String()), ModulesOpt(map[string]string{"logging": "info"}))
+	require.NoError(t, err)
+	defer h.Close()
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	logger := log.New()
+	h.Install(logger)
+	logger.WithField("vs", "web").Warn("down")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString(']')
+	require.NoError(t, err)
+	assert.Regexp(t, `^\d+ <28>1 `, line)
+	assert.Contains(t, line, ` logging [golb@32473 vs="web"]`)
+}
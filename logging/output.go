@@ -0,0 +1,144 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tag of syslog and SYSLOG_IDENTIFIER of journald
+const IDENTIFIER = "golb"
+
+// newFormatter returns the formatter of format
+func newFormatter(format string) log.Formatter {
+	if format == FORMAT_JSON {
+		return &log.JSONFormatter{}
+	}
+	return &log.TextFormatter{FullTimestamp: true}
+}
+
+// isSyslogAddress returns true for the addresses of DialSyslog
+func isSyslogAddress(output string) bool {
+	for _, scheme := range []string{"udp://", "tcp://", "unix://"} {
+		if strings.HasPrefix(output, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// newOutput returns the built-in Logger of output
+func newOutput(output, format string) (Logger, error) {
+	switch {
+	case output == "" || output == OUTPUT_STDERR:
+		return &writerOutput{newFormatter(format), os.Stderr}, nil
+	case output == OUTPUT_STDOUT:
+		return &writerOutput{newFormatter(format), os.Stdout}, nil
+	case output == OUTPUT_SYSLOG || isSyslogAddress(output):
+		if output == OUTPUT_SYSLOG {
+			output = ""
+		}
+		s, err := DialSyslog(output, "", IDENTIFIER)
+		if err != nil {
+			return nil, err
+		}
+		return &syslogOutput{s}, nil
+	case output == OUTPUT_JOURNALD:
+		j, err := DialJournal()
+		if err != nil {
+			return nil, err
+		}
+		return &journaldOutput{j}, nil
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writerOutput{newFormatter(format), f}, nil
+}
+
+// withModule returns a copy of e with the module field, the fields of e may be shared
+func withModule(module string, e *log.Entry) *log.Entry {
+	if module == "" {
+		return e
+	}
+	c := *e
+	c.Data = make(log.Fields, len(e.Data)+1)
+	for k, v := range e.Data {
+		c.Data[k] = v
+	}
+	c.Data["module"] = module
+	return &c
+}
+
+// Severity returns the syslog severity of level
+func Severity(level log.Level) int {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return SEVERITY_CRIT
+	case log.ErrorLevel:
+		return SEVERITY_ERR
+	case log.WarnLevel:
+		return SEVERITY_WARNING
+	case log.InfoLevel:
+		return SEVERITY_INFO
+	}
+	return SEVERITY_DEBUG
+}
+
+// fields returns the fields of e as strings
+func fields(e *log.Entry) map[string]string {
+	result := make(map[string]string, len(e.Data))
+	for k, v := range e.Data {
+		result[k] = fmt.Sprint(v)
+	}
+	return result
+}
+
+// writerOutput writes the formatted entries to w
+type writerOutput struct {
+	formatter log.Formatter
+	w         io.Writer
+}
+
+func (o *writerOutput) Log(module string, e *log.Entry) error {
+	b, err := o.formatter.Format(withModule(module, e))
+	if err != nil {
+		return err
+	}
+	_, err = o.w.Write(b)
+	return err
+}
+
+// Close closes the file, not stdout or stderr
+func (o *writerOutput) Close() error {
+	if f, ok := o.w.(*os.File); ok && f != os.Stdout && f != os.Stderr {
+		return f.Close()
+	}
+	return nil
+}
+
+// syslogOutput sends the entries to syslog, the module is the MSGID and the fields the structured data
+type syslogOutput struct {
+	*Syslog
+}
+
+func (o *syslogOutput) Log(module string, e *log.Entry) error {
+	return o.Send(Severity(e.Level), module, e.Message, fields(e))
+}
+
+// journaldOutput sends the entries to journald, the module in GOLB_MODULE
+type journaldOutput struct {
+	*Journal
+}
+
+func (o *journaldOutput) Log(module string, e *log.Entry) error {
+	f := fields(e)
+	if module != "" {
+		f["golb_module"] = module
+	}
+	return o.Send(Severity(e.Level), IDENTIFIER, e.Message, f)
+}
@@ -0,0 +1,187 @@
+package logging
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the severities of syslog, also the PRIORITY of journald
+const (
+	SEVERITY_CRIT    = 2
+	SEVERITY_ERR     = 3
+	SEVERITY_WARNING = 4
+	SEVERITY_INFO    = 6
+	SEVERITY_DEBUG   = 7
+
+	DEFAULT_SYSLOG_ADDRESS  = "unix:///dev/log"
+	DEFAULT_SYSLOG_FACILITY = "daemon"
+	// SD-ID of the fields in the structured data, 32473 is the enterprise number reserved for examples
+	SYSLOG_SD_ID = "golb@32473"
+	// timestamp of RFC 5424, at most microseconds
+	SYSLOG_TIME_FORMAT = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Syslog sends RFC 5424 messages over UDP, TCP (octet counting framing) or a unix socket,
+// it reconnects once on a write error
+type Syslog struct {
+	sync.Mutex
+	network  string
+	address  string
+	facility int
+	tag      string
+	hostname string
+	conn     net.Conn
+	// TCP or unix stream socket
+	stream bool
+}
+
+// DialSyslog connects to address: udp://host:514, tcp://host:601 or unix:///dev/log, empty means
+// DEFAULT_SYSLOG_ADDRESS. An empty facility means daemon, tag is the APP-NAME
+func DialSyslog(address, facility, tag string) (*Syslog, error) {
+	if address == "" {
+		address = DEFAULT_SYSLOG_ADDRESS
+	}
+	if facility == "" {
+		facility = DEFAULT_SYSLOG_FACILITY
+	}
+	f, ok := facilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Syslog{network: u.Scheme, address: u.Host, facility: f, tag: tag, hostname: "-"}
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "unix":
+		s.address = u.Path
+	default:
+		return nil, fmt.Errorf("syslog address %q should be udp://, tcp:// or unix://", address)
+	}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		s.hostname = h
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Syslog) String() string {
+	return s.network + "://" + s.address
+}
+
+func (s *Syslog) connect() error {
+	if s.network != "unix" {
+		conn, err := net.Dial(s.network, s.address)
+		s.conn, s.stream = conn, s.network == "tcp"
+		return err
+	}
+	// /dev/log is a datagram socket on most systems
+	conn, err := net.Dial("unixgram", s.address)
+	s.stream = false
+	if err != nil {
+		conn, err = net.Dial("unix", s.address)
+		s.stream = true
+	}
+	s.conn = conn
+	return err
+}
+
+// format returns the RFC 5424 message, the fields are the structured data
+func (s *Syslog) format(severity int, msgid, msg string, fields map[string]string, now time.Time) string {
+	if msgid == "" {
+		msgid = "-"
+	}
+	sd := "-"
+	if len(fields) > 0 {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		params := []string{SYSLOG_SD_ID}
+		for _, k := range keys {
+			params = append(params, fmt.Sprintf(`%s="%s"`, sdName(k), sdEscape(fields[k])))
+		}
+		sd = "[" + strings.Join(params, " ") + "]"
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s", s.facility*8+severity, now.Format(SYSLOG_TIME_FORMAT),
+		s.hostname, s.tag, os.Getpid(), msgid, sd, msg)
+}
+
+// sdName returns key as a SD-NAME, printable ASCII but '=', ' ', ']' and '"', 32 characters at most
+func sdName(key string) string {
+	b := []byte(key)
+	for i, c := range b {
+		if c <= ' ' || c >= 127 || c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 32 {
+		b = b[:32]
+	}
+	return string(b)
+}
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func sdEscape(value string) string {
+	return sdEscaper.Replace(value)
+}
+
+// frame returns the bytes of a message sent over the connection, octet counting over TCP
+// and newline terminated over a unix stream socket
+func (s *Syslog) frame(m string) []byte {
+	if !s.stream {
+		return []byte(m)
+	}
+	if s.network == "tcp" {
+		return []byte(fmt.Sprintf("%d %s", len(m), m))
+	}
+	return []byte(m + "\n")
+}
+
+// Send sends msg at severity with the fields as structured data, msgid may be empty
+func (s *Syslog) Send(severity int, msgid, msg string, fields map[string]string) error {
+	m := s.format(severity, msgid, msg, fields, time.Now())
+	s.Lock()
+	defer s.Unlock()
+	if s.conn != nil {
+		if _, err := s.conn.Write(s.frame(m)); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(s.frame(m))
+	return err
+}
+
+func (s *Syslog) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,27 @@
+// package lua is the Lua engine of the scripts, registered as "lua" by the golb program
+//
+// a script defines the global functions on_request(ctx) and on_response(ctx), both optional,
+// called with ctx of the request
+//   - vars: table of the variables, remote_addr, host, method, uri and vs, the ones set by
+//     on_request are seen by on_response
+//   - status, body: set status in on_request to answer the request with body,
+//     in on_response to change the status of the response
+//   - upstream: set in on_request to send the request to this peer
+//   - req_header(name), set_req_header(name, value): the request headers, changed in on_request
+//   - resp_header(name), set_resp_header(name, value): the response headers, a nil value deletes one
+//
+// only the base, table, string and math libraries are opened, and a call is stopped after
+// CALL_TIMEOUT. A script is loaded in a Lua state per concurrent request, so its globals
+// are not shared by the requests
+//
+//	function on_request(ctx)
+//	  if ctx.req_header("X-Bucket") == "7" then
+//	    ctx.status, ctx.body = 403, "denied"
+//	  end
+//	  ctx.vars.bucket = ctx.req_header("X-Bucket")
+//	end
+//
+//	function on_response(ctx)
+//	  ctx.set_resp_header("X-Bucket", ctx.vars.bucket)
+//	end
+package lua
@@ -0,0 +1,188 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	glua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/onestraw/golb/balancer"
+)
+
+const (
+	ENGINE = "lua"
+
+	// CALL_TIMEOUT stops a script looping forever
+	CALL_TIMEOUT = 100 * time.Millisecond
+
+	ON_REQUEST  = "on_request"
+	ON_RESPONSE = "on_response"
+)
+
+// libraries opened in the states, without io, os and the module loader
+var libraries = []struct {
+	name string
+	open glua.LGFunction
+}{
+	{glua.BaseLibName, glua.OpenBase},
+	{glua.TabLibName, glua.OpenTable},
+	{glua.StringLibName, glua.OpenString},
+	{glua.MathLibName, glua.OpenMath},
+}
+
+// Engine compiles the Lua scripts, see balancer.RegisterScriptEngine
+type Engine struct{}
+
+func (Engine) Compile(name string, source []byte) (balancer.ScriptFilter, error) {
+	chunk, err := parse.Parse(bytes.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := glua.Compile(chunk, name)
+	if err != nil {
+		return nil, err
+	}
+	f := &filter{proto: proto}
+	// the first state reports the errors of the script at load
+	L, err := f.newState()
+	if err != nil {
+		return nil, err
+	}
+	if L.GetGlobal(ON_REQUEST) == glua.LNil && L.GetGlobal(ON_RESPONSE) == glua.LNil {
+		L.Close()
+		return nil, fmt.Errorf("%s defines neither %s nor %s", name, ON_REQUEST, ON_RESPONSE)
+	}
+	f.states.Put(L)
+	return f, nil
+}
+
+// filter runs a script in the states of a pool, a state is not safe for concurrent use
+type filter struct {
+	proto  *glua.FunctionProto
+	states sync.Pool
+}
+
+// newState opens the libraries and runs the script, defining its functions
+func (f *filter) newState() (*glua.LState, error) {
+	L := glua.NewState(glua.Options{SkipOpenLibs: true})
+	for _, lib := range libraries {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(glua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// no file access
+	L.SetGlobal("dofile", glua.LNil)
+	L.SetGlobal("loadfile", glua.LNil)
+
+	L.Push(L.NewFunctionFromProto(f.proto))
+	if err := L.PCall(0, glua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	L.SetTop(0)
+	return L, nil
+}
+
+func (f *filter) OnRequest(ctx *balancer.ScriptContext) error {
+	return f.call(ON_REQUEST, ctx)
+}
+
+func (f *filter) OnResponse(ctx *balancer.ScriptContext) error {
+	return f.call(ON_RESPONSE, ctx)
+}
+
+// call runs the function fn of the script with ctx, if it is defined
+func (f *filter) call(fn string, ctx *balancer.ScriptContext) error {
+	L, ok := f.states.Get().(*glua.LState)
+	if !ok {
+		var err error
+		if L, err = f.newState(); err != nil {
+			return err
+		}
+	}
+	function := L.GetGlobal(fn)
+	if function.Type() != glua.LTFunction {
+		f.states.Put(L)
+		return nil
+	}
+
+	timeout, cancel := context.WithTimeout(ctx.Request.Context(), CALL_TIMEOUT)
+	defer cancel()
+	L.SetContext(timeout)
+	t := newContext(L, ctx)
+	err := L.CallByParam(glua.P{Fn: function, NRet: 0, Protect: true}, t)
+	L.RemoveContext()
+	if err != nil {
+		// the state may be left in the middle of the call
+		L.Close()
+		return err
+	}
+	err = readContext(t, ctx)
+	f.states.Put(L)
+	return err
+}
+
+// newContext returns the Lua table of ctx
+func newContext(L *glua.LState, ctx *balancer.ScriptContext) *glua.LTable {
+	t := L.NewTable()
+	vars := L.NewTable()
+	for k, v := range ctx.Vars {
+		vars.RawSetString(k, glua.LString(v))
+	}
+	t.RawSetString("vars", vars)
+	t.RawSetString("status", glua.LNumber(ctx.Status))
+	t.RawSetString("body", glua.LString(ctx.Body))
+	t.RawSetString("upstream", glua.LString(ctx.Upstream))
+
+	t.RawSetString("req_header", L.NewFunction(func(L *glua.LState) int {
+		L.Push(glua.LString(ctx.Request.Header.Get(L.CheckString(1))))
+		return 1
+	}))
+	t.RawSetString("set_req_header", L.NewFunction(func(L *glua.LState) int {
+		setHeader(L, ctx.Request.Header)
+		return 0
+	}))
+	t.RawSetString("resp_header", L.NewFunction(func(L *glua.LState) int {
+		L.Push(glua.LString(ctx.Header.Get(L.CheckString(1))))
+		return 1
+	}))
+	t.RawSetString("set_resp_header", L.NewFunction(func(L *glua.LState) int {
+		setHeader(L, ctx.Header)
+		return 0
+	}))
+	return t
+}
+
+// setHeader sets the header of the name and value arguments, nil deletes it
+func setHeader(L *glua.LState, h http.Header) {
+	name := L.CheckString(1)
+	if L.Get(2) == glua.LNil {
+		h.Del(name)
+		return
+	}
+	h.Set(name, L.CheckString(2))
+}
+
+// readContext copies the fields of the Lua table t back to ctx
+func readContext(t *glua.LTable, ctx *balancer.ScriptContext) error {
+	status, ok := t.RawGetString("status").(glua.LNumber)
+	if !ok {
+		return fmt.Errorf("ctx.status should be a number")
+	}
+	ctx.Status = int(status)
+	ctx.Body = []byte(glua.LVAsString(t.RawGetString("body")))
+	ctx.Upstream = glua.LVAsString(t.RawGetString("upstream"))
+	if vars, ok := t.RawGetString("vars").(*glua.LTable); ok {
+		vars.ForEach(func(k, v glua.LValue) {
+			if key, ok := k.(glua.LString); ok {
+				ctx.Vars[string(key)] = glua.LVAsString(v)
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package lua
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/balancer"
+	"github.com/onestraw/golb/config"
+)
+
+const script = `
+function on_request(ctx)
+  if ctx.req_header("X-Bucket") == "7" then
+    ctx.status, ctx.body = 403, "denied"
+    ctx.set_resp_header("X-Reason", "bucket")
+    return
+  end
+  if ctx.req_header("X-Bucket") == "2" then
+    ctx.upstream = upstream
+  end
+  ctx.set_req_header("X-Debug", nil)
+  ctx.vars.bucket = "b" .. ctx.req_header("X-Bucket")
+end
+
+function on_response(ctx)
+  ctx.set_resp_header("X-Bucket", ctx.vars.bucket .. " " .. ctx.vars.vs)
+  if ctx.status == 404 then
+    ctx.status = 410
+  end
+end
+`
+
+func scriptContext(r *http.Request) *balancer.ScriptContext {
+	return &balancer.ScriptContext{Request: r, Header: http.Header{}, Vars: map[string]string{"vs": "web"}}
+}
+
+func TestCompile(t *testing.T) {
+	_, err := Engine{}.Compile("bad.lua", []byte("function on_request("))
+	assert.Error(t, err)
+	_, err = Engine{}.Compile("fail.lua", []byte(`error("oops")`))
+	assert.Contains(t, err.Error(), "oops")
+	_, err = Engine{}.Compile("empty.lua", []byte("x = 1"))
+	assert.Contains(t, err.Error(), "defines neither on_request nor on_response")
+	_, err = Engine{}.Compile("io.lua", []byte(`io.open("/etc/passwd")`))
+	assert.Error(t, err)
+}
+
+func TestFilter(t *testing.T) {
+	f, err := Engine{}.Compile("ab.lua", []byte(`upstream = "127.0.0.1:10002"`+script))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Bucket", "1")
+	r.Header.Set("X-Debug", "1")
+	ctx := scriptContext(r)
+	require.NoError(t, f.OnRequest(ctx))
+	assert.Equal(t, 0, ctx.Status)
+	assert.Empty(t, ctx.Upstream)
+	assert.Empty(t, r.Header.Get("X-Debug"))
+	assert.Equal(t, "b1", ctx.Vars["bucket"])
+	ctx.Status = http.StatusNotFound
+	require.NoError(t, f.OnResponse(ctx))
+	assert.Equal(t, http.StatusGone, ctx.Status)
+	assert.Equal(t, "b1 web", ctx.Header.Get("X-Bucket"))
+
+	r.Header.Set("X-Bucket", "2")
+	ctx = scriptContext(r)
+	require.NoError(t, f.OnRequest(ctx))
+	assert.Equal(t, "127.0.0.1:10002", ctx.Upstream)
+
+	r.Header.Set("X-Bucket", "7")
+	ctx = scriptContext(r)
+	require.NoError(t, f.OnRequest(ctx))
+	assert.Equal(t, http.StatusForbidden, ctx.Status)
+	assert.Equal(t, "denied", string(ctx.Body))
+	assert.Equal(t, "bucket", ctx.Header.Get("X-Reason"))
+
+	f, err = Engine{}.Compile("loop.lua", []byte("function on_request(ctx) while true do end end"))
+	require.NoError(t, err)
+	assert.Error(t, f.OnRequest(scriptContext(r)))
+	// a state is not reused after an error
+	assert.Error(t, f.OnRequest(scriptContext(r)))
+	assert.NoError(t, f.OnResponse(scriptContext(r)))
+}
+
+func TestScripts(t *testing.T) {
+	balancer.RegisterScriptEngine(ENGINE, Engine{})
+	s1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("s1"))
+	}))
+	defer s1.Close()
+	s2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("s2"))
+	}))
+	defer s2.Close()
+
+	dir, err := ioutil.TempDir("", "golb-lua")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ab.lua")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`upstream = "`+s2.URL[7:]+`"`+script), 0644))
+
+	vs, err := balancer.NewVirtualServer(
+		balancer.NameOpt("web"),
+		balancer.AddressOpt("127.0.0.1:8124"),
+		balancer.PoolOpt([]config.Server{{Address: s1.URL[7:], Weight: 1}, {Address: s2.URL[7:], Weight: 1}}),
+		balancer.ScriptsOpt([]config.Script{{Engine: ENGINE, File: file}}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, vs.Run())
+	defer vs.Stop()
+
+	get := func(bucket string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:8124/", nil)
+		req.Host = "localhost"
+		req.Header.Set("X-Bucket", bucket)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	resp, _ := get("1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "b1 web", resp.Header.Get("X-Bucket"))
+	for i := 0; i < 4; i++ {
+		_, body := get("2")
+		assert.Equal(t, "s2", body)
+	}
+	resp, body := get("7")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "denied", body)
+}
@@ -0,0 +1,10 @@
+// package p2c provides power of two choices balancing
+//
+// two peers are picked at random, and the one with fewer requests in flight,
+// divided by its weight, gets the request. It needs no global ordering of the peers,
+// so it is cheap, and avoids the herd effect of always choosing the least loaded peer,
+// while its tail latency is much better than round-robin's under load
+//
+// The Power of Two Choices in Randomized Load Balancing, Michael Mitzenmacher
+// https://www.eecs.harvard.edu/~michaelm/postscripts/mythesis.pdf
+package p2c
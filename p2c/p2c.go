@@ -0,0 +1,214 @@
+package p2c
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Peer represents a backend server
+type Peer struct {
+	addr   string
+	weight int
+	down   bool
+	// only used when all the primary peers are down
+	backup bool
+	// requests in flight, updated atomically
+	active int64
+}
+
+// Pool is a group of Peers, one Peer can not belong to multiple Pool.
+// Get only takes the read lock, the requests in flight are counted atomically
+type Pool struct {
+	sync.RWMutex
+	peers []*Peer
+}
+
+func New() *Pool {
+	return &Pool{}
+}
+
+func CreatePool(pairs map[string]int) *Pool {
+	pool := New()
+	for addr, weight := range pairs {
+		pool.Add(addr, weight)
+	}
+	return pool
+}
+
+func (p *Pool) String() string {
+	p.RLock()
+	defer p.RUnlock()
+	result := []string{}
+	for _, peer := range p.peers {
+		if peer.backup {
+			result = append(result, peer.addr+" (backup)")
+		} else {
+			result = append(result, peer.addr)
+		}
+	}
+	sort.Strings(result)
+	return strings.Join(result, ", ")
+}
+
+func (p *Pool) Size() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.peers)
+}
+
+// Peers returns the sorted addresses of the peers, including the backup peers
+func (p *Pool) Peers() []string {
+	p.RLock()
+	defer p.RUnlock()
+	result := make([]string, 0, len(p.peers))
+	for _, peer := range p.peers {
+		result = append(result, peer.addr)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// find returns the peer of addr, nil if not found, the lock should be held
+func (p *Pool) find(addr string) *Peer {
+	for _, peer := range p.peers {
+		if peer.addr == addr {
+			return peer
+		}
+	}
+	return nil
+}
+
+// Add adds a peer, args are the weight (default 1) and whether it is a backup
+func (p *Pool) Add(addr string, args ...interface{}) {
+	if addr == "" {
+		return
+	}
+	peer := &Peer{addr: addr, weight: 1}
+	if len(args) > 0 {
+		if w, ok := args[0].(int); ok && w > 0 {
+			peer.weight = w
+		}
+	}
+	if len(args) > 1 {
+		peer.backup, _ = args[1].(bool)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.find(addr) != nil {
+		return
+	}
+	p.peers = append(p.peers, peer)
+}
+
+func (p *Pool) Remove(addr string) {
+	p.Lock()
+	defer p.Unlock()
+	for i, peer := range p.peers {
+		if peer.addr == addr {
+			p.peers = append(p.peers[:i], p.peers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *Pool) setPeerStatus(addr string, isDown bool) {
+	p.Lock()
+	defer p.Unlock()
+	if peer := p.find(addr); peer != nil {
+		peer.down = isDown
+	}
+}
+
+func (p *Pool) DownPeer(addr string) {
+	p.setPeerStatus(addr, true)
+}
+
+func (p *Pool) UpPeer(addr string) {
+	p.setPeerStatus(addr, false)
+}
+
+// SetWeight changes the weight of peer, weight <= 0 is ignored
+func (p *Pool) SetWeight(addr string, weight int) {
+	if weight <= 0 {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if peer := p.find(addr); peer != nil {
+		peer.weight = weight
+	}
+}
+
+// less returns true if a is less loaded than b for its weight
+func less(a, b *Peer) bool {
+	return atomic.LoadInt64(&a.active)*int64(b.weight) < atomic.LoadInt64(&b.active)*int64(a.weight)
+}
+
+// Get returns the less loaded of two random peers,
+// the backup peers are used only if all the primary peers are down
+func (p *Pool) Get(args ...interface{}) string {
+	p.RLock()
+	defer p.RUnlock()
+
+	if peer := p.get(false); peer != "" {
+		return peer
+	}
+	return p.get(true)
+}
+
+func (p *Pool) get(backup bool) string {
+	candidates := make([]*Peer, 0, len(p.peers))
+	for _, peer := range p.peers {
+		if !peer.down && peer.backup == backup {
+			candidates = append(candidates, peer)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return ""
+	case 1:
+		return candidates[0].addr
+	}
+	// the global source is safe for concurrent use
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if less(candidates[j], candidates[i]) {
+		i = j
+	}
+	return candidates[i].addr
+}
+
+// Acquire counts a request in flight to peer, it should be released by Release
+func (p *Pool) Acquire(addr string) {
+	p.RLock()
+	defer p.RUnlock()
+	if peer := p.find(addr); peer != nil {
+		atomic.AddInt64(&peer.active, 1)
+	}
+}
+
+// Release ends a request to peer
+func (p *Pool) Release(addr string) {
+	p.RLock()
+	defer p.RUnlock()
+	if peer := p.find(addr); peer != nil && atomic.AddInt64(&peer.active, -1) < 0 {
+		atomic.StoreInt64(&peer.active, 0)
+	}
+}
+
+// Active returns the requests in flight to peer
+func (p *Pool) Active(addr string) int {
+	p.RLock()
+	defer p.RUnlock()
+	if peer := p.find(addr); peer != nil {
+		return int(atomic.LoadInt64(&peer.active))
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+package p2c
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetP2C(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1})
+	assert.Equal(t, "a, b", pool.String())
+	assert.Equal(t, 2, pool.Size())
+
+	// the two peers are always compared
+	pool.Acquire("a")
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "b", pool.Get())
+	}
+	pool.Acquire("b")
+	pool.Acquire("b")
+	assert.Equal(t, "a", pool.Get())
+	assert.Equal(t, 2, pool.Active("b"))
+
+	// twice the weight, half the load
+	pool.SetWeight("b", 4)
+	assert.Equal(t, "b", pool.Get())
+
+	pool.DownPeer("b")
+	assert.Equal(t, "a", pool.Get())
+	pool.UpPeer("b")
+
+	pool.Release("a")
+	pool.Release("a")
+	assert.Equal(t, 0, pool.Active("a"))
+}
+
+func TestLeastLoaded(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1, "c": 1})
+	for i := 0; i < 5; i++ {
+		pool.Acquire("a")
+	}
+	// the most loaded peer loses every comparison
+	for i := 0; i < 100; i++ {
+		assert.NotEqual(t, "a", pool.Get())
+	}
+}
+
+func TestBackup(t *testing.T) {
+	pool := New()
+	pool.Add("a", 1)
+	pool.Add("b", 1, true)
+	assert.Equal(t, "a, b (backup)", pool.String())
+	assert.Equal(t, "a", pool.Get())
+	pool.DownPeer("a")
+	assert.Equal(t, "b", pool.Get())
+	pool.Remove("b")
+	assert.Equal(t, "", pool.Get())
+}
+
+func TestConcurrent(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 2, "c": 3})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				peer := pool.Get()
+				pool.Acquire(peer)
+				pool.Release(peer)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, peer := range pool.Peers() {
+		assert.Equal(t, 0, pool.Active(peer))
+	}
+}
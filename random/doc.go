@@ -0,0 +1,6 @@
+// package random provides weighted random balancing
+//
+// a peer is chosen at random with a probability proportional to its weight.
+// Get only takes a read lock and shares no state between the requests, so it scales
+// to very high request rates, where the mutex of round-robin becomes a hotspot
+package random
@@ -0,0 +1,176 @@
+package random
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Peer represents a backend server
+type Peer struct {
+	addr   string
+	weight int
+	down   bool
+	// only used when all the primary peers are down
+	backup bool
+}
+
+// Pool is a group of Peers, one Peer can not belong to multiple Pool
+type Pool struct {
+	sync.RWMutex
+	peers []*Peer
+}
+
+func New() *Pool {
+	return &Pool{}
+}
+
+func CreatePool(pairs map[string]int) *Pool {
+	pool := New()
+	for addr, weight := range pairs {
+		pool.Add(addr, weight)
+	}
+	return pool
+}
+
+func (p *Pool) String() string {
+	p.RLock()
+	defer p.RUnlock()
+	result := []string{}
+	for _, peer := range p.peers {
+		if peer.backup {
+			result = append(result, peer.addr+" (backup)")
+		} else {
+			result = append(result, peer.addr)
+		}
+	}
+	sort.Strings(result)
+	return strings.Join(result, ", ")
+}
+
+func (p *Pool) Size() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.peers)
+}
+
+// Peers returns the sorted addresses of the peers, including the backup peers
+func (p *Pool) Peers() []string {
+	p.RLock()
+	defer p.RUnlock()
+	result := make([]string, 0, len(p.peers))
+	for _, peer := range p.peers {
+		result = append(result, peer.addr)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// find returns the peer of addr, nil if not found, the lock should be held
+func (p *Pool) find(addr string) *Peer {
+	for _, peer := range p.peers {
+		if peer.addr == addr {
+			return peer
+		}
+	}
+	return nil
+}
+
+// Add adds a peer, args are the weight (default 1) and whether it is a backup
+func (p *Pool) Add(addr string, args ...interface{}) {
+	if addr == "" {
+		return
+	}
+	peer := &Peer{addr: addr, weight: 1}
+	if len(args) > 0 {
+		if w, ok := args[0].(int); ok && w > 0 {
+			peer.weight = w
+		}
+	}
+	if len(args) > 1 {
+		peer.backup, _ = args[1].(bool)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.find(addr) != nil {
+		return
+	}
+	p.peers = append(p.peers, peer)
+}
+
+func (p *Pool) Remove(addr string) {
+	p.Lock()
+	defer p.Unlock()
+	for i, peer := range p.peers {
+		if peer.addr == addr {
+			p.peers = append(p.peers[:i], p.peers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *Pool) setPeerStatus(addr string, isDown bool) {
+	p.Lock()
+	defer p.Unlock()
+	if peer := p.find(addr); peer != nil {
+		peer.down = isDown
+	}
+}
+
+func (p *Pool) DownPeer(addr string) {
+	p.setPeerStatus(addr, true)
+}
+
+func (p *Pool) UpPeer(addr string) {
+	p.setPeerStatus(addr, false)
+}
+
+// SetWeight changes the weight of peer, weight <= 0 is ignored
+func (p *Pool) SetWeight(addr string, weight int) {
+	if weight <= 0 {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if peer := p.find(addr); peer != nil {
+		peer.weight = weight
+	}
+}
+
+// Get returns a random peer weighted by weight,
+// the backup peers are used only if all the primary peers are down
+func (p *Pool) Get(args ...interface{}) string {
+	p.RLock()
+	defer p.RUnlock()
+
+	if peer := p.get(false); peer != "" {
+		return peer
+	}
+	return p.get(true)
+}
+
+func (p *Pool) get(backup bool) string {
+	total := 0
+	for _, peer := range p.peers {
+		if !peer.down && peer.backup == backup {
+			total += peer.weight
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	// the global source is safe for concurrent use
+	n := rand.Intn(total)
+	for _, peer := range p.peers {
+		if peer.down || peer.backup != backup {
+			continue
+		}
+		if n < peer.weight {
+			return peer.addr
+		}
+		n -= peer.weight
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+package random
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRandom(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 3})
+	assert.Equal(t, "a, b", pool.String())
+	assert.Equal(t, 2, pool.Size())
+
+	result := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		result[pool.Get()]++
+	}
+	assert.InDelta(t, 1000, result["a"], 200, "%v", result)
+	assert.InDelta(t, 3000, result["b"], 200, "%v", result)
+
+	pool.DownPeer("b")
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "a", pool.Get())
+	}
+	pool.UpPeer("b")
+
+	pool.SetWeight("a", 3)
+	pool.SetWeight("b", 0)
+	result = map[string]int{}
+	for i := 0; i < 4000; i++ {
+		result[pool.Get()]++
+	}
+	assert.InDelta(t, 2000, result["a"], 300, "%v", result)
+}
+
+func TestBackup(t *testing.T) {
+	pool := New()
+	pool.Add("a", 1)
+	pool.Add("b", 1, true)
+	assert.Equal(t, "a, b (backup)", pool.String())
+	assert.Equal(t, "a", pool.Get())
+	pool.DownPeer("a")
+	assert.Equal(t, "b", pool.Get())
+	pool.Remove("b")
+	assert.Equal(t, "", pool.Get())
+	assert.Equal(t, []string{"a"}, pool.Peers())
+}
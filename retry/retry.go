@@ -1,10 +1,10 @@
 package retry
 
 import (
+	"bufio"
 	"bytes"
-	"fmt"
 	"io"
-	"io/ioutil"
+	"net"
 	"net/http"
 
 	log "github.com/sirupsen/logrus"
@@ -14,6 +14,8 @@ type WrapResponseWriter struct {
 	http.ResponseWriter
 	buffer *bytes.Buffer
 	code   int
+	// the connection is handed over, e.g. for a WebSocket, there is no response to write
+	hijacked bool
 }
 
 func NewWrapResponseWriter(w http.ResponseWriter) *WrapResponseWriter {
@@ -25,26 +27,39 @@ func NewWrapResponseWriter(w http.ResponseWriter) *WrapResponseWriter {
 }
 
 func (w *WrapResponseWriter) WriteHeader(statusCode int) {
-	for k := range w.ResponseWriter.Header() {
-		delete(w.ResponseWriter.Header(), k)
-	}
 	w.code = statusCode
 }
 
 func (w *WrapResponseWriter) Write(data []byte) (int, error) {
 	log.Debugf("Write %v, buffer %v", string(data), w.buffer)
-	w.buffer.Reset()
 	return w.buffer.Write(data)
 }
 
-func requestBody(r *http.Request) ([]byte, error) {
-	bodyBytes, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, fmt.Errorf("read request error:%v", err)
+// Hijack hands the connection over, the try is not retried
+func (w *WrapResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	c, brw, err := hj.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return c, brw, err
+}
+
+// reset drops the headers and the body of the failed try
+func (w *WrapResponseWriter) reset() {
+	for k := range w.ResponseWriter.Header() {
+		delete(w.ResponseWriter.Header(), k)
 	}
+	w.buffer.Reset()
+}
 
-	r.Body.Close()
-	return bodyBytes, nil
+// replayable reports whether the body of r can be sent again, i.e. it has none or
+// GetBody returns a new copy of it, e.g. a body buffered in memory or in a file
+func replayable(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
 }
 
 var TRY = 3
@@ -59,24 +74,37 @@ func shouldRetry(code int) bool {
 	return retryCode[code]
 }
 
+// Retry tries again the requests answered with a retryCode, up to TRY times. A request
+// whose body can not be replayed is sent once, its body is not read into memory
 func Retry(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		body, err := requestBody(r)
-		if err != nil {
-			log.Errorf("bufferRequestBody err= %v", err)
+		if !replayable(r) {
+			next.ServeHTTP(w, r)
+			return
 		}
 		ww := NewWrapResponseWriter(w)
 
 		var count = 1
 		for {
-			r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
 			next.ServeHTTP(ww, r)
 			log.Debugf("[Retry]%dth try request, response code %d", count, ww.code)
+			if ww.hijacked {
+				return
+			}
 			if !shouldRetry(ww.code) || count >= TRY {
 				break
 			}
+			if r.GetBody != nil {
+				body, err := r.GetBody()
+				if err != nil {
+					log.Errorf("[Retry] replay request body err= %v", err)
+					break
+				}
+				r.Body = body
+			}
 			count++
+			ww.reset()
 			// If WriteHeader has not yet been called, Write calls
 			// WriteHeader(http.StatusOK) before writing the data.
 			// So set default http.StatusOK before retry
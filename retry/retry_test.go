@@ -1,9 +1,12 @@
 package retry
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -38,6 +41,30 @@ func testProxyRetry(t *testing.T, status_code int) {
 	assert.Equal(t, respBody, RESPONSE)
 }
 
+func TestProxyRetryHeaders(t *testing.T) {
+	var count = 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count += 1
+		if count < TRY {
+			w.Header().Set("X-Failed", "true")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("failed"))
+			return
+		}
+		w.Header().Set("X-Served", "true")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("chunk1 "))
+		w.Write([]byte("chunk2"))
+	})
+
+	rr := httptest.NewRecorder()
+	Retry(handler).ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get("X-Served"))
+	assert.Empty(t, rr.Header().Get("X-Failed"))
+	assert.Equal(t, "chunk1 chunk2", rr.Body.String())
+}
+
 func TestProxyRetry500(t *testing.T) {
 	testProxyRetry(t, http.StatusInternalServerError)
 }
@@ -67,3 +94,71 @@ func TestProxyRetryFail(t *testing.T) {
 	res := rr.Result()
 	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
 }
+
+func TestProxyRetryBodyError(t *testing.T) {
+	errTooLarge := errors.New("too large")
+	var count = 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count += 1
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Equal(t, "0123", string(body))
+		if err == errTooLarge {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	req := httptest.NewRequest("POST", "/test", io.MultiReader(strings.NewReader("0123"), errReader{errTooLarge}))
+	rr := httptest.NewRecorder()
+	Retry(handler).ServeHTTP(rr, req)
+	// the next handler sees the error of the body, and is not retried
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Equal(t, 1, count)
+}
+
+// errReader fails every read with err
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestProxyRetryReplay(t *testing.T) {
+	var bodies []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) < TRY {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+
+	// http.NewRequest sets GetBody for a strings.Reader
+	req, err := http.NewRequest("POST", "/test", strings.NewReader("data"))
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	Retry(handler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []string{"data", "data", "data"}, bodies)
+}
+
+func TestProxyRetryNotReplayable(t *testing.T) {
+	body := ioutil.NopCloser(strings.NewReader("data"))
+	var count = 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count += 1
+		// the body is passed as is, not read first
+		assert.Equal(t, body, r.Body)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	req := httptest.NewRequest("POST", "/test", nil)
+	req.Body = body
+	rr := httptest.NewRecorder()
+	Retry(handler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, 1, count)
+}
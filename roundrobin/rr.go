@@ -6,8 +6,12 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// DEFAULT_FACTOR keeps the configured weight
+const DEFAULT_FACTOR = 100
+
 // Peer represents a backend server
 type Peer struct {
 	addr             string
@@ -15,6 +19,12 @@ type Peer struct {
 	effective_weight int
 	current_weight   int
 	down             bool
+	// only used when all the primary peers are down
+	backup bool
+	// when the peer was added or marked up, zero means warm
+	since time.Time
+	// percent the weight is scaled by, see SetFactor
+	factor int
 	sync.RWMutex
 }
 
@@ -32,6 +42,7 @@ func CreatePeer(addr string, weight int) *Peer {
 		effective_weight: weight,
 		current_weight:   0,
 		down:             false,
+		factor:           DEFAULT_FACTOR,
 	}
 }
 
@@ -40,6 +51,8 @@ type Pool struct {
 	peers   []*Peer
 	current uint64
 	downNum int
+	// the window to ramp up the new or recovered peers, 0 disables it
+	slowStart time.Duration
 	sync.RWMutex
 }
 
@@ -48,7 +61,11 @@ func (p *Pool) String() string {
 	defer p.RUnlock()
 	result := []string{}
 	for _, peer := range p.peers {
-		result = append(result, peer.addr)
+		if peer.backup {
+			result = append(result, peer.addr+" (backup)")
+		} else {
+			result = append(result, peer.addr)
+		}
 	}
 	sort.Strings(result)
 	return strings.Join(result, ", ")
@@ -58,6 +75,19 @@ func (p *Pool) Size() int {
 	return len(p.peers)
 }
 
+// Peers returns the sorted addresses of the peers, including the backup peers
+func (p *Pool) Peers() []string {
+	p.RLock()
+	defer p.RUnlock()
+	result := make([]string, 0, len(p.peers))
+	for _, peer := range p.peers {
+		result = append(result, peer.addr)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Add adds a peer, args are the weight (default 1) and whether it is a backup
 func (p *Pool) Add(addr string, args ...interface{}) {
 	if addr == "" {
 		return
@@ -72,10 +102,16 @@ func (p *Pool) Add(addr string, args ...interface{}) {
 		}
 	}
 	peer := CreatePeer(addr, weight)
+	if len(args) > 1 {
+		peer.backup, _ = args[1].(bool)
+	}
 
 	p.Lock()
 	defer p.Unlock()
 
+	if p.slowStart > 0 {
+		peer.since = time.Now()
+	}
 	if peer.down {
 		p.downNum += 1
 	}
@@ -108,6 +144,9 @@ func (p *Pool) setPeerStatus(addr string, isDown bool) {
 
 			peer.Lock()
 			peer.down = isDown
+			if !isDown && p.slowStart > 0 {
+				peer.since = time.Now()
+			}
 			peer.Unlock()
 		}
 	}
@@ -137,21 +176,104 @@ func (p *Pool) Remove(addr string) {
 	}
 }
 
-// GetPeer return peer in smooth weighted roundrobin method
+// SetSlowStart ramps the weight of the peers added or marked up afterwards
+// from 1 to their full weight over d, 0 disables it
+func (p *Pool) SetSlowStart(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.slowStart = d
+}
+
+// SetWeight changes the weight of peer, weight <= 0 is ignored
+func (p *Pool) SetWeight(addr string, weight int) {
+	if weight <= 0 {
+		return
+	}
+	p.RLock()
+	defer p.RUnlock()
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		peer := p.peers[idx]
+		peer.Lock()
+		peer.weight = weight
+		peer.effective_weight = weight
+		peer.Unlock()
+	}
+}
+
+// SetFactor scales the weight of peer by percent, e.g. 50 halves its share of the requests
+// relative to the peers of the same weight, percent <= 0 is ignored
+func (p *Pool) SetFactor(addr string, percent int) {
+	if percent <= 0 {
+		return
+	}
+	p.RLock()
+	defer p.RUnlock()
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		peer := p.peers[idx]
+		peer.Lock()
+		peer.factor = percent
+		peer.Unlock()
+	}
+}
+
+// Factor returns the percent the weight of peer is scaled by, 0 if peer is not found
+func (p *Pool) Factor(addr string) int {
+	p.RLock()
+	defer p.RUnlock()
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		peer := p.peers[idx]
+		peer.RLock()
+		defer peer.RUnlock()
+		return peer.factor
+	}
+	return 0
+}
+
+// rampWeight returns the effective weight of peer scaled down during slow start,
+// the peer lock should be held
+func (p *Pool) rampWeight(peer *Peer, now time.Time) int {
+	weight := peer.effective_weight
+	if p.slowStart <= 0 || peer.since.IsZero() {
+		return weight
+	}
+	elapsed := now.Sub(peer.since)
+	if elapsed >= p.slowStart {
+		peer.since = time.Time{}
+		return weight
+	}
+	weight = int(int64(weight) * int64(elapsed) / int64(p.slowStart))
+	if weight < 1 {
+		weight = 1
+	}
+	return weight
+}
+
+// GetPeer return peer in smooth weighted roundrobin method,
+// the backup peers are used only if all the primary peers are down
 func (p *Pool) Get(args ...interface{}) string {
 	p.RLock()
 	defer p.RUnlock()
 
+	if peer := p.get(false); peer != "" {
+		return peer
+	}
+	return p.get(true)
+}
+
+func (p *Pool) get(backup bool) string {
 	var best *Peer = nil
 	total := 0
+	now := time.Now()
 	for _, peer := range p.peers {
-		if peer.down {
+		if peer.down || peer.backup != backup {
 			continue
 		}
 		peer.Lock()
 
-		total += peer.effective_weight
-		peer.current_weight += peer.effective_weight
+		// the factors are percents, the weights of all the peers are scaled by 100 by default
+		weight := p.rampWeight(peer, now) * peer.factor
+		total += weight
+		peer.current_weight += weight
 
 		if peer.effective_weight < peer.weight {
 			peer.effective_weight += 1
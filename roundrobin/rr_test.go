@@ -3,6 +3,7 @@ package roundrobin
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -163,3 +164,81 @@ func TestDownPeer(t *testing.T) {
 	expected_order = ",,,,,"
 	testGetPeer(t, pool, 6, expected_order)
 }
+
+func TestSlowStart(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 4})
+	pool.SetSlowStart(time.Hour)
+	pool.Add("b", 4)
+
+	// b starts with weight 1
+	expected_order := "a,a,b,a,a,a,a,b,a,a"
+	testGetPeer(t, pool, 10, expected_order)
+
+	// b is warm after the window
+	pool.peers[1].since = time.Now().Add(-time.Hour)
+	pool.peers[1].current_weight, pool.peers[0].current_weight = 0, 0
+	expected_order = "a,b,a,b,a,b"
+	testGetPeer(t, pool, 6, expected_order)
+	assert.True(t, pool.peers[1].since.IsZero())
+
+	// halfway through the window after recovery
+	pool.DownPeer("b")
+	pool.UpPeer("b")
+	assert.False(t, pool.peers[1].since.IsZero())
+	pool.peers[1].since = time.Now().Add(-30 * time.Minute)
+	pool.peers[1].current_weight, pool.peers[0].current_weight = 0, 0
+	expected_order = "a,b,a,a,b,a"
+	testGetPeer(t, pool, 6, expected_order)
+}
+
+func TestFactor(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1})
+	pool.Add("b", 1)
+	assert.Equal(t, DEFAULT_FACTOR, pool.Factor("a"))
+	assert.Equal(t, 0, pool.Factor("c"))
+
+	pool.SetFactor("b", 50)
+	pool.SetFactor("a", 0)
+	assert.Equal(t, DEFAULT_FACTOR, pool.Factor("a"))
+	expected_order := "a,b,a,a,b,a"
+	testGetPeer(t, pool, 6, expected_order)
+
+	// the factor is dropped with the peer
+	pool.Remove("b")
+	pool.Add("b", 1)
+	assert.Equal(t, DEFAULT_FACTOR, pool.Factor("b"))
+}
+
+func TestSetWeight(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1})
+	pool.SetWeight("b", 2)
+	pool.SetWeight("a", 0)
+	pool.SetWeight("c", 2)
+	expected_order := "b,a,b,b,a,b"
+	testGetPeer(t, pool, 6, expected_order)
+}
+
+func TestBackup(t *testing.T) {
+	// add in order, the order of a map is random
+	pool := CreatePool(map[string]int{"a": 1})
+	pool.Add("b", 1)
+	pool.Add("c", 2, true)
+	pool.Add("d", 1, true)
+	assert.Equal(t, "a, b, c (backup), d (backup)", pool.String())
+	assert.Equal(t, []string{"a", "b", "c", "d"}, pool.Peers())
+
+	expected_order := "a,b,a,b"
+	testGetPeer(t, pool, 4, expected_order)
+
+	pool.DownPeer("a")
+	expected_order = "b,b,b"
+	testGetPeer(t, pool, 3, expected_order)
+
+	pool.DownPeer("b")
+	expected_order = "c,d,c,c,d,c"
+	testGetPeer(t, pool, 6, expected_order)
+
+	pool.UpPeer("a")
+	expected_order = "a,a"
+	testGetPeer(t, pool, 2, expected_order)
+}
@@ -1,9 +1,12 @@
 package service
 
 import (
+	"encoding/json"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -11,12 +14,29 @@ import (
 	"github.com/onestraw/golb/config"
 	"github.com/onestraw/golb/controller"
 	sd "github.com/onestraw/golb/discovery"
+	"github.com/onestraw/golb/dns"
+	"github.com/onestraw/golb/failover"
+	"github.com/onestraw/golb/logging"
 )
 
 type Service struct {
+	configFile string
+	config     *config.Configuration
 	discovery  *sd.ServiceDiscovery
 	controller *controller.Controller
 	balancer   *balancer.Balancer
+	// stops the guardrails, nil if not started
+	stopGuardrails func()
+	// nil if not in a cluster
+	cluster *balancer.Cluster
+	// nil if no floating IP failover
+	failover *failover.Node
+	// virtual servers of the configuration file, before the state file is merged
+	configured []config.VirtualServer
+	// stops saving the state file, nil if not started
+	stopState func()
+	// stops checkpointing the stats, nil if not started
+	stopStats func()
 }
 
 func New(configFile string) (*Service, error) {
@@ -24,42 +44,222 @@ func New(configFile string) (*Service, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := configureLog(c.Log); err != nil {
+		return nil, err
+	}
+	configured := c.VServers
+	if c.StateFile != "" {
+		st, err := config.LoadState(c.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		if st != nil {
+			log.Infof("Merging state %s: %d pools, %d added, %d removed virtual servers",
+				c.StateFile, len(st.Pools), len(st.Added), len(st.Removed))
+			c.MergeState(st)
+		}
+	}
+
+	var resolver *dns.Resolver
+	if dnsCfg := c.DNS; len(dnsCfg.Servers) > 0 {
+		resolver, err = dns.New(dns.ServersOpt(dnsCfg.Servers),
+			dns.ProtocolOpt(dnsCfg.Protocol),
+			dns.ServerNameOpt(dnsCfg.ServerName),
+			dns.TimeoutOpt(time.Duration(dnsCfg.Timeout)*time.Second))
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Using DNS resolver %s", resolver)
+	}
 
 	sdCfg := c.ServiceDiscovery
 	dis, err := sd.New(sd.TypeOpt(sdCfg.Type),
 		sd.ClusterOpt(sdCfg.Cluster),
 		sd.PrefixOpt(sdCfg.Prefix),
-		sd.SecurityOpt(sdCfg.CertFile, sdCfg.KeyFile, sdCfg.TrustedCAFile))
+		sd.SecurityOpt(sdCfg.CertFile, sdCfg.KeyFile, sdCfg.TrustedCAFile),
+		sd.TokenOpt(sdCfg.Token),
+		sd.IntervalOpt(time.Duration(sdCfg.Interval)*time.Second),
+		sd.ResolverOpt(resolver))
 	if err != nil {
 		log.Warnf("New ServiceDiscovery err=%v", err)
 	}
 
 	ctl := controller.New(&c.Controller)
-	b, err := balancer.New(c.VServers)
+	ctl.Config = c
+	ctl.Events = balancer.NewEventFeed()
+	opts := []balancer.VirtualServerOption{balancer.ResolverOpt(resolver),
+		balancer.EventHandlerOpt(ctl.Events.Handler())}
+	if c.Events.Webhook != "" {
+		opts = append(opts, balancer.EventHandlerOpt(
+			balancer.Webhook(c.Events.Webhook, time.Duration(c.Events.Timeout)*time.Second)))
+	}
+	b, err := balancer.New(c.VServers, opts...)
 	if err != nil {
 		return nil, err
 	}
+	if st := c.Stats; st.File != "" && !st.Fresh {
+		// fresh counters rather than no start
+		if err := b.LoadStats(st.File); err != nil {
+			log.Errorf("Load stats %s error=%v", st.File, err)
+		}
+	}
+
+	var node *failover.Node
+	if f := c.Failover; f.Address != "" {
+		node, err = failover.New(failover.AddressOpt(f.Address),
+			failover.PeersOpt(f.Peers),
+			failover.PriorityOpt(f.Priority),
+			failover.IntervalOpt(time.Duration(f.Interval)*time.Second),
+			failover.PreemptOpt(!f.NoPreempt),
+			failover.SecretOpt(f.Secret),
+			failover.HookOpt(failover.Script(failover.STATE_MASTER, f.NotifyMaster, f.VirtualIP),
+				failover.Script(failover.STATE_BACKUP, f.NotifyBackup, f.VirtualIP)))
+		if err != nil {
+			return nil, err
+		}
+		ctl.Failover = node
+	}
 
 	return &Service{
+		configFile: configFile,
+		config:     c,
 		discovery:  dis,
 		controller: ctl,
 		balancer:   b,
+		failover:   node,
+		configured: configured,
 	}, nil
 }
 
 func (s *Service) Run() error {
-	log.Infof("Starting...")
-	sigC := make(chan os.Signal)
-	signal.Notify(sigC, os.Interrupt, os.Kill, syscall.SIGTERM)
+	log.WithFields(log.Fields{
+		"config":          s.configFile,
+		"virtual_servers": len(s.balancer.VServers),
+		"discovery":       s.config.ServiceDiscovery.Type,
+		"controller":      s.config.Controller.Address,
+		"metrics":         s.config.Controller.Metrics.Address,
+		"dns":             strings.Join(s.config.DNS.Servers, ","),
+	}).Infof("Starting...")
+	if data, err := json.Marshal(s.balancer.EffectiveConfig(s.config)); err == nil {
+		log.Infof("Effective configuration %s", data)
+	}
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP)
 
 	s.discovery.Run(s.balancer)
 	s.controller.Run(s.balancer)
 	if err := s.balancer.Run(); err != nil {
 		return err
 	}
+	if s.config.StateFile != "" {
+		s.stopState = s.balancer.SaveState(s.config.StateFile, s.configured)
+	}
+	if st := s.config.Stats; st.File != "" {
+		s.stopStats = s.balancer.SaveStats(st.File, time.Duration(st.Interval)*time.Second)
+	}
+	if g := s.config.Guardrails; g.Soft != (config.ResourceLimits{}) || g.Hard != (config.ResourceLimits{}) {
+		handlers := []balancer.EventHandler{}
+		if s.config.Events.Webhook != "" {
+			handlers = append(handlers, balancer.Webhook(s.config.Events.Webhook,
+				time.Duration(s.config.Events.Timeout)*time.Second))
+		}
+		s.stopGuardrails = balancer.StartGuardrails(g, handlers...)
+	}
+	if c := s.config.Cluster; c.Node != "" {
+		if c.Auth.Username == "" {
+			c.Auth = s.config.Controller.Auth
+		}
+		cluster, err := s.balancer.StartCluster(c)
+		if err != nil {
+			return err
+		}
+		s.cluster = cluster
+	}
+	if balancer.Inherited() {
+		// serving on the listeners of the parent, which drains and exits
+		log.Infof("Upgraded, stopping parent process %d", os.Getppid())
+		if err := syscall.Kill(os.Getppid(), syscall.SIGTERM); err != nil {
+			log.Errorf("Stop parent process error=%v", err)
+		}
+	}
+	// elected once serving, after the parent released the address on upgrade
+	if s.failover != nil {
+		if err := s.failover.Run(); err != nil {
+			return err
+		}
+		log.Infof("Failover node %s", s.failover)
+	}
 
-	sig := <-sigC
-	log.Infof("Caught signal %v, exiting...", sig)
+	for {
+		sig := <-sigC
+		if sig == syscall.SIGUSR2 {
+			s.upgrade()
+			continue
+		}
+		if sig == syscall.SIGHUP {
+			s.reload()
+			continue
+		}
+		log.Infof("Caught signal %v, exiting...", sig)
+		if s.stopGuardrails != nil {
+			s.stopGuardrails()
+		}
+		if s.cluster != nil {
+			s.cluster.Stop()
+		}
+		if s.failover != nil {
+			// hands the virtual IP over before the listeners close
+			s.failover.Stop()
+		}
+		if s.stopState != nil {
+			s.stopState()
+		}
+		if s.stopStats != nil {
+			s.stopStats()
+		}
+		return s.balancer.Stop()
+	}
+}
+
+// reload applies the virtual servers of the configuration file again, see balancer.Reload
+func (s *Service) reload() {
+	c, err := config.Load(s.configFile)
+	if err != nil {
+		log.Errorf("Reload %s error=%v", s.configFile, err)
+		return
+	}
+	if err := configureLog(c.Log); err != nil {
+		log.Errorf("Reload %s log error=%v", s.configFile, err)
+	}
+	if _, err := s.balancer.Reload(c.VServers, c.Reload); err != nil {
+		log.Errorf("Reload %s error=%v", s.configFile, err)
+	}
+}
 
-	return s.balancer.Stop()
+// configureLog makes c the logging of the standard logger, see logging.Configure
+func configureLog(c config.Log) error {
+	h, err := logging.Configure(logging.LevelOpt(c.Level),
+		logging.FormatOpt(c.Format),
+		logging.OutputOpt(c.Output),
+		logging.ModulesOpt(c.Modules))
+	if err != nil {
+		return err
+	}
+	log.Debugf("Logging %s", h)
+	return nil
+}
+
+// upgrade starts a new process with the listeners, the new process stops
+// this one once it is serving, see balancer.Upgrade
+func (s *Service) upgrade() {
+	proc, err := balancer.Upgrade()
+	if err != nil {
+		log.Errorf("Upgrade error=%v", err)
+		return
+	}
+	go func() {
+		// keep serving if the new process fails to start
+		state, err := proc.Wait()
+		log.Warnf("Upgraded process %d exited, state=%v, err=%v", proc.Pid, state, err)
+	}()
 }
@@ -0,0 +1,146 @@
+package stats
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LatencyBuckets are the upper bounds (in milliseconds) of the latency histogram,
+// the last implicit bucket holds everything greater than the largest bound
+var LatencyBuckets = []uint64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// Histogram is a fixed-bucket latency distribution, it is not goroutine safe
+// and relies on the lock of Stats
+type Histogram struct {
+	Buckets []uint64
+	Count   uint64
+	Sum     uint64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{
+		Buckets: make([]uint64, len(LatencyBuckets)+1),
+	}
+}
+
+// Observe records a latency value in milliseconds
+func (h *Histogram) Observe(ms uint64) {
+	idx := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if ms <= bound {
+			idx = i
+			break
+		}
+	}
+	h.Buckets[idx] += 1
+	h.Count += 1
+	h.Sum += ms
+}
+
+// Quantile returns the upper bound of the bucket where the q-th quantile falls in,
+// q is in range (0, 1]. It returns 0 if there is no sample, or if the quantile is
+// beyond the largest bound (+Inf)
+func (h *Histogram) Quantile(q float64) uint64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	if rank == 0 {
+		rank = 1
+	}
+	var acc uint64
+	for i, n := range h.Buckets {
+		acc += n
+		if acc >= rank {
+			if i < len(LatencyBuckets) {
+				return LatencyBuckets[i]
+			}
+			break
+		}
+	}
+	return 0
+}
+
+// FormatQuantile formats a quantile of a histogram with samples, in milliseconds,
+// e.g. 250 or >10000 if it is beyond the largest bound
+func FormatQuantile(ms uint64) string {
+	if ms == 0 {
+		return fmt.Sprintf(">%d", LatencyBuckets[len(LatencyBuckets)-1])
+	}
+	return strconv.FormatUint(ms, 10)
+}
+
+var percentiles = []struct {
+	label string
+	q     float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p99", 0.99},
+}
+
+func (h *Histogram) String() string {
+	if h.Count == 0 {
+		return ""
+	}
+	result := []string{}
+	for _, p := range percentiles {
+		result = append(result, fmt.Sprintf("%s:%sms", p.label, FormatQuantile(h.Quantile(p.q))))
+	}
+	return strings.Join(result, ", ")
+}
+
+type Bucket struct {
+	// upper bound in milliseconds, 0 means +Inf
+	Le    uint64 `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// LatencyReport is a point-in-time copy of Histogram
+type LatencyReport struct {
+	Count uint64 `json:"count"`
+	SumMs uint64 `json:"sum_ms"`
+	// 0 means +Inf if count is not 0, the quantile is beyond the largest bucket
+	P50     uint64   `json:"p50_ms"`
+	P90     uint64   `json:"p90_ms"`
+	P99     uint64   `json:"p99_ms"`
+	Buckets []Bucket `json:"buckets"`
+}
+
+func (h *Histogram) Report() *LatencyReport {
+	r := &LatencyReport{
+		Count:   h.Count,
+		SumMs:   h.Sum,
+		P50:     h.Quantile(0.5),
+		P90:     h.Quantile(0.9),
+		P99:     h.Quantile(0.99),
+		Buckets: make([]Bucket, len(h.Buckets)),
+	}
+	for i, n := range h.Buckets {
+		var le uint64
+		if i < len(LatencyBuckets) {
+			le = LatencyBuckets[i]
+		}
+		r.Buckets[i] = Bucket{Le: le, Count: n}
+	}
+	return r
+}
+
+// Sub returns r - prev with the percentiles of the difference, prev may be nil
+func (r *LatencyReport) Sub(prev *LatencyReport) *LatencyReport {
+	h := NewHistogram()
+	h.Count = r.Count
+	h.Sum = r.SumMs
+	for i, b := range r.Buckets {
+		h.Buckets[i] = b.Count
+	}
+	if prev != nil {
+		h.Count -= prev.Count
+		h.Sum -= prev.SumMs
+		for i, b := range prev.Buckets {
+			h.Buckets[i] -= b.Count
+		}
+	}
+	return h.Report()
+}
@@ -0,0 +1,58 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// RATE_WINDOW is the seconds a Rate averages over
+const RATE_WINDOW = 10
+
+// Rate counts the events of the last RATE_WINDOW seconds, one bucket per second
+type Rate struct {
+	sync.Mutex
+	counts [RATE_WINDOW]uint64
+	// the second of every bucket
+	secs [RATE_WINDOW]int64
+}
+
+func NewRate() *Rate {
+	return &Rate{}
+}
+
+// Inc counts an event at now
+func (r *Rate) Inc(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	sec := now.Unix()
+	i := sec % RATE_WINDOW
+	if r.secs[i] != sec {
+		r.secs[i] = sec
+		r.counts[i] = 0
+	}
+	r.counts[i] += 1
+}
+
+// PerSecond returns the events per second of the RATE_WINDOW full seconds before now
+func (r *Rate) PerSecond(now time.Time) float64 {
+	r.Lock()
+	defer r.Unlock()
+
+	sec := now.Unix()
+	var sum uint64
+	for i, s := range r.secs {
+		if s < sec && s >= sec-RATE_WINDOW {
+			sum += r.counts[i]
+		}
+	}
+	return float64(sum) / RATE_WINDOW
+}
+
+// Reset clears the counts
+func (r *Rate) Reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.counts = [RATE_WINDOW]uint64{}
+	r.secs = [RATE_WINDOW]int64{}
+}
@@ -5,6 +5,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Stats struct {
@@ -14,6 +15,20 @@ type Stats struct {
 	Path       map[string]uint64
 	InBytes    uint64
 	OutBytes   uint64
+	Latency    *Histogram
+	// upstream connections opened and reused
+	NewConns    uint64
+	ReusedConns uint64
+	// TLS handshakes with the upstream, full or resuming a session
+	FullHandshakes    uint64
+	ResumedHandshakes uint64
+	// requests in progress, a gauge kept by Reset
+	Active int64
+	// requests canceled before the upstream responded, e.g. the losing attempts of the hedged requests
+	Canceled uint64
+
+	// taken by the last Delta() call
+	last *Report
 }
 
 func New() *Stats {
@@ -23,6 +38,7 @@ func New() *Stats {
 		Path:       map[string]uint64{},
 		InBytes:    0,
 		OutBytes:   0,
+		Latency:    NewHistogram(),
 	}
 }
 
@@ -32,6 +48,8 @@ type Data struct {
 	Path       string
 	InBytes    uint64
 	OutBytes   uint64
+	// upstream response time
+	Latency time.Duration
 }
 
 func (s *Stats) Inc(d *Data) {
@@ -43,6 +61,45 @@ func (s *Stats) Inc(d *Data) {
 	s.Path[d.Path] += 1
 	s.InBytes += d.InBytes
 	s.OutBytes += d.OutBytes
+	s.Latency.Observe(uint64(d.Latency / time.Millisecond))
+}
+
+// IncHandshake counts a TLS handshake with the upstream
+func (s *Stats) IncHandshake(resumed bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if resumed {
+		s.ResumedHandshakes += 1
+	} else {
+		s.FullHandshakes += 1
+	}
+}
+
+// IncActive adds delta to the requests in progress
+func (s *Stats) IncActive(delta int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.Active += delta
+}
+
+// IncCanceled counts a request canceled before the upstream responded
+func (s *Stats) IncCanceled() {
+	s.Lock()
+	defer s.Unlock()
+	s.Canceled += 1
+}
+
+// IncConn counts an upstream connection
+func (s *Stats) IncConn(reused bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if reused {
+		s.ReusedConns += 1
+	} else {
+		s.NewConns += 1
+	}
 }
 
 func sortedMapString(dict map[string]uint64) string {
@@ -66,6 +123,10 @@ const (
 	PATH     = "path"
 	INBYTES  = "recv_bytes"
 	OUTBYTES = "send_bytes"
+	LATENCY  = "latency"
+	CONNS    = "conns"
+	CANCELED = "canceled"
+	TLS      = "tls_handshakes"
 )
 
 func (s *Stats) String() string {
@@ -82,7 +143,197 @@ func (s *Stats) String() string {
 		toS(PATH, sortedMapString(s.Path)),
 		toS(INBYTES, s.InBytes),
 		toS(OUTBYTES, s.OutBytes),
+		toS(LATENCY, s.Latency),
+		toS(CONNS, fmt.Sprintf("new:%d, reused:%d", s.NewConns, s.ReusedConns)),
+	}
+	if s.FullHandshakes+s.ResumedHandshakes > 0 {
+		result = append(result, toS(TLS, fmt.Sprintf("full:%d, resumed:%d", s.FullHandshakes, s.ResumedHandshakes)))
+	}
+	if s.Canceled > 0 {
+		result = append(result, toS(CANCELED, s.Canceled))
 	}
 
 	return strings.Join(result, "\n")
 }
+
+// Report is a point-in-time copy of Stats, suitable for JSON encoding
+type Report struct {
+	StatusCode map[string]uint64 `json:"status_code"`
+	Method     map[string]uint64 `json:"method"`
+	Path       map[string]uint64 `json:"path"`
+	InBytes    uint64            `json:"recv_bytes"`
+	OutBytes   uint64            `json:"send_bytes"`
+	Latency    *LatencyReport    `json:"latency"`
+	// upstream connections, ReuseRate is the percent reused
+	NewConns    uint64  `json:"new_conns"`
+	ReusedConns uint64  `json:"reused_conns"`
+	ReuseRate   float64 `json:"reuse_rate"`
+	// TLS handshakes with the upstream
+	FullHandshakes    uint64 `json:"full_handshakes"`
+	ResumedHandshakes uint64 `json:"resumed_handshakes"`
+	// requests in progress when reported
+	Active int64 `json:"active"`
+	// requests canceled before the upstream responded
+	Canceled uint64 `json:"canceled"`
+}
+
+// reuseRate returns the percent of reused connections, 0 if there is none
+func reuseRate(newConns, reusedConns uint64) float64 {
+	if newConns+reusedConns == 0 {
+		return 0
+	}
+	return float64(reusedConns) * 100 / float64(newConns+reusedConns)
+}
+
+func copyMap(dict map[string]uint64) map[string]uint64 {
+	result := make(map[string]uint64, len(dict))
+	for k, v := range dict {
+		result[k] = v
+	}
+	return result
+}
+
+func (s *Stats) Report() *Report {
+	s.RLock()
+	defer s.RUnlock()
+	return s.report()
+}
+
+func (s *Stats) report() *Report {
+	return &Report{
+		StatusCode:  copyMap(s.StatusCode),
+		Method:      copyMap(s.Method),
+		Path:        copyMap(s.Path),
+		InBytes:     s.InBytes,
+		OutBytes:    s.OutBytes,
+		Latency:     s.Latency.Report(),
+		NewConns:    s.NewConns,
+		ReusedConns: s.ReusedConns,
+		ReuseRate:   reuseRate(s.NewConns, s.ReusedConns),
+
+		FullHandshakes:    s.FullHandshakes,
+		ResumedHandshakes: s.ResumedHandshakes,
+		Active:            s.Active,
+		Canceled:          s.Canceled,
+	}
+}
+
+// Count returns the number of the requests recorded
+func (s *Stats) Count() uint64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.Latency.Count
+}
+
+// Reset clears all the counters
+func (s *Stats) Reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.StatusCode = map[string]uint64{}
+	s.Method = map[string]uint64{}
+	s.Path = map[string]uint64{}
+	s.InBytes = 0
+	s.OutBytes = 0
+	s.Latency = NewHistogram()
+	s.NewConns = 0
+	s.ReusedConns = 0
+	s.FullHandshakes = 0
+	s.ResumedHandshakes = 0
+	s.Canceled = 0
+	s.last = nil
+}
+
+// Restore adds the counters of r, e.g. saved before a restart, they are not
+// part of the next Delta()
+func (s *Stats) Restore(r *Report) {
+	s.Lock()
+	defer s.Unlock()
+
+	pending := s.report().Sub(s.last)
+	for k, v := range r.StatusCode {
+		s.StatusCode[k] += v
+	}
+	for k, v := range r.Method {
+		s.Method[k] += v
+	}
+	for k, v := range r.Path {
+		s.Path[k] += v
+	}
+	s.InBytes += r.InBytes
+	s.OutBytes += r.OutBytes
+	if l := r.Latency; l != nil && len(l.Buckets) == len(s.Latency.Buckets) {
+		s.Latency.Count += l.Count
+		s.Latency.Sum += l.SumMs
+		for i, b := range l.Buckets {
+			s.Latency.Buckets[i] += b.Count
+		}
+	}
+	s.NewConns += r.NewConns
+	s.ReusedConns += r.ReusedConns
+	s.FullHandshakes += r.FullHandshakes
+	s.ResumedHandshakes += r.ResumedHandshakes
+	s.Canceled += r.Canceled
+	s.last = s.report().Sub(pending)
+}
+
+// Delta returns the increments since the last Delta() call,
+// the first call returns the increments since creation or Reset()
+func (s *Stats) Delta() *Report {
+	s.Lock()
+	defer s.Unlock()
+
+	cur := s.report()
+	delta := cur.Sub(s.last)
+	s.last = cur
+	return delta
+}
+
+func subMap(cur, prev map[string]uint64) map[string]uint64 {
+	result := map[string]uint64{}
+	for k, v := range cur {
+		if d := v - prev[k]; d > 0 {
+			result[k] = d
+		}
+	}
+	return result
+}
+
+// Sub returns r - prev, prev may be nil
+func (r *Report) Sub(prev *Report) *Report {
+	if prev == nil {
+		prev = &Report{Latency: &LatencyReport{}}
+	}
+	return &Report{
+		StatusCode:  subMap(r.StatusCode, prev.StatusCode),
+		Method:      subMap(r.Method, prev.Method),
+		Path:        subMap(r.Path, prev.Path),
+		InBytes:     r.InBytes - prev.InBytes,
+		OutBytes:    r.OutBytes - prev.OutBytes,
+		Latency:     r.Latency.Sub(prev.Latency),
+		NewConns:    r.NewConns - prev.NewConns,
+		ReusedConns: r.ReusedConns - prev.ReusedConns,
+		ReuseRate:   reuseRate(r.NewConns-prev.NewConns, r.ReusedConns-prev.ReusedConns),
+
+		FullHandshakes:    r.FullHandshakes - prev.FullHandshakes,
+		ResumedHandshakes: r.ResumedHandshakes - prev.ResumedHandshakes,
+		Active:            r.Active,
+		Canceled:          r.Canceled - prev.Canceled,
+	}
+}
+
+// LatencyQuantile returns the q-th quantile of latency, false if there is no sample yet
+func (s *Stats) LatencyQuantile(q float64) (time.Duration, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.Latency.Count == 0 {
+		return 0, false
+	}
+	ms := s.Latency.Quantile(q)
+	if ms == 0 {
+		// beyond the largest bound, it is at least the bound
+		ms = LatencyBuckets[len(LatencyBuckets)-1]
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
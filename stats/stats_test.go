@@ -1,7 +1,9 @@
 package stats
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,6 +18,7 @@ func TestInc(t *testing.T) {
 	s.Inc(data)
 	assert.Equal(t, uint64(1), s.StatusCode[code])
 	assert.Equal(t, uint64(24), s.InBytes)
+	assert.Equal(t, uint64(1), s.Count())
 }
 
 func TestString(t *testing.T) {
@@ -28,6 +31,218 @@ func TestString(t *testing.T) {
 		OutBytes:   1024,
 	}
 	s.Inc(data)
-	expect := "status_code: 200:1\nmethod: GET:1\npath: /test:1\nrecv_bytes: 24\nsend_bytes: 1024"
+	expect := "status_code: 200:1\nmethod: GET:1\npath: /test:1\nrecv_bytes: 24\nsend_bytes: 1024\nlatency: p50:1ms, p90:1ms, p99:1ms\nconns: new:0, reused:0"
 	assert.Equal(t, expect, s.String())
 }
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram()
+	assert.Equal(t, uint64(0), h.Quantile(0.5))
+	assert.Equal(t, "", h.String())
+
+	for i := 0; i < 90; i++ {
+		h.Observe(3)
+	}
+	for i := 0; i < 9; i++ {
+		h.Observe(80)
+	}
+	h.Observe(20000)
+	assert.Equal(t, uint64(100), h.Count)
+	assert.Equal(t, uint64(5), h.Quantile(0.5))
+	assert.Equal(t, uint64(5), h.Quantile(0.9))
+	assert.Equal(t, uint64(100), h.Quantile(0.99))
+	// the overflow bucket is not reported as the largest bound
+	assert.Equal(t, uint64(0), h.Quantile(1))
+	assert.Equal(t, "p50:5ms, p90:5ms, p99:100ms", h.String())
+
+	h = NewHistogram()
+	h.Observe(20000)
+	assert.Equal(t, "p50:>10000ms, p90:>10000ms, p99:>10000ms", h.String())
+	assert.Equal(t, uint64(0), h.Report().P99)
+}
+
+func TestIncLatency(t *testing.T) {
+	s := New()
+	s.Inc(&Data{StatusCode: "200", Latency: 42 * time.Millisecond})
+	assert.Equal(t, uint64(1), s.Latency.Count)
+	assert.Equal(t, uint64(42), s.Latency.Sum)
+	assert.Equal(t, uint64(50), s.Latency.Quantile(0.5))
+}
+
+func TestReport(t *testing.T) {
+	s := New()
+	s.Inc(&Data{StatusCode: "200", Method: "GET", Path: "/", InBytes: 1, OutBytes: 2, Latency: 3 * time.Millisecond})
+	r := s.Report()
+	assert.Equal(t, map[string]uint64{"200": 1}, r.StatusCode)
+	assert.Equal(t, uint64(2), r.OutBytes)
+	assert.Equal(t, uint64(1), r.Latency.Count)
+	assert.Equal(t, uint64(5), r.Latency.P99)
+	assert.Equal(t, len(LatencyBuckets)+1, len(r.Latency.Buckets))
+
+	// report is a copy
+	s.Inc(&Data{StatusCode: "200"})
+	assert.Equal(t, uint64(1), r.StatusCode["200"])
+}
+
+func TestIncConn(t *testing.T) {
+	s := New()
+	s.IncConn(false)
+	for i := 0; i < 3; i++ {
+		s.IncConn(true)
+	}
+	r := s.Report()
+	assert.Equal(t, uint64(1), r.NewConns)
+	assert.Equal(t, uint64(3), r.ReusedConns)
+	assert.Equal(t, float64(75), r.ReuseRate)
+
+	s.Delta()
+	s.IncConn(true)
+	d := s.Delta()
+	assert.Equal(t, uint64(0), d.NewConns)
+	assert.Equal(t, float64(100), d.ReuseRate)
+
+	s.Reset()
+	assert.Equal(t, float64(0), s.Report().ReuseRate)
+}
+
+func TestIncHandshake(t *testing.T) {
+	s := New()
+	assert.NotContains(t, s.String(), TLS)
+	s.IncHandshake(false)
+	s.IncHandshake(true)
+	s.IncHandshake(true)
+	r := s.Report()
+	assert.Equal(t, uint64(1), r.FullHandshakes)
+	assert.Equal(t, uint64(2), r.ResumedHandshakes)
+	assert.Contains(t, s.String(), "tls_handshakes: full:1, resumed:2")
+
+	s.Delta()
+	s.IncHandshake(false)
+	d := s.Delta()
+	assert.Equal(t, uint64(1), d.FullHandshakes)
+	assert.Equal(t, uint64(0), d.ResumedHandshakes)
+}
+
+func TestIncCanceled(t *testing.T) {
+	s := New()
+	assert.NotContains(t, s.String(), CANCELED)
+	s.IncCanceled()
+	s.IncCanceled()
+	assert.Equal(t, uint64(2), s.Report().Canceled)
+	assert.Contains(t, s.String(), "canceled: 2")
+
+	s.Delta()
+	s.IncCanceled()
+	assert.Equal(t, uint64(1), s.Delta().Canceled)
+	s.Reset()
+	assert.Equal(t, uint64(0), s.Report().Canceled)
+}
+
+func TestResetAndDelta(t *testing.T) {
+	s := New()
+	data := &Data{StatusCode: "200", Method: "GET", Path: "/", InBytes: 1, OutBytes: 10, Latency: 3 * time.Millisecond}
+	s.Inc(data)
+	s.Inc(data)
+
+	d := s.Delta()
+	assert.Equal(t, uint64(2), d.StatusCode["200"])
+	assert.Equal(t, uint64(20), d.OutBytes)
+	assert.Equal(t, uint64(2), d.Latency.Count)
+
+	s.Inc(&Data{StatusCode: "500", Method: "GET", Path: "/", Latency: 300 * time.Millisecond})
+	d = s.Delta()
+	assert.Equal(t, map[string]uint64{"500": 1}, d.StatusCode)
+	assert.Equal(t, uint64(0), d.OutBytes)
+	assert.Equal(t, uint64(1), d.Latency.Count)
+	assert.Equal(t, uint64(500), d.Latency.P50)
+
+	d = s.Delta()
+	assert.Equal(t, 0, len(d.StatusCode))
+	assert.Equal(t, uint64(0), d.Latency.Count)
+
+	s.Reset()
+	r := s.Report()
+	assert.Equal(t, 0, len(r.StatusCode))
+	assert.Equal(t, uint64(0), r.InBytes)
+	assert.Equal(t, uint64(0), r.Latency.Count)
+
+	s.Inc(data)
+	assert.Equal(t, uint64(1), s.Delta().StatusCode["200"])
+}
+
+func TestIncActive(t *testing.T) {
+	s := New()
+	s.IncActive(1)
+	s.IncActive(1)
+	s.IncActive(-1)
+	assert.Equal(t, int64(1), s.Report().Active)
+
+	// a gauge, not an increment
+	assert.Equal(t, int64(1), s.Delta().Active)
+	s.Reset()
+	assert.Equal(t, int64(1), s.Report().Active)
+}
+
+func TestRestore(t *testing.T) {
+	s := New()
+	s.Inc(&Data{StatusCode: "200", Method: "GET", Path: "/", OutBytes: 10, Latency: 3 * time.Millisecond})
+	saved := s.Report()
+
+	s = New()
+	s.Inc(&Data{StatusCode: "500", Method: "GET", Path: "/", OutBytes: 5, Latency: time.Millisecond})
+	s.Restore(saved)
+	assert.Equal(t, map[string]uint64{"200": 1, "500": 1}, s.StatusCode)
+	assert.Equal(t, uint64(2), s.Method["GET"])
+	assert.Equal(t, uint64(15), s.OutBytes)
+	assert.Equal(t, uint64(2), s.Count())
+	assert.Equal(t, uint64(4), s.Latency.Sum)
+
+	// the restored counters are not increments
+	delta := s.Delta()
+	assert.Equal(t, map[string]uint64{"500": 1}, delta.StatusCode)
+	assert.Equal(t, uint64(5), delta.OutBytes)
+	assert.Equal(t, uint64(1), delta.Latency.Count)
+}
+
+func TestSubnet(t *testing.T) {
+	assert.Equal(t, "10.1.2.0/24", Subnet("10.1.2.3:5678"))
+	assert.Equal(t, "10.1.2.0/24", Subnet("10.1.2.200"))
+	assert.Equal(t, "2001:db8:1::/48", Subnet("[2001:db8:1:2::1]:80"))
+	assert.Equal(t, OTHER_SUBNET, Subnet("pipe"))
+}
+
+func TestSubnetStats(t *testing.T) {
+	s := NewSubnetStats()
+	s.Inc("10.1.2.3:1000", 10, 100)
+	s.Inc("10.1.2.4:1000", 10, 100)
+	s.Inc("10.1.3.4:1000", 1, 1)
+	r := s.Report()
+	assert.Equal(t, 2, len(r))
+	assert.Equal(t, SubnetCounter{Requests: 2, InBytes: 20, OutBytes: 200}, r["10.1.2.0/24"])
+
+	for i := 0; i < MAX_SUBNETS; i++ {
+		s.Inc(fmt.Sprintf("172.%d.%d.1:80", i/256, i%256), 0, 0)
+	}
+	r = s.Report()
+	assert.Equal(t, MAX_SUBNETS+1, len(r))
+	assert.Equal(t, uint64(2), r[OTHER_SUBNET].Requests)
+
+	s.Reset()
+	assert.Equal(t, 0, len(s.Report()))
+}
+
+func TestRate(t *testing.T) {
+	r := NewRate()
+	now := time.Unix(1000, 0)
+	assert.Equal(t, float64(0), r.PerSecond(now))
+	for i := 0; i < 20; i++ {
+		r.Inc(now)
+	}
+	r.Inc(now.Add(time.Second))
+	// the current second is not full yet
+	assert.Equal(t, float64(0), r.PerSecond(now))
+	assert.Equal(t, float64(2), r.PerSecond(now.Add(time.Second)))
+	assert.Equal(t, 2.1, r.PerSecond(now.Add(2*time.Second)))
+	assert.Equal(t, 0.1, r.PerSecond(now.Add(11*time.Second)))
+	assert.Equal(t, float64(0), r.PerSecond(now.Add(12*time.Second)))
+}
@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	// clients are aggregated by these prefix lengths
+	SUBNET_V4_BITS = 24
+	SUBNET_V6_BITS = 48
+
+	// limit the number of subnets tracked, the others are aggregated to OTHER_SUBNET
+	MAX_SUBNETS  = 4096
+	OTHER_SUBNET = "other"
+)
+
+type SubnetCounter struct {
+	Requests uint64 `json:"requests"`
+	InBytes  uint64 `json:"recv_bytes"`
+	OutBytes uint64 `json:"send_bytes"`
+}
+
+// SubnetStats aggregates client traffic by source network
+type SubnetStats struct {
+	sync.RWMutex
+	subnets map[string]*SubnetCounter
+}
+
+func NewSubnetStats() *SubnetStats {
+	return &SubnetStats{
+		subnets: map[string]*SubnetCounter{},
+	}
+}
+
+// Subnet returns the network of a "host:port" or "host" address, e.g. "10.1.2.0/24"
+func Subnet(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return OTHER_SUBNET
+	}
+	var ipnet *net.IPNet
+	if v4 := ip.To4(); v4 != nil {
+		ipnet = &net.IPNet{IP: v4.Mask(net.CIDRMask(SUBNET_V4_BITS, 32)), Mask: net.CIDRMask(SUBNET_V4_BITS, 32)}
+	} else {
+		ipnet = &net.IPNet{IP: ip.Mask(net.CIDRMask(SUBNET_V6_BITS, 128)), Mask: net.CIDRMask(SUBNET_V6_BITS, 128)}
+	}
+	return ipnet.String()
+}
+
+func (s *SubnetStats) Inc(remoteAddr string, inBytes, outBytes uint64) {
+	subnet := Subnet(remoteAddr)
+
+	s.Lock()
+	defer s.Unlock()
+
+	c, ok := s.subnets[subnet]
+	if !ok {
+		if len(s.subnets) >= MAX_SUBNETS {
+			subnet = OTHER_SUBNET
+			c, ok = s.subnets[subnet]
+		}
+		if !ok {
+			c = &SubnetCounter{}
+			s.subnets[subnet] = c
+		}
+	}
+	c.Requests += 1
+	c.InBytes += inBytes
+	c.OutBytes += outBytes
+}
+
+func (s *SubnetStats) Report() map[string]SubnetCounter {
+	s.RLock()
+	defer s.RUnlock()
+
+	result := make(map[string]SubnetCounter, len(s.subnets))
+	for k, v := range s.subnets {
+		result[k] = *v
+	}
+	return result
+}
+
+func (s *SubnetStats) Reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.subnets = map[string]*SubnetCounter{}
+}
@@ -0,0 +1,7 @@
+// package waf provides a lightweight web application firewall
+//
+// the requests are matched against regular expression rules, the default ones catch
+// the common SQL injection and cross-site scripting patterns in the path, the query,
+// the headers sent by browsers and the body. It is a first line of defense against
+// the scanners and the noisy attacks, not a replacement for a full WAF ruleset
+package waf
@@ -0,0 +1,94 @@
+package waf
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Rule matches a malicious pattern
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// DefaultRules catch the common SQL injection and cross-site scripting patterns
+var DefaultRules = []Rule{
+	{"sqli-union", regexp.MustCompile(`(?i)\bunion\b[\s/*]+(all[\s/*]+)?select\b`)},
+	{"sqli-tautology", regexp.MustCompile(`(?i)(['"]\s*\bor\b\s*['"]?\w+['"]?\s*=|\bor\b\s+(\d+)\s*=\s*(\d+)\b)`)},
+	{"sqli-stacked", regexp.MustCompile(`(?i);\s*(drop|delete|insert|update|alter|truncate)\s+(table|from|into)?\b`)},
+	{"sqli-sleep", regexp.MustCompile(`(?i)\b(sleep|benchmark|pg_sleep|waitfor\s+delay)\s*[('"]`)},
+	{"xss-script", regexp.MustCompile(`(?i)<\s*/?\s*script\b`)},
+	{"xss-tag", regexp.MustCompile(`(?i)<\s*(iframe|object|embed|svg)\b`)},
+	{"xss-handler", regexp.MustCompile(`(?i)\bon(error|load|click|mouseover|focus|submit)\s*=`)},
+	{"xss-uri", regexp.MustCompile(`(?i)\b(javascript|vbscript)\s*:`)},
+}
+
+// headers inspected, the others are not controlled by the victims' browsers
+var inspectedHeaders = []string{"Cookie", "Referer", "User-Agent"}
+
+// Violation is the rule matched by a request, and where
+type Violation struct {
+	Rule string
+	// path, query, body or the name of the header
+	Location string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("rule %s matched in %s", v.Rule, v.Location)
+}
+
+// WAF checks the requests against its rules
+type WAF struct {
+	rules []Rule
+}
+
+// New returns a WAF with rules, the default ones if none
+func New(rules ...Rule) *WAF {
+	if len(rules) == 0 {
+		rules = DefaultRules
+	}
+	return &WAF{rules: rules}
+}
+
+// unescape decodes the percent-encoding, s is returned as is if malformed
+func unescape(s string) string {
+	if u, err := url.QueryUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+func (w *WAF) match(location, value string) error {
+	if value == "" {
+		return nil
+	}
+	for _, rule := range w.rules {
+		if rule.Pattern.MatchString(value) {
+			return &Violation{Rule: rule.Name, Location: location}
+		}
+	}
+	return nil
+}
+
+// Inspect returns a *Violation if r or body, the beginning of its body, matches a rule
+func (w *WAF) Inspect(r *http.Request, body []byte) error {
+	if err := w.match("path", unescape(r.URL.EscapedPath())); err != nil {
+		return err
+	}
+	if err := w.match("query", unescape(r.URL.RawQuery)); err != nil {
+		return err
+	}
+	for _, h := range inspectedHeaders {
+		if err := w.match(h, unescape(strings.Join(r.Header[h], " "))); err != nil {
+			return err
+		}
+	}
+	value := string(body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		value = unescape(value)
+	}
+	return w.match("body", value)
+}
@@ -0,0 +1,59 @@
+package waf
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspect(t *testing.T) {
+	w := New()
+	clean := []string{
+		"/",
+		"/search?q=union+station&order=price",
+		"/products/select?id=42",
+		"/docs?title=Dr.+Strangelove+or+How+I+Learned",
+	}
+	for _, target := range clean {
+		assert.NoError(t, w.Inspect(httptest.NewRequest("GET", target, nil), nil), target)
+	}
+
+	attacks := map[string]string{
+		"/item?id=1%20UNION%20ALL%20SELECT%20password%20FROM%20users": "sqli-union",
+		"/login?user=admin'%20or%20'1'='1":                            "sqli-tautology",
+		"/item?id=1%20or%201=1":                                       "sqli-tautology",
+		"/item?id=1;DROP%20TABLE%20users":                             "sqli-stacked",
+		"/item?id=1%20and%20sleep(5)":                                 "sqli-sleep",
+		"/comment?text=%3Cscript%3Ealert(1)%3C/script%3E":             "xss-script",
+		"/p?x=%3Cimg%20src=x%20onerror=alert(1)%3E":                   "xss-handler",
+		"/p?next=javascript:alert(1)":                                 "xss-uri",
+	}
+	for target, rule := range attacks {
+		err := w.Inspect(httptest.NewRequest("GET", target, nil), nil)
+		if assert.Error(t, err, target) {
+			assert.Equal(t, &Violation{Rule: rule, Location: "query"}, err, target)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "<script>alert(1)</script>")
+	assert.Equal(t, &Violation{Rule: "xss-script", Location: "User-Agent"}, w.Inspect(r, nil))
+	// not inspected
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Anything", "<script>")
+	assert.NoError(t, w.Inspect(r, nil))
+
+	body := "name=x&comment=%3Ciframe+src%3Devil%3E"
+	r = httptest.NewRequest("POST", "/comment", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err := w.Inspect(r, []byte(body))
+	assert.Equal(t, &Violation{Rule: "xss-tag", Location: "body"}, err)
+	assert.Equal(t, "rule xss-tag matched in body", err.Error())
+
+	custom := New(Rule{"no-admin", regexp.MustCompile(`^/admin`)})
+	assert.Error(t, custom.Inspect(httptest.NewRequest("GET", "/admin/users", nil), nil))
+	assert.NoError(t, custom.Inspect(httptest.NewRequest("GET", "/?q=%3Cscript%3E", nil), nil))
+}